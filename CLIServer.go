@@ -5,11 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"time"
 )
 
 func main() {
-	running := true
 	dataServer := server.New("localhost", 8888)
 	err := dataServer.Start()
 
@@ -18,19 +16,13 @@ func main() {
 		return
 	}
 
+	// Stop returns once the port is released, after commands in flight have been answered
 	defer dataServer.Stop()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, os.Kill)
-	go func() {
-		for sgl := range c {
-			fmt.Printf("Recieved signal %q, shutting down\n", sgl.String())
-			running = false
-		}
-	}()
 
-	for running {
-		time.Sleep(time.Second * 1)
-	}
+	sgl := <-c
+	fmt.Printf("Recieved signal %q, shutting down\n", sgl.String())
 }
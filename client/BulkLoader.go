@@ -0,0 +1,383 @@
+package client
+
+import (
+	"context"
+	"datastore/wire"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTooManyFailures is returned by BulkLoader.Load when the configured failure limit was reached
+var ErrTooManyFailures = errors.New("bulk load aborted after too many failures")
+
+// RecordIterator
+/**
+* Produces the records for a bulk load one at a time. A ttl of zero means the record has no expiration, and ok is false
+* once there are no more records.
+ */
+type RecordIterator func() (key string, value string, ttl time.Duration, ok bool)
+
+// BulkLoadProgress
+/**
+* Running totals of a bulk load. Duplicates are records skipped because the key already existed (ErrKeyExists),
+* Failed are records that could not be loaded because of any other error. The two never overlap.
+ */
+type BulkLoadProgress struct {
+	Succeeded  int
+	Failed     int
+	Duplicates int
+}
+
+// RecordError
+/**
+* A record that could not be loaded, with the key it was for and the error it failed with, which Unwrap returns so
+* errors.Is finds ErrKeyExists for a duplicate
+ */
+type RecordError struct {
+	Key string
+	Err error
+}
+
+func (e RecordError) Error() string {
+	return fmt.Sprintf("failed to load key %q: %s", e.Key, e.Err.Error())
+}
+
+func (e RecordError) Unwrap() error {
+	return e.Err
+}
+
+// BulkLoadResult
+/**
+* What a bulk load did: the totals of every record it processed, and the errors of the records that were not loaded in
+* the order they were found
+ */
+type BulkLoadResult struct {
+	BulkLoadProgress
+	// Errors holds the first errors encountered, up to the configured maximum
+	Errors []RecordError
+}
+
+// BulkLoader
+/**
+* Loads records into the server from a RecordIterator, such as CSVRecords or JSONLinesRecords, with several workers
+* each sending its records in batches through a Pipeline. A BulkLoader can run several loads, one after the other or at
+* once.
+ */
+type BulkLoader struct {
+	client           *Client
+	parallelism      int
+	batchSize        int
+	progressInterval int
+	onProgress       func(BulkLoadProgress)
+	maxErrors        int
+	abortAfter       int
+}
+
+type BulkLoaderOption func(*BulkLoader)
+
+// WithParallelism sets the number of worker goroutines loading records, defaults to 8
+func WithParallelism(workers int) BulkLoaderOption {
+	return func(b *BulkLoader) {
+		b.parallelism = workers
+	}
+}
+
+// WithBatchSize sets how many records a worker sends together through a Pipeline, defaults to 100
+func WithBatchSize(records int) BulkLoaderOption {
+	return func(b *BulkLoader) {
+		b.batchSize = records
+	}
+}
+
+// WithProgress calls onProgress with the running totals every time another interval records have been processed
+func WithProgress(interval int, onProgress func(BulkLoadProgress)) BulkLoaderOption {
+	return func(b *BulkLoader) {
+		b.progressInterval = interval
+		b.onProgress = onProgress
+	}
+}
+
+// WithMaxErrors bounds how many record errors are kept in the result, defaults to 100
+func WithMaxErrors(maxErrors int) BulkLoaderOption {
+	return func(b *BulkLoader) {
+		b.maxErrors = maxErrors
+	}
+}
+
+// WithAbortAfter stops the load once this many records have failed, duplicates are not counted, zero never aborts
+func WithAbortAfter(failures int) BulkLoaderOption {
+	return func(b *BulkLoader) {
+		b.abortAfter = failures
+	}
+}
+
+// NewBulkLoader
+/**
+* Create a BulkLoader inserting records through c, with 8 workers sending batches of 100 records unless opts say
+* otherwise
+ */
+func NewBulkLoader(c *Client, opts ...BulkLoaderOption) *BulkLoader {
+	loader := &BulkLoader{
+		client:      c,
+		parallelism: 8,
+		batchSize:   100,
+		maxErrors:   100,
+	}
+
+	for _, opt := range opts {
+		opt(loader)
+	}
+
+	if loader.parallelism < 1 {
+		loader.parallelism = 1
+	}
+	if loader.batchSize < 1 {
+		loader.batchSize = 1
+	}
+
+	return loader
+}
+
+type bulkRecord struct {
+	key   string
+	value string
+	ttl   time.Duration
+}
+
+// Load
+/**
+* Drain the iterator, inserting every record into the server using the configured number of workers, each sending a
+* batch of records at a time through a Pipeline
+*
+* Individual record failures do not stop the load, they are counted and collected into the result. The load stops
+* early when the context is cancelled, returning ctx.Err(), or when the abort threshold is reached, returning
+* ErrTooManyFailures. In both cases the result reflects the records processed before stopping.
+ */
+func (b *BulkLoader) Load(ctx context.Context, iterator RecordIterator) (BulkLoadResult, error) {
+	loadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var result BulkLoadResult
+	var resultMutex sync.Mutex
+	aborted := false
+	processed := 0
+
+	record := func(key string, err error) {
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+
+		switch {
+		case err == nil:
+			result.Succeeded++
+		case errors.Is(err, ErrKeyExists):
+			result.Duplicates++
+		default:
+			result.Failed++
+		}
+
+		if err != nil && len(result.Errors) < b.maxErrors {
+			result.Errors = append(result.Errors, RecordError{Key: key, Err: err})
+		}
+
+		if b.abortAfter > 0 && result.Failed >= b.abortAfter && !aborted {
+			aborted = true
+			cancel()
+		}
+
+		processed++
+		if b.onProgress != nil && b.progressInterval > 0 && processed%b.progressInterval == 0 {
+			b.onProgress(result.BulkLoadProgress)
+		}
+	}
+
+	// servers without inline TTLs are sent the records with one as Client.GetOrSetWithTTL sends them, see loadBatch
+	inlineTTL, err := b.client.primaryHas(wire.CapabilityInlineTTL)
+	inlineTTL = inlineTTL && err == nil
+
+	batches := make(chan []bulkRecord, b.parallelism)
+	var workers sync.WaitGroup
+	for i := 0; i < b.parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range batches {
+				if loadCtx.Err() != nil {
+					return
+				}
+				b.loadBatch(batch, inlineTTL, record)
+			}
+		}()
+	}
+
+	send := func(batch []bulkRecord) {
+		select {
+		case batches <- batch:
+		case <-loadCtx.Done():
+		}
+	}
+	batch := make([]bulkRecord, 0, b.batchSize)
+	for loadCtx.Err() == nil {
+		key, value, ttl, ok := iterator()
+		if !ok {
+			break
+		}
+
+		batch = append(batch, bulkRecord{key: key, value: value, ttl: ttl})
+		if len(batch) == b.batchSize {
+			send(batch)
+			batch = make([]bulkRecord, 0, b.batchSize)
+		}
+	}
+	if len(batch) > 0 && loadCtx.Err() == nil {
+		send(batch)
+	}
+	close(batches)
+	workers.Wait()
+
+	resultMutex.Lock()
+	defer resultMutex.Unlock()
+	if aborted {
+		return result, ErrTooManyFailures
+	}
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	return result, nil
+}
+
+// loadBatch
+/**
+* Send a batch of records through one Pipeline and record the outcome of each, inserting the records without a TTL and
+* sending a GETORSET for those with one, which gives the key its expiration in the same step by the server's clock and
+* leaves a key that already existed as it was. Servers without inline TTLs get Client.GetOrSetWithTTL for each record
+* with a TTL once the rest of the batch has been sent.
+ */
+func (b *BulkLoader) loadBatch(batch []bulkRecord, inlineTTL bool, record func(key string, err error)) {
+	pipeline := b.client.Pipeline()
+	outcomes := make([]func() error, len(batch))
+	for i, r := range batch {
+		switch {
+		case r.ttl <= 0:
+			inserted := pipeline.Insert(r.key, r.value)
+			outcomes[i] = func() error { return inserted.Err }
+		case inlineTTL:
+			set := pipeline.GetOrSetWithTTL(r.key, r.value, r.ttl)
+			outcomes[i] = func() error { return existedAsDuplicate(set.Existed, set.Err) }
+		default:
+			r := r
+			outcomes[i] = func() error {
+				_, existed, err := b.client.GetOrSetWithTTL(r.key, r.value, r.ttl)
+				return existedAsDuplicate(existed, err)
+			}
+		}
+	}
+
+	// a failed flush leaves its error on every record it did not get an answer for
+	pipeline.Flush()
+	for i, r := range batch {
+		record(r.key, outcomes[i]())
+	}
+}
+
+// existedAsDuplicate reports a GETORSET that found the key already there as ErrKeyExists, like an insert of it
+func existedAsDuplicate(existed bool, err error) error {
+	if err == nil && existed {
+		return ErrKeyExists
+	}
+	return err
+}
+
+// CSVRecords
+/**
+* Iterate records from CSV rows of key,value or key,value,ttl where ttl is a duration string such as "30s"
+*
+* Iteration stops at the end of the input or at the first malformed row, after which err reports what went wrong.
+ */
+func CSVRecords(reader io.Reader) (iterator RecordIterator, err func() error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	var iterationErr error
+
+	iterator = func() (string, string, time.Duration, bool) {
+		if iterationErr != nil {
+			return "", "", 0, false
+		}
+
+		row, readErr := csvReader.Read()
+		if readErr != nil {
+			if readErr != io.EOF {
+				iterationErr = readErr
+			}
+			return "", "", 0, false
+		}
+
+		if len(row) < 2 || len(row) > 3 {
+			iterationErr = errors.New(fmt.Sprintf("expected 2 or 3 columns in csv row but found %d: %v", len(row), row))
+			return "", "", 0, false
+		}
+
+		var ttl time.Duration
+		if len(row) == 3 && row[2] != "" {
+			ttl, readErr = time.ParseDuration(row[2])
+			if readErr != nil {
+				iterationErr = readErr
+				return "", "", 0, false
+			}
+		}
+
+		return row[0], row[1], ttl, true
+	}
+
+	return iterator, func() error { return iterationErr }
+}
+
+type jsonRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   string `json:"ttl"`
+}
+
+// JSONLinesRecords
+/**
+* Iterate records from JSON lines of the form {"key": "...", "value": "...", "ttl": "30s"} where ttl is optional
+*
+* Iteration stops at the end of the input or at the first malformed line, after which err reports what went wrong.
+ */
+func JSONLinesRecords(reader io.Reader) (iterator RecordIterator, err func() error) {
+	decoder := json.NewDecoder(reader)
+	var iterationErr error
+
+	iterator = func() (string, string, time.Duration, bool) {
+		if iterationErr != nil {
+			return "", "", 0, false
+		}
+
+		var line jsonRecord
+		decodeErr := decoder.Decode(&line)
+		if decodeErr != nil {
+			if decodeErr != io.EOF {
+				iterationErr = decodeErr
+			}
+			return "", "", 0, false
+		}
+
+		var ttl time.Duration
+		if line.TTL != "" {
+			ttl, decodeErr = time.ParseDuration(line.TTL)
+			if decodeErr != nil {
+				iterationErr = decodeErr
+				return "", "", 0, false
+			}
+		}
+
+		return line.Key, line.Value, ttl, true
+	}
+
+	return iterator, func() error { return iterationErr }
+}
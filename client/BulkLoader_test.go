@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"datastore/server"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkLoader(t *testing.T) {
+	runningServer := server.New("localhost", 0)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", runningServer.Port())
+
+	records := 100000
+	if testing.Short() {
+		records = 10000
+	}
+	next := 0
+	iterator := func() (string, string, time.Duration, bool) {
+		if next >= records {
+			return "", "", 0, false
+		}
+		next++
+		return fmt.Sprintf("bulk:%d", next), "abc123", 0, true
+	}
+
+	progressCalls := 0
+	loader := NewBulkLoader(&client, WithParallelism(8), WithProgress(10000, func(progress BulkLoadProgress) {
+		progressCalls++
+	}))
+
+	result, err := loader.Load(context.Background(), iterator)
+	if err != nil || result.Succeeded != records || result.Failed != 0 || len(result.Errors) != 0 {
+		t.Fatalf("Expected %d records to load but got %+v: %q", records, result.BulkLoadProgress, err)
+	}
+	if progressCalls != records/10000 {
+		t.Fatalf("Expected progress to be reported %d times but was %d", records/10000, progressCalls)
+	}
+
+	count, err := client.Count()
+	if err != nil || count != records {
+		t.Fatalf("Expected %d keys but found %d: %q", records, count, err)
+	}
+
+	// reloading keys that already exist should collect them as duplicates rather than aborting the load
+	duplicates, _ := CSVRecords(strings.NewReader(csvRows(1, 100)))
+	loader = NewBulkLoader(&client, WithParallelism(4), WithMaxErrors(10))
+	result, err = loader.Load(context.Background(), duplicates)
+	if err != nil || result.Succeeded != 0 || result.Duplicates != 100 || len(result.Errors) != 10 {
+		t.Fatalf("Expected 100 duplicates with 10 collected errors but got %+v with %d errors: %q", result.BulkLoadProgress, len(result.Errors), err)
+	}
+	if !errors.Is(result.Errors[0], ErrKeyExists) {
+		t.Fatalf("Expected collected errors to be duplicate key errors but was %q", result.Errors[0])
+	}
+
+	// duplicates are not failures, so they never abort the load
+	duplicates, _ = CSVRecords(strings.NewReader(csvRows(1, 100)))
+	loader = NewBulkLoader(&client, WithParallelism(1), WithBatchSize(10), WithAbortAfter(5))
+	result, err = loader.Load(context.Background(), duplicates)
+	if err != nil || result.Duplicates != 100 || result.Failed != 0 {
+		t.Fatalf("Expected 100 duplicates without aborting but got %+v: %q", result.BulkLoadProgress, err)
+	}
+
+	runningServer.SetProtectedPrefixes("bulk")
+	protected, _ := CSVRecords(strings.NewReader(csvRows(records+1, records+100)))
+	result, err = loader.Load(context.Background(), protected)
+	if err != ErrTooManyFailures || result.Failed < 5 || result.Failed >= 100 {
+		t.Fatalf("Expected the load to abort after 5 failures but got %+v: %q", result.BulkLoadProgress, err)
+	}
+	runningServer.SetProtectedPrefixes()
+
+	client.Truncate()
+}
+
+func TestBulkLoaderCancellation(t *testing.T) {
+	runningServer := server.New("localhost", 0)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", runningServer.Port())
+
+	next := 0
+	endless := func() (string, string, time.Duration, bool) {
+		next++
+		return fmt.Sprintf("endless:%d", next), "abc123", time.Minute, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	started := time.Now()
+	result, err := NewBulkLoader(&client).Load(ctx, endless)
+	if err != context.DeadlineExceeded || result.Succeeded == 0 {
+		t.Fatalf("Expected the load to be cancelled after loading some records but got %+v: %q", result.BulkLoadProgress, err)
+	}
+	if time.Since(started) > time.Second {
+		t.Fatalf("Expected workers to stop promptly after cancellation but took %s", time.Since(started))
+	}
+
+	client.Truncate()
+}
+
+func TestBulkLoaderExpiresRecordsByTheServersClock(t *testing.T) {
+	// the server's clock runs an hour ahead of the client's
+	runningServer := server.New("localhost", 0, server.WithLogger(nil), server.WithClock(func() time.Time {
+		return time.Now().Add(time.Hour)
+	}))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", runningServer.Port())
+	defer client.Close()
+	client.Insert("bulk:1", "old")
+
+	records, _ := CSVRecords(strings.NewReader("bulk:1,new,1m\nbulk:2,new,1m\n"))
+	result, err := NewBulkLoader(&client).Load(context.Background(), records)
+	if err != nil || result.Succeeded != 1 || result.Duplicates != 1 {
+		t.Fatalf("Expected one record loaded and one duplicate but got %+v: %q", result.BulkLoadProgress, err)
+	}
+
+	if value, present, err := client.Read("bulk:2"); err != nil || !present || value != "new" {
+		t.Fatalf("Expected the record to live a minute by the server's clock but found %q, %t: %q", value, present, err)
+	}
+	if _, expires, err := client.ReadExpiration("bulk:1"); err != nil || expires {
+		t.Fatalf("Expected the duplicate to keep having no expiration but found one: %q", err)
+	}
+}
+
+func TestRecordIterators(t *testing.T) {
+	csvIterator, csvErr := CSVRecords(strings.NewReader("a,1\nb,2,30s\n"))
+	key, value, ttl, ok := csvIterator()
+	if !ok || key != "a" || value != "1" || ttl != 0 {
+		t.Fatalf("Expected record a=1 but got %q=%q (%s)", key, value, ttl)
+	}
+	key, value, ttl, ok = csvIterator()
+	if !ok || key != "b" || value != "2" || ttl != time.Second*30 {
+		t.Fatalf("Expected record b=2 with ttl 30s but got %q=%q (%s)", key, value, ttl)
+	}
+	_, _, _, ok = csvIterator()
+	if ok || csvErr() != nil {
+		t.Fatalf("Expected csv iteration to finish cleanly: %q", csvErr())
+	}
+
+	csvIterator, csvErr = CSVRecords(strings.NewReader("a\n"))
+	_, _, _, ok = csvIterator()
+	if ok || csvErr() == nil {
+		t.Fatalf("Expected an error for a malformed csv row")
+	}
+
+	jsonIterator, jsonErr := JSONLinesRecords(strings.NewReader("{\"key\":\"a\",\"value\":\"1\"}\n{\"key\":\"b\",\"value\":\"2\",\"ttl\":\"1m\"}\n"))
+	key, value, ttl, ok = jsonIterator()
+	if !ok || key != "a" || value != "1" || ttl != 0 {
+		t.Fatalf("Expected record a=1 but got %q=%q (%s)", key, value, ttl)
+	}
+	key, value, ttl, ok = jsonIterator()
+	if !ok || key != "b" || value != "2" || ttl != time.Minute {
+		t.Fatalf("Expected record b=2 with ttl 1m but got %q=%q (%s)", key, value, ttl)
+	}
+	_, _, _, ok = jsonIterator()
+	if ok || jsonErr() != nil {
+		t.Fatalf("Expected json iteration to finish cleanly: %q", jsonErr())
+	}
+
+	jsonIterator, jsonErr = JSONLinesRecords(strings.NewReader("{not json"))
+	_, _, _, ok = jsonIterator()
+	if ok || jsonErr() == nil {
+		t.Fatalf("Expected an error for a malformed json line")
+	}
+}
+
+func csvRows(from int, to int) string {
+	var rows strings.Builder
+	for i := from; i <= to; i++ {
+		rows.WriteString(fmt.Sprintf("bulk:%d,def456\n", i))
+	}
+	return rows.String()
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"datastore/wire"
+	"errors"
+	"time"
+)
+
+// Capabilities is what a server announced about itself, see Client.Capabilities
+type Capabilities = wire.Capabilities
+
+// Capability is one thing a server announced it supports, see the wire.Capability constants
+type Capability = wire.Capability
+
+// announced returns what the endpoint answered to CAPABILITIES and whether it has been asked yet
+func (e *endpoint) announced() (Capabilities, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.capabilities == nil {
+		return Capabilities{}, false
+	}
+	return *e.capabilities, true
+}
+
+func (e *endpoint) announce(capabilities Capabilities) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.capabilities = &capabilities
+}
+
+// Capabilities
+/**
+* Ask the primary what it supports: the protocol version it speaks, its build, and flags for the features it has as
+* configured right now, see wire.Capabilities
+*
+* The client asks by itself on the first connection it dials to each endpoint, before AUTH, and adapts to the answer.
+* Calling Capabilities refreshes what the client knows about the primary, for servers whose configuration changed.
+* Servers predating CAPABILITIES answer with an error, and the client adapts to them as if they had no capabilities.
+ */
+func (c *Client) Capabilities() (Capabilities, error) {
+	return c.askCapabilities(c.primary())
+}
+
+func (c *Client) askCapabilities(e *endpoint) (Capabilities, error) {
+	capabilitiesCommand, err := c.wire.EncodeMessage(wire.CAPABILITIES)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	trace := c.newTrace()
+	start := time.Now()
+	responseCommand, responseMessage, err := c.sendTo(trace, e, capabilitiesCommand)
+	err, _ = unwrapUnsent(err)
+	trace.finish(wire.CAPABILITIES, start, err)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	err = c.recordCapabilities(e, responseCommand, responseMessage)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	if responseCommand == wire.ERR {
+		return Capabilities{}, c.wire.DecodeError(responseMessage)
+	}
+
+	capabilities, _ := e.announced()
+	return capabilities, nil
+}
+
+// discover asks a new connection to an endpoint that was never asked what it supports, see Client.Capabilities
+func (c *Client) discover(e *endpoint, pooled *pooledConnection) error {
+	if _, known := e.announced(); known {
+		return nil
+	}
+
+	capabilitiesCommand, err := c.wire.EncodeMessage(wire.CAPABILITIES)
+	if err != nil {
+		return err
+	}
+
+	responseCommand, responseMessage, _, err := c.roundTrip(pooled, capabilitiesCommand)
+	if err != nil {
+		return err
+	}
+
+	return c.recordCapabilities(e, responseCommand, responseMessage)
+}
+
+// recordCapabilities keeps the answer to CAPABILITIES on the endpoint, an ERR from a server predating it is kept as
+// no capabilities
+func (c *Client) recordCapabilities(e *endpoint, responseCommand wire.Command, responseMessage []byte) error {
+	switch responseCommand {
+	case wire.CAPABILITIES:
+		capabilities, err := c.wire.DecodeCapabilitiesResponse(responseMessage)
+		if err != nil {
+			return malformedResponse(err)
+		}
+		e.announce(capabilities)
+		return nil
+	case wire.ERR:
+		e.announce(Capabilities{Flags: []Capability{}})
+		return nil
+	default:
+		return unexpectedResponse(wire.CAPABILITIES, responseCommand)
+	}
+}
+
+// primaryHas reports whether the primary announced the capability, dialing a connection to it first when none was
+// dialed yet, which asks
+func (c *Client) primaryHas(flag Capability) (bool, error) {
+	e := c.primary()
+	capabilities, known := e.announced()
+	if !known {
+		pooled, err := c.dial(nil, e)
+		if err != nil {
+			return false, err
+		}
+		e.connections.put(pooled)
+		capabilities, _ = e.announced()
+	}
+	return capabilities.Has(flag), nil
+}
+
+// getOrSetThenExpire
+/**
+* GetOrSetWithTTL for servers without wire.CapabilityInlineTTL: GETORSET inserts the key without an expiration and an
+* EXPIRE gives it one after. Unlike the single write it stands in for this is not atomic, other clients can read the
+* key without its expiration in between, and the key keeps no expiration when the EXPIRE fails.
+ */
+func (c *Client) getOrSetThenExpire(key string, defaultValue string, ttl time.Duration) (string, bool, error) {
+	value, existed, err := c.getOrSet(key, defaultValue)
+	if err != nil || existed {
+		return value, existed, err
+	}
+
+	// a key deleted before it could be expired has nothing left to expire
+	_, err = c.Expire(key, time.Now().Add(ttl))
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return value, existed, err
+	}
+	return value, existed, nil
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"datastore/server"
+	"datastore/wire"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesFollowTheServer(t *testing.T) {
+	runningServer := server.New("localhost", 8943, server.WithAdminToken("secret"), server.WithProtectedPrefixes("system"))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8943, WithAuthToken("secret"))
+	capabilities, err := client.Capabilities()
+	if err != nil || capabilities.ProtocolVersion != wire.ProtocolVersion || capabilities.ServerVersion != server.Version {
+		t.Fatalf("Expected the versions of the server but got %+v: %q", capabilities, err)
+	}
+	for _, flag := range []Capability{wire.CapabilityAuth, wire.CapabilityProtectedPrefixes, wire.CapabilityInlineTTL, wire.CapabilityHashes} {
+		if !capabilities.Has(flag) {
+			t.Fatalf("Expected the server to announce %q but found %v", flag, capabilities.Flags)
+		}
+	}
+
+	// the server announces inline TTLs, so the value and its expiration are set in one write
+	if _, existed, err := client.GetOrSetWithTTL("session", "1", time.Hour); err != nil || existed {
+		t.Fatalf("Expected the key to be set but got %q", err)
+	}
+	if expiration, present, err := client.ReadExpiration("session"); err != nil || !present || time.Until(expiration) < time.Minute {
+		t.Fatalf("Expected the key to expire in an hour but found %s: %q", expiration, err)
+	}
+
+	runningServer.SetProtectedPrefixes()
+	capabilities, err = client.Capabilities()
+	if err != nil || capabilities.Has(wire.CapabilityProtectedPrefixes) || !capabilities.Has(wire.CapabilityAuth) {
+		t.Fatalf("Expected asking again to see the protected prefixes cleared but found %v: %q", capabilities.Flags, err)
+	}
+}
+
+// legacyServer is a Transport connecting to a server from before CAPABILITIES and inline TTLs, which only knows
+// GETORSET without a TTL and EXPIRE
+type legacyServer struct {
+	mutex    sync.Mutex
+	commands []wire.Command
+	ttls     []time.Duration
+}
+
+func (l *legacyServer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	serverEnd, clientEnd := net.Pipe()
+	go l.serve(serverEnd)
+	return clientEnd, nil
+}
+
+// seen returns the commands the server received and the TTL of every GETORSET
+func (l *legacyServer) seen() ([]wire.Command, []time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]wire.Command{}, l.commands...), append([]time.Duration{}, l.ttls...)
+}
+
+func (l *legacyServer) serve(connection net.Conn) {
+	defer connection.Close()
+	protocol := wire.Protocol{}
+	frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+	for {
+		request, err := frames.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		command, _ := protocol.DecipherCommand(request)
+		response := protocol.EncodeErrResponse(errors.New("unknown command"))
+		switch command {
+		case wire.GETORSET:
+			_, _, ttl, _ := protocol.DecodeGetOrSet(request)
+			l.mutex.Lock()
+			l.ttls = append(l.ttls, ttl)
+			l.mutex.Unlock()
+			response = protocol.EncodeGetOrSetResponse("1", false)
+		case wire.EXPIRE:
+			response = protocol.EncodeAckResponse()
+		}
+
+		l.mutex.Lock()
+		l.commands = append(l.commands, command)
+		l.mutex.Unlock()
+		connection.Write(response)
+	}
+}
+
+func TestGetOrSetWithTTLFallsBackOnServersWithoutInlineTTL(t *testing.T) {
+	legacy := &legacyServer{}
+	client := New("localhost", 0, WithTransport(legacy))
+
+	if _, existed, err := client.GetOrSetWithTTL("session", "1", time.Hour); err != nil || existed {
+		t.Fatalf("Expected the key to be set but got %q", err)
+	}
+
+	commands, ttls := legacy.seen()
+	expected := []wire.Command{wire.CAPABILITIES, wire.GETORSET, wire.EXPIRE}
+	if len(commands) != len(expected) {
+		t.Fatalf("Expected the commands %v but the server saw %v", expected, commands)
+	}
+	for i, command := range commands {
+		if command != expected[i] {
+			t.Fatalf("Expected the commands %v but the server saw %v", expected, commands)
+		}
+	}
+	if len(ttls) != 1 || ttls[0] != 0 {
+		t.Fatalf("Expected GETORSET to be sent without a TTL but found %v", ttls)
+	}
+
+	// what the client learned on its first connection is kept, it does not ask again
+	client.GetOrSetWithTTL("session", "1", time.Hour)
+	if commands, _ := legacy.seen(); len(commands) != 5 || commands[3] != wire.GETORSET {
+		t.Fatalf("Expected only GETORSET and EXPIRE to be sent again but the server saw %v", commands)
+	}
+
+	if _, err := client.Capabilities(); err == nil {
+		t.Fatalf("Expected a server predating CAPABILITIES to answer it with an error")
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is matched by the CircuitOpenError requests fail with while an endpoint's circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitOpenError
+/**
+* Returned without contacting the endpoint while its circuit breaker is open. It matches ErrCircuitOpen with errors.Is
+* and unwraps to the transport failure that last tripped the breaker.
+ */
+type CircuitOpenError struct {
+	Endpoint Endpoint
+	Last     error
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s after: %s", e.Endpoint, e.Last.Error())
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return e.Last
+}
+
+type CircuitState int
+
+const (
+	// CircuitClosed sends requests to the endpoint as normal
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests without contacting the endpoint until the cooldown has passed
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through to find out whether the endpoint has recovered
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreaker
+/**
+* Settings for the circuit breaker each endpoint gets, see WithCircuitBreaker
+*
+* Once Failures transport failures happen in a row, each within Window of the first, the breaker opens and requests fail
+* fast with a CircuitOpenError. After Cooldown the next request is let through as a probe: success closes the breaker and
+* failure opens it for another cooldown. ERR responses and responses the client cannot decode mean the server is up, so
+* they never count as failures and reset the count like any other success.
+* Requests whose context was cancelled or timed out, see Client.WithContext, count as neither, and a probe given up on
+* that way leaves the next request to probe again.
+ */
+type CircuitBreaker struct {
+	Failures int
+	Window   time.Duration
+	Cooldown time.Duration
+	// OnStateChange is called, outside of the breaker's lock, whenever an endpoint's breaker changes state
+	OnStateChange func(endpoint Endpoint, from CircuitState, to CircuitState)
+}
+
+// circuitBreaker is the state of one endpoint's breaker, a nil breaker lets every request through
+type circuitBreaker struct {
+	settings CircuitBreaker
+	endpoint Endpoint
+
+	mutex        sync.Mutex
+	state        CircuitState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	last         error
+}
+
+func newCircuitBreaker(settings CircuitBreaker, endpoint Endpoint) *circuitBreaker {
+	if settings.Failures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{settings: settings, endpoint: endpoint}
+}
+
+// allow returns a CircuitOpenError if a request may not be sent now, moving an open breaker whose cooldown has passed
+// to half open and letting the caller through as its probe
+func (b *circuitBreaker) allow(trace *callTrace) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	from := b.state
+	switch {
+	case b.state == CircuitOpen && time.Since(b.openedAt) >= b.settings.Cooldown:
+		b.state = CircuitHalfOpen
+	case b.state != CircuitClosed:
+		err := &CircuitOpenError{Endpoint: b.endpoint, Last: b.last}
+		b.mutex.Unlock()
+		return err
+	}
+	to := b.state
+	b.mutex.Unlock()
+
+	b.notify(trace, from, to)
+	return nil
+}
+
+// record counts the outcome of a request the breaker allowed
+func (b *circuitBreaker) record(trace *callTrace, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	from := b.state
+	now := time.Now()
+	if isContextError(err) {
+		// a request the caller gave up on says nothing about the endpoint, a probe is left to the next request
+		if b.state == CircuitHalfOpen {
+			b.state = CircuitOpen
+		}
+	} else if !isTransportFailure(err) {
+		b.state = CircuitClosed
+		b.failures = 0
+	} else {
+		b.last = err
+		if b.failures == 0 || now.Sub(b.firstFailure) > b.settings.Window {
+			b.failures = 0
+			b.firstFailure = now
+		}
+		b.failures++
+
+		if b.state == CircuitHalfOpen || b.failures >= b.settings.Failures {
+			b.state = CircuitOpen
+			b.openedAt = now
+		}
+	}
+	to := b.state
+	b.mutex.Unlock()
+
+	b.notify(trace, from, to)
+}
+
+func (b *circuitBreaker) current() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// notify reports a state change to OnStateChange and as an event of the call that caused it
+func (b *circuitBreaker) notify(trace *callTrace, from CircuitState, to CircuitState) {
+	if from == to {
+		return
+	}
+
+	trace.emit(Event{Kind: BreakerStateChange, Endpoint: b.endpoint, From: from, To: to})
+	if b.settings.OnStateChange != nil {
+		b.settings.OnStateChange(b.endpoint, from, to)
+	}
+}
+
+// isTransportFailure reports whether err means the endpoint could not be reached or the connection to it failed, rather
+// than the server answering with something the request could not use
+func isTransportFailure(err error) bool {
+	var protocolErr *wire.Error
+	return err != nil && !errors.As(err, &protocolErr) && !errors.Is(err, ErrMalformedResponse) && !errors.Is(err, ErrUnexpectedResponse)
+}
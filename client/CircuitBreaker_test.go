@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// switchableTransport dials the real server until it is taken down, then closes its connections and fails every dial
+// after a delay, like a server that went away behind a slow network
+type switchableTransport struct {
+	delay time.Duration
+
+	mutex       sync.Mutex
+	down        bool
+	dials       int
+	connections []net.Conn
+}
+
+func (t *switchableTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	t.mutex.Lock()
+	t.dials++
+	down := t.down
+	t.mutex.Unlock()
+
+	if down {
+		time.Sleep(t.delay)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+
+	connection, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	t.connections = append(t.connections, connection)
+	t.mutex.Unlock()
+	return connection, nil
+}
+
+func (t *switchableTransport) setDown(down bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.down = down
+	if down {
+		for _, connection := range t.connections {
+			connection.Close()
+		}
+		t.connections = nil
+	}
+}
+
+func (t *switchableTransport) dialCount() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.dials
+}
+
+// transitionRecorder collects the state changes reported to OnStateChange
+type transitionRecorder struct {
+	mutex       sync.Mutex
+	transitions []string
+}
+
+func (r *transitionRecorder) record(endpoint Endpoint, from CircuitState, to CircuitState) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.transitions = append(r.transitions, fmt.Sprintf("%s->%s", from, to))
+}
+
+func (r *transitionRecorder) assert(t *testing.T, expected ...string) {
+	t.Helper()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if fmt.Sprint(r.transitions) != fmt.Sprint(expected) {
+		t.Fatalf("Expected transitions %v but found %v", expected, r.transitions)
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	startServers(t, 8913)
+
+	transport := &switchableTransport{delay: time.Millisecond * 50}
+	recorder := &transitionRecorder{}
+	client := New("localhost", 8913, WithTransport(transport), WithCircuitBreaker(CircuitBreaker{
+		Failures:      3,
+		Window:        time.Second,
+		Cooldown:      time.Millisecond * 200,
+		OnStateChange: recorder.record,
+	}))
+
+	_, err := client.Upsert("key", "value")
+	if err != nil {
+		t.Fatalf("Expected the write to succeed but got %q", err)
+	}
+
+	transport.setDown(true)
+	for i := 0; i < 3; i++ {
+		_, _, err = client.Read("key")
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected read %d to fail reaching the server but got %v", i, err)
+		}
+	}
+	recorder.assert(t, "closed->open")
+
+	dials := transport.dialCount()
+	started := time.Now()
+	_, _, err = client.Read("key")
+	var refused *net.OpError
+	if !errors.Is(err, ErrCircuitOpen) || !errors.As(err, &refused) {
+		t.Fatalf("Expected the open breaker to fail with the last dial error but got %v", err)
+	}
+	if time.Since(started) > transport.delay/2 || transport.dialCount() != dials {
+		t.Fatalf("Expected the open breaker to fail fast without dialing but took %s", time.Since(started))
+	}
+	if client.EndpointStats()[0].Circuit != CircuitOpen {
+		t.Fatalf("Expected the endpoint stats to report the open breaker")
+	}
+
+	// the probe after the cooldown fails while the server is still down and opens the breaker again
+	time.Sleep(time.Millisecond * 200)
+	_, _, err = client.Read("key")
+	if err == nil || errors.Is(err, ErrCircuitOpen) || transport.dialCount() != dials+1 {
+		t.Fatalf("Expected the probe to try the server and fail but got %v", err)
+	}
+	recorder.assert(t, "closed->open", "open->half-open", "half-open->open")
+
+	transport.setDown(false)
+	time.Sleep(time.Millisecond * 200)
+	value, present, err := client.Read("key")
+	if err != nil || !present || value != "value" {
+		t.Fatalf("Expected the probe to reach the recovered server but got %q: %v", value, err)
+	}
+	recorder.assert(t, "closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed")
+}
+
+func TestCircuitBreakerOnlyCountsConsecutiveTransportFailures(t *testing.T) {
+	startServers(t, 8914)
+
+	transport := &switchableTransport{}
+	recorder := &transitionRecorder{}
+	client := New("localhost", 8914, WithTransport(transport), WithCircuitBreaker(CircuitBreaker{
+		Failures:      3,
+		Window:        time.Second,
+		Cooldown:      time.Minute,
+		OnStateChange: recorder.record,
+	}))
+
+	client.Insert("key", "value")
+	for i := 0; i < 5; i++ {
+		_, err := client.Insert("key", "value")
+		if !errors.Is(err, ErrKeyExists) {
+			t.Fatalf("Expected an ERR response but got %v", err)
+		}
+	}
+	recorder.assert(t)
+
+	// a success between failures starts the count again
+	for _, down := range []bool{true, true, false, true, true} {
+		transport.setDown(down)
+		client.Present("key")
+	}
+	recorder.assert(t)
+
+	client.Present("key")
+	recorder.assert(t, "closed->open")
+}
+
+func TestCircuitBreakerForgetsFailuresOutsideTheWindow(t *testing.T) {
+	transport := &switchableTransport{}
+	transport.setDown(true)
+	recorder := &transitionRecorder{}
+	client := New("localhost", 8915, WithTransport(transport), WithCircuitBreaker(CircuitBreaker{
+		Failures:      2,
+		Window:        time.Millisecond * 50,
+		Cooldown:      time.Minute,
+		OnStateChange: recorder.record,
+	}))
+
+	client.Present("key")
+	time.Sleep(time.Millisecond * 100)
+	client.Present("key")
+	recorder.assert(t)
+
+	client.Present("key")
+	recorder.assert(t, "closed->open")
+}
@@ -1,27 +1,148 @@
 package client
 
 import (
-	"bufio"
+	"context"
 	"datastore/wire"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"net"
+	"sort"
+	"strconv"
 	"time"
 )
 
+var (
+	// ErrKeyExists is returned when inserting a key that already exists
+	ErrKeyExists = wire.ErrKeyExists
+	// ErrKeyNotFound is returned when updating, deleting, or expiring a key that does not exist
+	ErrKeyNotFound = wire.ErrKeyNotFound
+	// ErrUnauthorized is returned when the admin token is wrong or a command needs an admin session
+	ErrUnauthorized = wire.ErrUnauthorized
+	// ErrProtected is returned when writing under a protected prefix without an admin session
+	ErrProtected = wire.ErrProtected
+	// ErrTTLExceeded is returned when expiring a key later than the server's TTL policy allows for it
+	ErrTTLExceeded = wire.ErrTTLExceeded
+	// ErrRejected is returned when middleware on the server refused a request without a more specific error
+	ErrRejected = wire.ErrRejected
+	// ErrKeyTooComplex is returned when writing a key with more segments or longer segments than the server allows
+	ErrKeyTooComplex = wire.ErrKeyTooComplex
+	// ErrWrongType is returned when a hash method names a key holding a string, or a string method one holding a hash
+	ErrWrongType = wire.ErrWrongType
+	// ErrStoreFull is returned when a write would create a key while the server is over its high-water mark, callers
+	// can shed load on it and retry once keys have been deleted or expired
+	ErrStoreFull = wire.ErrStoreFull
+	// ErrNotInteger is returned when incrementing or decrementing a key that does not hold a 64-bit integer, or when
+	// the result would not fit in one
+	ErrNotInteger = wire.ErrNotInteger
+	// ErrValueTooLarge is returned when writing a value longer than the server allows
+	ErrValueTooLarge = wire.ErrValueTooLarge
+	// ErrReadOnly is returned when writing to a replica server rather than to its primary
+	ErrReadOnly = wire.ErrReadOnly
+	// ErrUnexpectedResponse is returned when the server answers a request with a well formed response of the wrong kind
+	ErrUnexpectedResponse = errors.New("unexpected response from server")
+	// ErrMalformedResponse is returned when a response from the server cannot be decoded
+	ErrMalformedResponse = errors.New("malformed response from server")
+)
+
+// Warning is something the server reported about a request that succeeded, see WithWarningListener
+type Warning = wire.Warning
+
+const (
+	// TTLClamped warns that Expire set an earlier expiration than requested because of the server's TTL policy
+	TTLClamped = wire.TTLCLAMPED
+)
+
+// maxExistsBatch is the most keys PresentMulti sends in a single MEXISTS request
+const maxExistsBatch = 4096
+
+// maxReadBatch is the most keys ReadMany sends in a single READMANY request
+const maxReadBatch = 4096
+
+// defaultMaxIdleConnections is how many idle connections to each endpoint a client keeps unless
+// WithMaxIdleConnections says otherwise
+const defaultMaxIdleConnections = 16
+
+// maxInsertBatch is the most keys InsertMany sends in a single INSERTMANY request
+const maxInsertBatch = 4096
+
+// Client
+/**
+* Sends commands to a server and decodes the responses
+*
+* A client is safe to use from several goroutines. Connections are dialed on first use and kept for reuse by later
+* calls, each taken by one call at a time, until Close.
+*
+* Methods that return a list of results, such as KeysBy and Export, return an empty non-nil slice when the server found
+* nothing, and nil only together with an error.
+ */
 type Client struct {
-	address string
-	port    int
-	wire    wire.Protocol
+	wire      wire.Protocol
+	transport Transport
+	timeout   time.Duration
+	authToken string
+	// database is the name of the database every connection selects, empty for the server's default database
+	database string
+
+	// endpoints holds the primary first and then any replicas
+	endpoints           []*endpoint
+	routing             RoutingPolicy
+	healthCheckInterval time.Duration
+	checks              *healthChecks
+	breaker             CircuitBreaker
+	retry               RetryPolicy
+	eventListener       func(Event)
+	warningListener     func(wire.Command, Warning)
+	maxIdleConnections  int
+	maxMessageSize      int
+
+	// session is only set on the Client a Session embeds, and sends every command over the session's connection
+	session *sessionConnection
+	// ctx bounds every request of a Client returned by WithContext, nil for any other
+	ctx context.Context
+}
+
+func New(address string, port int, opts ...Option) Client {
+	client := Client{
+		wire:                wire.Protocol{},
+		transport:           &net.Dialer{},
+		timeout:             time.Second * 10,
+		endpoints:           []*endpoint{newEndpoint(address, port)},
+		routing:             PrimaryOnly(),
+		healthCheckInterval: time.Second * 5,
+		checks:              &healthChecks{},
+		maxIdleConnections:  defaultMaxIdleConnections,
+		maxMessageSize:      wire.DefaultMaxMessageSize,
+	}
+
+	for _, opt := range opts {
+		opt(&client)
+	}
+	if client.maxMessageSize <= wire.LengthPrefixSize {
+		client.maxMessageSize = wire.DefaultMaxMessageSize
+	}
+	if client.maxMessageSize > wire.MaxFrameSize {
+		client.maxMessageSize = wire.MaxFrameSize
+	}
+
+	for _, e := range client.endpoints {
+		e.breaker = newCircuitBreaker(client.breaker, e.Endpoint)
+		e.connections.maxIdle = client.maxIdleConnections
+	}
+
+	return client
 }
 
-func New(address string, port int) Client {
-	return Client{
-		address: address,
-		port:    port,
-		wire:    wire.Protocol{},
+// Close
+/**
+* Close the idle connections the client keeps to every endpoint, and each connection still in use once its request
+* finishes. Copies of the client share its connections and are closed with it.
+*
+* A client used after Close keeps working without reusing connections, dialing one for each request and closing it
+* after the response.
+ */
+func (c *Client) Close() {
+	for _, e := range c.endpoints {
+		e.connections.close()
 	}
 }
 
@@ -36,6 +157,11 @@ func (c *Client) Read(key string) (string, bool, error) {
 		return "", false, err
 	}
 
+	return c.decodeRead(responseCommand, responseMessage)
+}
+
+// decodeRead decodes the response to a READ, for Read and for Reads queued on a Pipeline
+func (c *Client) decodeRead(responseCommand wire.Command, responseMessage []byte) (string, bool, error) {
 	switch responseCommand {
 	case wire.NULL:
 		return "", false, nil
@@ -45,19 +171,183 @@ func (c *Client) Read(key string) (string, bool, error) {
 	case wire.READ:
 		value, err := c.wire.DecodeReadResponse(responseMessage)
 		if err != nil {
-			return "", false, err
+			return "", false, malformedResponse(err)
 		}
 
 		return value, true, nil
 	default:
-		return "", false, errors.New(fmt.Sprintf("invalid response for READ command %q", responseCommand))
+		return "", false, unexpectedResponse(wire.READ, responseCommand)
+	}
+}
+
+// ReadBytes
+/**
+* Read a binary value, such as one written with InsertBytes
+*
+* Values are opaque bytes to the server and on the wire, so whatever bytes were written are read back, NUL bytes and
+* invalid UTF-8 included. Returns nil when the key is not present.
+ */
+func (c *Client) ReadBytes(key string) ([]byte, bool, error) {
+	value, present, err := c.Read(key)
+	if err != nil || !present {
+		return nil, present, err
+	}
+	return []byte(value), true, nil
+}
+
+type KeyStatus = wire.KeyStatus
+
+const (
+	// KeyLive keys are present and their value was read
+	KeyLive = wire.KeyLive
+	// KeyExpired keys expired and have not been cleaned up by the server yet
+	KeyExpired = wire.KeyExpired
+	// KeyMissing keys were never written, were deleted, or expired and have been cleaned up
+	KeyMissing = wire.KeyMissing
+)
+
+// ReadWithStatus
+/**
+* Read the value of a key like Read, also telling a key that expired apart from one that is not stored, see
+* engine.DataStore.ReadWithStatus. The value is only returned for KeyLive.
+ */
+func (c *Client) ReadWithStatus(key string) (string, KeyStatus, error) {
+	readCommand, err := c.wire.EncodeMessage(wire.READSTATUS, key)
+	if err != nil {
+		return "", KeyMissing, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(readCommand)
+	if err != nil {
+		return "", KeyMissing, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return "", KeyMissing, err
+	case wire.READSTATUS:
+		value, status, err := c.wire.DecodeReadStatusResponse(responseMessage)
+		if err != nil {
+			return "", KeyMissing, malformedResponse(err)
+		}
+
+		return value, status, nil
+	default:
+		return "", KeyMissing, unexpectedResponse(wire.READSTATUS, responseCommand)
 	}
 }
 
+// Insert
+// Insert a new key, returns ErrKeyExists if the key is already present
 func (c *Client) Insert(key string, value string) (bool, error) {
 	return c.executeAckOrNullCommand(wire.INSERT, key, value)
 }
 
+// InsertBytes is Insert of a binary value, such as a gob encoded struct or compressed JSON, see ReadBytes
+func (c *Client) InsertBytes(key string, value []byte) (bool, error) {
+	return c.Insert(key, string(value))
+}
+
+// InsertMany
+/**
+* Insert many new keys in a single round trip, returning how many were inserted. Keys that are already present are
+* skipped rather than failing the batch.
+*
+* The whole batch is refused, inserting nothing, when any key is under a protected prefix, breaks the server's key
+* limits, or is refused by its middleware. Batches larger than maxInsertBatch keys are split into several requests,
+* which are not inserted together.
+ */
+func (c *Client) InsertMany(entries map[string]string) (int, error) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	inserted := 0
+	for start := 0; start < len(keys); start += maxInsertBatch {
+		end := start + maxInsertBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch, err := c.insertBatch(keys[start:end], entries)
+		inserted += batch
+		if err != nil {
+			return inserted, err
+		}
+	}
+
+	return inserted, nil
+}
+
+func (c *Client) insertBatch(keys []string, entries map[string]string) (int, error) {
+	arguments := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		arguments = append(arguments, key, entries[key])
+	}
+
+	insertCommand, err := c.wire.EncodeMessage(wire.INSERTMANY, arguments...)
+	if err != nil {
+		return 0, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(insertCommand)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.INSERTMANY:
+		inserted, err := c.wire.DecodeInsertManyResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return inserted, nil
+	default:
+		return 0, unexpectedResponse(wire.INSERTMANY, responseCommand)
+	}
+}
+
+// ReadStale
+/**
+* Read the value of a key, still returning it for up to staleWindow after it expired with stale set, see
+* engine.DataStore.ReadStale
+ */
+func (c *Client) ReadStale(key string, staleWindow time.Duration) (string, bool, bool, error) {
+	readCommand, err := c.wire.EncodeMessage(wire.READSTALE, key, c.wire.EncodeDuration(staleWindow))
+	if err != nil {
+		return "", false, false, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(readCommand)
+	if err != nil {
+		return "", false, false, err
+	}
+
+	switch responseCommand {
+	case wire.NULL:
+		return "", false, false, nil
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return "", false, false, err
+	case wire.READSTALE:
+		value, stale, err := c.wire.DecodeReadStaleResponse(responseMessage)
+		if err != nil {
+			return "", false, false, malformedResponse(err)
+		}
+
+		return value, stale, true, nil
+	default:
+		return "", false, false, unexpectedResponse(wire.READSTALE, responseCommand)
+	}
+}
+
 func (c *Client) ReadExpiration(key string) (time.Time, bool, error) {
 	readCommand, err := c.wire.EncodeMessage(wire.READEXPIRATION, key)
 	if err != nil {
@@ -78,46 +368,72 @@ func (c *Client) ReadExpiration(key string) (time.Time, bool, error) {
 	case wire.READEXPIRATION:
 		value, err := c.wire.DecodeReadExpirationResponse(responseMessage)
 		if err != nil {
-			return time.Time{}, false, err
+			return time.Time{}, false, malformedResponse(err)
 		}
 
 		return value, true, nil
 	default:
-		return time.Time{}, false, errors.New(fmt.Sprintf("invalid response for READEXPIRATION command %q", responseCommand))
+		return time.Time{}, false, unexpectedResponse(wire.READEXPIRATION, responseCommand)
 	}
 }
 
+// Expire
+// Set the expiration of a key, returns ErrKeyNotFound if the key is not present
 func (c *Client) Expire(key string, expiration time.Time) (bool, error) {
 	return c.executeAckOrNullCommand(wire.EXPIRE, key, c.wire.EncodeTime(expiration))
 }
 
-func (c *Client) Update(key string, value string) (bool, error) {
-	return c.executeAckOrNullCommand(wire.UPDATE, key, value)
-}
+type ExpireMode = wire.ExpireMode
 
-func (c *Client) Delete(key string) (bool, error) {
-	return c.executeAckOrNullCommand(wire.DELETE, key)
+const (
+	// ExpireIfNone only sets the expiration when the key does not have one
+	ExpireIfNone = wire.ExpireIfNone
+	// ExpireIfSet only sets the expiration when the key already has one
+	ExpireIfSet = wire.ExpireIfSet
+	// ExpireIfLonger only sets the expiration when it is later than the current one, never for keys without one
+	ExpireIfLonger = wire.ExpireIfLonger
+	// ExpireIfShorter only sets the expiration when it is earlier than the current one, always for keys without one
+	ExpireIfShorter = wire.ExpireIfShorter
+)
+
+// ExpireWithMode
+// Set the expiration of a key when the mode allows it, returns whether the expiration changed and ErrKeyNotFound if
+// the key is not present
+func (c *Client) ExpireWithMode(key string, expiration time.Time, mode ExpireMode) (bool, error) {
+	return c.executeAckOrNullCommand(wire.EXPIRE, key, c.wire.EncodeTime(expiration), string(mode))
 }
 
-func (c *Client) Upsert(key string, value string) (bool, error) {
-	return c.executeAckOrNullCommand(wire.UPSERT, key, value)
+// ExpireIn
+// Expire a key ttl from now by the server's clock, so the skew between the clocks does not matter, returns
+// ErrKeyNotFound if the key is not present. A ttl of zero or less expires the key straight away.
+func (c *Client) ExpireIn(key string, ttl time.Duration) (bool, error) {
+	return c.executeAckOrNullCommand(wire.EXPIREIN, key, c.wire.EncodeDuration(ttl))
 }
 
-func (c *Client) Present(key string) (bool, error) {
-	return c.executeAckOrNullCommand(wire.PRESENT, key)
+// Increment
+/**
+* Add delta to the integer stored under key and return the result, the server does it in one step so concurrent
+* increments from any number of clients are never lost
+*
+* A key that is not present counts as zero and is created. Returns ErrNotInteger when the key holds something other
+* than a 64-bit integer and ErrWrongType when it holds a hash.
+ */
+func (c *Client) Increment(key string, delta int64) (int64, error) {
+	return c.counter(wire.INCR, key, delta)
 }
 
-func (c *Client) Truncate() (bool, error) {
-	return c.executeAckOrNullCommand(wire.TRUNCATE)
+// Decrement subtracts delta from the integer stored under key and returns the result, see Increment
+func (c *Client) Decrement(key string, delta int64) (int64, error) {
+	return c.counter(wire.DECR, key, delta)
 }
 
-func (c *Client) Count() (int, error) {
-	countCommand, err := c.wire.EncodeMessage(wire.COUNT)
+func (c *Client) counter(command wire.Command, key string, delta int64) (int64, error) {
+	counterCommand, err := c.wire.EncodeMessage(command, key, strconv.FormatInt(delta, 10))
 	if err != nil {
 		return 0, err
 	}
 
-	responseCommand, responseMessage, err := c.connectAndSendMessage(countCommand)
+	responseCommand, responseMessage, err := c.connectAndSendMessage(counterCommand)
 	if err != nil {
 		return 0, err
 	}
@@ -126,161 +442,992 @@ func (c *Client) Count() (int, error) {
 	case wire.ERR:
 		err := c.wire.DecodeError(responseMessage)
 		return 0, err
-	case wire.COUNT:
-		value, err := c.wire.DecodeCountResponse(responseMessage)
+	case command:
+		value, err := c.wire.DecodeCounterResponse(command, responseMessage)
 		if err != nil {
-			return 0, err
+			return 0, malformedResponse(err)
 		}
 
 		return value, nil
 	default:
-		return 0, errors.New(fmt.Sprintf("invalid response for COUNT command %q", responseCommand))
+		return 0, unexpectedResponse(command, responseCommand)
 	}
 }
 
-func (c *Client) KeysBy(prefix string) ([]string, error) {
-	keysByCommand, err := c.wire.EncodeMessage(wire.KEYSBY, prefix)
+// GetOrSet
+/**
+* Read the value of a key, inserting defaultValue first when the key is not present, as one step on the server so
+* concurrent callers all receive the same value. Returns the value and whether the key existed.
+ */
+func (c *Client) GetOrSet(key string, defaultValue string) (string, bool, error) {
+	return c.getOrSet(key, defaultValue)
+}
+
+// GetOrSetWithTTL
+/**
+* GetOrSet that gives the key an expiration ttl from now when it inserts it, a key that existed keeps its expiration
+*
+* Servers that do not announce wire.CapabilityInlineTTL get a GETORSET followed by an EXPIRE instead, which is not
+* atomic, see Client.Capabilities.
+ */
+func (c *Client) GetOrSetWithTTL(key string, defaultValue string, ttl time.Duration) (string, bool, error) {
+	inline, err := c.primaryHas(wire.CapabilityInlineTTL)
 	if err != nil {
-		return nil, err
+		return "", false, err
+	}
+	if !inline {
+		return c.getOrSetThenExpire(key, defaultValue, ttl)
 	}
 
-	responseCommand, responseMessage, err := c.connectAndSendMessage(keysByCommand)
+	return c.getOrSet(key, defaultValue, c.wire.EncodeDuration(ttl))
+}
+
+func (c *Client) getOrSet(key string, defaultValue string, ttl ...string) (string, bool, error) {
+	getOrSetCommand, err := c.wire.EncodeMessage(wire.GETORSET, append([]string{key, defaultValue}, ttl...)...)
 	if err != nil {
-		return nil, err
+		return "", false, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(getOrSetCommand)
+	if err != nil {
+		return "", false, err
 	}
 
+	return c.decodeGetOrSet(responseCommand, responseMessage)
+}
+
+// decodeGetOrSet decodes the response to GETORSET into the value and whether the key existed
+func (c *Client) decodeGetOrSet(responseCommand wire.Command, responseMessage []byte) (string, bool, error) {
 	switch responseCommand {
 	case wire.ERR:
 		err := c.wire.DecodeError(responseMessage)
-		return nil, err
-	case wire.KEYSBY:
-		value, err := c.wire.DecodeKeysByResponse(responseMessage)
+		return "", false, err
+	case wire.GETORSET:
+		value, existed, err := c.wire.DecodeGetOrSetResponse(responseMessage)
 		if err != nil {
-			return nil, err
+			return "", false, malformedResponse(err)
 		}
 
-		return value, nil
+		return value, existed, nil
 	default:
-		return nil, errors.New(fmt.Sprintf("invalid response for KEYSBY command %q", responseCommand))
+		return "", false, unexpectedResponse(wire.GETORSET, responseCommand)
 	}
 }
 
-func (c *Client) DeleteBy(prefix string) (int, error) {
-	deleteByCommand, err := c.wire.EncodeMessage(wire.DELETEBY, prefix)
+// Update
+// Update the value of an existing key, returns ErrKeyNotFound if the key is not present
+func (c *Client) Update(key string, value string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.UPDATE, key, value)
+}
+
+// Delete
+// Delete a key, returns ErrKeyNotFound if the key is not present
+func (c *Client) Delete(key string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.DELETE, key)
+}
+
+// DeleteIfEquals
+/**
+* Delete a key only if it still holds expectedValue, such as a lock only its holder should release
+*
+* Returns whether the key was deleted, and otherwise the value it holds instead. The value is the empty string when the
+* key was not present.
+ */
+func (c *Client) DeleteIfEquals(key string, expectedValue string) (bool, string, error) {
+	deleteCommand, err := c.wire.EncodeMessage(wire.CDELETE, key, expectedValue)
 	if err != nil {
-		return 0, err
+		return false, "", err
 	}
 
-	responseCommand, responseMessage, err := c.connectAndSendMessage(deleteByCommand)
+	responseCommand, responseMessage, err := c.connectAndSendMessage(deleteCommand)
 	if err != nil {
-		return 0, err
+		return false, "", err
 	}
 
 	switch responseCommand {
+	case wire.ACK:
+		return true, expectedValue, nil
+	case wire.NULL:
+		return false, "", nil
 	case wire.ERR:
 		err := c.wire.DecodeError(responseMessage)
-		return 0, err
-	case wire.DELETEBY:
-		value, err := c.wire.DecodeDeleteByResponse(responseMessage)
+		return false, "", err
+	case wire.CDELETE:
+		actual, err := c.wire.DecodeDeleteIfEqualsResponse(responseMessage)
 		if err != nil {
-			return 0, err
+			return false, "", malformedResponse(err)
 		}
 
-		return value, nil
+		return false, actual, nil
 	default:
-		return 0, errors.New(fmt.Sprintf("invalid response for DELETEBY command %q", responseCommand))
+		return false, "", unexpectedResponse(wire.CDELETE, responseCommand)
 	}
 }
 
-func (c *Client) ExpireBy(prefix string, expiration time.Time) (int, error) {
-	expireByCommand, err := c.wire.EncodeMessage(wire.EXPIREBY, prefix, c.wire.EncodeTime(expiration))
+// ReadAndDelete
+// Read a key and delete it in one step, so of several clients popping the same key only one receives its value.
+// Returns the value and whether the key was present.
+func (c *Client) ReadAndDelete(key string) (string, bool, error) {
+	getDelCommand, err := c.wire.EncodeMessage(wire.GETDEL, key)
 	if err != nil {
-		return 0, err
+		return "", false, err
 	}
 
-	responseCommand, responseMessage, err := c.connectAndSendMessage(expireByCommand)
+	responseCommand, responseMessage, err := c.connectAndSendMessage(getDelCommand)
 	if err != nil {
-		return 0, err
+		return "", false, err
 	}
 
 	switch responseCommand {
+	case wire.NULL:
+		return "", false, nil
 	case wire.ERR:
 		err := c.wire.DecodeError(responseMessage)
-		return 0, err
-	case wire.EXPIREBY:
-		value, err := c.wire.DecodeExpireByResponse(responseMessage)
+		return "", false, err
+	case wire.GETDEL:
+		value, err := c.wire.DecodeGetDelResponse(responseMessage)
 		if err != nil {
-			return 0, err
+			return "", false, malformedResponse(err)
 		}
 
-		return value, nil
+		return value, true, nil
 	default:
-		return 0, errors.New(fmt.Sprintf("invalid response for EXPIREBY command %q", responseCommand))
+		return "", false, unexpectedResponse(wire.GETDEL, responseCommand)
 	}
 }
 
-func (c *Client) executeAckOrNullCommand(command wire.Command, args ...string) (bool, error) {
-	parsedCommand, err := c.wire.EncodeMessage(command, args...)
+// ReadAndUpdate
+// Update a key and read the value it replaced in one step, so of several clients updating the same key each receives
+// the value the one before it wrote. Returns the old value and whether the key was present, a key that is not present
+// is not inserted.
+func (c *Client) ReadAndUpdate(key string, value string) (string, bool, error) {
+	getUpdateCommand, err := c.wire.EncodeMessage(wire.GETUPDATE, key, value)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 
-	responseCommand, responseMessage, err := c.connectAndSendMessage(parsedCommand)
+	responseCommand, responseMessage, err := c.connectAndSendMessage(getUpdateCommand)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 
 	switch responseCommand {
 	case wire.NULL:
-		return false, nil
+		return "", false, nil
 	case wire.ERR:
 		err := c.wire.DecodeError(responseMessage)
-		return false, err
-	case wire.ACK:
-		return true, nil
+		return "", false, err
+	case wire.GETUPDATE:
+		oldValue, err := c.wire.DecodeGetUpdateResponse(responseMessage)
+		if err != nil {
+			return "", false, malformedResponse(err)
+		}
+
+		return oldValue, true, nil
 	default:
-		return false, errors.New(fmt.Sprintf("invalid response for %q command %q", command, responseCommand))
+		return "", false, unexpectedResponse(wire.GETUPDATE, responseCommand)
+	}
+}
+
+// Upsert
+// Insert or update a key, returns false with no error if the key already had the provided value
+func (c *Client) Upsert(key string, value string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.UPSERT, key, value)
+}
+
+// Present
+// Check if a key is present, returns false with no error if it is absent
+func (c *Client) Present(key string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.PRESENT, key)
+}
+
+// ReadMany
+/**
+* Read many keys in a single round trip, returning the value of each key that is present. Keys that are not present
+* are left out of the map, so a key holding the empty string is told apart from a missing one.
+*
+* The keys are read one after the other on the server rather than atomically, and batches larger than maxReadBatch keys
+* are split into several requests.
+ */
+func (c *Client) ReadMany(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for start := 0; start < len(keys); start += maxReadBatch {
+		end := start + maxReadBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch, err := c.readBatch(keys[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range batch {
+			values[key] = value
+		}
 	}
+
+	return values, nil
 }
 
-// TODO, this doesn't do any kind of connection pooling
-func (c *Client) connectAndSendMessage(message []byte) (wire.Command, []byte, error) {
-	connection, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.address, c.port))
+func (c *Client) readBatch(keys []string) (map[string]string, error) {
+	readCommand, err := c.wire.EncodeMessage(wire.READMANY, keys...)
 	if err != nil {
-		return wire.ERR, nil, err
+		return nil, err
 	}
-	defer connection.Close()
-	err = connection.SetDeadline(time.Now().Add(time.Second * 10))
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(readCommand)
 	if err != nil {
-		return wire.ERR, nil, err
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.READMANY:
+		values, err := c.wire.DecodeReadManyResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return values, nil
+	default:
+		return nil, unexpectedResponse(wire.READMANY, responseCommand)
+	}
+}
+
+// PresentMulti
+/**
+* Determine which of the provided keys are present, returning a boolean for each key in the same order
+*
+* Large batches are split into requests of maxExistsBatch keys, so each batch is checked atomically on the server but
+* the batches are not checked together.
+ */
+func (c *Client) PresentMulti(keys []string) ([]bool, error) {
+	present := make([]bool, 0, len(keys))
+	for start := 0; start < len(keys); start += maxExistsBatch {
+		end := start + maxExistsBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch, err := c.presentBatch(keys[start:end])
+		if err != nil {
+			return nil, err
+		}
+		present = append(present, batch...)
 	}
 
-	_, err = connection.Write(message)
+	return present, nil
+}
+
+func (c *Client) presentBatch(keys []string) ([]bool, error) {
+	existsCommand, err := c.wire.EncodeMessage(wire.MEXISTS, keys...)
 	if err != nil {
-		return wire.ERR, nil, err
+		return nil, err
 	}
 
-	// https://stackoverflow.com/a/47585913
-	connectionBuffer := bufio.NewReader(connection)
-	messageSizeBytes, err := connectionBuffer.Peek(4)
+	responseCommand, responseMessage, err := c.connectAndSendMessage(existsCommand)
 	if err != nil {
-		return wire.ERR, nil, err
+		return nil, err
 	}
-	if len(messageSizeBytes) != 4 {
-		return wire.ERR, nil, err
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.MEXISTS:
+		value, err := c.wire.DecodeMExistsResponse(responseMessage, len(keys))
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return nil, unexpectedResponse(wire.MEXISTS, responseCommand)
 	}
+}
+
+func (c *Client) Truncate() (bool, error) {
+	return c.executeAckOrNullCommand(wire.TRUNCATE)
+}
 
-	messageSize := binary.LittleEndian.Uint32(messageSizeBytes[:4])
-	responseMessage := make([]byte, messageSize)
-	_, err = io.ReadFull(connectionBuffer, responseMessage)
+// DropDatabase
+/**
+* Remove the named database and every key in it, see WithDatabase. Returns false when the database did not exist, and
+* empties the default database rather than removing it for the empty name. Connections with the database selected,
+* including this client's own when it is the one WithDatabase selected, create it again with their next command.
+ */
+func (c *Client) DropDatabase(name string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.DROPDB, name)
+}
+
+func (c *Client) Count() (int, error) {
+	countCommand, err := c.wire.EncodeMessage(wire.COUNT)
 	if err != nil {
-		return wire.ERR, nil, err
+		return 0, err
 	}
 
-	responseCommand, err := c.wire.DecipherCommand(responseMessage)
+	responseCommand, responseMessage, err := c.connectAndSendMessage(countCommand)
 	if err != nil {
-		return wire.ERR, nil, err
+		return 0, err
 	}
 
-	return responseCommand, responseMessage, nil
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.COUNT:
+		value, err := c.wire.DecodeCountResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return 0, unexpectedResponse(wire.COUNT, responseCommand)
+	}
+}
+
+// CountBy counts the unexpired keys matching the prefix without sending the keys over the wire
+func (c *Client) CountBy(prefix string) (int, error) {
+	countByCommand, err := c.wire.EncodeMessage(wire.COUNTBY, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(countByCommand)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.COUNTBY:
+		value, err := c.wire.DecodeCountByResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return 0, unexpectedResponse(wire.COUNTBY, responseCommand)
+	}
+}
+
+func (c *Client) KeysBy(prefix string) ([]string, error) {
+	keysByCommand, err := c.wire.EncodeMessage(wire.KEYSBY, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(keysByCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.KEYSBY:
+		value, err := c.wire.DecodeKeysByResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return nil, unexpectedResponse(wire.KEYSBY, responseCommand)
+	}
+}
+
+// KeysMatching
+// Find the keys matching a glob pattern, sorted, where * matches any run of characters including the delimiter and a
+// backslash escapes the character after it, so \* matches a star
+func (c *Client) KeysMatching(pattern string) ([]string, error) {
+	keysMatchingCommand, err := c.wire.EncodeMessage(wire.KEYSMATCH, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(keysMatchingCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.KEYSMATCH:
+		keys, err := c.wire.DecodeKeysMatchingResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return keys, nil
+	default:
+		return nil, unexpectedResponse(wire.KEYSMATCH, responseCommand)
+	}
+}
+
+// ReadBy
+// Read the value of every key matching the prefix in one request, the keys and values are those present on the
+// server at a single instant. An empty prefix reads every key.
+func (c *Client) ReadBy(prefix string) (map[string]string, error) {
+	readByCommand, err := c.wire.EncodeMessage(wire.READBY, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(readByCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.READBY:
+		values, err := c.wire.DecodeReadByResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return values, nil
+	default:
+		return nil, unexpectedResponse(wire.READBY, responseCommand)
+	}
+}
+
+func (c *Client) DeleteBy(prefix string) (int, error) {
+	deleteByCommand, err := c.wire.EncodeMessage(wire.DELETEBY, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(deleteByCommand)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.DELETEBY:
+		value, err := c.wire.DecodeDeleteByResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return 0, unexpectedResponse(wire.DELETEBY, responseCommand)
+	}
+}
+
+// UpdateBy
+// Set every key matching the prefix to the value in one step, keeping their expirations, returns how many keys were
+// updated
+func (c *Client) UpdateBy(prefix string, value string) (int, error) {
+	updateByCommand, err := c.wire.EncodeMessage(wire.UPDATEBY, prefix, value)
+	if err != nil {
+		return 0, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(updateByCommand)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.UPDATEBY:
+		value, err := c.wire.DecodeUpdateByResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return 0, unexpectedResponse(wire.UPDATEBY, responseCommand)
+	}
+}
+
+func (c *Client) ExpireBy(prefix string, expiration time.Time) (int, error) {
+	expireByCommand, err := c.wire.EncodeMessage(wire.EXPIREBY, prefix, c.wire.EncodeTime(expiration))
+	if err != nil {
+		return 0, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(expireByCommand)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.EXPIREBY:
+		value, err := c.wire.DecodeExpireByResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return 0, unexpectedResponse(wire.EXPIREBY, responseCommand)
+	}
+}
+
+// ExpirationHistogram
+// Count the keys expiring within each bucket of remaining time to live, the final count is keys with no expiration
+func (c *Client) ExpirationHistogram(buckets []time.Duration) ([]int, error) {
+	encodedBuckets := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		encodedBuckets[i] = c.wire.EncodeDuration(bucket)
+	}
+
+	histogramCommand, err := c.wire.EncodeMessage(wire.EXPHIST, encodedBuckets...)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(histogramCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.EXPHIST:
+		value, err := c.wire.DecodeExpirationHistogramResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return nil, unexpectedResponse(wire.EXPHIST, responseCommand)
+	}
+}
+
+// Rename
+// Move the value and expiration of oldKey to newKey atomically. Returns ErrKeyNotFound if oldKey is not present and
+// ErrKeyExists if newKey is present and overwrite is false
+func (c *Client) Rename(oldKey string, newKey string, overwrite bool) (bool, error) {
+	return c.executeAckOrNullCommand(wire.RENAME, oldKey, newKey, strconv.FormatBool(overwrite))
+}
+
+// ExportedKey is a key returned by Export, Expiration is the zero time for keys that do not expire
+type ExportedKey = wire.ExportedKey
+
+// Export
+// Read every key under the prefix with its value and expiration, all as of a single instant
+func (c *Client) Export(prefix string) ([]ExportedKey, error) {
+	exportCommand, err := c.wire.EncodeMessage(wire.EXPORT, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(exportCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.EXPORT:
+		value, err := c.wire.DecodeExportResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return nil, unexpectedResponse(wire.EXPORT, responseCommand)
+	}
+}
+
+// ConfigSet
+// Change a server setting at runtime, needs a client created WithAuthToken
+func (c *Client) ConfigSet(name string, value string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.CONFIG, string(wire.ConfigSet), name, value)
+}
+
+// ConfigGet
+// Read the current value of a server setting, needs a client created WithAuthToken
+func (c *Client) ConfigGet(name string) (string, error) {
+	configCommand, err := c.wire.EncodeMessage(wire.CONFIG, string(wire.ConfigGet), name)
+	if err != nil {
+		return "", err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(configCommand)
+	if err != nil {
+		return "", err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return "", err
+	case wire.CONFIG:
+		value, err := c.wire.DecodeConfigResponse(responseMessage)
+		if err != nil {
+			return "", malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return "", unexpectedResponse(wire.CONFIG, responseCommand)
+	}
+}
+
+// Stats
+// Fetch the server's statistics by name, see the STATS command in the wire spec for what each one counts
+func (c *Client) Stats() (map[string]int64, error) {
+	statsCommand, err := c.wire.EncodeMessage(wire.STATS)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(statsCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.STATS:
+		stats, err := c.wire.DecodeStatsResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return stats, nil
+	default:
+		return nil, unexpectedResponse(wire.STATS, responseCommand)
+	}
+}
+
+// Info
+// Fetch the fields describing the server by name, see the INFO command in the wire spec. Later servers may add fields.
+func (c *Client) Info() (map[string]string, error) {
+	infoCommand, err := c.wire.EncodeMessage(wire.INFO)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(infoCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.INFO:
+		info, err := c.wire.DecodeInfoResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return info, nil
+	default:
+		return nil, unexpectedResponse(wire.INFO, responseCommand)
+	}
+}
+
+// ClientInfo describes one connection open to the server, see Clients
+type ClientInfo = wire.ClientInfo
+
+// Clients
+// Describe every connection open to the server and what it is doing, needs a client created WithAuthToken
+func (c *Client) Clients() ([]ClientInfo, error) {
+	clientsCommand, err := c.wire.EncodeMessage(wire.CLIENTS)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(clientsCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.CLIENTS:
+		clients, err := c.wire.DecodeClientsResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return clients, nil
+	default:
+		return nil, unexpectedResponse(wire.CLIENTS, responseCommand)
+	}
+}
+
+// KillClient
+// Close the server's connection with the ID from Clients, returns false if there is no such connection. Needs a client
+// created WithAuthToken.
+func (c *Client) KillClient(id int64) (bool, error) {
+	return c.executeAckOrNullCommand(wire.CLIENTKILL, strconv.FormatInt(id, 10))
+}
+
+// NewestKeys
+// Find up to n unexpired keys starting from the one whose value was written most recently
+func (c *Client) NewestKeys(n int) ([]string, error) {
+	return c.keysByWrite(wire.NEWEST, n)
+}
+
+// OldestKeys
+// Find up to n unexpired keys starting from the one whose value was written least recently
+func (c *Client) OldestKeys(n int) ([]string, error) {
+	return c.keysByWrite(wire.OLDEST, n)
+}
+
+func (c *Client) keysByWrite(command wire.Command, n int) ([]string, error) {
+	orderCommand, err := c.wire.EncodeMessage(command, strconv.Itoa(n))
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(orderCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case command:
+		keys, err := c.wire.DecodeWriteOrderResponse(command, responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return keys, nil
+	default:
+		return nil, unexpectedResponse(command, responseCommand)
+	}
+}
+
+// CompleteKeyPrefix
+// Suggest completions for a partially typed key prefix, a limit of zero or less returns every completion
+func (c *Client) CompleteKeyPrefix(partial string, limit int) ([]string, error) {
+	completeCommand, err := c.wire.EncodeMessage(wire.COMPLETE, partial, strconv.Itoa(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(completeCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.COMPLETE:
+		value, err := c.wire.DecodeCompleteResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return value, nil
+	default:
+		return nil, unexpectedResponse(wire.COMPLETE, responseCommand)
+	}
+}
+
+// Scan
+/**
+* Page through the keys matching the prefix without the server sending them all at once as KeysBy does. Returns up to
+* limit keys and the cursor to pass to the next call, start with an empty cursor and stop once the cursor returned is
+* empty. A limit of zero or less lets the server choose how many keys to return.
+*
+* Keys present for the whole scan are returned exactly once, and no key is returned twice, however the data store is
+* written to between calls. Keys added or deleted during the scan may or may not be returned.
+ */
+func (c *Client) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	scanCommand, err := c.wire.EncodeMessage(wire.SCAN, prefix, cursor, strconv.Itoa(limit))
+	if err != nil {
+		return nil, "", err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(scanCommand)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, "", err
+	case wire.SCAN:
+		keys, next, err := c.wire.DecodeScanResponse(responseMessage)
+		if err != nil {
+			return nil, "", malformedResponse(err)
+		}
+
+		return keys, next, nil
+	default:
+		return nil, "", unexpectedResponse(wire.SCAN, responseCommand)
+	}
+}
+
+// HSet sets a field of the hash stored under key, creating the hash when the key is not present, and returns whether
+// the field was created rather than replaced
+func (c *Client) HSet(key string, field string, value string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.HSET, key, field, value)
+}
+
+// HGet reads a field of the hash stored under key, returning whether the field was present
+func (c *Client) HGet(key string, field string) (string, bool, error) {
+	hGetCommand, err := c.wire.EncodeMessage(wire.HGET, key, field)
+	if err != nil {
+		return "", false, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(hGetCommand)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch responseCommand {
+	case wire.NULL:
+		return "", false, nil
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return "", false, err
+	case wire.HGET:
+		value, err := c.wire.DecodeHGetResponse(responseMessage)
+		if err != nil {
+			return "", false, malformedResponse(err)
+		}
+
+		return value, true, nil
+	default:
+		return "", false, unexpectedResponse(wire.HGET, responseCommand)
+	}
+}
+
+// HDel deletes a field of the hash stored under key, and the key along with its last field, returning whether the
+// field was present
+func (c *Client) HDel(key string, field string) (bool, error) {
+	return c.executeAckOrNullCommand(wire.HDEL, key, field)
+}
+
+// HGetAll reads every field of the hash stored under key, returning an empty map when the key is not present
+func (c *Client) HGetAll(key string) (map[string]string, error) {
+	hGetAllCommand, err := c.wire.EncodeMessage(wire.HGETALL, key)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(hGetAllCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return nil, err
+	case wire.HGETALL:
+		fields, err := c.wire.DecodeHGetAllResponse(responseMessage)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		return fields, nil
+	default:
+		return nil, unexpectedResponse(wire.HGETALL, responseCommand)
+	}
+}
+
+// HLen returns how many fields the hash stored under key has, zero when the key is not present
+func (c *Client) HLen(key string) (int, error) {
+	hLenCommand, err := c.wire.EncodeMessage(wire.HLEN, key)
+	if err != nil {
+		return 0, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(hLenCommand)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return 0, err
+	case wire.HLEN:
+		length, err := c.wire.DecodeHLenResponse(responseMessage)
+		if err != nil {
+			return 0, malformedResponse(err)
+		}
+
+		return length, nil
+	default:
+		return 0, unexpectedResponse(wire.HLEN, responseCommand)
+	}
+}
+
+func (c *Client) executeAckOrNullCommand(command wire.Command, args ...string) (bool, error) {
+	parsedCommand, err := c.wire.EncodeMessage(command, args...)
+	if err != nil {
+		return false, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(parsedCommand)
+	if err != nil {
+		return false, err
+	}
+
+	return c.decodeAckOrNull(command, responseCommand, responseMessage)
+}
+
+// decodeAckOrNull decodes the response to a command answered with ACK or NULL, true for ACK
+func (c *Client) decodeAckOrNull(command wire.Command, responseCommand wire.Command, responseMessage []byte) (bool, error) {
+	switch responseCommand {
+	case wire.NULL:
+		return false, nil
+	case wire.ERR:
+		err := c.wire.DecodeError(responseMessage)
+		return false, err
+	case wire.ACK:
+		return true, nil
+	default:
+		return false, unexpectedResponse(command, responseCommand)
+	}
+}
+
+func unexpectedResponse(command wire.Command, responseCommand wire.Command) error {
+	return fmt.Errorf("%w: invalid response for %s command %q", ErrUnexpectedResponse, command, responseCommand)
+}
+
+func malformedResponse(err error) error {
+	return fmt.Errorf("%w: %s", ErrMalformedResponse, err.Error())
 }
@@ -1,7 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"datastore/engine"
 	"datastore/server"
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,6 +46,11 @@ func TestE2EClient(t *testing.T) {
 		t.Fatalf("Expected to read value %q for key %q but got %q: %q", key, value, readValue, err)
 	}
 
+	success, err = client.Insert(key, value)
+	if success != false || !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("Expected inserting a duplicate key to fail with ErrKeyExists but got %q", err)
+	}
+
 	_, expirationPresent, err := client.ReadExpiration(key)
 	if err != nil || expirationPresent != false {
 		t.Fatalf("Expected to not read expiration %q", err)
@@ -46,7 +63,7 @@ func TestE2EClient(t *testing.T) {
 	}
 
 	expiration, expirationPresent, err := client.ReadExpiration(key)
-	if err != nil || expirationPresent != true || expiration.UnixMilli() != setExpiration.UnixMilli() {
+	if err != nil || expirationPresent != true || !expiration.Equal(setExpiration) {
 		t.Fatalf("Expected to read expiration %q but instead read %q: %q", setExpiration, expiration, err)
 	}
 
@@ -71,6 +88,11 @@ func TestE2EClient(t *testing.T) {
 		t.Fatalf("Expected to not read deleted value %q for key %q but got %q: %q", key, value, readValue, err)
 	}
 
+	success, err = client.Delete(key)
+	if success != false || !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected deleting a missing key to fail with ErrKeyNotFound but got %q", err)
+	}
+
 	success, err = client.Upsert(key, newValue)
 	if success != true || err != nil {
 		t.Fatalf("Got error upserting %q", err)
@@ -113,6 +135,46 @@ func TestE2EClient(t *testing.T) {
 		t.Fatalf("Expected 2 keys to be returned but found %d: %q", len(keys), err)
 	}
 
+	completions, err := client.CompleteKeyPrefix("state:MI:city:", 2)
+	if err != nil || len(completions) != 2 || completions[0] != "state:MI:city:China" || completions[1] != "state:MI:city:Detroit" {
+		t.Fatalf("Expected the first 2 completions for state:MI:city: but found %q: %v", completions, err)
+	}
+
+	changed, err := client.ExpireWithMode("state:OH:city:Toledo", time.Now().Add(time.Hour), ExpireIfLonger)
+	if changed || err != nil {
+		t.Fatalf("Expected extending a key without an expiration to change nothing but got %t: %v", changed, err)
+	}
+
+	changed, err = client.ExpireWithMode("state:OH:city:Toledo", time.Now().Add(time.Hour), ExpireIfNone)
+	if !changed || err != nil {
+		t.Fatalf("Expected setting a first expiration to succeed but got %t: %v", changed, err)
+	}
+
+	_, err = client.ExpireWithMode("state:OH:city:Akron", time.Now().Add(time.Hour), ExpireIfNone)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected expiring a missing key to fail with ErrKeyNotFound but got %v", err)
+	}
+
+	exported, err := client.Export("state:OH")
+	if err != nil || len(exported) != 2 || exported[0].Key != "state:OH:city:Sandusky" || exported[0].Value != "123" || !exported[0].Expiration.IsZero() {
+		t.Fatalf("Expected to export the 2 OH keys but found %v: %v", exported, err)
+	}
+
+	success, err = client.Rename("state:IN:city:Gary", "state:MI:city:China", false)
+	if success || !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("Expected renaming onto an existing key to fail with ErrKeyExists but got %q", err)
+	}
+
+	success, err = client.Rename("state:IN:city:Gary", "state:IN:city:Hammond", false)
+	if !success || err != nil {
+		t.Fatalf("Expected rename to succeed but got %q", err)
+	}
+
+	success, err = client.Rename("state:IN:city:Gary", "state:IN:city:Hammond", true)
+	if success || !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected renaming a missing key to fail with ErrKeyNotFound but got %q", err)
+	}
+
 	count, err = client.DeleteBy("state:MI")
 	if count != 3 || err != nil {
 		t.Fatalf("Got error deleting keys by prefix, expected to delete 3 items but %d was returned: %q", count, err)
@@ -133,14 +195,866 @@ func TestE2EClient(t *testing.T) {
 		t.Fatalf("Expected 3 keys but found %d: %v", count, err)
 	}
 
+	histogram, err := client.ExpirationHistogram([]time.Duration{time.Minute})
+	if err != nil || len(histogram) != 2 || histogram[0] != 2 || histogram[1] != 1 {
+		t.Fatalf("Expected histogram [2 1] but found %v: %v", histogram, err)
+	}
+
 	time.Sleep(time.Millisecond * 100)
 	keys, err = client.KeysBy("")
 	if err != nil || len(keys) != 1 {
 		t.Fatalf("Expected 1 key but found %d: %v", len(keys), err)
 	}
 
+	large := strings.Repeat("0123456789abcdef", 1<<16)
+	_, err = client.Upsert("large", large)
+	if err != nil {
+		t.Fatalf("Expected to write a 1MB value but got %q", err)
+	}
+
+	readValue, present, err = client.Read("large")
+	if err != nil || !present || readValue != large {
+		t.Fatalf("Expected to read back the 1MB value unchanged but got %d bytes: %q", len(readValue), err)
+	}
+
+	stats, err := client.Stats()
+	if err != nil || stats["keys"] != int64(len(keys)+1) {
+		t.Fatalf("Expected STATS to count %d keys but got %v: %q", len(keys)+1, stats, err)
+	}
+
+	newest, err := client.NewestKeys(1)
+	if err != nil || len(newest) != 1 || newest[0] != "large" {
+		t.Fatalf("Expected the newest key to be %q but found %v: %q", "large", newest, err)
+	}
+
+	oldest, err := client.OldestKeys(100)
+	if err != nil || len(oldest) != len(keys)+1 || oldest[len(oldest)-1] != "large" {
+		t.Fatalf("Expected every key oldest first ending with %q but found %v: %q", "large", oldest, err)
+	}
+
+	presence, err := client.PresentMulti([]string{"large", "missing", "large"})
+	if err != nil || len(presence) != 3 || !presence[0] || presence[1] || !presence[2] {
+		t.Fatalf("Expected presence [true false true] but found %v: %q", presence, err)
+	}
+
+	batch := make([]string, maxExistsBatch*2+1)
+	for i := range batch {
+		batch[i] = "missing"
+	}
+	batch[maxExistsBatch] = "large"
+	presence, err = client.PresentMulti(batch)
+	if err != nil || len(presence) != len(batch) || !presence[maxExistsBatch] || presence[maxExistsBatch-1] || presence[len(batch)-1] {
+		t.Fatalf("Expected a batch split across requests to find only %q but got %d results: %q", "large", len(presence), err)
+	}
+
+	presence, err = client.PresentMulti(nil)
+	if err != nil || len(presence) != 0 {
+		t.Fatalf("Expected an empty batch to find nothing but found %v: %q", presence, err)
+	}
+
+	client.Insert("lock:job42", "holder1")
+	deleted, actual, err := client.DeleteIfEquals("lock:job42", "holder2")
+	if err != nil || deleted || actual != "holder1" {
+		t.Fatalf("Expected a mismatch reporting %q but got deleted=%t, %q: %q", "holder1", deleted, actual, err)
+	}
+
+	deleted, actual, err = client.DeleteIfEquals("lock:job42", "holder1")
+	if err != nil || !deleted || actual != "holder1" {
+		t.Fatalf("Expected the lock to be released but got deleted=%t, %q: %q", deleted, actual, err)
+	}
+
+	deleted, actual, err = client.DeleteIfEquals("lock:job42", "holder1")
+	if err != nil || deleted || actual != "" {
+		t.Fatalf("Expected a released lock to be absent but got deleted=%t, %q: %q", deleted, actual, err)
+	}
+
+	value, existed, err := client.GetOrSetWithTTL("config:theme", "dark", time.Hour)
+	if err != nil || existed || value != "dark" {
+		t.Fatalf("Expected the default to be inserted but got %q, existed=%t: %q", value, existed, err)
+	}
+	expiration, _, _ = client.ReadExpiration("config:theme")
+	if expiration.Before(time.Now().Add(time.Minute*59)) || expiration.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("Expected the inserted default to expire in an hour but found %s", expiration)
+	}
+
+	value, existed, err = client.GetOrSet("config:theme", "light")
+	if err != nil || !existed || value != "dark" {
+		t.Fatalf("Expected the stored value back but got %q, existed=%t: %q", value, existed, err)
+	}
+
 	err = runningServer.Stop()
 	if err != nil {
 		t.Fatalf("Got an error shutting down server %q", err)
 	}
 }
+
+func TestReadStaleServesRecentlyExpiredKeys(t *testing.T) {
+	runningServer := server.New("localhost", 8910, server.WithStaleWindow(time.Minute))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8910)
+	client.Upsert("key", "abc123")
+
+	value, stale, present, err := client.ReadStale("key", time.Minute)
+	if err != nil || value != "abc123" || stale || !present {
+		t.Fatalf("Expected to read the fresh value but found %q stale %t present %t: %q", value, stale, present, err)
+	}
+
+	client.Expire("key", time.Now().Add(-time.Second))
+	// another write runs the cleanup, which must keep the key inside the server's stale window
+	client.Upsert("other", "def456")
+	time.Sleep(time.Millisecond * 100)
+
+	_, present, err = client.Read("key")
+	if err != nil || present {
+		t.Fatalf("Expected a normal read to miss the expired key: %q", err)
+	}
+
+	value, stale, present, err = client.ReadStale("key", time.Minute)
+	if err != nil || value != "abc123" || !stale || !present {
+		t.Fatalf("Expected to read the stale value but found %q stale %t present %t: %q", value, stale, present, err)
+	}
+
+	_, _, present, err = client.ReadStale("key", time.Millisecond)
+	if err != nil || present {
+		t.Fatalf("Expected a key expired for longer than the window to be absent: %q", err)
+	}
+}
+
+func TestReadWithStatusTellsExpiredKeysFromMissingOnes(t *testing.T) {
+	runningServer := server.New("localhost", 8929, server.WithStaleWindow(time.Minute))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8929)
+	client.Upsert("key", "abc123")
+
+	value, status, err := client.ReadWithStatus("key")
+	if err != nil || value != "abc123" || status != KeyLive {
+		t.Fatalf("Expected to read the live value but found %q with status %s: %q", value, status, err)
+	}
+
+	value, status, err = client.ReadWithStatus("never")
+	if err != nil || value != "" || status != KeyMissing {
+		t.Fatalf("Expected a key never written to be missing but found %q with status %s: %q", value, status, err)
+	}
+
+	client.Expire("key", time.Now().Add(-time.Second))
+	value, status, err = client.ReadWithStatus("key")
+	if err != nil || value != "" || status != KeyExpired {
+		t.Fatalf("Expected the expired key to be reported expired but found %q with status %s: %q", value, status, err)
+	}
+}
+
+func TestKeysBySplitIntoFramesIsReassembled(t *testing.T) {
+	runningServer := server.New("localhost", 8930, server.WithMaxResponseFrame(512))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8930)
+	local := engine.NewDataStore()
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("user:%d:%s", i, strings.Repeat("x", i%40))
+		client.Upsert(key, "1")
+		local.Upsert(key, "1")
+	}
+
+	keys, err := client.KeysBy("user")
+	expected := local.KeysBy("user")
+	sort.Strings(keys)
+	sort.Strings(expected)
+	if err != nil || strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected the split response to be reassembled into all %d keys but got %d: %q", len(expected), len(keys), err)
+	}
+
+	// the connection is still in step with the server after reading every frame
+	count, err := client.Count()
+	if err != nil || count != 300 {
+		t.Fatalf("Expected to count 300 keys after the split response but got %d: %q", count, err)
+	}
+}
+
+func TestEmptyResultsOverTheWire(t *testing.T) {
+	runningServer := server.New("localhost", 8912)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8912)
+
+	count, err := client.Count()
+	if err != nil || count != 0 {
+		t.Fatalf("Expected a count of 0 but found %d: %q", count, err)
+	}
+
+	deleted, err := client.DeleteBy("missing")
+	if err != nil || deleted != 0 {
+		t.Fatalf("Expected to delete 0 keys but deleted %d: %q", deleted, err)
+	}
+
+	expired, err := client.ExpireBy("missing", time.Now().Add(time.Minute))
+	if err != nil || expired != 0 {
+		t.Fatalf("Expected to expire 0 keys but expired %d: %q", expired, err)
+	}
+
+	lists := map[string]func() (int, bool, error){
+		"keys by": func() (int, bool, error) {
+			keys, err := client.KeysBy("missing")
+			return len(keys), keys == nil, err
+		},
+		"complete": func() (int, bool, error) {
+			completions, err := client.CompleteKeyPrefix("missing", 0)
+			return len(completions), completions == nil, err
+		},
+		"export": func() (int, bool, error) {
+			exported, err := client.Export("missing")
+			return len(exported), exported == nil, err
+		},
+		"newest": func() (int, bool, error) {
+			newest, err := client.NewestKeys(10)
+			return len(newest), newest == nil, err
+		},
+	}
+
+	for name, list := range lists {
+		length, isNil, err := list()
+		if err != nil || length != 0 || isNil {
+			t.Fatalf("%s: expected an empty non-nil result but found %d results, nil %t: %q", name, length, isNil, err)
+		}
+	}
+}
+
+func TestClampedExpireReportsAWarning(t *testing.T) {
+	runningServer := server.New("localhost", 8925, server.WithTTLPolicy(engine.TTLRule{Prefix: "session", MaxTTL: time.Hour}))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	var warnings []string
+	client := New("localhost", 8925, WithWarningListener(func(command wire.Command, warning Warning) {
+		warnings = append(warnings, fmt.Sprintf("%s %s", command, warning.Code))
+	}))
+	client.Insert("session:1", "abc123")
+
+	changed, err := client.Expire("session:1", time.Now().Add(time.Hour*2))
+	if err != nil || !changed {
+		t.Fatalf("Expected the clamped expire to still succeed but got %q", err)
+	}
+	if strings.Join(warnings, ",") != "EXPIRE TTLCLAMPED" {
+		t.Fatalf("Expected a TTLCLAMPED warning for the EXPIRE but found %q", warnings)
+	}
+
+	expiration, present, _ := client.ReadExpiration("session:1")
+	if !present || expiration.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("Expected the expiration to be clamped to an hour but found %s", expiration)
+	}
+
+	client.Expire("session:1", time.Now().Add(time.Minute))
+	if len(warnings) != 1 {
+		t.Fatalf("Expected no warning for an expiration within the TTL rule but found %q", warnings)
+	}
+
+	// a client without a listener never says HELLO and gets the plain response
+	legacy := New("localhost", 8925)
+	changed, err = legacy.Expire("session:1", time.Now().Add(time.Hour*2))
+	if err != nil || !changed {
+		t.Fatalf("Expected the clamped expire to succeed without warnings but got %q", err)
+	}
+}
+
+func benchmarkPresence(b *testing.B, port int, check func(client *Client, keys []string)) {
+	runningServer := server.New("localhost", port)
+	err := runningServer.Start()
+	if err != nil {
+		b.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", port)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		if i%2 == 0 {
+			client.Insert(keys[i], "abc123")
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		check(&client, keys)
+	}
+}
+
+func BenchmarkPresentEachKey(b *testing.B) {
+	benchmarkPresence(b, 8908, func(client *Client, keys []string) {
+		for _, key := range keys {
+			client.Present(key)
+		}
+	})
+}
+
+func BenchmarkPresentMulti(b *testing.B) {
+	benchmarkPresence(b, 8909, func(client *Client, keys []string) {
+		client.PresentMulti(keys)
+	})
+}
+
+func TestHashFields(t *testing.T) {
+	runningServer := server.New("localhost", 8941, server.WithMaxResponseFrame(512))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8941)
+	created, err := client.HSet("user:1", "name", "ada")
+	if err != nil || !created {
+		t.Fatalf("Expected the field to be created but got %t: %q", created, err)
+	}
+	if created, err := client.HSet("user:1", "name", "grace"); err != nil || created {
+		t.Fatalf("Expected the field to be replaced but got %t: %q", created, err)
+	}
+	if value, present, err := client.HGet("user:1", "name"); err != nil || !present || value != "grace" {
+		t.Fatalf("Expected to read the field but got %q, %t: %q", value, present, err)
+	}
+
+	// more fields than fit in one response frame
+	for i := 0; i < 200; i++ {
+		client.HSet("user:1", fmt.Sprintf("field:%d", i), strings.Repeat("x", i%40))
+	}
+	fields, err := client.HGetAll("user:1")
+	if err != nil || len(fields) != 201 || fields["field:39"] != strings.Repeat("x", 39) {
+		t.Fatalf("Expected the split response to be reassembled into all 201 fields but got %d: %q", len(fields), err)
+	}
+	if length, err := client.HLen("user:1"); err != nil || length != 201 {
+		t.Fatalf("Expected 201 fields but got %d: %q", length, err)
+	}
+	if deleted, err := client.HDel("user:1", "name"); err != nil || !deleted {
+		t.Fatalf("Expected the field to be deleted but got %t: %q", deleted, err)
+	}
+
+	if _, _, err := client.Read("user:1"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected reading a hash as a string to fail with ErrWrongType but got %q", err)
+	}
+	client.Insert("plain", "1")
+	if _, err := client.HSet("plain", "name", "ada"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected setting a field of a string to fail with ErrWrongType but got %q", err)
+	}
+}
+
+func TestStoreFullIsASentinel(t *testing.T) {
+	runningServer := server.New("localhost", 8942, server.WithWaterMarks(engine.WaterMarks{HighKeys: 1}))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8942)
+	client.Insert("a", "1")
+	if _, err := client.Insert("b", "1"); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("Expected the insert over the high-water mark to fail with ErrStoreFull but got %q", err)
+	}
+	if _, err := client.Delete("a"); err != nil {
+		t.Fatalf("Expected deletes to succeed while the store is full but got %q", err)
+	}
+	if inserted, err := client.Insert("b", "1"); err != nil || !inserted {
+		t.Fatalf("Expected the insert to succeed once the key was deleted but got %q", err)
+	}
+}
+
+func TestInsertManySkipsKeysAlreadyPresent(t *testing.T) {
+	runningServer := server.New("localhost", 8944, server.WithProtectedPrefixes("system"))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8944)
+	client.Insert("b", "old")
+
+	inserted, err := client.InsertMany(map[string]string{"a": "1", "b": "2", "c": "3"})
+	if err != nil || inserted != 2 {
+		t.Fatalf("Expected 2 keys to be inserted but got %d: %q", inserted, err)
+	}
+	if value, _, _ := client.Read("b"); value != "old" {
+		t.Fatalf("Expected the key already present to be left alone but read %q", value)
+	}
+
+	if inserted, err := client.InsertMany(nil); err != nil || inserted != 0 {
+		t.Fatalf("Expected an empty batch to insert nothing but got %d: %q", inserted, err)
+	}
+	if _, err := client.InsertMany(map[string]string{"d": "4", "system:d": "4"}); !errors.Is(err, ErrProtected) {
+		t.Fatalf("Expected a batch with a protected key to fail with ErrProtected but got %q", err)
+	}
+
+	entries := map[string]string{}
+	for i := 0; i < maxInsertBatch+10; i++ {
+		entries[fmt.Sprintf("bulk:%05d", i)] = "1"
+	}
+	if inserted, err := client.InsertMany(entries); err != nil || inserted != len(entries) {
+		t.Fatalf("Expected a batch larger than one request to be inserted whole but got %d: %q", inserted, err)
+	}
+	if count, _ := client.Count(); count != 3+len(entries) {
+		t.Fatalf("Expected %d keys but found %d", 3+len(entries), count)
+	}
+}
+
+func TestReadManyReturnsOnlyPresentKeys(t *testing.T) {
+	runningServer := server.New("localhost", 8945, server.WithMaxResponseFrame(512))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8945)
+	client.Insert("a", "1")
+	client.Insert("empty", "")
+	client.HSet("hash", "field", "1")
+
+	values, err := client.ReadMany([]string{"a", "empty", "missing", "hash"})
+	if err != nil || len(values) != 2 || values["a"] != "1" {
+		t.Fatalf("Expected the two string keys but found %v: %q", values, err)
+	}
+	if value, present := values["empty"]; !present || value != "" {
+		t.Fatalf("Expected the key holding the empty string to be returned")
+	}
+
+	// enough values to split the response into CONTINUED frames
+	keys := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("bulk:%03d", i)
+		client.Insert(key, strings.Repeat("v", 20))
+		keys = append(keys, key)
+	}
+	values, err = client.ReadMany(keys)
+	if err != nil || len(values) != 100 {
+		t.Fatalf("Expected every key of a split response but found %d: %q", len(values), err)
+	}
+
+	if values, err := client.ReadMany(nil); err != nil || len(values) != 0 {
+		t.Fatalf("Expected reading no keys to return none but found %v: %q", values, err)
+	}
+}
+
+func TestExpireInCountsFromTheServerClock(t *testing.T) {
+	runningServer := server.New("localhost", 8949)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8949)
+	client.Insert("session", "1")
+	client.Insert("gone", "1")
+
+	if changed, err := client.ExpireIn("session", time.Hour); err != nil || !changed {
+		t.Fatalf("Expected the key to be given an expiration but got %q", err)
+	}
+	if expiration, _, _ := client.ReadExpiration("session"); time.Until(expiration) < time.Minute*59 || time.Until(expiration) > time.Hour {
+		t.Fatalf("Expected the key to expire in an hour but found %s", expiration)
+	}
+
+	if changed, err := client.ExpireIn("gone", 0); err != nil || !changed {
+		t.Fatalf("Expected a ttl of zero to be applied but got %q", err)
+	}
+	if _, present, _ := client.Read("gone"); present {
+		t.Fatalf("Expected a ttl of zero to expire the key straight away")
+	}
+	if _, err := client.ExpireIn("missing", time.Hour); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected ErrKeyNotFound for a key that is not present but got %q", err)
+	}
+}
+
+func TestCountersOverTheWire(t *testing.T) {
+	runningServer := server.New("localhost", 8950)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8950)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for j := 0; j < 20; j++ {
+				client.Increment("requests", 2)
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	if value, err := client.Decrement("requests", 1); err != nil || value != 399 {
+		t.Fatalf("Expected every increment from every goroutine to count but got %d: %q", value, err)
+	}
+
+	client.Insert("word", "abc")
+	if _, err := client.Increment("word", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("Expected ErrNotInteger for a value that is not a number but got %q", err)
+	}
+}
+
+func TestReadAndDeletePopsEachValueOnce(t *testing.T) {
+	runningServer := server.New("localhost", 8951)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8951)
+	client.Insert("queue:job", "payload")
+
+	var popped int32
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			if value, present, err := client.ReadAndDelete("queue:job"); err == nil && present && value == "payload" {
+				atomic.AddInt32(&popped, 1)
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	if popped != 1 {
+		t.Fatalf("Expected exactly one client to pop the value but %d did", popped)
+	}
+	if _, present, err := client.ReadAndDelete("queue:job"); err != nil || present {
+		t.Fatalf("Expected the popped key to be gone but got %q", err)
+	}
+}
+
+func TestReadAndUpdateReturnsTheReplacedValue(t *testing.T) {
+	runningServer := server.New("localhost", 8960)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8960)
+	client.Insert("config:theme", "dark")
+
+	oldValue, present, err := client.ReadAndUpdate("config:theme", "light")
+	if err != nil || !present || oldValue != "dark" {
+		t.Fatalf("Expected to read the replaced value dark but got %q, %t: %q", oldValue, present, err)
+	}
+	if value, _, _ := client.Read("config:theme"); value != "light" {
+		t.Fatalf("Expected the key to hold the new value but found %q", value)
+	}
+	if _, present, err := client.ReadAndUpdate("config:missing", "light"); err != nil || present {
+		t.Fatalf("Expected a missing key to be reported absent but got %t: %q", present, err)
+	}
+}
+
+func TestReadByFetchesValuesInOneRequest(t *testing.T) {
+	runningServer := server.New("localhost", 8952, server.WithMaxResponseFrame(512))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8952)
+	for i := 0; i < 100; i++ {
+		client.Insert(fmt.Sprintf("user:%03d", i), strings.Repeat("v", 20))
+	}
+	client.Insert("other", "1")
+	client.Insert("user:expired", "1")
+	client.Expire("user:expired", time.Now().Add(-time.Second))
+
+	values, err := client.ReadBy("user")
+	if err != nil || len(values) != 100 || values["user:042"] != strings.Repeat("v", 20) {
+		t.Fatalf("Expected the 100 live keys under the prefix across split frames but found %d: %q", len(values), err)
+	}
+
+	if values, err := client.ReadBy(""); err != nil || len(values) != 101 {
+		t.Fatalf("Expected an empty prefix to read every live key but found %d: %q", len(values), err)
+	}
+}
+
+func TestUpdateByRewritesEveryKeyUnderAPrefix(t *testing.T) {
+	runningServer := server.New("localhost", 8953)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8953)
+	client.Insert("flag:a", "off")
+	client.Insert("flag:b", "off")
+	client.Insert("other", "off")
+
+	if updated, err := client.UpdateBy("flag", "on"); err != nil || updated != 2 {
+		t.Fatalf("Expected 2 keys to be updated but got %d: %q", updated, err)
+	}
+	values, err := client.ReadBy("")
+	if err != nil || values["flag:a"] != "on" || values["flag:b"] != "on" || values["other"] != "off" {
+		t.Fatalf("Expected only the keys under the prefix to change but read %v: %q", values, err)
+	}
+}
+
+func TestCountByCountsKeysUnderAPrefix(t *testing.T) {
+	runningServer := server.New("localhost", 8954)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8954)
+	client.Insert("region:1", "1")
+	client.Insert("region:2", "1")
+	client.Insert("region:3", "1")
+	client.Expire("region:3", time.Now().Add(-time.Second))
+	client.Insert("other", "1")
+
+	if count, err := client.CountBy("region"); err != nil || count != 2 {
+		t.Fatalf("Expected 2 live keys under the prefix but counted %d: %q", count, err)
+	}
+	if count, err := client.CountBy("missing"); err != nil || count != 0 {
+		t.Fatalf("Expected no keys under a prefix matching nothing but counted %d: %q", count, err)
+	}
+}
+
+func TestBinaryValuesRoundTripThroughTheServer(t *testing.T) {
+	runningServer := server.New("localhost", 8955)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	blob := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(blob)
+	values := map[string][]byte{
+		"nul":       {0x00, 'a', 0x00, 0x00},
+		"separator": {0x7C, 0x04, 0x00, 0x00, 0x00, 0x7C, 'R', 'E', 'A', 'D'},
+		"invalid":   {0xff, 0xfe, 0x7C, 0xc3},
+		"utf8":      []byte("héllo|wörld 日本"),
+		"empty":     {},
+		"blob":      blob,
+	}
+
+	client := New("localhost", 8955)
+	for key, value := range values {
+		if inserted, err := client.InsertBytes("bin|"+key, value); err != nil || !inserted {
+			t.Fatalf("Expected %s to be inserted but got %q", key, err)
+		}
+	}
+	for key, value := range values {
+		read, present, err := client.ReadBytes("bin|" + key)
+		if err != nil || !present || !bytes.Equal(read, value) {
+			t.Fatalf("Expected %s to read back the %d bytes written but read %d: %q", key, len(value), len(read), err)
+		}
+	}
+
+	if read, present, err := client.ReadBytes("bin|missing"); err != nil || present || read != nil {
+		t.Fatalf("Expected a missing key to read as nil but got %v: %q", read, err)
+	}
+}
+
+func TestResponsesAreBoundByTheMaximumMessageSize(t *testing.T) {
+	runningServer := server.New("localhost", 8957)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8957)
+	if _, err := client.Insert("large", strings.Repeat("v", 2048)); err != nil {
+		t.Fatalf("Error inserting %q", err)
+	}
+
+	bounded := New("localhost", 8957, WithMaxMessageSize(1024))
+	if _, _, err := bounded.Read("large"); !errors.Is(err, ErrMalformedResponse) {
+		t.Fatalf("Expected a response past the maximum to be refused but got %q", err)
+	}
+
+	// the server keeps to the same default bound, so a value past it is refused rather than allocated
+	if _, err := client.Insert("huge", strings.Repeat("v", wire.DefaultMaxMessageSize)); err == nil {
+		t.Fatalf("Expected a request past the default maximum to fail")
+	}
+	if present, err := client.Present("huge"); err != nil || present {
+		t.Fatalf("Expected the refused value not to be stored but got %t: %q", present, err)
+	}
+}
+
+func TestScanPagesThroughTheKeysOfTheServer(t *testing.T) {
+	runningServer := server.New("localhost", 8958)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8958)
+	entries := map[string]string{}
+	for i := 0; i < 100_000; i++ {
+		entries[fmt.Sprintf("scan:%d:key:%d", i%100, i)] = "1"
+	}
+	if inserted, err := client.InsertMany(entries); err != nil || inserted != len(entries) {
+		t.Fatalf("Expected %d keys to be inserted but inserted %d: %q", len(entries), inserted, err)
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for {
+		keys, next, err := client.Scan("scan", cursor, 1000)
+		if err != nil || len(keys) > 1000 {
+			t.Fatalf("Expected a page of at most 1000 keys but found %d: %q", len(keys), err)
+		}
+		for _, key := range keys {
+			if seen[key] {
+				t.Fatalf("Expected %q to be returned once but it was returned again", key)
+			}
+			seen[key] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(seen) != len(entries) {
+		t.Fatalf("Expected the scan to return all %d keys but found %d", len(entries), len(seen))
+	}
+}
+
+func TestKeysMatchingFindsKeysByGlobPattern(t *testing.T) {
+	runningServer := server.New("localhost", 8959)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8959)
+	client.Insert("region:1:store:1:employee:2", "1")
+	client.Insert("region:1:store:2:employee:2", "1")
+	client.Insert("region:1:store:2:employee:3", "1")
+	client.Insert("rate*limit", "1")
+
+	keys, err := client.KeysMatching("region:1:store:*:employee:2")
+	if err != nil || !reflect.DeepEqual(keys, []string{"region:1:store:1:employee:2", "region:1:store:2:employee:2"}) {
+		t.Fatalf("Expected the employee in both stores to match but found %v: %q", keys, err)
+	}
+	if keys, err := client.KeysMatching(`rate\*limit`); err != nil || !reflect.DeepEqual(keys, []string{"rate*limit"}) {
+		t.Fatalf("Expected an escaped star to match the key spelling it out but found %v: %q", keys, err)
+	}
+	if keys, err := client.KeysMatching("missing*"); err != nil || len(keys) != 0 {
+		t.Fatalf("Expected a pattern matching nothing to find no keys but found %v: %q", keys, err)
+	}
+}
+
+func TestClientsOnDifferentDatabasesDoNotSeeEachOthersKeys(t *testing.T) {
+	runningServer := server.New("localhost", 8965, server.WithLogger(nil))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	billing := New("localhost", 8965, WithDatabase("billing"))
+	defer billing.Close()
+	search := New("localhost", 8965, WithDatabase("search"))
+	defer search.Close()
+	fallback := New("localhost", 8965)
+	defer fallback.Close()
+
+	billing.Insert("config", "billing")
+	search.Insert("config", "search")
+	search.Insert("index", "1")
+	fallback.Insert("config", "default")
+
+	for client, expected := range map[*Client]string{&billing: "billing", &search: "search", &fallback: "default"} {
+		if value, _, err := client.Read("config"); err != nil || value != expected {
+			t.Fatalf("Expected config to be %q in the client's database but read %q: %q", expected, value, err)
+		}
+	}
+	if present, _ := billing.Present("index"); present {
+		t.Fatalf("Expected a key of one database to be missing from another")
+	}
+
+	if _, err := search.Truncate(); err != nil {
+		t.Fatalf("Expected TRUNCATE to succeed but got %q", err)
+	}
+	if count, _ := billing.Count(); count != 1 {
+		t.Fatalf("Expected TRUNCATE to leave other databases alone but billing has %d keys", count)
+	}
+
+	dropped, err := fallback.DropDatabase("billing")
+	if err != nil || !dropped {
+		t.Fatalf("Expected the billing database to be dropped but got %t: %q", dropped, err)
+	}
+	if present, _ := billing.Present("config"); present {
+		t.Fatalf("Expected the dropped database to come back empty")
+	}
+	if dropped, err = fallback.DropDatabase("missing"); err != nil || dropped {
+		t.Fatalf("Expected dropping a database that does not exist to return false but got %t: %q", dropped, err)
+	}
+}
+
+func TestInfoDescribesTheServer(t *testing.T) {
+	runningServer := server.New("localhost", 8968)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", 8968)
+	defer client.Close()
+	client.Insert("a", "1")
+
+	info, err := client.Info()
+	if err != nil || info["version"] != server.Version || info["port"] != "8968" || info["keys"] != "1" || info["connections"] != "1" {
+		t.Fatalf("Expected INFO to describe the server with one key and one connection but got %v: %q", info, err)
+	}
+}
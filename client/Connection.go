@@ -0,0 +1,483 @@
+package client
+
+import (
+	"context"
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxSendAttempts bounds how many connections a single request is tried on when the server recycles them
+const maxSendAttempts = 3
+
+type pooledConnection struct {
+	connection net.Conn
+	frames     *wire.FrameReader
+	writer     *wire.FrameWriter
+}
+
+// connectionPool
+/**
+* Idle connections to the server that can be reused for the next request instead of dialing a new one
+*
+* At most maxIdle connections are kept, zero keeps every one, and once the pool is closed every connection handed back
+* is closed instead. The pool is held by pointer so copies of a Client share it.
+ */
+type connectionPool struct {
+	mutex   sync.Mutex
+	idle    []*pooledConnection
+	maxIdle int
+	closed  bool
+}
+
+func (p *connectionPool) get() *pooledConnection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.idle) == 0 {
+		return nil
+	}
+
+	pooled := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return pooled
+}
+
+func (p *connectionPool) put(pooled *pooledConnection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed || (p.maxIdle > 0 && len(p.idle) >= p.maxIdle) {
+		pooled.connection.Close()
+		return
+	}
+	p.idle = append(p.idle, pooled)
+}
+
+// close closes every idle connection and every connection handed back from now on
+func (p *connectionPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	for _, pooled := range p.idle {
+		pooled.connection.Close()
+	}
+	p.idle = nil
+}
+
+func (c *Client) dial(trace *callTrace, e *endpoint) (*pooledConnection, error) {
+	trace.emit(Event{Kind: DialAttempt, Endpoint: e.Endpoint})
+	started := time.Now()
+	pooled, err := c.dialAndAuthenticate(e)
+	trace.emit(Event{Kind: DialResult, Endpoint: e.Endpoint, Duration: time.Since(started), Err: err})
+	return pooled, err
+}
+
+func (c *Client) dialAndAuthenticate(e *endpoint) (*pooledConnection, error) {
+	ctx, cancel := context.WithTimeout(c.requestContext(), c.timeout)
+	defer cancel()
+
+	connection, err := c.transport.DialContext(ctx, "tcp", e.String())
+	if err != nil {
+		if ctxErr := contextError(c.requestContext()); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	pooled := &pooledConnection{
+		connection: connection,
+		frames:     wire.NewFrameReader(connection, uint32(c.maxMessageSize)),
+		writer:     wire.NewFrameWriter(connection),
+	}
+
+	err = c.discover(e, pooled)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	if c.authToken != "" {
+		err = c.authenticate(pooled)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+
+	if c.database != "" {
+		err = c.selectDatabase(pooled)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+
+	if c.warningListener != nil {
+		err = c.hello(pooled)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+
+	return pooled, nil
+}
+
+// authenticate sends AUTH on a new connection so every request made on it runs in an admin session
+func (c *Client) authenticate(pooled *pooledConnection) error {
+	authCommand, err := c.wire.EncodeMessage(wire.AUTH, c.authToken)
+	if err != nil {
+		return err
+	}
+
+	responseCommand, responseMessage, _, err := c.roundTrip(pooled, authCommand)
+	if err != nil {
+		return err
+	}
+
+	switch responseCommand {
+	case wire.ACK:
+		return nil
+	case wire.ERR:
+		return c.wire.DecodeError(responseMessage)
+	default:
+		return unexpectedResponse(wire.AUTH, responseCommand)
+	}
+}
+
+// selectDatabase sends SELECTDB on a new connection so every request made on it runs in the client's database
+func (c *Client) selectDatabase(pooled *pooledConnection) error {
+	selectCommand, err := c.wire.EncodeMessage(wire.SELECTDB, c.database)
+	if err != nil {
+		return err
+	}
+
+	responseCommand, responseMessage, _, err := c.roundTrip(pooled, selectCommand)
+	if err != nil {
+		return err
+	}
+
+	switch responseCommand {
+	case wire.ACK:
+		return nil
+	case wire.ERR:
+		return c.wire.DecodeError(responseMessage)
+	default:
+		return unexpectedResponse(wire.SELECTDB, responseCommand)
+	}
+}
+
+// hello announces the protocol version on a new connection so the server sends warnings on it, a server that does not
+// know HELLO answers with an ERR and is left speaking version 1
+func (c *Client) hello(pooled *pooledConnection) error {
+	helloCommand, err := c.wire.EncodeMessage(wire.HELLO, strconv.Itoa(wire.ProtocolVersion))
+	if err != nil {
+		return err
+	}
+
+	responseCommand, responseMessage, _, err := c.roundTrip(pooled, helloCommand)
+	if err != nil {
+		return err
+	}
+
+	switch responseCommand {
+	case wire.HELLO:
+		_, err = c.wire.DecodeHelloResponse(responseMessage)
+		if err != nil {
+			return malformedResponse(err)
+		}
+		return nil
+	case wire.ERR:
+		return nil
+	default:
+		return unexpectedResponse(wire.HELLO, responseCommand)
+	}
+}
+
+// connectAndSendMessage
+/**
+* Send a message to the endpoint it is routed to and read the response
+*
+* Write commands, as marked in the wire spec, always go to the primary. Reads go where the routing policy chooses, and a
+* read that fails on a replica marks it unhealthy and is sent to the primary instead. Everything a Session sends goes
+* to the primary over the session's own connection. Calls that fail to reach the server are retried as the client's
+* RetryPolicy allows.
+ */
+func (c *Client) connectAndSendMessage(message []byte) (wire.Command, []byte, error) {
+	trace := c.newTrace()
+	started := time.Now()
+
+	responseCommand, responseMessage, err := c.sendWithPolicy(trace, message)
+	if trace != nil {
+		command, _ := c.wire.DecipherCommand(message)
+		trace.finish(command, started, err)
+	}
+	return responseCommand, responseMessage, err
+}
+
+// route sends a message to the endpoint chosen for it, see connectAndSendMessage
+func (c *Client) route(trace *callTrace, message []byte) (wire.Command, []byte, error) {
+	command, err := c.wire.DecipherCommand(message)
+	if err != nil || wire.IsWrite(command) || len(c.endpoints) == 1 {
+		return c.sendTo(trace, c.primary(), message)
+	}
+
+	target := c.chooseReadEndpoint()
+	responseCommand, responseMessage, err := c.sendTo(trace, target, message)
+	// a request the caller gave up on says nothing about the replica, and the primary would not be given time either
+	if err != nil && target != c.primary() && contextError(c.requestContext()) == nil {
+		target.markUnhealthy()
+		trace.emit(Event{Kind: FailoverToEndpoint, Endpoint: c.primary().Endpoint, Err: err})
+		return c.sendTo(trace, c.primary(), message)
+	}
+
+	return responseCommand, responseMessage, err
+}
+
+// sendTo
+/**
+* Send a message to one endpoint and read the response, reusing an idle connection when one is available
+*
+* A request is retried on a new connection when the server did not process it: when the connection was recycled, or
+* when a reused connection turned out to have been closed by the server before anything was read from it. Any other
+* failure closes the connection and is returned, so a connection left in an unknown state is never reused.
+*
+* Requests are refused without contacting the endpoint while its circuit breaker is open.
+ */
+func (c *Client) sendTo(trace *callTrace, e *endpoint, message []byte) (wire.Command, []byte, error) {
+	return c.sendThrough(trace, e, e.connections, message)
+}
+
+// sendThrough sends a message to one endpoint like sendTo, taking and returning connections from the provided pool
+func (c *Client) sendThrough(trace *callTrace, e *endpoint, connections *connectionPool, message []byte) (wire.Command, []byte, error) {
+	err := e.breaker.allow(trace)
+	if err != nil {
+		return wire.ERR, nil, err
+	}
+
+	responseCommand, responseMessage, err := c.sendWithRetries(trace, e, connections, message)
+	recorded, _ := unwrapUnsent(err)
+	e.breaker.record(trace, recorded)
+	return responseCommand, responseMessage, err
+}
+
+func (c *Client) sendWithRetries(trace *callTrace, e *endpoint, connections *connectionPool, message []byte) (wire.Command, []byte, error) {
+	var err error
+	for attempt := 0; attempt < maxSendAttempts; attempt++ {
+		if ctxErr := contextError(c.requestContext()); ctxErr != nil {
+			return wire.ERR, nil, ctxErr
+		}
+		if attempt > 0 {
+			trace.emit(Event{Kind: RetryScheduled, Endpoint: e.Endpoint, Attempt: attempt + 1, Err: err})
+		}
+
+		pooled := connections.get()
+		reused := pooled != nil
+		if reused {
+			trace.emit(Event{Kind: ConnectionReused, Endpoint: e.Endpoint})
+		} else {
+			pooled, err = c.dial(trace, e)
+			if err != nil {
+				return wire.ERR, nil, &unsentError{err: err}
+			}
+		}
+
+		var responseCommand wire.Command
+		var responseMessage []byte
+		var unprocessed bool
+		responseCommand, responseMessage, unprocessed, err = c.roundTrip(pooled, message)
+		if err != nil {
+			pooled.connection.Close()
+			trace.emit(Event{Kind: ConnectionDiscarded, Endpoint: e.Endpoint, Err: err})
+			if reused && unprocessed {
+				continue
+			}
+			return wire.ERR, nil, err
+		}
+
+		if c.isRecycleNotice(responseCommand, responseMessage) {
+			pooled.connection.Close()
+			err = wire.ErrConnectionRecycled
+			trace.emit(Event{Kind: ConnectionDiscarded, Endpoint: e.Endpoint, Err: err})
+			continue
+		}
+
+		if c.recycleNoticeBuffered(pooled) {
+			pooled.connection.Close()
+			trace.emit(Event{Kind: ConnectionDiscarded, Endpoint: e.Endpoint, Err: wire.ErrConnectionRecycled})
+		} else {
+			connections.put(pooled)
+		}
+
+		return responseCommand, responseMessage, nil
+	}
+
+	return wire.ERR, nil, err
+}
+
+// roundTrip
+/**
+* Write a message and read its response, also reporting whether a failure means the server never saw the message
+*
+* The exchange has the client's timeout, or until the deadline of the client's context when that is sooner. Cancelling
+* the context interrupts the exchange at once, returning the context's error, and leaves the connection unusable.
+ */
+func (c *Client) roundTrip(pooled *pooledConnection, message []byte) (wire.Command, []byte, bool, error) {
+	ctx := c.requestContext()
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		return wire.ERR, nil, false, ctxErr
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, bounded := ctx.Deadline(); bounded && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err := pooled.connection.SetDeadline(deadline)
+	if err != nil {
+		return wire.ERR, nil, false, err
+	}
+
+	stop := interruptOnCancel(ctx, pooled.connection)
+	responseCommand, responseMessage, unprocessed, err := c.exchange(pooled, message)
+	stop()
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return wire.ERR, nil, false, ctxErr
+		}
+	}
+	return responseCommand, responseMessage, unprocessed, err
+}
+
+// exchange writes a message and reads its response for roundTrip, once the connection's deadline has been set
+func (c *Client) exchange(pooled *pooledConnection, message []byte) (wire.Command, []byte, bool, error) {
+	err := pooled.writer.WriteFrame(message)
+	if err != nil {
+		return wire.ERR, nil, true, err
+	}
+
+	return c.readResponse(pooled, message)
+}
+
+// readResponse reads the response to a message that was written, unwrapping warnings and joining split responses
+func (c *Client) readResponse(pooled *pooledConnection, message []byte) (wire.Command, []byte, bool, error) {
+	responseMessage, err := readFrame(pooled.frames)
+	if err != nil {
+		return wire.ERR, nil, errors.Is(err, io.EOF), err
+	}
+
+	responseCommand, err := c.wire.DecipherCommand(responseMessage)
+	if err != nil {
+		return wire.ERR, nil, false, malformedResponse(err)
+	}
+
+	if responseCommand == wire.WARN {
+		return c.unwrapWarnings(message, responseMessage)
+	}
+	if responseCommand == wire.CONTINUED {
+		return c.joinContinued(pooled, responseMessage)
+	}
+
+	return responseCommand, responseMessage, false, nil
+}
+
+// joinContinued reads the rest of a response the server split into CONTINUED frames and returns it as one message
+func (c *Client) joinContinued(pooled *pooledConnection, responseMessage []byte) (wire.Command, []byte, bool, error) {
+	var continued []string
+	var splitCommand wire.Command
+	responseCommand := wire.CONTINUED
+	for responseCommand == wire.CONTINUED {
+		command, arguments, err := c.wire.DecodeContinued(responseMessage)
+		if err != nil {
+			return wire.ERR, nil, false, malformedResponse(err)
+		}
+		if splitCommand != "" && command != splitCommand {
+			return wire.ERR, nil, false, malformedResponse(fmt.Errorf("a split %s response continued as %s", splitCommand, command))
+		}
+		splitCommand = command
+		continued = append(continued, arguments...)
+
+		responseMessage, err = readFrame(pooled.frames)
+		if err != nil {
+			return wire.ERR, nil, false, err
+		}
+		responseCommand, err = c.wire.DecipherCommand(responseMessage)
+		if err != nil {
+			return wire.ERR, nil, false, malformedResponse(err)
+		}
+	}
+
+	if responseCommand != splitCommand {
+		return wire.ERR, nil, false, malformedResponse(fmt.Errorf("a split %s response ended with %s", splitCommand, responseCommand))
+	}
+	joined, err := c.wire.JoinResponse(continued, responseMessage)
+	if err != nil {
+		return wire.ERR, nil, false, malformedResponse(err)
+	}
+
+	return responseCommand, joined, false, nil
+}
+
+// unwrapWarnings hands the warnings of a WARN response to the warning listener and returns the response it wraps
+func (c *Client) unwrapWarnings(message []byte, responseMessage []byte) (wire.Command, []byte, bool, error) {
+	wrapped, warnings, err := c.wire.DecodeWarnings(responseMessage)
+	if err != nil {
+		return wire.ERR, nil, false, malformedResponse(err)
+	}
+
+	responseCommand, err := c.wire.DecipherCommand(wrapped)
+	if err != nil {
+		return wire.ERR, nil, false, malformedResponse(err)
+	}
+
+	if c.warningListener != nil {
+		command, _ := c.wire.DecipherCommand(message)
+		for _, warning := range warnings {
+			c.warningListener(command, warning)
+		}
+	}
+
+	return responseCommand, wrapped, false, nil
+}
+
+func (c *Client) isRecycleNotice(responseCommand wire.Command, responseMessage []byte) bool {
+	return responseCommand == wire.ERR && errors.Is(c.wire.DecodeError(responseMessage), wire.ErrConnectionRecycled)
+}
+
+// recycleNoticeBuffered reports whether the server already sent a recycle notice after the response just read
+func (c *Client) recycleNoticeBuffered(pooled *pooledConnection) bool {
+	if pooled.frames.Buffered() == 0 {
+		return false
+	}
+
+	notice, err := readFrame(pooled.frames)
+	if err != nil {
+		return true
+	}
+
+	responseCommand, err := c.wire.DecipherCommand(notice)
+	return err != nil || c.isRecycleNotice(responseCommand, notice)
+}
+
+// readFrame
+/**
+* Read one length prefixed frame
+*
+* Returns io.EOF only when the connection closed before any of the frame arrived, io.ErrUnexpectedEOF when it closed
+* part way through, and ErrMalformedResponse when the declared length cannot be a valid frame.
+ */
+func readFrame(frames *wire.FrameReader) ([]byte, error) {
+	message, err := frames.ReadFrame()
+	var invalidSize *wire.FrameSizeError
+	if errors.As(err, &invalidSize) {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedResponse, err.Error())
+	}
+
+	return message, err
+}
@@ -0,0 +1,215 @@
+package client
+
+import (
+	"datastore/server"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectionsAreRecycledAfterMaxRequests(t *testing.T) {
+	runningServer := server.New("localhost", 8892, server.WithMaxRequestsPerConnection(3))
+	client := New("localhost", 8892)
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100) // give runningServer time to fully start
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Upsert("key", "value")
+		if err != nil {
+			t.Fatalf("Expected request %d to succeed across connection recycling but got %q", i, err)
+		}
+	}
+
+	value, present, err := client.Read("key")
+	if err != nil || !present || value != "value" {
+		t.Fatalf("Expected to read the value back but got %q: %q", value, err)
+	}
+
+	// 11 requests at 3 per connection need at least 4 connections
+	if runningServer.AcceptedConnections() < 4 {
+		t.Fatalf("Expected connections to be recycled but the server only accepted %d", runningServer.AcceptedConnections())
+	}
+	if runningServer.AcceptedConnections() > 6 {
+		t.Fatalf("Expected connections to be reused but the server accepted %d", runningServer.AcceptedConnections())
+	}
+}
+
+func TestConnectionsAreRecycledAfterMaxAge(t *testing.T) {
+	runningServer := server.New("localhost", 8893, server.WithMaxConnectionAge(time.Millisecond*50))
+	client := New("localhost", 8893)
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Upsert("key", "value")
+		if err != nil {
+			t.Fatalf("Expected request %d to succeed across connection recycling but got %q", i, err)
+		}
+		time.Sleep(time.Millisecond * 30)
+	}
+
+	if runningServer.AcceptedConnections() < 2 {
+		t.Fatalf("Expected old connections to be recycled but the server only accepted %d", runningServer.AcceptedConnections())
+	}
+}
+
+func TestAuthTokenAuthenticatesEveryConnection(t *testing.T) {
+	runningServer := server.New("localhost", 8898,
+		server.WithAdminToken("secret"),
+		server.WithProtectedPrefixes("system"),
+		server.WithMaxRequestsPerConnection(2))
+	admin := New("localhost", 8898, WithAuthToken("secret"))
+	anonymous := New("localhost", 8898)
+	impostor := New("localhost", 8898, WithAuthToken("guess"))
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	// recycling after every other request means most of these run on a freshly authenticated connection
+	for i := 0; i < 5; i++ {
+		_, err := admin.Upsert("system:config", fmt.Sprintf("%d", i))
+		if err != nil {
+			t.Fatalf("Expected admin write %d to succeed but got %q", i, err)
+		}
+	}
+
+	_, err = anonymous.Upsert("system:config", "anonymous")
+	if !errors.Is(err, ErrProtected) {
+		t.Fatalf("Expected an anonymous write under a protected prefix to fail with ErrProtected but got %q", err)
+	}
+
+	_, err = impostor.Upsert("region:1", "impostor")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected a client with the wrong token to fail with ErrUnauthorized but got %q", err)
+	}
+
+	_, err = admin.ConfigSet("protected-prefixes", "")
+	if err != nil {
+		t.Fatalf("Expected an admin CONFIG SET to succeed but got %q", err)
+	}
+
+	_, err = admin.ConfigSet("ttl-policy", "pii=24h,pii:ssn=1h:reject")
+	if err != nil {
+		t.Fatalf("Expected setting the TTL policy to succeed but got %q", err)
+	}
+
+	policy, err := admin.ConfigGet("ttl-policy")
+	if err != nil || policy != "pii=24h0m0s,pii:ssn=1h0m0s:reject" {
+		t.Fatalf("Expected CONFIG GET to return the TTL policy but got %q: %q", policy, err)
+	}
+
+	admin.Upsert("pii:ssn:1", "abc123")
+	_, err = admin.Expire("pii:ssn:1", time.Now().Add(time.Hour*2))
+	if !errors.Is(err, ErrTTLExceeded) {
+		t.Fatalf("Expected expiring past the TTL rule to fail with ErrTTLExceeded but got %q", err)
+	}
+
+	_, err = anonymous.ConfigGet("ttl-policy")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected an anonymous CONFIG GET to fail with ErrUnauthorized but got %q", err)
+	}
+
+	_, err = anonymous.Upsert("system:config", "anonymous")
+	if err != nil {
+		t.Fatalf("Expected the write to succeed once the prefix was unprotected but got %q", err)
+	}
+}
+
+func TestAuthTokenLetsClientsIntoAServerRequiringAuth(t *testing.T) {
+	runningServer := server.New("localhost", 8964, server.WithRequiredAuth("shared"), server.WithLogger(nil))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	anonymous := New("localhost", 8964)
+	defer anonymous.Close()
+	if _, err = anonymous.Insert("key", "1"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected a client without a token to fail with ErrUnauthorized but got %q", err)
+	}
+
+	impostor := New("localhost", 8964, WithAuthToken("guess"))
+	defer impostor.Close()
+	if _, err = impostor.Insert("key", "1"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected a client with the wrong token to fail with ErrUnauthorized but got %q", err)
+	}
+
+	client := New("localhost", 8964, WithAuthToken("shared"))
+	defer client.Close()
+	if _, err = client.Insert("key", "1"); err != nil {
+		t.Fatalf("Expected an authenticated insert to succeed but got %q", err)
+	}
+	value, present, err := client.Read("key")
+	if err != nil || !present || value != "1" {
+		t.Fatalf("Expected an authenticated read of 1 but got %q, %t: %q", value, present, err)
+	}
+	if present, _ := anonymous.Present("key"); present {
+		t.Fatalf("Expected a client without a token to be refused reads")
+	}
+}
+
+func TestConnectionsAreReusedUntilClose(t *testing.T) {
+	runningServer := server.New("localhost", 8946)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8946, WithMaxIdleConnections(2))
+	for i := 0; i < 20; i++ {
+		client.Upsert("key", "value")
+	}
+	if accepted := runningServer.AcceptedConnections(); accepted != 1 {
+		t.Fatalf("Expected sequential calls to share one connection but the server accepted %d", accepted)
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 20; j++ {
+				if _, _, err := client.Read("key"); err != nil {
+					t.Errorf("Expected concurrent reads to succeed but got %q", err)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	if idle := len(client.primary().connections.idle); idle > 2 {
+		t.Fatalf("Expected at most 2 idle connections to be kept but found %d", idle)
+	}
+
+	client.Close()
+	if idle := len(client.primary().connections.idle); idle != 0 {
+		t.Fatalf("Expected Close to release every idle connection but found %d", idle)
+	}
+
+	// a closed client still works, without keeping its connections
+	accepted := runningServer.AcceptedConnections()
+	if value, _, err := client.Read("key"); err != nil || value != "value" {
+		t.Fatalf("Expected a closed client to keep working but got %q: %q", value, err)
+	}
+	if len(client.primary().connections.idle) != 0 || runningServer.AcceptedConnections() != accepted+1 {
+		t.Fatalf("Expected a closed client to dial for the request and not keep the connection")
+	}
+}
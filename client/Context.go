@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// WithContext
+/**
+* Return a copy of the client whose requests are bound by ctx, sharing the client's connections, endpoints, and session
+* if it has one. For example client.WithContext(ctx).Read(key).
+*
+* Dialing, writing, and reading the response each stop as soon as ctx is cancelled or its deadline passes, and the call
+* returns ctx.Err() instead of waiting out the timeout. A request interrupted part way may still have been applied by
+* the server, and its connection is closed rather than reused. The timeout still applies when ctx has a later deadline
+* or none. Calls made through a Session wait for the session's earlier commands before ctx is looked at.
+ */
+func (c *Client) WithContext(ctx context.Context) *Client {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+// requestContext returns the context the client's requests are bound by, see WithContext
+func (c *Client) requestContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// contextError returns the error of ctx once it is done, counting its deadline as passed as soon as the clock reaches
+// it, since a connection deadline set from it can fire before the context notices
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, bounded := ctx.Deadline(); bounded && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// isContextError reports whether err is a request giving up because its context was cancelled or timed out
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// aLongTimeAgo is a deadline in the past, which makes reads and writes blocked on a connection return at once
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptOnCancel
+/**
+* Unblock reads and writes on connection as soon as ctx is cancelled, by moving its deadline into the past. The returned
+* function stops watching ctx and must be called once the exchange is over, it returns once the watcher has stopped so
+* it can no longer touch the connection.
+ */
+func interruptOnCancel(ctx context.Context, connection net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			connection.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"datastore/server"
+	"datastore/wire"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startStallingServer starts a server on port whose reads of the key "stall" wait until the test is over
+func startStallingServer(t *testing.T, port int) {
+	t.Helper()
+	release := make(chan struct{})
+	stalling := server.MiddlewareFuncs{Read: func(ctx server.ConnContext, op wire.Command, key string) (string, error) {
+		if key == "stall" {
+			<-release
+		}
+		return key, nil
+	}}
+
+	runningServer := server.New("localhost", port, server.WithMiddleware(stalling), server.WithLogger(nil))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	t.Cleanup(func() {
+		close(release)
+		runningServer.Stop()
+	})
+}
+
+// returnsWithin fails the test unless call returns within limit, and returns its error
+func returnsWithin(t *testing.T, limit time.Duration, call func() error) error {
+	t.Helper()
+	returned := make(chan error, 1)
+	go func() { returned <- call() }()
+
+	select {
+	case err := <-returned:
+		return err
+	case <-time.After(limit):
+		t.Fatalf("Expected the call to return within %s", limit)
+		return nil
+	}
+}
+
+func TestCancellingTheContextUnblocksAStalledRequest(t *testing.T) {
+	startStallingServer(t, 8961)
+	client := New("localhost", 8961, WithCircuitBreaker(CircuitBreaker{Failures: 1, Cooldown: time.Hour}))
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	err := returnsWithin(t, time.Second*2, func() error {
+		_, _, err := client.WithContext(ctx).Read("stall")
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the stalled read to return context.Canceled but got %q", err)
+	}
+
+	// the interrupted connection is not reused and the breaker did not count the cancellation as a failure
+	if _, err := client.Insert("key", "1"); err != nil {
+		t.Fatalf("Expected the client to keep working after a cancelled request but got %q", err)
+	}
+	if _, err := client.WithContext(ctx).Insert("other", "1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a request with a cancelled context to fail without being sent but got %q", err)
+	}
+	if present, _ := client.Present("other"); present {
+		t.Fatalf("Expected a request with a cancelled context not to reach the server")
+	}
+}
+
+func TestTheDeadlineOfTheContextBoundsARequest(t *testing.T) {
+	startStallingServer(t, 8962)
+	client := New("localhost", 8962)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err := returnsWithin(t, time.Second*2, func() error {
+		_, _, err := client.WithContext(ctx).Read("stall")
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the stalled read to return context.DeadlineExceeded but got %q", err)
+	}
+
+	// a context with a later deadline than the timeout leaves the timeout in charge
+	short := New("localhost", 8962, WithTimeout(time.Millisecond*100))
+	defer short.Close()
+	later, cancelLater := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelLater()
+	err = returnsWithin(t, time.Second*2, func() error {
+		_, _, err := short.WithContext(later).Read("stall")
+		return err
+	})
+	if err == nil || isContextError(err) {
+		t.Fatalf("Expected the client's timeout to end the read but got %q", err)
+	}
+}
+
+// stallingTransport never connects, waiting for the dial's context instead
+type stallingTransport struct{}
+
+func (stallingTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+}
+
+func TestCancellingTheContextUnblocksADial(t *testing.T) {
+	client := New("localhost", 8963, WithTransport(stallingTransport{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	err := returnsWithin(t, time.Second*2, func() error {
+		_, err := client.WithContext(ctx).Insert("key", "1")
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the stalled dial to return context.Canceled but got %q", err)
+	}
+}
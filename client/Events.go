@@ -0,0 +1,209 @@
+package client
+
+import (
+	"datastore/wire"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventKind int
+
+const (
+	// DialAttempt is emitted before dialing Endpoint for a new connection
+	DialAttempt EventKind = iota
+	// DialResult is emitted once a dial, and the AUTH that follows it, has finished after Duration, failing with Err
+	DialResult
+	// ConnectionReused is emitted when an idle connection to Endpoint is taken from the pool
+	ConnectionReused
+	// ConnectionDiscarded is emitted when a connection to Endpoint is closed instead of going back to the pool because
+	// of Err
+	ConnectionDiscarded
+	// RetryScheduled is emitted when a request to Endpoint is about to be sent again as attempt number Attempt, counting
+	// from 1, because the server did not process it: Err says why. Retries of the RetryPolicy carry no Endpoint, as the
+	// call is routed again, and the backoff they wait first as Duration
+	RetryScheduled
+	// BreakerStateChange is emitted when the circuit breaker of Endpoint moves From one state To another
+	BreakerStateChange
+	// FailoverToEndpoint is emitted when a read that failed on a replica with Err is sent to Endpoint, the primary
+	FailoverToEndpoint
+	// CallFinished is emitted last for every call, with the Command sent, the Duration of the whole call, and the Err it
+	// returned
+	CallFinished
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case DialAttempt:
+		return "dial-attempt"
+	case DialResult:
+		return "dial-result"
+	case ConnectionReused:
+		return "connection-reused"
+	case ConnectionDiscarded:
+		return "connection-discarded"
+	case RetryScheduled:
+		return "retry-scheduled"
+	case BreakerStateChange:
+		return "breaker-state-change"
+	case FailoverToEndpoint:
+		return "failover-to-endpoint"
+	case CallFinished:
+		return "call-finished"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event
+/**
+* Something the client did while making a call, see WithEventListener. Kind says what happened and which of the other
+* fields are set, as described on each EventKind.
+*
+* Call numbers the logical call the event belongs to, a method of the client or one health check PING, so the events of
+* calls made at the same time can be told apart. Every call ends with a CallFinished event.
+ */
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	Call     uint64
+	Endpoint Endpoint
+	Command  wire.Command
+	Attempt  int
+	Duration time.Duration
+	From     CircuitState
+	To       CircuitState
+	Err      error
+}
+
+// callTrace emits the events of one call, a nil trace emits nothing so calls cost nothing extra without a listener
+type callTrace struct {
+	listener func(Event)
+	call     uint64
+}
+
+// nextCall numbers calls across every client
+var nextCall uint64
+
+// newTrace starts the trace of a call, which is nil unless the client has an event listener
+func (c *Client) newTrace() *callTrace {
+	if c.eventListener == nil {
+		return nil
+	}
+	return &callTrace{listener: c.eventListener, call: atomic.AddUint64(&nextCall, 1)}
+}
+
+func (t *callTrace) emit(event Event) {
+	if t == nil {
+		return
+	}
+
+	event.Call = t.call
+	event.Time = time.Now()
+	t.listener(event)
+}
+
+// finish emits the CallFinished event of a call that started at started
+func (t *callTrace) finish(command wire.Command, started time.Time, err error) {
+	if t == nil {
+		return
+	}
+
+	t.emit(Event{Kind: CallFinished, Command: command, Duration: time.Since(started), Err: err})
+}
+
+// CallSummary
+/**
+* What happened during one call, put together from its events by SummarizeCalls
+*
+* Endpoints lists each endpoint a connection was dialed to or reused for, in order, and may repeat one that was tried
+* more than once.
+ */
+type CallSummary struct {
+	Call      uint64
+	Command   wire.Command
+	Duration  time.Duration
+	Err       error
+	Endpoints []Endpoint
+	Dials     int
+	// FailedDials counts the dials that did not produce a connection
+	FailedDials int
+	Reused      int
+	Discarded   int
+	Retries     int
+	Failovers   int
+	// BreakerChanges describes each breaker state change as "endpoint from->to"
+	BreakerChanges []string
+}
+
+func (s CallSummary) String() string {
+	endpoints := make([]string, len(s.Endpoints))
+	for i, endpoint := range s.Endpoints {
+		endpoints[i] = endpoint.String()
+	}
+
+	summary := fmt.Sprintf("call %d %s took %s via [%s]: dials=%d failed-dials=%d reused=%d discarded=%d retries=%d failovers=%d",
+		s.Call, s.Command, s.Duration, strings.Join(endpoints, " "), s.Dials, s.FailedDials, s.Reused, s.Discarded, s.Retries, s.Failovers)
+	if len(s.BreakerChanges) > 0 {
+		summary += " breaker=[" + strings.Join(s.BreakerChanges, " ") + "]"
+	}
+	if s.Err != nil {
+		summary += " error=" + s.Err.Error()
+	}
+
+	return summary
+}
+
+// SummarizeCalls
+/**
+* Build an event listener that collects the events of each call and hands its summary to log once the call finishes,
+* for example WithEventListener(SummarizeCalls(func(s CallSummary) { log.Println(s) }))
+*
+* log is called on the goroutine that made the call, and may be called for several calls at once.
+ */
+func SummarizeCalls(log func(CallSummary)) func(Event) {
+	var mutex sync.Mutex
+	calls := map[uint64]*CallSummary{}
+
+	return func(event Event) {
+		mutex.Lock()
+		summary, found := calls[event.Call]
+		if !found {
+			summary = &CallSummary{Call: event.Call}
+			calls[event.Call] = summary
+		}
+
+		switch event.Kind {
+		case DialAttempt:
+			summary.Dials++
+			summary.Endpoints = append(summary.Endpoints, event.Endpoint)
+		case DialResult:
+			if event.Err != nil {
+				summary.FailedDials++
+			}
+		case ConnectionReused:
+			summary.Reused++
+			summary.Endpoints = append(summary.Endpoints, event.Endpoint)
+		case ConnectionDiscarded:
+			summary.Discarded++
+		case RetryScheduled:
+			summary.Retries++
+		case BreakerStateChange:
+			summary.BreakerChanges = append(summary.BreakerChanges, fmt.Sprintf("%s %s->%s", event.Endpoint, event.From, event.To))
+		case FailoverToEndpoint:
+			summary.Failovers++
+		case CallFinished:
+			summary.Command = event.Command
+			summary.Duration = event.Duration
+			summary.Err = event.Err
+			delete(calls, event.Call)
+		}
+		mutex.Unlock()
+
+		if event.Kind == CallFinished {
+			log(*summary)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"datastore/server"
+	"datastore/wire"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder keeps every event a client emits and describes the events of each call in a form tests can compare
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(event Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+// lastCall describes the events of the most recently finished call of command, in the order they were emitted
+func (r *eventRecorder) lastCall(command wire.Command) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var call uint64
+	for _, event := range r.events {
+		if event.Kind == CallFinished && event.Command == command {
+			call = event.Call
+		}
+	}
+
+	var described []string
+	for _, event := range r.events {
+		if event.Call != call {
+			continue
+		}
+
+		description := fmt.Sprintf("%s %d", event.Kind, event.Endpoint.Port)
+		switch event.Kind {
+		case RetryScheduled:
+			description += fmt.Sprintf(" attempt %d", event.Attempt)
+		case BreakerStateChange:
+			description += fmt.Sprintf(" %s->%s", event.From, event.To)
+		case CallFinished:
+			description = fmt.Sprintf("%s %s", event.Kind, event.Command)
+		}
+		if event.Err != nil {
+			description += " failed"
+		}
+		described = append(described, description)
+	}
+
+	return described
+}
+
+func (r *eventRecorder) assertLastCall(t *testing.T, command wire.Command, expected ...string) {
+	t.Helper()
+	found := r.lastCall(command)
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected the events of the last %s call to be %q but found %q", command, expected, found)
+	}
+}
+
+// replicaFirst sends every read to the last healthy replica, or the primary when there is none
+type replicaFirst struct{}
+
+func (p replicaFirst) ChooseRead(candidates []EndpointStats) int {
+	return len(candidates) - 1
+}
+
+func TestEventsOfAFailoverFromADeadReplica(t *testing.T) {
+	startServers(t, 8921)
+
+	recorder := &eventRecorder{}
+	var summaries []CallSummary
+	summarize := SummarizeCalls(func(summary CallSummary) { summaries = append(summaries, summary) })
+	client := New("localhost", 8921,
+		WithReplicas(Endpoint{Address: "localhost", Port: 8922}),
+		WithRoutingPolicy(replicaFirst{}),
+		WithEventListener(func(event Event) {
+			recorder.record(event)
+			summarize(event)
+		}),
+	)
+	// keep background health checks from touching the endpoints while the events are recorded
+	client.checks.last = time.Now()
+	client.healthCheckInterval = time.Hour
+
+	client.Upsert("key", "value")
+	recorder.assertLastCall(t, wire.UPSERT, "dial-attempt 8921", "dial-result 8921", "call-finished UPSERT")
+
+	// nothing listens on the replica, so the read fails over to the primary and reuses its connection
+	value, present, err := client.Read("key")
+	if err != nil || !present || value != "value" {
+		t.Fatalf("Expected the read to fail over to the primary but got %q: %q", value, err)
+	}
+	recorder.assertLastCall(t, wire.READ,
+		"dial-attempt 8922",
+		"dial-result 8922 failed",
+		"failover-to-endpoint 8921 failed",
+		"connection-reused 8921",
+		"call-finished READ",
+	)
+
+	// the replica is unhealthy now, so reads go straight to the primary
+	client.Read("key")
+	recorder.assertLastCall(t, wire.READ, "connection-reused 8921", "call-finished READ")
+
+	summary := summaries[1]
+	if summary.Command != wire.READ || summary.Dials != 1 || summary.FailedDials != 1 || summary.Failovers != 1 || summary.Reused != 1 || summary.Err != nil || len(summary.Endpoints) != 2 {
+		t.Fatalf("Expected a summary of the failover but found %s", summary)
+	}
+	if !strings.Contains(summary.String(), "via [localhost:8922 localhost:8921]") {
+		t.Fatalf("Expected the summary to list the endpoints tried but found %s", summary)
+	}
+}
+
+func TestEventsOfARetryAfterADeadPooledConnection(t *testing.T) {
+	runningServer := server.New("localhost", 8923, server.WithIdleTimeout(time.Millisecond*50))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	recorder := &eventRecorder{}
+	client := New("localhost", 8923, WithEventListener(recorder.record))
+
+	client.Upsert("key", "value")
+	time.Sleep(time.Millisecond * 150) // let the server close the idle connection
+
+	_, present, err := client.Read("key")
+	if err != nil || !present {
+		t.Fatalf("Expected the read to be retried on a new connection but got %q", err)
+	}
+	recorder.assertLastCall(t, wire.READ,
+		"connection-reused 8923",
+		"connection-discarded 8923 failed",
+		"retry-scheduled 8923 attempt 2 failed",
+		"dial-attempt 8923",
+		"dial-result 8923",
+		"call-finished READ",
+	)
+}
+
+func TestEventsOfABreakerOpening(t *testing.T) {
+	recorder := &eventRecorder{}
+	client := New("localhost", 8924, WithEventListener(recorder.record), WithCircuitBreaker(CircuitBreaker{
+		Failures: 1,
+		Window:   time.Minute,
+		Cooldown: time.Minute,
+	}))
+
+	client.Present("key")
+	recorder.assertLastCall(t, wire.PRESENT,
+		"dial-attempt 8924",
+		"dial-result 8924 failed",
+		"breaker-state-change 8924 closed->open",
+		"call-finished PRESENT failed",
+	)
+
+	client.Present("key")
+	recorder.assertLastCall(t, wire.PRESENT, "call-finished PRESENT failed")
+}
+
+func TestCallsWithoutAListenerDoNotAllocateForEvents(t *testing.T) {
+	client := New("localhost", 8924)
+
+	allocations := testing.AllocsPerRun(100, func() {
+		trace := client.newTrace()
+		trace.emit(Event{Kind: DialAttempt, Endpoint: client.primary().Endpoint})
+		trace.finish(wire.READ, time.Now(), nil)
+	})
+	if allocations != 0 {
+		t.Fatalf("Expected no allocations without a listener but found %.0f", allocations)
+	}
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"datastore/wire"
+	"net"
+	"time"
+)
+
+// Transport
+/**
+* Opens connections to the server, net.Dialer is the default
+*
+* Replacing the transport lets tests put something between the client and the server, such as the faults package.
+ */
+type Transport interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+type Option func(*Client)
+
+// WithTransport sets the Transport used to open connections to the server
+func WithTransport(transport Transport) Option {
+	return func(c *Client) {
+		c.transport = transport
+	}
+}
+
+// WithTimeout bounds how long a single request may take including connecting, defaults to 10 seconds
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithDatabase
+/**
+* Select the named database on every connection the client opens, so every call reads and writes the keys of that
+* database alone, and Truncate only empties it. The server creates the database the first time it is used.
+ */
+func WithDatabase(name string) Option {
+	return func(c *Client) {
+		c.database = name
+	}
+}
+
+// WithAuthToken
+/**
+* Send AUTH with the token on every connection the client opens, before any request. With the server's admin token the
+* connections are admin sessions, and with the token a server started WithRequiredAuth asks for they may send commands
+* at all. A wrong token fails every request with ErrUnauthorized.
+ */
+func WithAuthToken(token string) Option {
+	return func(c *Client) {
+		c.authToken = token
+	}
+}
+
+// WithReplicas adds servers that reads may be sent to depending on the routing policy, writes only go to the primary
+func WithReplicas(replicas ...Endpoint) Option {
+	return func(c *Client) {
+		for _, replica := range replicas {
+			c.endpoints = append(c.endpoints, newEndpoint(replica.Address, replica.Port))
+		}
+	}
+}
+
+// WithRoutingPolicy sets how reads are spread over the primary and replicas, defaults to PrimaryOnly
+func WithRoutingPolicy(policy RoutingPolicy) Option {
+	return func(c *Client) {
+		c.routing = policy
+	}
+}
+
+// WithHealthCheckInterval sets how often endpoints are checked while reads are being routed, defaults to 5 seconds
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(c *Client) {
+		c.healthCheckInterval = interval
+	}
+}
+
+// WithCircuitBreaker
+/**
+* Give every endpoint a circuit breaker so requests fail fast with ErrCircuitOpen while it is down instead of each one
+* waiting for the connection to fail, see CircuitBreaker. Disabled by default.
+ */
+func WithCircuitBreaker(settings CircuitBreaker) Option {
+	return func(c *Client) {
+		c.breaker = settings
+	}
+}
+
+// WithRetryPolicy
+/**
+* Retry calls that fail to reach the server after a backoff, as the policy describes, instead of returning the failure
+* at once. Disabled by default, so every call is made once.
+ */
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithEventListener
+/**
+* Call listener with an Event for each dial, retry, failover, pooled connection reused or discarded, and breaker state
+* change, followed by a CallFinished event at the end of every call. It is called synchronously on the goroutine making
+* the call, so it should return quickly. SummarizeCalls turns the events into one summary per call.
+ */
+func WithEventListener(listener func(Event)) Option {
+	return func(c *Client) {
+		c.eventListener = listener
+	}
+}
+
+// WithWarningListener
+/**
+* Call listener with each warning the server attaches to a successful response, along with the command of the request,
+* see Warning. The call still returns its usual result. Setting a listener makes every new connection announce the
+* protocol version with HELLO, since servers only send warnings to clients that do. Servers too old to know HELLO never
+* send warnings.
+ */
+func WithWarningListener(listener func(command wire.Command, warning Warning)) Option {
+	return func(c *Client) {
+		c.warningListener = listener
+	}
+}
+
+// WithMaxIdleConnections
+/**
+* Bound how many idle connections to each endpoint the client keeps for reuse, defaults to 16. Calls made while every
+* kept connection is busy dial another, which is closed after its request when the pool is already full. Zero keeps
+* every connection.
+ */
+func WithMaxIdleConnections(connections int) Option {
+	return func(c *Client) {
+		c.maxIdleConnections = connections
+	}
+}
+
+// WithMaxMessageSize
+/**
+* Refuse responses longer than size bytes, length prefix included, with ErrMalformedResponse before allocating anything
+* for them. Defaults to wire.DefaultMaxMessageSize, the bound servers keep to unless configured otherwise, and is capped
+* at wire.MaxFrameSize. Raise it along with server.WithMaxMessageSize to read values longer than the default.
+ */
+func WithMaxMessageSize(size int) Option {
+	return func(c *Client) {
+		c.maxMessageSize = size
+	}
+}
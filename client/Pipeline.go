@@ -0,0 +1,329 @@
+package client
+
+import (
+	"datastore/wire"
+	"errors"
+	"time"
+)
+
+// pipelineCommand is the Command of the CallFinished event of a Flush, which sends several commands in one call
+const pipelineCommand wire.Command = "PIPELINE"
+
+// PipelinedRead is what a Read queued on a Pipeline found, filled in by Flush, see Client.Read
+type PipelinedRead struct {
+	Value   string
+	Present bool
+	Err     error
+}
+
+// PipelinedWrite is what a write queued on a Pipeline did, filled in by Flush, Applied and Err being what the Client
+// method of the same name returns
+type PipelinedWrite struct {
+	Applied bool
+	Err     error
+}
+
+// PipelinedGetOrSet is what a GetOrSetWithTTL queued on a Pipeline did, filled in by Flush, Value, Existed, and Err
+// being what Client.GetOrSetWithTTL returns
+type PipelinedGetOrSet struct {
+	Value   string
+	Existed bool
+	Err     error
+}
+
+// Pipeline
+/**
+* Calls queued to be sent together by Flush, see Client.Pipeline. A Pipeline is not safe for use by several goroutines
+* at once.
+ */
+type Pipeline struct {
+	client   *Client
+	messages [][]byte
+	// results fill in the holder of each queued call from its response, or from the error that left it without one
+	results []func(responseCommand wire.Command, responseMessage []byte, err error)
+}
+
+// Pipeline
+/**
+* Start a pipeline, queueing calls that Flush sends to the primary in a single write before reading any of the
+* responses, instead of waiting for each response before sending the next request. The server answers them in the
+* order they were queued, and each sees the effects of those before it.
+*
+* Each queued call returns the holder its result is filled into once Flush returns. Unlike a Txn the calls are not
+* applied together, other clients' commands can run in between, and reads go to the primary whatever the routing policy.
+ */
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+// Read queues a Read of a key
+func (p *Pipeline) Read(key string) *PipelinedRead {
+	result := &PipelinedRead{}
+	p.queue(func(responseCommand wire.Command, responseMessage []byte, err error) {
+		if err != nil {
+			result.Err = err
+			return
+		}
+		result.Value, result.Present, result.Err = p.client.decodeRead(responseCommand, responseMessage)
+	}, wire.READ, key)
+	return result
+}
+
+// Present queues a Present check of a key
+func (p *Pipeline) Present(key string) *PipelinedRead {
+	result := &PipelinedRead{}
+	p.queue(func(responseCommand wire.Command, responseMessage []byte, err error) {
+		if err != nil {
+			result.Err = err
+			return
+		}
+		result.Present, result.Err = p.client.decodeAckOrNull(wire.PRESENT, responseCommand, responseMessage)
+	}, wire.PRESENT, key)
+	return result
+}
+
+// Insert queues an Insert of a new key
+func (p *Pipeline) Insert(key string, value string) *PipelinedWrite {
+	return p.queueAckOrNull(wire.INSERT, key, value)
+}
+
+// Update queues an Update of a key that is present
+func (p *Pipeline) Update(key string, value string) *PipelinedWrite {
+	return p.queueAckOrNull(wire.UPDATE, key, value)
+}
+
+// Upsert queues an Upsert of a key whether or not it is present
+func (p *Pipeline) Upsert(key string, value string) *PipelinedWrite {
+	return p.queueAckOrNull(wire.UPSERT, key, value)
+}
+
+// Delete queues a Delete of a key that is present
+func (p *Pipeline) Delete(key string) *PipelinedWrite {
+	return p.queueAckOrNull(wire.DELETE, key)
+}
+
+// Expire queues an Expire of a key that is present
+func (p *Pipeline) Expire(key string, expiration time.Time) *PipelinedWrite {
+	return p.queueAckOrNull(wire.EXPIRE, key, p.client.wire.EncodeTime(expiration))
+}
+
+// GetOrSetWithTTL
+/**
+* Queue a GetOrSetWithTTL of a key. Unlike Client.GetOrSetWithTTL it is sent as a single GETORSET whatever the server,
+* so servers that do not announce wire.CapabilityInlineTTL answer it with an error.
+ */
+func (p *Pipeline) GetOrSetWithTTL(key string, defaultValue string, ttl time.Duration) *PipelinedGetOrSet {
+	result := &PipelinedGetOrSet{}
+	p.queue(func(responseCommand wire.Command, responseMessage []byte, err error) {
+		if err != nil {
+			result.Err = err
+			return
+		}
+		result.Value, result.Existed, result.Err = p.client.decodeGetOrSet(responseCommand, responseMessage)
+	}, wire.GETORSET, key, defaultValue, p.client.wire.EncodeDuration(ttl))
+	return result
+}
+
+func (p *Pipeline) queueAckOrNull(command wire.Command, arguments ...string) *PipelinedWrite {
+	result := &PipelinedWrite{}
+	p.queue(func(responseCommand wire.Command, responseMessage []byte, err error) {
+		if err != nil {
+			result.Err = err
+			return
+		}
+		result.Applied, result.Err = p.client.decodeAckOrNull(command, responseCommand, responseMessage)
+	}, command, arguments...)
+	return result
+}
+
+func (p *Pipeline) queue(result func(wire.Command, []byte, error), command wire.Command, arguments ...string) {
+	message, err := p.client.wire.EncodeMessage(command, arguments...)
+	if err != nil {
+		// a call that cannot be encoded fails on its own, without being sent
+		result(wire.ERR, nil, err)
+		return
+	}
+	p.messages = append(p.messages, message)
+	p.results = append(p.results, result)
+}
+
+// Flush
+/**
+* Send the queued calls in a single write and read their responses in order, filling in the holder of each. The queue
+* is emptied, so the Pipeline can be used for more calls.
+*
+* An error means the responses could not all be read, for example when the connection failed part way. Calls answered
+* before then have their results, and every other call has the error, although the server may have applied it. Calls
+* the server did not get to because it recycled the connection are sent again on a new one.
+ */
+func (p *Pipeline) Flush() error {
+	messages, results := p.messages, p.results
+	p.messages, p.results = nil, nil
+	if len(messages) == 0 {
+		return nil
+	}
+
+	c := p.client
+	trace := c.newTrace()
+	started := time.Now()
+	var responses []pipelinedResponse
+	var err error
+	if c.session != nil {
+		responses, err = c.session.flush(trace, c, messages)
+	} else {
+		responses, err = c.sendPipeline(trace, c.primary(), c.primary().connections, messages)
+	}
+	trace.finish(pipelineCommand, started, err)
+
+	for i, result := range results {
+		if i < len(responses) {
+			result(responses[i].command, responses[i].message, nil)
+		} else {
+			result(wire.ERR, nil, err)
+		}
+	}
+	return err
+}
+
+// pipelinedResponse is the response to one message of a pipeline
+type pipelinedResponse struct {
+	command wire.Command
+	message []byte
+}
+
+// flush sends a pipeline through the session's connection like send
+func (s *sessionConnection) flush(trace *callTrace, c *Client, messages [][]byte) ([]pipelinedResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.connections.idle) == 0 {
+		if pooled := c.primary().connections.get(); pooled != nil {
+			s.connections.put(pooled)
+		}
+	}
+
+	return c.sendPipeline(trace, c.primary(), &s.connections, messages)
+}
+
+// sendPipeline
+/**
+* Send messages to one endpoint and read their responses like sendThrough, returning the responses read before any
+* failure
+*
+* The messages the server did not process are sent again on a new connection, as sendWithRetries does for one message:
+* all of them when a reused connection turns out to have been closed, and those after a recycle notice.
+ */
+func (c *Client) sendPipeline(trace *callTrace, e *endpoint, connections *connectionPool, messages [][]byte) ([]pipelinedResponse, error) {
+	err := e.breaker.allow(trace)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]pipelinedResponse, 0, len(messages))
+	for attempt := 0; attempt < maxSendAttempts; attempt++ {
+		if ctxErr := contextError(c.requestContext()); ctxErr != nil {
+			err = ctxErr
+			break
+		}
+		if attempt > 0 {
+			trace.emit(Event{Kind: RetryScheduled, Endpoint: e.Endpoint, Attempt: attempt + 1, Err: err})
+		}
+
+		pooled := connections.get()
+		reused := pooled != nil
+		if reused {
+			trace.emit(Event{Kind: ConnectionReused, Endpoint: e.Endpoint})
+		} else {
+			pooled, err = c.dial(trace, e)
+			if err != nil {
+				break
+			}
+		}
+
+		var unprocessed bool
+		responses, unprocessed, err = c.exchangePipeline(pooled, messages, responses)
+		if err != nil {
+			pooled.connection.Close()
+			trace.emit(Event{Kind: ConnectionDiscarded, Endpoint: e.Endpoint, Err: err})
+			if (reused && unprocessed) || errors.Is(err, wire.ErrConnectionRecycled) {
+				continue
+			}
+			break
+		}
+
+		if c.recycleNoticeBuffered(pooled) {
+			pooled.connection.Close()
+			trace.emit(Event{Kind: ConnectionDiscarded, Endpoint: e.Endpoint, Err: wire.ErrConnectionRecycled})
+		} else {
+			connections.put(pooled)
+		}
+		break
+	}
+
+	e.breaker.record(trace, err)
+	return responses, err
+}
+
+// exchangePipeline
+/**
+* Write the messages that have no response yet and read their responses, appending them to responses, also reporting
+* whether a failure means the server never saw the message whose response was being read
+*
+* The messages are written while the responses are read, so the server is never held up writing responses the client
+* is not reading yet. The exchange has the client's timeout, and is bound by the client's context, like roundTrip.
+ */
+func (c *Client) exchangePipeline(pooled *pooledConnection, messages [][]byte, responses []pipelinedResponse) ([]pipelinedResponse, bool, error) {
+	ctx := c.requestContext()
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		return responses, false, ctxErr
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, bounded := ctx.Deadline(); bounded && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err := pooled.connection.SetDeadline(deadline)
+	if err != nil {
+		return responses, false, err
+	}
+
+	stop := interruptOnCancel(ctx, pooled.connection)
+	defer stop()
+
+	// writing consumes the segments it is given, and the messages may have to be sent again
+	pending := messages[len(responses):]
+	segments := append([][]byte(nil), pending...)
+	written := make(chan error, 1)
+	go func() {
+		written <- pooled.writer.WriteFrame(segments...)
+	}()
+
+	unprocessed := false
+	for _, message := range pending {
+		var responseCommand wire.Command
+		var responseMessage []byte
+		responseCommand, responseMessage, unprocessed, err = c.readResponse(pooled, message)
+		if err == nil && c.isRecycleNotice(responseCommand, responseMessage) {
+			err = wire.ErrConnectionRecycled
+		}
+		if err != nil {
+			break
+		}
+		responses = append(responses, pipelinedResponse{command: responseCommand, message: responseMessage})
+	}
+
+	if err != nil {
+		// unblock the write, which may be waiting on a server that stopped reading
+		pooled.connection.SetDeadline(aLongTimeAgo)
+	}
+	writeErr := <-written
+	if err == nil && writeErr != nil {
+		err = writeErr
+	}
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return responses, false, ctxErr
+		}
+	}
+	return responses, unprocessed, err
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"datastore/server"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPipelineAnswersEachCallInOrder(t *testing.T) {
+	runningServer := server.New("localhost", 8970, server.WithLogger(nil))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", 8970)
+	defer client.Close()
+	client.Insert("present", "old")
+
+	pipeline := client.Pipeline()
+	inserted := pipeline.Insert("present", "new")
+	updated := pipeline.Update("present", "new")
+	read := pipeline.Read("present")
+	upserted := pipeline.Upsert("present", "new")
+	expired := pipeline.Expire("present", time.Now().Add(time.Hour))
+	deleted := pipeline.Delete("present")
+	missing := pipeline.Read("present")
+	present := pipeline.Present("present")
+	err = pipeline.Flush()
+	if err != nil {
+		t.Fatalf("Expected the pipeline to be flushed but got %q", err)
+	}
+
+	// each call sees the effects of the ones queued before it
+	if inserted.Applied || !errors.Is(inserted.Err, ErrKeyExists) {
+		t.Fatalf("Expected the insert of a present key to fail but got %+v", inserted)
+	}
+	if !updated.Applied || updated.Err != nil || read.Value != "new" || !read.Present || read.Err != nil {
+		t.Fatalf("Expected the read to find the update but got %+v and %+v", updated, read)
+	}
+	if upserted.Applied || upserted.Err != nil || !expired.Applied || !deleted.Applied {
+		t.Fatalf("Expected the unchanged upsert to be skipped and the rest applied but got %+v, %+v, and %+v", upserted, expired, deleted)
+	}
+	if missing.Present || missing.Err != nil || present.Present || present.Err != nil {
+		t.Fatalf("Expected the deleted key to be missing but got %+v and %+v", missing, present)
+	}
+
+	// the flush emptied the queue
+	if err = pipeline.Flush(); err != nil {
+		t.Fatalf("Expected flushing nothing to succeed but got %q", err)
+	}
+}
+
+func TestPipelineSendsWhatARecycledConnectionDidNotProcessAgain(t *testing.T) {
+	runningServer := server.New("localhost", 8971, server.WithLogger(nil), server.WithMaxRequestsPerConnection(10))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", 8971)
+	defer client.Close()
+
+	pipeline := client.Pipeline()
+	results := make([]*PipelinedWrite, 25)
+	for i := range results {
+		results[i] = pipeline.Insert(fmt.Sprintf("key:%d", i), "1")
+	}
+	err = pipeline.Flush()
+	if err != nil {
+		t.Fatalf("Expected the pipeline to be flushed over several connections but got %q", err)
+	}
+
+	for i, result := range results {
+		if !result.Applied || result.Err != nil {
+			t.Fatalf("Expected insert %d to be applied once but got %+v", i, result)
+		}
+	}
+	if count, _ := client.Count(); count != len(results) {
+		t.Fatalf("Expected %d keys but found %d", len(results), count)
+	}
+}
+
+func TestPipelineFailsEveryCallItCouldNotSend(t *testing.T) {
+	// nothing listens on this port
+	client := New("localhost", 8972)
+	pipeline := client.Pipeline()
+	read := pipeline.Read("a")
+	inserted := pipeline.Insert("a", "1")
+
+	err := pipeline.Flush()
+	if err == nil || !errors.Is(read.Err, err) || !errors.Is(inserted.Err, err) {
+		t.Fatalf("Expected the flush and every call to fail the same way but got %q, %q, and %q", err, read.Err, inserted.Err)
+	}
+}
+
+// BenchmarkInserts compares 1000 inserts each waiting for its response with the same inserts flushed as one pipeline
+func BenchmarkInserts(b *testing.B) {
+	const inserts = 1000
+
+	runningServer := server.New("localhost", 8973, server.WithLogger(nil))
+	err := runningServer.Start()
+	if err != nil {
+		b.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", 8973)
+	defer client.Close()
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			client.Truncate()
+			for key := 0; key < inserts; key++ {
+				client.Insert(fmt.Sprintf("key:%d", key), "abc123")
+			}
+		}
+	})
+
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			client.Truncate()
+			pipeline := client.Pipeline()
+			for key := 0; key < inserts; key++ {
+				pipeline.Insert(fmt.Sprintf("key:%d", key), "abc123")
+			}
+			err := pipeline.Flush()
+			if err != nil {
+				b.Fatalf("Error flushing the pipeline %q", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"datastore/wire"
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy
+/**
+* Settings for retrying calls that fail to reach the server, such as while it restarts, see WithRetryPolicy
+*
+* A call is made at most MaxAttempts times, counting the first. The first retry waits InitialBackoff and each one after
+* it Multiplier times as long as the one before, a Multiplier below 1 keeping every wait the same. Jitter takes up to
+* that fraction, between 0 and 1, off each wait at random, so clients that failed together do not all retry together.
+* Retryable decides which failures are worth retrying, IsTransient when it is nil.
+*
+* Reads are retried whenever Retryable allows. Writes are only retried when they failed before being sent, for example
+* when the connection was refused, since a write that timed out waiting for its response may have been applied. ERR
+* responses are answers rather than failures and are never retried, and neither are calls whose context is done, see
+* Client.WithContext, which also cuts a wait short.
+ */
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Multiplier     float64
+	Jitter         float64
+	Retryable      func(err error) bool
+}
+
+// IsTransient
+/**
+* Report whether err is a failure to reach the server that may go away by itself: the connection being refused or reset,
+* or a timeout. Calls given up on through their context and calls refused by an open circuit breaker are not, nor is
+* anything the server answered.
+ */
+func IsTransient(err error) bool {
+	if err == nil || isContextError(err) || errors.Is(err, ErrCircuitOpen) || !isTransportFailure(err) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return IsTransient(err)
+	}
+	return !isContextError(err) && p.Retryable(err)
+}
+
+// backoff returns how long to wait before the retry that follows attempt, counting from 1, jitter included
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	wait := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		wait *= multiplier
+	}
+
+	jitter := p.Jitter
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return time.Duration(wait * (1 - jitter*rand.Float64()))
+}
+
+// unsentError is what sendWithRetries fails with when the message was never written, so a RetryPolicy can tell writes
+// that are safe to retry from those that may have been applied. It never leaves the client, the callers of sendTo and
+// sendThrough return the error it wraps.
+type unsentError struct {
+	err error
+}
+
+func (e *unsentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unsentError) Unwrap() error {
+	return e.err
+}
+
+// unwrapUnsent returns the error an unsentError wraps and true, or err itself and false for any other error
+func unwrapUnsent(err error) (error, bool) {
+	if unsent, ok := err.(*unsentError); ok {
+		return unsent.err, true
+	}
+	return err, false
+}
+
+// sendWithPolicy sends a message through a session or routes it, once or as many times as the retry policy allows
+func (c *Client) sendWithPolicy(trace *callTrace, message []byte) (wire.Command, []byte, error) {
+	command, err := c.wire.DecipherCommand(message)
+	write := err != nil || wire.IsWrite(command)
+
+	for attempt := 1; ; attempt++ {
+		var responseCommand wire.Command
+		var responseMessage []byte
+		if c.session != nil {
+			responseCommand, responseMessage, err = c.session.send(trace, c, message)
+		} else {
+			responseCommand, responseMessage, err = c.route(trace, message)
+		}
+
+		err, unsent := unwrapUnsent(err)
+		if err == nil || attempt >= c.retry.MaxAttempts || (write && !unsent) || !c.retry.retryable(err) {
+			return responseCommand, responseMessage, err
+		}
+
+		wait := c.retry.backoff(attempt)
+		trace.emit(Event{Kind: RetryScheduled, Attempt: attempt + 1, Duration: wait, Err: err})
+		err = c.pause(wait)
+		if err != nil {
+			return wire.ERR, nil, err
+		}
+	}
+}
+
+// pause waits before a retry, returning the error of the client's context as soon as it is done
+func (c *Client) pause(wait time.Duration) error {
+	ctx := c.requestContext()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"datastore/server"
+	"datastore/wire"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// refusingTransport refuses its first dials the way a server that is not listening yet would, then dials for real
+type refusingTransport struct {
+	refusals int32
+	dials    atomic.Int32
+}
+
+func (t *refusingTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if t.dials.Add(1) <= t.refusals {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestRetryPolicyRetriesRefusedConnections(t *testing.T) {
+	runningServer := server.New("localhost", 8969)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	policy := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond * 10, Multiplier: 2, Jitter: 0.5}
+	transport := &refusingTransport{refusals: 3}
+	retries := 0
+	client := New("localhost", 8969, WithTransport(transport), WithRetryPolicy(policy), WithEventListener(func(event Event) {
+		if event.Kind == RetryScheduled {
+			retries++
+		}
+	}))
+	defer client.Close()
+
+	// writes that never reached the server are retried like reads
+	inserted, err := client.Insert("a", "1")
+	if err != nil || !inserted || transport.dials.Load() != 4 || retries != 3 {
+		t.Fatalf("Expected the insert to succeed on the fourth dial after 3 retries but got %t after %d dials and %d retries: %q", inserted, transport.dials.Load(), retries, err)
+	}
+
+	// an ERR response is an answer, not a failure to retry
+	retries = 0
+	if _, err = client.Update("missing", "1"); !errors.Is(err, ErrKeyNotFound) || retries != 0 {
+		t.Fatalf("Expected the update to fail with ErrKeyNotFound without retrying but got %q after %d retries", err, retries)
+	}
+
+	// the last failure is returned once every attempt was used
+	refusing := New("localhost", 8969, WithTransport(&refusingTransport{refusals: 3}), WithRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	if _, _, err = refusing.Read("a"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Expected the refusal after 3 attempts but got %q", err)
+	}
+}
+
+func TestRetryPolicyOnlyRetriesReadsThatTimedOut(t *testing.T) {
+	// the listener answers CAPABILITIES like a server predating it and nothing else, so every request times out after
+	// being sent
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening %q", err)
+	}
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		protocol := wire.Protocol{}
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			defer connection.Close()
+			go func() {
+				frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+				for {
+					request, err := frames.ReadFrame()
+					if err != nil {
+						return
+					}
+					if command, _ := protocol.DecipherCommand(request); command == wire.CAPABILITIES {
+						connection.Write(protocol.EncodeErrResponse(errors.New("unknown command")))
+					}
+				}
+			}()
+		}
+	}()
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	client := New("localhost", listener.Addr().(*net.TCPAddr).Port, WithTimeout(time.Millisecond*50), WithRetryPolicy(policy))
+	defer client.Close()
+
+	_, _, err = client.Read("a")
+	if !IsTransient(err) || accepted.Load() != 3 {
+		t.Fatalf("Expected the read to time out on each of 3 connections but got %q on %d", err, accepted.Load())
+	}
+
+	// the insert may have been applied before it timed out, so it is not sent again
+	accepted.Store(0)
+	_, err = client.Insert("a", "1")
+	if !IsTransient(err) || accepted.Load() != 1 {
+		t.Fatalf("Expected the insert to time out on a single connection but got %q on %d", err, accepted.Load())
+	}
+}
+
+func TestRetryPolicyStopsWaitingWhenTheContextIsDone(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}
+	client := New("localhost", 8969, WithTransport(&refusingTransport{refusals: 3}), WithRetryPolicy(policy))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	started := time.Now()
+	_, _, err := client.WithContext(ctx).Read("a")
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(started) > time.Second {
+		t.Fatalf("Expected the retry to give up with the context after %s but got %q", time.Since(started), err)
+	}
+}
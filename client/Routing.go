@@ -0,0 +1,277 @@
+package client
+
+import (
+	"datastore/wire"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWeight is how much a new health check moves an endpoint's latency average
+const latencyWeight = 0.3
+
+// Endpoint is the address of a server the client can send requests to
+type Endpoint struct {
+	Address string
+	Port    int
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Address, strconv.Itoa(e.Port))
+}
+
+// EndpointStats
+/**
+* What the client has learned about one endpoint from its health checks
+*
+* Latency is an exponentially weighted moving average of PING round trips and stays zero until a check succeeds.
+* Unhealthy endpoints failed their last check, or a read sent to them since, and are left out of read routing until a
+* check passes again.
+ */
+type EndpointStats struct {
+	Endpoint Endpoint
+	Primary  bool
+	Healthy  bool
+	Latency  time.Duration
+	// Circuit is the state of the endpoint's circuit breaker, always CircuitClosed unless WithCircuitBreaker is used
+	Circuit CircuitState
+}
+
+// RoutingPolicy
+/**
+* Decides which endpoint each read is sent to, writes always go to the primary whatever the policy
+*
+* ChooseRead returns an index into candidates. The primary is always candidates[0], followed by the replicas that are
+* currently healthy. Policies may be called from many goroutines at once.
+ */
+type RoutingPolicy interface {
+	ChooseRead(candidates []EndpointStats) int
+}
+
+type primaryOnly struct{}
+
+// PrimaryOnly sends every read to the primary, it is the default policy
+func PrimaryOnly() RoutingPolicy {
+	return primaryOnly{}
+}
+
+func (p primaryOnly) ChooseRead(candidates []EndpointStats) int {
+	return 0
+}
+
+type roundRobinReads struct {
+	next uint64
+}
+
+// RoundRobinReads spreads reads evenly over the primary and the healthy replicas
+func RoundRobinReads() RoutingPolicy {
+	return &roundRobinReads{}
+}
+
+func (p *roundRobinReads) ChooseRead(candidates []EndpointStats) int {
+	return int((atomic.AddUint64(&p.next, 1) - 1) % uint64(len(candidates)))
+}
+
+type nearestReads struct {
+	mutex      sync.Mutex
+	hysteresis float64
+	current    Endpoint
+}
+
+// NearestReads
+/**
+* Send reads to the endpoint with the lowest latency
+*
+* To keep reads from flapping between endpoints with similar latencies, reads only move away from the current endpoint
+* when another one is faster by more than the hysteresis, a fraction of the current endpoint's latency such as 0.2.
+* Reads go to the primary until an endpoint has a latency measured.
+ */
+func NearestReads(hysteresis float64) RoutingPolicy {
+	return &nearestReads{hysteresis: hysteresis}
+}
+
+func (p *nearestReads) ChooseRead(candidates []EndpointStats) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	fastest, current := -1, -1
+	for i, candidate := range candidates {
+		if candidate.Latency == 0 {
+			continue
+		}
+		if fastest < 0 || candidate.Latency < candidates[fastest].Latency {
+			fastest = i
+		}
+		if candidate.Endpoint == p.current {
+			current = i
+		}
+	}
+
+	if fastest < 0 {
+		return 0
+	}
+
+	if current < 0 || float64(candidates[fastest].Latency) < float64(candidates[current].Latency)*(1-p.hysteresis) {
+		current = fastest
+	}
+
+	p.current = candidates[current].Endpoint
+	return current
+}
+
+// endpoint is an Endpoint along with its own connection pool and health
+type endpoint struct {
+	Endpoint
+	connections *connectionPool
+	breaker     *circuitBreaker
+
+	mutex   sync.Mutex
+	healthy bool
+	latency time.Duration
+	// capabilities is what the endpoint answered to CAPABILITIES, nil until it was asked
+	capabilities *Capabilities
+}
+
+func newEndpoint(address string, port int) *endpoint {
+	return &endpoint{Endpoint: Endpoint{Address: address, Port: port}, connections: &connectionPool{}, healthy: true}
+}
+
+func (e *endpoint) stats(primary bool) EndpointStats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return EndpointStats{Endpoint: e.Endpoint, Primary: primary, Healthy: e.healthy, Latency: e.latency, Circuit: e.breaker.current()}
+}
+
+func (e *endpoint) recordCheck(roundTrip time.Duration, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.healthy = err == nil
+	if err != nil {
+		return
+	}
+
+	if e.latency == 0 {
+		e.latency = roundTrip
+	} else {
+		e.latency = time.Duration(latencyWeight*float64(roundTrip) + (1-latencyWeight)*float64(e.latency))
+	}
+}
+
+func (e *endpoint) markUnhealthy() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.healthy = false
+}
+
+// healthChecks makes sure only one round of background health checks runs at a time
+type healthChecks struct {
+	mutex   sync.Mutex
+	running bool
+	last    time.Time
+}
+
+func (h *healthChecks) start(interval time.Duration) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.running || time.Since(h.last) < interval {
+		return false
+	}
+
+	h.running = true
+	return true
+}
+
+func (h *healthChecks) finish() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.running = false
+	h.last = time.Now()
+}
+
+func (c *Client) primary() *endpoint {
+	return c.endpoints[0]
+}
+
+// EndpointStats returns what the client knows about the primary followed by each replica, in the order they were added
+func (c *Client) EndpointStats() []EndpointStats {
+	stats := make([]EndpointStats, len(c.endpoints))
+	for i, e := range c.endpoints {
+		stats[i] = e.stats(i == 0)
+	}
+	return stats
+}
+
+// CheckEndpoints
+/**
+* PING every endpoint and wait for the results
+*
+* Reads routed to replicas run these checks in the background once per health check interval, calling this directly is
+* only needed to refresh the stats sooner.
+ */
+func (c *Client) CheckEndpoints() {
+	var wait sync.WaitGroup
+	for _, e := range c.endpoints {
+		wait.Add(1)
+		go func(e *endpoint) {
+			defer wait.Done()
+			e.recordCheck(c.ping(e))
+		}(e)
+	}
+	wait.Wait()
+}
+
+func (c *Client) ping(e *endpoint) (time.Duration, error) {
+	pingCommand, err := c.wire.EncodeMessage(wire.PING)
+	if err != nil {
+		return 0, err
+	}
+
+	trace := c.newTrace()
+	start := time.Now()
+	responseCommand, responseMessage, err := c.sendTo(trace, e, pingCommand)
+	err, _ = unwrapUnsent(err)
+	trace.finish(wire.PING, start, err)
+	if err != nil {
+		return 0, err
+	}
+
+	switch responseCommand {
+	case wire.ACK:
+		return time.Since(start), nil
+	case wire.ERR:
+		return 0, c.wire.DecodeError(responseMessage)
+	default:
+		return 0, unexpectedResponse(wire.PING, responseCommand)
+	}
+}
+
+// chooseReadEndpoint asks the routing policy for an endpoint out of the primary and the healthy replicas
+func (c *Client) chooseReadEndpoint() *endpoint {
+	if c.checks.start(c.healthCheckInterval) {
+		go func() {
+			c.CheckEndpoints()
+			c.checks.finish()
+		}()
+	}
+
+	candidates := []EndpointStats{c.primary().stats(true)}
+	endpoints := []*endpoint{c.primary()}
+	for _, replica := range c.endpoints[1:] {
+		stats := replica.stats(false)
+		if stats.Healthy {
+			candidates = append(candidates, stats)
+			endpoints = append(endpoints, replica)
+		}
+	}
+
+	chosen := c.routing.ChooseRead(candidates)
+	if chosen < 0 || chosen >= len(endpoints) {
+		return c.primary()
+	}
+	return endpoints[chosen]
+}
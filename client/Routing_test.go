@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"datastore/server"
+	"datastore/wire"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayedTransport slows down every request written to some endpoints and counts the commands each endpoint receives
+type delayedTransport struct {
+	delays map[int]time.Duration
+
+	mutex    sync.Mutex
+	received map[int]map[wire.Command]int
+}
+
+func newDelayedTransport(delays map[int]time.Duration) *delayedTransport {
+	return &delayedTransport{delays: delays, received: map[int]map[wire.Command]int{}}
+}
+
+func (t *delayedTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	connection, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	_, portString, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portString)
+	return &delayedConnection{Conn: connection, transport: t, port: port}, nil
+}
+
+func (t *delayedTransport) count(port int, command wire.Command) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.received[port][command]
+}
+
+type delayedConnection struct {
+	net.Conn
+	transport *delayedTransport
+	port      int
+}
+
+func (c *delayedConnection) Write(request []byte) (int, error) {
+	protocol := wire.Protocol{}
+	command, _ := protocol.DecipherCommand(request)
+
+	c.transport.mutex.Lock()
+	if c.transport.received[c.port] == nil {
+		c.transport.received[c.port] = map[wire.Command]int{}
+	}
+	c.transport.received[c.port][command]++
+	c.transport.mutex.Unlock()
+
+	time.Sleep(c.transport.delays[c.port])
+	return c.Conn.Write(request)
+}
+
+func startServers(t *testing.T, ports ...int) {
+	for _, port := range ports {
+		runningServer := server.New("localhost", port)
+		err := runningServer.Start()
+		if err != nil {
+			t.Fatalf("Error starting server on %d %q", port, err)
+		}
+		t.Cleanup(func() { runningServer.Stop() })
+	}
+	time.Sleep(time.Millisecond * 100) // give the servers time to fully start
+}
+
+func TestNearestReadsPreferTheFastestEndpoint(t *testing.T) {
+	startServers(t, 8902, 8903, 8904)
+
+	transport := newDelayedTransport(map[int]time.Duration{8902: time.Millisecond * 20, 8903: time.Millisecond * 20})
+	client := New("localhost", 8902,
+		WithReplicas(Endpoint{Address: "localhost", Port: 8903}, Endpoint{Address: "localhost", Port: 8904}),
+		WithRoutingPolicy(NearestReads(0.2)),
+		WithHealthCheckInterval(time.Hour),
+		WithTransport(transport),
+	)
+
+	for i := 0; i < 3; i++ {
+		client.CheckEndpoints()
+	}
+
+	stats := client.EndpointStats()
+	if len(stats) != 3 || !stats[0].Primary || stats[1].Primary || stats[2].Primary {
+		t.Fatalf("Expected stats for the primary followed by 2 replicas but got %v", stats)
+	}
+	if stats[2].Latency == 0 || stats[2].Latency >= stats[0].Latency || stats[2].Latency >= stats[1].Latency {
+		t.Fatalf("Expected the undelayed replica to have the lowest latency but got %v", stats)
+	}
+
+	for i := 0; i < 20; i++ {
+		_, _, err := client.Read("key")
+		if err != nil {
+			t.Fatalf("Expected read %d to succeed but got %q", i, err)
+		}
+	}
+
+	if transport.count(8904, wire.READ) != 20 {
+		t.Fatalf("Expected every read to go to the fastest replica but it received %d", transport.count(8904, wire.READ))
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Upsert("key"+strconv.Itoa(i), "value")
+		if err != nil {
+			t.Fatalf("Expected write %d to succeed but got %q", i, err)
+		}
+	}
+
+	if transport.count(8902, wire.UPSERT) != 10 || transport.count(8903, wire.UPSERT) != 0 || transport.count(8904, wire.UPSERT) != 0 {
+		t.Fatalf("Expected every write to go to the primary")
+	}
+
+	// the servers do not replicate, so a write that reached a replica would show up in its count
+	for _, port := range []int{8903, 8904} {
+		replica := New("localhost", port)
+		count, err := replica.Count()
+		if err != nil || count != 0 {
+			t.Fatalf("Expected no keys written to the replica on %d but found %d: %q", port, count, err)
+		}
+	}
+}
+
+func TestRoundRobinReadsSkipUnhealthyEndpoints(t *testing.T) {
+	startServers(t, 8905, 8906)
+
+	// nothing listens on 8907
+	transport := newDelayedTransport(nil)
+	client := New("localhost", 8905,
+		WithReplicas(Endpoint{Address: "localhost", Port: 8906}, Endpoint{Address: "localhost", Port: 8907}),
+		WithRoutingPolicy(RoundRobinReads()),
+		WithHealthCheckInterval(time.Hour),
+		WithTransport(transport),
+	)
+
+	_, err := client.Upsert("key", "value")
+	if err != nil {
+		t.Fatalf("Expected the write to succeed but got %q", err)
+	}
+
+	// reads routed to the missing replica fall back to the primary and take it out of rotation
+	for i := 0; i < 9; i++ {
+		_, _, err := client.Read("key")
+		if err != nil {
+			t.Fatalf("Expected read %d to succeed but got %q", i, err)
+		}
+	}
+
+	stats := client.EndpointStats()
+	if !stats[0].Healthy || !stats[1].Healthy || stats[2].Healthy {
+		t.Fatalf("Expected only the missing replica to be unhealthy but got %v", stats)
+	}
+
+	client.CheckEndpoints()
+	stats = client.EndpointStats()
+	if stats[2].Healthy || stats[2].Latency != 0 {
+		t.Fatalf("Expected the missing replica to fail its health check but got %v", stats[2])
+	}
+
+	primaryReads, replicaReads := transport.count(8905, wire.READ), transport.count(8906, wire.READ)
+	for i := 0; i < 10; i++ {
+		client.Read("key")
+	}
+
+	if transport.count(8905, wire.READ)-primaryReads != 5 || transport.count(8906, wire.READ)-replicaReads != 5 {
+		t.Fatalf("Expected reads to alternate between the healthy endpoints")
+	}
+}
+
+func TestNearestReadsHysteresis(t *testing.T) {
+	primary := Endpoint{Address: "primary", Port: 1}
+	near := Endpoint{Address: "near", Port: 1}
+	far := Endpoint{Address: "far", Port: 1}
+
+	policy := NearestReads(0.2)
+
+	unmeasured := []EndpointStats{{Endpoint: primary, Primary: true, Healthy: true}, {Endpoint: near, Healthy: true}}
+	if policy.ChooseRead(unmeasured) != 0 {
+		t.Fatalf("Expected reads to go to the primary before any latency is measured")
+	}
+
+	candidates := []EndpointStats{
+		{Endpoint: primary, Primary: true, Healthy: true, Latency: time.Millisecond * 30},
+		{Endpoint: near, Healthy: true, Latency: time.Millisecond * 10},
+		{Endpoint: far, Healthy: true, Latency: time.Millisecond * 20},
+	}
+	if policy.ChooseRead(candidates) != 1 {
+		t.Fatalf("Expected reads to go to the nearest endpoint")
+	}
+
+	// far is now a little faster, but not by enough to move
+	candidates[2].Latency = time.Millisecond * 9
+	if policy.ChooseRead(candidates) != 1 {
+		t.Fatalf("Expected reads to stay on the current endpoint within the hysteresis")
+	}
+
+	candidates[2].Latency = time.Millisecond * 7
+	if policy.ChooseRead(candidates) != 2 {
+		t.Fatalf("Expected reads to move once another endpoint is clearly faster")
+	}
+
+	// the current endpoint dropping out of the candidates moves reads to the fastest remaining one
+	if policy.ChooseRead(candidates[:2]) != 1 {
+		t.Fatalf("Expected reads to move when the current endpoint is no longer a candidate")
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"datastore/wire"
+	"sync"
+)
+
+// Session
+/**
+* A handle on the client whose commands are strictly ordered: each is sent to the primary over the session's own
+* connection only once the one before it has been answered, so it always sees the effects of every earlier command in
+* the session. An Insert followed by an Expire of the same key can never be applied the other way around.
+*
+* A session can be shared between goroutines, whose commands are then sent one at a time in the order they were called.
+* Reads go to the primary whatever the client's routing policy. If the connection fails or the server recycles it the
+* session moves to a new one, which keeps the order because nothing is in flight when it does.
+*
+* Close hands the connection back to the client once the session is no longer needed.
+ */
+type Session struct {
+	Client
+}
+
+// sessionConnection holds the connection of a session, its mutex is held for the whole of each command
+type sessionConnection struct {
+	mutex       sync.Mutex
+	connections connectionPool
+}
+
+// Session starts a session on the client, see Session
+func (c *Client) Session() *Session {
+	session := &Session{Client: *c}
+	session.Client.session = &sessionConnection{}
+	return session
+}
+
+// Close returns the session's connection to the client's pool, a session used after Close opens a new connection
+func (s *Session) Close() {
+	s.session.mutex.Lock()
+	defer s.session.mutex.Unlock()
+
+	pooled := s.session.connections.get()
+	if pooled != nil {
+		s.primary().connections.put(pooled)
+	}
+}
+
+// send sends a message through the session's connection, taking an idle one from the client or dialing a new one when
+// it has none
+func (s *sessionConnection) send(trace *callTrace, c *Client, message []byte) (wire.Command, []byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.connections.idle) == 0 {
+		if pooled := c.primary().connections.get(); pooled != nil {
+			s.connections.put(pooled)
+		}
+	}
+
+	return c.sendThrough(trace, c.primary(), &s.connections, message)
+}
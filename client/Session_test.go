@@ -0,0 +1,90 @@
+package client
+
+import (
+	"datastore/server"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionAppliesInsertThenExpireInOrder(t *testing.T) {
+	// recycle connections often so the session has to move between them part way through
+	runningServer := server.New("localhost", 8917, server.WithMaxRequestsPerConnection(50))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8917)
+	session := client.Session()
+	defer session.Close()
+
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	var writers sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		writers.Add(1)
+		go func(writer int) {
+			defer writers.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("key:%d:%d", writer, i)
+				session.Insert(key, "abc123")
+				session.Expire(key, expiration)
+			}
+		}(writer)
+	}
+	writers.Wait()
+
+	for writer := 0; writer < 8; writer++ {
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key:%d:%d", writer, i)
+			found, present, err := client.ReadExpiration(key)
+			if err != nil || !present || !found.Equal(expiration) {
+				t.Fatalf("Expected %q to expire at %s but found %s, present=%t: %q", key, expiration, found, present, err)
+			}
+		}
+	}
+}
+
+func TestSessionSendsEverythingToThePrimaryOverOneConnection(t *testing.T) {
+	primary := server.New("localhost", 8918)
+	replica := server.New("localhost", 8919)
+	for _, runningServer := range []*server.Server{&primary, &replica} {
+		err := runningServer.Start()
+		if err != nil {
+			t.Fatalf("Error starting server %q", err)
+		}
+		defer runningServer.Stop()
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	client := New("localhost", 8918,
+		WithReplicas(Endpoint{Address: "localhost", Port: 8919}),
+		WithRoutingPolicy(RoundRobinReads()),
+		WithHealthCheckInterval(time.Hour),
+	)
+	session := client.Session()
+
+	// the replica never sees the writes, so any read routed to it would miss the key
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		session.Insert(key, "abc123")
+		value, present, err := session.Read(key)
+		if err != nil || !present || value != "abc123" {
+			t.Fatalf("Expected the session to read back %q but got %q, present=%t: %q", key, value, present, err)
+		}
+	}
+
+	if primary.AcceptedConnections() != 1 || replica.AcceptedConnections() != 0 {
+		t.Fatalf("Expected one connection to the primary but found %d to the primary and %d to the replica", primary.AcceptedConnections(), replica.AcceptedConnections())
+	}
+
+	// the connection goes back to the client when the session is closed
+	session.Close()
+	client.Insert("after", "abc123")
+	if primary.AcceptedConnections() != 1 {
+		t.Fatalf("Expected the client to reuse the session's connection but the primary accepted %d", primary.AcceptedConnections())
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"datastore/wire"
+	"time"
+)
+
+// TxnResult is what one command of a Txn did, Applied and Err being what the Client method of the same name returns
+type TxnResult struct {
+	Applied bool
+	Err     error
+}
+
+// Txn
+/**
+* Writes queued to be applied together by Commit, see Client.Begin. A Txn is not safe for use by several goroutines at
+* once.
+ */
+type Txn struct {
+	client   *Client
+	commands [][]byte
+}
+
+// Begin
+/**
+* Start a transaction, queueing writes that Commit sends to the primary in a single MULTI request. The server applies
+* them in order with nothing in between, so no reader sees some of them applied and others not, for example a key
+* deleted before another replacing it is written.
+*
+* Commands of a transaction can still fail on their own, such as an Insert of a key that is present, without stopping
+* the commands after them or undoing those before them.
+ */
+func (c *Client) Begin() *Txn {
+	return &Txn{client: c}
+}
+
+// Insert queues an Insert of a new key
+func (t *Txn) Insert(key string, value string) {
+	t.queue(wire.INSERT, key, value)
+}
+
+// Update queues an Update of a key that is present
+func (t *Txn) Update(key string, value string) {
+	t.queue(wire.UPDATE, key, value)
+}
+
+// Upsert queues an Upsert of a key whether or not it is present
+func (t *Txn) Upsert(key string, value string) {
+	t.queue(wire.UPSERT, key, value)
+}
+
+// Delete queues a Delete of a key that is present
+func (t *Txn) Delete(key string) {
+	t.queue(wire.DELETE, key)
+}
+
+// Expire queues an Expire of a key that is present
+func (t *Txn) Expire(key string, expiration time.Time) {
+	t.queue(wire.EXPIRE, key, t.client.wire.EncodeTime(expiration))
+}
+
+func (t *Txn) queue(command wire.Command, arguments ...string) {
+	message, _ := t.client.wire.EncodeMessage(command, arguments...)
+	t.commands = append(t.commands, message)
+}
+
+// Commit
+/**
+* Send the queued commands in a single MULTI request and return the result of each, in the order they were queued. The
+* queue is emptied, so the Txn can be used for another transaction.
+*
+* An error means nothing was applied: the request could not be sent, or the server refused the whole transaction
+* because one of its commands is under a protected prefix or was refused by its middleware. A transaction too large for
+* one frame is refused rather than split, as its commands would no longer be applied together.
+ */
+func (t *Txn) Commit() ([]TxnResult, error) {
+	commands := t.commands
+	t.commands = nil
+	if len(commands) == 0 {
+		return []TxnResult{}, nil
+	}
+
+	c := t.client
+	multiCommand, err := c.wire.EncodeMulti(commands)
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, err := c.connectAndSendMessage(multiCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseCommand {
+	case wire.MULTI:
+	case wire.ERR:
+		return nil, c.wire.DecodeError(responseMessage)
+	default:
+		return nil, unexpectedResponse(wire.MULTI, responseCommand)
+	}
+
+	responses, err := c.wire.DecodeMultiResponse(responseMessage, len(commands))
+	if err != nil {
+		return nil, malformedResponse(err)
+	}
+
+	results := make([]TxnResult, len(responses))
+	for i, response := range responses {
+		command, _ := c.wire.DecipherCommand(commands[i])
+		answered, err := c.wire.DecipherCommand(response)
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+
+		switch answered {
+		case wire.ACK:
+			results[i].Applied = true
+		case wire.NULL:
+		case wire.ERR:
+			results[i].Err = c.wire.DecodeError(response)
+		default:
+			return nil, unexpectedResponse(command, answered)
+		}
+	}
+
+	return results, nil
+}
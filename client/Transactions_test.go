@@ -0,0 +1,61 @@
+package client
+
+import (
+	"datastore/server"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTxnAppliesItsCommandsTogether(t *testing.T) {
+	runningServer := server.New("localhost", 8967, server.WithProtectedPrefixes("system"))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	client := New("localhost", 8967)
+	defer client.Close()
+	client.Insert("cart:1", "apple")
+
+	txn := client.Begin()
+	txn.Delete("cart:1")
+	txn.Upsert("order:1", "apple")
+	txn.Upsert("order:1", "apple")
+	txn.Insert("order:1", "pear")
+	txn.Expire("order:1", time.Now().Add(time.Hour))
+	results, err := txn.Commit()
+	if err != nil {
+		t.Fatalf("Expected the transaction to be committed but got %q", err)
+	}
+
+	expected := []TxnResult{{Applied: true}, {Applied: true}, {}, {Err: ErrKeyExists}, {Applied: true}}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results but got %+v", len(expected), results)
+	}
+	for i, result := range results {
+		if result.Applied != expected[i].Applied || !errors.Is(result.Err, expected[i].Err) || (result.Err == nil) != (expected[i].Err == nil) {
+			t.Fatalf("Expected result %d to be %+v but got %+v", i, expected[i], result)
+		}
+	}
+	if present, _ := client.Present("cart:1"); present {
+		t.Fatalf("Expected the cart to be deleted")
+	}
+	if value, _, _ := client.Read("order:1"); value != "apple" {
+		t.Fatalf("Expected the order to hold the cart but found %q", value)
+	}
+
+	// the commit emptied the queue, and a protected key refuses the whole of the next transaction
+	txn.Upsert("order:2", "pear")
+	txn.Insert("system:1", "pear")
+	if _, err := txn.Commit(); !errors.Is(err, ErrProtected) {
+		t.Fatalf("Expected the transaction to be refused for its protected key but got %q", err)
+	}
+	if present, _ := client.Present("order:2"); present {
+		t.Fatalf("Expected nothing of the refused transaction to be applied")
+	}
+	if results, err := txn.Commit(); err != nil || len(results) != 0 {
+		t.Fatalf("Expected committing nothing to succeed without results but got %+v: %q", results, err)
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"datastore/wire"
+	"sync"
+	"time"
+)
+
+// Change
+/**
+* A change to a key under the prefix of a Watch, see engine.Change for the operations. Err is only set on the last
+* change a watch hands its handler, when the watch ended because the connection failed, and the other fields are empty
+* then.
+ */
+type Change struct {
+	wire.Change
+	Err error
+}
+
+// Watch
+/**
+* Call handler with every change made from now on to the keys under prefix in the client's database, in the order they
+* were made, until stop is called. Watch returns once the primary has subscribed, so every change made after it
+* returns is seen.
+*
+* The changes are read from a connection of the watch's own on a goroutine that handler runs on, so a slow handler
+* holds up the changes after it, and the server drops changes for a watch that falls too far behind. The server sends
+* a PING every half of the client's timeout while nothing changes, and the watch ends when nothing arrives for the
+* timeout past that, so a server that went away is noticed. When the watch ends for any reason other than stop, handler
+* is called one last time with a Change whose Err says why.
+*
+* stop closes the connection and waits for handler to return, so handler is not called once stop returns and must not
+* call stop itself. stop may be called more than once.
+ */
+func (c *Client) Watch(prefix string, handler func(Change)) (stop func(), err error) {
+	heartbeat := c.timeout / 2
+	watchCommand, err := c.wire.EncodeMessage(wire.WATCH, prefix, c.wire.EncodeDuration(heartbeat))
+	if err != nil {
+		return nil, err
+	}
+
+	pooled, err := c.dialAndAuthenticate(c.primary())
+	if err != nil {
+		return nil, err
+	}
+
+	responseCommand, responseMessage, _, err := c.roundTrip(pooled, watchCommand)
+	if err == nil && responseCommand == wire.ERR {
+		err = c.wire.DecodeError(responseMessage)
+	} else if err == nil && responseCommand != wire.ACK {
+		err = unexpectedResponse(wire.WATCH, responseCommand)
+	}
+	if err != nil {
+		pooled.connection.Close()
+		return nil, err
+	}
+
+	stopping := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		err := c.readChanges(pooled, heartbeat, handler)
+		select {
+		case <-stopping:
+		default:
+			handler(Change{Err: err})
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopping)
+			pooled.connection.Close()
+		})
+		<-finished
+	}, nil
+}
+
+// readChanges hands handler every EVENT frame read from a watch's connection, skipping the heartbeats, until a read
+// fails, waiting for each frame up to the client's timeout past the heartbeat
+func (c *Client) readChanges(pooled *pooledConnection, heartbeat time.Duration, handler func(Change)) error {
+	defer pooled.connection.Close()
+
+	for {
+		err := pooled.connection.SetReadDeadline(time.Now().Add(heartbeat + c.timeout))
+		if err != nil {
+			return err
+		}
+
+		message, err := readFrame(pooled.frames)
+		if err != nil {
+			return err
+		}
+
+		command, err := c.wire.DecipherCommand(message)
+		if err != nil {
+			return malformedResponse(err)
+		}
+		switch command {
+		case wire.PING:
+			continue
+		case wire.EVENT:
+			change, err := c.wire.DecodeEvent(message)
+			if err != nil {
+				return malformedResponse(err)
+			}
+			handler(Change{Change: change})
+		case wire.ERR:
+			return c.wire.DecodeError(message)
+		default:
+			return unexpectedResponse(wire.WATCH, command)
+		}
+	}
+}
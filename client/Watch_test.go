@@ -0,0 +1,135 @@
+package client
+
+import (
+	"datastore/server"
+	"datastore/wire"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// collectChanges returns a handler sending every change it is called with to the returned channel
+func collectChanges() (func(Change), chan Change) {
+	changes := make(chan Change, 100)
+	return func(change Change) { changes <- change }, changes
+}
+
+// nextChange fails the test unless a change arrives within a second
+func nextChange(t *testing.T, changes chan Change) Change {
+	t.Helper()
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a change within a second")
+		return Change{}
+	}
+}
+
+func TestWatchStreamsChangesInOrder(t *testing.T) {
+	runningServer := server.New("localhost", 8966)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	watcher := New("localhost", 8966)
+	defer watcher.Close()
+	handler, changes := collectChanges()
+	stop, err := watcher.Watch("orders:", handler)
+	if err != nil {
+		t.Fatalf("Expected the watch to start but got %q", err)
+	}
+
+	writer := New("localhost", 8966)
+	defer writer.Close()
+	writer.Insert("orders:1", "pending")
+	writer.Insert("customers:1", "ada")
+	writer.Insert("orders:2", "pending")
+	writer.Update("orders:1", "shipped")
+	writer.Delete("orders:2")
+
+	expected := []Change{
+		{Change: wire.Change{Operation: "insert", Key: "orders:1", Value: "pending"}},
+		{Change: wire.Change{Operation: "insert", Key: "orders:2", Value: "pending"}},
+		{Change: wire.Change{Operation: "update", Key: "orders:1", Value: "shipped"}},
+		{Change: wire.Change{Operation: "delete", Key: "orders:2", Value: "pending"}},
+	}
+	previous := uint64(0)
+	for _, want := range expected {
+		change := nextChange(t, changes)
+		if change.Err != nil || change.Operation != want.Operation || change.Key != want.Key || change.Value != want.Value {
+			t.Fatalf("Expected %s of %q to %q but received %+v", want.Operation, want.Key, want.Value, change)
+		}
+		if change.Sequence <= previous {
+			t.Fatalf("Expected changes in sequence order but %d came after %d", change.Sequence, previous)
+		}
+		previous = change.Sequence
+	}
+
+	// stopping the watch calls the handler no more, not even with an error
+	stop()
+	stop()
+	writer.Insert("orders:3", "pending")
+	select {
+	case change := <-changes:
+		t.Fatalf("Expected no changes once the watch stopped but received %+v", change)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// startSilentServer answers CAPABILITIES with an error and WATCH with ACK, and then never sends anything
+func startSilentServer(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening %q", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { connection.Close() })
+
+		protocol := wire.Protocol{}
+		frames := wire.NewFrameReader(connection, uint32(wire.DefaultMaxMessageSize))
+		for {
+			request, err := frames.ReadFrame()
+			if err != nil {
+				return
+			}
+			command, _ := protocol.DecipherCommand(request)
+			if command == wire.WATCH {
+				connection.Write(protocol.EncodeAckResponse())
+				continue
+			}
+			connection.Write(protocol.EncodeErrResponse(errors.New("unknown command")))
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestWatchEndsWhenTheServerStopsSendingHeartbeats(t *testing.T) {
+	port := startSilentServer(t)
+	watcher := New("localhost", port, WithTimeout(time.Millisecond*100))
+	defer watcher.Close()
+
+	handler, changes := collectChanges()
+	stop, err := watcher.Watch("", handler)
+	if err != nil {
+		t.Fatalf("Expected the watch to start but got %q", err)
+	}
+	defer stop()
+
+	change := nextChange(t, changes)
+	if !errors.Is(change.Err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected the watch to end for missing heartbeats but received %+v", change)
+	}
+}
@@ -0,0 +1,296 @@
+package faults
+
+import (
+	"bufio"
+	"context"
+	"datastore/client"
+	"datastore/wire"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type Kind int
+
+const (
+	// Respond passes the server's response through untouched
+	Respond Kind = iota
+	// WrongCommand replaces the command of the response frame
+	WrongCommand
+	// Corrupt flips every bit of one byte of the response frame
+	Corrupt
+	// Truncate sends only the start of the response frame and then closes the connection
+	Truncate
+	// OverstateLength declares a frame length larger than the bytes that follow, and then sends nothing else
+	OverstateLength
+	// Delay waits before sending the response
+	Delay
+	// Trickle sends the response one byte at a time with a wait before each byte
+	Trickle
+	// CloseEarly closes the connection once the request has been written, without sending a response
+	CloseEarly
+)
+
+// Fault
+/**
+* What happens to the response of one request
+*
+* Use the constructor functions rather than building a Fault directly.
+ */
+type Fault struct {
+	Kind    Kind
+	Offset  int
+	Wait    time.Duration
+	Command wire.Command
+}
+
+func RespondNormally() Fault {
+	return Fault{Kind: Respond}
+}
+
+// RespondWith replaces the response command with the provided command, keeping the arguments
+func RespondWith(command wire.Command) Fault {
+	return Fault{Kind: WrongCommand, Command: command}
+}
+
+// CorruptAt flips the byte at the provided offset of the response frame, offsets past the end change nothing
+func CorruptAt(offset int) Fault {
+	return Fault{Kind: Corrupt, Offset: offset}
+}
+
+// TruncateAt sends the first offset bytes of the response frame and then closes the connection
+func TruncateAt(offset int) Fault {
+	return Fault{Kind: Truncate, Offset: offset}
+}
+
+// OverstateLengthBy adds extra to the declared length of the response frame
+func OverstateLengthBy(extra int) Fault {
+	return Fault{Kind: OverstateLength, Offset: extra}
+}
+
+// DelayBy waits for the provided duration before sending the response
+func DelayBy(wait time.Duration) Fault {
+	return Fault{Kind: Delay, Wait: wait}
+}
+
+// TrickleEvery sends the response one byte at a time, waiting interval before each byte
+func TrickleEvery(interval time.Duration) Fault {
+	return Fault{Kind: Trickle, Wait: interval}
+}
+
+func CloseAfterRequest() Fault {
+	return Fault{Kind: CloseEarly}
+}
+
+// FaultyTransport
+/**
+* A client.Transport that connects to a real server and misbehaves on the way back according to a script
+*
+* Every request written on any connection opened by the transport takes the next fault from the script, in order, and
+* once the script runs out responses are passed through normally. Requests still reach the server unchanged, only
+* responses are tampered with, so a request that fails on the client may have been applied by the server.
+ */
+type FaultyTransport struct {
+	dialer client.Transport
+
+	mutex    sync.Mutex
+	script   []Fault
+	requests int
+}
+
+// New creates a FaultyTransport that opens its connections with dialer, or a net.Dialer when dialer is nil
+func New(dialer client.Transport, script ...Fault) *FaultyTransport {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	return &FaultyTransport{dialer: dialer, script: script}
+}
+
+// Requests returns the number of requests written through the transport so far
+func (t *FaultyTransport) Requests() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.requests
+}
+
+func (t *FaultyTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	connection, err := t.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultyConnection{Conn: connection, transport: t, reader: bufio.NewReader(connection)}, nil
+}
+
+func (t *FaultyTransport) next() Fault {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	fault := RespondNormally()
+	if t.requests < len(t.script) {
+		fault = t.script[t.requests]
+	}
+	t.requests++
+
+	return fault
+}
+
+// faultyConnection
+/**
+* Writing a request reads the server's whole response up front and rewrites it according to the fault, reads then
+* hand out the rewritten bytes. Once those run out reads fall through to the real connection, which is how an
+* overstated length ends up waiting for bytes that never come.
+ */
+type faultyConnection struct {
+	net.Conn
+	transport *FaultyTransport
+	reader    *bufio.Reader
+
+	fault    Fault
+	pending  []byte
+	readErr  error
+	delayed  bool
+	deadline time.Time
+}
+
+func (c *faultyConnection) Write(request []byte) (int, error) {
+	written, err := c.Conn.Write(request)
+	if err != nil {
+		return written, err
+	}
+
+	c.fault = c.transport.next()
+	c.pending = nil
+	c.readErr = nil
+	c.delayed = false
+
+	if c.fault.Kind == CloseEarly {
+		c.Conn.Close()
+		c.readErr = io.EOF
+		return written, nil
+	}
+
+	response, err := c.readResponse()
+	if err != nil {
+		c.readErr = err
+		return written, nil
+	}
+
+	c.pending = c.apply(response)
+
+	// anything the server sent after the response, such as a recycle notice, is passed through untouched
+	if c.reader.Buffered() > 0 {
+		trailing, _ := c.reader.Peek(c.reader.Buffered())
+		c.pending = append(c.pending, trailing...)
+		c.reader.Discard(len(trailing))
+	}
+
+	return written, nil
+}
+
+func (c *faultyConnection) Read(buffer []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		return c.reader.Read(buffer)
+	}
+
+	count := len(c.pending)
+	switch c.fault.Kind {
+	case Delay:
+		if !c.delayed {
+			c.delayed = true
+			err := c.wait(c.fault.Wait)
+			if err != nil {
+				return 0, err
+			}
+		}
+	case Trickle:
+		err := c.wait(c.fault.Wait)
+		if err != nil {
+			return 0, err
+		}
+		count = 1
+	}
+
+	count = copy(buffer, c.pending[:count])
+	c.pending = c.pending[count:]
+	return count, nil
+}
+
+func (c *faultyConnection) SetDeadline(deadline time.Time) error {
+	c.deadline = deadline
+	return c.Conn.SetDeadline(deadline)
+}
+
+func (c *faultyConnection) SetReadDeadline(deadline time.Time) error {
+	c.deadline = deadline
+	return c.Conn.SetReadDeadline(deadline)
+}
+
+// wait sleeps for the provided duration, or until the read deadline and then fails the same way a real read would
+func (c *faultyConnection) wait(duration time.Duration) error {
+	if !c.deadline.IsZero() && time.Now().Add(duration).After(c.deadline) {
+		time.Sleep(time.Until(c.deadline))
+		return os.ErrDeadlineExceeded
+	}
+
+	time.Sleep(duration)
+	return nil
+}
+
+func (c *faultyConnection) readResponse() ([]byte, error) {
+	messageSizeBytes, err := c.reader.Peek(wire.LengthPrefixSize)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.LittleEndian.Uint32(messageSizeBytes))
+	_, err = io.ReadFull(c.reader, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (c *faultyConnection) apply(response []byte) []byte {
+	switch c.fault.Kind {
+	case WrongCommand:
+		protocol := wire.Protocol{}
+		command, err := protocol.DecipherCommand(response)
+		if err != nil {
+			return response
+		}
+
+		// swap the command between the leading separator and the rest of the frame, then fix up the length
+		rewritten := append([]byte{}, response[:wire.LengthPrefixSize+1]...)
+		rewritten = append(rewritten, []byte(c.fault.Command)...)
+		rewritten = append(rewritten, response[wire.LengthPrefixSize+1+len(command):]...)
+		binary.LittleEndian.PutUint32(rewritten, uint32(len(rewritten)))
+		return rewritten
+	case Corrupt:
+		if c.fault.Offset < len(response) {
+			response[c.fault.Offset] ^= 0xFF
+		}
+		return response
+	case Truncate:
+		c.Conn.Close()
+		c.readErr = io.EOF
+		if c.fault.Offset < len(response) {
+			return response[:c.fault.Offset]
+		}
+		return response
+	case OverstateLength:
+		declared := binary.LittleEndian.Uint32(response)
+		binary.LittleEndian.PutUint32(response, declared+uint32(c.fault.Offset))
+		return response
+	default:
+		return response
+	}
+}
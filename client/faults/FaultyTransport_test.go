@@ -0,0 +1,156 @@
+package faults
+
+import (
+	"datastore/client"
+	"datastore/server"
+	"datastore/wire"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClientHandlesProtocolFaults(t *testing.T) {
+	runningServer := server.New("localhost", 8894)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100) // give runningServer time to fully start
+
+	seed := client.New("localhost", 8894)
+	_, err = seed.Upsert("key", "value")
+	if err != nil {
+		t.Fatalf("Error seeding server %q", err)
+	}
+
+	cases := []struct {
+		name     string
+		fault    Fault
+		expected error
+	}{
+		{"wrong command", RespondWith(wire.COUNT), client.ErrUnexpectedResponse},
+		{"unknown command", RespondWith("BOGUS"), client.ErrMalformedResponse},
+		{"corrupt command", CorruptAt(6), client.ErrMalformedResponse},
+		{"corrupt argument length", CorruptAt(11), client.ErrMalformedResponse},
+		{"corrupt frame length", CorruptAt(3), client.ErrMalformedResponse},
+		{"truncated length prefix", TruncateAt(2), io.ErrUnexpectedEOF},
+		{"truncated frame", TruncateAt(10), io.ErrUnexpectedEOF},
+		{"empty response", TruncateAt(0), io.EOF},
+		{"overstated length", OverstateLengthBy(10), os.ErrDeadlineExceeded},
+		{"impossible length", OverstateLengthBy(1 << 31), client.ErrMalformedResponse},
+		{"slow response", DelayBy(time.Second), os.ErrDeadlineExceeded},
+		{"slow trickle", TrickleEvery(time.Millisecond * 50), os.ErrDeadlineExceeded},
+		{"closed after request", CloseAfterRequest(), io.EOF},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the first request on a new connection asks the server for its capabilities, the fault hits the read after it
+			transport := New(nil, RespondNormally(), testCase.fault)
+			faultyClient := client.New("localhost", 8894, client.WithTransport(transport), client.WithTimeout(time.Millisecond*200))
+
+			start := time.Now()
+			value, present, err := faultyClient.Read("key")
+			if !errors.Is(err, testCase.expected) {
+				t.Fatalf("Expected %q but got %q with value %q present %t", testCase.expected, err, value, present)
+			}
+			if time.Since(start) > time.Second {
+				t.Fatalf("Expected the fault to be reported within the timeout but it took %s", time.Since(start))
+			}
+
+			// the faulty connection must not be reused, so the next request goes through cleanly
+			value, present, err = faultyClient.Read("key")
+			if err != nil || !present || value != "value" {
+				t.Fatalf("Expected the request after a fault to succeed but got %q: %q", value, err)
+			}
+		})
+	}
+}
+
+func TestClientToleratesSlowButTimelyResponses(t *testing.T) {
+	runningServer := server.New("localhost", 8895)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	transport := New(nil, RespondNormally(), DelayBy(time.Millisecond*50), TrickleEvery(time.Millisecond), RespondNormally())
+	faultyClient := client.New("localhost", 8895, client.WithTransport(transport), client.WithTimeout(time.Second))
+
+	success, err := faultyClient.Insert("key", "value")
+	if !success || err != nil {
+		t.Fatalf("Expected a delayed response to succeed but got %q", err)
+	}
+
+	value, present, err := faultyClient.Read("key")
+	if err != nil || !present || value != "value" {
+		t.Fatalf("Expected a trickled response to decode to %q but got %q: %q", "value", value, err)
+	}
+}
+
+func TestClientRetriesRequestsOnStaleConnections(t *testing.T) {
+	runningServer := server.New("localhost", 8896)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	transport := New(nil, RespondNormally(), RespondNormally(), CloseAfterRequest())
+	faultyClient := client.New("localhost", 8896, client.WithTransport(transport))
+
+	_, err = faultyClient.Upsert("key", "value")
+	if err != nil {
+		t.Fatalf("Expected the first request to succeed but got %q", err)
+	}
+
+	// the pooled connection dies without a response, which looks like the server closed it while idle
+	value, present, err := faultyClient.Read("key")
+	if err != nil || !present || value != "value" {
+		t.Fatalf("Expected the read to be retried on a new connection but got %q: %q", value, err)
+	}
+	if transport.Requests() != 4 {
+		t.Fatalf("Expected 4 requests including the retry and the capabilities asked on the first connection but found %d", transport.Requests())
+	}
+}
+
+func TestClientNeverPanicsOnCorruptedResponses(t *testing.T) {
+	runningServer := server.New("localhost", 8897)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	seed := client.New("localhost", 8897)
+	seed.Upsert("region:1:store:1", "abc123")
+	seed.Upsert("region:1:store:2", "def456")
+
+	typedErrors := []error{client.ErrMalformedResponse, client.ErrUnexpectedResponse, os.ErrDeadlineExceeded, io.ErrUnexpectedEOF}
+
+	// every byte of a KEYSBY response with two keys
+	for offset := 0; offset < 60; offset++ {
+		transport := New(nil, RespondNormally(), CorruptAt(offset))
+		faultyClient := client.New("localhost", 8897, client.WithTransport(transport), client.WithTimeout(time.Millisecond*100))
+
+		_, err := faultyClient.KeysBy("region")
+		if err == nil {
+			continue
+		}
+
+		typed := false
+		for _, typedError := range typedErrors {
+			typed = typed || errors.Is(err, typedError)
+		}
+		if !typed {
+			t.Fatalf("Expected corrupting byte %d to produce a typed error but got %q", offset, err)
+		}
+	}
+}
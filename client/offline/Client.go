@@ -0,0 +1,288 @@
+package offline
+
+import (
+	"datastore/client"
+	"datastore/engine"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by writes made while offline when the replay queue is full and the overflow policy is
+// RejectWrites
+var ErrQueueFull = errors.New("offline replay queue is full")
+
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued write to make room for a new one
+	DropOldest OverflowPolicy = iota
+	// RejectWrites refuses new writes with ErrQueueFull until the queue has been flushed
+	RejectWrites
+)
+
+type Options struct {
+	// MaxQueueSize bounds the number of writes buffered while offline, defaults to 10000
+	MaxQueueSize int
+	// OverflowPolicy decides what happens to a write made while offline when the queue is full
+	OverflowPolicy OverflowPolicy
+}
+
+type operationType int
+
+const (
+	upsertOperation operationType = iota
+	deleteOperation
+	expireOperation
+)
+
+type operation struct {
+	kind       operationType
+	key        string
+	value      string
+	expiration time.Time
+}
+
+// Client
+/**
+* A client that keeps accepting writes while the server is unreachable
+*
+* While the server is reachable every operation is sent to it and the result mirrored into a local engine.DataStore.
+* When an operation fails because the server cannot be reached, writes are applied to the local store instead and
+* appended to a bounded replay queue, and reads are served from the local store. The queue is replayed to the server
+* in order before the next operation once it becomes reachable again, or explicitly with Flush.
+*
+* Offline writes are evaluated against the local store only, so for example an offline Insert succeeds for a key the
+* local store has never seen even if the server has it. Replays use Upsert, Delete, and Expire so they are idempotent,
+* and conflicts with writes other clients made during the outage are resolved last writer wins by replay order: a
+* replayed write overwrites whatever the server holds for that key at the time it is replayed.
+ */
+type Client struct {
+	remote  *client.Client
+	local   engine.DataStore
+	options Options
+
+	mutex   sync.Mutex
+	queue   []operation
+	dropped int
+}
+
+func New(remote *client.Client, options Options) *Client {
+	if options.MaxQueueSize <= 0 {
+		options.MaxQueueSize = 10000
+	}
+
+	return &Client{
+		remote:  remote,
+		local:   engine.NewDataStore(),
+		options: options,
+	}
+}
+
+// QueueDepth returns the number of writes waiting to be replayed to the server
+func (c *Client) QueueDepth() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.queue)
+}
+
+// Dropped returns the number of queued writes discarded by the DropOldest policy
+func (c *Client) Dropped() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.dropped
+}
+
+// Flush
+/**
+* Replay queued writes to the server in order
+*
+* Stops at the first write that could not reach the server, leaving it and everything after it queued, and returns
+* that error. Writes the server rejects (for example deleting a key that no longer exists) count as replayed.
+ */
+func (c *Client) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.flush()
+}
+
+func (c *Client) Read(key string) (string, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.flush() == nil {
+		value, present, err := c.remote.Read(key)
+		if !isTransportError(err) {
+			if err == nil {
+				c.mirrorRead(key, value, present)
+			}
+			return value, present, err
+		}
+	}
+
+	value, present := c.local.Read(key)
+	return value, present, nil
+}
+
+func (c *Client) Insert(key string, value string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.flush() == nil {
+		success, err := c.remote.Insert(key, value)
+		if !isTransportError(err) {
+			if success {
+				c.local.Delete(key)
+				c.local.Insert(key, value)
+			}
+			return success, err
+		}
+	}
+
+	return c.writeLocally(operation{kind: upsertOperation, key: key, value: value}, func() bool {
+		return c.local.Insert(key, value)
+	}, client.ErrKeyExists)
+}
+
+func (c *Client) Update(key string, value string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.flush() == nil {
+		success, err := c.remote.Update(key, value)
+		if !isTransportError(err) {
+			if success {
+				c.local.Upsert(key, value)
+			}
+			return success, err
+		}
+	}
+
+	return c.writeLocally(operation{kind: upsertOperation, key: key, value: value}, func() bool {
+		return c.local.Update(key, value)
+	}, client.ErrKeyNotFound)
+}
+
+func (c *Client) Upsert(key string, value string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.flush() == nil {
+		success, err := c.remote.Upsert(key, value)
+		if !isTransportError(err) {
+			if err == nil {
+				c.local.Upsert(key, value)
+			}
+			return success, err
+		}
+	}
+
+	return c.writeLocally(operation{kind: upsertOperation, key: key, value: value}, func() bool {
+		return c.local.Upsert(key, value)
+	}, nil)
+}
+
+func (c *Client) Delete(key string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.flush() == nil {
+		success, err := c.remote.Delete(key)
+		if !isTransportError(err) {
+			c.local.Delete(key)
+			return success, err
+		}
+	}
+
+	return c.writeLocally(operation{kind: deleteOperation, key: key}, func() bool {
+		return c.local.Delete(key)
+	}, client.ErrKeyNotFound)
+}
+
+func (c *Client) Expire(key string, expiration time.Time) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.flush() == nil {
+		success, err := c.remote.Expire(key, expiration)
+		if !isTransportError(err) {
+			if success {
+				c.local.Expire(key, expiration)
+			}
+			return success, err
+		}
+	}
+
+	return c.writeLocally(operation{kind: expireOperation, key: key, expiration: expiration}, func() bool {
+		return c.local.Expire(key, expiration)
+	}, client.ErrKeyNotFound)
+}
+
+// writeLocally
+/**
+* Apply a write to the local store and queue it for replay, returning rejected if the local store refused it
+ */
+func (c *Client) writeLocally(op operation, apply func() bool, rejected error) (bool, error) {
+	if len(c.queue) >= c.options.MaxQueueSize && c.options.OverflowPolicy == RejectWrites {
+		return false, ErrQueueFull
+	}
+
+	if !apply() {
+		return false, rejected
+	}
+
+	if len(c.queue) >= c.options.MaxQueueSize {
+		c.queue = c.queue[1:]
+		c.dropped++
+	}
+	c.queue = append(c.queue, op)
+
+	return true, nil
+}
+
+func (c *Client) flush() error {
+	for len(c.queue) > 0 {
+		op := c.queue[0]
+
+		var err error
+		switch op.kind {
+		case upsertOperation:
+			_, err = c.remote.Upsert(op.key, op.value)
+		case deleteOperation:
+			_, err = c.remote.Delete(op.key)
+		case expireOperation:
+			_, err = c.remote.Expire(op.key, op.expiration)
+		}
+
+		if isTransportError(err) {
+			return err
+		}
+
+		c.queue = c.queue[1:]
+	}
+
+	return nil
+}
+
+func (c *Client) mirrorRead(key string, value string, present bool) {
+	if present {
+		c.local.Upsert(key, value)
+	} else {
+		c.local.Delete(key)
+	}
+}
+
+// isTransportError
+/**
+* Whether an error means the server could not be reached, as opposed to the server answering with a rejection
+ */
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,125 @@
+package offline
+
+import (
+	"datastore/client"
+	"datastore/server"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWritesSurviveAnOutage(t *testing.T) {
+	runningServer := server.New("localhost", 8890)
+	remote := client.New("localhost", 8890)
+	offlineClient := New(&remote, Options{})
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	time.Sleep(time.Millisecond * 100) // give runningServer time to fully start
+
+	success, err := offlineClient.Insert("user:1", "alice")
+	if !success || err != nil || offlineClient.QueueDepth() != 0 {
+		t.Fatalf("Expected an online insert to go straight to the server but got %t: %q", success, err)
+	}
+	offlineClient.Insert("user:2", "bob")
+	offlineClient.Insert("user:3", "carol")
+
+	err = runningServer.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping server %q", err)
+	}
+
+	// none of these should surface an error while the server is down
+	expiration := time.Now().Add(time.Hour)
+	writes := []func() (bool, error){
+		func() (bool, error) { return offlineClient.Insert("user:4", "dave") },
+		func() (bool, error) { return offlineClient.Update("user:1", "alice2") },
+		func() (bool, error) { return offlineClient.Upsert("user:5", "erin") },
+		func() (bool, error) { return offlineClient.Delete("user:2") },
+		func() (bool, error) { return offlineClient.Expire("user:3", expiration) },
+		func() (bool, error) { return offlineClient.Upsert("user:4", "dave2") },
+	}
+	for i, write := range writes {
+		success, err := write()
+		if !success || err != nil {
+			t.Fatalf("Expected offline write %d to succeed locally but got %t: %q", i, success, err)
+		}
+	}
+
+	if offlineClient.QueueDepth() != len(writes) {
+		t.Fatalf("Expected %d queued writes but found %d", len(writes), offlineClient.QueueDepth())
+	}
+
+	value, present, err := offlineClient.Read("user:4")
+	if err != nil || !present || value != "dave2" {
+		t.Fatalf("Expected to read the offline write from the local store but got %q: %q", value, err)
+	}
+
+	err = runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error restarting server %q", err)
+	}
+	defer runningServer.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	err = offlineClient.Flush()
+	if err != nil || offlineClient.QueueDepth() != 0 {
+		t.Fatalf("Expected the queue to flush once the server was back but %d writes remain: %q", offlineClient.QueueDepth(), err)
+	}
+
+	expected := map[string]string{"user:1": "alice2", "user:3": "carol", "user:4": "dave2", "user:5": "erin"}
+	for key, expectedValue := range expected {
+		remoteValue, present, err := remote.Read(key)
+		if err != nil || !present || remoteValue != expectedValue {
+			t.Fatalf("Expected server to converge to %q for key %q but found %q: %q", expectedValue, key, remoteValue, err)
+		}
+
+		localValue, present := offlineClient.local.Read(key)
+		if !present || localValue != remoteValue {
+			t.Fatalf("Expected local store to match server for key %q but found %q", key, localValue)
+		}
+	}
+
+	_, present, _ = remote.Read("user:2")
+	if present {
+		t.Fatalf("Expected the offline delete to be replayed to the server")
+	}
+
+	remoteExpiration, present, err := remote.ReadExpiration("user:3")
+	if err != nil || !present || !remoteExpiration.Equal(expiration) {
+		t.Fatalf("Expected the offline expiration %q to be replayed but found %q: %q", expiration, remoteExpiration, err)
+	}
+
+	remote.Truncate()
+}
+
+func TestQueueOverflowPolicies(t *testing.T) {
+	// nothing listens on this port, so every write is made offline
+	remote := client.New("localhost", 8891)
+
+	offlineClient := New(&remote, Options{MaxQueueSize: 2})
+	offlineClient.Upsert("a", "1")
+	offlineClient.Upsert("b", "2")
+	success, err := offlineClient.Upsert("c", "3")
+	if !success || err != nil || offlineClient.QueueDepth() != 2 || offlineClient.Dropped() != 1 {
+		t.Fatalf("Expected the oldest write to be dropped but queue depth was %d with %d dropped: %q", offlineClient.QueueDepth(), offlineClient.Dropped(), err)
+	}
+	if offlineClient.queue[0].key != "b" {
+		t.Fatalf("Expected the oldest remaining write to be for key b but was %q", offlineClient.queue[0].key)
+	}
+
+	offlineClient = New(&remote, Options{MaxQueueSize: 2, OverflowPolicy: RejectWrites})
+	offlineClient.Upsert("a", "1")
+	offlineClient.Upsert("b", "2")
+	_, err = offlineClient.Upsert("c", "3")
+	if !errors.Is(err, ErrQueueFull) || offlineClient.QueueDepth() != 2 || offlineClient.Dropped() != 0 {
+		t.Fatalf("Expected the new write to be rejected but queue depth was %d: %q", offlineClient.QueueDepth(), err)
+	}
+
+	err = offlineClient.Flush()
+	if err == nil {
+		t.Fatalf("Expected flushing without a server to fail")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"datastore/proxy"
+	"datastore/server"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+)
+
+// datastore-proxy forwards wire protocol traffic to a primary server, mirroring writes to a shadow server and comparing
+// a sample of reads between them, for migrating from one server to another
+func main() {
+	address := flag.String("address", "localhost", "address to listen on")
+	port := flag.Int("port", 8888, "port to listen on")
+	primary := flag.String("primary", "", "host:port of the server every request is forwarded to")
+	shadow := flag.String("shadow", "", "host:port of the server writes are mirrored to, empty mirrors nothing")
+	shadowToken := flag.String("shadow-token", "", "admin token to authenticate the connection to the shadow with")
+	compareRate := flag.Float64("compare", 0, "percentage of single key reads to compare between the primary and the shadow")
+	queue := flag.Int("queue", 10000, "how many requests may wait to be sent to the shadow before more are dropped")
+	flag.Parse()
+
+	if *primary == "" {
+		fmt.Println("Usage: datastore-proxy -primary <host:port> [-shadow <host:port>] [-compare <percent>]")
+		os.Exit(2)
+	}
+
+	dataProxy := proxy.New(*address, *port, *primary,
+		proxy.WithShadow(*shadow),
+		proxy.WithShadowAdminToken(*shadowToken),
+		proxy.WithCompareRate(*compareRate),
+		proxy.WithMirrorQueue(*queue),
+		proxy.WithLogger(server.NewStandardLogger(log.New(os.Stderr, "", log.LstdFlags), server.LogInfo)),
+	)
+	err := dataProxy.Start()
+	if err != nil {
+		fmt.Println("Error starting proxy:", err.Error())
+		os.Exit(1)
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	received := <-interrupts
+	fmt.Printf("Received signal %q, shutting down\n", received.String())
+	dataProxy.Stop()
+}
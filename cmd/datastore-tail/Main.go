@@ -0,0 +1,62 @@
+package main
+
+import (
+	"datastore/wal"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// datastore-tail prints the records of a change log as JSON lines as they are written, for debugging a change feed
+func main() {
+	dir := flag.String("dir", "", "directory of the change log to follow")
+	from := flag.Uint64("from", 0, "sequence of the first record to print, defaults to the oldest record in the log")
+	flag.Parse()
+
+	if *dir == "" {
+		fmt.Println("Usage: datastore-tail -dir <change log directory> [-from <sequence>]")
+		os.Exit(2)
+	}
+
+	reader, err := wal.Open(*dir)
+	if err != nil {
+		fmt.Println("Error opening change log:", err.Error())
+		os.Exit(1)
+	}
+
+	if *from > 0 {
+		err = reader.Seek(*from)
+		if err != nil {
+			fmt.Println("Error seeking in change log:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		reader.Close()
+	}()
+
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, wal.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading change log:", err.Error())
+			os.Exit(1)
+		}
+
+		err = encoder.Encode(record)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing record:", err.Error())
+			os.Exit(1)
+		}
+	}
+}
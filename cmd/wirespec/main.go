@@ -0,0 +1,31 @@
+package main
+
+import (
+	"datastore/wire"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// wirespec writes the machine readable description of the wire protocol, run it with go generate ./wire
+func main() {
+	output := flag.String("o", "", "file to write the spec to, defaults to stdout")
+	flag.Parse()
+
+	document, err := wire.SpecJSON()
+	if err != nil {
+		fmt.Println("Error generating wire spec:", err.Error())
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(document)
+	} else {
+		err = os.WriteFile(*output, document, 0644)
+	}
+
+	if err != nil {
+		fmt.Println("Error writing wire spec:", err.Error())
+		os.Exit(1)
+	}
+}
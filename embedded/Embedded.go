@@ -0,0 +1,113 @@
+package embedded
+
+import (
+	"context"
+	"datastore/client"
+	"datastore/server"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTimeout bounds how long Run waits for the server to become ready
+const startTimeout = time.Second * 10
+
+// Run
+/**
+* Start a server on a free port and a client connected to it for a test, see Start. The test fails if the server does
+* not start. The returned function stops the server and closes the client's connections, it is also registered with
+* t.Cleanup so calling it is only needed to stop early, and calling it more than once does nothing.
+ */
+func Run(t testing.TB, opts ...Option) (*client.Client, func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	embeddedClient, embeddedServer, err := Start(ctx, opts...)
+	if err != nil {
+		t.Fatalf("Error starting embedded server %q", err)
+	}
+
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { embeddedServer.Stop() })
+	}
+	t.Cleanup(stop)
+
+	return embeddedClient, stop
+}
+
+// Start
+/**
+* Start a server on a free port and return it with a client connected to it, for programs and examples that want a
+* data store without running one separately. Options are passed through to both sides, see WithServerOptions,
+* WithClientOptions, and InMemory.
+*
+* Start returns once the server has answered a request from the client, and ctx bounds how long it waits for that. It
+* does not stop the server when ctx is done, call Stop on the returned server once finished with it, which closes the
+* client's connections too.
+ */
+func Start(ctx context.Context, opts ...Option) (*client.Client, *server.Server, error) {
+	embeddedConfig := config{address: "localhost"}
+	for _, opt := range opts {
+		opt(&embeddedConfig)
+	}
+
+	embeddedServer := server.New(embeddedConfig.address, 0, embeddedConfig.serverOptions...)
+	clientOptions := embeddedConfig.clientOptions
+	if embeddedConfig.inMemory {
+		clientOptions = append(clientOptions, client.WithTransport(&pipeTransport{server: &embeddedServer}))
+	} else {
+		err := embeddedServer.Start()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	embeddedClient := client.New(embeddedConfig.address, embeddedServer.Port(), clientOptions...)
+	err := waitUntilReady(ctx, &embeddedClient)
+	if err != nil {
+		embeddedServer.Stop()
+		return nil, nil, err
+	}
+
+	return &embeddedClient, &embeddedServer, nil
+}
+
+// waitUntilReady sends requests until the server answers one, returning the last request's error once ctx is done
+func waitUntilReady(ctx context.Context, embeddedClient *client.Client) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, err = embeddedClient.Count()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+// pipeTransport is the client.Transport for InMemory, connecting the client to the server without a listener
+type pipeTransport struct {
+	server *server.Server
+}
+
+func (p *pipeTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	clientSide, serverSide := net.Pipe()
+	go p.server.ServeConn(serverSide)
+	return clientSide, nil
+}
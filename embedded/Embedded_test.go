@@ -0,0 +1,108 @@
+package embedded
+
+import (
+	"context"
+	"datastore/client"
+	"datastore/server"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitForGoroutines waits until no more goroutines are running than before, failing the test if some are left
+func waitForGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buffer := make([]byte, 1<<16)
+			t.Fatalf("Expected %d goroutines once stopped but found %d:\n%s", before, runtime.NumGoroutine(), buffer[:runtime.Stack(buffer, true)])
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRunServesAClient(t *testing.T) {
+	c, _ := Run(t)
+
+	inserted, err := c.Insert("a", "1")
+	if err != nil || !inserted {
+		t.Fatalf("Expected the insert to succeed but got %q", err)
+	}
+	value, present, err := c.Read("a")
+	if err != nil || !present || value != "1" {
+		t.Fatalf("Expected to read back the inserted value but got %q, %t: %q", value, present, err)
+	}
+}
+
+func TestTwoInstancesDoNotCollide(t *testing.T) {
+	first, _ := Run(t)
+	second, _ := Run(t)
+
+	first.Insert("a", "1")
+	if _, present, err := second.Read("a"); err != nil || present {
+		t.Fatalf("Expected the second instance not to see the first one's keys: %q", err)
+	}
+
+	second.Insert("a", "2")
+	if value, _, err := first.Read("a"); err != nil || value != "1" {
+		t.Fatalf("Expected the first instance to keep its own value but read %q: %q", value, err)
+	}
+}
+
+func TestStoppingLeavesNoGoroutinesBehind(t *testing.T) {
+	for _, opts := range [][]Option{nil, {InMemory()}} {
+		before := runtime.NumGoroutine()
+
+		c, stop := Run(t, opts...)
+		for i := 0; i < 10; i++ {
+			c.Upsert("a", "1")
+		}
+		stop()
+		stop()
+
+		waitForGoroutines(t, before)
+	}
+}
+
+func TestInMemoryServesWithoutAListener(t *testing.T) {
+	c, embeddedServer, err := Start(context.Background(), InMemory())
+	if err != nil {
+		t.Fatalf("Error starting in memory %q", err)
+	}
+	defer embeddedServer.Stop()
+
+	if embeddedServer.Port() != 0 {
+		t.Fatalf("Expected no port to be bound but found %d", embeddedServer.Port())
+	}
+	c.Insert("a:b", "1")
+	keys, err := c.KeysBy("a")
+	if err != nil || len(keys) != 1 || keys[0] != "a:b" {
+		t.Fatalf("Expected the in memory server to hold the key but found %v: %q", keys, err)
+	}
+}
+
+func TestOptionsReachBothSides(t *testing.T) {
+	protected := WithServerOptions(server.WithProtectedPrefixes("config"))
+
+	admin, _ := Run(t, protected, WithAdminToken("secret"), InMemory())
+	if inserted, err := admin.Insert("config:a", "1"); err != nil || !inserted {
+		t.Fatalf("Expected the client to be authenticated with the server's admin token but got %q", err)
+	}
+
+	anonymous, _ := Run(t, protected, WithClientOptions(client.WithTimeout(time.Second)))
+	if _, err := anonymous.Insert("config:a", "1"); !errors.Is(err, client.ErrProtected) {
+		t.Fatalf("Expected the server option to protect the prefix but got %q", err)
+	}
+}
+
+func TestStartGivesUpWhenTheContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := Start(ctx, InMemory())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected starting to fail with the context's error but got %q", err)
+	}
+}
@@ -0,0 +1,35 @@
+package embedded_test
+
+import (
+	"context"
+	"datastore/embedded"
+	"fmt"
+	"testing"
+)
+
+func ExampleStart() {
+	c, embeddedServer, err := embedded.Start(context.Background(), embedded.InMemory())
+	if err != nil {
+		fmt.Println("Error starting:", err)
+		return
+	}
+	defer embeddedServer.Stop()
+
+	c.Insert("greeting", "hello")
+	value, _, _ := c.Read("greeting")
+	fmt.Println(value)
+	// Output: hello
+}
+
+func ExampleRun() {
+	// a test using the embedded server, stopped once the test finishes
+	testGreeting := func(t *testing.T) {
+		c, _ := embedded.Run(t)
+
+		c.Insert("greeting", "hello")
+		if value, _, _ := c.Read("greeting"); value != "hello" {
+			t.Fatalf("Expected to read back the greeting but got %q", value)
+		}
+	}
+	_ = testGreeting
+}
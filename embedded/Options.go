@@ -0,0 +1,58 @@
+package embedded
+
+import (
+	"datastore/client"
+	"datastore/server"
+)
+
+// config holds the settings Options can change
+type config struct {
+	address       string
+	inMemory      bool
+	serverOptions []server.Option
+	clientOptions []client.Option
+}
+
+type Option func(*config)
+
+// WithAddress sets the address the server listens on, defaults to localhost. The port is always a free one
+func WithAddress(address string) Option {
+	return func(c *config) {
+		c.address = address
+	}
+}
+
+// InMemory
+/**
+* Serve the client without a listener: every connection the client opens is one end of a net.Pipe whose other end the
+* server serves in the same process, so nothing is bound and no port is used. The server is never started, and stopping
+* it closes the connections it is serving.
+ */
+func InMemory() Option {
+	return func(c *config) {
+		c.inMemory = true
+	}
+}
+
+// WithServerOptions passes options through to server.New
+func WithServerOptions(opts ...server.Option) Option {
+	return func(c *config) {
+		c.serverOptions = append(c.serverOptions, opts...)
+	}
+}
+
+// WithClientOptions passes options through to client.New, the transport is replaced in memory, see InMemory
+func WithClientOptions(opts ...client.Option) Option {
+	return func(c *config) {
+		c.clientOptions = append(c.clientOptions, opts...)
+	}
+}
+
+// WithAdminToken sets the server's admin token and authenticates the client with it, so the client's connections are
+// admin sessions that may write under protected prefixes, see server.WithProtectedPrefixes
+func WithAdminToken(token string) Option {
+	return func(c *config) {
+		c.serverOptions = append(c.serverOptions, server.WithAdminToken(token))
+		c.clientOptions = append(c.clientOptions, client.WithAuthToken(token))
+	}
+}
@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultArchiveAttempts = 3
+	defaultArchiveQueue    = 10000
+)
+
+// ArchiveSink
+/**
+* Somewhere expired keys are kept instead of vanishing, see Options.ExpirationArchive
+*
+* Archive is called once for each key that expires, with the value it held and the time it expired at. Returning an
+* error has the key offered again later, until Options.ArchiveAttempts calls have failed and it is dropped.
+ */
+type ArchiveSink interface {
+	Archive(key string, value string, expiredAt time.Time) error
+}
+
+// archivedKey is an expired key waiting to be delivered to the sink
+type archivedKey struct {
+	key       string
+	value     string
+	expiredAt time.Time
+	failures  int
+}
+
+// expirationArchive
+/**
+* Queues the keys removed because they expired and delivers them to the sink in the order they were removed
+*
+* Keys are queued while the data store's mutex is held, by the same step that removes them, so each key is queued once
+* whether the cleanup or a write replacing it finds it expired first. They are delivered after the mutex is released so
+* a slow sink never holds up the data store. A delivery stops at the first failure and the failed key is tried again on
+* the next one, each cleanup starting a delivery.
+ */
+type expirationArchive struct {
+	sink     ArchiveSink
+	attempts int
+	limit    int
+
+	mutex    sync.Mutex
+	pending  []archivedKey
+	archived int
+	dropped  int
+
+	// delivering is held for a whole delivery so concurrent cleanups do not hand the sink the same key
+	delivering sync.Mutex
+}
+
+func newExpirationArchive(options Options) *expirationArchive {
+	if options.ExpirationArchive == nil {
+		return nil
+	}
+
+	archive := &expirationArchive{
+		sink:     options.ExpirationArchive,
+		attempts: options.ArchiveAttempts,
+		limit:    options.ArchiveQueue,
+	}
+	if archive.attempts <= 0 {
+		archive.attempts = defaultArchiveAttempts
+	}
+	if archive.limit <= 0 {
+		archive.limit = defaultArchiveQueue
+	}
+
+	return archive
+}
+
+// queue adds an expired key to be delivered, dropping it when the queue is full
+func (a *expirationArchive) queue(key string, node dataNode) {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.pending) >= a.limit {
+		a.dropped++
+		return
+	}
+	a.pending = append(a.pending, archivedKey{key: key, value: node.value, expiredAt: node.expiration})
+}
+
+// deliver hands the queued keys to the sink until the queue is empty or the sink fails, the caller must not hold the
+// data store's mutex
+func (a *expirationArchive) deliver() {
+	if a == nil {
+		return
+	}
+
+	a.delivering.Lock()
+	defer a.delivering.Unlock()
+
+	for {
+		a.mutex.Lock()
+		if len(a.pending) == 0 {
+			a.mutex.Unlock()
+			return
+		}
+		next := a.pending[0]
+		a.mutex.Unlock()
+
+		err := a.sink.Archive(next.key, next.value, next.expiredAt)
+
+		a.mutex.Lock()
+		if err == nil {
+			a.pending = a.pending[1:]
+			a.archived++
+			a.mutex.Unlock()
+			continue
+		}
+
+		a.pending[0].failures++
+		if a.pending[0].failures >= a.attempts {
+			a.pending = a.pending[1:]
+			a.dropped++
+		}
+		a.mutex.Unlock()
+		return
+	}
+}
+
+// counts returns how many keys have been archived, dropped, and are waiting
+func (a *expirationArchive) counts() (int, int, int) {
+	if a == nil {
+		return 0, 0, 0
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.archived, a.dropped, len(a.pending)
+}
+
+// jsonLinesArchive writes each archived key as one JSON object per line
+type jsonLinesArchive struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+type jsonLinesRecord struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+// NewJSONLinesArchive
+/**
+* Archive expired keys to the writer as JSON lines of the form {"key":"...","value":"...","expired_at":"..."}, with
+* the expiration formatted as RFC 3339. A failed write is reported to the data store, which offers the key again.
+ */
+func NewJSONLinesArchive(writer io.Writer) ArchiveSink {
+	return &jsonLinesArchive{encoder: json.NewEncoder(writer)}
+}
+
+func (a *jsonLinesArchive) Archive(key string, value string, expiredAt time.Time) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.encoder.Encode(jsonLinesRecord{Key: key, Value: value, ExpiredAt: expiredAt})
+}
+
+// DataStoreArchive
+/**
+* Archive expired keys into another data store, under Prefix followed by the key, for example "archive:" + key
+*
+* Archived keys expire TTL after they are archived by Target's clock, or keep Target's default TTL when TTL is zero.
+ */
+type DataStoreArchive struct {
+	Target *DataStore
+	Prefix string
+	TTL    time.Duration
+}
+
+func (a DataStoreArchive) Archive(key string, value string, expiredAt time.Time) error {
+	targetKey := a.Prefix + key
+	a.Target.Upsert(targetKey, value)
+	if a.TTL <= 0 {
+		return nil
+	}
+
+	_, err := a.Target.ExpireWithMode(targetKey, a.Target.now().Add(a.TTL), ExpireAlways)
+	return err
+}
@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers every key archived and can be made to fail
+type recordingSink struct {
+	mutex    sync.Mutex
+	failing  bool
+	calls    int
+	archived map[string][]string
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{archived: map[string][]string{}}
+}
+
+func (s *recordingSink) Archive(key string, value string, expiredAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	if s.failing {
+		return errors.New("archive unavailable")
+	}
+	s.archived[key] = append(s.archived[key], value)
+	return nil
+}
+
+func (s *recordingSink) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+func (s *recordingSink) assertArchived(t *testing.T, key string, values ...string) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if fmt.Sprint(s.archived[key]) != fmt.Sprint(values) {
+		t.Fatalf("Expected %q to be archived as %q but found %q", key, values, s.archived[key])
+	}
+}
+
+func TestArchiveReceivesEachExpiredKeyOnce(t *testing.T) {
+	now := time.Now()
+	sink := newRecordingSink()
+	ds := NewDataStoreWithOptions(Options{
+		Clock:             func() time.Time { return now },
+		CheckInvariants:   true,
+		StaleWindow:       time.Minute,
+		ExpirationArchive: sink,
+	})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	for _, key := range []string{"swept", "stale", "inserted", "upserted", "deleted", "renamed", "old:a", "old:b", "live"} {
+		ds.Insert(key, key+"-value")
+	}
+	ds.Expire("swept", now.Add(-time.Hour))
+	ds.Expire("stale", now.Add(-time.Second))
+
+	// the cleanup archives what it removes and leaves keys in the stale window alone
+	ds.CleanupNow()
+	sink.assertArchived(t, "swept", "swept-value")
+	sink.assertArchived(t, "stale")
+
+	// writes that replace or remove an expired key the cleanup has not reached archive it themselves
+	for _, key := range []string{"inserted", "upserted", "deleted", "renamed", "old:a", "old:b"} {
+		ds.Expire(key, now.Add(-time.Hour))
+	}
+	ds.Insert("inserted", "fresh")
+	ds.Upsert("upserted", "fresh")
+	ds.Delete("deleted")
+	ds.Rename("live", "renamed", false)
+	ds.DeleteBy("old")
+	ds.Truncate()
+	ds.CleanupNow()
+
+	sink.assertArchived(t, "swept", "swept-value")
+	sink.assertArchived(t, "stale", "stale-value")
+	sink.assertArchived(t, "inserted", "inserted-value")
+	sink.assertArchived(t, "upserted", "upserted-value")
+	sink.assertArchived(t, "deleted", "deleted-value")
+	sink.assertArchived(t, "renamed", "renamed-value")
+	sink.assertArchived(t, "old:a", "old:a-value")
+	sink.assertArchived(t, "old:b", "old:b-value")
+	sink.assertArchived(t, "live")
+
+	stats := ds.Stats()
+	if stats.Archived != 8 || stats.ArchiveDropped != 0 || stats.ArchivePending != 0 {
+		t.Fatalf("Expected 8 keys archived and none dropped or waiting but found %+v", stats)
+	}
+}
+
+func TestArchiveIsExactlyOnceWhileCleanupsRaceWrites(t *testing.T) {
+	withParallelism(t)
+
+	sink := newRecordingSink()
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, ExpirationArchive: sink})
+
+	var waitGroup sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		waitGroup.Add(1)
+		go func(key string) {
+			defer waitGroup.Done()
+			for version := 0; version < 200; version++ {
+				// the next Insert replaces the expired version unless a cleanup removed it first
+				ds.Insert(key, fmt.Sprint(version))
+				ds.Expire(key, time.Now().Add(-time.Second))
+			}
+		}(fmt.Sprintf("key%d", writer))
+	}
+	waitGroup.Wait()
+	ds.CleanupNow()
+
+	var expected []string
+	for version := 0; version < 200; version++ {
+		expected = append(expected, fmt.Sprint(version))
+	}
+	for writer := 0; writer < 4; writer++ {
+		sink.assertArchived(t, fmt.Sprintf("key%d", writer), expected...)
+	}
+}
+
+func TestArchiveDropsKeysItKeepsFailingToArchive(t *testing.T) {
+	now := time.Now()
+	sink := newRecordingSink()
+	sink.setFailing(true)
+	ds := NewDataStoreWithOptions(Options{
+		Clock:             func() time.Time { return now },
+		CheckInvariants:   true,
+		ExpirationArchive: sink,
+		ArchiveAttempts:   2,
+		ArchiveQueue:      2,
+	})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	for _, key := range []string{"first", "second", "third"} {
+		ds.Insert(key, key+"-value")
+		ds.Expire(key, now.Add(-time.Second))
+	}
+
+	// the queue holds two keys so the third is dropped straight away, and each cleanup tries the oldest key once
+	ds.CleanupNow()
+	stats := ds.Stats()
+	if stats.ArchiveDropped != 1 || stats.ArchivePending != 2 || sink.calls != 1 {
+		t.Fatalf("Expected one key dropped from the full queue after one attempt but found %+v after %d calls", stats, sink.calls)
+	}
+
+	ds.CleanupNow()
+	stats = ds.Stats()
+	if stats.ArchiveDropped != 2 || stats.ArchivePending != 1 || sink.calls != 2 {
+		t.Fatalf("Expected the key failing twice to be dropped but found %+v after %d calls", stats, sink.calls)
+	}
+	if ds.ApproximateCount() != 0 {
+		t.Fatalf("Expected the failing archive not to keep expired keys in the data store but found %d", ds.ApproximateCount())
+	}
+
+	sink.setFailing(false)
+	ds.CleanupNow()
+	stats = ds.Stats()
+	if stats.Archived != 1 || stats.ArchiveDropped != 2 || stats.ArchivePending != 0 {
+		t.Fatalf("Expected the waiting key to be archived once the archive recovered but found %+v", stats)
+	}
+
+	archivedKeys := 0
+	for _, key := range []string{"first", "second", "third"} {
+		archivedKeys += len(sink.archived[key])
+	}
+	if archivedKeys != 1 {
+		t.Fatalf("Expected exactly one key archived but found %v", sink.archived)
+	}
+}
+
+func TestDataStoreArchiveKeepsExpiredKeysInAnotherDataStore(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	archive := NewDataStoreWithOptions(Options{Clock: clock, CheckInvariants: true})
+	archive.cleanupSignal = make(chan uint64, 100)
+	ds := NewDataStoreWithOptions(Options{
+		Clock:             clock,
+		CheckInvariants:   true,
+		ExpirationArchive: DataStoreArchive{Target: &archive, Prefix: "archive:", TTL: time.Hour * 24},
+	})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	ds.Insert("session:1", "alice")
+	ds.Insert("session:2", "bob")
+	ds.Expire("session:1", now.Add(time.Minute))
+
+	now = now.Add(time.Minute * 2)
+	ds.CleanupNow()
+
+	if ds.Present("session:1") || !ds.Present("session:2") {
+		t.Fatalf("Expected only the expired session to leave the data store")
+	}
+	value, present := archive.Read("archive:session:1")
+	if !present || value != "alice" || archive.Count() != 1 {
+		t.Fatalf("Expected the expired session to be archived under its prefix but found %q", value)
+	}
+	assertExpiration(t, &archive, "archive:session:1", now.Add(time.Hour*24))
+
+	// the archive's own TTL removes archived keys in time
+	now = now.Add(time.Hour * 25)
+	archive.CleanupNow()
+	if archive.ApproximateCount() != 0 {
+		t.Fatalf("Expected the archived session to expire from the archive but found %d keys", archive.ApproximateCount())
+	}
+}
+
+func TestJSONLinesArchiveWritesOneObjectPerKey(t *testing.T) {
+	expiredAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	var output bytes.Buffer
+	sink := NewJSONLinesArchive(&output)
+
+	sink.Archive("session:1", "alice", expiredAt)
+	sink.Archive("session:2", "line\nbreak", expiredAt.Add(time.Second))
+
+	var records []jsonLinesRecord
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		var record jsonLinesRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("Expected every line to be a JSON object but got %q", err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 || records[0].Key != "session:1" || records[0].Value != "alice" || !records[0].ExpiredAt.Equal(expiredAt) {
+		t.Fatalf("Expected two archived records but found %+v", records)
+	}
+	if records[1].Value != "line\nbreak" {
+		t.Fatalf("Expected values to survive a round trip but found %q", records[1].Value)
+	}
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotBatchable is the Result of an Operation whose kind ApplyBatch does not apply
+var ErrNotBatchable = errors.New("operation cannot be applied in a batch")
+
+// Operation
+/**
+* One write of a batch, see ApplyBatch. Kind is ChangeInsert, ChangeUpdate, ChangeUpsert, ChangeDelete, or ChangeExpire
+* and does what the data store's method of the same name does. Value is only used by inserts, updates, and upserts, and
+* Expiration and Mode only by expires, like ExpireWithMode.
+ */
+type Operation struct {
+	Kind       ChangeOperation
+	Key        string
+	Value      string
+	Expiration time.Time
+	Mode       ExpireMode
+}
+
+// Result
+/**
+* What an Operation of a batch did. Applied is whether it changed the key, and Err says why it did not when it failed:
+* ErrKeyExists for an insert of a present key, ErrKeyNotFound for an update, delete, or expire of a missing one, and
+* otherwise the error the key, the value, the expiration, or the data store was refused with. An upsert of the value a
+* key already holds, or an expire its mode skips, is not applied and has no error.
+ */
+type Result struct {
+	Applied bool
+	Err     error
+}
+
+// ApplyBatch
+/**
+* Apply operations in order in one critical section, so no other read or write sees the data store between two of
+* them, returning the Result of each in the same order
+*
+* An operation that fails does not stop the ones after it, nor undo the ones before it, so a caller wanting all or
+* nothing checks what it can first. Values longer than the MaxValueLength fail their operation before anything is
+* applied, and every value is spilled before the mutex is taken, like a single write.
+ */
+func (ds *DataStore) ApplyBatch(operations []Operation) []Result {
+	results := make([]Result, len(operations))
+	spilled := make([]*spilledValue, len(operations))
+	for i, operation := range operations {
+		switch operation.Kind {
+		case ChangeInsert, ChangeUpdate, ChangeUpsert:
+			results[i].Err = ds.CheckValue(operation.Value)
+			if results[i].Err == nil {
+				spilled[i] = ds.spill.spill(operation.Key, operation.Value)
+			}
+		case ChangeDelete, ChangeExpire:
+		default:
+			results[i].Err = ErrNotBatchable
+		}
+	}
+	defer func() {
+		for _, value := range spilled {
+			ds.spill.release(value)
+		}
+	}()
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ApplyBatch")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	for i, operation := range operations {
+		if results[i].Err != nil {
+			continue
+		}
+
+		var err error
+		applied := false
+		switch operation.Kind {
+		case ChangeInsert:
+			err = ds.insert(operation.Key, operation.Value, spilled[i], timestamp)
+			applied = err == nil
+		case ChangeUpdate:
+			err = ds.update(operation.Key, operation.Value, spilled[i], timestamp)
+			applied = err == nil
+		case ChangeUpsert:
+			applied, err = ds.upsert(operation.Key, operation.Value, spilled[i], timestamp)
+		case ChangeDelete:
+			applied = ds.delete(operation.Key, timestamp)
+			if !applied {
+				err = ErrKeyNotFound
+			}
+		case ChangeExpire:
+			applied, _, err = ds.expire(operation.Key, operation.Expiration, operation.Mode, timestamp)
+		}
+		results[i] = Result{Applied: applied, Err: err}
+	}
+
+	return results
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApplyBatchReturnsTheResultOfEachOperationInOrder(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true, MaxValueLength: 8})
+	ds.Insert("present", "old")
+	ds.HSet("hash", "field", "value")
+
+	results := ds.ApplyBatch([]Operation{
+		{Kind: ChangeInsert, Key: "present", Value: "new"},
+		{Kind: ChangeInsert, Key: "inserted", Value: "new"},
+		{Kind: ChangeUpdate, Key: "missing", Value: "new"},
+		{Kind: ChangeUpdate, Key: "hash", Value: "new"},
+		{Kind: ChangeUpsert, Key: "present", Value: "old"},
+		{Kind: ChangeUpsert, Key: "present", Value: strings.Repeat("v", 9)},
+		{Kind: ChangeUpsert, Key: "present", Value: "upserted"},
+		{Kind: ChangeExpire, Key: "inserted", Expiration: now.Add(time.Hour)},
+		{Kind: ChangeExpire, Key: "inserted", Expiration: now.Add(time.Minute), Mode: ExpireIfLonger},
+		{Kind: ChangeExpire, Key: "missing", Expiration: now.Add(time.Hour)},
+		{Kind: ChangeDelete, Key: "missing"},
+		{Kind: ChangeDelete, Key: "hash"},
+		{Kind: ChangeTruncate},
+	})
+
+	expected := []Result{
+		{Err: ErrKeyExists},
+		{Applied: true},
+		{Err: ErrKeyNotFound},
+		{Err: ErrWrongType},
+		{},
+		{Err: ErrValueTooLarge},
+		{Applied: true},
+		{Applied: true},
+		{},
+		{Err: ErrKeyNotFound},
+		{Err: ErrKeyNotFound},
+		{Applied: true},
+		{Err: ErrNotBatchable},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results but got %v", len(expected), results)
+	}
+	for i, result := range results {
+		if result.Applied != expected[i].Applied || !errors.Is(result.Err, expected[i].Err) || (expected[i].Err == nil) != (result.Err == nil) {
+			t.Fatalf("Expected result %d to be %+v but got %+v", i, expected[i], result)
+		}
+	}
+
+	if value, _ := ds.Read("present"); value != "upserted" {
+		t.Fatalf("Expected the upsert to be applied but found %q", value)
+	}
+	if expiration, _ := ds.ReadExpiration("inserted"); !expiration.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected the inserted key to expire in an hour but found %s", expiration)
+	}
+	if ds.Present("hash") || ds.Count() != 2 {
+		t.Fatalf("Expected the hash to be deleted and nothing else truncated, found %d keys", ds.Count())
+	}
+}
+
+func TestApplyBatchIsNeverSeenHalfApplied(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.Insert("a", "1")
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	halfApplied := 0
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if ds.Count() != 1 {
+				halfApplied++
+			}
+		}
+	}()
+
+	// moving the key back and forth deletes one and creates the other in every batch
+	for i := 0; i < 1000; i++ {
+		from, to := "a", "b"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		results := ds.ApplyBatch([]Operation{{Kind: ChangeDelete, Key: from}, {Kind: ChangeInsert, Key: to, Value: "1"}})
+		if !results[0].Applied || !results[1].Applied {
+			t.Fatalf("Expected both operations of batch %d to be applied but got %+v", i, results)
+		}
+	}
+	close(stop)
+	readers.Wait()
+
+	if halfApplied != 0 {
+		t.Fatalf("Expected readers never to see a batch half applied but they did %d times", halfApplied)
+	}
+}
+
+func TestApplyBatchRecordsEveryChange(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	changes, unsubscribe := ds.Subscribe("")
+	defer unsubscribe()
+	ds.Insert("a", "1")
+
+	ds.ApplyBatch([]Operation{{Kind: ChangeDelete, Key: "a"}, {Kind: ChangeUpsert, Key: "b", Value: "2"}})
+
+	assertChanges(t, receiveChanges(changes),
+		Change{Operation: ChangeInsert, Key: "a", Value: "1"},
+		Change{Operation: ChangeDelete, Key: "a", Value: "1"},
+		Change{Operation: ChangeUpsert, Key: "b", Value: "2"},
+	)
+}
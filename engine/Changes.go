@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrResyncRequired is returned by ChangesSince when changes after the requested sequence are no longer retained
+var ErrResyncRequired = errors.New("changes are no longer retained, read the keys again")
+
+// ChangeOperation is what a Change did to its key
+type ChangeOperation string
+
+const (
+	ChangeInsert ChangeOperation = "insert"
+	ChangeUpdate ChangeOperation = "update"
+	ChangeUpsert ChangeOperation = "upsert"
+	ChangeDelete ChangeOperation = "delete"
+	// ChangeExpire sets the Expiration of a key without changing its value
+	ChangeExpire ChangeOperation = "expire"
+	// ChangeExpired removes a key that expired, when the cleanup removes it or a write replaces it
+	ChangeExpired ChangeOperation = "expired"
+	// ChangeTruncate removes every key, its Key is empty
+	ChangeTruncate ChangeOperation = "truncate"
+	// ChangeHSet sets the Field of the hash stored under Key to Value, creating the hash if it was not present
+	ChangeHSet ChangeOperation = "hset"
+	// ChangeHDel removes the Field of the hash stored under Key, whose Value it held, and the key with its last field
+	ChangeHDel ChangeOperation = "hdel"
+)
+
+// Change
+/**
+* One write to the data store, numbered by Sequence. Sequences start at 1 and increase by exactly one for every change,
+* so a gap between two changes a reader has seen means it missed the changes in between.
+*
+* Value is the value written by inserts, updates, and upserts and the value removed by deletes and expirations.
+* Expiration is set by ChangeExpire. A Rename is a ChangeDelete of the old key followed by a ChangeUpsert of the new one,
+* or by a ChangeHSet of each field when the key holds a hash. Field is only set by ChangeHSet and ChangeHDel.
+ */
+type Change struct {
+	Sequence   uint64
+	Time       time.Time
+	Operation  ChangeOperation
+	Key        string
+	Field      string
+	Value      string
+	Expiration time.Time
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%d %s %q", c.Sequence, c.Operation, c.Key)
+}
+
+// ChangeFeed
+/**
+* Somewhere every change is sent as it is made, such as a log other processes consume, see Options.ChangeFeed
+*
+* Append is called with each change in sequence order while the data store's mutex is held, so it should be quick. The
+* data store numbers its changes after LastSequence, which is read once when the data store is created, so a feed that
+* outlives one data store keeps a single sequence across the data stores that write to it.
+ */
+type ChangeFeed interface {
+	LastSequence() uint64
+	Append(change Change) error
+}
+
+// changeLog
+/**
+* Numbers every change and keeps the most recent ones, up to Options.ChangeRetention changes that are no older than
+* Options.ChangeRetentionAge, in a ring buffer. Only used while holding the owning DataStore's mutex.
+ */
+type changeLog struct {
+	sequence uint64
+	limit    int
+	maxAge   time.Duration
+	feed     ChangeFeed
+	// feedFailures counts the changes the feed failed to append
+	feedFailures int
+	// retained is a ring buffer of the last len(retained) changes, the oldest at start
+	retained []Change
+	start    int
+	// subscribers are sent every change to their keys, see DataStore.Subscribe
+	subscribers        []*subscription
+	subscriptionBuffer int
+	// subscriptionDropped counts the changes not sent to subscribers whose buffer was full
+	subscriptionDropped int
+	// seperator splits keys into the segments subscribers' prefixes match on
+	seperator string
+}
+
+func newChangeLog(options Options, seperator string) changeLog {
+	log := changeLog{limit: options.ChangeRetention, maxAge: options.ChangeRetentionAge, feed: options.ChangeFeed, subscriptionBuffer: options.SubscriptionBuffer, seperator: seperator}
+	if log.feed != nil {
+		log.sequence = log.feed.LastSequence()
+	}
+	if log.subscriptionBuffer <= 0 {
+		log.subscriptionBuffer = DefaultSubscriptionBuffer
+	}
+	return log
+}
+
+func (l *changeLog) record(change Change) {
+	l.sequence++
+	change.Sequence = l.sequence
+	if l.feed != nil && l.feed.Append(change) != nil {
+		l.feedFailures++
+	}
+	l.publish(change)
+	if l.limit <= 0 {
+		return
+	}
+
+	if len(l.retained) < l.limit {
+		l.retained = append(l.retained, change)
+		return
+	}
+	l.retained[l.start] = change
+	l.start = (l.start + 1) % len(l.retained)
+}
+
+// recordsValues reports whether changes go anywhere, so values spilled to disk only have to be read back when they do
+func (l *changeLog) recordsValues() bool {
+	return l.limit > 0 || l.feed != nil || len(l.subscribers) > 0
+}
+
+// at returns the i-th oldest retained change
+func (l *changeLog) at(i int) Change {
+	return l.retained[(l.start+i)%len(l.retained)]
+}
+
+// since returns the retained changes after the sequence, or ErrResyncRequired if some of them are no longer retained
+func (l *changeLog) since(sequence uint64, timestamp time.Time) ([]Change, error) {
+	if sequence >= l.sequence {
+		return []Change{}, nil
+	}
+
+	skipped := 0
+	if l.maxAge > 0 {
+		for skipped < len(l.retained) && l.at(skipped).Time.Before(timestamp.Add(-l.maxAge)) {
+			skipped++
+		}
+	}
+
+	missed := int(l.sequence - sequence)
+	if missed > len(l.retained)-skipped {
+		return nil, ErrResyncRequired
+	}
+
+	changes := make([]Change, missed)
+	for i := range changes {
+		changes[i] = l.at(len(l.retained) - missed + i)
+	}
+
+	return changes, nil
+}
+
+// recordChange numbers a change made now, keeps it for ChangesSince, and marks the store changed for reads in
+// copy-on-write mode. The caller must hold the mutex
+func (ds *DataStore) recordChange(operation ChangeOperation, key string, node dataNode, timestamp time.Time) {
+	if ds.changes.recordsValues() {
+		node = ds.withValue(node)
+	}
+	change := Change{Time: timestamp, Operation: operation, Key: key, Value: node.value}
+	if operation == ChangeExpire {
+		change.Expiration = node.expiration
+	}
+	ds.changes.record(change)
+	ds.markChanged()
+}
+
+// ChangeSequence returns the sequence of the latest change, zero before the first one unless Options.ChangeFeed holds
+// earlier changes
+func (ds *DataStore) ChangeSequence() uint64 {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return ds.changes.sequence
+}
+
+// ChangesSince
+/**
+* Return the changes made after the provided sequence in order, so a reader that saw every change up to it can catch
+* up on what it missed
+*
+* Only the changes allowed by Options.ChangeRetention and Options.ChangeRetentionAge are kept. When some of the changes
+* after the sequence are gone this returns ErrResyncRequired, and the reader has to read the keys it cares about again
+* after noting ChangeSequence. A sequence at or after the latest change returns no changes.
+ */
+func (ds *DataStore) ChangesSince(sequence uint64) ([]Change, error) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ChangesSince")
+
+	return ds.changes.since(sequence, ds.now())
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func describeChanges(changes []Change) string {
+	described := make([]string, len(changes))
+	for i, change := range changes {
+		described[i] = fmt.Sprintf("%s %s=%s", change.Operation, change.Key, change.Value)
+	}
+	return strings.Join(described, ", ")
+}
+
+func TestChangesSinceReplaysWhatAReaderMissed(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{
+		Clock:           func() time.Time { return now },
+		CheckInvariants: true,
+		ChangeRetention: 100,
+	})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	ds.Insert("a", "1")
+	ds.Insert("b", "2")
+	seen := ds.ChangeSequence()
+	if seen != 2 {
+		t.Fatalf("Expected two changes before the reader disconnected but found %d", seen)
+	}
+
+	// everything the reader misses while disconnected, including writes that change nothing
+	ds.Insert("a", "ignored")
+	ds.Update("a", "3")
+	ds.Upsert("b", "2")
+	ds.Upsert("c", "4")
+	ds.Expire("c", now.Add(time.Minute))
+	ds.Rename("c", "d", false)
+	ds.Delete("b")
+	ds.Delete("missing")
+	ds.Expire("a", now.Add(time.Second))
+	now = now.Add(time.Second * 2)
+	ds.CleanupNow()
+
+	changes, err := ds.ChangesSince(seen)
+	if err != nil {
+		t.Fatalf("Expected the missed changes to be retained but got %q", err)
+	}
+	expected := "update a=3, upsert c=4, expire c=4, delete c=4, upsert d=4, delete b=2, expire a=3, expired a=3"
+	if describeChanges(changes) != expected {
+		t.Fatalf("Expected to replay %q but found %q", expected, describeChanges(changes))
+	}
+	for i, change := range changes {
+		if change.Sequence != seen+uint64(i)+1 {
+			t.Fatalf("Expected the replayed changes to follow on from %d without gaps but found %s", seen, change)
+		}
+	}
+	if !changes[2].Expiration.Equal(now.Add(time.Minute-time.Second*2)) || !changes[0].Expiration.IsZero() {
+		t.Fatalf("Expected only expire changes to carry the expiration but found %+v", changes[:3])
+	}
+
+	caughtUp, err := ds.ChangesSince(ds.ChangeSequence())
+	if err != nil || len(caughtUp) != 0 {
+		t.Fatalf("Expected a reader that is caught up to have nothing to replay but found %q: %q", describeChanges(caughtUp), err)
+	}
+}
+
+func TestChangesSinceAsksForAResyncOnceChangesAreGone(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{
+		Clock:              func() time.Time { return now },
+		CheckInvariants:    true,
+		ChangeRetention:    3,
+		ChangeRetentionAge: time.Minute,
+	})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	for i := 0; i < 5; i++ {
+		ds.Upsert("key", fmt.Sprint(i))
+	}
+
+	// only the last three of the five changes fit in the buffer
+	changes, err := ds.ChangesSince(2)
+	if err != nil || describeChanges(changes) != "upsert key=2, upsert key=3, upsert key=4" {
+		t.Fatalf("Expected the last three changes to be retained but found %q: %q", describeChanges(changes), err)
+	}
+	_, err = ds.ChangesSince(1)
+	if !errors.Is(err, ErrResyncRequired) {
+		t.Fatalf("Expected a reader that missed a change pushed out of the buffer to resync but got %q", err)
+	}
+
+	// changes older than the retention age are gone even while they fit in the buffer
+	now = now.Add(time.Minute * 2)
+	ds.Upsert("key", "5")
+	changes, err = ds.ChangesSince(5)
+	if err != nil || describeChanges(changes) != "upsert key=5" {
+		t.Fatalf("Expected the recent change to be retained but found %q: %q", describeChanges(changes), err)
+	}
+	_, err = ds.ChangesSince(4)
+	if !errors.Is(err, ErrResyncRequired) {
+		t.Fatalf("Expected a reader that missed an aged out change to resync but got %q", err)
+	}
+
+	withoutRetention := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	withoutRetention.Insert("key", "value")
+	_, err = withoutRetention.ChangesSince(0)
+	if !errors.Is(err, ErrResyncRequired) || withoutRetention.ChangeSequence() != 1 {
+		t.Fatalf("Expected changes to be numbered but not kept without a retention but got %q", err)
+	}
+}
+
+func TestChangeSequencesHaveNoGapsUnderConcurrentWrites(t *testing.T) {
+	withParallelism(t)
+
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, ChangeRetention: 10000})
+
+	var waitGroup sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		waitGroup.Add(1)
+		go func(key string) {
+			defer waitGroup.Done()
+			for version := 0; version < 500; version++ {
+				ds.Upsert(key, fmt.Sprint(version))
+			}
+		}(fmt.Sprintf("key%d", writer))
+	}
+	waitGroup.Wait()
+
+	changes, err := ds.ChangesSince(0)
+	if err != nil || len(changes) != 2000 {
+		t.Fatalf("Expected every change to be retained but found %d: %q", len(changes), err)
+	}
+
+	lastVersion := map[string]int{}
+	for i, change := range changes {
+		if change.Sequence != uint64(i)+1 {
+			t.Fatalf("Expected sequences to increase by one but found %s at %d", change, i)
+		}
+
+		version := 0
+		fmt.Sscan(change.Value, &version)
+		if previous, found := lastVersion[change.Key]; found && version != previous+1 {
+			t.Fatalf("Expected the changes of %q in the order they were written but found %d after %d", change.Key, version, previous)
+		}
+		lastVersion[change.Key] = version
+	}
+}
+
+// failingFeed holds changes up to last and fails to append every other change
+type failingFeed struct {
+	last     uint64
+	appended []uint64
+}
+
+func (f *failingFeed) LastSequence() uint64 {
+	return f.last
+}
+
+func (f *failingFeed) Append(change Change) error {
+	if change.Sequence%2 == 0 {
+		return errors.New("feed unavailable")
+	}
+	f.appended = append(f.appended, change.Sequence)
+	return nil
+}
+
+func TestChangeFeedContinuesItsSequence(t *testing.T) {
+	feed := &failingFeed{last: 41}
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, ChangeFeed: feed})
+
+	for i := 0; i < 4; i++ {
+		ds.Upsert("key", fmt.Sprint(i))
+	}
+
+	if ds.ChangeSequence() != 45 || fmt.Sprint(feed.appended) != "[43 45]" {
+		t.Fatalf("Expected changes numbered after the feed's last one but found %d with %v appended", ds.ChangeSequence(), feed.appended)
+	}
+	if failures := ds.Stats().ChangeFeedFailures; failures != 2 {
+		t.Fatalf("Expected the failed appends to be counted but found %d", failures)
+	}
+}
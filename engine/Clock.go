@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// clockGuard
+/**
+* Keeps the time the data store sees from going backwards when the Options.Clock does, such as when NTP corrects a wall
+* clock that ran fast
+*
+* Every reading is compared with the latest one seen so far, the high-water mark, and readings behind it are replaced by
+* it, so a key that has expired never becomes live again and the expiration heap is never evaluated out of order. A
+* regression is counted when a reading is behind the one before it, so a clock that jumps back once and carries on from
+* there counts one regression however long it takes to catch up with the high-water mark.
+ */
+type clockGuard struct {
+	clock func() time.Time
+
+	mutex     sync.Mutex
+	highWater time.Time
+	// previous is the clock's last reading, to tell a new regression from a clock still catching up after one
+	previous          time.Time
+	regressions       int
+	largestRegression time.Duration
+}
+
+func newClockGuard(clock func() time.Time) *clockGuard {
+	return &clockGuard{clock: clock}
+}
+
+// now returns the later of the clock's reading and the latest reading seen before it
+func (g *clockGuard) now() time.Time {
+	// compared by the wall clock alone, the monotonic reading time.Now carries never goes backwards and would hide the
+	// jump from expirations that only have a wall clock reading, such as those sent over the wire
+	reading := g.clock().Round(0)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if reading.Before(g.previous) {
+		g.regressions++
+		if regression := g.previous.Sub(reading); regression > g.largestRegression {
+			g.largestRegression = regression
+		}
+	}
+	g.previous = reading
+
+	if reading.Before(g.highWater) {
+		return g.highWater
+	}
+	g.highWater = reading
+	return reading
+}
+
+// regressionCounts returns how many times the clock went backwards and the largest jump back
+func (g *clockGuard) regressionCounts() (int, time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.regressions, g.largestRegression
+}
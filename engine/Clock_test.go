@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockRegressionsDoNotResurrectExpiredKeys(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.Insert("expired", "1")
+	ds.Expire("expired", start.Add(time.Minute))
+	ds.Insert("expiring", "2")
+	ds.Expire("expiring", start.Add(time.Minute*3))
+
+	now = start.Add(time.Minute * 2)
+	if ds.Present("expired") || !ds.Present("expiring") {
+		t.Fatalf("Expected only the first key to have expired before the clock jumped")
+	}
+
+	now = start.Add(time.Second * 30)
+	if ds.Present("expired") {
+		t.Fatalf("Expected the key to stay expired when the clock went back before its expiration")
+	}
+	if !ds.Present("expiring") {
+		t.Fatalf("Expected the key that had not expired to stay live")
+	}
+	if counts := ds.ExpirationHistogram([]time.Duration{time.Minute * 2}); counts[0] != 1 {
+		t.Fatalf("Expected the remaining time to be counted from before the jump but found %v", counts)
+	}
+
+	// the clock catching up again is not another regression
+	now = start.Add(time.Minute * 2)
+	if !ds.Present("expiring") {
+		t.Fatalf("Expected the key to stay live until its expiration")
+	}
+	now = start.Add(time.Minute * 4)
+	if ds.Present("expiring") {
+		t.Fatalf("Expected the key to expire once the clock passed its expiration")
+	}
+
+	stats := ds.Stats()
+	if stats.ClockRegressions != 1 || stats.LargestClockRegression != time.Second*90 {
+		t.Fatalf("Expected one regression of 90s but found %d of up to %s", stats.ClockRegressions, stats.LargestClockRegression)
+	}
+}
+
+func TestEveryClockRegressionIsCounted(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	for _, offset := range []time.Duration{time.Minute, time.Second * 50, time.Second * 55, time.Second * 10, time.Hour} {
+		now = start.Add(offset)
+		ds.Insert("key", "1")
+		ds.Delete("key")
+	}
+
+	stats := ds.Stats()
+	if stats.ClockRegressions != 2 || stats.LargestClockRegression != time.Second*45 {
+		t.Fatalf("Expected two regressions of up to 45s but found %d of up to %s", stats.ClockRegressions, stats.LargestClockRegression)
+	}
+}
+
+func TestExpireInCountsFromTheDataStoreClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.Insert("key", "1")
+	ds.Insert("now", "1")
+	ds.Insert("past", "1")
+
+	if !ds.ExpireIn("key", time.Minute) {
+		t.Fatalf("Expected the key to be given an expiration")
+	}
+	if expiration, _ := ds.ReadExpiration("key"); !expiration.Equal(start.Add(time.Minute)) {
+		t.Fatalf("Expected the key to expire a minute after the clock but found %s", expiration)
+	}
+
+	now = start.Add(time.Second * 20)
+	if ttl, hasExpiration := ds.TTL("key"); !hasExpiration || ttl != time.Second*40 {
+		t.Fatalf("Expected 40s left to live but found %s", ttl)
+	}
+	if _, hasExpiration := ds.TTL("now"); hasExpiration {
+		t.Fatalf("Expected a key without an expiration to have no TTL")
+	}
+
+	if !ds.ExpireIn("now", 0) || !ds.ExpireIn("past", -time.Minute) {
+		t.Fatalf("Expected a ttl of zero or less to be applied")
+	}
+	if ds.Present("now") || ds.Present("past") {
+		t.Fatalf("Expected a ttl of zero or less to expire the key straight away")
+	}
+	if ds.ExpireIn("missing", time.Minute) || ds.ExpireIn("now", time.Minute) {
+		t.Fatalf("Expected keys that are not present not to be given an expiration")
+	}
+	if _, hasExpiration := ds.TTL("missing"); hasExpiration {
+		t.Fatalf("Expected a key that is not present to have no TTL")
+	}
+}
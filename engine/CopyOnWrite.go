@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// copyOnWriteByDefault turns on Options.CopyOnWriteReads for every data store created, for tests to run the whole suite
+// in copy-on-write mode
+var copyOnWriteByDefault = false
+
+// readView
+/**
+* The copy of the store that reads use without taking the mutex when Options.CopyOnWriteReads is set
+*
+* The published map is never modified once it has been stored. Writes modify the data store's own map under the mutex as
+* usual and mark the view changed, then publish a fresh copy of the whole map before releasing the mutex.
+ */
+type readView struct {
+	published atomic.Pointer[map[string]dataNode]
+	// changed is set once the store has been modified since the last copy was published, the caller must hold the mutex
+	changed bool
+	// copies counts the copies published, read through Stats
+	copies int
+}
+
+func newReadView() *readView {
+	view := &readView{}
+	view.published.Store(&map[string]dataNode{})
+	return view
+}
+
+// markChanged records that the store is being modified, the caller must hold the mutex
+func (ds *DataStore) markChanged() {
+	if ds.view != nil {
+		ds.view.changed = true
+	}
+}
+
+// publishReads
+/**
+* Publish a copy of the store for reads when it was modified, the caller must hold the mutex and every operation that
+* modifies the store must call this before releasing it
+ */
+func (ds *DataStore) publishReads() {
+	if ds.view == nil || !ds.view.changed {
+		return
+	}
+
+	published := make(map[string]dataNode, len(ds.inMemoryStore))
+	for key, node := range ds.inMemoryStore {
+		published[key] = node
+	}
+	ds.view.published.Store(&published)
+	ds.view.changed = false
+	ds.view.copies++
+}
+
+// readCopies returns how many copies have been published for reads, the caller must hold the mutex
+func (ds *DataStore) readCopies() int {
+	if ds.view == nil {
+		return 0
+	}
+	return ds.view.copies
+}
+
+// publishedStore
+/**
+* Return the copy of the store published for reads, which may be read without the mutex and must not be modified.
+* lockFree is false when the data store is not in copy-on-write mode and the caller has to read the store under the
+* mutex instead.
+ */
+func (ds *DataStore) publishedStore() (store map[string]dataNode, lockFree bool) {
+	if ds.view == nil {
+		return nil, false
+	}
+	return *ds.view.published.Load(), true
+}
+
+// findViewViolation checks that the published copy of the store matches the store, the caller must hold the mutex
+func (ds *DataStore) findViewViolation() error {
+	if ds.view == nil {
+		return nil
+	}
+	if ds.view.changed {
+		return errors.New("the store was modified without publishing a copy for reads")
+	}
+
+	published := *ds.view.published.Load()
+	if len(published) != len(ds.inMemoryStore) {
+		return errors.New(fmt.Sprintf("%d keys are stored but the copy published for reads has %d", len(ds.inMemoryStore), len(published)))
+	}
+	for key, node := range ds.inMemoryStore {
+		if publishedNode, present := published[key]; !present || publishedNode != node {
+			return errors.New(fmt.Sprintf("key %q is stored as %+v but published for reads as %+v", key, node, publishedNode))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain runs every test a second time with every data store in copy-on-write mode
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if code == 0 {
+		copyOnWriteByDefault = true
+		code = m.Run()
+	}
+	os.Exit(code)
+}
+
+func TestCopyOnWriteReadsSeeEveryCompletedWrite(t *testing.T) {
+	withParallelism(t)
+
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, CopyOnWriteReads: true})
+	ds.Insert("counter", "0")
+
+	const writes = 500
+	var written int64
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		for i := 1; i <= writes; i++ {
+			ds.Update("counter", fmt.Sprint(i))
+			atomic.StoreInt64(&written, int64(i))
+		}
+	}()
+
+	failures := make(chan string, 4)
+	for reader := 0; reader < 4; reader++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			last := 0
+			for last < writes {
+				completed := int(atomic.LoadInt64(&written))
+				value, present := ds.Read("counter")
+				current := 0
+				fmt.Sscan(value, &current)
+				if !present || current < last || current < completed {
+					failures <- fmt.Sprintf("read %q after reading %d with %d writes completed", value, last, completed)
+					return
+				}
+				last = current
+			}
+		}()
+	}
+	waitGroup.Wait()
+	close(failures)
+
+	if failure := <-failures; failure != "" {
+		t.Fatalf("Expected reads to see every write completed before them and never go back but %s", failure)
+	}
+	if copies := ds.Stats().ReadCopies; copies != writes+1 {
+		t.Fatalf("Expected a copy published for each write but found %d", copies)
+	}
+}
+
+func TestCopyOnWriteReadsFilterExpiredKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{
+		Clock:            func() time.Time { return now },
+		CheckInvariants:  true,
+		CopyOnWriteReads: true,
+		StaleWindow:      time.Minute,
+	})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	ds.Insert("a", "1")
+	ds.Insert("b", "2")
+	ds.Expire("a", now.Add(time.Second))
+	copies := ds.Stats().ReadCopies
+	ds.Upsert("b", "2")
+	ds.Read("b")
+	if ds.Stats().ReadCopies != copies {
+		t.Fatalf("Expected writes that change nothing and reads not to publish a copy")
+	}
+
+	now = now.Add(time.Second * 2)
+	ds.CleanupNow()
+
+	_, present := ds.Read("a")
+	_, hasExpiration := ds.ReadExpiration("a")
+	value, stale, found := ds.ReadStale("a", time.Minute)
+	if present || hasExpiration || ds.Present("a") || !found || !stale || value != "1" {
+		t.Fatalf("Expected the expired key to be absent except to stale reads but found %t %t %q %t", present, hasExpiration, value, stale)
+	}
+	if multi := ds.PresentMulti([]string{"a", "b", "c"}); fmt.Sprint(multi) != "[false true false]" {
+		t.Fatalf("Expected only the live key to be present but found %v", multi)
+	}
+
+	now = now.Add(time.Minute * 2)
+	ds.CleanupNow()
+	if _, _, found = ds.ReadStale("a", time.Hour); found {
+		t.Fatalf("Expected the key to be gone from reads once the cleanup removed it")
+	}
+}
+
+// benchmarkModes runs a benchmark once with the mutex and once in copy-on-write mode
+func benchmarkModes(b *testing.B, run func(b *testing.B, options Options)) {
+	if copyOnWriteByDefault {
+		b.Skip("compares the two modes, so only runs while they can be told apart")
+	}
+
+	for _, copyOnWrite := range []bool{false, true} {
+		b.Run(fmt.Sprintf("CopyOnWriteReads=%t", copyOnWrite), func(b *testing.B) {
+			run(b, Options{CopyOnWriteReads: copyOnWrite})
+		})
+	}
+}
+
+// BenchmarkParallelReads
+/**
+* Reads from every goroutine at once with a writer updating a key every millisecond, run with -cpu 1,2,4,8 to see how
+* reads scale with cores in each mode
+ */
+func BenchmarkParallelReads(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, options Options) {
+		ds := NewDataStoreWithOptions(options)
+		for i := 0; i < 1000; i++ {
+			ds.Insert(fmt.Sprintf("region:%d:store:%d", i%10, i), "abc123")
+		}
+
+		stop := make(chan bool)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+					ds.Upsert("region:0:store:0", fmt.Sprint(i))
+				}
+			}
+		}()
+		defer close(stop)
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				ds.Read(fmt.Sprintf("region:%d:store:%d", i%10, i%1000))
+				i++
+			}
+		})
+	})
+}
+
+// BenchmarkWriteAmplification
+/**
+* Measures what copying the store on every write costs as the store grows. Filling the store is itself quadratic in
+* copy-on-write mode, so each store is filled once and shared by the runs of its sub-benchmark.
+ */
+func BenchmarkWriteAmplification(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, options Options) {
+		for _, size := range []int{1000, 10000} {
+			ds := NewDataStoreWithOptions(options)
+			// skip the cleanups, which would otherwise cost more than the writes without copy-on-write
+			ds.cleanupSignal = make(chan uint64)
+			go func(signals chan uint64) {
+				for range signals {
+				}
+			}(ds.cleanupSignal)
+			for i := 0; i < size; i++ {
+				ds.Insert(fmt.Sprintf("tenant:1:item:%d", i), "abc123")
+			}
+
+			b.Run(fmt.Sprintf("%d keys", size), func(b *testing.B) {
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ds.Upsert(fmt.Sprintf("tenant:1:item:%d", i%size), fmt.Sprint(i))
+				}
+			})
+		}
+	})
+}
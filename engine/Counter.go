@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"math"
+	"strconv"
+)
+
+// Increment
+/**
+* Add delta to the integer stored under key and return the result, for counters shared by several writers
+*
+* The value is read, added to, and written back in one critical section, so concurrent increments are never lost. A key
+* that is not present counts as zero and is created with the default TTL like Insert, a key that is present keeps its
+* expiration. Returns ErrNotInteger when the value is not a base 10 64-bit integer or the result would not be one,
+* ErrWrongType when the key holds a hash, and when the key is not present a KeyTooComplexError if it breaks the
+* KeyLimits and ErrStoreFull if the data store is over its WaterMarks.
+ */
+func (ds *DataStore) Increment(key string, delta int64) (int64, error) {
+	return ds.addToCounter("Increment", key, delta)
+}
+
+// Decrement subtracts delta from the integer stored under key and returns the result, see Increment
+func (ds *DataStore) Decrement(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrNotInteger
+	}
+	return ds.addToCounter("Decrement", key, -delta)
+}
+
+func (ds *DataStore) addToCounter(operation string, key string, delta int64) (int64, error) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants(operation)
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	node, present := ds.inMemoryStore[key]
+	live := present && !ds.isExpired(node, timestamp)
+	if live && node.hash != nil {
+		return 0, ErrWrongType
+	}
+
+	var current int64
+	if live {
+		value, _ := ds.spill.load(node)
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		current = parsed
+	}
+
+	result := current + delta
+	if (delta > 0 && result < current) || (delta < 0 && result > current) {
+		return 0, ErrNotInteger
+	}
+
+	counter := newNode(strconv.FormatInt(result, 10), nil)
+	if live {
+		counter.hasExpiration = node.hasExpiration
+		counter.expiration = node.expiration
+	} else {
+		err := ds.checkKey(key)
+		if err == nil {
+			err = ds.refuseNewKey()
+		}
+		if err != nil {
+			return 0, err
+		}
+		ds.makeRoom(key, timestamp)
+		ds.retireIfExpired(key, timestamp)
+		ds.expirations.remove(key)
+		counter = ds.withDefaultTTL(key, counter, timestamp)
+	}
+
+	ds.setNode(key, ds.governWrite(key, counter, timestamp))
+	ds.keyIndex.Add(key)
+	ds.writes.touch(key, timestamp)
+	ds.recordChange(ChangeUpsert, key, ds.inMemoryStore[key], timestamp)
+
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentIncrementsAreNeverLost(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	var waitGroup sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := 0; i < 500; i++ {
+				ds.Increment("requests", 3)
+				ds.Decrement("requests", 1)
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	if value, _ := ds.Read("requests"); value != "8000" {
+		t.Fatalf("Expected every increment and decrement to count but read %q", value)
+	}
+}
+
+func TestIncrementTreatsMissingKeysAsZero(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	if value, err := ds.Increment("counter", 5); err != nil || value != 5 {
+		t.Fatalf("Expected a missing key to count from zero but got %d: %q", value, err)
+	}
+	if value, err := ds.Decrement("negative", 5); err != nil || value != -5 {
+		t.Fatalf("Expected a missing key to count down from zero but got %d: %q", value, err)
+	}
+
+	// an expired key is not present either
+	ds.Expire("counter", now.Add(time.Minute))
+	now = now.Add(time.Minute * 2)
+	if value, err := ds.Increment("counter", 1); err != nil || value != 1 {
+		t.Fatalf("Expected an expired key to count from zero but got %d: %q", value, err)
+	}
+	if _, hasExpiration := ds.ReadExpiration("counter"); hasExpiration {
+		t.Fatalf("Expected the recreated key not to keep the old expiration")
+	}
+
+	ds.Expire("counter", now.Add(time.Minute))
+	ds.Increment("counter", 1)
+	if expiration, hasExpiration := ds.ReadExpiration("counter"); !hasExpiration || !expiration.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Expected a counter that is present to keep its expiration but found %s", expiration)
+	}
+}
+
+func TestIncrementRefusesValuesThatAreNotIntegers(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.Insert("word", "abc")
+	ds.Insert("max", "9223372036854775807")
+	ds.HSet("hash", "field", "1")
+
+	if _, err := ds.Increment("word", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("Expected ErrNotInteger for a value that is not a number but got %q", err)
+	}
+	if value, _ := ds.Read("word"); value != "abc" {
+		t.Fatalf("Expected a refused increment to leave the value alone but read %q", value)
+	}
+	if _, err := ds.Increment("max", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("Expected ErrNotInteger for an increment that overflows but got %q", err)
+	}
+	if _, err := ds.Decrement("missing", math.MinInt64); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("Expected ErrNotInteger for a decrement that overflows but got %q", err)
+	}
+	if _, err := ds.Increment("hash", 1); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected ErrWrongType for a key holding a hash but got %q", err)
+	}
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -9,19 +10,60 @@ type dataNode struct {
 	value         string
 	hasExpiration bool
 	expiration    time.Time
+	// spilled refers to the file holding the value instead of value when it was longer than Options.SpillThreshold
+	spilled *spilledValue
+	// hash holds the fields of a key holding a hash instead of a value, nil for keys holding a string
+	hash *hashFields
 }
 
 type DataStore struct {
 	inMemoryStore      map[string]dataNode
 	keyIndex           PrefixTrie
-	internalStoreMutex sync.Mutex
+	expirations        expirationHeap
+	writes             writeOrder
+	ttlRules           []TTLRule
+	defaultTTL         time.Duration
+	defaultTTLsApplied int
+	options            Options
+	archive            *expirationArchive
+	changes            changeLog
+	// view is the copy of the store read without the mutex, nil unless Options.CopyOnWriteReads is set
+	view      *readView
+	keyLimits KeyLimits
+	// valueLimit is read without the mutex, see valueLimit
+	valueLimit *valueLimit
+	spill      *spillTier
+	clock      *clockGuard
+	// internalStoreMutex is only read locked by the reads of a single key, everything else takes it whole
+	internalStoreMutex sync.RWMutex
+	// generation is incremented by Truncate so cleanups scheduled before it can be told apart
+	generation uint64
+	// cleanupSignal receives the generation of every scheduled cleanup instead of starting it, for tests to run them
+	cleanupSignal chan uint64
+	// cleanupQueued is set while a cleanup is waiting for the mutex, so writes made in the meantime leave it to that one
+	cleanupQueued bool
+	// longestLockHold is the longest a bulk operation has held the mutex, see lockHold
+	longestLockHold time.Duration
+	// lockHoldHook is called with when the mutex was taken and released by every hold of a bulk operation, for tests
+	lockHoldHook func(acquired time.Time, released time.Time)
+	// snapshotCopies are the snapshots being copied in slices, which keep the nodes replaced while they are released
+	snapshotCopies []*snapshotCopy
+	// sizeBytes is the size of every stored node, kept up to date by setNode and deleteNode, see nodeSize
+	sizeBytes  int
+	waterMarks WaterMarks
+	// full is set while writes creating keys are refused, see storeFull
+	full                bool
+	storeFullRejections int
+	// expiredRemoved counts the expired keys the cleanup has removed, see Stats.ExpiredRemoved
+	expiredRemoved int
+	// sweeper removes expired keys every Options.CleanupInterval once the data store is first used, nil without one
+	sweeper *sweeper
+	// eviction tracks the order keys were used in for Options.MaxKeys, nil without it
+	eviction *eviction
 }
 
 func NewDataStore() DataStore {
-	return DataStore{
-		inMemoryStore: map[string]dataNode{},
-		keyIndex:      NewPrefixTrie(),
-	}
+	return NewDataStoreWithOptions(Options{})
 }
 
 // Read
@@ -33,14 +75,74 @@ func NewDataStore() DataStore {
 * present when reading
  */
 func (ds *DataStore) Read(key string) (string, bool) {
-	ds.internalStoreMutex.Lock()
-	readValue, present := ds.inMemoryStore[key]
-	ds.internalStoreMutex.Unlock()
+	readValue, present := ds.readNode("Read", key)
+	defer ds.spill.release(readValue.spilled)
 
-	if readValue.hasExpiration && readValue.expiration.Before(time.Now()) {
+	if !present || readValue.hash != nil || ds.isExpired(readValue, ds.now()) {
 		return "", false
 	}
-	return readValue.value, present
+	return ds.spill.load(readValue)
+}
+
+// ReadStale
+/**
+* Read a value from the data store that has the provided key, serving it even after it has expired
+*
+* An expired key is still returned as long as it expired no more than staleWindow ago and has not been cleaned up yet,
+* with stale set to mark it expired. Keys are only guaranteed to survive the cleanup for Options.StaleWindow after
+* they expire, so a staleWindow longer than that may still find keys missing.
+ */
+func (ds *DataStore) ReadStale(key string, staleWindow time.Duration) (string, bool, bool) {
+	readValue, present := ds.readNode("ReadStale", key)
+	defer ds.spill.release(readValue.spilled)
+	if !present || readValue.hash != nil {
+		return "", false, false
+	}
+
+	timestamp := ds.now()
+	stale := ds.isExpired(readValue, timestamp)
+	if stale && readValue.expiration.Add(staleWindow).Before(timestamp) {
+		return "", false, false
+	}
+
+	value, loaded := ds.spill.load(readValue)
+	return value, stale && loaded, loaded
+}
+
+// KeyStatus tells a ReadWithStatus caller why a key was or was not read
+type KeyStatus int
+
+const (
+	// KeyMissing keys were never written, were deleted, or expired and have since been cleaned up
+	KeyMissing KeyStatus = iota
+	// KeyLive keys are present and their value was read
+	KeyLive
+	// KeyExpired keys are still stored with an expiration in the past, until the cleanup removes them
+	KeyExpired
+)
+
+// ReadWithStatus
+/**
+* Read a value from the data store like Read, also telling a key that expired apart from one that is not stored
+*
+* The value is only returned for KeyLive. Expired keys are reported as KeyExpired until the cleanup removes them, which
+* happens shortly after they expire unless Options.StaleWindow keeps them around for longer, and as KeyMissing after.
+ */
+func (ds *DataStore) ReadWithStatus(key string) (string, KeyStatus) {
+	readValue, present := ds.readNode("ReadWithStatus", key)
+	defer ds.spill.release(readValue.spilled)
+	if !present || readValue.hash != nil {
+		return "", KeyMissing
+	}
+	if ds.isExpired(readValue, ds.now()) {
+		return "", KeyExpired
+	}
+
+	value, loaded := ds.spill.load(readValue)
+	if !loaded {
+		return "", KeyMissing
+	}
+	return value, KeyLive
 }
 
 // ReadExpiration
@@ -53,11 +155,18 @@ func (ds *DataStore) Read(key string) (string, bool) {
 * had an expiration set when reading
  */
 func (ds *DataStore) ReadExpiration(key string) (time.Time, bool) {
-	ds.internalStoreMutex.Lock()
-	readValue, present := ds.inMemoryStore[key]
-	ds.internalStoreMutex.Unlock()
+	store, lockFree := ds.publishedStore()
+	if lockFree {
+		defer ds.lockAndCheckInvariants("ReadExpiration")
+	} else {
+		ds.internalStoreMutex.RLock()
+		defer ds.internalStoreMutex.RUnlock()
+		defer ds.checkInvariants("ReadExpiration")
+		store = ds.inMemoryStore
+	}
 
-	if !present || readValue.hasExpiration && readValue.expiration.Before(time.Now()) {
+	readValue, present := store[key]
+	if !present || ds.isExpired(readValue, ds.now()) {
 		return time.Time{}, false
 	}
 	return readValue.expiration, readValue.hasExpiration
@@ -65,12 +174,40 @@ func (ds *DataStore) ReadExpiration(key string) (time.Time, bool) {
 
 // Present
 /**
-* Determine if the provided key is present in the data store
+* Determine if the provided key is present in the data store, holding either a string or a hash
 *
 * returns a boolean indicating if the key was present or not
  */
 func (ds *DataStore) Present(key string) bool {
-	_, present := ds.Read(key)
+	node, present := ds.readNode("Present", key)
+	ds.spill.release(node.spilled)
+	return present && !ds.isExpired(node, ds.now())
+}
+
+// PresentMulti
+/**
+* Determine which of the provided keys are present in the data store, checking them all in one critical section
+*
+* returns a boolean for each key in the same order, expired keys are not present just like with Present
+ */
+func (ds *DataStore) PresentMulti(keys []string) []bool {
+	store, lockFree := ds.publishedStore()
+	if lockFree {
+		defer ds.lockAndCheckInvariants("PresentMulti")
+	} else {
+		ds.internalStoreMutex.RLock()
+		defer ds.internalStoreMutex.RUnlock()
+		defer ds.checkInvariants("PresentMulti")
+		store = ds.inMemoryStore
+	}
+
+	timestamp := ds.now()
+	present := make([]bool, len(keys))
+	for i, key := range keys {
+		node, stored := store[key]
+		present[i] = stored && !ds.isExpired(node, timestamp)
+	}
+
 	return present
 }
 
@@ -82,78 +219,223 @@ func (ds *DataStore) Present(key string) bool {
 *
 * returns the value of the key in the data store and a boolean indicating if the new value was inserted. If the new
 * value was not inserted because the key already existed this will return the current value of the key.
+*
+* Keys that break the KeyLimits are not inserted either, see CheckKey to tell the two apart, nor are values longer than
+* the MaxValueLength, see CheckValue, nor keys written while the data store is over its WaterMarks, see CheckCapacity.
  */
 func (ds *DataStore) Insert(key string, value string) bool {
-	go ds.cleanupExpirations()
-	valueExists := ds.Present(key)
-	if !valueExists {
-		ds.internalStoreMutex.Lock()
-		ds.inMemoryStore[key] = dataNode{value: value}
-		ds.keyIndex.Add(key)
-		ds.internalStoreMutex.Unlock()
-		return true
+	if ds.CheckValue(value) != nil {
+		return false
+	}
+	spilled := ds.spill.spill(key, value)
+	defer ds.spill.release(spilled)
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Insert")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	return ds.insert(key, value, spilled, ds.now()) == nil
+}
+
+// insert writes a new key for Insert and ApplyBatch, returning why it was not inserted. The caller must hold the mutex
+// and have checked the value.
+func (ds *DataStore) insert(key string, value string, spilled *spilledValue, timestamp time.Time) error {
+	if ds.isLive(key, timestamp) {
+		return ErrKeyExists
+	}
+	if err := ds.checkKey(key); err != nil {
+		return err
+	}
+	if err := ds.refuseNewKey(); err != nil {
+		return err
 	}
 
-	return false
+	ds.makeRoom(key, timestamp)
+	ds.retireIfExpired(key, timestamp)
+	ds.expirations.remove(key)
+	ds.setNode(key, ds.governWrite(key, ds.withDefaultTTL(key, newNode(value, spilled), timestamp), timestamp))
+	ds.keyIndex.Add(key)
+	ds.writes.touch(key, timestamp)
+	ds.recordChange(ChangeInsert, key, ds.inMemoryStore[key], timestamp)
+	return nil
 }
 
 // Update
 /*
 * Update the provided key in the datastore to have the new provided value
 *
-* This will not insert a new key if the key does not already exist in the data store.
+* This will not insert a new key if the key does not already exist in the data store. The key keeps the expiration it
+* has, the node is rewritten with the expiration read from the one it replaces under the same lock.
 *
 * Returns the new value of the key and a boolean indicating if the update was successful. If the update was not
-* successful it returns the empty string "" for the value.
+* successful it returns the empty string "" for the value. Values longer than the MaxValueLength are not written, see
+* CheckValue.
  */
 func (ds *DataStore) Update(key string, value string) bool {
-	go ds.cleanupExpirations()
-	valueExists := ds.Present(key)
-	if valueExists {
-		ds.internalStoreMutex.Lock()
-		currentNode := ds.inMemoryStore[key]
-		ds.inMemoryStore[key] = dataNode{
-			value:         value,
-			hasExpiration: currentNode.hasExpiration,
-			expiration:    currentNode.expiration,
-		}
-		ds.internalStoreMutex.Unlock()
-		return true
+	if ds.CheckValue(value) != nil {
+		return false
+	}
+	spilled := ds.spill.spill(key, value)
+	defer ds.spill.release(spilled)
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Update")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	return ds.update(key, value, spilled, ds.now()) == nil
+}
+
+// update rewrites the value of a present key for Update and ApplyBatch, returning ErrKeyNotFound or ErrWrongType when
+// it was not updated. The caller must hold the mutex and have checked the value.
+func (ds *DataStore) update(key string, value string, spilled *spilledValue, timestamp time.Time) error {
+	currentNode := ds.inMemoryStore[key]
+	if !ds.isLive(key, timestamp) {
+		return ErrKeyNotFound
+	}
+	if currentNode.hash != nil {
+		return ErrWrongType
 	}
 
-	return false
+	node := newNode(value, spilled)
+	node.hasExpiration = currentNode.hasExpiration
+	node.expiration = currentNode.expiration
+	ds.setNode(key, ds.governWrite(key, node, timestamp))
+	ds.writes.touch(key, timestamp)
+	ds.recordChange(ChangeUpdate, key, ds.inMemoryStore[key], timestamp)
+	return nil
 }
 
 // Upsert
 /**
 * Insert the provided value for the provided key, or Update the value if the key already exists
 *
-* return the updated value of the key.
+* A key that already exists keeps its expiration like with Update, a key that is inserted gets the default TTL like
+* with Insert.
+*
+* Returns false without writing anything when the key already holds exactly the provided value, leaving its expiration
+* untouched, unless Options.AlwaysRewriteUpserts is set. Also returns false without writing anything when the value is
+* longer than the MaxValueLength, or the key is not present and breaks the KeyLimits or the data store is over its
+* WaterMarks.
  */
 func (ds *DataStore) Upsert(key string, value string) bool {
-	go ds.cleanupExpirations()
-	currentValue, valueExists := ds.Read(key)
-
-	if valueExists && currentValue == value {
+	if ds.CheckValue(value) != nil {
 		return false
 	}
+	spilled := ds.spill.spill(key, value)
+	defer ds.spill.release(spilled)
 
 	ds.internalStoreMutex.Lock()
-	if valueExists {
-		currentNode := ds.inMemoryStore[key]
-		ds.inMemoryStore[key] = dataNode{
-			value:         value,
-			hasExpiration: currentNode.hasExpiration,
-			expiration:    currentNode.expiration,
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Upsert")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	upserted, _ := ds.upsert(key, value, spilled, ds.now())
+	return upserted
+}
+
+// upsert writes a key for Upsert and ApplyBatch, returning false with no error when the key already held the value, and
+// the error when it could not be written. The caller must hold the mutex and have checked the value.
+func (ds *DataStore) upsert(key string, value string, spilled *spilledValue, timestamp time.Time) (bool, error) {
+	currentNode, valueExists := ds.inMemoryStore[key]
+	valueExists = valueExists && !ds.isExpired(currentNode, timestamp)
+
+	if valueExists && currentNode.hash != nil {
+		return false, ErrWrongType
+	}
+	if valueExists && !ds.options.AlwaysRewriteUpserts && sameValue(currentNode, value, spilled) {
+		return false, nil
+	}
+	if !valueExists {
+		if err := ds.checkKey(key); err != nil {
+			return false, err
+		}
+		if err := ds.refuseNewKey(); err != nil {
+			return false, err
 		}
+	}
+
+	node := newNode(value, spilled)
+	if valueExists {
+		node.hasExpiration = currentNode.hasExpiration
+		node.expiration = currentNode.expiration
+		ds.setNode(key, ds.governWrite(key, node, timestamp))
 	} else {
-		ds.inMemoryStore[key] = dataNode{value: value}
+		ds.makeRoom(key, timestamp)
+		ds.retireIfExpired(key, timestamp)
+		ds.expirations.remove(key)
+		ds.setNode(key, ds.governWrite(key, ds.withDefaultTTL(key, node, timestamp), timestamp))
 	}
 	ds.keyIndex.Add(key)
+	ds.writes.touch(key, timestamp)
+	ds.recordChange(ChangeUpsert, key, ds.inMemoryStore[key], timestamp)
 
-	ds.internalStoreMutex.Unlock()
+	return true, nil
+}
 
-	return true
+// GetOrSet
+/**
+* Read the value of a key, inserting defaultValue first when the key is not present
+*
+* The read and the insert happen in one critical section, so concurrent callers all receive the value of whichever of
+* them inserted it. An expired key is not present and is replaced, expiration and all. Returns the value of the key and
+* whether it existed.
+ */
+func (ds *DataStore) GetOrSet(key string, defaultValue string) (string, bool) {
+	return ds.GetOrSetWithTTL(key, defaultValue, 0)
+}
+
+// GetOrSetWithTTL
+/**
+* GetOrSet that gives the key an expiration ttl from now when it inserts it, a key that existed keeps its expiration.
+* With a ttl of zero or less the inserted key gets the default TTL like Insert. A key that is not present and breaks
+* the KeyLimits, or is written while the data store is over its WaterMarks, is not inserted, returning the empty string
+* as not existing. Neither is a defaultValue longer than the MaxValueLength, which is still fine for reading a key that
+* is present.
+ */
+func (ds *DataStore) GetOrSetWithTTL(key string, defaultValue string, ttl time.Duration) (string, bool) {
+	tooLarge := ds.CheckValue(defaultValue) != nil
+	var spilled *spilledValue
+	if !tooLarge {
+		spilled = ds.spill.spill(key, defaultValue)
+	}
+	defer ds.spill.release(spilled)
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("GetOrSetWithTTL")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	currentNode, present := ds.inMemoryStore[key]
+	if present && !ds.isExpired(currentNode, timestamp) {
+		ds.eviction.used(key)
+		return ds.valueOf(currentNode), true
+	}
+	if tooLarge || ds.checkKey(key) != nil || ds.refuseNewKey() != nil {
+		return "", false
+	}
+
+	ds.makeRoom(key, timestamp)
+	ds.retireIfExpired(key, timestamp)
+	ds.expirations.remove(key)
+	node := newNode(defaultValue, spilled)
+	if ttl > 0 {
+		node.hasExpiration = true
+		node.expiration = timestamp.Add(ttl)
+		ds.expirations.set(key, node.expiration)
+	}
+	ds.setNode(key, ds.governWrite(key, ds.withDefaultTTL(key, node, timestamp), timestamp))
+	ds.keyIndex.Add(key)
+	ds.writes.touch(key, timestamp)
+	ds.recordChange(ChangeInsert, key, ds.inMemoryStore[key], timestamp)
+
+	return defaultValue, false
 }
 
 // Delete
@@ -163,61 +445,443 @@ func (ds *DataStore) Upsert(key string, value string) bool {
 * returns a boolean indicating whether a value was deleted or not
  */
 func (ds *DataStore) Delete(key string) bool {
-	go ds.cleanupExpirations()
-	valueExists := ds.Present(key)
-
 	ds.internalStoreMutex.Lock()
-	delete(ds.inMemoryStore, key)
-	ds.keyIndex.Delete(key)
-	ds.internalStoreMutex.Unlock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Delete")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	return ds.delete(key, ds.now())
+}
+
+// delete removes a key for Delete and ApplyBatch, returning whether it was present. The caller must hold the mutex.
+func (ds *DataStore) delete(key string, timestamp time.Time) bool {
+	valueExists := ds.isLive(key, timestamp)
+	if valueExists {
+		ds.recordChange(ChangeDelete, key, ds.inMemoryStore[key], timestamp)
+	}
+	ds.retireIfExpired(key, timestamp)
+	ds.removeKey(key)
 
 	return valueExists
 }
 
+// DeleteIfEquals
+/**
+* Delete the provided key only if its current value is expectedValue, checking and deleting in one step
+*
+* Useful for releasing a lock only while it is still held by the caller. Returns whether the key was deleted, the
+* value it held, and whether it was present, so a key holding the empty string is told apart from a missing one.
+* Expired keys and keys holding a hash are not present.
+ */
+func (ds *DataStore) DeleteIfEquals(key string, expectedValue string) (bool, string, bool) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("DeleteIfEquals")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	node, present := ds.inMemoryStore[key]
+	if !present || node.hash != nil || ds.isExpired(node, timestamp) {
+		return false, "", false
+	}
+	value := ds.valueOf(node)
+	if !holdsValue(node, expectedValue) {
+		return false, value, true
+	}
+
+	ds.recordChange(ChangeDelete, key, node, timestamp)
+	ds.removeKey(key)
+	return true, value, true
+}
+
+// ReadAndDelete
+/**
+* Read the value of a key and delete it in one step, so of several callers popping the same key only one receives its
+* value
+*
+* Returns the value and whether the key was present. Expired keys are not present, and keys holding a hash are left
+* alone and reported as not present, see HoldsHash.
+ */
+func (ds *DataStore) ReadAndDelete(key string) (string, bool) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ReadAndDelete")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	node, present := ds.inMemoryStore[key]
+	if !present || node.hash != nil || ds.isExpired(node, timestamp) {
+		return "", false
+	}
+	value := ds.valueOf(node)
+
+	ds.recordChange(ChangeDelete, key, node, timestamp)
+	ds.removeKey(key)
+	return value, true
+}
+
+// ReadAndUpdate
+/**
+* Update the value of a key like Update and return the value it replaced, reading and writing in one step so of several
+* callers updating the same key each receives the value the one before it wrote
+*
+* Returns the old value and whether the key was present and updated. Expired keys are not present, and keys holding a
+* hash are left alone and reported as not present, see HoldsHash. A value longer than the MaxValueLength updates
+* nothing and is reported the same way, see CheckValue.
+ */
+func (ds *DataStore) ReadAndUpdate(key string, value string) (string, bool) {
+	if ds.CheckValue(value) != nil {
+		return "", false
+	}
+	spilled := ds.spill.spill(key, value)
+	defer ds.spill.release(spilled)
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ReadAndUpdate")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	currentNode := ds.inMemoryStore[key]
+	if !ds.isLive(key, timestamp) || currentNode.hash != nil {
+		return "", false
+	}
+	// read before the write, the node being replaced may hold its value in a spill file the write releases
+	oldValue := ds.valueOf(currentNode)
+
+	node := newNode(value, spilled)
+	node.hasExpiration = currentNode.hasExpiration
+	node.expiration = currentNode.expiration
+	ds.setNode(key, ds.governWrite(key, node, timestamp))
+	ds.writes.touch(key, timestamp)
+	ds.recordChange(ChangeUpdate, key, ds.inMemoryStore[key], timestamp)
+	return oldValue, true
+}
+
 // Count
 /**
 * Count the number of keys in the datastore
 *
-* Count will return an approximation of the number of active keys, but for performance reasons it may count some
-* expired keys that have not yet been cleaned up.
+* Keys that expired are not counted even when the cleanup has not removed them yet, see ApproximateCount for a count
+* that does not have to check expirations.
 *
-* returns the number of items in the datastore as an int
+* returns the number of unexpired keys in the datastore as an int
  */
 func (ds *DataStore) Count() int {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Count")
+
+	return ds.countLive()
+}
+
+// ApproximateCount
+/**
+* Count the number of keys held by the datastore in constant time
+*
+* This is an approximation of the number of unexpired keys that also counts expired keys the cleanup has not removed
+* yet, see Count.
+ */
+func (ds *DataStore) ApproximateCount() int {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ApproximateCount")
+
 	return len(ds.inMemoryStore)
 }
 
+// CountBy
+/**
+* Count the unexpired keys matching the provided prefix, with the same restrictions on matching a key as described in
+* KeysBy
+*
+* Unlike CountByApprox every key under the prefix is checked, so keys that expired are never counted, but the keys are
+* counted as the key index is walked rather than collected the way KeysBy does.
+ */
+func (ds *DataStore) CountBy(prefix string) int {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("CountBy")
+
+	timestamp := ds.now()
+	count := 0
+	ds.keyIndex.Each(prefix, func(key string) {
+		if ds.isLive(key, timestamp) {
+			count++
+		}
+	})
+	return count
+}
+
+// CountByApprox
+/**
+* Count the keys matching the provided prefix from the key index's counters, in time proportional to the depth of the
+* prefix rather than the number of keys under it
+*
+* Like Count this is an approximation that may include expired keys that have not been cleaned up yet. The same
+* restrictions on matching a key as described in KeysBy apply.
+ */
+func (ds *DataStore) CountByApprox(prefix string) int {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("CountByApprox")
+
+	return ds.keyIndex.CountUnder(prefix)
+}
+
 // Truncate
 /**
 * Delete all values from the data store
+*
+* Resets the key index and expiration tracking along with the values, leaving the data store in the same state as a
+* newly created one. Cleanups scheduled before the truncate are discarded rather than run against the new contents.
+*
+* returns the number of unexpired keys that were removed
  */
-func (ds *DataStore) Truncate() {
+func (ds *DataStore) Truncate() int {
 	ds.internalStoreMutex.Lock()
-	ds.inMemoryStore = map[string]dataNode{}
+	removed := ds.countLive()
+	timestamp := ds.now()
+	for key := range ds.inMemoryStore {
+		ds.retireIfExpired(key, timestamp)
+		ds.deleteNode(key)
+	}
+	ds.keyIndex = ds.keyIndex.empty()
+	ds.expirations = newExpirationHeap()
+	ds.writes = newWriteOrder()
+	ds.generation++
+	// the cleanup queued before is discarded, so the next write queues one for the new generation
+	ds.cleanupQueued = false
+	ds.recordChange(ChangeTruncate, "", dataNode{}, timestamp)
+	ds.publishReads()
+	ds.checkInvariants("Truncate")
 	ds.internalStoreMutex.Unlock()
+
+	return removed
 }
 
+// ExpireMode decides whether ExpireWithMode replaces a key's current expiration
+type ExpireMode int
+
+const (
+	// ExpireAlways sets the expiration regardless of the current one
+	ExpireAlways ExpireMode = iota
+	// ExpireIfNone only sets the expiration when the key does not have one
+	ExpireIfNone
+	// ExpireIfSet only sets the expiration when the key already has one
+	ExpireIfSet
+	// ExpireIfLonger only sets the expiration when it is later than the current one, a key without an expiration
+	// lives forever so it is never extended
+	ExpireIfLonger
+	// ExpireIfShorter only sets the expiration when it is earlier than the current one, a key without an expiration
+	// lives forever so it is always shortened
+	ExpireIfShorter
+)
+
 // Expire
 /**
 * Sets an expiration time for a key
 *
 * Once the expiration time for a key passes it will behave as if it has been deleted. The actusal deletion of
 * underlying expired data will happen asynchronously
+*
+* The presence check and the write happen in one critical section, so an Expire racing a Delete of the same key can
+* never bring the deleted key back.
  */
 func (ds *DataStore) Expire(key string, expiration time.Time) bool {
-	valueExists := ds.Present(key)
-	if valueExists {
-		ds.internalStoreMutex.Lock()
-		valueToUpdate := ds.inMemoryStore[key]
-		valueToUpdate.hasExpiration = true
-		valueToUpdate.expiration = expiration
-		ds.inMemoryStore[key] = valueToUpdate
-		ds.internalStoreMutex.Unlock()
+	changed, err := ds.ExpireWithMode(key, expiration, ExpireAlways)
+	return changed && err == nil
+}
+
+// ExpireWithMode
+/**
+* Sets an expiration time for a key when the mode allows it, see ExpireMode
+*
+* The current expiration is compared and replaced in one critical section, so concurrent callers extending the same
+* key with ExpireIfLonger always leave the latest requested expiration in place. The expiration is limited by the TTL
+* policy before the mode compares it, see TTLRule.
+*
+* Returns ErrKeyNotFound if the key is not present, ErrTTLExceeded if a TTL rule refuses the expiration, otherwise
+* whether the expiration was changed.
+ */
+func (ds *DataStore) ExpireWithMode(key string, expiration time.Time, mode ExpireMode) (bool, error) {
+	changed, _, err := ds.ExpireWithLimit(key, expiration, mode)
+	return changed, err
+}
+
+// ExpireWithLimit
+/**
+* ExpireWithMode that also returns the expiration the key was given, which is earlier than the one requested when a TTL
+* rule shortened it. The expiration is the zero time when it was not changed.
+ */
+func (ds *DataStore) ExpireWithLimit(key string, expiration time.Time, mode ExpireMode) (bool, time.Time, error) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ExpireWithLimit")
+	defer ds.publishReads()
+
+	return ds.expire(key, expiration, mode, ds.now())
+}
+
+// ExpireIn
+/**
+* Expire a key ttl from now by the data store's clock, so callers on other machines are not affected by the skew between
+* their clock and the server's. A ttl of zero or less expires the key straight away.
+*
+* Returns false if the key is not present or a TTL rule refuses the expiration, like Expire.
+ */
+func (ds *DataStore) ExpireIn(key string, ttl time.Duration) bool {
+	changed, _, err := ds.ExpireInWithLimit(key, ttl, ExpireAlways)
+	return changed && err == nil
+}
+
+// ExpireInWithLimit
+/**
+* ExpireWithMode for an expiration ttl from now by the data store's clock, see ExpireIn, that also returns the time to
+* live the key was given, which is shorter than the one requested when a TTL rule shortened it. The time to live is
+* zero when the expiration was not changed.
+ */
+func (ds *DataStore) ExpireInWithLimit(key string, ttl time.Duration, mode ExpireMode) (bool, time.Duration, error) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ExpireInWithLimit")
+	defer ds.publishReads()
+
+	// a key only expires once the clock is past its expiration, so no time to live at all has to be in the past
+	if ttl == 0 {
+		ttl = -time.Nanosecond
+	}
+	timestamp := ds.now()
+	changed, expiration, err := ds.expire(key, timestamp.Add(ttl), mode, timestamp)
+	if !changed {
+		return changed, 0, err
+	}
+	return true, expiration.Sub(timestamp), nil
+}
+
+// TTL returns how long the key has left to live and whether it has an expiration, zero and false when it is not present
+func (ds *DataStore) TTL(key string) (time.Duration, bool) {
+	expiration, hasExpiration := ds.ReadExpiration(key)
+	if !hasExpiration {
+		return 0, false
+	}
 
-		return true
+	remaining := expiration.Sub(ds.now())
+	if remaining < 0 {
+		// the key expired since it was read
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// expire gives a key an expiration when the mode allows it, for ExpireWithLimit and ExpireInWithLimit. The caller must
+// hold the mutex.
+func (ds *DataStore) expire(key string, expiration time.Time, mode ExpireMode, timestamp time.Time) (bool, time.Time, error) {
+	valueToUpdate, present := ds.inMemoryStore[key]
+	if !present || ds.isExpired(valueToUpdate, timestamp) {
+		return false, time.Time{}, ErrKeyNotFound
+	}
+
+	expiration, err := ds.limitExpiration(key, expiration, timestamp)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	var apply bool
+	switch mode {
+	case ExpireIfNone:
+		apply = !valueToUpdate.hasExpiration
+	case ExpireIfSet:
+		apply = valueToUpdate.hasExpiration
+	case ExpireIfLonger:
+		apply = valueToUpdate.hasExpiration && expiration.After(valueToUpdate.expiration)
+	case ExpireIfShorter:
+		apply = !valueToUpdate.hasExpiration || expiration.Before(valueToUpdate.expiration)
+	default:
+		apply = true
+	}
+
+	if !apply {
+		return false, time.Time{}, nil
 	}
 
-	return false
+	valueToUpdate.hasExpiration = true
+	valueToUpdate.expiration = expiration
+	ds.setNode(key, valueToUpdate)
+	ds.expirations.set(key, expiration)
+	ds.recordChange(ChangeExpire, key, valueToUpdate, timestamp)
+
+	return true, expiration, nil
+}
+
+// Rename
+/**
+* Move the value stored under oldKey to newKey in a single step, so no reader ever sees the value under both keys or
+* under neither
+*
+* The expiration travels with the value. Returns ErrKeyNotFound if oldKey is not present, and ErrKeyExists if newKey is
+* present and overwrite is false, and a KeyTooComplexError if newKey breaks the KeyLimits. Renaming a key to itself
+* does nothing.
+ */
+func (ds *DataStore) Rename(oldKey string, newKey string, overwrite bool) error {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Rename")
+	defer ds.publishReads()
+
+	timestamp := ds.now()
+	node, present := ds.inMemoryStore[oldKey]
+	if !present || ds.isExpired(node, timestamp) {
+		return ErrKeyNotFound
+	}
+
+	if oldKey == newKey {
+		return nil
+	}
+	err := ds.checkKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	existingNode, newKeyPresent := ds.inMemoryStore[newKey]
+	if newKeyPresent && !ds.isExpired(existingNode, timestamp) && !overwrite {
+		return ErrKeyExists
+	}
+	ds.retireIfExpired(newKey, timestamp)
+
+	// the value's file is held while it moves from one key to the other
+	ds.spill.acquire(node.spilled)
+	defer ds.spill.release(node.spilled)
+	ds.deleteNode(oldKey)
+	ds.keyIndex.Delete(oldKey)
+	ds.expirations.remove(oldKey)
+	ds.writes.remove(oldKey)
+
+	if node.hasExpiration {
+		ds.expirations.set(newKey, node.expiration)
+	} else {
+		ds.expirations.remove(newKey)
+	}
+	ds.setNode(newKey, ds.governWrite(newKey, node, timestamp))
+	ds.keyIndex.Add(newKey)
+	ds.writes.touch(newKey, timestamp)
+	ds.recordChange(ChangeDelete, oldKey, node, timestamp)
+	if node.hash != nil {
+		ds.recordHashWrite(newKey, node.hash, timestamp)
+	} else {
+		ds.recordChange(ChangeUpsert, newKey, ds.inMemoryStore[newKey], timestamp)
+	}
+
+	return nil
+}
+
+// KeySeparator returns the separator keys are split into segments on, see Options.KeySeparator
+func (ds *DataStore) KeySeparator() string {
+	return ds.keyIndex.seperator
 }
 
 // KeysBy
@@ -229,67 +893,473 @@ func (ds *DataStore) Expire(key string, expiration time.Time) bool {
 * but not the searches "cou", "country:", or "country:Canada"
 *
 * Return a slice of all the string keys that match the prefix
+*
+* The keys are those present at a single instant: the key index is walked and each key checked against the stored
+* values under one hold of the mutex, so a KeysBy racing a DeleteBy or other writes never returns a key that was
+* already removed, nor misses one that was present throughout.
  */
 func (ds *DataStore) KeysBy(prefix string) []string {
-	allKeys := ds.keyIndex.Find(prefix)
-	var unexpiredKeys []string
-	for _, key := range allKeys {
-		if ds.Present(key) {
-			unexpiredKeys = append(unexpiredKeys, key)
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("KeysBy")
+
+	return ds.liveKeysBy(prefix, ds.now())
+}
+
+// ReadBy
+/**
+* Read the value of every key matching the prefix, see KeysBy for how prefixes match. An empty prefix reads every key.
+*
+* The keys and their values are read under one hold of the mutex, so they are those present at a single instant. Keys
+* that expired are left out even when the cleanup has not removed them yet, as are keys holding a hash. The map is the
+* caller's to change.
+ */
+func (ds *DataStore) ReadBy(prefix string) map[string]string {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ReadBy")
+
+	keys := ds.liveKeysBy(prefix, ds.now())
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		node := ds.inMemoryStore[key]
+		if node.hash == nil {
+			values[key] = ds.valueOf(node)
 		}
 	}
+	return values
+}
 
-	return unexpiredKeys
+// CompleteKeyPrefix
+/**
+* Suggest completions for a partially typed key prefix, see PrefixTrie.Complete for how completions are matched
+*
+* Completions whose keys have all expired are left out. A limit of zero or less returns every completion.
+ */
+func (ds *DataStore) CompleteKeyPrefix(partial string, limit int) []string {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("CompleteKeyPrefix")
+
+	timestamp := ds.now()
+	var completions []string
+	for _, completion := range ds.keyIndex.Complete(partial, 0) {
+		if limit > 0 && len(completions) >= limit {
+			break
+		}
+
+		for _, key := range ds.keyIndex.Find(completion) {
+			node, present := ds.inMemoryStore[key]
+			if present && !ds.isExpired(node, timestamp) {
+				completions = append(completions, completion)
+				break
+			}
+		}
+	}
+
+	return completions
 }
 
 // DeleteBy
 /**
 * Delete all keys that match a provided prefix
 *
-* The same restrictions as to what constitute matching a key as described in KeysBy apply to this method
+* The same restrictions as to what constitute matching a key as described in KeysBy apply to this method. Expired keys
+* that have not been cleaned up yet are removed as well, so DeleteBy("") leaves the data store in the same state as
+* Truncate.
+*
+* With Options.MaxLockHold set the keys are found and deleted a slice at a time, and keys written under the prefix while
+* the mutex is released may or may not be deleted.
+*
+* returns the number of unexpired keys that were removed
  */
 func (ds *DataStore) DeleteBy(prefix string) int {
-	keysToRemove := ds.KeysBy(prefix)
-	ds.internalStoreMutex.Lock()
-	ds.keyIndex.DeleteAll(prefix)
+	hold := ds.holdLock()
+	defer hold.release()
+	defer ds.checkInvariants("DeleteBy")
+	defer ds.publishReads()
+
+	timestamp := ds.now()
+	if hold.sliced() {
+		return ds.deleteBySliced(prefix, timestamp, hold)
+	}
+
+	keysToRemove := ds.keyIndex.Find(prefix)
+	removed := 0
 	for _, key := range keysToRemove {
-		delete(ds.inMemoryStore, key)
+		node, present := ds.inMemoryStore[key]
+		if present && !ds.isExpired(node, timestamp) {
+			removed++
+			ds.recordChange(ChangeDelete, key, node, timestamp)
+		}
+		ds.retireIfExpired(key, timestamp)
+		ds.deleteNode(key)
+		ds.expirations.remove(key)
+		ds.writes.remove(key)
+	}
+	if prefix == "" {
+		ds.keyIndex = ds.keyIndex.empty()
+		ds.expirations = newExpirationHeap()
+		ds.writes = newWriteOrder()
+	} else {
+		ds.keyIndex.DeleteAll(prefix)
 	}
-	ds.internalStoreMutex.Unlock()
 
-	return len(keysToRemove)
+	return removed
+}
+
+// deleteBySliced
+/**
+* DeleteBy for Options.MaxLockHold, removing every key from the index along with the rest so the store is consistent
+* whenever the mutex is released. Keys are found a slice at a time, as finding them all at once takes as long as the
+* store is large, and no more keys are deleted than were under the prefix to begin with so writers adding keys under it
+* cannot keep it going. The caller must hold the mutex.
+ */
+func (ds *DataStore) deleteBySliced(prefix string, timestamp time.Time, hold *lockHold) int {
+	removed := 0
+	remaining := ds.keyIndex.CountUnder(prefix)
+	for remaining > 0 {
+		keysToRemove := ds.keyIndex.FindLimit(prefix, lockHoldCheckInterval)
+		if len(keysToRemove) == 0 {
+			break
+		}
+
+		for _, key := range keysToRemove {
+			if remaining == 0 {
+				break
+			}
+			remaining--
+
+			node, present := ds.inMemoryStore[key]
+			if present && !ds.isExpired(node, timestamp) {
+				removed++
+				ds.recordChange(ChangeDelete, key, node, timestamp)
+			}
+			ds.retireIfExpired(key, timestamp)
+			ds.removeKey(key)
+			if hold.next() {
+				// the rest of the slice may have changed while the mutex was released, so it is found again
+				break
+			}
+		}
+	}
+
+	return removed
 }
 
 // ExpireBy
 /**
 * Set the provided expiration on all keys matching the provided prefix
 *
-* The same restrictions as to what constitute matching a key as described in KeysBy apply to this method
+* The same restrictions as to what constitute matching a key as described in KeysBy apply to this method. Keys whose
+* TTL rule refuses the expiration are left unchanged, see TTLRule.
+*
+* With Options.MaxLockHold set the matching keys are found at once but given the expiration a slice at a time, and keys
+* deleted while the mutex is released are skipped.
+*
+* returns the number of keys that were given the expiration
  */
 func (ds *DataStore) ExpireBy(prefix string, expiration time.Time) int {
-	keysToExpire := ds.KeysBy(prefix)
+	hold := ds.holdLock()
+	defer hold.release()
+	defer ds.checkInvariants("ExpireBy")
+	defer ds.publishReads()
+
+	timestamp := ds.now()
+	expired := 0
+	for _, key := range ds.liveKeysBy(prefix, timestamp) {
+		if hold.next() && !ds.isLive(key, timestamp) {
+			continue
+		}
+
+		limited, err := ds.limitExpiration(key, expiration, timestamp)
+		if err != nil {
+			continue
+		}
 
-	for _, key := range keysToExpire {
-		ds.Expire(key, expiration)
+		node := ds.inMemoryStore[key]
+		node.hasExpiration = true
+		node.expiration = limited
+		ds.setNode(key, node)
+		ds.expirations.set(key, limited)
+		ds.recordChange(ChangeExpire, key, node, timestamp)
+		expired++
 	}
 
-	return len(keysToExpire)
+	return expired
 }
 
-// cleanupExpirations
+// UpdateBy
+/**
+* Set every key matching the provided prefix to the provided value, keeping their expirations
+*
+* The same restrictions as to what constitute matching a key as described in KeysBy apply to this method. Keys that
+* expired and keys holding a hash are left unchanged.
+*
+* The keys are found and updated under one hold of the mutex, so a DeleteBy or other writes never land halfway through.
+* With Options.MaxLockHold set the matching keys are found at once but updated a slice at a time instead, and keys
+* deleted while the mutex is released are skipped.
+*
+* returns the number of keys that were updated, none when the value is longer than the MaxValueLength
+ */
+func (ds *DataStore) UpdateBy(prefix string, value string) int {
+	if ds.CheckValue(value) != nil {
+		return 0
+	}
+	spilled := ds.spill.spill(prefix, value)
+	defer ds.spill.release(spilled)
+
+	hold := ds.holdLock()
+	defer hold.release()
+	defer ds.checkInvariants("UpdateBy")
+	defer ds.publishReads()
+
+	timestamp := ds.now()
+	updated := 0
+	for _, key := range ds.liveKeysBy(prefix, timestamp) {
+		if hold.next() && !ds.isLive(key, timestamp) {
+			continue
+		}
+
+		currentNode := ds.inMemoryStore[key]
+		if currentNode.hash != nil {
+			continue
+		}
+
+		node := newNode(value, spilled)
+		node.hasExpiration = currentNode.hasExpiration
+		node.expiration = currentNode.expiration
+		ds.setNode(key, ds.governWrite(key, node, timestamp))
+		ds.writes.touch(key, timestamp)
+		ds.recordChange(ChangeUpdate, key, ds.inMemoryStore[key], timestamp)
+		updated++
+	}
+
+	return updated
+}
+
+// ExpirationHistogram
 /**
-* Cleans up expired items in the data store
+* Count how many keys will expire within each of the provided time buckets
 *
-* Internally this is run async whenever a modification is made to the data store
+* The buckets are upper bounds of remaining time to live relative to the current time of the data store's clock and
+* are sorted before counting. A key is counted in the first bucket whose bound is greater than or equal to its
+* remaining time to live, so bucket i holds keys expiring in (buckets[i-1], buckets[i]], the lower edge being
+* exclusive and the upper edge inclusive. Keys expiring after the largest bucket are not counted in any bucket and
+* keys that have already expired are never counted.
+*
+* The histogram is computed from the expiration index, so only keys that have an expiration are visited.
+*
+* returns a slice with one count per bucket followed by a final count of the keys that have no expiration
  */
-func (ds *DataStore) cleanupExpirations() {
+func (ds *DataStore) ExpirationHistogram(buckets []time.Duration) []int {
+	sortedBuckets := make([]time.Duration, len(buckets))
+	copy(sortedBuckets, buckets)
+	sort.Slice(sortedBuckets, func(i, j int) bool { return sortedBuckets[i] < sortedBuckets[j] })
+
+	counts := make([]int, len(sortedBuckets)+1)
+
 	ds.internalStoreMutex.Lock()
-	timestamp := time.Now()
-	for key, value := range ds.inMemoryStore {
-		if value.hasExpiration && value.expiration.Before(timestamp) {
-			delete(ds.inMemoryStore, key)
-			ds.keyIndex.Delete(key)
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("ExpirationHistogram")
+
+	timestamp := ds.now()
+	for _, entry := range ds.expirations.entries {
+		remaining := entry.expiration.Sub(timestamp)
+		if remaining <= 0 {
+			continue
+		}
+
+		bucket := sort.Search(len(sortedBuckets), func(i int) bool { return sortedBuckets[i] >= remaining })
+		if bucket < len(sortedBuckets) {
+			counts[bucket]++
 		}
 	}
-	ds.internalStoreMutex.Unlock()
+	counts[len(sortedBuckets)] = len(ds.inMemoryStore) - ds.expirations.Len()
+
+	return counts
+}
+
+// CleanupNow
+/**
+* Remove expired keys from the data store immediately instead of waiting for a write to schedule a cleanup
+*
+* Returns once the keys it removed, and any still waiting, have been offered to Options.ExpirationArchive.
+ */
+func (ds *DataStore) CleanupNow() {
+	removed := 0
+	defer func() { ds.reportCleanup(removed) }()
+	defer ds.archive.deliver()
+	hold := ds.holdLock()
+	defer hold.release()
+	defer ds.checkInvariants("CleanupNow")
+	defer ds.publishReads()
+
+	removed = ds.removeExpired(hold)
+}
+
+// scheduleCleanup
+/**
+* Queue a cleanup of expired items tagged with the current generation, the caller must hold the mutex
+*
+* Internally this is run whenever a modification is made to the data store. The cleanup waits for the mutex, so it runs
+* after the caller's write has finished. Only one cleanup is queued at a time, writes made while it waits for the mutex
+* are cleaned up by it rather than each starting a goroutine of their own, so a burst of writes starts one cleanup.
+ */
+func (ds *DataStore) scheduleCleanup() {
+	generation := ds.generation
+	if ds.cleanupSignal != nil {
+		ds.cleanupSignal <- generation
+		return
+	}
+
+	if ds.cleanupQueued {
+		return
+	}
+	ds.cleanupQueued = true
+	go ds.cleanupExpirations(generation)
+}
+
+// cleanupExpirations
+/**
+* Cleans up expired items in the data store for a cleanup scheduled in the provided generation
+*
+* Truncate starts a new generation, and cleanups scheduled before it are discarded since the keys that scheduled them
+* are gone. Returns whether the cleanup ran. Keys waiting for Options.ExpirationArchive are delivered either way.
+ */
+func (ds *DataStore) cleanupExpirations(generation uint64) bool {
+	ran, removed := false, 0
+	// deferred before the mutex is taken so they run once it has been released, reporting after the delivery
+	defer func() {
+		if ran {
+			ds.reportCleanup(removed)
+		}
+	}()
+	defer ds.archive.deliver()
+	hold := ds.holdLock()
+	defer hold.release()
+	defer ds.checkInvariants("cleanupExpirations")
+	defer ds.publishReads()
+
+	if generation != ds.generation {
+		return false
+	}
+
+	// cleared before the keys are looked at, so writes made while the mutex is released between slices queue another
+	ds.cleanupQueued = false
+	ran, removed = true, ds.removeExpired(hold)
+	return true
+}
+
+// removeExpired
+/**
+* Delete the expired items, keeping those that expired within Options.StaleWindow for ReadStale, and queue them for
+* Options.ExpirationArchive. The caller must hold the mutex, which is released between slices of the keys.
+*
+* The keys are taken from the expiration heap earliest first, stopping at the first that has not expired, so a cleanup
+* costs O(log n) per expired key rather than a walk of the whole store. An entry that no longer agrees with its key's
+* node is brought in line with it instead of being trusted. Returns how many keys it removed.
+ */
+func (ds *DataStore) removeExpired(hold *lockHold) int {
+	removed := 0
+	now := ds.now()
+	timestamp := now.Add(-ds.options.StaleWindow)
+	for entry := ds.expirations.peek(); entry != nil && entry.expiration.Before(timestamp); entry = ds.expirations.peek() {
+		key := entry.key
+		node, present := ds.inMemoryStore[key]
+		switch {
+		case present && ds.isExpired(node, timestamp):
+			ds.retire(key, node, now)
+			ds.removeKey(key)
+			ds.expiredRemoved++
+			removed++
+		case present && node.hasExpiration:
+			ds.expirations.set(key, node.expiration)
+		default:
+			ds.expirations.remove(key)
+		}
+		hold.next()
+	}
+	return removed
+}
+
+// reportCleanup hands how many keys a cleanup removed to Options.OnCleanup, the caller must not hold the mutex
+func (ds *DataStore) reportCleanup(removed int) {
+	if ds.options.OnCleanup != nil {
+		ds.options.OnCleanup(removed)
+	}
+}
+
+// retireIfExpired retires the key if it is stored and expired, for writes that are about to replace or remove it without
+// going through the cleanup. The caller must hold the mutex and remove or replace the key.
+func (ds *DataStore) retireIfExpired(key string, timestamp time.Time) {
+	node, present := ds.inMemoryStore[key]
+	if present && ds.isExpired(node, timestamp) {
+		ds.retire(key, node, timestamp)
+	}
+}
+
+// retire queues an expired key for the archive and records it as a ChangeExpired, the caller must hold the mutex and
+// remove or replace the key
+func (ds *DataStore) retire(key string, node dataNode, timestamp time.Time) {
+	if ds.archive != nil || ds.changes.recordsValues() {
+		node = ds.withValue(node)
+	}
+	ds.archive.queue(key, node)
+	ds.recordChange(ChangeExpired, key, node, timestamp)
+}
+
+// removeKey deletes a key from the store, index, and expiration and write tracking, the caller must hold the mutex
+func (ds *DataStore) removeKey(key string) {
+	ds.markChanged()
+	ds.deleteNode(key)
+	ds.keyIndex.Delete(key)
+	ds.expirations.remove(key)
+	ds.writes.remove(key)
+}
+
+// countLive
+/**
+* Count the keys in the data store that have not expired, the caller must hold the mutex
+ */
+func (ds *DataStore) countLive() int {
+	timestamp := ds.now()
+	live := len(ds.inMemoryStore)
+	for _, entry := range ds.expirations.entries {
+		if entry.expiration.Before(timestamp) {
+			live--
+		}
+	}
+
+	return live
+}
+
+// isLive reports whether the key is in the data store and has not expired, the caller must hold the mutex
+func (ds *DataStore) isLive(key string, timestamp time.Time) bool {
+	node, present := ds.inMemoryStore[key]
+	return present && !ds.isExpired(node, timestamp)
+}
+
+// liveKeysBy finds the keys matching the prefix that have not expired, the caller must hold the mutex for both the walk
+// of the key index and the checks of the stored values so the result is a single instant
+func (ds *DataStore) liveKeysBy(prefix string, timestamp time.Time) []string {
+	var unexpiredKeys []string
+	for _, key := range ds.keyIndex.Find(prefix) {
+		if ds.isLive(key, timestamp) {
+			unexpiredKeys = append(unexpiredKeys, key)
+		}
+	}
+
+	return unexpiredKeys
+}
+
+func (ds *DataStore) isExpired(node dataNode, timestamp time.Time) bool {
+	return node.hasExpiration && node.expiration.Before(timestamp)
+}
+
+// now returns the current time by Options.Clock, never earlier than a time it returned before, see clockGuard
+func (ds *DataStore) now() time.Time {
+	// every operation reads the clock, so this is where the sweeper learns where the data store lives
+	ds.sweeper.attach(ds)
+	return ds.clock.now()
 }
@@ -2,7 +2,13 @@ package engine
 
 import (
 	"fmt"
+	"golang.org/x/exp/slices"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -194,6 +200,301 @@ func TestDeleteAbsentValue(t *testing.T) {
 	}
 }
 
+func TestDeleteIfEquals(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("lock:job42", "holder1")
+
+	deleted, actual, present := ds.DeleteIfEquals("lock:job42", "holder2")
+	if deleted || actual != "holder1" || !present {
+		t.Fatalf("Expected a mismatch reporting %q but got deleted=%t, %q, present=%t", "holder1", deleted, actual, present)
+	}
+	value, present := ds.Read("lock:job42")
+	if !present || value != "holder1" {
+		t.Fatalf("Expected a mismatch to leave the key alone but found %q", value)
+	}
+
+	deleted, actual, _ = ds.DeleteIfEquals("lock:job42", "holder1")
+	if !deleted || actual != "holder1" {
+		t.Fatalf("Expected the key to be deleted but got deleted=%t, %q", deleted, actual)
+	}
+	if ds.Present("lock:job42") {
+		t.Fatalf("Expected key %q to be deleted but it is still present", "lock:job42")
+	}
+
+	deleted, actual, present = ds.DeleteIfEquals("lock:job42", "holder1")
+	if deleted || actual != "" || present {
+		t.Fatalf("Expected an absent key to report nothing but got deleted=%t, %q, present=%t", deleted, actual, present)
+	}
+
+	// a key holding the empty string that did not match is present
+	ds.Insert("lock:job43", "")
+	deleted, actual, present = ds.DeleteIfEquals("lock:job43", "holder1")
+	if deleted || actual != "" || !present {
+		t.Fatalf("Expected a mismatch on the empty string to report it present but got deleted=%t, %q, present=%t", deleted, actual, present)
+	}
+}
+
+func TestDeleteIfEqualsTreatsExpiredKeysAsAbsent(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	// keep the expired key resident so the check cannot rely on the cleanup having run
+	ds.cleanupSignal = make(chan uint64, 10)
+
+	ds.Insert("lock:job42", "holder1")
+	ds.Expire("lock:job42", now.Add(time.Second))
+	now = now.Add(time.Second * 2)
+
+	deleted, actual, present := ds.DeleteIfEquals("lock:job42", "holder1")
+	if deleted || actual != "" || present {
+		t.Fatalf("Expected an expired key to be absent but got deleted=%t, %q", deleted, actual)
+	}
+
+	ds.internalStoreMutex.Lock()
+	_, resident := ds.inMemoryStore["lock:job42"]
+	ds.internalStoreMutex.Unlock()
+	if !resident {
+		t.Fatalf("Expected the expired key to still be resident")
+	}
+}
+
+func TestDeleteIfEqualsNeverReleasesAnotherHoldersLock(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("lock:job%d", i)
+		ds.Insert(key, "holder1")
+
+		// holder1's lock has run out and holder2 took it over while holder1 was still about to release it
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.DeleteIfEquals(key, "holder1")
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.Expire(key, time.Now().Add(-time.Second))
+			ds.Insert(key, "holder2")
+		}()
+		close(start)
+		wg.Wait()
+
+		// whichever order they ran in, holder1's release never removes holder2's lock
+		value, present := ds.Read(key)
+		if !present || value != "holder2" {
+			t.Fatalf("Expected holder2 to hold %q but found %q, present=%t", key, value, present)
+		}
+
+		deleted, actual, _ := ds.DeleteIfEquals(key, "holder1")
+		if deleted || actual != "holder2" {
+			t.Fatalf("Expected holder1 to leave holder2's lock on %q but got deleted=%t, %q", key, deleted, actual)
+		}
+		deleted, _, _ = ds.DeleteIfEquals(key, "holder2")
+		if !deleted {
+			t.Fatalf("Expected holder2 to release its own lock on %q", key)
+		}
+	}
+}
+
+func TestReadAndDeleteHandsEachValueToOneCaller(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("queue:job%d", i)
+		ds.Insert(key, "payload")
+
+		start := make(chan bool)
+		var popped int32
+		var wg sync.WaitGroup
+		for consumer := 0; consumer < 16; consumer++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if value, present := ds.ReadAndDelete(key); present && value == "payload" {
+					atomic.AddInt32(&popped, 1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if popped != 1 {
+			t.Fatalf("Expected exactly one consumer to pop %q but %d did", key, popped)
+		}
+		if ds.Present(key) {
+			t.Fatalf("Expected %q to be deleted once popped", key)
+		}
+	}
+}
+
+func TestReadAndDeleteTreatsExpiredKeysAndHashesAsAbsent(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.Insert("expired", "1")
+	ds.Expire("expired", now.Add(time.Second))
+	ds.HSet("hash", "field", "1")
+	now = now.Add(time.Second * 2)
+
+	if value, present := ds.ReadAndDelete("expired"); present || value != "" {
+		t.Fatalf("Expected an expired key to be absent but read %q", value)
+	}
+	if _, present := ds.ReadAndDelete("hash"); present || !ds.HoldsHash("hash") {
+		t.Fatalf("Expected a key holding a hash to be reported absent and left alone")
+	}
+}
+
+func TestReadAndUpdateHandsEachCallerTheValueBeforeIt(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.Insert("sequence", "start")
+
+	const writers = 16
+	start := make(chan bool)
+	oldValues := make(chan string, writers)
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			<-start
+			if oldValue, present := ds.ReadAndUpdate("sequence", fmt.Sprintf("writer%d", writer)); present {
+				oldValues <- oldValue
+			}
+		}(writer)
+	}
+	close(start)
+	wg.Wait()
+	close(oldValues)
+
+	// every value written is replaced exactly once except the last, so the old values chain from start to the last write
+	seen := map[string]bool{}
+	for oldValue := range oldValues {
+		if seen[oldValue] {
+			t.Fatalf("Expected each value to be replaced once but %q was returned twice", oldValue)
+		}
+		seen[oldValue] = true
+	}
+	last, _ := ds.Read("sequence")
+	if len(seen) != writers || !seen["start"] || seen[last] {
+		t.Fatalf("Expected the %d old values to be start and every write but the last %q, found %v", writers, last, seen)
+	}
+}
+
+func TestReadAndUpdateKeepsExpirationAndLeavesMissingKeysAlone(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.Insert("session", "1")
+	ds.Expire("session", now.Add(time.Minute))
+	ds.Insert("expired", "1")
+	ds.Expire("expired", now.Add(time.Second))
+	ds.HSet("hash", "field", "1")
+	now = now.Add(time.Second * 2)
+
+	if oldValue, present := ds.ReadAndUpdate("session", "2"); !present || oldValue != "1" {
+		t.Fatalf("Expected to read the old value 1 but got %q, %t", oldValue, present)
+	}
+	if value, _ := ds.Read("session"); value != "2" {
+		t.Fatalf("Expected the key to hold the new value but found %q", value)
+	}
+	if expiration, _ := ds.ReadExpiration("session"); !expiration.Equal(now.Add(time.Minute - time.Second*2)) {
+		t.Fatalf("Expected the update to keep the expiration but found %v", expiration)
+	}
+	if oldValue, present := ds.ReadAndUpdate("expired", "2"); present || oldValue != "" {
+		t.Fatalf("Expected an expired key to be absent but read %q", oldValue)
+	}
+	if _, present := ds.ReadAndUpdate("missing", "2"); present || ds.Present("missing") {
+		t.Fatalf("Expected a missing key to be reported absent and not inserted")
+	}
+	if _, present := ds.ReadAndUpdate("hash", "2"); present || !ds.HoldsHash("hash") {
+		t.Fatalf("Expected a key holding a hash to be reported absent and left alone")
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	value, existed := ds.GetOrSet("config:theme", "dark")
+	if existed || value != "dark" {
+		t.Fatalf("Expected the default to be inserted but got %q, existed=%t", value, existed)
+	}
+	assertExpiration(t, &ds, "config:theme", time.Time{})
+
+	value, existed = ds.GetOrSet("config:theme", "light")
+	if !existed || value != "dark" {
+		t.Fatalf("Expected the stored value to be returned but got %q, existed=%t", value, existed)
+	}
+	if stored, _ := ds.Read("config:theme"); stored != "dark" {
+		t.Fatalf("Expected the stored value to be left alone but found %q", stored)
+	}
+}
+
+func TestGetOrSetWithTTLOnlyExpiresWhatItInserts(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	ds.GetOrSetWithTTL("session:1", "alice", time.Minute)
+	assertExpiration(t, &ds, "session:1", now.Add(time.Minute))
+
+	ds.Insert("session:2", "bob")
+	value, existed := ds.GetOrSetWithTTL("session:2", "carol", time.Minute)
+	if !existed || value != "bob" {
+		t.Fatalf("Expected the existing value to be returned but got %q, existed=%t", value, existed)
+	}
+	assertExpiration(t, &ds, "session:2", time.Time{})
+
+	// an expired key that is still resident is absent, and its expiration does not carry over to the new value
+	now = now.Add(time.Minute * 2)
+	value, existed = ds.GetOrSet("session:1", "dave")
+	if existed || value != "dave" {
+		t.Fatalf("Expected the expired key to be replaced but got %q, existed=%t", value, existed)
+	}
+	assertExpiration(t, &ds, "session:1", time.Time{})
+}
+
+func TestGetOrSetInsertsOnceUnderContention(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	start := make(chan bool)
+	values := make([]string, 100)
+	inserted := make([]bool, 100)
+	var wg sync.WaitGroup
+	for i := range values {
+		wg.Add(1)
+		go func(caller int) {
+			defer wg.Done()
+			<-start
+			value, existed := ds.GetOrSet("counter", fmt.Sprintf("caller%d", caller))
+			values[caller] = value
+			inserted[caller] = !existed
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	insertions := 0
+	for i, value := range values {
+		if inserted[i] {
+			insertions++
+		}
+		if value != values[0] {
+			t.Fatalf("Expected every caller to receive %q but caller %d received %q", values[0], i, value)
+		}
+	}
+	if insertions != 1 {
+		t.Fatalf("Expected exactly one caller to insert the default but found %d", insertions)
+	}
+}
+
 func TestInsertAndPresent(t *testing.T) {
 	ds := NewDataStore()
 
@@ -216,6 +517,208 @@ func TestInsertAndPresent(t *testing.T) {
 	}
 }
 
+func TestPresentMulti(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("key1", "abc123")
+	ds.Insert("key2", "abc123")
+	ds.Insert("expired", "abc123")
+	ds.Expire("expired", now.Add(-time.Second))
+
+	present := ds.PresentMulti([]string{"key1", "missing", "expired", "key2", "key1"})
+	expected := []bool{true, false, false, true, true}
+	if len(present) != len(expected) {
+		t.Fatalf("Expected %d results but found %d", len(expected), len(present))
+	}
+	for i := range expected {
+		if present[i] != expected[i] {
+			t.Fatalf("Expected presence %v but found %v", expected, present)
+		}
+	}
+
+	if len(ds.PresentMulti(nil)) != 0 {
+		t.Fatalf("Expected no results for an empty batch")
+	}
+}
+
+func TestReadStale(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true, StaleWindow: time.Minute})
+
+	ds.Insert("key", "abc123")
+	ds.Expire("key", now.Add(time.Second*10))
+
+	value, stale, present := ds.ReadStale("key", time.Minute)
+	if value != "abc123" || stale || !present {
+		t.Fatalf("Expected to read the fresh value but found %q stale %t present %t", value, stale, present)
+	}
+
+	now = now.Add(time.Second * 30)
+	_, present = ds.Read("key")
+	if present {
+		t.Fatalf("Expected read to miss the expired key")
+	}
+
+	value, stale, present = ds.ReadStale("key", time.Minute)
+	if value != "abc123" || !stale || !present {
+		t.Fatalf("Expected to read the stale value within the window but found %q stale %t present %t", value, stale, present)
+	}
+
+	value, stale, present = ds.ReadStale("key", time.Second*10)
+	if value != "" || stale || present {
+		t.Fatalf("Expected a key expired for longer than the window to be absent but found %q stale %t present %t", value, stale, present)
+	}
+
+	ds.CleanupNow()
+	value, stale, present = ds.ReadStale("key", time.Minute)
+	if value != "abc123" || !stale || !present {
+		t.Fatalf("Expected the cleanup to keep a key inside its stale window but found %q stale %t present %t", value, stale, present)
+	}
+
+	now = now.Add(time.Minute)
+	ds.CleanupNow()
+	_, _, present = ds.ReadStale("key", time.Hour)
+	if present {
+		t.Fatalf("Expected the cleanup to remove the key once its stale window passed")
+	}
+}
+
+func TestReadWithStatus(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("key", "abc123")
+	ds.Expire("key", now.Add(time.Second*10))
+	if value, status := ds.ReadWithStatus("key"); value != "abc123" || status != KeyLive {
+		t.Fatalf("Expected to read the live value but found %q with status %d", value, status)
+	}
+	if value, status := ds.ReadWithStatus("never"); value != "" || status != KeyMissing {
+		t.Fatalf("Expected a key never written to be missing but found %q with status %d", value, status)
+	}
+
+	now = now.Add(time.Second * 30)
+	if value, status := ds.ReadWithStatus("key"); value != "" || status != KeyExpired {
+		t.Fatalf("Expected the resident key to be reported expired but found %q with status %d", value, status)
+	}
+
+	ds.CleanupNow()
+	if _, status := ds.ReadWithStatus("key"); status != KeyMissing {
+		t.Fatalf("Expected the key to be missing once cleaned up but found status %d", status)
+	}
+}
+
+func TestReadWithStatusReportsExpiredKeysInsideTheStaleWindow(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true, StaleWindow: time.Minute})
+
+	ds.Insert("key", "abc123")
+	ds.Expire("key", now.Add(time.Second*10))
+	now = now.Add(time.Second * 30)
+	ds.CleanupNow()
+	if _, status := ds.ReadWithStatus("key"); status != KeyExpired {
+		t.Fatalf("Expected the cleanup to keep reporting the key expired inside the stale window but found status %d", status)
+	}
+
+	now = now.Add(time.Minute)
+	ds.CleanupNow()
+	if _, status := ds.ReadWithStatus("key"); status != KeyMissing {
+		t.Fatalf("Expected the key to be missing once its stale window passed but found status %d", status)
+	}
+}
+
+func TestCleanupRemovesExpiredKeysWithoutAStaleWindow(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("key", "abc123")
+	ds.Expire("key", now.Add(-time.Second))
+
+	value, stale, present := ds.ReadStale("key", time.Minute)
+	if value != "abc123" || !stale || !present {
+		t.Fatalf("Expected to read the stale value before the cleanup ran but found %q stale %t present %t", value, stale, present)
+	}
+
+	ds.CleanupNow()
+	_, _, present = ds.ReadStale("key", time.Minute)
+	if present {
+		t.Fatalf("Expected the cleanup to remove the expired key")
+	}
+}
+
+func TestOnCleanupReportsWhatEachCleanupRemoved(t *testing.T) {
+	now := time.Now()
+	var reported []int
+	ds := NewDataStoreWithOptions(Options{
+		Clock:           func() time.Time { return now },
+		CheckInvariants: true,
+		OnCleanup:       func(removed int) { reported = append(reported, removed) },
+	})
+	ds.cleanupSignal = make(chan uint64, 10)
+
+	ds.Insert("a", "1")
+	ds.Insert("b", "1")
+	ds.Expire("a", now.Add(time.Second))
+	ds.Expire("b", now.Add(time.Second))
+	now = now.Add(time.Second * 2)
+
+	ds.CleanupNow()
+	ds.CleanupNow()
+	if len(reported) != 2 || reported[0] != 2 || reported[1] != 0 {
+		t.Fatalf("Expected the cleanups to report removing 2 keys then none but found %v", reported)
+	}
+	if stats := ds.Stats(); stats.ExpiredRemoved != 2 {
+		t.Fatalf("Expected Stats to count the 2 keys the cleanup removed but found %d", stats.ExpiredRemoved)
+	}
+}
+
+func TestCleanupScheduledBeforeTruncateIsDiscarded(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.cleanupSignal = make(chan uint64, 10)
+
+	ds.Insert("key", "abc123")
+	ds.Expire("key", now.Add(time.Second))
+	staleCleanup := <-ds.cleanupSignal
+
+	ds.Truncate()
+	ds.Insert("key", "def456")
+	ds.Expire("key", now.Add(time.Hour))
+	ds.Insert("expired", "def456")
+	ds.Expire("expired", now.Add(time.Second))
+	freshCleanup := <-ds.cleanupSignal
+	<-ds.cleanupSignal
+
+	// the expiration set before the truncate has passed, but the new key's has not
+	now = now.Add(time.Second * 2)
+
+	if ds.cleanupExpirations(staleCleanup) {
+		t.Fatalf("Expected the cleanup scheduled before the truncate to be discarded")
+	}
+	if !ds.cleanupExpirations(freshCleanup) {
+		t.Fatalf("Expected the cleanup scheduled after the truncate to run")
+	}
+
+	value, present := ds.Read("key")
+	expiration, _ := ds.ReadExpiration("key")
+	if value != "def456" || !present || !expiration.Equal(now.Add(time.Hour-time.Second*2)) {
+		t.Fatalf("Expected the key inserted after the truncate to keep its value and fresh expiration but found %q %t %q", value, present, expiration)
+	}
+
+	ds.internalStoreMutex.Lock()
+	_, resident := ds.inMemoryStore["expired"]
+	ds.internalStoreMutex.Unlock()
+	if resident {
+		t.Fatalf("Expected the cleanup scheduled after the truncate to remove keys that expired since")
+	}
+
+	ds.CleanupNow()
+	_, present = ds.Read("key")
+	if !present {
+		t.Fatalf("Expected CleanupNow to leave the unexpired key alone")
+	}
+}
+
 func TestCount(t *testing.T) {
 	ds := NewDataStore()
 
@@ -255,6 +758,34 @@ func TestCount(t *testing.T) {
 	}
 }
 
+func TestCountLeavesOutExpiredKeysBeforeTheCleanup(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	// keep the expired keys resident so the count cannot rely on the cleanup having run
+	ds.cleanupSignal = make(chan uint64, 1000)
+
+	for i := 0; i < 150; i++ {
+		key := fmt.Sprintf("key%d", i)
+		ds.Insert(key, "abc123")
+		if i < 100 {
+			ds.Expire(key, now.Add(time.Second))
+		}
+	}
+	now = now.Add(time.Second * 2)
+
+	if count := ds.Count(); count != 50 {
+		t.Fatalf("Expected only the 50 unexpired keys to be counted but counted %d", count)
+	}
+	if count := ds.ApproximateCount(); count != 150 {
+		t.Fatalf("Expected the approximation to count the expired keys still resident but counted %d", count)
+	}
+
+	ds.CleanupNow()
+	if count, approximate := ds.Count(), ds.ApproximateCount(); count != 50 || approximate != 50 {
+		t.Fatalf("Expected both counts to agree once the cleanup ran but found %d and %d", count, approximate)
+	}
+}
+
 func TestReadExpiredValue(t *testing.T) {
 	ds := NewDataStore()
 
@@ -317,6 +848,30 @@ func TestInsertExpiredKeyRemovesExpiration(t *testing.T) {
 	}
 }
 
+func TestUpsertIdenticalValueIsANoOp(t *testing.T) {
+	ds := NewDataStore()
+
+	key := "testkey"
+	expiration := time.Now().Add(time.Hour)
+	ds.Upsert(key, "abc123")
+	ds.Expire(key, expiration)
+
+	if ds.Upsert(key, "abc123") {
+		t.Fatalf("expected upserting an identical value to report no change")
+	}
+
+	readExpiration, present := ds.ReadExpiration(key)
+	if !present || !readExpiration.Equal(expiration) {
+		t.Fatalf("expected identical upsert to keep expiration %q but found %q", expiration, readExpiration)
+	}
+
+	rewriting := NewDataStoreWithOptions(Options{AlwaysRewriteUpserts: true})
+	rewriting.Upsert(key, "abc123")
+	if !rewriting.Upsert(key, "abc123") {
+		t.Fatalf("expected upserting an identical value to be written when the comparison is disabled")
+	}
+}
+
 func TestUpsertExpiredKeyRemovesExpiration(t *testing.T) {
 	ds := NewDataStore()
 
@@ -387,7 +942,7 @@ func TestInsertTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 
-	count := ds.Count()
+	count := ds.ApproximateCount()
 	if count != 3 {
 		t.Fatalf("expected count to be 3 because there was no write to cleanup but was %d", count)
 	}
@@ -396,7 +951,7 @@ func TestInsertTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 10)
 
-	count = ds.Count()
+	count = ds.ApproximateCount()
 	if count != 1 {
 		t.Fatalf("expected count to be 1 because write cause cleanup but was %d", count)
 	}
@@ -420,7 +975,7 @@ func TestUpdateTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 
-	count := ds.Count()
+	count := ds.ApproximateCount()
 	if count != 3 {
 		t.Fatalf("expected count to be 3 because there was no write to cleanup but was %d", count)
 	}
@@ -429,7 +984,7 @@ func TestUpdateTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 10)
 
-	count = ds.Count()
+	count = ds.ApproximateCount()
 	if count != 1 {
 		t.Fatalf("expected count to be 1 because write cause cleanup but was %d", count)
 	}
@@ -455,7 +1010,7 @@ func TestUpsertTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 
-	count := ds.Count()
+	count := ds.ApproximateCount()
 	if count != 3 {
 		t.Fatalf("expected count to be 3 because there was no write to cleanup but was %d", count)
 	}
@@ -464,7 +1019,7 @@ func TestUpsertTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 10)
 
-	count = ds.Count()
+	count = ds.ApproximateCount()
 	if count != 1 {
 		t.Fatalf("expected count to be 1 because write cause cleanup but was %d", count)
 	}
@@ -491,7 +1046,7 @@ func TestDeleteTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 
-	count := ds.Count()
+	count := ds.ApproximateCount()
 	if count != 4 {
 		t.Fatalf("expected count to be 4 because there was no write to cleanup but was %d", count)
 	}
@@ -500,7 +1055,7 @@ func TestDeleteTriggersAsyncExpirationCleanup(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 10)
 
-	count = ds.Count()
+	count = ds.ApproximateCount()
 	if count != 0 {
 		t.Fatalf("expected count to be 0 because write cause cleanup but was %d", count)
 	}
@@ -508,6 +1063,10 @@ func TestDeleteTriggersAsyncExpirationCleanup(t *testing.T) {
 
 func TestThreadSafetyOfWriteOperationsWithAsyncCleanup(t *testing.T) {
 	ds := NewDataStore()
+	runWriteOperationsWithAsyncCleanup(t, &ds)
+}
+
+func runWriteOperationsWithAsyncCleanup(t *testing.T, ds *DataStore) {
 
 	// Without mutexes on updates to the internal data store this test will crash
 	for i := 0; i < 1000; i++ {
@@ -560,10 +1119,93 @@ func TestTruncate(t *testing.T) {
 		t.Fatalf("Expected 100 items but found %d", count)
 	}
 
-	ds.Truncate()
+	removed := ds.Truncate()
 	count = ds.Count()
-	if count != 0 {
-		t.Fatalf("Expected 0 items but found %d", count)
+	if count != 0 || removed != 100 {
+		t.Fatalf("Expected 0 items after removing 100 but found %d after removing %d", count, removed)
+	}
+}
+
+func TestTruncateResetsKeyIndex(t *testing.T) {
+	ds := NewDataStore()
+	baselineNodes := ds.keyIndex.countNodes()
+
+	for i := 0; i < 1000; i++ {
+		ds.Insert(fmt.Sprintf("region:%d:store:%d", i%10, i), "abc123")
+	}
+	ds.Expire("region:0:store:0", time.Now().Add(-time.Second))
+	ds.Expire("region:1:store:1", time.Now().Add(time.Hour))
+
+	removed := ds.Truncate()
+	if removed != 999 {
+		t.Fatalf("Expected 999 unexpired keys to be removed but was %d", removed)
+	}
+
+	if ds.KeysBy("") != nil {
+		t.Fatalf("Expected no keys after truncate but found %q", ds.KeysBy(""))
+	}
+
+	// check the index directly, KeysBy would hide stale index entries behind its presence check
+	if ds.keyIndex.countNodes() != baselineNodes || ds.expirations.Len() != 0 {
+		t.Fatalf("Expected the index to be back to %d nodes with no expirations but found %d nodes and %d expirations", baselineNodes, ds.keyIndex.countNodes(), ds.expirations.Len())
+	}
+}
+
+func TestTruncateAndDeleteAllLeaveIdenticalState(t *testing.T) {
+	truncated := NewDataStore()
+	deleted := NewDataStore()
+
+	for _, ds := range []*DataStore{&truncated, &deleted} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("region:%d:store:%d", i%10, i)
+			ds.Insert(key, "abc123")
+			if i%3 == 0 {
+				ds.Expire(key, time.Now().Add(-time.Second))
+			}
+		}
+	}
+
+	truncatedCount := truncated.Truncate()
+	deletedCount := deleted.DeleteBy("")
+	if truncatedCount != deletedCount {
+		t.Fatalf("Expected truncate and delete by to report the same count but was %d and %d", truncatedCount, deletedCount)
+	}
+
+	if len(truncated.inMemoryStore) != 0 || len(deleted.inMemoryStore) != 0 {
+		t.Fatalf("Expected both stores to be empty but found %d and %d values", len(truncated.inMemoryStore), len(deleted.inMemoryStore))
+	}
+
+	if !reflect.DeepEqual(truncated.keyIndex, deleted.keyIndex) || !reflect.DeepEqual(truncated.expirations, deleted.expirations) {
+		t.Fatalf("Expected truncate and delete by to leave identical indexes")
+	}
+}
+
+func TestKeysInsertedAgainAfterTruncateHaveNoExpiration(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("session:1", "abc123")
+	ds.Expire("session:1", now.Add(time.Second))
+	ds.Insert("session:2", "abc123")
+	ds.Expire("session:2", now.Add(time.Hour))
+	// session:1 has expired but is still stored, the cleanup has not run
+	now = now.Add(time.Second * 2)
+
+	ds.Truncate()
+	for _, key := range []string{"session:1", "session:2"} {
+		if !ds.Insert(key, "def456") {
+			t.Fatalf("Expected %q to be inserted again after the truncate", key)
+		}
+		if expiration, present := ds.ReadExpiration(key); present {
+			t.Fatalf("Expected %q to have no expiration after the truncate but found %s", key, expiration)
+		}
+	}
+
+	// an expiration left behind would remove the keys once it passed
+	now = now.Add(time.Hour * 2)
+	ds.CleanupNow()
+	if ds.Count() != 2 {
+		t.Fatalf("Expected both keys to outlive their old expirations but found %d", ds.Count())
 	}
 }
 
@@ -615,6 +1257,313 @@ func TestFindingKeysByPrefix(t *testing.T) {
 	}
 }
 
+func TestExpireWithMode(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(time.Minute)
+	later := now.Add(time.Hour)
+
+	type state int
+	const (
+		noExpiration state = iota
+		expiresEarlier
+		expiresLater
+		alreadyExpired
+		missing
+	)
+
+	type expireCase struct {
+		mode     ExpireMode
+		state    state
+		target   time.Time
+		changed  bool
+		expected error
+	}
+
+	cases := []expireCase{
+		{ExpireAlways, noExpiration, later, true, nil},
+		{ExpireAlways, expiresLater, earlier, true, nil},
+		{ExpireIfNone, noExpiration, later, true, nil},
+		{ExpireIfNone, expiresEarlier, later, false, nil},
+		{ExpireIfSet, noExpiration, later, false, nil},
+		{ExpireIfSet, expiresEarlier, later, true, nil},
+		{ExpireIfLonger, noExpiration, later, false, nil},
+		{ExpireIfLonger, expiresEarlier, later, true, nil},
+		{ExpireIfLonger, expiresLater, earlier, false, nil},
+		{ExpireIfLonger, expiresLater, later, false, nil},
+		{ExpireIfShorter, noExpiration, earlier, true, nil},
+		{ExpireIfShorter, expiresLater, earlier, true, nil},
+		{ExpireIfShorter, expiresEarlier, later, false, nil},
+		{ExpireIfShorter, expiresEarlier, earlier, false, nil},
+	}
+	for _, mode := range []ExpireMode{ExpireAlways, ExpireIfNone, ExpireIfSet, ExpireIfLonger, ExpireIfShorter} {
+		cases = append(cases, expireCase{mode, alreadyExpired, later, false, ErrKeyNotFound})
+		cases = append(cases, expireCase{mode, missing, later, false, ErrKeyNotFound})
+	}
+
+	for i, testCase := range cases {
+		ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }})
+		if testCase.state != missing {
+			ds.Insert("session:1", "abc123")
+		}
+
+		var initial time.Time
+		switch testCase.state {
+		case expiresEarlier:
+			initial = earlier
+		case expiresLater:
+			initial = later
+		case alreadyExpired:
+			initial = now.Add(-time.Second)
+		}
+		if !initial.IsZero() {
+			ds.Expire("session:1", initial)
+		}
+
+		changed, err := ds.ExpireWithMode("session:1", testCase.target, testCase.mode)
+		if changed != testCase.changed || err != testCase.expected {
+			t.Fatalf("case %d: expected mode %d on state %d to return %t, %q but got %t, %q", i, testCase.mode, testCase.state, testCase.changed, testCase.expected, changed, err)
+		}
+
+		expiration, hasExpiration := ds.ReadExpiration("session:1")
+		expected := initial
+		if changed {
+			expected = testCase.target
+		}
+		if testCase.state != alreadyExpired && testCase.state != missing && (!expiration.Equal(expected) || hasExpiration != !expected.IsZero()) {
+			t.Fatalf("case %d: expected expiration %q but found %q", i, expected, expiration)
+		}
+	}
+}
+
+func TestConcurrentExtendOnlyExpiresKeepTheLatest(t *testing.T) {
+	ds := NewDataStore()
+	runConcurrentExtendOnlyExpires(t, &ds)
+}
+
+func runConcurrentExtendOnlyExpires(t *testing.T, ds *DataStore) {
+	ds.Insert("session:1", "abc123")
+
+	base := time.Now().Add(time.Hour)
+	ds.Expire("session:1", base)
+
+	var writers sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		writers.Add(1)
+		go func(writer int) {
+			defer writers.Done()
+			for i := 0; i < 1000; i++ {
+				ds.ExpireWithMode("session:1", base.Add(time.Duration(rand.Intn(10000))*time.Millisecond), ExpireIfLonger)
+			}
+			if writer == 0 {
+				ds.ExpireWithMode("session:1", base.Add(time.Minute), ExpireIfLonger)
+			}
+		}(writer)
+	}
+	writers.Wait()
+
+	expiration, _ := ds.ReadExpiration("session:1")
+	if !expiration.Equal(base.Add(time.Minute)) {
+		t.Fatalf("expected racing extend only writers to leave the latest expiration %q but found %q", base.Add(time.Minute), expiration)
+	}
+}
+
+func TestRename(t *testing.T) {
+	cases := []struct {
+		name          string
+		newKeyPresent bool
+		overwrite     bool
+		expected      error
+	}{
+		{"new key absent", false, false, nil},
+		{"new key absent with overwrite", false, true, nil},
+		{"new key present", true, false, ErrKeyExists},
+		{"new key present with overwrite", true, true, nil},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ds := NewDataStore()
+			ds.Insert("upload:tmp:123", "abc123")
+			if testCase.newKeyPresent {
+				ds.Insert("upload:final:123", "def456")
+			}
+
+			err := ds.Rename("upload:tmp:123", "upload:final:123", testCase.overwrite)
+			if err != testCase.expected {
+				t.Fatalf("expected rename to return %q but got %q", testCase.expected, err)
+			}
+
+			expectedValue := "abc123"
+			if err != nil {
+				expectedValue = "def456"
+			}
+			value, present := ds.Read("upload:final:123")
+			if !present || value != expectedValue {
+				t.Fatalf("expected upload:final:123 to hold %q but found %q", expectedValue, value)
+			}
+
+			_, oldPresent := ds.Read("upload:tmp:123")
+			if oldPresent != (err != nil) {
+				t.Fatalf("expected upload:tmp:123 to be present only when the rename failed")
+			}
+		})
+	}
+}
+
+func TestRenameMissingOrExpiredKey(t *testing.T) {
+	ds := NewDataStore()
+
+	err := ds.Rename("upload:tmp:1", "upload:final:1", true)
+	if err != ErrKeyNotFound {
+		t.Fatalf("expected renaming a missing key to return %q but got %q", ErrKeyNotFound, err)
+	}
+
+	ds.Insert("upload:tmp:2", "abc123")
+	ds.Expire("upload:tmp:2", time.Now().Add(-time.Second))
+	err = ds.Rename("upload:tmp:2", "upload:final:2", true)
+	if err != ErrKeyNotFound {
+		t.Fatalf("expected renaming an expired key to return %q but got %q", ErrKeyNotFound, err)
+	}
+
+	// an expired key is not in the way of a rename
+	ds.Insert("upload:tmp:3", "abc123")
+	err = ds.Rename("upload:tmp:3", "upload:tmp:2", false)
+	if err != nil {
+		t.Fatalf("expected renaming over an expired key to succeed but got %q", err)
+	}
+	_, hasExpiration := ds.ReadExpiration("upload:tmp:2")
+	if hasExpiration {
+		t.Fatalf("expected the renamed key to not inherit the expiration of the key it replaced")
+	}
+}
+
+func TestRenameCarriesExpirationAndUpdatesIndex(t *testing.T) {
+	ds := NewDataStore()
+
+	expiration := time.Now().Add(time.Hour)
+	ds.Insert("upload:tmp:123", "abc123")
+	ds.Expire("upload:tmp:123", expiration)
+
+	err := ds.Rename("upload:tmp:123", "upload:final:123", false)
+	if err != nil {
+		t.Fatalf("expected rename to succeed but got %q", err)
+	}
+
+	readExpiration, present := ds.ReadExpiration("upload:final:123")
+	if !present || !readExpiration.Equal(expiration) {
+		t.Fatalf("expected expiration %q to travel with the key but found %q", expiration, readExpiration)
+	}
+	if ds.expirations.byKey["upload:tmp:123"] != nil || ds.expirations.Len() != 1 {
+		t.Fatalf("expected only the new key to be tracked for expiration")
+	}
+
+	tmpKeys := ds.KeysBy("upload:tmp")
+	finalKeys := ds.KeysBy("upload:final")
+	if tmpKeys != nil || !slices.Equal(finalKeys, []string{"upload:final:123"}) {
+		t.Fatalf("expected the index to hold only the new key but found %q and %q", tmpKeys, finalKeys)
+	}
+	// the index should look the same as if the new key had been inserted and the old one deleted
+	reference := NewDataStore()
+	reference.Insert("upload:tmp:123", "abc123")
+	reference.Insert("upload:final:123", "abc123")
+	reference.Delete("upload:tmp:123")
+	if ds.keyIndex.countNodes() != reference.keyIndex.countNodes() {
+		t.Fatalf("expected %d index nodes after rename but found %d", reference.keyIndex.countNodes(), ds.keyIndex.countNodes())
+	}
+}
+
+func TestRenameIsNeverObservedHalfDone(t *testing.T) {
+	ds := NewDataStore()
+	ds.Insert("a", "abc123")
+
+	done := make(chan bool)
+	failures := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(failures)
+				return
+			default:
+			}
+
+			ds.internalStoreMutex.Lock()
+			_, aPresent := ds.inMemoryStore["a"]
+			_, bPresent := ds.inMemoryStore["b"]
+			ds.internalStoreMutex.Unlock()
+
+			if aPresent == bPresent {
+				failures <- fmt.Sprintf("found a present %t and b present %t", aPresent, bPresent)
+				close(failures)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20000; i++ {
+		if i%2 == 0 {
+			ds.Rename("a", "b", false)
+		} else {
+			ds.Rename("b", "a", false)
+		}
+	}
+	close(done)
+
+	for failure := range failures {
+		t.Fatalf("expected the value under exactly one key but %s", failure)
+	}
+}
+
+func TestCompletingKeyPrefixes(t *testing.T) {
+	ds := NewDataStore()
+
+	data := "abc123"
+
+	ds.Insert("region:1:store:1:employee:1", data)
+	ds.Insert("region:1:store:1:employee:2", data)
+	ds.Insert("region:1:manager", data)
+	ds.Insert("region:1:store:2:employee:4", data)
+	ds.Insert("region:1:stock:3", data)
+	ds.Insert("region:2:store:4:employee:7", data)
+	ds.Insert("category:3:product:7", data)
+
+	midSegment := ds.CompleteKeyPrefix("region:1:st", 0)
+	if !slices.Equal(midSegment, []string{"region:1:stock", "region:1:store"}) {
+		t.Fatalf("expected mid segment completions [region:1:stock region:1:store] but found %q", midSegment)
+	}
+
+	segmentBoundary := ds.CompleteKeyPrefix("region:1:", 0)
+	if !slices.Equal(segmentBoundary, []string{"region:1:manager", "region:1:stock", "region:1:store"}) {
+		t.Fatalf("expected every child of region:1 but found %q", segmentBoundary)
+	}
+
+	topLevel := ds.CompleteKeyPrefix("reg", 0)
+	if !slices.Equal(topLevel, []string{"region"}) {
+		t.Fatalf("expected top level completion [region] but found %q", topLevel)
+	}
+
+	noMatches := ds.CompleteKeyPrefix("region:1:x", 0)
+	if noMatches != nil {
+		t.Fatalf("expected no completions but found %q", noMatches)
+	}
+
+	missingParent := ds.CompleteKeyPrefix("region:9:st", 0)
+	if missingParent != nil {
+		t.Fatalf("expected no completions under a missing segment but found %q", missingParent)
+	}
+
+	limited := ds.CompleteKeyPrefix("region:1:", 2)
+	if !slices.Equal(limited, []string{"region:1:manager", "region:1:stock"}) {
+		t.Fatalf("expected the first 2 completions but found %q", limited)
+	}
+
+	ds.Expire("region:1:stock:3", time.Now().Add(-time.Second))
+	withoutExpired := ds.CompleteKeyPrefix("region:1:st", 0)
+	if !slices.Equal(withoutExpired, []string{"region:1:store"}) {
+		t.Fatalf("expected completions with only expired keys to be left out but found %q", withoutExpired)
+	}
+}
+
 func TestPrefixSearchUpdatedOnDelete(t *testing.T) {
 	ds := NewDataStore()
 
@@ -710,6 +1659,176 @@ func TestDeleteKeysByPrefix(t *testing.T) {
 	}
 }
 
+func TestReadByReturnsTheValuesOfLiveKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	// keep the expired key resident so the check cannot rely on the cleanup having run
+	ds.cleanupSignal = make(chan uint64, 10)
+
+	ds.Insert("user:1:name", "ada")
+	ds.Insert("user:2:name", "")
+	ds.Insert("user:3:name", "grace")
+	ds.Expire("user:3:name", now.Add(time.Second))
+	ds.HSet("user:4", "name", "alan")
+	ds.Insert("other", "1")
+	now = now.Add(time.Second * 2)
+
+	values := ds.ReadBy("user")
+	expected := map[string]string{"user:1:name": "ada", "user:2:name": ""}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %v but read %v", expected, values)
+	}
+
+	if values := ds.ReadBy(""); len(values) != 3 || values["other"] != "1" {
+		t.Fatalf("Expected an empty prefix to read every live string key but read %v", values)
+	}
+	if values := ds.ReadBy("missing"); values == nil || len(values) != 0 {
+		t.Fatalf("Expected an empty map for a prefix matching nothing but read %v", values)
+	}
+}
+
+func TestUpdateByKeepsExpirations(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	expiration := now.Add(time.Hour)
+	ds.Insert("flag:a", "off")
+	ds.Insert("flag:b", "off")
+	ds.Expire("flag:b", expiration)
+	ds.Insert("flag:expired", "off")
+	ds.Expire("flag:expired", now.Add(time.Second))
+	ds.HSet("flag:hash", "field", "off")
+	ds.Insert("other", "off")
+	now = now.Add(time.Second * 2)
+
+	if updated := ds.UpdateBy("flag", "on"); updated != 2 {
+		t.Fatalf("Expected the two live string keys to be updated but %d were", updated)
+	}
+	if values := ds.ReadBy(""); !reflect.DeepEqual(values, map[string]string{"flag:a": "on", "flag:b": "on", "other": "off"}) {
+		t.Fatalf("Expected only the keys under the prefix to change but read %v", values)
+	}
+	if readExpiration, present := ds.ReadExpiration("flag:b"); !present || !readExpiration.Equal(expiration) {
+		t.Fatalf("Expected the updated key to keep its expiration but found %s", readExpiration)
+	}
+	if _, present := ds.ReadExpiration("flag:a"); present {
+		t.Fatalf("Expected a key without an expiration not to be given one")
+	}
+}
+
+func TestUpdateByRacingDeleteByIsAllOrNothing(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	for round := 0; round < 50; round++ {
+		for i := 0; i < 100; i++ {
+			ds.Insert(fmt.Sprintf("region:%d", i), "old")
+		}
+
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var updated int
+		go func() {
+			defer wg.Done()
+			<-start
+			updated = ds.UpdateBy("region", "new")
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.DeleteBy("region")
+		}()
+		close(start)
+		wg.Wait()
+
+		if updated != 0 && updated != 100 {
+			t.Fatalf("Expected the update to run entirely before or after the delete but it updated %d keys", updated)
+		}
+		if count := ds.Count(); count != 0 {
+			t.Fatalf("Expected the delete to remove every key but %d remain", count)
+		}
+	}
+}
+
+func TestCountByLeavesOutExpiredKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	// keep the expired key resident so the check cannot rely on the cleanup having run
+	ds.cleanupSignal = make(chan uint64, 10)
+
+	ds.Insert("region:1", "1")
+	ds.Insert("region:1:store:1", "1")
+	ds.Insert("region:2", "1")
+	ds.Expire("region:2", now.Add(time.Second))
+	ds.Insert("other", "1")
+	now = now.Add(time.Second * 2)
+
+	if count := ds.CountBy("region"); count != 2 {
+		t.Fatalf("Expected the two live keys under the prefix but counted %d", count)
+	}
+	if approx := ds.CountByApprox("region"); approx != 3 {
+		t.Fatalf("Expected the approximation to still count the expired key but counted %d", approx)
+	}
+	if count := ds.CountBy(""); count != 3 {
+		t.Fatalf("Expected an empty prefix to count every live key but counted %d", count)
+	}
+	if count := ds.CountBy("reg"); count != 0 {
+		t.Fatalf("Expected an incomplete prefix to match nothing but counted %d", count)
+	}
+}
+
+func TestKeysByRacingDeleteByReturnsASingleInstant(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.cleanupSignal = make(chan uint64, 100000)
+
+	const groupSize = 20
+	stop := make(chan bool)
+	var writers sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		writers.Add(1)
+		go func(group string) {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// keys are inserted one at a time in order and deleted together, so at any instant the group holds
+				// its first n keys
+				for i := 0; i < groupSize; i++ {
+					ds.Insert(fmt.Sprintf("%s:%02d", group, i), "value")
+				}
+				ds.DeleteBy(group)
+			}
+		}(fmt.Sprintf("group:%d", writer))
+	}
+
+	// keep calling until enough calls raced the writers, calls that found nothing prove nothing
+	for racing := 0; racing < 2000; {
+		keys := ds.KeysBy("group")
+		if len(keys) > 0 {
+			racing++
+		}
+		slices.Sort(keys)
+
+		found := map[string]int{}
+		for _, key := range keys {
+			var writer, i int
+			fmt.Sscanf(key, "group:%d:%d", &writer, &i)
+			group := fmt.Sprintf("group:%d", writer)
+			if i != found[group] {
+				t.Fatalf("Expected the keys of %q present at one instant to be its first keys in order but found %q", group, ds.KeysBy(group))
+			}
+			found[group]++
+		}
+	}
+
+	close(stop)
+	writers.Wait()
+}
+
 func TestExpireKeysByPrefix(t *testing.T) {
 	ds := NewDataStore()
 
@@ -794,3 +1913,448 @@ func TestUpdateAndUpsertDoNotRemoveExpirations(t *testing.T) {
 		t.Fatalf("Expected expiration to be set to %q but was not: %q", expiration, readExpiration)
 	}
 }
+
+func TestExpirationSurvivesInterleavedUpdatesAndUpserts(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	expiration := now.Add(time.Minute * 30)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		ds.Insert(key, "abc123")
+		ds.Expire(key, expiration)
+	}
+	ds.Insert("persistent", "abc123")
+
+	var waitGroup sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		waitGroup.Add(1)
+		go func(writer int) {
+			defer waitGroup.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key%d", i%10)
+				value := fmt.Sprintf("%d-%d", writer, i)
+				if i%2 == 0 {
+					ds.Update(key, value)
+				} else {
+					ds.Upsert(key, value)
+				}
+				ds.Upsert("persistent", value)
+			}
+		}(writer)
+	}
+	waitGroup.Wait()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		readExpiration, present := ds.ReadExpiration(key)
+		if !present || !readExpiration.Equal(expiration) {
+			t.Fatalf("Expected %s to keep its expiration %s through every write but found %s", key, expiration, readExpiration)
+		}
+	}
+	if _, present := ds.ReadExpiration("persistent"); present {
+		t.Fatalf("Expected a key without an expiration not to be given one by its writes")
+	}
+}
+
+func TestExpirationHistogram(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }})
+
+	ttls := map[string]time.Duration{
+		"expired":       -time.Second,
+		"thirtySeconds": time.Second * 30,
+		"oneMinute":     time.Minute, // exactly on a boundary lands in the lower bucket
+		"justOverOne":   time.Minute + time.Millisecond,
+		"tenMinutes":    time.Minute * 10,
+		"oneHour":       time.Hour,
+		"twoDays":       time.Hour * 48,
+	}
+	for key, ttl := range ttls {
+		ds.Insert(key, "abc123")
+		ds.Expire(key, now.Add(ttl))
+	}
+	ds.Insert("noExpiration1", "abc123")
+	ds.Insert("noExpiration2", "abc123")
+
+	counts := ds.ExpirationHistogram([]time.Duration{time.Hour, time.Minute, time.Hour * 24})
+	expected := []int{2, 3, 0, 2}
+	if len(counts) != len(expected) {
+		t.Fatalf("expected counts %v but got %v", expected, counts)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Fatalf("expected counts %v but got %v", expected, counts)
+		}
+	}
+
+	ds.Delete("thirtySeconds")
+	ds.Upsert("oneHour", "def456")
+	ds.Insert("justOverOne", "def456")
+	counts = ds.ExpirationHistogram([]time.Duration{time.Minute})
+	if len(counts) != 2 || counts[0] != 1 || counts[1] != 2 {
+		t.Fatalf("expected counts [1 2] but got %v", counts)
+	}
+
+	counts = ds.ExpirationHistogram(nil)
+	if len(counts) != 1 || counts[0] != 2 {
+		t.Fatalf("expected counts [2] but got %v", counts)
+	}
+}
+
+func TestExpireDoesNotResurrectConcurrentlyDeletedKeys(t *testing.T) {
+	ds := NewDataStore()
+	runExpireRacingDelete(t, &ds)
+}
+
+func runExpireRacingDelete(t *testing.T, ds *DataStore) {
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		ds.Insert(key, "abc123")
+
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.Expire(key, time.Now().Add(time.Hour))
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.Delete(key)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.CleanupNow()
+		}()
+		close(start)
+		wg.Wait()
+
+		// either the expiration landed before the delete and the key is gone, or it landed after and was ignored
+		value, present := ds.Read(key)
+		if present {
+			t.Fatalf("Expected key %q to stay deleted but it was resurrected with value %q", key, value)
+		}
+
+		ds.internalStoreMutex.Lock()
+		_, resident := ds.inMemoryStore[key]
+		_, tracked := ds.expirations.byKey[key]
+		ds.internalStoreMutex.Unlock()
+		if resident || tracked {
+			t.Fatalf("Expected no trace of deleted key %q but resident=%t tracked=%t", key, resident, tracked)
+		}
+	}
+}
+
+func BenchmarkUpsertSameValue(b *testing.B) {
+	value := strings.Repeat("a", 1024)
+
+	for _, alwaysRewrite := range []bool{false, true} {
+		b.Run(fmt.Sprintf("AlwaysRewriteUpserts=%t", alwaysRewrite), func(b *testing.B) {
+			ds := NewDataStoreWithOptions(Options{AlwaysRewriteUpserts: alwaysRewrite})
+			for i := 0; i < 100; i++ {
+				ds.Upsert(fmt.Sprintf("region:%d:store:%d", i%10, i), value)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ds.Upsert(fmt.Sprintf("region:%d:store:%d", i%10, i%100), value)
+			}
+		})
+	}
+}
+
+func TestCountByApprox(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	for i := 0; i < 10; i++ {
+		ds.Insert(fmt.Sprintf("region:%d:store:%d", i%2, i), "abc123")
+	}
+	ds.Expire("region:0:store:0", now.Add(time.Second))
+	now = now.Add(time.Second * 2)
+
+	// the expired key is still counted until it is cleaned up
+	if ds.CountByApprox("region:0") != 5 || ds.CountByApprox("") != 10 || ds.CountByApprox("region:2") != 0 {
+		t.Fatalf("Expected 5 keys under region:0 and 10 in total but found %d and %d", ds.CountByApprox("region:0"), ds.CountByApprox(""))
+	}
+
+	ds.CleanupNow()
+	ds.DeleteBy("region:1")
+	if ds.CountByApprox("region:0") != 4 || ds.CountByApprox("region:1") != 0 || ds.CountByApprox("") != 4 {
+		t.Fatalf("Expected 4 keys under region:0 and none under region:1 but found %d and %d", ds.CountByApprox("region:0"), ds.CountByApprox("region:1"))
+	}
+
+	ds.Truncate()
+	if ds.CountByApprox("") != 0 {
+		t.Fatalf("Expected no keys after truncating but counted %d", ds.CountByApprox(""))
+	}
+}
+
+func BenchmarkCountByApprox(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("%d keys", size), func(b *testing.B) {
+			ds := NewDataStore()
+			ds.cleanupSignal = make(chan uint64, size)
+			for i := 0; i < size; i++ {
+				ds.Insert(fmt.Sprintf("tenant:1:item:%d", i), "abc123")
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ds.CountByApprox("tenant:1")
+			}
+		})
+	}
+}
+
+func TestABurstOfWritesQueuesOneCleanup(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.Insert("expired", "1")
+	ds.Expire("expired", time.Now().Add(-time.Second))
+
+	// holding the mutex keeps the queued cleanup waiting, as it would behind a burst of writes
+	ds.internalStoreMutex.Lock()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		ds.scheduleCleanup()
+	}
+	started := runtime.NumGoroutine() - before
+	ds.internalStoreMutex.Unlock()
+	if started > 1 {
+		t.Fatalf("Expected at most one cleanup to be queued but %d goroutines were started", started)
+	}
+
+	// the queued cleanup still removes the expired key, and the next write queues another
+	deadline := time.Now().Add(time.Second)
+	for ds.ApproximateCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the queued cleanup to remove the expired key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ds.Insert("later", "1")
+	ds.Expire("later", time.Now().Add(-time.Second))
+	ds.Insert("trigger", "1")
+	for ds.ApproximateCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a write after the cleanup to queue another")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTruncateLetsTheNextWriteQueueACleanup(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.internalStoreMutex.Lock()
+	ds.scheduleCleanup()
+	ds.internalStoreMutex.Unlock()
+	ds.Truncate()
+
+	// the cleanup queued before the truncate is discarded, this one must be queued anew
+	ds.Insert("expired", "1")
+	ds.Expire("expired", time.Now().Add(-time.Second))
+	deadline := time.Now().Add(time.Second)
+	for ds.ApproximateCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a write after the truncate to have the expired key cleaned up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkWritesWithExpirations(b *testing.B) {
+	ds := NewDataStore()
+	before := runtime.NumGoroutine()
+	peak := 0
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key:%d", i%1000)
+		ds.Upsert(key, "abc123")
+		ds.Expire(key, time.Now().Add(time.Millisecond))
+		if i%100 == 0 {
+			if started := runtime.NumGoroutine() - before; started > peak {
+				peak = started
+			}
+		}
+	}
+	b.ReportMetric(float64(peak), "peak-goroutines")
+}
+
+func TestCleanupChecksHeapEntriesAgainstTheirKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.cleanupSignal = make(chan uint64, 100)
+	ds.Insert("persistent", "1")
+	ds.Insert("extended", "1")
+	ds.Expire("extended", now.Add(time.Hour))
+	ds.Insert("expired", "1")
+	ds.Expire("expired", now.Add(time.Second))
+
+	// entries that disagree with their nodes, as a heap gone stale would have
+	ds.internalStoreMutex.Lock()
+	ds.expirations.set("persistent", now.Add(time.Millisecond))
+	ds.expirations.set("extended", now.Add(time.Millisecond))
+	ds.expirations.set("gone", now.Add(time.Millisecond))
+	ds.internalStoreMutex.Unlock()
+
+	now = now.Add(time.Minute)
+	ds.CleanupNow()
+
+	if ds.ApproximateCount() != 2 || !ds.Present("persistent") || !ds.Present("extended") {
+		t.Fatalf("Expected only the expired key to be removed but %d keys are left", ds.ApproximateCount())
+	}
+	if expiration, _ := ds.ReadExpiration("extended"); !expiration.Equal(now.Add(-time.Minute).Add(time.Hour)) {
+		t.Fatalf("Expected the extended key to keep its expiration but found %s", expiration)
+	}
+}
+
+func BenchmarkCleanupWithFewExpirations(b *testing.B) {
+	if copyOnWriteByDefault {
+		b.Skip("copying a million keys on every write is not what this measures")
+	}
+
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }})
+	ds.cleanupSignal = make(chan uint64, 1_000_000+20*b.N)
+	// padded so keys written at the same instant arrive in the order writeOrder keeps them in
+	for i := 0; i < 1_000_000; i++ {
+		ds.Insert(fmt.Sprintf("key:%07d", i), "abc123")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 10; j++ {
+			key := fmt.Sprintf("expiring:%d", j)
+			ds.Upsert(key, "abc123")
+			ds.Expire(key, now.Add(time.Millisecond))
+		}
+		now = now.Add(time.Second)
+		b.StartTimer()
+
+		ds.CleanupNow()
+	}
+}
+
+func TestConcurrentInsertsOfTheSameKeyHaveOneWinner(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	for round := 0; round < 50; round++ {
+		key := fmt.Sprintf("key:%d", round)
+		var inserted int64
+		var waitGroup sync.WaitGroup
+		start := make(chan bool)
+		for writer := 0; writer < 16; writer++ {
+			waitGroup.Add(1)
+			go func(writer int) {
+				defer waitGroup.Done()
+				<-start
+				if ds.Insert(key, fmt.Sprint(writer)) {
+					atomic.AddInt64(&inserted, 1)
+				}
+			}(writer)
+		}
+		close(start)
+		waitGroup.Wait()
+
+		if inserted != 1 {
+			t.Fatalf("Expected exactly one insert of %q to succeed but %d did", key, inserted)
+		}
+	}
+}
+
+func TestReadsShareTheMutex(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	// a cleanup waiting for the mutex would hold up new reads behind it
+	ds.cleanupSignal = make(chan uint64, 10)
+	ds.Insert("a", "1")
+
+	// a read holding the mutex does not keep other reads out
+	ds.internalStoreMutex.RLock()
+	defer ds.internalStoreMutex.RUnlock()
+	done := make(chan bool)
+	go func() {
+		ds.Read("a")
+		ds.Present("a")
+		ds.ReadExpiration("a")
+		ds.PresentMulti([]string{"a"})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the reads to go ahead while another read holds the mutex")
+	}
+}
+
+func TestKeySeparatorSplitsTheKeysOfTheDataStore(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{
+		KeySeparator: "/",
+		TTLRules:     []TTLRule{{Prefix: "tmp/", MaxTTL: time.Hour, Reject: true}},
+	})
+	for _, key := range []string{"usr/local/bin", "usr/local/lib", "usr/share", "usr:local:bin", "usr", "tmp/cache"} {
+		if !ds.Insert(key, "1") {
+			t.Fatalf("Expected %q to be inserted", key)
+		}
+	}
+
+	keys := ds.KeysBy("usr/local")
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"usr/local/bin", "usr/local/lib"}) {
+		t.Fatalf("Expected the keys under usr/local but found %v", keys)
+	}
+	// a colon is part of a segment like any other character
+	if keys := ds.KeysBy("usr:local"); len(keys) != 0 {
+		t.Fatalf("Expected no keys under usr:local but found %v", keys)
+	}
+	if count := ds.CountBy("usr"); count != 4 {
+		t.Fatalf("Expected 4 keys under usr, the colon separated key and usr itself included, but counted %d", count)
+	}
+	if keys := ds.KeysMatching("usr/*/bin"); !slices.Equal(keys, []string{"usr/local/bin"}) {
+		t.Fatalf("Expected usr/*/bin to match usr/local/bin but found %v", keys)
+	}
+
+	if _, err := ds.ExpireWithMode("tmp/cache", time.Now().Add(time.Hour*2), ExpireAlways); err == nil {
+		t.Fatalf("Expected the TTL rule to apply to the keys under tmp split on the separator")
+	}
+
+	if deleted := ds.DeleteBy("usr/local"); deleted != 2 || !ds.Present("usr:local:bin") {
+		t.Fatalf("Expected deleting usr/local to delete its 2 keys and leave usr:local:bin but deleted %d", deleted)
+	}
+
+	ds.Truncate()
+	ds.Insert("var/log/syslog", "1")
+	if keys := ds.KeysBy("var/log"); !slices.Equal(keys, []string{"var/log/syslog"}) {
+		t.Fatalf("Expected truncating to keep the separator but found %v under var/log", keys)
+	}
+	if ds.KeySeparator() != "/" {
+		t.Fatalf("Expected the separator to be / but found %q", ds.KeySeparator())
+	}
+}
+
+func TestDeleteByOfManyNamespacesDoesNotGrowTheKeyIndex(t *testing.T) {
+	ds := NewDataStore()
+	ds.Insert("config", "1")
+	baselineNodes := ds.keyIndex.countNodes()
+
+	for i := 0; i < 10_000; i++ {
+		namespace := fmt.Sprintf("tenant:%d", i)
+		ds.Insert(namespace+":user:1", "1")
+		ds.Insert(namespace+":user:2:session", "1")
+		if deleted := ds.DeleteBy(namespace); deleted != 2 {
+			t.Fatalf("Expected deleting %s to delete its 2 keys but deleted %d", namespace, deleted)
+		}
+	}
+
+	if ds.keyIndex.countNodes() != baselineNodes {
+		t.Fatalf("Expected the index to be back to %d nodes but found %d", baselineNodes, ds.keyIndex.countNodes())
+	}
+}
@@ -0,0 +1,38 @@
+package engine
+
+import "time"
+
+// SetDefaultTTL
+/**
+* Change how long keys created without an expiration live for, zero disables the default
+*
+* The default is given to keys created by Insert, or by Upsert of a key that is not present. Updates and upserts of keys
+* that are present keep whatever expiration the key already has, and keys already stored are not changed. The TTL
+* policy still applies on top, so a default longer than a key's TTL rule is shortened to the rule's limit.
+ */
+func (ds *DataStore) SetDefaultTTL(ttl time.Duration) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	ds.defaultTTL = ttl
+}
+
+// DefaultTTL returns the current default TTL, zero when it is disabled
+func (ds *DataStore) DefaultTTL() time.Duration {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return ds.defaultTTL
+}
+
+// withDefaultTTL gives a node about to be created under key the default expiration if it has none, the caller must
+// hold the mutex and store the returned node
+func (ds *DataStore) withDefaultTTL(key string, node dataNode, timestamp time.Time) dataNode {
+	if ds.defaultTTL <= 0 || node.hasExpiration {
+		return node
+	}
+
+	node.hasExpiration = true
+	node.expiration = timestamp.Add(ds.defaultTTL)
+	ds.expirations.set(key, node.expiration)
+	ds.defaultTTLsApplied++
+	return node
+}
@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func assertExpiration(t *testing.T, ds *DataStore, key string, expected time.Time) {
+	t.Helper()
+	expiration, hasExpiration := ds.ReadExpiration(key)
+	if expected.IsZero() && hasExpiration {
+		t.Fatalf("Expected %q to have no expiration but found %q", key, expiration)
+	}
+	if !expected.IsZero() && (!hasExpiration || !expiration.Equal(expected)) {
+		t.Fatalf("Expected %q to expire at %q but found %q", key, expected, expiration)
+	}
+}
+
+func TestDefaultTTLAppliesToCreatedKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true, DefaultTTL: time.Hour})
+
+	ds.Insert("inserted", "abc123")
+	ds.Upsert("upserted", "abc123")
+	assertExpiration(t, &ds, "inserted", now.Add(time.Hour))
+	assertExpiration(t, &ds, "upserted", now.Add(time.Hour))
+
+	// later writes to a present key keep its expiration instead of starting the default again
+	created := now
+	now = now.Add(time.Minute)
+	ds.Update("inserted", "def456")
+	ds.Upsert("upserted", "def456")
+	assertExpiration(t, &ds, "inserted", created.Add(time.Hour))
+	assertExpiration(t, &ds, "upserted", created.Add(time.Hour))
+
+	ds.Expire("inserted", now.Add(time.Hour*48))
+	ds.Upsert("inserted", "ghi789")
+	assertExpiration(t, &ds, "inserted", now.Add(time.Hour*48))
+
+	// an expired key written again is created fresh
+	ds.Expire("upserted", now.Add(-time.Second))
+	ds.Insert("upserted", "abc123")
+	assertExpiration(t, &ds, "upserted", now.Add(time.Hour))
+
+	if ds.Stats().DefaultTTLsApplied != 3 {
+		t.Fatalf("Expected 3 keys to have received the default but found %d", ds.Stats().DefaultTTLsApplied)
+	}
+}
+
+func TestDefaultTTLDoesNotTouchKeysWrittenBeforeIt(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("immortal", "abc123")
+	assertExpiration(t, &ds, "immortal", time.Time{})
+
+	ds.SetDefaultTTL(time.Hour)
+	ds.Update("immortal", "def456")
+	ds.Upsert("immortal", "ghi789")
+	assertExpiration(t, &ds, "immortal", time.Time{})
+
+	ds.Insert("cached", "abc123")
+	assertExpiration(t, &ds, "cached", now.Add(time.Hour))
+
+	ds.SetDefaultTTL(0)
+	ds.Insert("disabled", "abc123")
+	assertExpiration(t, &ds, "disabled", time.Time{})
+
+	ds.Truncate()
+	if ds.DefaultTTL() != 0 || ds.Stats().DefaultTTLsApplied != 1 {
+		t.Fatalf("Expected truncating to leave the default and its count alone but found %s and %d", ds.DefaultTTL(), ds.Stats().DefaultTTLsApplied)
+	}
+}
+
+func TestTTLPolicyShortensTheDefaultTTL(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{
+		Clock:           func() time.Time { return now },
+		CheckInvariants: true,
+		DefaultTTL:      time.Hour * 48,
+		TTLRules:        []TTLRule{{Prefix: "pii", MaxTTL: time.Hour * 24, Reject: true}},
+	})
+
+	ds.Insert("pii:1", "abc123")
+	ds.Insert("public:1", "abc123")
+	assertExpiration(t, &ds, "pii:1", now.Add(time.Hour*24))
+	assertExpiration(t, &ds, "public:1", now.Add(time.Hour*48))
+}
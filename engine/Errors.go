@@ -0,0 +1,20 @@
+package engine
+
+import "errors"
+
+var (
+	// ErrKeyNotFound is returned when an operation needs a key that is not present or has expired
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrKeyExists is returned when an operation would replace a key it was not allowed to replace
+	ErrKeyExists = errors.New("key already exists")
+	// ErrTTLExceeded is returned when an expiration is further away than a rejecting TTLRule allows
+	ErrTTLExceeded = errors.New("expiration exceeds the maximum TTL")
+	// ErrWrongType is returned when a hash operation finds a key holding a string, or a string operation one holding a
+	// hash
+	ErrWrongType = errors.New("key holds a value of the wrong type")
+	// ErrStoreFull is returned when a write would create a key while the data store is over its WaterMarks
+	ErrStoreFull = errors.New("data store is full")
+	// ErrNotInteger is returned when Increment or Decrement finds a value that is not a 64-bit integer, or would leave
+	// one that is not
+	ErrNotInteger = errors.New("value is not a 64-bit integer")
+)
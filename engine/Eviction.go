@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy chooses the key a data store with Options.MaxKeys evicts to make room for a new one
+type EvictionPolicy int
+
+const (
+	// EvictLeastRecentlyUsed evicts the key that was read or written the longest ago
+	EvictLeastRecentlyUsed EvictionPolicy = iota
+	// EvictNearestExpiration evicts the key that expires the soonest, or the least recently used key while no key has
+	// an expiration
+	EvictNearestExpiration
+)
+
+// eviction
+/**
+* The keys of a data store with Options.MaxKeys in the order they were last used, least recently used at the front,
+* with an index by key so a key can be moved to the back or removed in O(1).
+*
+* Keys are added and removed along with the nodes of the store while holding the owning DataStore's mutex, so every
+* stored key is tracked. Reads move keys while holding the DataStore's mutex for reading or not at all, so the order has
+* a mutex of its own, and reads only ever move keys that are tracked, never adding a key a write has just removed.
+ */
+type eviction struct {
+	policy  EvictionPolicy
+	maxKeys int
+	mutex   sync.Mutex
+	order   *list.List
+	byKey   map[string]*list.Element
+	// evicted counts the keys evicted, guarded by the DataStore's mutex, see Stats.Evicted
+	evicted int
+}
+
+// newEviction returns the eviction of a data store with Options.MaxKeys, or nil when it never evicts
+func newEviction(options Options) *eviction {
+	if options.MaxKeys <= 0 {
+		return nil
+	}
+	return &eviction{policy: options.EvictionPolicy, maxKeys: options.MaxKeys, order: list.New(), byKey: map[string]*list.Element{}}
+}
+
+// track moves key to the back as the most recently used, adding it when it is not tracked yet, for writes storing it
+func (e *eviction) track(key string) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if element, tracked := e.byKey[key]; tracked {
+		e.order.MoveToBack(element)
+		return
+	}
+	e.byKey[key] = e.order.PushBack(key)
+}
+
+// used moves key to the back as the most recently used when it is tracked, for reads
+func (e *eviction) used(key string) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if element, tracked := e.byKey[key]; tracked {
+		e.order.MoveToBack(element)
+	}
+}
+
+// remove stops tracking key, for writes removing it from the store
+func (e *eviction) remove(key string) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if element, tracked := e.byKey[key]; tracked {
+		e.order.Remove(element)
+		delete(e.byKey, key)
+	}
+}
+
+// leastRecentlyUsed returns the key used the longest ago, false when no key is tracked
+func (e *eviction) leastRecentlyUsed() (string, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	front := e.order.Front()
+	if front == nil {
+		return "", false
+	}
+	return front.Value.(string), true
+}
+
+// evictedCount returns how many keys have been evicted, the caller must hold the DataStore's mutex
+func (e *eviction) evictedCount() int {
+	if e == nil {
+		return 0
+	}
+	return e.evicted
+}
+
+// makeRoom
+/**
+* Evict keys until a write creating key leaves no more than Options.MaxKeys keys, see EvictionPolicy. A key that is
+* already stored, expired or not, is replaced rather than added, so nothing is evicted for it. Evicted keys are recorded
+* as deleted, and expired keys chosen for eviction are retired like the cleanup would, without counting them as
+* evicted. The caller must hold the mutex and only call it once the write is certain to create the key.
+ */
+func (ds *DataStore) makeRoom(key string, timestamp time.Time) {
+	if ds.eviction == nil {
+		return
+	}
+	if _, present := ds.inMemoryStore[key]; present {
+		return
+	}
+
+	for len(ds.inMemoryStore) >= ds.eviction.maxKeys {
+		victim, found := ds.evictionVictim()
+		if !found {
+			return
+		}
+
+		node := ds.inMemoryStore[victim]
+		if ds.isExpired(node, timestamp) {
+			ds.retire(victim, node, timestamp)
+		} else {
+			ds.recordChange(ChangeDelete, victim, node, timestamp)
+			ds.eviction.evicted++
+		}
+		ds.removeKey(victim)
+	}
+}
+
+// evictionVictim chooses the key to evict by the EvictionPolicy, the caller must hold the mutex
+func (ds *DataStore) evictionVictim() (string, bool) {
+	if ds.eviction.policy == EvictNearestExpiration && len(ds.expirations.entries) > 0 {
+		return ds.expirations.entries[0].key, true
+	}
+	return ds.eviction.leastRecentlyUsed()
+}
+
+// findEvictionViolation checks that the eviction order tracks exactly the stored keys, the caller must hold the mutex
+func (ds *DataStore) findEvictionViolation() error {
+	if ds.eviction == nil {
+		return nil
+	}
+	ds.eviction.mutex.Lock()
+	defer ds.eviction.mutex.Unlock()
+
+	if ds.eviction.order.Len() != len(ds.eviction.byKey) || len(ds.eviction.byKey) != len(ds.inMemoryStore) {
+		return errors.New(fmt.Sprintf("%d keys are stored but the eviction order holds %d entries and %d lookups", len(ds.inMemoryStore), ds.eviction.order.Len(), len(ds.eviction.byKey)))
+	}
+	for element := ds.eviction.order.Front(); element != nil; element = element.Next() {
+		key := element.Value.(string)
+		if _, present := ds.inMemoryStore[key]; !present || ds.eviction.byKey[key] != element {
+			return errors.New(fmt.Sprintf("eviction order entry for %q is not a stored key or not the entry looked up by its key", key))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func sortedKeys(ds *DataStore) []string {
+	keys := ds.KeysBy("")
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRecentlyReadKeysSurviveEviction(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, MaxKeys: 100})
+
+	hot := []string{}
+	for i := 0; i < 10; i++ {
+		hot = append(hot, fmt.Sprintf("hot:%d", i))
+		ds.Insert(hot[i], "abc123")
+	}
+	for i := 0; i < 190; i++ {
+		if i%10 == 0 {
+			for _, key := range hot {
+				ds.Read(key)
+			}
+		}
+		ds.Insert(fmt.Sprintf("cold:%d", i), "abc123")
+	}
+
+	if ds.Count() != 100 || ds.Stats().Evicted != 100 {
+		t.Fatalf("Expected 100 keys left and 100 evicted but found %d keys and %d evicted", ds.Count(), ds.Stats().Evicted)
+	}
+	for _, key := range hot {
+		if !ds.Present(key) {
+			t.Fatalf("Expected the recently read key %q to survive eviction", key)
+		}
+	}
+	if _, present := ds.Read("cold:0"); present {
+		t.Fatalf("Expected the least recently used key to be evicted")
+	}
+	if len(ds.KeysBy("hot")) != 10 || len(ds.KeysBy("cold")) != 90 || ds.CountBy("cold") != 90 {
+		t.Fatalf("Expected the key index to lose the evicted keys but found %q", ds.KeysBy(""))
+	}
+}
+
+func TestKeysExpiringSoonestAreEvictedFirst(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true, MaxKeys: 3, EvictionPolicy: EvictNearestExpiration})
+
+	ds.Insert("later", "abc123")
+	ds.Expire("later", now.Add(time.Hour))
+	ds.Insert("sooner", "abc123")
+	ds.Expire("sooner", now.Add(time.Minute))
+	ds.Insert("forever", "abc123")
+
+	ds.Insert("a", "abc123")
+	assertKeys(t, "the keys after evicting one", sortedKeys(&ds), "a", "forever", "later")
+	ds.Insert("b", "abc123")
+	assertKeys(t, "the keys after evicting two", sortedKeys(&ds), "a", "b", "forever")
+
+	// without expirations the least recently used key goes
+	ds.Read("forever")
+	ds.Insert("c", "abc123")
+	assertKeys(t, "the keys after evicting three", sortedKeys(&ds), "b", "c", "forever")
+
+	// an expired key chosen for eviction is retired rather than counted as evicted
+	ds.Expire("b", now.Add(time.Second))
+	now = now.Add(time.Minute)
+	ds.Insert("d", "abc123")
+	if ds.Stats().Evicted != 3 || ds.Count() != 3 {
+		t.Fatalf("Expected 3 evictions and 3 keys but found %d evictions and %d keys", ds.Stats().Evicted, ds.Count())
+	}
+}
+
+func TestEveryWriteCreatingAKeyEvicts(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, MaxKeys: 2})
+	ds.Insert("a", "1")
+	ds.Insert("b", "1")
+
+	// writes to keys already present never evict
+	ds.Update("a", "2")
+	ds.Upsert("b", "2")
+	ds.Increment("a", 1)
+	if ds.Stats().Evicted != 0 {
+		t.Fatalf("Expected writes to present keys not to evict but %d keys were", ds.Stats().Evicted)
+	}
+
+	ds.GetOrSet("c", "1")
+	ds.Upsert("d", "1")
+	ds.Increment("e", 1)
+	ds.HSet("f", "field", "1")
+	assertKeys(t, "the keys left", sortedKeys(&ds), "e", "f")
+	if ds.Stats().Evicted != 4 {
+		t.Fatalf("Expected every write creating a key to evict one but %d keys were", ds.Stats().Evicted)
+	}
+
+	ds.Truncate()
+	ds.Insert("g", "1")
+	ds.Insert("h", "1")
+	if ds.Count() != 2 || ds.Stats().Evicted != 4 {
+		t.Fatalf("Expected a truncated data store to start evicting from empty")
+	}
+}
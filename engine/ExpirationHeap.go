@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"container/heap"
+	"time"
+)
+
+type expirationEntry struct {
+	key        string
+	expiration time.Time
+	index      int
+}
+
+// expirationHeap
+/**
+* A min-heap of key expirations ordered by expiration time, with an index by key so that an entry can be updated or
+* removed in O(log n) when the expiration of its key changes or the key is deleted.
+*
+* Only keys that have an expiration set are tracked. The heap is not thread safe and must only be used while holding
+* the owning DataStore's mutex.
+ */
+type expirationHeap struct {
+	entries []*expirationEntry
+	byKey   map[string]*expirationEntry
+}
+
+func newExpirationHeap() expirationHeap {
+	return expirationHeap{
+		byKey: map[string]*expirationEntry{},
+	}
+}
+
+func (h *expirationHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *expirationHeap) Less(i, j int) bool {
+	return h.entries[i].expiration.Before(h.entries[j].expiration)
+}
+
+func (h *expirationHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *expirationHeap) Push(x any) {
+	entry := x.(*expirationEntry)
+	entry.index = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *expirationHeap) Pop() any {
+	last := len(h.entries) - 1
+	entry := h.entries[last]
+	h.entries[last] = nil
+	h.entries = h.entries[:last]
+	entry.index = -1
+	return entry
+}
+
+// set
+/**
+* Track the expiration of a key, replacing any expiration already tracked for it
+ */
+func (h *expirationHeap) set(key string, expiration time.Time) {
+	if entry, present := h.byKey[key]; present {
+		entry.expiration = expiration
+		heap.Fix(h, entry.index)
+		return
+	}
+
+	entry := &expirationEntry{key: key, expiration: expiration}
+	h.byKey[key] = entry
+	heap.Push(h, entry)
+}
+
+// remove
+/**
+* Stop tracking the expiration of a key, does nothing if the key has no tracked expiration
+ */
+func (h *expirationHeap) remove(key string) {
+	if entry, present := h.byKey[key]; present {
+		heap.Remove(h, entry.index)
+		delete(h.byKey, key)
+	}
+}
+
+// peek
+/**
+* Returns the entry with the earliest expiration without removing it, or nil if nothing is tracked
+ */
+func (h *expirationHeap) peek() *expirationEntry {
+	if len(h.entries) == 0 {
+		return nil
+	}
+
+	return h.entries[0]
+}
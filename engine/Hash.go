@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"sort"
+	"time"
+)
+
+// hashFields
+/**
+* The fields of a key holding a hash. A stored hashFields is never changed, writes replace it with a copy, so copies of
+* the store published for reads and snapshots can share it with the store.
+ */
+type hashFields struct {
+	fields map[string]string
+}
+
+func (h *hashFields) get(field string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	value, present := h.fields[field]
+	return value, present
+}
+
+// with returns a copy of the fields with field set to value
+func (h *hashFields) with(field string, value string) *hashFields {
+	copied := &hashFields{fields: make(map[string]string, h.length()+1)}
+	if h != nil {
+		for name, fieldValue := range h.fields {
+			copied.fields[name] = fieldValue
+		}
+	}
+	copied.fields[field] = value
+	return copied
+}
+
+// without returns a copy of the fields without field, nil once no fields are left
+func (h *hashFields) without(field string) *hashFields {
+	if h.length() <= 1 {
+		return nil
+	}
+
+	copied := &hashFields{fields: make(map[string]string, h.length()-1)}
+	for name, value := range h.fields {
+		if name != field {
+			copied.fields[name] = value
+		}
+	}
+	return copied
+}
+
+func (h *hashFields) length() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+// bytes is the length of every field name and value, counted towards Stats.ValueBytes
+func (h *hashFields) bytes() int {
+	if h == nil {
+		return 0
+	}
+
+	total := 0
+	for name, value := range h.fields {
+		total += len(name) + len(value)
+	}
+	return total
+}
+
+// sortedFields returns the names of the fields in sorted order
+func (h *hashFields) sortedFields() []string {
+	names := make([]string, 0, h.length())
+	if h != nil {
+		for name := range h.fields {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HSet
+/**
+* Set a field of the hash stored under key, creating the hash when the key is not present
+*
+* A key holding a hash is a single key like any other: it expires, is renamed, and is deleted as a whole, and setting a
+* field keeps the expiration it has. A new hash gets the default TTL like Insert. Returns whether the field was
+* created rather than replaced, ErrWrongType when the key holds a string, a ValueTooLargeError when the value is longer
+* than the MaxValueLength, and when the key is not present a KeyTooComplexError if it breaks the KeyLimits and
+* ErrStoreFull if the data store is over its WaterMarks.
+ */
+func (ds *DataStore) HSet(key string, field string, value string) (bool, error) {
+	err := ds.CheckValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("HSet")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	node, present := ds.inMemoryStore[key]
+	live := present && !ds.isExpired(node, timestamp)
+	if live && node.hash == nil {
+		return false, ErrWrongType
+	}
+
+	if !live {
+		err := ds.checkKey(key)
+		if err == nil {
+			err = ds.refuseNewKey()
+		}
+		if err != nil {
+			return false, err
+		}
+		ds.makeRoom(key, timestamp)
+		ds.retireIfExpired(key, timestamp)
+		ds.expirations.remove(key)
+		node = ds.withDefaultTTL(key, dataNode{}, timestamp)
+	}
+
+	_, replaced := node.hash.get(field)
+	node.hash = node.hash.with(field, value)
+	ds.setNode(key, ds.governWrite(key, node, timestamp))
+	ds.keyIndex.Add(key)
+	ds.writes.touch(key, timestamp)
+	ds.recordFieldChange(ChangeHSet, key, field, value, timestamp)
+
+	return !replaced, nil
+}
+
+// HGet
+/**
+* Read a field of the hash stored under key
+*
+* Returns the value of the field and whether it was present, a key that is not present holds no fields. Returns
+* ErrWrongType when the key holds a string.
+ */
+func (ds *DataStore) HGet(key string, field string) (string, bool, error) {
+	node, live, err := ds.readHash("HGet", key)
+	if err != nil || !live {
+		return "", false, err
+	}
+
+	value, present := node.hash.get(field)
+	return value, present, nil
+}
+
+// HDel
+/**
+* Delete a field of the hash stored under key, deleting the key along with its last field
+*
+* Returns whether the field was present, and ErrWrongType when the key holds a string.
+ */
+func (ds *DataStore) HDel(key string, field string) (bool, error) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("HDel")
+	defer ds.publishReads()
+	defer ds.scheduleCleanup()
+
+	timestamp := ds.now()
+	node, present := ds.inMemoryStore[key]
+	if !present || ds.isExpired(node, timestamp) {
+		return false, nil
+	}
+	if node.hash == nil {
+		return false, ErrWrongType
+	}
+	value, fieldPresent := node.hash.get(field)
+	if !fieldPresent {
+		return false, nil
+	}
+
+	node.hash = node.hash.without(field)
+	if node.hash == nil {
+		ds.removeKey(key)
+	} else {
+		ds.setNode(key, node)
+		ds.writes.touch(key, timestamp)
+	}
+	ds.recordFieldChange(ChangeHDel, key, field, value, timestamp)
+
+	return true, nil
+}
+
+// HGetAll
+/**
+* Read every field of the hash stored under key, returning an empty map when the key is not present and ErrWrongType
+* when it holds a string. The map is the caller's to change.
+ */
+func (ds *DataStore) HGetAll(key string) (map[string]string, error) {
+	node, live, err := ds.readHash("HGetAll", key)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, node.hash.length())
+	if live {
+		for name, value := range node.hash.fields {
+			fields[name] = value
+		}
+	}
+	return fields, nil
+}
+
+// HLen returns how many fields the hash stored under key has, zero when the key is not present and ErrWrongType when
+// it holds a string
+func (ds *DataStore) HLen(key string) (int, error) {
+	node, live, err := ds.readHash("HLen", key)
+	if err != nil || !live {
+		return 0, err
+	}
+	return node.hash.length(), nil
+}
+
+// HoldsHash reports whether the key is present and holds a hash, for telling a string operation that found no string
+// apart from one that found a hash
+func (ds *DataStore) HoldsHash(key string) bool {
+	_, live, err := ds.readHash("HoldsHash", key)
+	return live && err == nil
+}
+
+// readHash looks up a key for a hash read, returning whether it is present and ErrWrongType when it holds a string
+func (ds *DataStore) readHash(operation string, key string) (dataNode, bool, error) {
+	node, present := ds.readNode(operation, key)
+	ds.spill.release(node.spilled)
+	if !present || ds.isExpired(node, ds.now()) {
+		return dataNode{}, false, nil
+	}
+	if node.hash == nil {
+		return dataNode{}, false, ErrWrongType
+	}
+	return node, true, nil
+}
+
+// recordFieldChange records a change to one field of a hash, see recordChange. The caller must hold the mutex
+func (ds *DataStore) recordFieldChange(operation ChangeOperation, key string, field string, value string, timestamp time.Time) {
+	ds.changes.record(Change{Time: timestamp, Operation: operation, Key: key, Field: field, Value: value})
+	ds.markChanged()
+}
+
+// recordHashWrite records a hash written whole under key as a ChangeHSet of each of its fields, the caller must hold
+// the mutex
+func (ds *DataStore) recordHashWrite(key string, hash *hashFields, timestamp time.Time) {
+	for _, field := range hash.sortedFields() {
+		value, _ := hash.get(field)
+		ds.recordFieldChange(ChangeHSet, key, field, value, timestamp)
+	}
+}
@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHashFieldLifecycle(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	created, err := ds.HSet("user:1", "name", "ada")
+	if err != nil || !created {
+		t.Fatalf("Expected the first field to be created but got %t: %q", created, err)
+	}
+	ds.HSet("user:1", "role", "admin")
+	if created, _ := ds.HSet("user:1", "name", "grace"); created {
+		t.Fatalf("Expected setting an existing field to replace it rather than create it")
+	}
+
+	if value, present, _ := ds.HGet("user:1", "name"); !present || value != "grace" {
+		t.Fatalf("Expected the replaced value but read %q, %t", value, present)
+	}
+	if _, present, _ := ds.HGet("user:1", "email"); present {
+		t.Fatalf("Expected a field that was never set not to be present")
+	}
+	if length, _ := ds.HLen("user:1"); length != 2 {
+		t.Fatalf("Expected 2 fields but found %d", length)
+	}
+	if fields, _ := ds.HGetAll("user:1"); len(fields) != 2 || fields["name"] != "grace" || fields["role"] != "admin" {
+		t.Fatalf("Expected every field to be read but found %v", fields)
+	}
+	if keys := ds.KeysBy("user"); len(keys) != 1 || keys[0] != "user:1" {
+		t.Fatalf("Expected the hash to be indexed like any key but found %v", keys)
+	}
+	if !ds.Present("user:1") {
+		t.Fatalf("Expected a key holding a hash to be present")
+	}
+
+	if deleted, _ := ds.HDel("user:1", "email"); deleted {
+		t.Fatalf("Expected deleting a field that is not present to do nothing")
+	}
+	if deleted, _ := ds.HDel("user:1", "role"); !deleted {
+		t.Fatalf("Expected the field to be deleted")
+	}
+	ds.HDel("user:1", "name")
+	if ds.Present("user:1") || ds.Count() != 0 {
+		t.Fatalf("Expected deleting the last field to delete the key")
+	}
+	if fields, err := ds.HGetAll("user:1"); err != nil || fields == nil || len(fields) != 0 {
+		t.Fatalf("Expected a missing key to hold no fields but found %v: %q", fields, err)
+	}
+}
+
+func TestHashAndStringOperationsReturnErrWrongType(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.Insert("string", "value")
+	ds.HSet("hash", "field", "value")
+
+	if _, err := ds.HSet("string", "field", "value"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected HSet on a string to fail with ErrWrongType but got %q", err)
+	}
+	if _, _, err := ds.HGet("string", "field"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected HGet on a string to fail with ErrWrongType but got %q", err)
+	}
+	if _, err := ds.HDel("string", "field"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected HDel on a string to fail with ErrWrongType but got %q", err)
+	}
+	if _, err := ds.HGetAll("string"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected HGetAll on a string to fail with ErrWrongType but got %q", err)
+	}
+	if _, err := ds.HLen("string"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Expected HLen on a string to fail with ErrWrongType but got %q", err)
+	}
+	if value, _ := ds.Read("string"); value != "value" {
+		t.Fatalf("Expected the string to be left alone but read %q", value)
+	}
+
+	if _, present := ds.Read("hash"); present {
+		t.Fatalf("Expected a hash not to be read as a string")
+	}
+	if ds.Update("hash", "value") || ds.Upsert("hash", "value") || ds.Insert("hash", "value") {
+		t.Fatalf("Expected string writes not to replace a hash")
+	}
+	if deleted, _, present := ds.DeleteIfEquals("hash", ""); deleted || present {
+		t.Fatalf("Expected a conditional delete not to match a hash")
+	}
+	if !ds.HoldsHash("hash") || ds.HoldsHash("string") || ds.HoldsHash("missing") {
+		t.Fatalf("Expected HoldsHash to tell the hash apart from the string and the missing key")
+	}
+	if value, _, _ := ds.HGet("hash", "field"); value != "value" {
+		t.Fatalf("Expected the hash to be left alone but read %q", value)
+	}
+
+	if !ds.Delete("hash") || ds.HoldsHash("hash") {
+		t.Fatalf("Expected Delete to remove a hash like any key")
+	}
+}
+
+func TestExpiringAHashRemovesEveryField(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	ds.HSet("session", "user", "ada")
+	ds.Expire("session", now.Add(time.Minute))
+	ds.HSet("session", "cart", "3")
+	if expiration, _ := ds.ReadExpiration("session"); !expiration.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Expected setting a field to keep the expiration but found %s", expiration)
+	}
+
+	now = now.Add(time.Hour)
+	if length, _ := ds.HLen("session"); length != 0 {
+		t.Fatalf("Expected an expired hash to hold no fields but found %d", length)
+	}
+	ds.CleanupNow()
+	if ds.Count() != 0 {
+		t.Fatalf("Expected the cleanup to remove the expired hash")
+	}
+
+	if created, _ := ds.HSet("session", "user", "grace"); !created {
+		t.Fatalf("Expected a field of an expired hash to be created again")
+	}
+	if fields, _ := ds.HGetAll("session"); len(fields) != 1 {
+		t.Fatalf("Expected none of the expired fields to come back but found %v", fields)
+	}
+	if _, hasExpiration := ds.ReadExpiration("session"); hasExpiration {
+		t.Fatalf("Expected the new hash not to inherit the expiration")
+	}
+}
+
+func TestConcurrentFieldWritersDoNotLoseUpdates(t *testing.T) {
+	withParallelism(t)
+
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	var waitGroup sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		waitGroup.Add(1)
+		go func(writer int) {
+			defer waitGroup.Done()
+			for i := 0; i < 200; i++ {
+				ds.HSet("counters", fmt.Sprintf("%d:%d", writer, i), "1")
+			}
+		}(writer)
+	}
+	waitGroup.Wait()
+
+	if length, _ := ds.HLen("counters"); length != 8*200 {
+		t.Fatalf("Expected every field written to be kept but found %d", length)
+	}
+}
+
+func TestHashChangesCarryTheField(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{ChangeRetention: 10})
+	ds.HSet("a", "x", "1")
+	ds.HSet("a", "y", "2")
+	ds.HDel("a", "x")
+	ds.Rename("a", "b", false)
+
+	changes, _ := ds.ChangesSince(0)
+	expected := []Change{
+		{Operation: ChangeHSet, Key: "a", Field: "x", Value: "1"},
+		{Operation: ChangeHSet, Key: "a", Field: "y", Value: "2"},
+		{Operation: ChangeHDel, Key: "a", Field: "x", Value: "1"},
+		{Operation: ChangeDelete, Key: "a"},
+		{Operation: ChangeHSet, Key: "b", Field: "y", Value: "2"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes but found %v", len(expected), changes)
+	}
+	for i, change := range changes {
+		if change.Operation != expected[i].Operation || change.Key != expected[i].Key || change.Field != expected[i].Field || change.Value != expected[i].Value {
+			t.Fatalf("Expected change %d to be %+v but found %+v", i, expected[i], change)
+		}
+	}
+}
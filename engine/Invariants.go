@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// InvariantViolation
+/**
+* The value Options.CheckInvariants panics with when an operation leaves the data store in an inconsistent state
+ */
+type InvariantViolation struct {
+	// Operation is the public method that was about to return
+	Operation string
+	// Invariant describes what was found to be wrong
+	Invariant string
+}
+
+func (v *InvariantViolation) Error() string {
+	return fmt.Sprintf("invariant violated by %s: %s", v.Operation, v.Invariant)
+}
+
+// checkInvariants
+/**
+* Panic with an InvariantViolation naming the operation if the data store is inconsistent, does nothing unless
+* Options.CheckInvariants is set. The caller must hold the mutex.
+ */
+func (ds *DataStore) checkInvariants(operation string) {
+	if !ds.options.CheckInvariants {
+		return
+	}
+
+	err := ds.findViolation()
+	if err != nil {
+		panic(&InvariantViolation{Operation: operation, Invariant: err.Error()})
+	}
+}
+
+// lockAndCheckInvariants is checkInvariants for operations that return without holding the mutex
+func (ds *DataStore) lockAndCheckInvariants(operation string) {
+	if !ds.options.CheckInvariants {
+		return
+	}
+
+	ds.internalStoreMutex.RLock()
+	defer ds.internalStoreMutex.RUnlock()
+	ds.checkInvariants(operation)
+}
+
+// findViolation
+/**
+* Walk every structure of the data store and describe the first inconsistency found between them:
+*
+* - Every key in the store is a key in the index and every key in the index is in the store
+* - Every leaf of the index is a key, since the index reports leaves as keys
+* - Every node of the index counts the keys at and under it, and only the root may count none
+* - A key has an expiration tracked in the heap exactly when it has one set, and both hold the same time
+* - No key has an expiration set to the zero time
+* - The heap's entries, key lookup, and positions agree, and the entries are in heap order
+* - Every key in the store is in the write order exactly once and nothing else is
+* - The size kept for the water marks is the size of every stored node
+* - In copy-on-write mode the copy published for reads holds exactly what the store does
+ */
+func (ds *DataStore) findViolation() error {
+	indexed := map[string]bool{}
+	nodes := []*trieNode{&ds.keyIndex.root}
+	for len(nodes) > 0 {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+
+		if node != &ds.keyIndex.root && node.leaves == nil && !node.isKey {
+			return errors.New(fmt.Sprintf("index leaf %q is not a key", node.value))
+		}
+		counted := 0
+		if node.isKey {
+			counted++
+		}
+		for _, childNode := range node.leaves {
+			counted += childNode.count
+		}
+		if node.count != counted {
+			return errors.New(fmt.Sprintf("index node %q counts %d keys but has %d", node.value, node.count, counted))
+		}
+		if node != &ds.keyIndex.root && node.count == 0 {
+			return errors.New(fmt.Sprintf("index node %q has no keys under it", node.value))
+		}
+		if node.isKey {
+			indexed[node.value] = true
+		}
+		for _, childNode := range node.leaves {
+			nodes = append(nodes, childNode)
+		}
+	}
+
+	for key := range indexed {
+		if _, present := ds.inMemoryStore[key]; !present {
+			return errors.New(fmt.Sprintf("key %q is in the index but not in the store", key))
+		}
+	}
+
+	expiring := 0
+	size := 0
+	for key, node := range ds.inMemoryStore {
+		size += nodeSize(key, node)
+		if !indexed[key] {
+			return errors.New(fmt.Sprintf("key %q is in the store but not in the index", key))
+		}
+
+		entry, tracked := ds.expirations.byKey[key]
+		if !node.hasExpiration {
+			if tracked {
+				return errors.New(fmt.Sprintf("key %q has no expiration but one is tracked for it", key))
+			}
+			continue
+		}
+
+		expiring++
+		if node.expiration.IsZero() {
+			return errors.New(fmt.Sprintf("key %q has an expiration set to the zero time", key))
+		}
+		if !tracked {
+			return errors.New(fmt.Sprintf("key %q has an expiration that is not tracked", key))
+		}
+		if !entry.expiration.Equal(node.expiration) {
+			return errors.New(fmt.Sprintf("key %q expires at %s but is tracked as expiring at %s", key, node.expiration, entry.expiration))
+		}
+	}
+
+	if size != ds.sizeBytes {
+		return errors.New(fmt.Sprintf("the stored nodes have a size of %d but %d is kept", size, ds.sizeBytes))
+	}
+
+	if len(ds.expirations.entries) != len(ds.expirations.byKey) || len(ds.expirations.entries) != expiring {
+		return errors.New(fmt.Sprintf("%d keys have expirations but the heap holds %d entries and %d lookups", expiring, len(ds.expirations.entries), len(ds.expirations.byKey)))
+	}
+
+	for i, entry := range ds.expirations.entries {
+		if entry.index != i || ds.expirations.byKey[entry.key] != entry {
+			return errors.New(fmt.Sprintf("heap entry for %q at %d records position %d or is not the entry looked up by its key", entry.key, i, entry.index))
+		}
+		if i > 0 && ds.expirations.Less(i, (i-1)/2) {
+			return errors.New(fmt.Sprintf("heap entry for %q expires before its parent", entry.key))
+		}
+	}
+
+	if ds.writes.entries.Len() != len(ds.writes.byKey) || len(ds.writes.byKey) != len(ds.inMemoryStore) {
+		return errors.New(fmt.Sprintf("%d keys are stored but the write order holds %d entries and %d lookups", len(ds.inMemoryStore), ds.writes.entries.Len(), len(ds.writes.byKey)))
+	}
+	for element := ds.writes.entries.Front(); element != nil; element = element.Next() {
+		key := element.Value.(writeOrderEntry).key
+		if _, present := ds.inMemoryStore[key]; !present || ds.writes.byKey[key] != element {
+			return errors.New(fmt.Sprintf("write order entry for %q is not a stored key or not the entry looked up by its key", key))
+		}
+	}
+
+	err := ds.findEvictionViolation()
+	if err != nil {
+		return err
+	}
+	return ds.findViewViolation()
+}
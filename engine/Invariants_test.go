@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runRandomWorkload
+/**
+* Apply a random mix of every operation to a small set of keys from several goroutines at once, returning the first
+* invariant violation any of them panicked with
+ */
+func runRandomWorkload(ds *DataStore, seed int64, workers int, operations int) error {
+	violations := make(chan error, workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(random *rand.Rand) {
+			defer wg.Done()
+			defer func() {
+				if violation := recover(); violation != nil {
+					violations <- fmt.Errorf("%v", violation)
+				}
+			}()
+
+			for i := 0; i < operations; i++ {
+				key := fmt.Sprintf("region:%d:store:%d", random.Intn(3), random.Intn(5))
+				prefix := fmt.Sprintf("region:%d", random.Intn(3))
+				expiration := time.Now().Add(time.Duration(random.Intn(20)-10) * time.Millisecond)
+
+				switch random.Intn(18) {
+				case 0:
+					ds.Insert(key, "abc123")
+				case 1:
+					ds.Update(key, "def456")
+				case 2:
+					ds.Upsert(key, fmt.Sprintf("%d", random.Intn(3)))
+				case 3:
+					ds.Delete(key)
+				case 4:
+					ds.Expire(key, expiration)
+				case 5:
+					ds.ExpireWithMode(key, expiration, ExpireMode(random.Intn(5)))
+				case 6:
+					ds.Rename(key, fmt.Sprintf("region:%d:store:%d", random.Intn(3), random.Intn(5)), random.Intn(2) == 0)
+				case 7:
+					ds.Read(key)
+				case 8:
+					ds.ReadExpiration(key)
+				case 9:
+					ds.KeysBy(prefix)
+				case 10:
+					ds.DeleteBy(prefix)
+				case 11:
+					ds.ExpireBy(prefix, expiration)
+				case 12:
+					ds.CompleteKeyPrefix("region:", 0)
+				case 13:
+					ds.ExpirationHistogram([]time.Duration{time.Millisecond})
+				case 14:
+					ds.Count()
+				case 15:
+					if random.Intn(20) == 0 {
+						ds.Truncate()
+					} else {
+						snapshot := ds.Snapshot()
+						snapshot.Release()
+					}
+				case 16:
+					ds.CountByApprox(prefix)
+				case 17:
+					ds.GetOrSetWithTTL(key, fmt.Sprintf("%d", random.Intn(3)), time.Duration(random.Intn(10))*time.Millisecond)
+				}
+			}
+		}(rand.New(rand.NewSource(seed + int64(worker))))
+	}
+	wg.Wait()
+	close(violations)
+
+	return <-violations
+}
+
+// withParallelism makes sure goroutines really run at the same time even on a single CPU machine
+func withParallelism(t *testing.T) {
+	previous := runtime.GOMAXPROCS(4)
+	t.Cleanup(func() { runtime.GOMAXPROCS(previous) })
+}
+
+func TestInvariantsHoldUnderRandomWorkload(t *testing.T) {
+	withParallelism(t)
+
+	for run := 0; run < 10; run++ {
+		seed := time.Now().UnixNano()
+		ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+		err := runRandomWorkload(&ds, seed, 8, 2000)
+		if err != nil {
+			t.Fatalf("Random workload with seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestInvariantsHoldInConcurrencyScenarios(t *testing.T) {
+	withParallelism(t)
+
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, ds *DataStore)
+	}{
+		{"write operations with async cleanup", runWriteOperationsWithAsyncCleanup},
+		{"concurrent extend only expires", runConcurrentExtendOnlyExpires},
+		{"expire racing delete", runExpireRacingDelete},
+		{"update racing delete", runUpdateRacingDelete},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			defer func() {
+				if violation := recover(); violation != nil {
+					t.Fatalf("%v", violation)
+				}
+			}()
+
+			ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+			scenario.run(t, &ds)
+		})
+	}
+}
+
+// runUpdateRacingDelete used to find the key resurrected in the store without an index entry, because Update checked
+// for the key before taking the lock to write it
+func runUpdateRacingDelete(t *testing.T, ds *DataStore) {
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		ds.Insert(key, "abc123")
+
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.Update(key, "def456")
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			ds.Delete(key)
+		}()
+		close(start)
+		wg.Wait()
+
+		value, present := ds.Read(key)
+		if present {
+			t.Fatalf("Expected key %q to stay deleted but it was resurrected with value %q", key, value)
+		}
+	}
+}
+
+func TestInvariantViolationsNameTheOperation(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	// corrupt the store behind the index's back, without a write that would start a cleanup that finds it first
+	ds.inMemoryStore["region:1:store:2"] = dataNode{value: "def456"}
+
+	defer func() {
+		violation, ok := recover().(*InvariantViolation)
+		if !ok || violation.Operation != "Read" {
+			t.Fatalf("Expected Read to panic with an invariant violation but got %v", violation)
+		}
+	}()
+
+	ds.Read("region:1:store:1")
+}
+
+func TestInvariantsAreNotCheckedByDefault(t *testing.T) {
+	ds := NewDataStore()
+	ds.inMemoryStore["region:1:store:2"] = dataNode{value: "def456"}
+	// reads in copy-on-write mode only see the corruption once it is published
+	ds.markChanged()
+	ds.publishReads()
+
+	_, present := ds.Read("region:1:store:2")
+	if !present {
+		t.Fatalf("Expected the unchecked store to read the corrupt key without panicking")
+	}
+}
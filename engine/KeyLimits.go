@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultMaxKeySegments is the most separator delimited segments a key may have unless KeyLimits says otherwise
+	DefaultMaxKeySegments = 128
+	// DefaultMaxSegmentLength is the longest a single segment of a key may be unless KeyLimits says otherwise
+	DefaultMaxSegmentLength = 1024
+	// DefaultMaxKeyLength is the longest a key may be unless KeyLimits says otherwise
+	DefaultMaxKeyLength = 16 * 1024
+)
+
+// ErrKeyTooComplex matches every KeyTooComplexError with errors.Is
+var ErrKeyTooComplex = &KeyTooComplexError{}
+
+// KeyTooComplexError
+/**
+* Returned when a key written to the data store breaks one of its KeyLimits. Limit names the limit that was broken,
+* "segments", "segment length", or "key length", Allowed is its value, and Found is how far the key went over it.
+ */
+type KeyTooComplexError struct {
+	Limit   string
+	Allowed int
+	Found   int
+}
+
+func (e *KeyTooComplexError) Error() string {
+	return fmt.Sprintf("key too complex, %s of %d exceeds the limit of %d", e.Limit, e.Found, e.Allowed)
+}
+
+func (e *KeyTooComplexError) Is(target error) bool {
+	var tooComplex *KeyTooComplexError
+	return errors.As(target, &tooComplex)
+}
+
+// KeyLimits
+/**
+* The largest keys a data store accepts, protecting the key index from keys so deep or so long that they slow down
+* every operation on it
+*
+* Keys are checked when a write would create them, by Insert, Upsert, GetOrSet, and Rename, and refused with a
+* KeyTooComplexError from CheckKey. Keys already stored stay readable and writable if the limits are lowered. A zero
+* field takes its default, and MaxKeySegments is never more than the deepest the index goes, 4096 segments.
+ */
+type KeyLimits struct {
+	MaxKeySegments   int
+	MaxSegmentLength int
+	MaxKeyLength     int
+}
+
+// withDefaults fills in the zero fields of the limits and caps the segments at the depth of the trie
+func (l KeyLimits) withDefaults() KeyLimits {
+	if l.MaxKeySegments <= 0 {
+		l.MaxKeySegments = DefaultMaxKeySegments
+	}
+	if l.MaxKeySegments > maxTrieDepth {
+		l.MaxKeySegments = maxTrieDepth
+	}
+	if l.MaxSegmentLength <= 0 {
+		l.MaxSegmentLength = DefaultMaxSegmentLength
+	}
+	if l.MaxKeyLength <= 0 {
+		l.MaxKeyLength = DefaultMaxKeyLength
+	}
+	return l
+}
+
+// SetKeyLimits replaces the limits on the keys writes may create, see KeyLimits
+func (ds *DataStore) SetKeyLimits(limits KeyLimits) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	ds.keyLimits = limits.withDefaults()
+}
+
+// KeyLimits returns the current limits on keys with the defaults filled in
+func (ds *DataStore) KeyLimits() KeyLimits {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return ds.keyLimits
+}
+
+// CheckKey
+/**
+* Check a key against the KeyLimits without writing anything, returning the KeyTooComplexError a write creating it
+* would be refused with, or nil when it is within the limits
+ */
+func (ds *DataStore) CheckKey(key string) error {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return ds.checkKey(key)
+}
+
+// checkKey checks key against the limits without allocating, the caller must hold the mutex
+func (ds *DataStore) checkKey(key string) error {
+	limits := ds.keyLimits
+	if len(key) > limits.MaxKeyLength {
+		return &KeyTooComplexError{Limit: "key length", Allowed: limits.MaxKeyLength, Found: len(key)}
+	}
+
+	segments := strings.Count(key, ds.keyIndex.seperator) + 1
+	if segments > limits.MaxKeySegments {
+		return &KeyTooComplexError{Limit: "segments", Allowed: limits.MaxKeySegments, Found: segments}
+	}
+
+	for remaining := key; ; {
+		segment, rest, more := strings.Cut(remaining, ds.keyIndex.seperator)
+		if len(segment) > limits.MaxSegmentLength {
+			return &KeyTooComplexError{Limit: "segment length", Allowed: limits.MaxSegmentLength, Found: len(segment)}
+		}
+		if !more {
+			return nil
+		}
+		remaining = rest
+	}
+}
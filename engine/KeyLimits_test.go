@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeysBreakingTheLimitsAreRefused(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{
+		CheckInvariants: true,
+		KeyLimits:       KeyLimits{MaxKeySegments: 4, MaxSegmentLength: 8, MaxKeyLength: 24},
+	})
+	ds.Insert("a", "1")
+
+	for key, limit := range map[string]string{
+		"a:b:c:d:e":                     "segments",
+		"a:123456789":                   "segment length",
+		"12345678:12345678:12345678":    "key length",
+		strings.Repeat("a:", 10000):     "key length",
+		strings.Repeat(":", 10):         "segments",
+		"a:b:" + strings.Repeat("x", 9): "segment length",
+	} {
+		err := ds.CheckKey(key)
+		var tooComplex *KeyTooComplexError
+		if !errors.Is(err, ErrKeyTooComplex) || !errors.As(err, &tooComplex) || tooComplex.Limit != limit {
+			t.Fatalf("Expected %.20q to break the %s limit but got %q", key, limit, err)
+		}
+
+		_, existed := ds.GetOrSet(key, "1")
+		if ds.Insert(key, "1") || ds.Upsert(key, "1") || existed || !errors.Is(ds.Rename("a", key, false), ErrKeyTooComplex) {
+			t.Fatalf("Expected every write creating %.20q to be refused", key)
+		}
+		if ds.Present(key) || !ds.Present("a") {
+			t.Fatalf("Expected nothing to be written for %.20q", key)
+		}
+	}
+	if ds.Count() != 1 || ds.ChangeSequence() != 1 {
+		t.Fatalf("Expected only the first insert to be written but found %d keys after %d changes", ds.Count(), ds.ChangeSequence())
+	}
+
+	// keys stored before the limits were lowered stay writable
+	ds.Insert("a:b:c:d", "1")
+	ds.SetKeyLimits(KeyLimits{MaxKeySegments: 2})
+	if !ds.Upsert("a:b:c:d", "2") || !ds.Update("a:b:c:d", "3") || ds.Insert("a:b:c", "1") {
+		t.Fatalf("Expected keys already stored to be writable while new ones are refused")
+	}
+
+	if limits := ds.KeyLimits(); limits != (KeyLimits{MaxKeySegments: 2, MaxSegmentLength: DefaultMaxSegmentLength, MaxKeyLength: DefaultMaxKeyLength}) {
+		t.Fatalf("Expected unset limits to take their defaults but found %+v", limits)
+	}
+	ds.SetKeyLimits(KeyLimits{MaxKeySegments: maxTrieDepth * 2})
+	if limits := ds.KeyLimits(); limits.MaxKeySegments != maxTrieDepth {
+		t.Fatalf("Expected the segments to be capped at the depth of the trie but found %d", limits.MaxKeySegments)
+	}
+}
+
+func TestRealisticKeysAreWithinTheDefaultLimits(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+
+	for _, key := range []string{
+		"",
+		"a",
+		"country:USA:state:MI",
+		"tenant:42:user:1001:session:7f3c9a2e-4b1d-4e8a-9c6f-1a2b3c4d5e6f",
+		"cache:https://example.com/search?q=go+datastore&page=2",
+		"metrics:" + strings.Repeat("host:region:", 60) + "cpu",
+		"blob:" + strings.Repeat("x", DefaultMaxSegmentLength),
+	} {
+		if err := ds.CheckKey(key); err != nil || !ds.Insert(key, "1") {
+			t.Fatalf("Expected %.40q to be within the default limits but got %q", key, err)
+		}
+	}
+}
+
+// BenchmarkUnrelatedWritesAfterPathologicalKeys
+/**
+* Writes and prefix searches of ordinary keys in a data store that has refused a few hundred keys of 10,000 segments,
+* compare with the clean sub-benchmark to see the refused keys cost nothing, and with refusing to see what each of
+* them costs to turn away
+ */
+func BenchmarkUnrelatedWritesAfterPathologicalKeys(b *testing.B) {
+	pathological := strings.Repeat("a:", 9999) + "a"
+
+	for _, attempts := range []int{0, 500} {
+		name := "clean"
+		if attempts > 0 {
+			name = "refused"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			ds := NewDataStore()
+			for i := 0; i < attempts; i++ {
+				ds.Upsert(fmt.Sprintf("%s:%d", pathological, i), "value")
+			}
+			for i := 0; i < 1000; i++ {
+				ds.Upsert(fmt.Sprintf("tenant:%d:user:%d", i%10, i), "value")
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ds.Upsert(fmt.Sprintf("tenant:%d:user:%d", i%10, i%1000), fmt.Sprint(i))
+				ds.KeysBy("tenant:3")
+			}
+		})
+	}
+
+	b.Run("refusing", func(b *testing.B) {
+		ds := NewDataStore()
+		for i := 0; i < b.N; i++ {
+			ds.Upsert(pathological, "value")
+		}
+	})
+}
+
+func TestAKeyOfAHundredThousandSegmentsIsRefusedCleanly(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{
+		CheckInvariants: true,
+		KeyLimits:       KeyLimits{MaxKeySegments: maxTrieDepth, MaxKeyLength: 1 << 20},
+	})
+	pathological := strings.Repeat("a:", 100_000-1) + "a"
+
+	if ds.Insert(pathological, "1") || ds.Upsert(pathological, "1") {
+		t.Fatalf("Expected a key of 100000 segments to be refused")
+	}
+	var tooComplex *KeyTooComplexError
+	if err := ds.CheckKey(pathological); !errors.As(err, &tooComplex) || tooComplex.Limit != "segments" || tooComplex.Found != 100_000 {
+		t.Fatalf("Expected the key to break the segments limit but got %q", err)
+	}
+	if ds.KeysBy(pathological) != nil || ds.CountBy(pathological) != 0 || ds.DeleteBy(pathological) != 0 {
+		t.Fatalf("Expected prefixes deeper than the index to match nothing")
+	}
+
+	// the deepest keys allowed are walked without recursing once per segment
+	deepest := strings.Repeat("a:", maxTrieDepth-1) + "a"
+	for i := 0; i < 10; i++ {
+		if !ds.Insert(fmt.Sprintf("%s%d", strings.Repeat("a:", maxTrieDepth-1), i), "1") {
+			t.Fatalf("Expected a key of %d segments to be inserted", maxTrieDepth)
+		}
+	}
+	if keys, _ := ds.Scan("", "", 5); len(keys) != 5 || len(ds.KeysBy("a")) != 10 || len(ds.KeysMatching("a:*")) != 10 {
+		t.Fatalf("Expected the deepest keys to be found by every walk of the index")
+	}
+	if ds.DeleteBy("a") != 10 || ds.Present(deepest) {
+		t.Fatalf("Expected the deepest keys to be deleted")
+	}
+}
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+)
+
+// globPattern
+/**
+* A pattern for KeysMatching split at its stars into the literal text between them, with escapes already removed.
+* parts[0] is the text before the first star and the last part the text after the last one, a pattern without stars
+* has a single part that keys must equal.
+ */
+type globPattern struct {
+	parts []string
+}
+
+// parseGlob
+/**
+* Parse a pattern where * matches any run of characters, the seperator included, and a backslash matches the character
+* after it literally, so \* matches a star and \\ a backslash. A backslash at the end of the pattern matches itself, and
+* consecutive stars match like one.
+ */
+func parseGlob(pattern string) globPattern {
+	var parts []string
+	var literal strings.Builder
+	starred := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			literal.WriteByte(pattern[i])
+		case pattern[i] == '*':
+			if !starred || literal.Len() > 0 {
+				parts = append(parts, literal.String())
+				literal.Reset()
+			}
+			starred = true
+			continue
+		default:
+			literal.WriteByte(pattern[i])
+		}
+		starred = false
+	}
+
+	return globPattern{parts: append(parts, literal.String())}
+}
+
+// literal reports whether the pattern has no stars, so it matches its one part alone
+func (g globPattern) literal() bool {
+	return len(g.parts) == 1
+}
+
+// matches reports whether the whole key matches the pattern
+func (g globPattern) matches(key string) bool {
+	if g.literal() {
+		return key == g.parts[0]
+	}
+
+	first, last := g.parts[0], g.parts[len(g.parts)-1]
+	if len(key) < len(first)+len(last) || !strings.HasPrefix(key, first) || !strings.HasSuffix(key, last) {
+		return false
+	}
+
+	// the parts between the stars are found leftmost first, which leaves the most room for those after them
+	remaining := key[len(first) : len(key)-len(last)]
+	for _, part := range g.parts[1 : len(g.parts)-1] {
+		index := strings.Index(remaining, part)
+		if index < 0 {
+			return false
+		}
+		remaining = remaining[index+len(part):]
+	}
+	return true
+}
+
+// triePrefix returns the whole segments before the first star, every key the pattern matches is under them
+func (g globPattern) triePrefix(seperator string) string {
+	// split like the key index splits keys, so separators running into each other are cut at the same places
+	segments := strings.Split(g.parts[0], seperator)
+	return strings.Join(segments[:len(segments)-1], seperator)
+}
+
+// KeysMatching
+/**
+* Find the keys that match a glob pattern, sorted, where * matches any run of characters including the delimiter and
+* a backslash escapes the character after it. For example "region:1:store:*:employee:2" matches the employee in every
+* store of region 1, "reg*" every key starting with reg, and "*" every key. A pattern without stars matches only the key
+* it spells out, so "region:" matches the key "region:" and not the keys under region.
+*
+* Only the keys under the whole segments before the first star are checked against the pattern, the key index is walked
+* straight to them, so patterns starting with literal segments cost about as much as the keys under those segments.
+* Keys that expired are left out even when the cleanup has not removed them yet.
+ */
+func (ds *DataStore) KeysMatching(pattern string) []string {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("KeysMatching")
+
+	glob := parseGlob(pattern)
+	timestamp := ds.now()
+	keys := []string{}
+	if glob.literal() {
+		if ds.isLive(glob.parts[0], timestamp) {
+			keys = append(keys, glob.parts[0])
+		}
+		return keys
+	}
+
+	ds.keyIndex.Each(glob.triePrefix(ds.keyIndex.seperator), func(key string) {
+		if glob.matches(key) && ds.isLive(key, timestamp) {
+			keys = append(keys, key)
+		}
+	})
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeysMatchingGlobPatterns(t *testing.T) {
+	ds := NewDataStore()
+	keys := []string{
+		"region:1:store:1:employee:1",
+		"region:1:store:1:employee:2",
+		"region:1:store:2:employee:2",
+		"region:1:store:2:annex:employee:2",
+		"region:2:store:1:employee:2",
+		"region:1",
+		"region:",
+		"regional",
+		"rate*limit",
+		`back\slash`,
+	}
+	for _, key := range keys {
+		ds.Insert(key, "1")
+	}
+
+	cases := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"region:1:store:*:employee:2", []string{"region:1:store:1:employee:2", "region:1:store:2:annex:employee:2", "region:1:store:2:employee:2"}},
+		{"reg*", []string{"region:", "region:1", "region:1:store:1:employee:1", "region:1:store:1:employee:2", "region:1:store:2:annex:employee:2", "region:1:store:2:employee:2", "region:2:store:1:employee:2", "regional"}},
+		{"region:*:store:1:*", []string{"region:1:store:1:employee:1", "region:1:store:1:employee:2", "region:2:store:1:employee:2"}},
+		{"*employee:1", []string{"region:1:store:1:employee:1"}},
+		{"*:employee:*2", []string{"region:1:store:1:employee:2", "region:1:store:2:annex:employee:2", "region:1:store:2:employee:2", "region:2:store:1:employee:2"}},
+		{"region:1:store:*:annex*", []string{"region:1:store:2:annex:employee:2"}},
+		{"*", keys},
+		{"**", keys},
+		// a trailing seperator is part of the key, not a search under the prefix
+		{"region:", []string{"region:"}},
+		{"region:*", []string{"region:", "region:1", "region:1:store:1:employee:1", "region:1:store:1:employee:2", "region:1:store:2:annex:employee:2", "region:1:store:2:employee:2", "region:2:store:1:employee:2"}},
+		{"region:1:*:", []string{}},
+		{`rate\*limit`, []string{"rate*limit"}},
+		{`rate\**`, []string{"rate*limit"}},
+		{`back\\slash`, []string{`back\slash`}},
+		{"region:1", []string{"region:1"}},
+		{"missing:*", []string{}},
+		{"region:1:store:1:employee:1*x", []string{}},
+	}
+
+	for _, c := range cases {
+		expected := slices.Clone(c.expected)
+		slices.Sort(expected)
+		if found := ds.KeysMatching(c.pattern); !slices.Equal(found, expected) {
+			t.Fatalf("Expected %q to match %v but found %v", c.pattern, expected, found)
+		}
+	}
+}
+
+func TestKeysMatchingLeavesOutExpiredKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }})
+	ds.cleanupSignal = make(chan uint64, 10)
+	ds.Insert("session:1", "1")
+	ds.Insert("session:2", "1")
+	ds.Expire("session:2", now.Add(time.Minute))
+	now = now.Add(time.Hour)
+
+	if found := ds.KeysMatching("session:*"); !slices.Equal(found, []string{"session:1"}) {
+		t.Fatalf("Expected only the live session to match but found %v", found)
+	}
+	if found := ds.KeysMatching("session:2"); len(found) != 0 {
+		t.Fatalf("Expected an expired key not to match itself but found %v", found)
+	}
+}
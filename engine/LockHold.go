@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"runtime"
+	"time"
+)
+
+// lockHoldCheckInterval is how many items a bulk operation works through between looking at the clock for
+// Options.MaxLockHold
+const lockHoldCheckInterval = 64
+
+// lockHold
+/**
+* The mutex as held by a bulk operation, which releases it between slices of its work once the next slice would keep it
+* past Options.MaxLockHold, so the operations waiting for the mutex are not held up behind it. Operations on a single
+* key take the mutex directly.
+*
+* How long every hold lasted is measured with the data store's clock for Stats.LongestLockHold.
+ */
+type lockHold struct {
+	ds       *DataStore
+	acquired time.Time
+	// checked is when the clock was last looked at, the time since is how long the last slice of items took
+	checked time.Time
+	items   int
+}
+
+// holdLock takes the mutex for a bulk operation, which must give it back with release
+func (ds *DataStore) holdLock() *lockHold {
+	ds.internalStoreMutex.Lock()
+	acquired := ds.now()
+	return &lockHold{ds: ds, acquired: acquired, checked: acquired}
+}
+
+// sliced reports whether the operation may release the mutex part way through, in which case it must leave the store
+// consistent after every item it works through
+func (h *lockHold) sliced() bool {
+	return h.ds.options.MaxLockHold > 0
+}
+
+// next
+/**
+* Count an item of work done, releasing the mutex and taking it again when the next lockHoldCheckInterval items would
+* take as long as the last ones did and keep it past Options.MaxLockHold. Returns whether the mutex was released, in which
+* case anything read from the store before may have changed. A copy of the store is published for reads first when
+* they are copy-on-write, so in that mode every slice costs a copy of the whole store.
+ */
+func (h *lockHold) next() bool {
+	h.items++
+	if !h.sliced() || h.items%lockHoldCheckInterval != 0 {
+		return false
+	}
+
+	now := h.ds.now()
+	lastSlice := now.Sub(h.checked)
+	h.checked = now
+	if now.Sub(h.acquired)+lastSlice < h.ds.options.MaxLockHold {
+		return false
+	}
+
+	h.ds.publishReads()
+	h.release()
+	// give the operations waiting for the mutex the chance to take it before it is taken again
+	runtime.Gosched()
+	h.ds.internalStoreMutex.Lock()
+	h.acquired = h.ds.now()
+	h.checked = h.acquired
+	return true
+}
+
+// release records how long the mutex was held and releases it
+func (h *lockHold) release() {
+	released := h.ds.now()
+	if held := released.Sub(h.acquired); held > h.ds.longestLockHold {
+		h.ds.longestLockHold = held
+	}
+	if h.ds.lockHoldHook != nil {
+		h.ds.lockHoldHook(h.acquired, released)
+	}
+	h.ds.internalStoreMutex.Unlock()
+}
@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tickingClock advances by a millisecond every time it is read, so how long a bulk operation holds the mutex depends
+// only on how often it looks at the clock
+func tickingClock() func() time.Time {
+	var mutex sync.Mutex
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+}
+
+// recordLockHolds collects how long each hold of a bulk operation lasted
+func recordLockHolds(ds *DataStore) *[]time.Duration {
+	holds := &[]time.Duration{}
+	ds.lockHoldHook = func(acquired time.Time, released time.Time) {
+		*holds = append(*holds, released.Sub(acquired))
+	}
+	return holds
+}
+
+// discardScheduledCleanups drops the cleanups writes schedule, each of which walks the whole store, so large stores can
+// be filled quickly
+func discardScheduledCleanups(t *testing.T, ds *DataStore) {
+	signal := make(chan uint64)
+	done := make(chan struct{})
+	ds.cleanupSignal = signal
+	go func() {
+		for {
+			select {
+			case <-signal:
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(done) })
+}
+
+func TestBulkOperationsReleaseTheMutexWithinMaxLockHold(t *testing.T) {
+	const keys = 2000
+	const budget = time.Millisecond * 5
+
+	operations := map[string]struct {
+		prepare func(ds *DataStore)
+		run     func(ds *DataStore)
+	}{
+		"DeleteBy": {run: func(ds *DataStore) {
+			if removed := ds.DeleteBy("bulk"); removed != keys {
+				t.Fatalf("Expected every key under the prefix to be deleted but %d were", removed)
+			}
+		}},
+		"ExpireBy": {run: func(ds *DataStore) {
+			if expired := ds.ExpireBy("bulk", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)); expired != keys {
+				t.Fatalf("Expected every key under the prefix to be given the expiration but %d were", expired)
+			}
+		}},
+		"CleanupNow": {
+			prepare: func(ds *DataStore) {
+				ds.ExpireBy("bulk", time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC))
+			},
+			run: func(ds *DataStore) {
+				ds.CleanupNow()
+				if count := ds.ApproximateCount(); count != 1 {
+					t.Fatalf("Expected the cleanup to remove every expired key but %d are left", count)
+				}
+			},
+		},
+		"Snapshot": {run: func(ds *DataStore) {
+			snapshot := ds.Snapshot()
+			defer snapshot.Release()
+			if found := len(snapshot.KeysBy("bulk")); found != keys {
+				t.Fatalf("Expected the snapshot to hold every key but it has %d", found)
+			}
+		}},
+	}
+
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			ds := NewDataStoreWithOptions(Options{Clock: tickingClock(), MaxLockHold: budget})
+			discardScheduledCleanups(t, &ds)
+			for i := 0; i < keys; i++ {
+				ds.Insert(fmt.Sprintf("bulk:%d", i), "1")
+			}
+			ds.Insert("other", "1")
+			// checked from here on only, as checking after every insert walks the whole store each time
+			ds.options.CheckInvariants = true
+			if operation.prepare != nil {
+				operation.prepare(&ds)
+			}
+
+			holds := recordLockHolds(&ds)
+			operation.run(&ds)
+
+			if len(*holds) < 2 {
+				t.Fatalf("Expected the operation to release the mutex part way through but it was held %d times", len(*holds))
+			}
+			for i, held := range *holds {
+				if held > budget {
+					t.Fatalf("Expected no hold to exceed %s but hold %d of %d lasted %s", budget, i, len(*holds), held)
+				}
+			}
+			if longest := ds.Stats().LongestLockHold; longest > budget {
+				t.Fatalf("Expected the longest hold to be within the budget but it was %s", longest)
+			}
+			if _, present := ds.Read("other"); !present {
+				t.Fatalf("Expected the key outside the prefix to be left alone")
+			}
+		})
+	}
+}
+
+func TestBulkOperationsHoldTheMutexThroughoutWithoutMaxLockHold(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{Clock: tickingClock()})
+	discardScheduledCleanups(t, &ds)
+	for i := 0; i < 5000; i++ {
+		ds.Insert(fmt.Sprintf("bulk:%d", i), "1")
+	}
+
+	holds := recordLockHolds(&ds)
+	ds.DeleteBy("bulk")
+	if len(*holds) != 1 {
+		t.Fatalf("Expected DeleteBy to hold the mutex once but it was held %d times", len(*holds))
+	}
+	if longest := ds.Stats().LongestLockHold; longest != (*holds)[0] {
+		t.Fatalf("Expected the hold to be recorded as the longest but found %s", longest)
+	}
+}
+
+func TestSlicedSnapshotsAreASingleInstant(t *testing.T) {
+	withParallelism(t)
+
+	ds := NewDataStoreWithOptions(Options{MaxLockHold: time.Microsecond * 50})
+	discardScheduledCleanups(t, &ds)
+	for i := 0; i < 2000; i++ {
+		ds.Insert(fmt.Sprintf("filler:%d", i), "1")
+	}
+	ds.Insert("token:0", "1")
+
+	// the token moves from key to key, and every instant of the store holds it exactly once
+	done := make(chan struct{})
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				ds.Rename(fmt.Sprintf("token:%d", i), fmt.Sprintf("token:%d", i+1), false)
+			}
+		}
+	}()
+	defer waitGroup.Wait()
+	defer close(done)
+
+	for i := 0; i < 20; i++ {
+		snapshot := ds.Snapshot()
+		tokens := snapshot.KeysBy("token")
+		snapshot.Release()
+		if len(tokens) != 1 {
+			t.Fatalf("Expected the snapshot to hold the token exactly once but found %v", tokens)
+		}
+	}
+}
+
+func TestReadsAreNotHeldUpByAHugeDeleteBy(t *testing.T) {
+	if copyOnWriteByDefault {
+		t.Skip("reads do not take the mutex in copy-on-write mode")
+	}
+	withParallelism(t)
+
+	const budget = time.Millisecond * 2
+	ds := NewDataStoreWithOptions(Options{Clock: tickingClock(), MaxLockHold: budget})
+	discardScheduledCleanups(t, &ds)
+	for i := 0; i < 20000; i++ {
+		ds.Insert(fmt.Sprintf("bulk:%d", i), "1")
+	}
+	ds.Insert("other", "1")
+
+	var holds []time.Duration
+	var released atomic.Int64
+	ds.lockHoldHook = func(acquired time.Time, releasedAt time.Time) {
+		holds = append(holds, releasedAt.Sub(acquired))
+		released.Add(1)
+	}
+
+	// each read notes how many holds had been released by the time it completed
+	deleting := make(chan struct{})
+	done := make(chan struct{})
+	readsAfter := make(chan map[int64]bool)
+	go func() {
+		after := map[int64]bool{}
+		<-deleting
+		for {
+			select {
+			case <-done:
+				readsAfter <- after
+				return
+			default:
+				ds.Read("other")
+				after[released.Load()] = true
+			}
+		}
+	}()
+
+	close(deleting)
+	if removed := ds.DeleteBy("bulk"); removed != 20000 {
+		t.Fatalf("Expected every key under the prefix to be deleted but %d were", removed)
+	}
+	close(done)
+	after := <-readsAfter
+
+	// the clock only moves when it is read, by DeleteBy and by a read that was taking its own time when the mutex was
+	// taken again, so how long each hold lasted depends on how the work was sliced and not on the scheduler
+	if len(holds) < 2 {
+		t.Fatalf("Expected DeleteBy to release the mutex part way through but it held it %d times", len(holds))
+	}
+	for i, held := range holds {
+		if held > budget+time.Millisecond {
+			t.Fatalf("Expected no hold to exceed %s but hold %d of %d lasted %s", budget, i, len(holds), held)
+		}
+	}
+
+	interleaved := 0
+	for releasedBefore := range after {
+		if releasedBefore > 0 && releasedBefore < int64(len(holds)) {
+			interleaved++
+		}
+	}
+	if interleaved == 0 {
+		t.Fatalf("Expected reads to complete between the slices of DeleteBy but none did")
+	}
+}
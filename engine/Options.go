@@ -0,0 +1,125 @@
+package engine
+
+import "time"
+
+// Options
+/**
+* Configuration for a DataStore created with NewDataStoreWithOptions
+*
+* The zero value of every field keeps the default behavior of NewDataStore
+ */
+type Options struct {
+	// Clock returns the current time used when evaluating expirations. Defaults to time.Now. The data store never goes
+	// back in time when the clock does, see Stats.ClockRegressions
+	Clock func() time.Time
+	// AlwaysRewriteUpserts skips comparing an upserted value against the stored one, so upserting an identical value
+	// is written like any other change. Useful when values are large enough that the compare costs more than the write
+	AlwaysRewriteUpserts bool
+	// CheckInvariants validates the consistency of the store, index, and expiration tracking before every operation
+	// returns, panicking with an InvariantViolation when they disagree. The checks walk the whole data store, so this
+	// is only meant for tests and debugging
+	CheckInvariants bool
+	// TTLRules limit how long keys under some prefixes may live, see TTLRule and DataStore.SetTTLPolicy
+	TTLRules []TTLRule
+	// StaleWindow keeps expired keys around for this long before the cleanup removes them, so ReadStale can still
+	// serve them. Expired keys are absent to every other operation whatever the window is
+	StaleWindow time.Duration
+	// DefaultTTL gives keys created by Insert or Upsert without an expiration one DefaultTTL from when they were written,
+	// see DataStore.SetDefaultTTL. Zero leaves them without an expiration
+	DefaultTTL time.Duration
+	// ExpirationArchive is given every key that expires once it is removed, by the cleanup or by a write replacing it,
+	// instead of the key vanishing, see ArchiveSink. Nil leaves expired keys to vanish
+	ExpirationArchive ArchiveSink
+	// ArchiveAttempts is how many times the ExpirationArchive may fail to archive a key before the key is dropped and
+	// counted in Stats.ArchiveDropped. Defaults to 3
+	ArchiveAttempts int
+	// ArchiveQueue limits how many expired keys may wait for the ExpirationArchive, keys that expire while it is full
+	// are dropped and counted in Stats.ArchiveDropped. Defaults to 10000
+	ArchiveQueue int
+	// ChangeRetention is how many of the most recent changes are kept for DataStore.ChangesSince. Zero keeps none, so
+	// ChangesSince asks for a resync whenever a change was missed
+	ChangeRetention int
+	// ChangeRetentionAge drops retained changes older than it, zero keeps them until ChangeRetention pushes them out
+	ChangeRetentionAge time.Duration
+	// ChangeFeed is sent every change as it is made, numbered after the changes the feed already holds, see ChangeFeed.
+	// Changes the feed fails to append are counted in Stats.ChangeFeedFailures. Nil sends changes nowhere
+	ChangeFeed ChangeFeed
+	// SubscriptionBuffer is how many changes each subscriber of DataStore.Subscribe may fall behind by before changes to
+	// it are dropped, zero uses DefaultSubscriptionBuffer
+	SubscriptionBuffer int
+	// KeySeparator splits keys into the segments KeysBy, DeleteBy, and the other prefix operations match on, TTL rules
+	// and KeyLimits included. It may be longer than one character. Empty uses DefaultKeySeparator
+	KeySeparator string
+	// KeyLimits bound the keys writes may create, see KeyLimits. Zero fields take the defaults
+	KeyLimits KeyLimits
+	// MaxValueLength is the longest value Insert, Update, Upsert, GetOrSet, ReadAndUpdate, UpdateBy, and HSet accept,
+	// longer values are refused without writing anything, see DataStore.CheckValue. Zero accepts values of any length
+	MaxValueLength int
+	// CopyOnWriteReads serves Read, ReadStale, ReadWithStatus, ReadExpiration, Present, and PresentMulti from a copy of
+	// the store that every write replaces, so reads never take the mutex and are not held up by writes or by each
+	// other. Each write that changes anything copies the whole store while holding the mutex, which costs about 100ns a
+	// key, so it only pays off for read-mostly data stores of up to around 100,000 keys written a few times a second.
+	// Everything else, KeysBy and the other operations on the key index included, still takes the mutex
+	CopyOnWriteReads bool
+	// SpillDirectory keeps values longer than SpillThreshold in files in the directory instead of in memory, read back
+	// transparently. Files are removed when their key is replaced, deleted, expired, or truncated, and files nothing
+	// refers to are removed when the data store is created, see ReconcileSpills. Values written to the change log or
+	// the expiration archive are read back into memory. Empty keeps every value in memory
+	SpillDirectory string
+	// SpillThreshold is the longest value kept in memory when SpillDirectory is set, zero uses DefaultSpillThreshold
+	SpillThreshold int
+	// MaxLockHold bounds how long DeleteBy, ExpireBy, Snapshot, and the cleanup of expired keys hold the mutex. They
+	// work through their keys in slices, releasing the mutex between them for the operations waiting on it, so a bulk
+	// operation is no longer a single instant to other writers, see each of them. The clock is looked at every few
+	// dozen keys, releasing the mutex when the next few dozen would keep it past MaxLockHold. Operations on a single key
+	// are not sliced. Zero holds the mutex for the whole operation, see Stats.LongestLockHold
+	MaxLockHold time.Duration
+	// WaterMarks refuse writes that would create keys once the data store holds too much, until enough of it is
+	// deleted or expires, see WaterMarks and DataStore.SetWaterMarks. The zero value never refuses them
+	WaterMarks WaterMarks
+	// MaxKeys turns the data store into a bounded cache, evicting a key chosen by EvictionPolicy whenever a write would
+	// create a key past MaxKeys, see Stats.Evicted. Expired keys that have not been cleaned up yet count towards it.
+	// Reads and writes of a key count as using it, reads then take a mutex of their own to record it. Zero never evicts
+	MaxKeys int
+	// EvictionPolicy chooses the key MaxKeys evicts, the least recently used one unless set
+	EvictionPolicy EvictionPolicy
+	// CleanupInterval removes expired keys this often in the background, on top of the cleanup every write schedules,
+	// until DataStore.Close. Zero leaves them to the cleanups scheduled by writes and to DataStore.CleanupNow
+	CleanupInterval time.Duration
+	// OnCleanup is called with how many expired keys each cleanup removed, after it has released the mutex, for the
+	// cleanups writes schedule, those run every CleanupInterval, and CleanupNow alike. It runs on the goroutine of the
+	// cleanup and must not call CleanupNow. Nil calls nothing
+	OnCleanup func(removed int)
+}
+
+func NewDataStoreWithOptions(options Options) DataStore {
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	var view *readView
+	if options.CopyOnWriteReads || copyOnWriteByDefault {
+		view = newReadView()
+	}
+
+	keyIndex := NewPrefixTrieWithSeparator(options.KeySeparator)
+	return DataStore{
+		inMemoryStore: map[string]dataNode{},
+		keyIndex:      keyIndex,
+		expirations:   newExpirationHeap(),
+		writes:        newWriteOrder(),
+		ttlRules:      normalizeTTLRules(options.TTLRules, keyIndex.seperator),
+		options:       options,
+		clock:         newClockGuard(options.Clock),
+		defaultTTL:    options.DefaultTTL,
+		archive:       newExpirationArchive(options),
+		changes:       newChangeLog(options, keyIndex.seperator),
+		keyLimits:     options.KeyLimits.withDefaults(),
+		valueLimit:    newValueLimit(options.MaxValueLength),
+		view:          view,
+		spill:         newSpillTier(options),
+		waterMarks:    options.WaterMarks,
+		sweeper:       newSweeper(options),
+		eviction:      newEviction(options),
+	}
+}
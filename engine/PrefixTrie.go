@@ -1,13 +1,20 @@
 package engine
 
 import (
+	"sort"
 	"strings"
 )
 
+// maxTrieDepth is the most segments a key or prefix may have, deeper keys are refused by Add and deeper prefixes match
+// nothing without the trie being walked, so no single key can make operations on the trie arbitrarily slow
+const maxTrieDepth = 4096
+
 type trieNode struct {
 	value  string
 	isKey  bool
 	leaves map[string]*trieNode
+	// count is the number of keys at or under this node, nodes other than the root are removed once it reaches zero
+	count int
 }
 
 type PrefixTrie struct {
@@ -15,27 +22,55 @@ type PrefixTrie struct {
 	seperator string
 }
 
+// DefaultKeySeparator is the separator keys are split into segments on unless another one is configured
+const DefaultKeySeparator = ":"
+
 func NewPrefixTrie() PrefixTrie {
+	return NewPrefixTrieWithSeparator(DefaultKeySeparator)
+}
+
+// NewPrefixTrieWithSeparator
+/**
+* Create a trie splitting keys into segments on the provided separator, which may be longer than one character. An
+* empty separator splits on DefaultKeySeparator. Keys may hold any other separator, it is part of their segments.
+ */
+func NewPrefixTrieWithSeparator(seperator string) PrefixTrie {
+	if seperator == "" {
+		seperator = DefaultKeySeparator
+	}
+
 	return PrefixTrie{
 		trieNode{
 			value: "",
 		},
-		":",
+		seperator,
 	}
 }
 
+// empty returns a trie with the same separator and no keys
+func (t *PrefixTrie) empty() PrefixTrie {
+	return NewPrefixTrieWithSeparator(t.seperator)
+}
+
 // Add
 /**
 * Add a key to the trie as a root key and index all other parts of the key delimited by the configured seperator
+*
+* Returns false without adding anything when the key has more than maxTrieDepth segments.
  */
-func (t *PrefixTrie) Add(prefix string) {
+func (t *PrefixTrie) Add(prefix string) bool {
+	if t.tooDeep(prefix) {
+		return false
+	}
+
 	prefixComponents := strings.Split(prefix, t.seperator)
 	var currentValue strings.Builder
 	currentNode := &t.root
+	path := []*trieNode{currentNode}
 
 	for i, component := range prefixComponents {
 		if i > 0 {
-			currentValue.WriteString(":")
+			currentValue.WriteString(t.seperator)
 		}
 		currentValue.WriteString(component)
 
@@ -50,9 +85,18 @@ func (t *PrefixTrie) Add(prefix string) {
 		} else {
 			currentNode = currentNode.leaves[currentValue.String()]
 		}
+		path = append(path, currentNode)
+	}
+
+	if currentNode.isKey {
+		return true
 	}
 
 	currentNode.isKey = true
+	for _, node := range path {
+		node.count++
+	}
+	return true
 }
 
 // Delete
@@ -64,18 +108,55 @@ func (t *PrefixTrie) Add(prefix string) {
 * If the key has parent nodes that are not keys and do not have other children delete those as well
  */
 func (t *PrefixTrie) Delete(key string) bool {
-	_, anythingDeleted := t.deleteKey(&t.root, key)
-	return anythingDeleted
+	path := t.path(key)
+	if path == nil || !path[len(path)-1].isKey {
+		return false
+	}
+
+	path[len(path)-1].isKey = false
+	t.removeCounted(path, 1)
+	return true
 }
 
+// DeleteAll
+/**
+* Delete the node exactly matching the provided prefix along with everything under it, and any parent nodes left
+* without keys under them
+*
+* Returns whether a node matched the prefix
+ */
 func (t *PrefixTrie) DeleteAll(prefix string) bool {
-	deleteRoot, anythingDeleted := t.deleteBranch(&t.root, prefix)
+	path := t.path(prefix)
+	if path == nil {
+		return false
+	}
 
-	if deleteRoot {
+	node := path[len(path)-1]
+	if node == &t.root {
 		t.root.leaves = map[string]*trieNode{}
+		t.root.count = 0
+		return true
+	}
+
+	removed := node.count
+	node.count = 0
+	t.removeCounted(path[:len(path)-1], removed)
+	delete(path[len(path)-2].leaves, node.value)
+	return true
+}
+
+// CountUnder
+/**
+* Count the keys that start with the provided prefix in O(depth) using the node counters, with the same rules for
+* matching a prefix as Find
+ */
+func (t *PrefixTrie) CountUnder(prefix string) int {
+	path := t.path(prefix)
+	if path == nil {
+		return 0
 	}
 
-	return anythingDeleted
+	return path[len(path)-1].count
 }
 
 // Find
@@ -87,126 +168,302 @@ func (t *PrefixTrie) DeleteAll(prefix string) bool {
 * but not the searches "cou", "country:", or "country:Canada"
  */
 func (t *PrefixTrie) Find(prefix string) []string {
-	prefixComponents := strings.Split(prefix, t.seperator)
-	var currentValue strings.Builder
+	path := t.path(prefix)
+	if path == nil {
+		return nil
+	}
+
+	return t.findKeys(path[len(path)-1])
+}
+
+// FindLimit
+/**
+* Find up to limit keys that start with the provided prefix, with the same rules for matching a prefix as Find. Which
+* keys are found when there are more is unspecified. The walk stops once it has found enough, so a call costs about as
+* much as the keys it returns however many are under the prefix.
+ */
+func (t *PrefixTrie) FindLimit(prefix string, limit int) []string {
+	path := t.path(prefix)
+	if path == nil {
+		return nil
+	}
+
+	return t.findKeysLimit(path[len(path)-1], nil, limit)
+}
+
+// Each calls visit with every key that starts with the provided prefix, with the same rules for matching a prefix as
+// Find, without collecting the keys into a slice
+func (t *PrefixTrie) Each(prefix string, visit func(key string)) {
+	path := t.path(prefix)
+	if path == nil {
+		return
+	}
+
+	t.eachKey(path[len(path)-1], visit)
+}
+
+// EachAfter
+/**
+* Call visit with the keys that start with the provided prefix and come after the key after, in segment order, until
+* visit returns false. The prefix matches with the same rules as Find, an empty after starts from the first key.
+*
+* Segment order compares keys one segment at a time, a key coming before the keys under it. It is the order of a walk
+* of the trie, so a walk can resume after any key whether or not it is still in the trie, and each call costs about as
+* much as the keys it visits plus sorting the children of the nodes it passes through.
+ */
+func (t *PrefixTrie) EachAfter(prefix string, after string, visit func(key string) bool) {
+	path := t.path(prefix)
+	if path == nil {
+		return
+	}
+
+	var bound []string
+	if after != "" {
+		bound = strings.Split(after, t.seperator)
+	}
+	depth := len(path) - 1
+	if bound != nil && prefix != "" {
+		// the prefix decides whether its keys all come before after, all come after it, or straddle it
+		for i, component := range strings.Split(prefix, t.seperator) {
+			if i == len(bound) || component > bound[i] {
+				bound = nil
+				break
+			}
+			if component < bound[i] {
+				return
+			}
+		}
+	}
+
+	t.eachKeyAfter(path[depth], depth, bound, visit)
+}
+
+// eachKeyAfter
+/**
+* Visit the keys at and under the provided node in segment order, see EachAfter. The node is depth segments deep and a
+* bound is the segments of the key to resume after, whose first depth segments are those of the node, or nil when every
+* key under the node comes after it. Stops once visit returns false.
+ */
+func (t *PrefixTrie) eachKeyAfter(node *trieNode, depth int, bound []string, visit func(key string) bool) {
+	type step struct {
+		node  *trieNode
+		depth int
+		bound []string
+	}
+
+	// an explicit stack rather than recursion, so the walk does not grow the goroutine stack with the depth of the trie
+	steps := []step{{node, depth, bound}}
+	for len(steps) > 0 {
+		current := steps[len(steps)-1]
+		steps = steps[:len(steps)-1]
+		node, depth, bound := current.node, current.depth, current.bound
+
+		// a node on the path to the bound is the bound or a key before it
+		if bound == nil && node.isKey && !visit(node.value) {
+			return
+		}
+
+		children := make([]*trieNode, 0, len(node.leaves))
+		for _, childNode := range node.leaves {
+			if bound == nil || depth == len(bound) || t.component(node, childNode) >= bound[depth] {
+				children = append(children, childNode)
+			}
+		}
+		// siblings share every segment but their last, so their values sort like their last segments, and they are
+		// pushed last first so the first is walked next
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].value > children[j].value
+		})
+
+		for _, childNode := range children {
+			childBound := bound
+			if bound == nil || depth == len(bound) || t.component(node, childNode) > bound[depth] {
+				childBound = nil
+			}
+			steps = append(steps, step{childNode, depth + 1, childBound})
+		}
+	}
+}
+
+// component returns the segment a child adds to the value of its parent
+func (t *PrefixTrie) component(parent *trieNode, child *trieNode) string {
+	if parent == &t.root {
+		return child.value
+	}
+	return child.value[len(parent.value)+len(t.seperator):]
+}
+
+// Complete
+/**
+* Suggest completions for a partially typed key prefix
+*
+* Every segment of the partial input except the last must match the trie exactly, the last segment may be incomplete.
+* Returns the values of the child segments under the deepest fully matching segment whose final component starts with
+* the incomplete text, sorted. For example with keys "region:1:store:1" and "region:1:manager" the partial
+* "region:1:st" completes to "region:1:store", and "region:1:" (trailing seperator) completes to both
+* "region:1:manager" and "region:1:store". A limit of zero or less returns every completion.
+ */
+func (t *PrefixTrie) Complete(partial string, limit int) []string {
+	if t.tooDeep(partial) {
+		return nil
+	}
+
+	prefixComponents := strings.Split(partial, t.seperator)
+	trailingText := prefixComponents[len(prefixComponents)-1]
 	currentNode := &t.root
 
-	if prefix == "" {
-		return t.findKeys(currentNode)
+	for _, component := range prefixComponents[:len(prefixComponents)-1] {
+		value := component
+		if currentNode != &t.root {
+			value = currentNode.value + t.seperator + component
+		}
+
+		currentNode = currentNode.leaves[value]
+		if currentNode == nil {
+			return nil
+		}
 	}
 
-	for i, component := range prefixComponents {
-		if i > 0 {
-			currentValue.WriteString(":")
+	var completions []string
+	for value, childNode := range currentNode.leaves {
+		if strings.HasPrefix(t.component(currentNode, childNode), trailingText) {
+			completions = append(completions, value)
 		}
-		currentValue.WriteString(component)
+	}
 
-		if currentNode.leaves[currentValue.String()] == nil {
-			currentNode = nil
-			break
-		} else {
-			currentNode = currentNode.leaves[currentValue.String()]
+	sort.Strings(completions)
+	if limit > 0 && len(completions) > limit {
+		completions = completions[:limit]
+	}
+
+	return completions
+}
+
+// countNodes
+/**
+* Count every node in the trie including the root, used to check that deletes release their nodes
+ */
+func (t *PrefixTrie) countNodes() int {
+	count := 0
+	nodes := []*trieNode{&t.root}
+	for len(nodes) > 0 {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		count++
+		for _, childNode := range node.leaves {
+			nodes = append(nodes, childNode)
 		}
 	}
 
-	return t.findKeys(currentNode)
+	return count
 }
 
 // findKeys
 /**
-* Find all child nodes under the provided node that represent complete keys.
+* Find all nodes at and under the provided node that represent complete keys.
 *
-* Complete keys are nodes that either have no children or have the isKey property set to true
+* Complete keys are the nodes Add marked with isKey. Delete clears it and removes the nodes left without keys under
+* them, so every leaf is a key except the root of an empty trie, which is never returned as the key "".
  */
 func (t *PrefixTrie) findKeys(node *trieNode) []string {
-	var keys []string
-
 	if node == nil {
 		return nil
-	} else if node.leaves == nil {
-		return append(keys, node.value)
-	} else {
+	}
+
+	var keys []string
+	t.eachKey(node, func(key string) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// findKeysLimit appends the keys at and under the provided node to keys until it holds limit of them, see findKeys
+func (t *PrefixTrie) findKeysLimit(node *trieNode, keys []string, limit int) []string {
+	nodes := []*trieNode{node}
+	for len(nodes) > 0 && len(keys) < limit {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+
 		if node.isKey {
 			keys = append(keys, node.value)
 		}
-
 		for _, childNode := range node.leaves {
-			keys = append(keys, t.findKeys(childNode)...)
+			nodes = append(nodes, childNode)
 		}
-
-		return keys
 	}
+
+	return keys
 }
 
-// deleteKey
+// eachKey
 /**
-* Delete a specific child node of the provided node from the prefixTrie that exactly matches the provided key value
-*
-* What deleting means depends on whether the matching node has any child nodes.
-* If it has child nodes then the `isKey` property of the node is set to false and the node is not removed.
-* If it does not have child nodes then the node it removed from the trie and deleted. If the node has any parent nodes
-* that have no children except the deleted nodes (or other parents in the tree that fit that definition) then those are
-* deleted as well.
-*
-* Returns two booleans, the first boolean indicates whether this particular call of the method visited a node that
-* matched the provided key. This parameter is used for recursion and should not be used directly by a caller.
-* The other parameter indicates whether any recursive call of this method below this call visited a node that matched
-* the key and was deleted and is for the external caller's use.
+* Call visit with each key at and under the provided node, see findKeys. The nodes waiting to be walked are kept in a
+* slice rather than on the goroutine stack, as are those of every walk of the trie, so a deep trie cannot overflow it.
  */
-func (t *PrefixTrie) deleteKey(node *trieNode, key string) (bool, bool) {
-	anythingDeleted := false
+func (t *PrefixTrie) eachKey(node *trieNode, visit func(key string)) {
+	nodes := []*trieNode{node}
+	for len(nodes) > 0 {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
 
-	if node == nil {
-		return false, false
-	} else if node.value == key {
-		return true, node.isKey
-	} else {
-		for _, childNode := range node.leaves {
-			deleteKey, anythingDeletedHere := t.deleteKey(childNode, key)
-			anythingDeleted = anythingDeleted || anythingDeletedHere
-			if deleteKey {
-				if childNode.leaves == nil {
-					delete(node.leaves, childNode.value)
-				} else {
-					childNode.isKey = false
-				}
-			}
+		if node.isKey {
+			visit(node.value)
 		}
-
-		if node.leaves == nil && !node.isKey {
-			return true, anythingDeleted
+		for _, childNode := range node.leaves {
+			nodes = append(nodes, childNode)
 		}
-		return false, anythingDeleted
 	}
 }
 
-// deleteBranch
+// path
 /**
-* Delete a child node under the provided node that exactly matches the provided key prefix, including deleting all
-* the children of that node
-*
-* Returns two booleans, the first boolean indicates whether this particular call of the method visited a node that
-* matched the provided key. This parameter is used for recursion and should not be used directly by a caller.
-* The other parameter indicates whether any recursive call of this method below this call visited a node that matched
-* the key and was deleted and is for the external caller's use.
+* Find the nodes from the root down to the node exactly matching the provided prefix, or nil when there is no such node.
+* The empty prefix matches the root alone.
  */
-func (t *PrefixTrie) deleteBranch(node *trieNode, prefix string) (bool, bool) {
-	anythingDeleted := false
+func (t *PrefixTrie) path(prefix string) []*trieNode {
+	currentNode := &t.root
+	path := []*trieNode{currentNode}
 
-	if node == nil {
-		return false, false
-	} else if node.value == prefix {
-		return true, true
-	} else {
-		for _, childNode := range node.leaves {
-			deleteBranch, anythingDeletedHere := t.deleteBranch(childNode, prefix)
-			anythingDeleted = anythingDeleted || anythingDeletedHere
-			if deleteBranch {
-				delete(node.leaves, childNode.value)
-				break
-			}
+	if prefix == "" {
+		return path
+	}
+	if t.tooDeep(prefix) {
+		return nil
+	}
+
+	var currentValue strings.Builder
+	for i, component := range strings.Split(prefix, t.seperator) {
+		if i > 0 {
+			currentValue.WriteString(t.seperator)
+		}
+		currentValue.WriteString(component)
+
+		currentNode = currentNode.leaves[currentValue.String()]
+		if currentNode == nil {
+			return nil
 		}
+		path = append(path, currentNode)
+	}
+
+	return path
+}
+
+// tooDeep reports whether a key or prefix has more segments than the trie holds, without splitting it
+func (t *PrefixTrie) tooDeep(prefix string) bool {
+	return strings.Count(prefix, t.seperator) >= maxTrieDepth
+}
+
+// removeCounted
+/**
+* Take removed keys off the counts of every node on the path, then delete the nodes at the end of the path that are left
+* without any keys, so no branch of the trie outlives its keys
+ */
+func (t *PrefixTrie) removeCounted(path []*trieNode, removed int) {
+	for _, node := range path {
+		node.count -= removed
+	}
 
-		return false, anythingDeleted
+	for i := len(path) - 1; i > 0 && path[i].count == 0; i-- {
+		delete(path[i-1].leaves, path[i].value)
 	}
 }
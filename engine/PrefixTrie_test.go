@@ -1,8 +1,12 @@
 package engine
 
 import (
+	"fmt"
 	"golang.org/x/exp/slices"
+	"math/rand"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAddNodesWithNoSeparator(t *testing.T) {
@@ -174,6 +178,56 @@ func TestFindKeysThatHaveOtherKeysNestedUnderThem(t *testing.T) {
 }
 
 // test (not) finding incomplete prefixes
+func TestFindLimitStopsAtTheLimit(t *testing.T) {
+	trie := NewPrefixTrie()
+
+	node1 := "country:USA:state:MI"
+	node2 := "country:USA:state:MI:city:China"
+	node3 := "country:USA:state:OH:city:Sandusky"
+	node4 := "country:Canada:province:ON"
+	trie.Add(node1)
+	trie.Add(node2)
+	trie.Add(node3)
+	trie.Add(node4)
+
+	someUSANodes := trie.FindLimit("country:USA", 2)
+	if len(someUSANodes) != 2 || slices.Contains(someUSANodes, node4) {
+		t.Fatalf("expected %v to be length 2 and only contain keys under country:USA", someUSANodes)
+	}
+
+	allUSANodes := trie.FindLimit("country:USA", 10)
+	if len(allUSANodes) != 3 || !slices.Contains(allUSANodes, node1) || !slices.Contains(allUSANodes, node2) || !slices.Contains(allUSANodes, node3) {
+		t.Fatalf("expected %v to be length 3 and contain %q, %q, %q", allUSANodes, node1, node2, node3)
+	}
+
+	if empty := NewPrefixTrie(); len(empty.FindLimit("", 10)) != 0 {
+		t.Fatalf("expected an empty trie to have no keys but found %v", empty.FindLimit("", 10))
+	}
+}
+
+func TestEachVisitsTheKeysFindReturns(t *testing.T) {
+	trie := NewPrefixTrie()
+	trie.Add("country:USA:state:MI")
+	trie.Add("country:USA:state:MI:city:China")
+	trie.Add("country:USA:state:OH:city:Sandusky")
+	trie.Add("country:Canada:province:ON")
+
+	for _, prefix := range []string{"", "country", "country:USA", "country:USA:state:MI", "country:Mexico", "cou"} {
+		var visited []string
+		trie.Each(prefix, func(key string) { visited = append(visited, key) })
+
+		found := trie.Find(prefix)
+		slices.Sort(visited)
+		slices.Sort(found)
+		if !slices.Equal(visited, found) {
+			t.Fatalf("expected Each(%q) to visit %v but it visited %v", prefix, found, visited)
+		}
+	}
+
+	empty := NewPrefixTrie()
+	empty.Each("", func(key string) { t.Fatalf("expected an empty trie to have no keys but visited %q", key) })
+}
+
 func TestTryToFindWithIncompletePrefix(t *testing.T) {
 	trie := NewPrefixTrie()
 
@@ -278,6 +332,42 @@ func TestDeletePrefixThatIsNotAKey(t *testing.T) {
 	}
 }
 
+func TestDeleteAllPrunesAncestorsLeftWithoutKeys(t *testing.T) {
+	trie := NewPrefixTrie()
+	trie.Add("a:b:c:d")
+
+	if !trie.DeleteAll("a:b") || len(trie.root.leaves) != 0 || trie.countNodes() != 1 {
+		t.Fatalf("Expected deleting a:b to leave the root without leaves but found %d nodes", trie.countNodes())
+	}
+
+	trie.Add("a")
+	trie.Add("a:b:c:d")
+	if !trie.DeleteAll("a:b") || trie.countNodes() != 2 || !slices.Equal(trie.Find(""), []string{"a"}) {
+		t.Fatalf("Expected deleting a:b to keep the key a and nothing under it but found %d nodes", trie.countNodes())
+	}
+}
+
+func TestCreatingAndDeletingNamespacesReturnsToTheBaselineNodeCount(t *testing.T) {
+	trie := NewPrefixTrie()
+	trie.Add("config")
+	baseline := trie.countNodes()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10_000; i++ {
+			namespace := fmt.Sprintf("tenant:%d:round:%d", i, round)
+			trie.Add(namespace + ":user:1")
+			trie.Add(namespace + ":user:2:session")
+		}
+		for i := 0; i < 10_000; i++ {
+			trie.DeleteAll(fmt.Sprintf("tenant:%d:round:%d", i, round))
+		}
+
+		if trie.countNodes() != baseline {
+			t.Fatalf("round %d: expected the trie to be back to %d nodes but found %d", round, baseline, trie.countNodes())
+		}
+	}
+}
+
 func TestDeleteAllLeafNode(t *testing.T) {
 	trie := NewPrefixTrie()
 
@@ -310,6 +400,130 @@ func TestDeleteAllLeafNode(t *testing.T) {
 	}
 }
 
+func TestCompletePartialPrefix(t *testing.T) {
+	trie := NewPrefixTrie()
+
+	trie.Add("region:1:store:1")
+	trie.Add("region:1:store:2")
+	trie.Add("region:1:manager")
+	trie.Add("region:10:store:1")
+	trie.Add("regional")
+
+	completions := trie.Complete("region:1:st", 10)
+	if !slices.Equal(completions, []string{"region:1:store"}) {
+		t.Fatalf("expected [region:1:store] but got %v", completions)
+	}
+
+	completions = trie.Complete("region:1", 10)
+	if !slices.Equal(completions, []string{"region:1", "region:10"}) {
+		t.Fatalf("expected [region:1 region:10] but got %v", completions)
+	}
+
+	completions = trie.Complete("region:1:store:", 1)
+	if !slices.Equal(completions, []string{"region:1:store:1"}) {
+		t.Fatalf("expected the limit to keep only [region:1:store:1] but got %v", completions)
+	}
+
+	completions = trie.Complete("", 0)
+	if !slices.Equal(completions, []string{"region", "regional"}) {
+		t.Fatalf("expected every root segment but got %v", completions)
+	}
+
+	completions = trie.Complete("region:1:store:1:", 0)
+	if completions != nil {
+		t.Fatalf("expected no completions under a leaf but got %v", completions)
+	}
+}
+
+func TestCountUnderMatchesBruteForceCounts(t *testing.T) {
+	seed := time.Now().UnixNano()
+	random := rand.New(rand.NewSource(seed))
+	trie := NewPrefixTrie()
+	keys := map[string]bool{}
+
+	prefixes := []string{"", "a", "b"}
+	for _, first := range []string{"a", "b"} {
+		for second := 0; second < 3; second++ {
+			prefixes = append(prefixes, fmt.Sprintf("%s:%d", first, second))
+			for third := 0; third < 3; third++ {
+				prefixes = append(prefixes, fmt.Sprintf("%s:%d:%d", first, second, third))
+			}
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		prefix := prefixes[random.Intn(len(prefixes))]
+		switch random.Intn(4) {
+		case 0, 1:
+			if prefix != "" {
+				trie.Add(prefix)
+				keys[prefix] = true
+			}
+		case 2:
+			trie.Delete(prefix)
+			delete(keys, prefix)
+		case 3:
+			if random.Intn(10) == 0 {
+				trie.DeleteAll(prefix)
+				for key := range keys {
+					if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+":") {
+						delete(keys, key)
+					}
+				}
+			}
+		}
+
+		// every remaining node is a distinct prefix of a remaining key, anything more is a branch left behind
+		indexed := map[string]bool{}
+		for _, candidate := range prefixes {
+			expected := 0
+			for key := range keys {
+				if candidate == "" || key == candidate || strings.HasPrefix(key, candidate+":") {
+					expected++
+				}
+			}
+			if counted := trie.CountUnder(candidate); counted != expected {
+				t.Fatalf("seed %d, step %d: expected %d keys under %q but counted %d", seed, i, expected, candidate, counted)
+			}
+			if candidate != "" && expected > 0 {
+				indexed[candidate] = true
+			}
+		}
+		if trie.countNodes() != len(indexed)+1 {
+			t.Fatalf("seed %d, step %d: expected %d nodes for %d keys but found %d", seed, i, len(indexed)+1, len(keys), trie.countNodes())
+		}
+	}
+}
+
+func TestCountUnderIncompletePrefix(t *testing.T) {
+	trie := NewPrefixTrie()
+	trie.Add("country:USA:state:MI")
+	trie.Add("country:USA:state:OH")
+	trie.Add("country:USA:state:OH")
+
+	for prefix, expected := range map[string]int{"": 2, "country": 2, "country:USA:state:OH": 1, "cou": 0, "country:": 0, "country:Canada": 0} {
+		if counted := trie.CountUnder(prefix); counted != expected {
+			t.Fatalf("Expected %d keys under %q but counted %d", expected, prefix, counted)
+		}
+	}
+}
+
+func TestKeysDeeperThanTheTrieAreRefused(t *testing.T) {
+	trie := NewPrefixTrie()
+	deepest := strings.Repeat("a:", maxTrieDepth-1) + "a"
+	tooDeep := deepest + ":a"
+
+	if !trie.Add(deepest) || trie.Add(tooDeep) {
+		t.Fatalf("Expected keys of up to %d segments to be added and deeper keys refused", maxTrieDepth)
+	}
+	if trie.CountUnder("") != 1 || trie.CountUnder(deepest) != 1 || trie.Find(tooDeep) != nil || trie.Complete(tooDeep, 0) != nil {
+		t.Fatalf("Expected only the deepest key allowed to be indexed")
+	}
+	if trie.Delete(tooDeep) || !trie.Delete(deepest) || trie.countNodes() != 1 {
+		t.Fatalf("Expected deleting the deepest key to release every node but found %d", trie.countNodes())
+	}
+}
+
 func collectLeaves(node *trieNode) []trieNode {
 	var leaves []trieNode
 
@@ -323,3 +537,156 @@ func collectLeaves(node *trieNode) []trieNode {
 		return leaves
 	}
 }
+
+func TestEachAfterResumesInSegmentOrder(t *testing.T) {
+	trie := NewPrefixTrie()
+	for _, key := range []string{"a-x", "a:c", "a", "b", "a:b:z", "a:b", ":x"} {
+		trie.Add(key)
+	}
+
+	collect := func(prefix string, after string) []string {
+		visited := []string{}
+		trie.EachAfter(prefix, after, func(key string) bool {
+			visited = append(visited, key)
+			return true
+		})
+		return visited
+	}
+
+	// a comes before the keys under it, which come before a-x although "-" sorts before ":"
+	expected := []string{":x", "a", "a:b", "a:b:z", "a:c", "a-x", "b"}
+	if visited := collect("", ""); !slices.Equal(visited, expected) {
+		t.Fatalf("expected the keys in segment order %v but visited %v", expected, visited)
+	}
+	for i, after := range expected {
+		if visited := collect("", after); !slices.Equal(visited, expected[i+1:]) {
+			t.Fatalf("expected resuming after %q to visit %v but it visited %v", after, expected[i+1:], visited)
+		}
+	}
+
+	// resuming after a key that is not in the trie starts from where it would have been
+	if visited := collect("", "a:bb"); !slices.Equal(visited, []string{"a:c", "a-x", "b"}) {
+		t.Fatalf("expected resuming after a missing key to visit the keys after it but visited %v", visited)
+	}
+	if visited := collect("a", "a:b"); !slices.Equal(visited, []string{"a:b:z", "a:c"}) {
+		t.Fatalf("expected resuming under a prefix to visit the keys after the cursor but visited %v", visited)
+	}
+	if visited := collect("a", "0"); !slices.Equal(visited, []string{"a", "a:b", "a:b:z", "a:c"}) {
+		t.Fatalf("expected a cursor before the prefix to visit every key under it but visited %v", visited)
+	}
+	if visited := collect("a", "a-x"); len(visited) != 0 {
+		t.Fatalf("expected a cursor after the prefix to visit nothing but visited %v", visited)
+	}
+
+	var first []string
+	trie.EachAfter("", "", func(key string) bool {
+		first = append(first, key)
+		return len(first) < 2
+	})
+	if !slices.Equal(first, expected[:2]) {
+		t.Fatalf("expected the walk to stop once visit returned false but visited %v", first)
+	}
+}
+
+func TestPrefixTrieWithAMultiCharacterSeparator(t *testing.T) {
+	trie := NewPrefixTrieWithSeparator("::")
+	for _, key := range []string{"region::1::store::1", "region::1::store::2", "region::1:store:3", "region::2::store::1", "region:::x"} {
+		trie.Add(key)
+	}
+
+	// a single colon is part of a segment, and separators running into each other split where strings.Split does
+	found := trie.Find("region::1")
+	slices.Sort(found)
+	if expected := []string{"region::1::store::1", "region::1::store::2"}; !slices.Equal(found, expected) {
+		t.Fatalf("expected %v under region::1 but found %v", expected, found)
+	}
+	if found := trie.Find("region::1:store"); len(found) != 0 {
+		t.Fatalf("expected a prefix ending part way through a segment to match nothing but found %v", found)
+	}
+	if found := trie.Find("region::1:store:3"); !slices.Equal(found, []string{"region::1:store:3"}) {
+		t.Fatalf("expected the key holding single colons to be found but found %v", found)
+	}
+	if found := trie.Find("region:::x"); !slices.Equal(found, []string{"region:::x"}) {
+		t.Fatalf("expected the key with three colons to be found but found %v", found)
+	}
+	if completions := trie.Complete("region::1::st", 0); !slices.Equal(completions, []string{"region::1::store"}) {
+		t.Fatalf("expected region::1::st to complete to region::1::store but got %v", completions)
+	}
+
+	if !trie.Delete("region::1::store::1") || trie.CountUnder("region::1") != 1 {
+		t.Fatalf("expected deleting a key to leave 1 under region::1 but found %d", trie.CountUnder("region::1"))
+	}
+	if !trie.DeleteAll("region::1") || trie.CountUnder("region") != 3 {
+		t.Fatalf("expected deleting region::1 to leave 3 keys under region but found %d", trie.CountUnder("region"))
+	}
+
+	var visited []string
+	trie.EachAfter("region", "region::2", func(key string) bool {
+		visited = append(visited, key)
+		return true
+	})
+	if !slices.Equal(visited, []string{"region::2::store::1", "region:::x"}) {
+		t.Fatalf("expected resuming after region::2 to visit the keys after it but visited %v", visited)
+	}
+
+	if empty := NewPrefixTrieWithSeparator(""); empty.seperator != DefaultKeySeparator {
+		t.Fatalf("expected an empty separator to split on %q but it splits on %q", DefaultKeySeparator, empty.seperator)
+	}
+}
+
+func TestFindOnlyReturnsKeysUnderPrefixesThatExist(t *testing.T) {
+	build := func(added []string, deleted []string) PrefixTrie {
+		trie := NewPrefixTrie()
+		for _, key := range added {
+			trie.Add(key)
+		}
+		for _, key := range deleted {
+			trie.Delete(key)
+		}
+		return trie
+	}
+
+	cases := []struct {
+		name     string
+		added    []string
+		deleted  []string
+		prefix   string
+		expected []string
+	}{
+		{"empty trie", nil, nil, "", nil},
+		{"everything deleted", []string{"a", "a:b"}, []string{"a", "a:b"}, "", nil},
+		{"deleted leaf key", []string{"a", "a:b"}, []string{"a:b"}, "a:b", nil},
+		{"deleted leaf key under its parent", []string{"a", "a:b"}, []string{"a:b"}, "a", []string{"a"}},
+		{"deleted key with children", []string{"a", "a:b"}, []string{"a"}, "a", []string{"a:b"}},
+		{"deleted key never added", []string{"a:b"}, []string{"a"}, "a", []string{"a:b"}},
+		{"prefix longer than a leaf key", []string{"a"}, nil, "a:b:c", nil},
+		{"prefix longer than any key", []string{"a:b"}, nil, "a:b:c:d", nil},
+		{"prefix below a deleted key", []string{"a:b"}, []string{"a:b"}, "a:b:c", nil},
+		{"internal node that is not a key", []string{"a:b:c", "a:b:d"}, nil, "a:b", []string{"a:b:c", "a:b:d"}},
+		{"internal node whose keys were deleted", []string{"a:b:c", "a:x"}, []string{"a:b:c"}, "a:b", nil},
+		{"partial segment", []string{"abc:d"}, nil, "ab", nil},
+		{"exact key", []string{"a:b"}, nil, "a:b", []string{"a:b"}},
+	}
+
+	for _, c := range cases {
+		trie := build(c.added, c.deleted)
+		found := trie.Find(c.prefix)
+		slices.Sort(found)
+		if !slices.Equal(found, c.expected) {
+			t.Fatalf("%s: expected Find(%q) to return %v but found %v", c.name, c.prefix, c.expected, found)
+		}
+
+		var visited []string
+		trie.Each(c.prefix, func(key string) { visited = append(visited, key) })
+		slices.Sort(visited)
+		if !slices.Equal(visited, c.expected) {
+			t.Fatalf("%s: expected Each(%q) to visit %v but visited %v", c.name, c.prefix, c.expected, visited)
+		}
+		if limited := trie.FindLimit(c.prefix, 10); len(limited) != len(c.expected) {
+			t.Fatalf("%s: expected FindLimit(%q) to find %d keys but found %v", c.name, c.prefix, len(c.expected), limited)
+		}
+		if count := trie.CountUnder(c.prefix); count != len(c.expected) {
+			t.Fatalf("%s: expected CountUnder(%q) to count %d keys but counted %d", c.name, c.prefix, len(c.expected), count)
+		}
+	}
+}
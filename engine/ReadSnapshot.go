@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+type snapshotData struct {
+	nodes map[string]dataNode
+	// spill holds a reference to the file of every spilled value in nodes until the snapshot is released
+	spill *spillTier
+}
+
+// ReadSnapshot
+/**
+* A frozen view of a DataStore as of the moment Snapshot was called
+*
+* Writes and expirations that happen after the snapshot was taken are not visible through it, so readers can look at
+* many related keys as of a single instant while writers carry on. Keys that had already expired when the snapshot was
+* taken are left out of it.
+*
+* A snapshot is safe to read from several goroutines, but Release must not be called while it is being read.
+ */
+type ReadSnapshot struct {
+	data      *snapshotData
+	seperator string
+}
+
+// Snapshot
+/**
+* Capture a consistent read only view of the data store
+*
+* This version copies every live key under the lock, so taking a snapshot costs time and memory proportional to the
+* size of the store and holds up writers while the copy is made. Release the snapshot as soon as it is no longer needed
+* so the copy can be collected.
+*
+* With Options.MaxLockHold set the keys are copied a slice at a time, and the nodes that writes replace while the mutex
+* is released are kept aside so the snapshot still shows the store as it was when Snapshot was called.
+ */
+func (ds *DataStore) Snapshot() ReadSnapshot {
+	hold := ds.holdLock()
+	defer hold.release()
+	defer ds.checkInvariants("Snapshot")
+
+	timestamp := ds.now()
+	nodes := make(map[string]dataNode, len(ds.inMemoryStore))
+	copying := &snapshotCopy{originals: map[string]snapshotOriginal{}}
+	if hold.sliced() {
+		ds.snapshotCopies = append(ds.snapshotCopies, copying)
+	}
+
+	for key, node := range ds.inMemoryStore {
+		if !ds.isExpired(node, timestamp) {
+			ds.spill.acquire(node.spilled)
+			nodes[key] = node
+		}
+		hold.next()
+	}
+	ds.finishCopy(copying, nodes, timestamp)
+
+	return ReadSnapshot{data: &snapshotData{nodes: nodes, spill: ds.spill}, seperator: ds.keyIndex.seperator}
+}
+
+// snapshotCopy holds the nodes that were stored when a snapshot being copied in slices started, for every key written
+// since
+type snapshotCopy struct {
+	originals map[string]snapshotOriginal
+}
+
+type snapshotOriginal struct {
+	node    dataNode
+	present bool
+}
+
+// keepForSnapshots
+/**
+* Keep the node stored under key aside for every snapshot being copied that has not kept it yet, holding a reference to
+* its file, before a write replaces or deletes it. The caller must hold the mutex.
+ */
+func (ds *DataStore) keepForSnapshots(key string) {
+	for _, copying := range ds.snapshotCopies {
+		if _, kept := copying.originals[key]; !kept {
+			node, present := ds.inMemoryStore[key]
+			ds.spill.acquire(node.spilled)
+			copying.originals[key] = snapshotOriginal{node: node, present: present}
+		}
+	}
+}
+
+// finishCopy
+/**
+* Stop keeping nodes aside for the snapshot and put the ones it kept in place of whatever was copied for their keys, so
+* the snapshot holds the live keys as of timestamp. The caller must hold the mutex.
+ */
+func (ds *DataStore) finishCopy(copying *snapshotCopy, nodes map[string]dataNode, timestamp time.Time) {
+	for i, other := range ds.snapshotCopies {
+		if other == copying {
+			ds.snapshotCopies = append(ds.snapshotCopies[:i], ds.snapshotCopies[i+1:]...)
+			break
+		}
+	}
+
+	for key, original := range copying.originals {
+		if copied, present := nodes[key]; present {
+			ds.spill.release(copied.spilled)
+			delete(nodes, key)
+		}
+
+		if original.present && !ds.isExpired(original.node, timestamp) {
+			nodes[key] = original.node
+		} else {
+			ds.spill.release(original.node.spilled)
+		}
+	}
+}
+
+// Release drops the snapshot's copy of the data, after which the snapshot behaves as if it were empty. Files holding
+// values spilled to disk that were deleted from the store after the snapshot was taken are removed once it is released
+func (s *ReadSnapshot) Release() {
+	if s.data != nil {
+		for _, node := range s.data.nodes {
+			s.data.spill.release(node.spilled)
+		}
+	}
+	s.data = nil
+}
+
+func (s *ReadSnapshot) Read(key string) (string, bool) {
+	if s.data == nil {
+		return "", false
+	}
+
+	node, present := s.data.nodes[key]
+	if !present || node.hash != nil {
+		return "", false
+	}
+	return s.data.spill.load(node)
+}
+
+func (s *ReadSnapshot) ReadExpiration(key string) (time.Time, bool) {
+	if s.data == nil {
+		return time.Time{}, false
+	}
+
+	node, present := s.data.nodes[key]
+	return node.expiration, present && node.hasExpiration
+}
+
+func (s *ReadSnapshot) Present(key string) bool {
+	if s.data == nil {
+		return false
+	}
+
+	_, present := s.data.nodes[key]
+	return present
+}
+
+// HGetAll returns every field of the hash stored under key and whether the key holds a hash, the map is the caller's to
+// change
+func (s *ReadSnapshot) HGetAll(key string) (map[string]string, bool) {
+	if s.data == nil {
+		return nil, false
+	}
+
+	node, present := s.data.nodes[key]
+	if !present || node.hash == nil {
+		return nil, false
+	}
+
+	fields := make(map[string]string, node.hash.length())
+	for name, value := range node.hash.fields {
+		fields[name] = value
+	}
+	return fields, true
+}
+
+func (s *ReadSnapshot) Count() int {
+	if s.data == nil {
+		return 0
+	}
+
+	return len(s.data.nodes)
+}
+
+// KeysBy
+/**
+* Find all keys in the snapshot under the provided prefix, sorted
+*
+* Matches the same separator bounded prefixes as DataStore.KeysBy, but scans every key in the snapshot rather than
+* using an index.
+ */
+func (s *ReadSnapshot) KeysBy(prefix string) []string {
+	var keys []string
+	for _, key := range s.sortedKeys() {
+		if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+s.seperator) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// ForEach
+/**
+* Call fn for every key in the snapshot in sorted key order until it returns false. The expiration is the zero time
+* for keys that do not expire.
+ */
+func (s *ReadSnapshot) ForEach(fn func(key string, value string, expiration time.Time) bool) {
+	for _, key := range s.sortedKeys() {
+		node := s.data.nodes[key]
+		var expiration time.Time
+		if node.hasExpiration {
+			expiration = node.expiration
+		}
+
+		value, _ := s.data.spill.load(node)
+		if !fn(key, value, expiration) {
+			return
+		}
+	}
+}
+
+// sortedKeys returns every key in the snapshot in sorted order
+func (s *ReadSnapshot) sortedKeys() []string {
+	if s.data == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(s.data.nodes))
+	for key := range s.data.nodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
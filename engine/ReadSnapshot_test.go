@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSnapshotIsUnaffectedByLaterWrites(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	ds := NewDataStoreWithOptions(Options{Clock: clock})
+	// the clock is moved below, which would race with cleanups running in the background
+	ds.cleanupSignal = make(chan uint64, 5000)
+
+	expected := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("region:%d:store:%d", i%10, i)
+		ds.Insert(key, "abc123")
+		expected[key] = "abc123"
+	}
+	ds.Expire("region:0:store:0", now.Add(-time.Second))
+	delete(expected, "region:0:store:0")
+	ds.Expire("region:1:store:1", now.Add(time.Minute))
+
+	snapshot := ds.Snapshot()
+	defer snapshot.Release()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("region:%d:store:%d", i%10, i)
+		switch i % 4 {
+		case 0:
+			ds.Delete(key)
+		case 1:
+			ds.Update(key, "def456")
+		case 2:
+			ds.Expire(key, now.Add(time.Second))
+		case 3:
+			ds.Insert(fmt.Sprintf("region:%d:new:%d", i%10, i), "ghi789")
+		}
+	}
+	ds.DeleteBy("region:5")
+	now = now.Add(time.Hour) // expire everything with an expiration
+
+	if snapshot.Count() != len(expected) {
+		t.Fatalf("expected the snapshot to hold %d keys but found %d", len(expected), snapshot.Count())
+	}
+
+	seen := 0
+	snapshot.ForEach(func(key string, value string, expiration time.Time) bool {
+		seen++
+		if expected[key] != value {
+			t.Fatalf("expected key %q to hold %q in the snapshot but found %q", key, expected[key], value)
+		}
+		return true
+	})
+	if seen != len(expected) {
+		t.Fatalf("expected ForEach to visit %d keys but it visited %d", len(expected), seen)
+	}
+
+	if snapshot.Present("region:0:store:0") {
+		t.Fatalf("expected a key that had already expired to be left out of the snapshot")
+	}
+
+	expiration, present := snapshot.ReadExpiration("region:1:store:1")
+	if !present || !expiration.Equal(now.Add(-time.Hour).Add(time.Minute)) {
+		t.Fatalf("expected the snapshot to keep the expiration from when it was taken but found %q", expiration)
+	}
+
+	value, present := snapshot.Read("region:5:store:5")
+	if !present || value != "abc123" {
+		t.Fatalf("expected a key deleted after the snapshot to still be readable from it but found %q", value)
+	}
+
+	region5 := snapshot.KeysBy("region:5")
+	if len(region5) != 100 || !slices.IsSorted(region5) {
+		t.Fatalf("expected 100 sorted keys under region:5 but found %d", len(region5))
+	}
+	if snapshot.KeysBy("region:5:st") != nil {
+		t.Fatalf("expected KeysBy to only match complete prefix segments")
+	}
+}
+
+func TestReleasedSnapshotCanBeCollected(t *testing.T) {
+	ds := NewDataStore()
+	for i := 0; i < 10000; i++ {
+		ds.Insert(fmt.Sprintf("region:%d:store:%d", i%10, i), "abc123")
+	}
+
+	snapshot := ds.Snapshot()
+	collected := make(chan bool, 1)
+	runtime.SetFinalizer(snapshot.data, func(*snapshotData) { collected <- true })
+
+	snapshot.Release()
+	if snapshot.Count() != 0 || snapshot.Present("region:1:store:1") {
+		t.Fatalf("expected a released snapshot to be empty")
+	}
+
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case <-collected:
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	t.Fatalf("expected the released snapshot's copy of the data to be garbage collected")
+}
+
+func TestSnapshotHoldsTheFieldsOfHashes(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.HSet("user:1", "name", "ada")
+	ds.Insert("plain", "1")
+
+	snapshot := ds.Snapshot()
+	defer snapshot.Release()
+	ds.HSet("user:1", "name", "grace")
+
+	fields, holdsHash := snapshot.HGetAll("user:1")
+	if !holdsHash || len(fields) != 1 || fields["name"] != "ada" {
+		t.Fatalf("Expected the fields as they were when the snapshot was taken but found %v", fields)
+	}
+	if _, holdsHash := snapshot.HGetAll("plain"); holdsHash {
+		t.Fatalf("Expected a key holding a string not to be reported as a hash")
+	}
+}
@@ -0,0 +1,45 @@
+package engine
+
+// defaultScanLimit is how many keys Scan returns when it is not given a limit
+const defaultScanLimit = 100
+
+// Scan
+/**
+* Page through the keys matching the prefix, returning at most limit of them and the cursor to pass to the next call to
+* continue after them. Start with an empty cursor, the cursor returned is empty once there are no more keys. A limit of
+* zero or less returns up to 100 keys. See KeysBy for how prefixes match.
+*
+* Keys are returned in segment order, see PrefixTrie.EachAfter, and the cursor is the last key returned, so a scan
+* tolerates writes between calls: a key present for the whole scan is returned exactly once, and no key is returned
+* twice. Keys added or deleted while the scan is under way may or may not be returned. Each call holds the mutex for
+* about as long as it takes to find its keys, however many keys match the prefix.
+ */
+func (ds *DataStore) Scan(prefix string, cursor string, limit int) ([]string, string) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Scan")
+
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	timestamp := ds.now()
+	keys := []string{}
+	more := false
+	ds.keyIndex.EachAfter(prefix, cursor, func(key string) bool {
+		if !ds.isLive(key, timestamp) {
+			return true
+		}
+		if len(keys) == limit {
+			// one key past the page tells the caller there is another page
+			more = true
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+
+	if !more {
+		return keys, ""
+	}
+	return keys, keys[len(keys)-1]
+}
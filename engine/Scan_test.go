@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// scanAll pages through the keys under prefix limit at a time, calling between with each page before asking for the
+// next one, and returns how many times each key was returned
+func scanAll(t *testing.T, ds *DataStore, prefix string, limit int, between func(page []string)) map[string]int {
+	seen := map[string]int{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 1_000_000 {
+			t.Fatalf("Expected the scan to finish but it was still going after %d pages", pages)
+		}
+
+		keys, next := ds.Scan(prefix, cursor, limit)
+		if len(keys) > limit {
+			t.Fatalf("Expected at most %d keys in a page but found %d", limit, len(keys))
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		if between != nil {
+			between(keys)
+		}
+		if next == "" {
+			return seen
+		}
+		cursor = next
+	}
+}
+
+func TestScanPagesThroughEveryKey(t *testing.T) {
+	if copyOnWriteByDefault {
+		t.Skip("copying a hundred thousand keys on every insert is not what this tests")
+	}
+
+	ds := NewDataStore()
+	for i := 0; i < 100_000; i++ {
+		ds.Insert(fmt.Sprintf("region:%d:store:%d", i%10, i), "1")
+	}
+
+	seen := scanAll(t, &ds, "", 1000, nil)
+	if len(seen) != 100_000 {
+		t.Fatalf("Expected the scan to return all 100000 keys but found %d", len(seen))
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Fatalf("Expected %q to be returned once but it was returned %d times", key, times)
+		}
+	}
+
+	seen = scanAll(t, &ds, "region:3", 1000, nil)
+	if len(seen) != 10_000 {
+		t.Fatalf("Expected the scan of region:3 to return its 10000 keys but found %d", len(seen))
+	}
+}
+
+func TestScanToleratesWritesBetweenPages(t *testing.T) {
+	ds := NewDataStore()
+	for i := 0; i < 1000; i++ {
+		ds.Insert(fmt.Sprintf("user:%03d", i), "1")
+		ds.Insert(fmt.Sprintf("user:%03d:session", i), "1")
+	}
+
+	added := 0
+	seen := scanAll(t, &ds, "user", 50, func(page []string) {
+		for _, key := range page {
+			// deleting the key the cursor points at must not lose the place
+			ds.Delete(key)
+			ds.Insert(fmt.Sprintf("%s:new:%d", key, added), "1")
+			added++
+		}
+		ds.Delete("user:999:session")
+	})
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user:%03d", i)
+		if seen[key] != 1 {
+			t.Fatalf("Expected %q to be returned once but it was returned %d times", key, seen[key])
+		}
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Fatalf("Expected %q to be returned at most once but it was returned %d times", key, times)
+		}
+	}
+	if seen["user:999:session"] != 0 {
+		t.Fatalf("Expected a key deleted before the scan reached it not to be returned")
+	}
+}
+
+func TestScanSkipsExpiredKeys(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }})
+	ds.cleanupSignal = make(chan uint64, 10)
+	ds.Insert("a", "1")
+	ds.Insert("b", "1")
+	ds.Insert("c", "1")
+	ds.Expire("b", now.Add(time.Minute))
+	now = now.Add(time.Hour)
+
+	keys, cursor := ds.Scan("", "", 2)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" || cursor != "" {
+		t.Fatalf("Expected the live keys a and c in one page but found %v and cursor %q", keys, cursor)
+	}
+
+	if keys, cursor := ds.Scan("missing", "", 0); len(keys) != 0 || cursor != "" {
+		t.Fatalf("Expected no keys under a missing prefix but found %v and cursor %q", keys, cursor)
+	}
+}
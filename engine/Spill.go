@@ -0,0 +1,324 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSpillThreshold is the longest value kept in memory when Options.SpillDirectory is set without a threshold
+	DefaultSpillThreshold = 1 << 20
+	// spillSuffix ends the name of every file the spill tier writes, other files in the directory are left alone
+	spillSuffix = ".spill"
+)
+
+// spilledValue is a value stored in a file instead of in its dataNode, the file is never modified once written
+type spilledValue struct {
+	path   string
+	length int
+	// sum is the SHA-256 of the value, so writes can tell whether they change a spilled value without reading it back
+	sum [sha256.Size]byte
+}
+
+// spillTier
+/**
+* Keeps values longer than the threshold in files in dir, one file per written value, named by a hash of the key it was
+* written under followed by a random suffix
+*
+* Files are reference counted: the store holds a reference for as long as a node refers to the file, and writes, reads,
+* and snapshots hold one while they use it, so a file replaced or deleted in the store stays readable until the last of
+* them is done and is then removed. A nil spillTier keeps every value in memory.
+ */
+type spillTier struct {
+	dir       string
+	threshold int
+
+	mutex    sync.Mutex
+	refs     map[string]int
+	failures int
+}
+
+func newSpillTier(options Options) *spillTier {
+	if options.SpillDirectory == "" {
+		return nil
+	}
+
+	tier := &spillTier{dir: options.SpillDirectory, threshold: options.SpillThreshold, refs: map[string]int{}}
+	if tier.threshold <= 0 {
+		tier.threshold = DefaultSpillThreshold
+	}
+	os.MkdirAll(tier.dir, 0o755)
+	tier.reconcile()
+
+	return tier
+}
+
+// spill
+/**
+* Write a value longer than the threshold to a new file, returning nil for values kept in memory. The caller holds the
+* only reference to the file and must release it. A value that cannot be written is kept in memory and counted as a
+* failure.
+ */
+func (s *spillTier) spill(key string, value string) *spilledValue {
+	if s == nil || len(value) <= s.threshold {
+		return nil
+	}
+
+	keySum := sha256.Sum256([]byte(key))
+	file, err := os.CreateTemp(s.dir, hex.EncodeToString(keySum[:8])+"-*"+spillSuffix)
+	if err != nil {
+		s.fail()
+		return nil
+	}
+
+	spilled := &spilledValue{path: file.Name(), length: len(value), sum: sha256.Sum256([]byte(value))}
+	// referenced before it is written so reconciling the directory meanwhile leaves it alone
+	s.mutex.Lock()
+	s.refs[spilled.path] = 1
+	s.mutex.Unlock()
+
+	_, err = io.WriteString(file, value)
+	closeErr := file.Close()
+	if err != nil || closeErr != nil {
+		s.release(spilled)
+		s.fail()
+		return nil
+	}
+
+	return spilled
+}
+
+// acquire takes a reference to the file of a spilled value, reporting false when the file has already been removed
+func (s *spillTier) acquire(spilled *spilledValue) bool {
+	if s == nil || spilled == nil {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.refs[spilled.path] == 0 {
+		return false
+	}
+	s.refs[spilled.path]++
+	return true
+}
+
+// release drops a reference to the file of a spilled value, removing the file once nothing refers to it
+func (s *spillTier) release(spilled *spilledValue) {
+	if s == nil || spilled == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.refs[spilled.path]--
+	if s.refs[spilled.path] > 0 {
+		return
+	}
+	delete(s.refs, spilled.path)
+	os.Remove(spilled.path)
+}
+
+// load returns the value of a node, reading it from its file when it was spilled. The caller must hold a reference to
+// the file. Reports false, counting a failure, when the file cannot be read.
+func (s *spillTier) load(node dataNode) (string, bool) {
+	if node.spilled == nil {
+		return node.value, true
+	}
+
+	file, err := os.Open(node.spilled.path)
+	if err != nil {
+		s.fail()
+		return "", false
+	}
+	defer file.Close()
+
+	var value strings.Builder
+	value.Grow(node.spilled.length)
+	_, err = io.Copy(&value, file)
+	if err != nil || value.Len() != node.spilled.length {
+		s.fail()
+		return "", false
+	}
+	return value.String(), true
+}
+
+// holds reports whether a file is referenced
+func (s *spillTier) holds(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.refs[path] > 0
+}
+
+func (s *spillTier) fail() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures++
+}
+
+func (s *spillTier) failureCount() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failures
+}
+
+// reconcile removes the spill files in the directory that nothing refers to, returning how many were removed
+func (s *spillTier) reconcile() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := 0
+	for _, entry := range entries {
+		path := filepath.Join(s.dir, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spillSuffix) || s.refs[path] > 0 {
+			continue
+		}
+		if os.Remove(path) == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// sameValue reports whether a node holds value, spilled as the provided spilled value when it is not nil
+func sameValue(node dataNode, value string, spilled *spilledValue) bool {
+	if node.spilled == nil || spilled == nil {
+		return node.spilled == nil && spilled == nil && node.value == value
+	}
+	return node.spilled.length == spilled.length && node.spilled.sum == spilled.sum
+}
+
+// holdsValue reports whether a node holds value, hashing value to compare it with a spilled one
+func holdsValue(node dataNode, value string) bool {
+	if node.spilled == nil {
+		return node.value == value
+	}
+	return node.spilled.length == len(value) && node.spilled.sum == sha256.Sum256([]byte(value))
+}
+
+// ReconcileSpills
+/**
+* Remove the files in Options.SpillDirectory that no key refers to, such as those left behind when the process stopped
+* without deleting them, returning how many were removed. A data store reconciles the directory when it is created, as
+* it starts empty every file in the directory is removed then.
+ */
+func (ds *DataStore) ReconcileSpills() (int, error) {
+	if ds.spill == nil {
+		return 0, nil
+	}
+
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return ds.spill.reconcile()
+}
+
+// newNode creates the node storing value, or referring to its file when it was spilled
+func newNode(value string, spilled *spilledValue) dataNode {
+	if spilled != nil {
+		return dataNode{spilled: spilled}
+	}
+	return dataNode{value: value}
+}
+
+// setNode
+/**
+* Store the node under key, taking a reference to its file and releasing the one held by the node it replaces when they
+* differ. Every write to the store goes through setNode or deleteNode. The caller must hold the mutex.
+ */
+func (ds *DataStore) setNode(key string, node dataNode) {
+	ds.keepForSnapshots(key)
+	previous, replaced := ds.inMemoryStore[key]
+	if previous.spilled != node.spilled {
+		ds.spill.acquire(node.spilled)
+		ds.spill.release(previous.spilled)
+	}
+	if replaced {
+		ds.sizeBytes -= nodeSize(key, previous)
+	}
+	ds.sizeBytes += nodeSize(key, node)
+	ds.inMemoryStore[key] = node
+	ds.eviction.track(key)
+}
+
+// deleteNode removes the node stored under key and releases its file, the caller must hold the mutex
+func (ds *DataStore) deleteNode(key string) {
+	ds.keepForSnapshots(key)
+	node, present := ds.inMemoryStore[key]
+	if present {
+		ds.sizeBytes -= nodeSize(key, node)
+	}
+	ds.spill.release(node.spilled)
+	delete(ds.inMemoryStore, key)
+	ds.eviction.remove(key)
+}
+
+// valueOf
+/**
+* The value of a node, read from its file while holding the mutex when it was spilled. Only for the operations that
+* return or record the value of a key other than Read, which reads spilled values after releasing the mutex. The
+* caller must hold the mutex.
+ */
+func (ds *DataStore) valueOf(node dataNode) string {
+	value, _ := ds.spill.load(node)
+	return value
+}
+
+// withValue returns a copy of the node holding its value in memory, for handing the value outside the store. The caller
+// must hold the mutex
+func (ds *DataStore) withValue(node dataNode) dataNode {
+	if node.spilled != nil {
+		node.value = ds.valueOf(node)
+		node.spilled = nil
+	}
+	return node
+}
+
+// readNode
+/**
+* Look up the node for a read, holding a reference to its file that the caller must release once the value is loaded.
+* Takes the mutex for reading, checking invariants as the operation, unless reads are copy-on-write.
+ */
+func (ds *DataStore) readNode(operation string, key string) (dataNode, bool) {
+	store, lockFree := ds.publishedStore()
+	if !lockFree {
+		ds.internalStoreMutex.RLock()
+		defer ds.internalStoreMutex.RUnlock()
+		defer ds.checkInvariants(operation)
+
+		node, present := ds.inMemoryStore[key]
+		ds.spill.acquire(node.spilled)
+		if present {
+			ds.eviction.used(key)
+		}
+		return node, present
+	}
+
+	defer ds.lockAndCheckInvariants(operation)
+	for {
+		node, present := store[key]
+		if ds.spill.acquire(node.spilled) {
+			if present {
+				ds.eviction.used(key)
+			}
+			return node, present
+		}
+		// the file was replaced since the copy was published, a newer copy is published before the writer finishes
+		runtime.Gosched()
+		store, _ = ds.publishedStore()
+	}
+}
@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spillFiles returns the names of the spill files in dir
+func spillFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Expected to list the spill directory but got %q", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spillSuffix) {
+			files = append(files, entry.Name())
+		}
+	}
+	return files
+}
+
+func TestValuesLongerThanTheThresholdAreSpilled(t *testing.T) {
+	dir := t.TempDir()
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, SpillDirectory: dir, SpillThreshold: 16})
+
+	ds.Insert("at", strings.Repeat("a", 16))
+	ds.Insert("over", strings.Repeat("b", 17))
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("Expected only the value over the threshold to be spilled but found %v", files)
+	}
+
+	for key, expected := range map[string]string{"at": strings.Repeat("a", 16), "over": strings.Repeat("b", 17)} {
+		if value, present := ds.Read(key); !present || value != expected {
+			t.Fatalf("Expected to read %q for %q but got %q, %t", expected, key, value, present)
+		}
+	}
+
+	stats := ds.Stats()
+	if stats.SpilledKeys != 1 || stats.SpilledBytes != 17 || stats.ValueBytes != 16 || stats.SpillFailures != 0 {
+		t.Fatalf("Expected one spilled value of 17 bytes and 16 bytes in memory but found %+v", stats)
+	}
+}
+
+func TestLargeSpilledValuesReadBackUnchanged(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a 100MB value")
+	}
+
+	dir := t.TempDir()
+	ds := NewDataStoreWithOptions(Options{SpillDirectory: dir})
+	value := strings.Repeat("0123456789", 10_000_000)
+
+	ds.Insert("features:1", value)
+	read, present := ds.Read("features:1")
+	if !present || read != value {
+		t.Fatalf("Expected to read back the 100MB value but read %d bytes, %t", len(read), present)
+	}
+	if stats := ds.Stats(); stats.SpilledBytes != len(value) || stats.ValueBytes != 0 {
+		t.Fatalf("Expected the value to be kept out of memory but found %+v", stats)
+	}
+}
+
+func TestRemovingSpilledValuesRemovesTheirFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{
+		CheckInvariants: true,
+		SpillDirectory:  dir,
+		SpillThreshold:  4,
+		Clock:           func() time.Time { return now },
+	})
+	large := "a value over the threshold"
+
+	ds.Insert("deleted", large)
+	ds.Insert("replaced", large)
+	ds.Insert("expired", large)
+	ds.Insert("kept", large)
+	if files := spillFiles(t, dir); len(files) != 4 {
+		t.Fatalf("Expected a file for every value but found %v", files)
+	}
+
+	ds.Delete("deleted")
+	ds.Update("replaced", "1")
+	ds.Expire("expired", now.Add(time.Second))
+	now = now.Add(time.Minute)
+	ds.CleanupNow()
+
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("Expected only the file of the kept value to remain but found %v", files)
+	}
+	if value, present := ds.Read("kept"); !present || value != large {
+		t.Fatalf("Expected the kept value to stay readable but got %q, %t", value, present)
+	}
+}
+
+func TestSpilledValuesStayReadableThroughSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, SpillDirectory: dir, SpillThreshold: 4})
+	ds.Insert("a", "the first value")
+
+	snapshot := ds.Snapshot()
+	ds.Update("a", "the second value")
+	if value, present := snapshot.Read("a"); !present || value != "the first value" {
+		t.Fatalf("Expected the snapshot to read the value it was taken with but got %q, %t", value, present)
+	}
+	if files := spillFiles(t, dir); len(files) != 2 {
+		t.Fatalf("Expected the replaced file to be kept for the snapshot but found %v", files)
+	}
+
+	snapshot.Release()
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("Expected the replaced file to be removed with the snapshot but found %v", files)
+	}
+}
+
+func TestTruncateEmptiesTheSpillDirectory(t *testing.T) {
+	dir := t.TempDir()
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, SpillDirectory: dir, SpillThreshold: 4})
+	for _, key := range []string{"a", "b", "c"} {
+		ds.Insert(key, "a value over the threshold")
+	}
+
+	if removed := ds.Truncate(); removed != 3 {
+		t.Fatalf("Expected 3 keys to be truncated but got %d", removed)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("Expected truncate to remove every file but found %v", files)
+	}
+}
+
+func TestFilesLeftByACrashAreReconciled(t *testing.T) {
+	dir := t.TempDir()
+	crashed := NewDataStoreWithOptions(Options{SpillDirectory: dir, SpillThreshold: 4})
+	crashed.Insert("a", "a value over the threshold")
+	crashed.Insert("b", "a value over the threshold")
+	unrelated := filepath.Join(dir, "notes.txt")
+	os.WriteFile(unrelated, []byte("not a spill file"), 0o644)
+
+	// the crashed data store is abandoned with its files still in the directory
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, SpillDirectory: dir, SpillThreshold: 4})
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("Expected the files nothing refers to to be removed on startup but found %v", files)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Fatalf("Expected other files in the directory to be left alone but got %q", err)
+	}
+
+	ds.Insert("c", "a value over the threshold")
+	os.WriteFile(filepath.Join(dir, "orphan"+spillSuffix), []byte("left behind"), 0o644)
+	removed, err := ds.ReconcileSpills()
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected only the orphaned file to be reconciled but removed %d: %q", removed, err)
+	}
+	if value, present := ds.Read("c"); !present || value != "a value over the threshold" {
+		t.Fatalf("Expected the referenced file to be kept but read %q, %t", value, present)
+	}
+}
@@ -0,0 +1,99 @@
+package engine
+
+import "time"
+
+// Stats
+/**
+* Counters describing the data store, see DataStore.Stats
+ */
+type Stats struct {
+	// Keys is the number of keys stored, counting expired keys that have not been cleaned up yet like Count does
+	Keys int
+	// DefaultTTLsApplied is how many keys have been given the default TTL since the data store was created
+	DefaultTTLsApplied int
+	// Archived is how many expired keys Options.ExpirationArchive has archived
+	Archived int
+	// ArchiveDropped is how many expired keys were never archived, because the archive failed too often or its queue
+	// was full
+	ArchiveDropped int
+	// ArchivePending is how many expired keys are waiting to be archived
+	ArchivePending int
+	// ChangeFeedFailures is how many changes Options.ChangeFeed failed to append
+	ChangeFeedFailures int
+	// ReadCopies is how many copies of the store writes have published for reads, zero unless Options.CopyOnWriteReads
+	// is set
+	ReadCopies int
+	// ValueBytes is the length of the values held in memory, and of the field names and values of hashes, counting
+	// expired keys that have not been cleaned up yet
+	ValueBytes int
+	// SpilledKeys is how many values are stored in files in Options.SpillDirectory
+	SpilledKeys int
+	// SpilledBytes is the length of the values stored in files in Options.SpillDirectory
+	SpilledBytes int
+	// SpillFailures is how many values could not be written to or read back from Options.SpillDirectory, values that
+	// could not be written are kept in memory instead
+	SpillFailures int
+	// ClockRegressions is how many times Options.Clock went backwards. Expirations are evaluated against the latest time
+	// the clock returned until it catches up, so keys that expired before the jump stay expired
+	ClockRegressions int
+	// LargestClockRegression is the furthest Options.Clock has gone backwards in a single jump
+	LargestClockRegression time.Duration
+	// LongestLockHold is the longest DeleteBy, ExpireBy, Snapshot, or a cleanup of expired keys has held the mutex at
+	// once, see Options.MaxLockHold
+	LongestLockHold time.Duration
+	// SizeBytes is the length of every key, value held in memory, and field of a hash, counting expired keys that have
+	// not been cleaned up yet, which is what Options.WaterMarks are compared with
+	SizeBytes int
+	// StoreFullRejections is how many writes were refused with ErrStoreFull because the data store was over its
+	// WaterMarks
+	StoreFullRejections int
+	// ExpiredRemoved is how many expired keys the cleanup has removed, expired keys a write replaced or deleted first are
+	// not counted
+	ExpiredRemoved int
+	// Evicted is how many keys were evicted to keep the data store within Options.MaxKeys, expired keys chosen for
+	// eviction are not counted
+	Evicted int
+	// SubscriptionDropped is how many changes were not sent to a subscriber of DataStore.Subscribe because it had fallen
+	// Options.SubscriptionBuffer changes behind
+	SubscriptionDropped int
+}
+
+// Stats returns the data store's current counters
+func (ds *DataStore) Stats() Stats {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("Stats")
+
+	archived, dropped, pending := ds.archive.counts()
+	regressions, largestRegression := ds.clock.regressionCounts()
+	valueBytes, spilledKeys, spilledBytes := 0, 0, 0
+	for _, node := range ds.inMemoryStore {
+		valueBytes += len(node.value) + node.hash.bytes()
+		if node.spilled != nil {
+			spilledKeys++
+			spilledBytes += node.spilled.length
+		}
+	}
+
+	return Stats{
+		Keys:                   len(ds.inMemoryStore),
+		DefaultTTLsApplied:     ds.defaultTTLsApplied,
+		Archived:               archived,
+		ArchiveDropped:         dropped,
+		ArchivePending:         pending,
+		ChangeFeedFailures:     ds.changes.feedFailures,
+		ReadCopies:             ds.readCopies(),
+		ValueBytes:             valueBytes,
+		SpilledKeys:            spilledKeys,
+		SpilledBytes:           spilledBytes,
+		SpillFailures:          ds.spill.failureCount(),
+		ClockRegressions:       regressions,
+		LargestClockRegression: largestRegression,
+		LongestLockHold:        ds.longestLockHold,
+		SizeBytes:              ds.sizeBytes,
+		StoreFullRejections:    ds.storeFullRejections,
+		ExpiredRemoved:         ds.expiredRemoved,
+		Evicted:                ds.eviction.evictedCount(),
+		SubscriptionDropped:    ds.changes.subscriptionDropped,
+	}
+}
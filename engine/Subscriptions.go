@@ -0,0 +1,73 @@
+package engine
+
+import "strings"
+
+// DefaultSubscriptionBuffer is how many changes a subscriber may fall behind by unless Options.SubscriptionBuffer says
+// otherwise
+const DefaultSubscriptionBuffer = 256
+
+// subscription is one subscriber of Subscribe, only used while holding the owning DataStore's mutex
+type subscription struct {
+	prefix  string
+	changes chan Change
+}
+
+// matches reports whether the change is to a key under the subscription's prefix, a truncate removes keys under every
+// prefix
+func (s *subscription) matches(change Change, seperator string) bool {
+	return s.prefix == "" || change.Operation == ChangeTruncate || change.Key == s.prefix || strings.HasPrefix(change.Key, s.prefix+seperator)
+}
+
+// Subscribe
+/**
+* Receive every change made from now on to the keys under prefix, matched segment by segment like KeysBy, with the
+* empty prefix receiving the changes to every key. Changes arrive in order as the Change recorded for ChangesSince,
+* with the value written, or the value removed by deletes and expirations, read back into memory when it was spilled.
+* Keys the cleanup removes once they expired arrive as ChangeExpired, and a ChangeTruncate reaches every subscriber.
+*
+* Writers never wait for subscribers. Each subscriber has a buffer of Options.SubscriptionBuffer changes, and changes
+* arriving while it is full are dropped and counted in Stats.SubscriptionDropped, so a subscriber that must not miss
+* changes should read them promptly and catch up with ChangesSince when it sees a gap in their Sequence where a change
+* to its keys is possible.
+*
+* The returned function unsubscribes, closing the channel once no more changes will be sent on it. It may be called
+* more than once.
+ */
+func (ds *DataStore) Subscribe(prefix string) (<-chan Change, func()) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+
+	subscriber := &subscription{
+		prefix:  strings.TrimSuffix(prefix, ds.keyIndex.seperator),
+		changes: make(chan Change, ds.changes.subscriptionBuffer),
+	}
+	ds.changes.subscribers = append(ds.changes.subscribers, subscriber)
+
+	unsubscribe := func() {
+		ds.internalStoreMutex.Lock()
+		defer ds.internalStoreMutex.Unlock()
+
+		for i, subscribed := range ds.changes.subscribers {
+			if subscribed == subscriber {
+				ds.changes.subscribers = append(ds.changes.subscribers[:i:i], ds.changes.subscribers[i+1:]...)
+				close(subscriber.changes)
+				return
+			}
+		}
+	}
+	return subscriber.changes, unsubscribe
+}
+
+// publish sends the change to every subscriber of its key that has room for it, counting it dropped for the others
+func (l *changeLog) publish(change Change) {
+	for _, subscriber := range l.subscribers {
+		if !subscriber.matches(change, l.seperator) {
+			continue
+		}
+		select {
+		case subscriber.changes <- change:
+		default:
+			l.subscriptionDropped++
+		}
+	}
+}
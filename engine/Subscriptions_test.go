@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// receiveChanges reads the changes waiting on the channel without blocking
+func receiveChanges(changes <-chan Change) []Change {
+	received := []Change{}
+	for {
+		select {
+		case change, open := <-changes:
+			if !open {
+				return received
+			}
+			received = append(received, change)
+		default:
+			return received
+		}
+	}
+}
+
+func assertChanges(t *testing.T, received []Change, expected ...Change) {
+	t.Helper()
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d changes but received %v", len(expected), received)
+	}
+	for i, change := range received {
+		if change.Operation != expected[i].Operation || change.Key != expected[i].Key || change.Value != expected[i].Value {
+			t.Fatalf("Expected change %d to %s %q to %q but received %s to %q", i, expected[i].Operation, expected[i].Key, expected[i].Value, change, change.Value)
+		}
+	}
+}
+
+func TestSubscribersReceiveTheChangesUnderTheirPrefix(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	changes, unsubscribe := ds.Subscribe("user:")
+	defer unsubscribe()
+
+	ds.Insert("user:1", "ada")
+	ds.Insert("users:1", "grace")
+	ds.Insert("admin:1", "alan")
+	ds.Update("user:1", "ada lovelace")
+	ds.Upsert("user", "all")
+	ds.Delete("user:1")
+	ds.Truncate()
+
+	assertChanges(t, receiveChanges(changes),
+		Change{Operation: ChangeInsert, Key: "user:1", Value: "ada"},
+		Change{Operation: ChangeUpdate, Key: "user:1", Value: "ada lovelace"},
+		Change{Operation: ChangeUpsert, Key: "user", Value: "all"},
+		Change{Operation: ChangeDelete, Key: "user:1", Value: "ada lovelace"},
+		Change{Operation: ChangeTruncate},
+	)
+}
+
+func TestSubscribersReceiveKeysTheCleanupExpires(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true, SpillDirectory: dir, SpillThreshold: 4})
+	changes, unsubscribe := ds.Subscribe("")
+	defer unsubscribe()
+
+	ds.Insert("session:1", "spilled value")
+	ds.Expire("session:1", now.Add(time.Second))
+	now = now.Add(time.Minute)
+	ds.CleanupNow()
+
+	assertChanges(t, receiveChanges(changes),
+		Change{Operation: ChangeInsert, Key: "session:1", Value: "spilled value"},
+		Change{Operation: ChangeExpire, Key: "session:1", Value: "spilled value"},
+		Change{Operation: ChangeExpired, Key: "session:1", Value: "spilled value"},
+	)
+}
+
+func TestSlowSubscribersDropChangesInsteadOfStallingWriters(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, SubscriptionBuffer: 2})
+	slow, unsubscribeSlow := ds.Subscribe("")
+	defer unsubscribeSlow()
+	unrelated, unsubscribeUnrelated := ds.Subscribe("other")
+	defer unsubscribeUnrelated()
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		ds.Insert(key, "1")
+	}
+
+	assertChanges(t, receiveChanges(slow),
+		Change{Operation: ChangeInsert, Key: "a", Value: "1"},
+		Change{Operation: ChangeInsert, Key: "b", Value: "1"},
+	)
+	if len(receiveChanges(unrelated)) != 0 || ds.Stats().SubscriptionDropped != 3 {
+		t.Fatalf("Expected the 3 changes the slow subscriber had no room for to be dropped but found %d", ds.Stats().SubscriptionDropped)
+	}
+}
+
+func TestUnsubscribingClosesTheChannel(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	changes, unsubscribe := ds.Subscribe("")
+	ds.Insert("a", "1")
+
+	unsubscribe()
+	unsubscribe()
+	ds.Insert("b", "1")
+
+	assertChanges(t, receiveChanges(changes), Change{Operation: ChangeInsert, Key: "a", Value: "1"})
+	if _, open := <-changes; open {
+		t.Fatalf("Expected the channel to be closed once unsubscribed")
+	}
+}
@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// sweeper
+/**
+* Removes expired keys every Options.CleanupInterval, so a data store that is mostly read does not keep them until the
+* next write schedules a cleanup
+*
+* NewDataStoreWithOptions returns the data store by value, so the sweeper cannot be handed it there. It starts with the
+* first operation on the data store instead, which is why a data store must not be copied once it is in use, as with
+* its mutex. Each sweep is a CleanupNow, waiting for the mutex like any other operation, and runs alongside the
+* cleanups scheduled by writes.
+ */
+type sweeper struct {
+	interval time.Duration
+	started  sync.Once
+	stopped  sync.Once
+	stop     chan struct{}
+	// done is closed once the goroutine has returned, or by Close when it never started
+	done chan struct{}
+}
+
+// newSweeper returns nil unless Options.CleanupInterval is set, a nil sweeper never starts
+func newSweeper(options Options) *sweeper {
+	if options.CleanupInterval <= 0 {
+		return nil
+	}
+	return &sweeper{interval: options.CleanupInterval, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// attach starts sweeping ds unless it was started or closed before
+func (s *sweeper) attach(ds *DataStore) {
+	if s == nil {
+		return
+	}
+	s.started.Do(func() {
+		go s.run(ds)
+	})
+}
+
+func (s *sweeper) run(ds *DataStore) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ds.CleanupNow()
+		}
+	}
+}
+
+// close stops the sweeper and waits for a sweep in progress to finish
+func (s *sweeper) close() {
+	if s == nil {
+		return
+	}
+	s.stopped.Do(func() {
+		close(s.stop)
+	})
+	// a sweeper that never started is kept from starting
+	s.started.Do(func() {
+		close(s.done)
+	})
+	<-s.done
+}
+
+// Close
+/**
+* Stop the background sweeper started by Options.CleanupInterval, waiting for a sweep in progress to finish
+*
+* Expired keys are still removed by the cleanups writes schedule and by CleanupNow. Closing again, or closing a data
+* store without a CleanupInterval, does nothing. Close must not be called from an ArchiveSink, which a sweep waits on.
+ */
+func (ds *DataStore) Close() {
+	ds.sweeper.close()
+}
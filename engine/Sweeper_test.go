@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForApproximateCount polls the data store until it holds count keys, expired ones included
+func waitForApproximateCount(t *testing.T, ds *DataStore, count int) {
+	deadline := time.Now().Add(time.Second)
+	for ds.ApproximateCount() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d keys to be left but found %d", count, ds.ApproximateCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSweeperRemovesExpiredKeysWithoutWrites(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, CleanupInterval: 5 * time.Millisecond})
+	defer ds.Close()
+	// keep the writes from cleaning up, so only the sweeper can
+	ds.cleanupSignal = make(chan uint64, 100)
+
+	for i := 0; i < 10; i++ {
+		ds.Insert(fmt.Sprintf("key:%d", i), "1")
+		ds.Expire(fmt.Sprintf("key:%d", i), time.Now().Add(-time.Second))
+	}
+	ds.Insert("kept", "1")
+
+	waitForApproximateCount(t, &ds, 1)
+	if value, present := ds.Read("kept"); !present || value != "1" {
+		t.Fatalf("Expected the key without an expiration to be kept but read %q", value)
+	}
+}
+
+func TestCloseStopsTheSweeper(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, CleanupInterval: time.Millisecond})
+	ds.cleanupSignal = make(chan uint64, 100)
+	ds.Insert("a", "1")
+
+	ds.Close()
+	ds.Close()
+	ds.Insert("b", "1")
+	ds.Expire("b", time.Now().Add(-time.Second))
+	time.Sleep(20 * time.Millisecond)
+	if count := ds.ApproximateCount(); count != 2 {
+		t.Fatalf("Expected the expired key to stay once the sweeper was closed but found %d keys", count)
+	}
+
+	ds.CleanupNow()
+	if count := ds.ApproximateCount(); count != 1 {
+		t.Fatalf("Expected CleanupNow to keep working after Close but found %d keys", count)
+	}
+}
+
+func TestClosingBeforeTheFirstOperationKeepsTheSweeperFromStarting(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CleanupInterval: time.Millisecond})
+	ds.cleanupSignal = make(chan uint64, 100)
+	ds.Close()
+
+	ds.Insert("a", "1")
+	ds.Expire("a", time.Now().Add(-time.Second))
+	time.Sleep(20 * time.Millisecond)
+	if count := ds.ApproximateCount(); count != 1 {
+		t.Fatalf("Expected no sweeper to run after Close but found %d keys", count)
+	}
+
+	// a data store without a CleanupInterval has nothing to close
+	plain := NewDataStore()
+	plain.Close()
+}
+
+func TestSweeperRunsAlongsideWriteTriggeredCleanups(t *testing.T) {
+	withParallelism(t)
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, CleanupInterval: time.Millisecond, MaxLockHold: time.Microsecond})
+	defer ds.Close()
+
+	done := make(chan bool)
+	for writer := 0; writer < 4; writer++ {
+		go func(writer int) {
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key:%d:%d", writer, i)
+				ds.Insert(key, "1")
+				ds.Expire(key, time.Now().Add(-time.Second))
+				ds.Read(key)
+			}
+			done <- true
+		}(writer)
+	}
+	for writer := 0; writer < 4; writer++ {
+		<-done
+	}
+
+	waitForApproximateCount(t, &ds, 0)
+}
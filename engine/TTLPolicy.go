@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"strings"
+	"time"
+)
+
+// TTLRule
+/**
+* The longest time keys under Prefix may live for
+*
+* Prefixes are matched on separator boundaries like KeysBy, so "pii" governs "pii:ssn:1" but not "piie:1", and a
+* trailing separator is ignored. When several rules match a key the one with the longest prefix applies.
+*
+* Expirations requested through Expire, ExpireWithMode, and ExpireBy that are further away than MaxTTL are shortened to
+* MaxTTL from now, or refused with ErrTTLExceeded when Reject is set. Keys written without an expiration, or moved under
+* the prefix by Rename, are given one MaxTTL from now whatever Reject is set to.
+ */
+type TTLRule struct {
+	Prefix string
+	MaxTTL time.Duration
+	Reject bool
+}
+
+// SetTTLPolicy
+/**
+* Replace the TTL rules, see TTLRule
+*
+* New rules only apply to keys as they are written or expired from then on, keys already stored keep their current
+* expirations.
+ */
+func (ds *DataStore) SetTTLPolicy(rules ...TTLRule) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+
+	ds.ttlRules = normalizeTTLRules(rules, ds.keyIndex.seperator)
+}
+
+// normalizeTTLRules copies the rules with any trailing separator removed from their prefixes
+func normalizeTTLRules(rules []TTLRule, seperator string) []TTLRule {
+	normalized := make([]TTLRule, len(rules))
+	for i, rule := range rules {
+		rule.Prefix = strings.TrimSuffix(rule.Prefix, seperator)
+		normalized[i] = rule
+	}
+	return normalized
+}
+
+// TTLPolicy returns the current TTL rules
+func (ds *DataStore) TTLPolicy() []TTLRule {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return append([]TTLRule{}, ds.ttlRules...)
+}
+
+// ttlRuleFor finds the rule with the longest prefix governing key, the caller must hold the mutex
+func (ds *DataStore) ttlRuleFor(key string) (TTLRule, bool) {
+	var governing TTLRule
+	found := false
+	for _, rule := range ds.ttlRules {
+		if key != rule.Prefix && !strings.HasPrefix(key, rule.Prefix+ds.keyIndex.seperator) {
+			continue
+		}
+		if !found || len(rule.Prefix) > len(governing.Prefix) {
+			governing = rule
+			found = true
+		}
+	}
+
+	return governing, found
+}
+
+// limitExpiration
+/**
+* Apply the TTL policy to an expiration requested for key, returning the expiration to set or ErrTTLExceeded. The
+* caller must hold the mutex.
+ */
+func (ds *DataStore) limitExpiration(key string, expiration time.Time, timestamp time.Time) (time.Time, error) {
+	rule, governed := ds.ttlRuleFor(key)
+	if !governed {
+		return expiration, nil
+	}
+
+	limit := timestamp.Add(rule.MaxTTL)
+	if !expiration.After(limit) {
+		return expiration, nil
+	}
+	if rule.Reject {
+		return time.Time{}, ErrTTLExceeded
+	}
+	return limit, nil
+}
+
+// governWrite
+/**
+* Give a node about to be stored under key an expiration within the TTL policy and track it, for writes that do not
+* request an expiration themselves. The caller must hold the mutex and store the returned node.
+ */
+func (ds *DataStore) governWrite(key string, node dataNode, timestamp time.Time) dataNode {
+	rule, governed := ds.ttlRuleFor(key)
+	if !governed {
+		return node
+	}
+
+	limit := timestamp.Add(rule.MaxTTL)
+	if !node.hasExpiration || node.expiration.After(limit) {
+		node.hasExpiration = true
+		node.expiration = limit
+		ds.expirations.set(key, limit)
+	}
+	return node
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newPolicyStore(now time.Time, rules ...TTLRule) *DataStore {
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+	ds.SetTTLPolicy(rules...)
+	return &ds
+}
+
+func TestTTLPolicyClampsOrRejectsExpirations(t *testing.T) {
+	now := time.Now()
+	ds := newPolicyStore(now,
+		TTLRule{Prefix: "pii:", MaxTTL: time.Hour * 24},
+		TTLRule{Prefix: "secret", MaxTTL: time.Hour, Reject: true},
+	)
+
+	for _, key := range []string{"pii:ssn:1", "secret:1", "public:1"} {
+		ds.Insert(key, "abc123")
+	}
+
+	changed, err := ds.ExpireWithMode("pii:ssn:1", now.Add(time.Hour*48), ExpireAlways)
+	expiration, _ := ds.ReadExpiration("pii:ssn:1")
+	if !changed || err != nil || !expiration.Equal(now.Add(time.Hour*24)) {
+		t.Fatalf("Expected a 48h expiration under pii to be clamped to 24h but found %q: %q", expiration, err)
+	}
+
+	_, err = ds.ExpireWithMode("pii:ssn:1", now.Add(time.Hour), ExpireAlways)
+	expiration, _ = ds.ReadExpiration("pii:ssn:1")
+	if err != nil || !expiration.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected an expiration within the limit to be kept but found %q: %q", expiration, err)
+	}
+
+	changed, err = ds.ExpireWithMode("secret:1", now.Add(time.Hour*2), ExpireAlways)
+	expiration, _ = ds.ReadExpiration("secret:1")
+	if changed || !errors.Is(err, ErrTTLExceeded) || !expiration.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected a 2h expiration under secret to be refused and keep the automatic 1h but found %q: %q", expiration, err)
+	}
+
+	ds.Expire("public:1", now.Add(time.Hour*48))
+	expiration, _ = ds.ReadExpiration("public:1")
+	if !expiration.Equal(now.Add(time.Hour * 48)) {
+		t.Fatalf("Expected keys outside every rule to be untouched but found %q", expiration)
+	}
+
+	ds.Insert("secret:2", "abc123")
+	if ds.ExpireBy("secret", now.Add(time.Hour*2)) != 0 {
+		t.Fatalf("Expected expire by to skip keys whose rule refuses the expiration")
+	}
+	if ds.ExpireBy("pii", now.Add(time.Hour*48)) != 1 {
+		t.Fatalf("Expected expire by to clamp keys under a clamping rule")
+	}
+	expiration, _ = ds.ReadExpiration("pii:ssn:1")
+	if !expiration.Equal(now.Add(time.Hour * 24)) {
+		t.Fatalf("Expected expire by to clamp to 24h but found %q", expiration)
+	}
+}
+
+func TestTTLPolicyAppliesToWritesWithoutExpirations(t *testing.T) {
+	now := time.Now()
+	ds := newPolicyStore(now, TTLRule{Prefix: "pii", MaxTTL: time.Hour * 24})
+
+	ds.Insert("pii:ssn:1", "abc123")
+	ds.Upsert("pii:ssn:2", "abc123")
+	ds.Insert("piie:1", "abc123")
+	ds.Insert("public:1", "abc123")
+
+	for _, key := range []string{"pii:ssn:1", "pii:ssn:2"} {
+		expiration, hasExpiration := ds.ReadExpiration(key)
+		if !hasExpiration || !expiration.Equal(now.Add(time.Hour*24)) {
+			t.Fatalf("Expected %q to be given the 24h maximum but found %q", key, expiration)
+		}
+	}
+
+	for _, key := range []string{"piie:1", "public:1"} {
+		_, hasExpiration := ds.ReadExpiration(key)
+		if hasExpiration {
+			t.Fatalf("Expected %q outside the separator bounded prefix to have no expiration", key)
+		}
+	}
+
+	ds.Expire("public:1", now.Add(time.Hour*48))
+	err := ds.Rename("public:1", "pii:moved", false)
+	expiration, _ := ds.ReadExpiration("pii:moved")
+	if err != nil || !expiration.Equal(now.Add(time.Hour*24)) {
+		t.Fatalf("Expected a key renamed under pii to be clamped to 24h but found %q: %q", expiration, err)
+	}
+}
+
+func TestTTLPolicyLongestPrefixWins(t *testing.T) {
+	now := time.Now()
+	ds := newPolicyStore(now,
+		TTLRule{Prefix: "pii", MaxTTL: time.Hour * 24},
+		TTLRule{Prefix: "pii:ssn", MaxTTL: time.Hour, Reject: true},
+		TTLRule{Prefix: "pii:ssn:archive", MaxTTL: time.Hour * 2},
+	)
+
+	cases := []struct {
+		key      string
+		expected time.Duration
+		err      error
+	}{
+		{"pii:email:1", time.Hour * 24, nil},
+		{"pii:ssn:1", time.Hour, ErrTTLExceeded},
+		{"pii:ssn:archive:1", time.Hour * 2, nil},
+	}
+
+	for _, testCase := range cases {
+		ds.Insert(testCase.key, "abc123")
+		_, err := ds.ExpireWithMode(testCase.key, now.Add(time.Hour*48), ExpireAlways)
+		expiration, _ := ds.ReadExpiration(testCase.key)
+		if !errors.Is(err, testCase.err) || !expiration.Equal(now.Add(testCase.expected)) {
+			t.Fatalf("Expected %q to expire in %s with error %v but found %q: %v", testCase.key, testCase.expected, testCase.err, expiration, err)
+		}
+	}
+}
+
+func TestExpireWithLimitReportsTheExpirationSet(t *testing.T) {
+	now := time.Now()
+	ds := newPolicyStore(now, TTLRule{Prefix: "pii", MaxTTL: time.Hour * 24})
+	ds.Insert("pii:ssn:1", "abc123")
+
+	changed, expiration, err := ds.ExpireWithLimit("pii:ssn:1", now.Add(time.Hour*48), ExpireAlways)
+	if !changed || err != nil || !expiration.Equal(now.Add(time.Hour*24)) {
+		t.Fatalf("Expected the clamped expiration to be reported but found %q: %q", expiration, err)
+	}
+
+	changed, expiration, err = ds.ExpireWithLimit("pii:ssn:1", now.Add(time.Hour), ExpireAlways)
+	if !changed || err != nil || !expiration.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected an expiration within the limit to be reported unchanged but found %q: %q", expiration, err)
+	}
+
+	changed, expiration, err = ds.ExpireWithLimit("pii:ssn:1", now.Add(time.Hour*2), ExpireIfShorter)
+	if changed || err != nil || !expiration.IsZero() {
+		t.Fatalf("Expected no expiration when the mode kept the current one but found %q: %q", expiration, err)
+	}
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultMaxValueLength is the longest value servers accept unless told otherwise, data stores accept values of any
+// length unless Options.MaxValueLength says otherwise. It is well within wire.DefaultMaxMessageSize, so a write of a
+// value just over it still arrives in a frame the server reads and is answered with VALUETOOLARGE.
+const DefaultMaxValueLength = 4 << 20
+
+// ErrValueTooLarge matches every ValueTooLargeError with errors.Is
+var ErrValueTooLarge = &ValueTooLargeError{}
+
+// ValueTooLargeError
+/**
+* Returned when a value written to the data store is longer than its MaxValueLength. Allowed is the limit and Found is
+* the length of the value.
+ */
+type ValueTooLargeError struct {
+	Allowed int
+	Found   int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value too large, length of %d exceeds the max value length of %d", e.Found, e.Allowed)
+}
+
+func (e *ValueTooLargeError) Is(target error) bool {
+	var tooLarge *ValueTooLargeError
+	return errors.As(target, &tooLarge)
+}
+
+// valueLimit holds the longest value writes accept, zero for no limit. It is read without the mutex, so a value that
+// is refused is never spilled, and held by pointer so copies of the data store share it.
+type valueLimit struct {
+	maxLength atomic.Int64
+}
+
+func newValueLimit(maxLength int) *valueLimit {
+	limit := &valueLimit{}
+	limit.maxLength.Store(int64(maxLength))
+	return limit
+}
+
+// SetMaxValueLength replaces the longest value writes accept, zero or less accepts values of any length, see
+// Options.MaxValueLength
+func (ds *DataStore) SetMaxValueLength(length int) {
+	if length < 0 {
+		length = 0
+	}
+	ds.valueLimit.maxLength.Store(int64(length))
+}
+
+// MaxValueLength returns the longest value writes accept, zero when values may be any length
+func (ds *DataStore) MaxValueLength() int {
+	return int(ds.valueLimit.maxLength.Load())
+}
+
+// CheckValue
+/**
+* Check a value against the MaxValueLength without writing anything, returning the ValueTooLargeError a write of it
+* would be refused with, or nil when it is short enough
+ */
+func (ds *DataStore) CheckValue(value string) error {
+	allowed := ds.MaxValueLength()
+	if allowed > 0 && len(value) > allowed {
+		return &ValueTooLargeError{Allowed: allowed, Found: len(value)}
+	}
+	return nil
+}
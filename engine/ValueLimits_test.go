@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValuesLongerThanTheLimitAreRefused(t *testing.T) {
+	dir := t.TempDir()
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, MaxValueLength: 16, SpillDirectory: dir, SpillThreshold: 8})
+	atLimit := strings.Repeat("a", 16)
+	overLimit := strings.Repeat("b", 17)
+
+	if ds.CheckValue(atLimit) != nil || !ds.Insert("at", atLimit) || !ds.Upsert("upserted", atLimit) {
+		t.Fatalf("Expected a value exactly at the limit to be written")
+	}
+
+	err := ds.CheckValue(overLimit)
+	var tooLarge *ValueTooLargeError
+	if !errors.Is(err, ErrValueTooLarge) || !errors.As(err, &tooLarge) || tooLarge.Allowed != 16 || tooLarge.Found != 17 {
+		t.Fatalf("Expected a value one over the limit to be too large but got %q", err)
+	}
+	if !strings.Contains(err.Error(), "max value length of 16") {
+		t.Fatalf("Expected the error to name the limit but got %q", err)
+	}
+
+	_, existed := ds.GetOrSet("new", overLimit)
+	_, updated := ds.ReadAndUpdate("at", overLimit)
+	if ds.Insert("over", overLimit) || ds.Update("at", overLimit) || ds.Upsert("at", overLimit) || existed || updated {
+		t.Fatalf("Expected every write of a value one over the limit to be refused")
+	}
+	if ds.UpdateBy("", overLimit) != 0 {
+		t.Fatalf("Expected UpdateBy with a value one over the limit to update nothing")
+	}
+	if _, err := ds.HSet("hash", "field", overLimit); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Expected HSet with a value one over the limit to fail with ErrValueTooLarge but got %q", err)
+	}
+	if value, _ := ds.Read("at"); value != atLimit || ds.Present("over") || ds.Present("new") || ds.Present("hash") {
+		t.Fatalf("Expected nothing to be written by the refused writes")
+	}
+	if files := spillFiles(t, dir); len(files) != 2 {
+		t.Fatalf("Expected refused values not to be spilled but found %v", files)
+	}
+
+	// a key that is present is still read by GetOrSet whatever the default
+	if value, existed := ds.GetOrSet("at", overLimit); !existed || value != atLimit {
+		t.Fatalf("Expected GetOrSet to read a present key but got %q, %t", value, existed)
+	}
+
+	ds.SetMaxValueLength(0)
+	if ds.MaxValueLength() != 0 || !ds.Insert("over", overLimit) {
+		t.Fatalf("Expected a limit of zero to accept values of any length")
+	}
+}
+
+func TestValuesOfAnyLengthAreAcceptedWithoutALimit(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	large := strings.Repeat("v", DefaultMaxValueLength+1)
+
+	if ds.MaxValueLength() != 0 || ds.CheckValue(large) != nil || !ds.Insert("large", large) {
+		t.Fatalf("Expected a data store without a limit to accept a value longer than the default servers use")
+	}
+}
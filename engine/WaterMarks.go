@@ -0,0 +1,89 @@
+package engine
+
+// WaterMarks
+/**
+* How full a data store may get before it refuses writes that would create keys, a safety valve for data stores that
+* must not grow without bound and do not evict
+*
+* Once the size of the data store reaches HighBytes, or the number of keys reaches HighKeys, writes that would create a
+* key are refused with ErrStoreFull: Insert, Upsert, GetOrSet, and HSet of keys that are not present. Everything else
+* keeps working, reads, writes to keys already present, deletes, renames, and expirations, so the data store can
+* drain. Writes creating keys resume once the size is below LowBytes and the number of keys below LowKeys.
+*
+* A high mark of zero or less is no limit. A low mark of zero or less, or above its high mark, resumes writes at 90% of
+* the high mark. The size and the number of keys count expired keys until the cleanup removes them, see
+* Stats.SizeBytes.
+ */
+type WaterMarks struct {
+	HighBytes int
+	LowBytes  int
+	HighKeys  int
+	LowKeys   int
+}
+
+// lowMark is the usage below which a data store refusing new keys accepts them again
+func lowMark(high int, low int) int {
+	if low <= 0 || low > high {
+		return high - high/10
+	}
+	return low
+}
+
+// SetWaterMarks replaces the marks at which the data store refuses and resumes creating keys, see WaterMarks
+func (ds *DataStore) SetWaterMarks(marks WaterMarks) {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	ds.waterMarks = marks
+}
+
+// WaterMarks returns the marks as they were set, see SetWaterMarks
+func (ds *DataStore) WaterMarks() WaterMarks {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	return ds.waterMarks
+}
+
+// CheckCapacity returns ErrStoreFull while the data store refuses writes that would create keys, see WaterMarks,
+// without writing anything or counting a refusal
+func (ds *DataStore) CheckCapacity() error {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	if ds.storeFull() {
+		return ErrStoreFull
+	}
+	return nil
+}
+
+// refuseNewKey returns ErrStoreFull and counts the refusal in Stats.StoreFullRejections while the data store refuses
+// writes that would create keys, the caller must hold the mutex
+func (ds *DataStore) refuseNewKey() error {
+	if !ds.storeFull() {
+		return nil
+	}
+
+	ds.storeFullRejections++
+	return ErrStoreFull
+}
+
+// storeFull
+/**
+* Whether the data store refuses writes that would create keys, starting to when the usage reaches a high mark and
+* stopping once it is below both low marks. The caller must hold the mutex.
+ */
+func (ds *DataStore) storeFull() bool {
+	marks := ds.waterMarks
+	bytesOver := func(mark int) bool { return marks.HighBytes > 0 && ds.sizeBytes >= mark }
+	keysOver := func(mark int) bool { return marks.HighKeys > 0 && len(ds.inMemoryStore) >= mark }
+
+	if ds.full {
+		ds.full = bytesOver(lowMark(marks.HighBytes, marks.LowBytes)) || keysOver(lowMark(marks.HighKeys, marks.LowKeys))
+	} else {
+		ds.full = bytesOver(marks.HighBytes) || keysOver(marks.HighKeys)
+	}
+	return ds.full
+}
+
+// nodeSize is how much a node stored under key counts towards Stats.SizeBytes
+func nodeSize(key string, node dataNode) int {
+	return len(key) + len(node.value) + node.hash.bytes()
+}
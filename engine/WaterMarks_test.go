@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWritesCreatingKeysAreRefusedOverTheHighWaterMark(t *testing.T) {
+	// every key is 6 bytes and every value 4, so each key counts 10 bytes
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, WaterMarks: WaterMarks{HighBytes: 1000, LowBytes: 500}})
+	for i := 0; i < 100; i++ {
+		if !ds.Insert(fmt.Sprintf("key:%02d", i), "1234") {
+			t.Fatalf("Expected key %d to be inserted below the high mark", i)
+		}
+	}
+	if size := ds.Stats().SizeBytes; size != 1000 {
+		t.Fatalf("Expected the size to count every key and value but found %d", size)
+	}
+
+	if ds.Insert("key:xx", "1234") || ds.Upsert("key:xx", "1234") {
+		t.Fatalf("Expected writes creating keys to be refused at the high mark")
+	}
+	if value, existed := ds.GetOrSet("key:xx", "1234"); existed || value != "" {
+		t.Fatalf("Expected GetOrSet not to create the key but got %q", value)
+	}
+	if _, err := ds.HSet("hash", "field", "1"); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("Expected HSet creating a key to fail with ErrStoreFull but got %q", err)
+	}
+	if !errors.Is(ds.CheckCapacity(), ErrStoreFull) {
+		t.Fatalf("Expected CheckCapacity to report the data store full")
+	}
+	if rejections := ds.Stats().StoreFullRejections; rejections != 4 {
+		t.Fatalf("Expected every refused write to be counted but found %d", rejections)
+	}
+
+	// everything that does not create a key still works, so the data store can drain
+	if value, _ := ds.Read("key:00"); value != "1234" {
+		t.Fatalf("Expected reads to keep working but read %q", value)
+	}
+	if !ds.Update("key:00", "5678") || !ds.Upsert("key:01", "5678") {
+		t.Fatalf("Expected writes to keys already present to keep working")
+	}
+	if value, existed := ds.GetOrSet("key:02", "5678"); !existed || value != "1234" {
+		t.Fatalf("Expected GetOrSet of a key already present to keep working but got %q", value)
+	}
+	if !ds.Expire("key:03", time.Now().Add(time.Hour)) {
+		t.Fatalf("Expected expirations to keep working")
+	}
+	if ds.Rename("key:04", "key:yy", false) != nil {
+		t.Fatalf("Expected renames to keep working")
+	}
+
+	// deleting down to the low mark keeps refusing, only going below it resumes
+	for i := 99; i >= 50; i-- {
+		if !ds.Delete(fmt.Sprintf("key:%02d", i)) {
+			t.Fatalf("Expected key %d to be deleted", i)
+		}
+	}
+	if size := ds.Stats().SizeBytes; size != 500 {
+		t.Fatalf("Expected the size to shrink with the deletes but found %d", size)
+	}
+	if ds.Insert("key:xx", "1234") {
+		t.Fatalf("Expected writes creating keys to be refused until the size is below the low mark")
+	}
+
+	ds.Delete("key:49")
+	if !ds.Insert("key:xx", "1234") {
+		t.Fatalf("Expected writes creating keys to resume below the low mark")
+	}
+	if ds.CheckCapacity() != nil {
+		t.Fatalf("Expected CheckCapacity to report room once writes resumed")
+	}
+}
+
+func TestKeyCountWaterMarks(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true, WaterMarks: WaterMarks{HighKeys: 10}})
+	for i := 0; i < 10; i++ {
+		ds.Insert(fmt.Sprintf("key:%d", i), "1")
+	}
+	if ds.Insert("key:10", "1") {
+		t.Fatalf("Expected the insert to be refused at the high mark")
+	}
+
+	// without a low mark writes resume at 90% of the high mark
+	ds.Delete("key:0")
+	if ds.Insert("key:10", "1") {
+		t.Fatalf("Expected the insert to be refused at the low mark")
+	}
+	ds.Delete("key:1")
+	if !ds.Insert("key:10", "1") {
+		t.Fatalf("Expected the insert to succeed below the low mark")
+	}
+}
+
+func TestWaterMarksCanBeChanged(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	for i := 0; i < 10; i++ {
+		ds.Insert(fmt.Sprintf("key:%d", i), "1")
+	}
+
+	ds.SetWaterMarks(WaterMarks{HighKeys: 5})
+	if ds.Insert("key:10", "1") {
+		t.Fatalf("Expected lowering the high mark below the usage to refuse new keys")
+	}
+	if marks := ds.WaterMarks(); marks.HighKeys != 5 || marks.LowKeys != 0 {
+		t.Fatalf("Expected the marks to be returned as they were set but found %+v", marks)
+	}
+
+	ds.SetWaterMarks(WaterMarks{})
+	if !ds.Insert("key:10", "1") {
+		t.Fatalf("Expected clearing the marks to let new keys in")
+	}
+}
+
+func TestSizeBytesFollowsEveryWrite(t *testing.T) {
+	ds := NewDataStoreWithOptions(Options{CheckInvariants: true})
+	ds.Insert("a", "1")
+	ds.Upsert("a", "123")
+	ds.HSet("h", "field", "value")
+	ds.Rename("a", "abc", false)
+	ds.HDel("h", "field")
+
+	if size := ds.Stats().SizeBytes; size != len("abc")+len("123") {
+		t.Fatalf("Expected the size of the remaining key but found %d", size)
+	}
+
+	ds.Truncate()
+	if size := ds.Stats().SizeBytes; size != 0 {
+		t.Fatalf("Expected a truncated data store to have no size but found %d", size)
+	}
+}
@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"container/list"
+	"time"
+)
+
+type writeOrderEntry struct {
+	key       string
+	updatedAt time.Time
+}
+
+// writeOrder
+/**
+* A doubly linked list of keys ordered by when their value was last written, oldest at the front, with an index by key
+* so that a key can be moved to the newest end or removed in O(1) as it is written or deleted. Keys written at the same
+* time are ordered by key.
+*
+* Every key in the data store is tracked, expired or not. The list is not thread safe and must only be used while
+* holding the owning DataStore's mutex.
+ */
+type writeOrder struct {
+	entries *list.List
+	byKey   map[string]*list.Element
+}
+
+func newWriteOrder() writeOrder {
+	return writeOrder{
+		entries: list.New(),
+		byKey:   map[string]*list.Element{},
+	}
+}
+
+// touch moves key to the newest end, after any keys written at the same updatedAt that sort before it
+func (o *writeOrder) touch(key string, updatedAt time.Time) {
+	o.remove(key)
+
+	entry := writeOrderEntry{key: key, updatedAt: updatedAt}
+	newer := (*list.Element)(nil)
+	for element := o.entries.Back(); element != nil; element = element.Prev() {
+		existing := element.Value.(writeOrderEntry)
+		if !existing.updatedAt.Equal(updatedAt) || existing.key < key {
+			break
+		}
+		newer = element
+	}
+
+	if newer == nil {
+		o.byKey[key] = o.entries.PushBack(entry)
+	} else {
+		o.byKey[key] = o.entries.InsertBefore(entry, newer)
+	}
+}
+
+func (o *writeOrder) remove(key string) {
+	element, present := o.byKey[key]
+	if !present {
+		return
+	}
+
+	o.entries.Remove(element)
+	delete(o.byKey, key)
+}
+
+// OldestKeys
+/**
+* Find up to n unexpired keys in the order their values were last written, starting from the least recently written
+*
+* Insert, Update, Upsert, and Rename count as writes, while changing a key's expiration does not. Expired keys that
+* have not been cleaned up yet are skipped.
+ */
+func (ds *DataStore) OldestKeys(n int) []string {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("OldestKeys")
+
+	return ds.keysByWrite(n, ds.writes.entries.Front(), (*list.Element).Next)
+}
+
+// NewestKeys
+/**
+* Find up to n unexpired keys in the order their values were last written, starting from the most recently written,
+* see OldestKeys
+ */
+func (ds *DataStore) NewestKeys(n int) []string {
+	ds.internalStoreMutex.Lock()
+	defer ds.internalStoreMutex.Unlock()
+	defer ds.checkInvariants("NewestKeys")
+
+	return ds.keysByWrite(n, ds.writes.entries.Back(), (*list.Element).Prev)
+}
+
+// keysByWrite walks the write order from start collecting up to n live keys, the caller must hold the mutex
+func (ds *DataStore) keysByWrite(n int, start *list.Element, step func(*list.Element) *list.Element) []string {
+	timestamp := ds.now()
+	keys := []string{}
+	for element := start; element != nil && len(keys) < n; element = step(element) {
+		key := element.Value.(writeOrderEntry).key
+		if ds.isLive(key, timestamp) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
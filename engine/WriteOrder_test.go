@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func assertKeys(t *testing.T, description string, found []string, expected ...string) {
+	t.Helper()
+	if len(found) != len(expected) || (len(found) > 0 && !reflect.DeepEqual(found, expected)) {
+		t.Fatalf("Expected %s to be %q but found %q", description, expected, found)
+	}
+}
+
+func TestKeysAreOrderedByLastWrite(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		ds.Insert(key, "abc123")
+		now = now.Add(time.Second)
+	}
+	assertKeys(t, "the oldest keys", ds.OldestKeys(10), "a", "b", "c", "d")
+	assertKeys(t, "the newest keys", ds.NewestKeys(2), "d", "c")
+
+	// updates move a key to the newest end, an upsert that changes nothing and a new expiration do not
+	ds.Update("b", "def456")
+	now = now.Add(time.Second)
+	ds.Upsert("a", "def456")
+	now = now.Add(time.Second)
+	ds.Upsert("c", "abc123")
+	ds.Expire("d", now.Add(time.Hour))
+	assertKeys(t, "the oldest keys after updates", ds.OldestKeys(10), "c", "d", "b", "a")
+
+	ds.Delete("d")
+	ds.Rename("c", "e", false)
+	now = now.Add(time.Second)
+	assertKeys(t, "the oldest keys after a delete and rename", ds.OldestKeys(10), "b", "a", "e")
+
+	ds.Expire("a", now.Add(time.Second))
+	now = now.Add(time.Second * 2)
+	assertKeys(t, "the newest keys with one expired", ds.NewestKeys(2), "e", "b")
+
+	ds.CleanupNow()
+	assertKeys(t, "the oldest keys after the cleanup", ds.OldestKeys(10), "b", "e")
+
+	ds.Truncate()
+	assertKeys(t, "the oldest keys after truncating", ds.OldestKeys(10))
+	assertKeys(t, "zero keys", ds.NewestKeys(0))
+}
+
+func TestKeysWrittenAtTheSameTimeAreOrderedByKey(t *testing.T) {
+	now := time.Now()
+	ds := NewDataStoreWithOptions(Options{Clock: func() time.Time { return now }, CheckInvariants: true})
+
+	ds.Insert("first", "abc123")
+	now = now.Add(time.Second)
+	for _, key := range []string{"c", "a", "d", "b"} {
+		ds.Insert(key, "abc123")
+	}
+
+	assertKeys(t, "the oldest keys", ds.OldestKeys(10), "first", "a", "b", "c", "d")
+	assertKeys(t, "the newest keys", ds.NewestKeys(3), "d", "c", "b")
+}
+
+func BenchmarkNewestKeys(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("%d keys", size), func(b *testing.B) {
+			ds := NewDataStore()
+			// nothing expires, so skip the cleanup every insert schedules to keep the setup fast
+			ds.cleanupSignal = make(chan uint64, size)
+			for i := 0; i < size; i++ {
+				ds.Insert(fmt.Sprintf("key%d", i), "abc123")
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ds.NewestKeys(10)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package proxy
+
+// Logger
+/**
+* Receives what the proxy has to say, see WithLogger. It has the methods of server.Logger, so a logger made by
+* server.NewStandardLogger or written for a server can be given to a proxy as well.
+*
+* Methods are called from every connection's goroutine at once, and must be safe to call concurrently.
+ */
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// discardLogger drops every message, for proxies without WithLogger
+type discardLogger struct{}
+
+func (discardLogger) Debugf(string, ...any) {}
+func (discardLogger) Infof(string, ...any)  {}
+func (discardLogger) Errorf(string, ...any) {}
@@ -0,0 +1,80 @@
+package proxy
+
+import "time"
+
+// config holds the settings Options can change, it is embedded in Proxy
+type config struct {
+	shadowAddress    string
+	shadowAdminToken string
+	mirrorQueue      int
+	compareRate      float64
+	mismatchListener func(Mismatch)
+	dialTimeout      time.Duration
+	logger           Logger
+}
+
+type Option func(*config)
+
+// WithShadow
+/**
+* Mirror every write the primary accepted to the server at address, see Proxy. Mirrored writes wait in a queue of
+* WithMirrorQueue requests and are sent by a single connection, so the shadow never slows down the primary.
+ */
+func WithShadow(address string) Option {
+	return func(c *config) {
+		c.shadowAddress = address
+	}
+}
+
+// WithShadowAdminToken authenticates the connection to the shadow as an admin session, so writes to protected prefixes
+// that the primary accepted from an admin session are mirrored too
+func WithShadowAdminToken(token string) Option {
+	return func(c *config) {
+		c.shadowAdminToken = token
+	}
+}
+
+// WithMirrorQueue limits how many requests may wait to be sent to the shadow, requests arriving while it is full are
+// dropped and counted in the proxy-shadow-dropped statistic. Defaults to 10000
+func WithMirrorQueue(size int) Option {
+	return func(c *config) {
+		c.mirrorQueue = size
+	}
+}
+
+// WithCompareRate
+/**
+* Send the provided percentage of single key reads, READ, READSTATUS, READEXPIRATION, and PRESENT, to the shadow as well
+* and compare its response with the primary's, see Mismatch. Zero compares none, 100 compares all of them.
+ */
+func WithCompareRate(percent float64) Option {
+	return func(c *config) {
+		c.compareRate = percent
+	}
+}
+
+// WithMismatchListener calls listener with every read the shadow answered differently from the primary instead of
+// logging it
+func WithMismatchListener(listener func(Mismatch)) Option {
+	return func(c *config) {
+		c.mismatchListener = listener
+	}
+}
+
+// WithDialTimeout limits how long connecting to the primary or the shadow may take, defaults to 5 seconds
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithLogger
+/**
+* Send what the proxy logs to logger: when it starts listening, connections it failed to accept, and the mismatches no
+* WithMismatchListener is given for. The proxy logs nothing without it.
+ */
+func WithLogger(logger Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
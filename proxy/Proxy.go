@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"datastore/wire"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Proxy
+/**
+* Speaks the wire protocol to clients and forwards every request to a primary server, so traffic can be mirrored to a
+* shadow server while migrating from one to the other
+*
+* Each client connection gets a connection to the primary of its own, so AUTH, HELLO, and every other session setting
+* apply to it just as they would talking to the primary directly, and the primary's responses are sent back unchanged.
+* The one exception is STATS, which the proxy answers with the primary's statistics plus its own:
+*
+* - proxy-shadow-mirrored: how many writes were sent to the shadow
+* - proxy-shadow-dropped: how many writes and compared reads were dropped because the mirror queue was full
+* - proxy-shadow-failed: how many requests could not be sent to the shadow or were not answered
+* - proxy-compared: how many reads were compared between the primary and the shadow
+* - proxy-mismatches: how many compared reads the shadow answered differently
+*
+* When the primary closes its connection, such as when recycling it, the proxy closes the client's connection too.
+ */
+type Proxy struct {
+	address string
+	port    int
+	primary string
+	wire    wire.Protocol
+	shadow  *shadow
+
+	mutex       sync.Mutex
+	listener    net.Listener
+	connections map[net.Conn]bool
+	config
+}
+
+func New(address string, port int, primary string, opts ...Option) *Proxy {
+	proxyConfig := config{
+		mirrorQueue: 10000,
+		dialTimeout: time.Second * 5,
+	}
+	for _, opt := range opts {
+		opt(&proxyConfig)
+	}
+	if proxyConfig.logger == nil {
+		proxyConfig.logger = discardLogger{}
+	}
+
+	return &Proxy{
+		address:     address,
+		port:        port,
+		primary:     primary,
+		shadow:      newShadow(proxyConfig),
+		connections: map[net.Conn]bool{},
+		config:      proxyConfig,
+	}
+}
+
+func (p *Proxy) Start() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(p.address, strconv.Itoa(p.port)))
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	p.listener = listener
+	p.mutex.Unlock()
+
+	p.logger.Infof("Proxy listening on %s:%d for %s", p.address, p.port, p.primary)
+	p.shadow.start()
+	go p.listenForConnections(listener)
+	return nil
+}
+
+// Stop closes the listener and every open connection, writes still waiting to be mirrored are dropped
+func (p *Proxy) Stop() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.listener == nil {
+		return nil
+	}
+
+	err := p.listener.Close()
+	p.listener = nil
+	for connection := range p.connections {
+		connection.Close()
+	}
+	p.shadow.stop()
+
+	return err
+}
+
+// listenForConnections accepts connections until Stop closes the listener
+func (p *Proxy) listenForConnections(listener net.Listener) {
+	backoff := time.Duration(0)
+	for {
+		connection, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// such as running out of file descriptors, which waiting gives the open connections time to release
+			backoff = nextAcceptBackoff(backoff)
+			p.logger.Errorf("Error accepting a connection, retrying in %s: %s", backoff, err.Error())
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		p.mutex.Lock()
+		if p.listener == nil {
+			p.mutex.Unlock()
+			connection.Close()
+			return
+		}
+		p.connections[connection] = true
+		p.mutex.Unlock()
+
+		go p.handleConnection(connection)
+	}
+}
+
+// maxAcceptBackoff is the longest listenForConnections waits between failed accepts
+const maxAcceptBackoff = time.Second
+
+// nextAcceptBackoff doubles the wait after a failed accept, starting at 5ms and capped at maxAcceptBackoff
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return time.Millisecond * 5
+	}
+	if backoff*2 > maxAcceptBackoff {
+		return maxAcceptBackoff
+	}
+	return backoff * 2
+}
+
+// handleConnection forwards the requests of a client connection to a connection of its own to the primary, one at a
+// time in the order they arrive, until either side closes its connection
+func (p *Proxy) handleConnection(connection net.Conn) {
+	defer func() {
+		p.mutex.Lock()
+		delete(p.connections, connection)
+		p.mutex.Unlock()
+		connection.Close()
+	}()
+
+	frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+	writer := wire.NewFrameWriter(connection)
+
+	primary, err := net.DialTimeout("tcp", p.primary, p.dialTimeout)
+	if err != nil {
+		writer.WriteFrame(p.wire.EncodeErrResponse(err))
+		return
+	}
+	defer primary.Close()
+	upstream := newUpstream(primary)
+	// database is the one the client selected, which the requests mirrored from it run in on the shadow
+	database := ""
+
+	for {
+		request, err := frames.ReadFrame()
+		var truncated *wire.TruncatedFrameError
+		var invalidSize *wire.FrameSizeError
+		if errors.As(err, &truncated) || errors.As(err, &invalidSize) {
+			writer.WriteFrame(p.wire.EncodeErrResponse(err))
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		response, err := upstream.send(request)
+		if err != nil {
+			return
+		}
+
+		command, _ := p.wire.DecipherCommand(request)
+		switch command {
+		case wire.STATS:
+			response = p.withStats(response)
+		case wire.SELECTDB:
+			if name, err := p.wire.DecodeSelectDB(request); err == nil {
+				database = name
+			}
+		}
+		// observed before writing the response, which consumes its frames
+		p.shadow.observe(command, database, request, response)
+		err = writer.WriteFrame(response...)
+		if err != nil {
+			return
+		}
+
+		// the primary follows the last response on a connection it recycles with a notice, then closes it
+		if upstream.frames.Buffered() > 0 {
+			notice, err := upstream.frames.ReadFrame()
+			if err == nil {
+				writer.WriteFrame(notice)
+			}
+			return
+		}
+	}
+}
+
+// withStats adds the proxy's statistics to the primary's STATS response, other responses are returned unchanged
+func (p *Proxy) withStats(response [][]byte) [][]byte {
+	if len(response) != 1 {
+		return response
+	}
+
+	stats, err := p.wire.DecodeStatsResponse(response[0])
+	if err != nil {
+		return response
+	}
+
+	for name, value := range p.shadow.stats() {
+		stats[name] = value
+	}
+	return [][]byte{p.wire.EncodeStatsResponse(stats)}
+}
+
+// upstream is a connection the proxy sends requests on, to the primary or the shadow
+type upstream struct {
+	connection net.Conn
+	frames     *wire.FrameReader
+	writer     *wire.FrameWriter
+	wire       wire.Protocol
+}
+
+func newUpstream(connection net.Conn) *upstream {
+	return &upstream{
+		connection: connection,
+		frames:     wire.NewFrameReader(connection, wire.MaxFrameSize),
+		writer:     wire.NewFrameWriter(connection),
+	}
+}
+
+// send writes a request and reads every frame of its response, the CONTINUED frames of a split response included
+func (u *upstream) send(request []byte) ([][]byte, error) {
+	err := u.writer.WriteFrame(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var response [][]byte
+	for {
+		frame, err := u.frames.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, frame)
+
+		command, err := u.wire.DecipherCommand(frame)
+		if err != nil || command != wire.CONTINUED {
+			return response, nil
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"datastore/client"
+	"datastore/server"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, port int) {
+	t.Helper()
+	runningServer := server.New("localhost", port)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	t.Cleanup(func() { runningServer.Stop() })
+	time.Sleep(time.Millisecond * 100)
+}
+
+func startProxy(t *testing.T, port int, primary string, opts ...Option) *Proxy {
+	t.Helper()
+	runningProxy := New("localhost", port, primary, opts...)
+	err := runningProxy.Start()
+	if err != nil {
+		t.Fatalf("Error starting proxy %q", err)
+	}
+	t.Cleanup(func() { runningProxy.Stop() })
+	return runningProxy
+}
+
+// waitForStat waits until the statistic reported through the client reaches at least the expected value
+func waitForStat(t *testing.T, c client.Client, name string, expected int64) map[string]int64 {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		stats, err := c.Stats()
+		if err == nil && stats[name] >= expected {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to reach %d but found %v: %q", name, expected, stats, err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWritesAreMirroredAndMismatchedReadsCounted(t *testing.T) {
+	startServer(t, 8931)
+	startServer(t, 8932)
+
+	var mutex sync.Mutex
+	var mismatches []Mismatch
+	startProxy(t, 8933, "localhost:8931",
+		WithShadow("localhost:8932"),
+		WithCompareRate(100),
+		WithMismatchListener(func(mismatch Mismatch) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			mismatches = append(mismatches, mismatch)
+		}),
+	)
+
+	proxied := client.New("localhost", 8933)
+	shadow := client.New("localhost", 8932)
+	for i := 0; i < 20; i++ {
+		proxied.Upsert(fmt.Sprintf("user:%d", i), "1")
+	}
+	proxied.Delete("user:0")
+	proxied.Insert("user:1", "refused")
+	waitForStat(t, proxied, "proxy-shadow-mirrored", 21)
+
+	count, err := shadow.Count()
+	if err != nil || count != 19 {
+		t.Fatalf("Expected the shadow to hold the 19 keys written through the proxy but found %d: %q", count, err)
+	}
+
+	for i := 1; i < 20; i++ {
+		proxied.Read(fmt.Sprintf("user:%d", i))
+	}
+	stats := waitForStat(t, proxied, "proxy-compared", 19)
+	if stats["proxy-mismatches"] != 0 || stats["keys"] != 19 {
+		t.Fatalf("Expected the primary's statistics and no mismatches while the servers agree but found %v", stats)
+	}
+
+	// the shadow falls out of step with the primary
+	shadow.Upsert("user:5", "2")
+	value, present, err := proxied.Read("user:5")
+	if err != nil || !present || value != "1" {
+		t.Fatalf("Expected reads to be answered by the primary but got %q, %t: %q", value, present, err)
+	}
+	waitForStat(t, proxied, "proxy-mismatches", 1)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(mismatches) != 1 {
+		t.Fatalf("Expected one mismatch to be reported but got %v", mismatches)
+	}
+	expected := Mismatch{Command: "READ", Key: "user:5", Primary: `READ "1"`, Shadow: `READ "2"`}
+	if mismatches[0] != expected {
+		t.Fatalf("Expected the mismatch %v but got %v", expected, mismatches[0])
+	}
+}
+
+func TestMirroredRequestsRunInTheDatabaseTheirClientSelected(t *testing.T) {
+	startServer(t, 8974)
+	startServer(t, 8975)
+	startProxy(t, 8976, "localhost:8974", WithShadow("localhost:8975"), WithCompareRate(100))
+
+	defaults := client.New("localhost", 8976)
+	orders := client.New("localhost", 8976, client.WithDatabase("orders"))
+	for i := 0; i < 5; i++ {
+		defaults.Upsert(fmt.Sprintf("key:%d", i), "default")
+		orders.Upsert(fmt.Sprintf("key:%d", i), "orders")
+	}
+	waitForStat(t, defaults, "proxy-shadow-mirrored", 10)
+
+	for i := 0; i < 5; i++ {
+		defaults.Read(fmt.Sprintf("key:%d", i))
+		orders.Read(fmt.Sprintf("key:%d", i))
+	}
+	stats := waitForStat(t, defaults, "proxy-compared", 10)
+	if stats["proxy-mismatches"] != 0 {
+		t.Fatalf("Expected the shadow to answer reads from the database their client selected but found %v", stats)
+	}
+
+	for database, expected := range map[string]string{"": "default", "orders": "orders"} {
+		shadow := client.New("localhost", 8975, client.WithDatabase(database))
+		value, present, err := shadow.Read("key:4")
+		if err != nil || !present || value != expected {
+			t.Fatalf("Expected the shadow's database %q to hold %q but found %q: %q", database, expected, value, err)
+		}
+	}
+}
+
+func TestClientsSeeTheSameResultsThroughTheProxy(t *testing.T) {
+	startServer(t, 8934)
+	startServer(t, 8935)
+	startServer(t, 8936)
+	startProxy(t, 8937, "localhost:8934", WithShadow("localhost:8935"), WithCompareRate(50))
+
+	results := func(c client.Client) []string {
+		var outcomes []string
+		record := func(values ...interface{}) {
+			outcomes = append(outcomes, fmt.Sprint(values...))
+		}
+
+		record(c.Insert("a", "1"))
+		record(c.Insert("a", "2"))
+		record(c.Update("missing", "1"))
+		record(c.Upsert("a:b", "3"))
+		record(c.Read("a"))
+		record(c.Read("missing"))
+		record(c.ReadWithStatus("a:b"))
+		record(c.Present("a:b"))
+		record(c.PresentMulti([]string{"a", "missing", "a:b"}))
+		record(c.DeleteIfEquals("a:b", "4"))
+		record(c.Rename("a", "c", false))
+		record(c.KeysBy("c"))
+		record(c.Delete("missing"))
+		record(c.Count())
+		return outcomes
+	}
+
+	direct := results(client.New("localhost", 8936))
+	proxied := results(client.New("localhost", 8937))
+	for i := range direct {
+		if direct[i] != proxied[i] {
+			t.Fatalf("Expected call %d to return %q through the proxy as it does directly but got %q", i, direct[i], proxied[i])
+		}
+	}
+}
+
+func TestMirroringNeverHoldsUpThePrimary(t *testing.T) {
+	startServer(t, 8938)
+
+	// a shadow that accepts connections but never answers
+	stalled, err := net.Listen("tcp", "localhost:8939")
+	if err != nil {
+		t.Fatalf("Error listening for the shadow %q", err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			connection, err := stalled.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			defer connection.Close()
+		}
+	}()
+
+	startProxy(t, 8940, "localhost:8938", WithShadow("localhost:8939"), WithMirrorQueue(5))
+	proxied := client.New("localhost", 8940)
+
+	started := time.Now()
+	for i := 0; i < 50; i++ {
+		inserted, err := proxied.Insert(fmt.Sprintf("key%d", i), "1")
+		if err != nil || !inserted {
+			t.Fatalf("Expected the primary to accept every write but got %q", err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected writes to be answered without waiting for the shadow but they took %s", elapsed)
+	}
+
+	stats, err := proxied.Stats()
+	if err != nil || stats["proxy-shadow-dropped"] < 44 || stats["keys"] != 50 {
+		t.Fatalf("Expected the writes the full queue could not hold to be dropped but found %v: %q", stats, err)
+	}
+}
+
+// recordingLogger keeps every message logged, prefixed with its level
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (r *recordingLogger) record(level string, format string, args []any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages = append(r.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (r *recordingLogger) Debugf(format string, args ...any) { r.record("DEBUG", format, args) }
+func (r *recordingLogger) Infof(format string, args ...any)  { r.record("INFO", format, args) }
+func (r *recordingLogger) Errorf(format string, args ...any) { r.record("ERROR", format, args) }
+
+// failingListener fails every Accept with err until it has failed times times, then reports being closed
+type failingListener struct {
+	net.Listener
+	err   error
+	times int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.times == 0 {
+		return nil, net.ErrClosed
+	}
+	l.times--
+	return nil, l.err
+}
+
+func TestFailedAcceptsAreLoggedAndRetriedAfterABackoff(t *testing.T) {
+	logger := &recordingLogger{}
+	proxy := New("localhost", 0, "localhost:0", WithLogger(logger))
+	listener := &failingListener{err: errors.New("too many open files"), times: 3}
+
+	started := time.Now()
+	proxy.listenForConnections(listener)
+	if elapsed := time.Since(started); elapsed < time.Millisecond*35 {
+		t.Fatalf("Expected the 3 failed accepts to be retried after 5, 10, and 20ms but they took %s", elapsed)
+	}
+
+	failures := 0
+	for _, message := range logger.messages {
+		if strings.HasPrefix(message, "ERROR Error accepting a connection") && strings.HasSuffix(message, "too many open files") {
+			failures++
+		}
+	}
+	if failures != 3 {
+		t.Fatalf("Expected each of the 3 failed accepts to be logged but found %v", logger.messages)
+	}
+}
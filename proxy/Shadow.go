@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bytes"
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// comparedReads are the reads on a single key WithCompareRate samples
+var comparedReads = map[wire.Command]bool{
+	wire.READ:           true,
+	wire.READSTATUS:     true,
+	wire.READEXPIRATION: true,
+	wire.PRESENT:        true,
+}
+
+// Mismatch
+/**
+* A read the shadow answered differently from the primary. Primary and Shadow describe each response as its command
+* followed by its quoted arguments, such as READ "abc123" or NULL.
+*
+* Reads are compared after the writes sent to the primary before them have been mirrored, but writes from other
+* connections may land in between, so a mismatch on a key written at the same time is not necessarily a fault.
+ */
+type Mismatch struct {
+	Command wire.Command
+	Key     string
+	Primary string
+	Shadow  string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s %q: primary answered %s, shadow answered %s", m.Command, m.Key, m.Primary, m.Shadow)
+}
+
+// shadowRequest is a request waiting to be sent to the shadow in the database the client selected, with the primary's
+// response when it is to be compared
+type shadowRequest struct {
+	request  []byte
+	command  wire.Command
+	database string
+	compare  [][]byte
+}
+
+// shadow
+/**
+* Sends the requests the proxy mirrors to the shadow server from a queue, on a single connection opened when the first
+* one arrives and reopened after a failure. A nil shadow mirrors nothing.
+*
+* The connection is shared by every client, so SELECTDB is not mirrored as it is sent. A request is preceded on the
+* connection by a SELECTDB of the database its client selected instead, whenever that differs from the one before.
+ */
+type shadow struct {
+	address     string
+	adminToken  string
+	dialTimeout time.Duration
+	compareRate float64
+	listener    func(Mismatch)
+	wire        wire.Protocol
+
+	queue    chan shadowRequest
+	done     chan struct{}
+	stopOnce sync.Once
+	// upstream is only used by the goroutine sending the queue
+	upstream *upstream
+	// database is the one selected on upstream, empty for the default database
+	database string
+
+	mirrored   atomic.Int64
+	dropped    atomic.Int64
+	failed     atomic.Int64
+	compared   atomic.Int64
+	mismatches atomic.Int64
+}
+
+func newShadow(c config) *shadow {
+	if c.shadowAddress == "" {
+		return nil
+	}
+
+	listener := c.mismatchListener
+	if listener == nil {
+		listener = func(mismatch Mismatch) {
+			c.logger.Infof("Shadow mismatch on %s", mismatch.String())
+		}
+	}
+
+	return &shadow{
+		address:     c.shadowAddress,
+		adminToken:  c.shadowAdminToken,
+		dialTimeout: c.dialTimeout,
+		compareRate: c.compareRate,
+		listener:    listener,
+		queue:       make(chan shadowRequest, c.mirrorQueue),
+		done:        make(chan struct{}),
+	}
+}
+
+func (s *shadow) start() {
+	if s != nil {
+		go s.sendQueued()
+	}
+}
+
+func (s *shadow) stop() {
+	if s != nil {
+		s.stopOnce.Do(func() { close(s.done) })
+	}
+}
+
+// observe
+/**
+* Queue a request the primary answered for the shadow: writes the primary accepted are mirrored, and a sample of reads
+* on single keys are compared. Never blocks, requests arriving while the queue is full are dropped and counted.
+ */
+func (s *shadow) observe(command wire.Command, database string, request []byte, response [][]byte) {
+	if s == nil || len(response) == 0 {
+		return
+	}
+
+	queued := shadowRequest{request: request, command: command, database: database}
+	switch {
+	case wire.IsWrite(command):
+		responseCommand, _ := s.wire.DecipherCommand(response[len(response)-1])
+		if responseCommand == wire.ERR {
+			return
+		}
+	case comparedReads[command] && rand.Float64()*100 < s.compareRate:
+		// a copy, as the proxy consumes the response when writing it to the client
+		queued.compare = append([][]byte(nil), response...)
+	default:
+		return
+	}
+
+	select {
+	case s.queue <- queued:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *shadow) sendQueued() {
+	for {
+		select {
+		case <-s.done:
+			if s.upstream != nil {
+				s.upstream.connection.Close()
+			}
+			return
+		case queued := <-s.queue:
+			s.send(queued)
+		}
+	}
+}
+
+func (s *shadow) send(queued shadowRequest) {
+	response, err := s.roundTrip(queued.request, queued.database)
+	if err != nil {
+		s.failed.Add(1)
+		return
+	}
+
+	if queued.compare == nil {
+		s.mirrored.Add(1)
+		return
+	}
+
+	s.compared.Add(1)
+	if bytes.Equal(bytes.Join(response, nil), bytes.Join(queued.compare, nil)) {
+		return
+	}
+	s.mismatches.Add(1)
+
+	mismatch := Mismatch{Command: queued.command, Primary: s.describe(queued.compare), Shadow: s.describe(response)}
+	if _, arguments, err := s.wire.DecodeFrame(queued.request); err == nil && len(arguments) > 0 {
+		mismatch.Key = arguments[0]
+	}
+	s.listener(mismatch)
+}
+
+// roundTrip
+/**
+* Send a request to the shadow in database, connecting first when there is no open connection. A request answered with
+* a recycle notice was not processed, so it is sent once more on a new connection.
+ */
+func (s *shadow) roundTrip(request []byte, database string) ([][]byte, error) {
+	var response [][]byte
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		response, err = s.sendOnce(request, database)
+		if err != nil || len(response) != 1 || !errors.Is(s.wire.DecodeError(response[0]), wire.ErrConnectionRecycled) {
+			return response, err
+		}
+		s.disconnect()
+	}
+
+	return response, wire.ErrConnectionRecycled
+}
+
+func (s *shadow) sendOnce(request []byte, database string) ([][]byte, error) {
+	if s.upstream == nil {
+		connection, err := net.DialTimeout("tcp", s.address, s.dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		s.upstream = newUpstream(connection)
+
+		if s.adminToken != "" {
+			err = s.sendSetting(wire.AUTH, s.adminToken)
+			if err != nil {
+				s.disconnect()
+				return nil, err
+			}
+		}
+	}
+
+	if database != s.database {
+		err := s.sendSetting(wire.SELECTDB, database)
+		if err != nil {
+			s.disconnect()
+			return nil, err
+		}
+		s.database = database
+	}
+
+	response, err := s.upstream.send(request)
+	if err != nil {
+		s.disconnect()
+		return nil, err
+	}
+	return response, nil
+}
+
+// sendSetting sends a command changing the connection's session, such as AUTH, returning the error unless it is ACKed
+func (s *shadow) sendSetting(command wire.Command, argument string) error {
+	request, err := s.wire.EncodeMessage(command, argument)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.upstream.send(request)
+	if err != nil {
+		return err
+	}
+	responseCommand, _ := s.wire.DecipherCommand(response[0])
+	if responseCommand != wire.ACK {
+		return s.wire.DecodeError(response[0])
+	}
+	return nil
+}
+
+func (s *shadow) disconnect() {
+	s.upstream.connection.Close()
+	s.upstream = nil
+	s.database = ""
+}
+
+// describe renders a response for a Mismatch
+func (s *shadow) describe(response [][]byte) string {
+	var arguments []string
+	var command wire.Command
+	for _, frame := range response {
+		frameCommand, frameArguments, err := s.wire.DecodeFrame(frame)
+		if err != nil {
+			return fmt.Sprintf("%q", frame)
+		}
+		if frameCommand == wire.CONTINUED && len(frameArguments) > 0 {
+			frameArguments = frameArguments[1:]
+		}
+		command = frameCommand
+		arguments = append(arguments, frameArguments...)
+	}
+
+	described := []string{string(command)}
+	for _, argument := range arguments {
+		described = append(described, fmt.Sprintf("%q", argument))
+	}
+	return strings.Join(described, " ")
+}
+
+// stats returns the statistics the proxy adds to STATS
+func (s *shadow) stats() map[string]int64 {
+	if s == nil {
+		return map[string]int64{}
+	}
+
+	return map[string]int64{
+		"proxy-shadow-mirrored": s.mirrored.Load(),
+		"proxy-shadow-dropped":  s.dropped.Load(),
+		"proxy-shadow-failed":   s.failed.Load(),
+		"proxy-compared":        s.compared.Load(),
+		"proxy-mismatches":      s.mismatches.Load(),
+	}
+}
@@ -0,0 +1,620 @@
+package server
+
+import (
+	"bufio"
+	"datastore/engine"
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AppendSync is how often the append only log is flushed to disk, see WithAppendOnlyLog
+type AppendSync int
+
+const (
+	// AppendSyncAlways flushes the log before each logged write is answered, so an answered write survives the machine
+	// crashing
+	AppendSyncAlways AppendSync = iota
+	// AppendSyncEverySecond flushes the log once a second, so the machine crashing loses at most the last second of writes
+	AppendSyncEverySecond
+	// AppendSyncNever leaves flushing the log to the operating system
+	AppendSyncNever
+)
+
+// appendSyncInterval is how often AppendSyncEverySecond flushes the log
+const appendSyncInterval = time.Second
+
+// ErrNoAppendOnlyLog is returned by RewriteAppendOnlyLog when the server was created without WithAppendOnlyLog
+var ErrNoAppendOnlyLog = errors.New("the server has no append only log")
+
+// appendLog
+/**
+* The append only log set with WithAppendOnlyLog, held by pointer so copies of the Server share it
+*
+* Every write command that changes something is appended with the keys and values middleware resolved it to, see
+* resolvedFrame, and is replayed without going through middleware again. Logged commands run one at a time, each
+* appended before the next one starts, so the log holds them in the order they changed the store and replaying it
+* rebuilds the same store. Commands that failed or found nothing to change, answered with ERR or NULL, are
+* not logged. CONFIG changes settings rather than the store and is not logged either.
+*
+* SELECTDB is not logged as it is sent, since most connections select a database and then only read. A logged command
+* run in a different database from the one before it is preceded in the log by a SELECTDB of its database instead.
+*
+* A logged write that leaves its keys expiring is followed in the log by an EXPIRE of each at the time it falls at, see
+* resolvedExpirations, so EXPIREIN, GETORSET with a TTL, the default TTL, and TTL rules do not count from when the log
+* is replayed. Keys whose expiration has passed by then only expire once the whole log has been replayed, see
+* replayFrame.
+ */
+type appendLog struct {
+	path   string
+	sync   AppendSync
+	logger Logger
+
+	// mutex is held while a logged command runs and is appended, and while the log is opened, rewritten, or closed
+	mutex sync.Mutex
+	file  *os.File
+	// replayed is set once the log has been replayed into the store, which only the first Start does
+	replayed bool
+	// database is the one the last command in the log ran in, empty for the default database, see append
+	database string
+	// unsynced is set while appended commands wait for the next flush under AppendSyncEverySecond
+	unsynced bool
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// newAppendLog returns nil when no path was configured, a nil appendLog logs nothing
+func newAppendLog(path string, sync AppendSync, logger Logger) *appendLog {
+	if path == "" {
+		return nil
+	}
+	return &appendLog{path: path, sync: sync, logger: logger}
+}
+
+// open replays the log into the store the first time it is opened, then opens it for appending
+func (l *appendLog) open(s *Server) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		return nil
+	}
+
+	if !l.replayed {
+		err := l.replay(s)
+		if err != nil {
+			return err
+		}
+		l.replayed = true
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+
+	if l.sync == AppendSyncEverySecond {
+		l.stopSync = make(chan struct{})
+		l.syncDone = make(chan struct{})
+		go l.syncEverySecond(l.stopSync, l.syncDone)
+	}
+	return nil
+}
+
+// replay
+/**
+* Run every command in the log against the store as a resolved admin session, the caller must hold the mutex
+*
+* Keys do not expire part way through the replay, see replayFrame, the expirations that have passed are applied once
+* every command has run. A log cut short by a crash ends in a frame that cannot be read whole. The log is truncated to
+* the last frame that could be, with a warning, rather than refusing to start.
+ */
+func (l *appendLog) replay(s *Server) error {
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	replaying := &session{admin: true, resolved: true}
+	held := heldExpirations{}
+	frames := wire.NewFrameReader(file, wire.MaxFrameSize)
+	complete := int64(0)
+	replayed := 0
+	for {
+		frame, err := frames.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			_, err = s.wire.DecipherCommand(frame)
+		}
+		if err != nil {
+			l.logger.Errorf("Truncating the append only log %s to the %d commands before byte %d, the rest could not be read: %s", l.path, replayed, complete, err.Error())
+			l.database = replaying.database
+			held.apply(s, replaying)
+			return file.Truncate(complete)
+		}
+
+		err = s.replayFrame(replaying, frame, held)
+		if err != nil {
+			l.logger.Errorf("Replaying command %d of the append only log %s failed: %s", replayed+1, l.path, err.Error())
+		}
+		complete += int64(len(frame))
+		replayed++
+	}
+
+	l.database = replaying.database
+	held.apply(s, replaying)
+	return nil
+}
+
+// heldExpirations are the EXPIREs of a log being replayed whose time has passed by database and key, see replayFrame
+type heldExpirations map[string]map[string][]byte
+
+// replayFrame
+/**
+* Run a command of the log being replayed, holding back an EXPIRE whose time has passed rather than expiring the key
+* while later commands in the log may still have found it live, such as an EXPIREIN that extended it in time. A later
+* command writing the key drops the held EXPIRE, since the log carries the key's expiration after that command.
+*
+* Every logged command succeeded when it was first run, so one that fails on a key whose EXPIRE was held back ran after
+* the key expired, and runs again once the key has.
+ */
+func (s *Server) replayFrame(replaying *session, frame []byte, held heldExpirations) error {
+	if command, _ := s.wire.DecipherCommand(frame); command == wire.EXPIRE {
+		key, expiration, _, err := s.wire.DecodeExpireWithMode(frame)
+		if err == nil && !expiration.After(s.clock()) {
+			if held[replaying.database] == nil {
+				held[replaying.database] = map[string][]byte{}
+			}
+			held[replaying.database][key] = frame
+			return nil
+		}
+	}
+
+	replaying.written = replaying.written[:0]
+	response, err := s.handleMessage(replaying, frame)
+	if err == nil {
+		err = responseError(s, response)
+	}
+	if err != nil && held.release(s, replaying) {
+		replaying.written = replaying.written[:0]
+		response, err = s.handleMessage(replaying, frame)
+		if err == nil {
+			err = responseError(s, response)
+		}
+	}
+
+	for _, key := range replaying.written {
+		delete(held[replaying.database], key.stored)
+	}
+	return err
+}
+
+// release applies the held EXPIREs of the keys the command just replayed wrote, reporting whether there were any
+func (h heldExpirations) release(s *Server, replaying *session) bool {
+	written := append([]writtenKey(nil), replaying.written...)
+	released := false
+	for _, key := range written {
+		frame, isHeld := h[replaying.database][key.stored]
+		if isHeld {
+			delete(h[replaying.database], key.stored)
+			s.handleMessage(replaying, frame)
+			released = true
+		}
+	}
+	return released
+}
+
+// apply runs every held EXPIRE once the log has been replayed, those of keys a command that did not name them removed,
+// such as DELETEBY, failing quietly
+func (h heldExpirations) apply(s *Server, replaying *session) {
+	for database, frames := range h {
+		replaying.database = database
+		for _, frame := range frames {
+			s.handleMessage(replaying, frame)
+		}
+	}
+}
+
+// responseError returns the error an ERR response carries, nil for any other response
+func responseError(s *Server, response net.Buffers) error {
+	command, err := s.wire.DecipherCommand(response[0])
+	if err != nil || command != wire.ERR {
+		return err
+	}
+	return s.wire.DecodeError(response[0])
+}
+
+// append writes the frames of a logged command run in database to the log, after a SELECTDB when the command before it
+// ran in another one, the caller must hold the mutex
+func (l *appendLog) append(database string, frames ...[]byte) error {
+	if l.file == nil {
+		return nil
+	}
+
+	if database != l.database {
+		selectDB, err := (&wire.Protocol{}).EncodeMessage(wire.SELECTDB, database)
+		if err != nil {
+			return err
+		}
+		_, err = l.file.Write(selectDB)
+		if err != nil {
+			return err
+		}
+		l.database = database
+	}
+
+	for _, frame := range frames {
+		_, err := l.file.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch l.sync {
+	case AppendSyncAlways:
+		return l.file.Sync()
+	case AppendSyncEverySecond:
+		l.unsynced = true
+	}
+	return nil
+}
+
+func (l *appendLog) syncEverySecond(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(appendSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mutex.Lock()
+			if l.unsynced && l.file != nil {
+				err := l.file.Sync()
+				if err != nil {
+					l.logger.Errorf("Error syncing the append only log: %s", err.Error())
+				}
+				l.unsynced = false
+			}
+			l.mutex.Unlock()
+		}
+	}
+}
+
+// close flushes and closes the log, which open appends to again
+func (l *appendLog) close() {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	stop, done := l.stopSync, l.syncDone
+	l.stopSync, l.syncDone = nil, nil
+	l.mutex.Unlock()
+	// stopped without holding the mutex, which a flush in progress is waiting for
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return
+	}
+	err := l.file.Sync()
+	if err == nil {
+		err = l.file.Close()
+	}
+	if err != nil {
+		l.logger.Errorf("Error closing the append only log: %s", err.Error())
+	}
+	l.file = nil
+	l.unsynced = false
+}
+
+// runCommand
+/**
+* Handle a request, streaming its resolvedFrame to the replicas and appending it to the append only log when it is a
+* write that changed something, followed by the resolvedExpirations of the keys it wrote
+*
+* A write that was applied but could not be appended is answered with an error, since it may not survive a restart.
+* Replicas refuse every write but those their primary streams with a READONLY error.
+ */
+func (s *Server) runCommand(session *session, command wire.Command, message []byte) (net.Buffers, error) {
+	if !changesStore(command) {
+		return s.handleMessage(session, message)
+	}
+	if s.replicaOf != "" && !session.replicating {
+		return net.Buffers{s.wire.EncodeErrResponse(wire.ErrReadOnly)}, nil
+	}
+
+	defer s.replicas.holdWrite()()
+	if s.appendLog != nil {
+		s.appendLog.mutex.Lock()
+		defer s.appendLog.mutex.Unlock()
+	}
+	session.written = session.written[:0]
+	response, err := s.handleMessage(session, message)
+	if err != nil {
+		return nil, err
+	}
+
+	answered, err := s.wire.DecipherCommand(response[0])
+	if err != nil || answered == wire.ERR || answered == wire.NULL {
+		return response, nil
+	}
+
+	frames := append([][]byte{s.resolvedFrame(session, command, message)}, s.resolvedExpirations(session, command)...)
+	for _, frame := range frames {
+		s.replicas.stream(session.database, frame)
+	}
+	if s.appendLog == nil {
+		return response, nil
+	}
+	err = s.appendLog.append(session.database, frames...)
+	if err != nil {
+		s.logger.Errorf("Error appending %s to the append only log: %s", command, err.Error())
+		return nil, fmt.Errorf("the write was applied but could not be appended to the append only log: %w", err)
+	}
+	return response, nil
+}
+
+// prefixWrites are the writes on every key under a prefix, which note the prefix on the session rather than the keys,
+// see beforePrefixWrite
+var prefixWrites = map[wire.Command]bool{wire.DELETEBY: true, wire.UPDATEBY: true, wire.EXPIREBY: true, wire.TRUNCATE: true}
+
+// resolvedExpirations
+/**
+* Return an EXPIRE at the time it falls at for each key a write left expiring, logged and streamed after the write so
+* replaying it or applying it on a replica does not count a relative TTL from then instead. EXPIRE already carries one,
+* and the prefixWrites set none. Each EXPIRE names the key middleware resolved, like resolvedFrame.
+ */
+func (s *Server) resolvedExpirations(session *session, command wire.Command) [][]byte {
+	if command == wire.EXPIRE || prefixWrites[command] || len(session.written) == 0 {
+		return nil
+	}
+
+	store := s.database(session.database)
+	var frames [][]byte
+	for _, key := range session.written {
+		expiration, expires := store.ReadExpiration(key.stored)
+		if !expires {
+			continue
+		}
+		frame, err := s.wire.EncodeMessage(wire.EXPIRE, key.stored, s.wire.EncodeTime(expiration))
+		if err == nil {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// resolvedFrame
+/**
+* Return the frame of a write with the keys and values middleware resolved it to in place of those it was sent with,
+* see writtenKey, so that replaying it or applying it on a replica writes what the store holds without running the
+* middleware again, under the identity of a session that is gone. The frame is returned as it was sent when there is
+* no middleware to resolve it through.
+ */
+func (s *Server) resolvedFrame(session *session, command wire.Command, message []byte) []byte {
+	if len(s.middleware) == 0 || session.resolved || len(session.written) == 0 {
+		return message
+	}
+
+	frame, err := s.resolveFrame(command, message, session.written)
+	if err != nil {
+		s.logger.Errorf("Error resolving %s for the append only log and replicas, writing it as it was sent: %s", command, err.Error())
+		return message
+	}
+	return frame
+}
+
+// resolveFrame puts the keys and values written resolved to in place of the ones a frame of command carries, those of a
+// MULTI in place of the ones of each command it carries in turn
+func (s *Server) resolveFrame(command wire.Command, message []byte, written []writtenKey) ([]byte, error) {
+	if command == wire.MULTI {
+		frames, err := s.wire.DecodeMulti(message)
+		if err != nil {
+			return nil, err
+		}
+		if len(frames) != len(written) {
+			return nil, fmt.Errorf("expected %d resolved keys but found %d", len(frames), len(written))
+		}
+		for i, frame := range frames {
+			carried, _ := s.wire.DecipherCommand(frame)
+			frames[i], err = s.resolveFrame(carried, frame, written[i:i+1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s.wire.EncodeMulti(frames)
+	}
+
+	// a TRUNCATE middleware resolved to the keys under a prefix deletes them
+	if command == wire.TRUNCATE {
+		if len(written) != 1 || written[0].stored == "" {
+			return message, nil
+		}
+		return s.wire.EncodeMessage(wire.DELETEBY, written[0].stored)
+	}
+
+	_, arguments, err := s.wire.DecodeFrame(message)
+	if err != nil {
+		return nil, err
+	}
+	expected := 1
+	switch command {
+	case wire.INSERTMANY:
+		expected = len(arguments) / 2
+	case wire.RENAME:
+		expected = 2
+	}
+	if len(written) != expected {
+		return nil, fmt.Errorf("expected %d resolved keys but found %d", expected, len(written))
+	}
+
+	switch command {
+	case wire.INSERTMANY:
+		for i, key := range written {
+			arguments[2*i], arguments[2*i+1] = key.stored, key.value
+		}
+	case wire.RENAME:
+		arguments[0], arguments[1] = written[0].stored, written[1].stored
+	case wire.HSET:
+		arguments[0], arguments[2] = written[0].stored, written[0].value
+	case wire.INSERT, wire.UPDATE, wire.UPSERT, wire.GETUPDATE, wire.GETORSET, wire.UPDATEBY:
+		arguments[0], arguments[1] = written[0].stored, written[0].value
+	default:
+		arguments[0] = written[0].stored
+	}
+	return s.wire.EncodeMessage(command, arguments...)
+}
+
+// RewriteAppendOnlyLog
+/**
+* Replace the append only log with the fewest commands that rebuild what the store holds now: an UPSERT or an HSET of
+* each field for every key, and an EXPIRE for every key that expires, for the default database and then for each named
+* database after a SELECTDB of it
+*
+* Logged writes wait for the rewrite to finish. The new log is written next to the old one and renamed over it, so a
+* crash part way through leaves the old log in place. Returns ErrNoAppendOnlyLog without WithAppendOnlyLog, and an
+* error before Start has replayed the log, since the store does not hold what it logged yet.
+ */
+func (s *Server) RewriteAppendOnlyLog() error {
+	l := s.appendLog
+	if l == nil {
+		return ErrNoAppendOnlyLog
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.replayed {
+		return errors.New("the append only log is replayed by Start, it cannot be rewritten before")
+	}
+
+	rewritten := l.path + ".rewrite"
+	database, err := s.writeStoreCommands(rewritten)
+	if err != nil {
+		os.Remove(rewritten)
+		return err
+	}
+
+	err = os.Rename(rewritten, l.path)
+	if err != nil {
+		os.Remove(rewritten)
+		return err
+	}
+	syncDirectory(filepath.Dir(l.path))
+	l.database = database
+
+	if l.file == nil {
+		return nil
+	}
+	l.file.Close()
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	l.unsynced = false
+	return err
+}
+
+// writeStoreCommands
+/**
+* Write the commands rebuilding a snapshot of every database to a new file at path and flush it, returning the name of
+* the database the last of them runs in
+ */
+func (s *Server) writeStoreCommands(path string) (string, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	database, err := s.writeSnapshot(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	return database, err
+}
+
+// writeSnapshot
+/**
+* Write the commands rebuilding a snapshot of every database to writer: an UPSERT or an HSET of each field for every
+* key, and an EXPIRE for every key that expires, for the default database and then for each named database after a
+* SELECTDB of it. Returns the name of the database the last of them runs in.
+ */
+func (s *Server) writeSnapshot(writer io.Writer) (string, error) {
+	var err error
+	write := func(command wire.Command, arguments ...string) {
+		if err != nil {
+			return
+		}
+		var message []byte
+		message, err = s.wire.EncodeMessage(command, arguments...)
+		if err == nil {
+			_, err = writer.Write(message)
+		}
+	}
+	writeDatabase := func(store *engine.DataStore) {
+		snapshot := store.Snapshot()
+		defer snapshot.Release()
+
+		snapshot.ForEach(func(key string, value string, expiration time.Time) bool {
+			if fields, holdsHash := snapshot.HGetAll(key); holdsHash {
+				names := make([]string, 0, len(fields))
+				for name := range fields {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					write(wire.HSET, key, name, fields[name])
+				}
+			} else {
+				write(wire.UPSERT, key, value)
+			}
+			if !expiration.IsZero() {
+				write(wire.EXPIRE, key, s.wire.EncodeTime(expiration))
+			}
+			return err == nil
+		})
+	}
+
+	database := ""
+	writeDatabase(&s.dataStore)
+	for _, name := range s.databaseNames() {
+		if err != nil {
+			break
+		}
+		write(wire.SELECTDB, name)
+		database = name
+		writeDatabase(s.database(name))
+	}
+
+	return database, err
+}
+
+// syncDirectory flushes a rename in dir to disk where the platform allows it, failing quietly where it does not
+func syncDirectory(dir string) {
+	directory, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	directory.Sync()
+	directory.Close()
+}
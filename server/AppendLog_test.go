@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"datastore/wire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// run sends a request through runCommand, as a connection would, so writes are appended to the log
+func run(t *testing.T, server *Server, command wire.Command, arguments ...string) wire.Command {
+	protocol := wire.Protocol{}
+	request, err := protocol.EncodeMessage(command, arguments...)
+	if err != nil {
+		t.Fatalf("Error encoding %s request %q", command, err)
+	}
+
+	response, err := server.runCommand(&session{admin: true}, command, request)
+	if err != nil {
+		t.Fatalf("Expected the %s request to be handled but got %q", command, err)
+	}
+	responseCommand, _ := protocol.DecipherCommand(response[0])
+	return responseCommand
+}
+
+// startWithLog starts a server on a free port appending to the log at path
+func startWithLog(t *testing.T, path string, opts ...Option) *Server {
+	server := New("localhost", 0, append(opts, WithAppendOnlyLog(path, AppendSyncAlways))...)
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	return &server
+}
+
+func TestTheAppendOnlyLogRebuildsTheStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+	protocol := wire.Protocol{}
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	first := startWithLog(t, path)
+	run(t, first, wire.INSERT, "region:1:store:1", "1")
+	run(t, first, wire.INSERT, "region:1:store:2", "2")
+	run(t, first, wire.INSERT, "region:2:store:1", "3")
+	run(t, first, wire.UPDATE, "region:1:store:1", "10")
+	run(t, first, wire.UPSERT, "region:1:store:3", "4")
+	run(t, first, wire.DELETE, "region:1:store:2")
+	run(t, first, wire.EXPIRE, "region:1:store:3", protocol.EncodeTime(expiration))
+	run(t, first, wire.DELETEBY, "region:2")
+	run(t, first, wire.HSET, "user:1", "name", "ada")
+	run(t, first, wire.READ, "region:1:store:1")
+	if responseCommand := run(t, first, wire.INSERT, "region:1:store:1", "ignored"); responseCommand == wire.ACK {
+		t.Fatalf("Expected inserting a present key to fail")
+	}
+	first.Stop()
+
+	logged := 0
+	log, _ := os.ReadFile(path)
+	for len(log) > 0 {
+		frame, err := wire.NewFrameReader(bytes.NewReader(log), wire.MaxFrameSize).ReadFrame()
+		if err != nil {
+			t.Fatalf("Error reading the log %q", err)
+		}
+		log = log[len(frame):]
+		logged++
+	}
+	if logged != 9 {
+		t.Fatalf("Expected the 9 writes that changed the store to be logged but found %d", logged)
+	}
+
+	second := startWithLog(t, path)
+	defer second.Stop()
+	expected := map[string]string{"region:1:store:1": "10", "region:1:store:3": "4"}
+	if second.dataStore.Count() != 3 {
+		t.Fatalf("Expected 3 keys after replaying the log but found %d", second.dataStore.Count())
+	}
+	for key, value := range expected {
+		if actual, present := second.dataStore.Read(key); !present || actual != value {
+			t.Fatalf("Expected %q to hold %q after replaying the log but found %q", key, value, actual)
+		}
+	}
+	if actual, present := second.dataStore.ReadExpiration("region:1:store:3"); !present || !actual.Equal(expiration) {
+		t.Fatalf("Expected the expiration %s to be replayed but found %s", expiration, actual)
+	}
+	if value, present, err := second.dataStore.HGet("user:1", "name"); err != nil || !present || value != "ada" {
+		t.Fatalf("Expected the hash to be replayed but found %q", value)
+	}
+}
+
+func TestACorruptTailOfTheAppendOnlyLogIsTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+	protocol := wire.Protocol{}
+
+	first := startWithLog(t, path)
+	run(t, first, wire.INSERT, "region:1:store:1", "1")
+	run(t, first, wire.INSERT, "region:1:store:2", "2")
+	first.Stop()
+
+	complete, _ := os.ReadFile(path)
+	cutShort, _ := protocol.EncodeMessage(wire.INSERT, "region:1:store:3", "3")
+	os.WriteFile(path, append(append([]byte{}, complete...), cutShort[:len(cutShort)-2]...), 0644)
+
+	second := startWithLog(t, path)
+	if second.dataStore.Count() != 2 {
+		t.Fatalf("Expected the 2 complete commands to be replayed but found %d keys", second.dataStore.Count())
+	}
+	if truncated, _ := os.ReadFile(path); len(truncated) != len(complete) {
+		t.Fatalf("Expected the log to be truncated to %d bytes but found %d", len(complete), len(truncated))
+	}
+
+	// writes after the truncation are appended to the complete commands
+	run(t, second, wire.INSERT, "region:1:store:3", "3")
+	second.Stop()
+	third := startWithLog(t, path)
+	defer third.Stop()
+	if third.dataStore.Count() != 3 {
+		t.Fatalf("Expected the write after the truncation to be replayed but found %d keys", third.dataStore.Count())
+	}
+}
+
+func TestRewritingTheAppendOnlyLogKeepsOnlyTheCurrentState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+	protocol := wire.Protocol{}
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	unlogged := New("localhost", 0)
+	if err := unlogged.RewriteAppendOnlyLog(); err != ErrNoAppendOnlyLog {
+		t.Fatalf("Expected a server without a log to refuse rewriting it but got %q", err)
+	}
+
+	first := startWithLog(t, path)
+	for i := 0; i < 100; i++ {
+		run(t, first, wire.UPSERT, "counter", "value")
+	}
+	run(t, first, wire.INSERT, "region:1:store:1", "1")
+	run(t, first, wire.DELETE, "region:1:store:1")
+	run(t, first, wire.EXPIRE, "counter", protocol.EncodeTime(expiration))
+	run(t, first, wire.HSET, "user:1", "name", "ada")
+	run(t, first, wire.HSET, "user:1", "email", "ada@example.com")
+	before, _ := os.Stat(path)
+
+	err := first.RewriteAppendOnlyLog()
+	if err != nil {
+		t.Fatalf("Error rewriting the log %q", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("Expected the rewritten log to be smaller than %d bytes but found %d", before.Size(), after.Size())
+	}
+
+	// writes after the rewrite are appended to the rewritten log
+	run(t, first, wire.INSERT, "region:1:store:2", "2")
+	first.Stop()
+
+	second := startWithLog(t, path)
+	defer second.Stop()
+	if second.dataStore.Count() != 3 {
+		t.Fatalf("Expected 3 keys after replaying the rewritten log but found %d", second.dataStore.Count())
+	}
+	if actual, present := second.dataStore.ReadExpiration("counter"); !present || !actual.Equal(expiration) {
+		t.Fatalf("Expected the expiration %s to be rewritten but found %s", expiration, actual)
+	}
+	fields, err := second.dataStore.HGetAll("user:1")
+	if err != nil || len(fields) != 2 || fields["email"] != "ada@example.com" {
+		t.Fatalf("Expected both fields of the hash to be rewritten but found %v", fields)
+	}
+	if value, present := second.dataStore.Read("region:1:store:2"); !present || value != "2" {
+		t.Fatalf("Expected the write after the rewrite to be replayed but found %q", value)
+	}
+}
+
+func TestReplayingTheAppendOnlyLogKeepsTheExpirationsRelativeTTLsResolvedTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+	protocol := wire.Protocol{}
+	var elapsed atomic.Int64
+	clock := func() time.Time {
+		return time.Now().Add(time.Duration(elapsed.Load()))
+	}
+
+	first := startWithLog(t, path, WithClock(clock), WithDefaultTTL(time.Minute))
+	run(t, first, wire.INSERT, "defaulted", "1")
+	run(t, first, wire.GETORSET, "cached", "2", protocol.EncodeDuration(time.Minute))
+	run(t, first, wire.INSERT, "extended", "3")
+	run(t, first, wire.EXPIREIN, "extended", protocol.EncodeDuration(time.Hour))
+	run(t, first, wire.INSERT, "recreated", "old")
+	elapsed.Store(int64(time.Second * 90))
+	if responseCommand := run(t, first, wire.INSERT, "recreated", "new"); responseCommand != wire.ACK {
+		t.Fatalf("Expected the expired key to be inserted again but got %s", responseCommand)
+	}
+	first.Stop()
+
+	// the replaying server has no default TTL and starts once the first minute has gone by
+	elapsed.Store(int64(time.Minute * 2))
+	second := startWithLog(t, path, WithClock(clock))
+	defer second.Stop()
+	for _, key := range []string{"defaulted", "cached"} {
+		if _, present := second.dataStore.Read(key); present {
+			t.Fatalf("Expected %q to have expired a minute after it was written but it was replayed", key)
+		}
+	}
+	if ttl, expires := second.dataStore.TTL("extended"); !expires || ttl > time.Hour-time.Minute {
+		t.Fatalf("Expected %q to have expired an hour after it was extended but found %s left", "extended", ttl)
+	}
+	if value, present := second.dataStore.Read("recreated"); !present || value != "new" {
+		t.Fatalf("Expected %q to hold the value it was inserted with again but found %q", "recreated", value)
+	}
+	if ttl, _ := second.dataStore.TTL("recreated"); ttl > time.Second*30 {
+		t.Fatalf("Expected %q to expire a minute after it was inserted again but found %s left", "recreated", ttl)
+	}
+}
+
+// writeAsTenant writes keys of every shape as an anonymous session, which tenantKeys keeps under "anonymous:"
+func writeAsTenant(t *testing.T, server *Server) {
+	protocol := wire.Protocol{}
+	anonymous := &session{}
+	runIn(t, server, anonymous, wire.INSERT, "a", "1")
+	runIn(t, server, anonymous, wire.EXPIREIN, "a", protocol.EncodeDuration(time.Hour))
+	runIn(t, server, anonymous, wire.INSERTMANY, "b", "2", "c", "3")
+	runIn(t, server, anonymous, wire.RENAME, "c", "d", "false")
+	runIn(t, server, anonymous, wire.HSET, "user", "name", "ada")
+	upsert, _ := protocol.EncodeMessage(wire.UPSERT, "e", "5")
+	multi, _ := protocol.EncodeMulti([][]byte{upsert})
+	response, err := server.runCommand(anonymous, wire.MULTI, multi)
+	if err != nil || len(response) == 0 {
+		t.Fatalf("Expected the MULTI request to be handled but got %q", err)
+	}
+}
+
+// expectTenantKeys fails unless the store holds the keys writeAsTenant wrote, under "anonymous:" and no other prefix
+func expectTenantKeys(t *testing.T, server *Server) {
+	keys := server.dataStore.KeysBy("")
+	sort.Strings(keys)
+	expected := []string{"anonymous:a", "anonymous:b", "anonymous:d", "anonymous:e", "anonymous:user"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected the keys %v middleware resolved to be replayed but found %v", expected, keys)
+	}
+	if _, expires := server.dataStore.TTL("anonymous:a"); !expires {
+		t.Fatalf("Expected the expiration of %q to be replayed", "anonymous:a")
+	}
+}
+
+func TestReplayingTheAppendOnlyLogKeepsTheKeysMiddlewareResolved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+
+	first := startWithLog(t, path, WithMiddleware(tenantKeys))
+	writeAsTenant(t, first)
+	expectTenantKeys(t, first)
+	first.Stop()
+
+	// replaying as an admin does not move the keys under "admin:"
+	second := startWithLog(t, path, WithMiddleware(tenantKeys))
+	defer second.Stop()
+	expectTenantKeys(t, second)
+}
+
+func TestReplayingARewrittenAppendOnlyLogKeepsTheKeysMiddlewareResolved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+
+	first := startWithLog(t, path, WithMiddleware(tenantKeys))
+	writeAsTenant(t, first)
+	first.Stop()
+
+	second := startWithLog(t, path, WithMiddleware(tenantKeys))
+	err := second.RewriteAppendOnlyLog()
+	if err != nil {
+		t.Fatalf("Error rewriting the log %q", err)
+	}
+	second.Stop()
+
+	third := startWithLog(t, path, WithMiddleware(tenantKeys))
+	defer third.Stop()
+	expectTenantKeys(t, third)
+}
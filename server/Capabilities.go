@@ -0,0 +1,31 @@
+package server
+
+import "datastore/wire"
+
+// Version identifies the build of the server in answers to CAPABILITIES, set at build time with
+// -ldflags "-X datastore/server.Version=..."
+var Version = "devel"
+
+// capabilities
+/**
+* What the server tells clients about itself in answer to CAPABILITIES: what the protocol version it speaks supports,
+* and what its configuration adds at the time of asking, since the tokens and the protected prefixes decide whether a
+* client should AUTH
+ */
+func (s *Server) capabilities() wire.Capabilities {
+	flags := wire.SpecCapabilities()
+	if s.adminToken != "" || s.requiredToken != "" {
+		flags = append(flags, wire.CapabilityAuth)
+	}
+	if s.requiredToken != "" {
+		flags = append(flags, wire.CapabilityAuthRequired)
+	}
+	if len(s.ProtectedPrefixes()) > 0 {
+		flags = append(flags, wire.CapabilityProtectedPrefixes)
+	}
+	if s.replicaOf != "" {
+		flags = append(flags, wire.CapabilityReadOnly)
+	}
+
+	return wire.Capabilities{ProtocolVersion: wire.ProtocolVersion, ServerVersion: Version, Flags: flags}
+}
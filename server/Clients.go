@@ -0,0 +1,98 @@
+package server
+
+import (
+	"datastore/wire"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connectionState
+/**
+* What one open connection is doing, reported by CLIENTS. handleConnection registers it when the connection is accepted,
+* updates it as each command starts and finishes, and unregisters it when the connection closes.
+ */
+type connectionState struct {
+	id            int64
+	remoteAddress string
+	connectedAt   time.Time
+
+	mutex    sync.Mutex
+	requests int64
+	bytesIn  int64
+	bytesOut int64
+	command  wire.Command
+	started  time.Time
+	identity string
+}
+
+// begin records a request of size bytes starting to run
+func (c *connectionState) begin(command wire.Command, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.command = command
+	c.started = time.Now()
+	c.bytesIn += int64(size)
+}
+
+// finish records the running command having been answered with a response of size bytes
+func (c *connectionState) finish(size int, identity string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.command = ""
+	c.started = time.Time{}
+	c.requests++
+	c.bytesOut += int64(size)
+	c.identity = identity
+}
+
+func (c *connectionState) info(now time.Time) wire.ClientInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	info := wire.ClientInfo{
+		ID:            c.id,
+		RemoteAddress: c.remoteAddress,
+		ConnectedAt:   c.connectedAt,
+		Requests:      c.requests,
+		BytesIn:       c.bytesIn,
+		BytesOut:      c.bytesOut,
+		Command:       c.command,
+		Identity:      c.identity,
+	}
+	if c.command != "" {
+		info.Running = now.Sub(c.started)
+	}
+
+	return info
+}
+
+// clients describes every open connection, ordered by ID
+func (t *connectionTracker) clients() []wire.ClientInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	clients := make([]wire.ClientInfo, 0, len(t.open))
+	for _, state := range t.open {
+		clients = append(clients, state.info(now))
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	return clients
+}
+
+// kill closes the open connection with the ID, which ends its handleConnection, and reports whether there was one
+func (t *connectionTracker) kill(id int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for connection, state := range t.open {
+		if state.id == id {
+			connection.Close()
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"datastore/client"
+	"datastore/wire"
+	"net"
+	"testing"
+	"time"
+)
+
+// roundTrip sends a request on a raw connection and returns the command of the response
+func roundTrip(t *testing.T, connection net.Conn, command wire.Command, arguments ...string) (wire.Command, error) {
+	t.Helper()
+	protocol := wire.Protocol{}
+	request, _ := protocol.EncodeMessage(command, arguments...)
+
+	_, err := connection.Write(request)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+	if err != nil {
+		return "", err
+	}
+
+	return protocol.DecipherCommand(response)
+}
+
+func dial(t *testing.T, address string) net.Conn {
+	t.Helper()
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error connecting to server %q", err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	connection.SetDeadline(time.Now().Add(time.Second * 5))
+	return connection
+}
+
+func findClient(clients []client.ClientInfo, connection net.Conn) (client.ClientInfo, bool) {
+	for _, info := range clients {
+		if info.RemoteAddress == connection.LocalAddr().String() {
+			return info, true
+		}
+	}
+	return client.ClientInfo{}, false
+}
+
+func TestClientsDescribesEveryConnection(t *testing.T) {
+	slowStarted := make(chan bool, 1)
+	releaseSlow := make(chan bool)
+	runningServer := New("localhost", 8916, WithAdminToken("secret"))
+	runningServer.beforeCommand = func(command wire.Command) {
+		if command == wire.PING {
+			slowStarted <- true
+			<-releaseSlow
+		}
+	}
+
+	started := time.Now().Truncate(time.Millisecond)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	protocol := wire.Protocol{}
+	readRequest, _ := protocol.EncodeMessage(wire.READ, "missing")
+	pingRequest, _ := protocol.EncodeMessage(wire.PING)
+
+	idle := dial(t, "localhost:8916")
+	victim := dial(t, "localhost:8916")
+	for _, connection := range []net.Conn{idle, victim} {
+		command, err := roundTrip(t, connection, wire.READ, "missing")
+		if err != nil || command != wire.NULL {
+			t.Fatalf("Expected a NULL response but got %s: %q", command, err)
+		}
+	}
+
+	slow := dial(t, "localhost:8916")
+	slowResponse := make(chan wire.Command, 1)
+	go func() {
+		command, _ := roundTrip(t, slow, wire.PING)
+		slowResponse <- command
+	}()
+	<-slowStarted
+	time.Sleep(time.Millisecond * 50)
+
+	admin := client.New("localhost", 8916, client.WithAuthToken("secret"))
+	clients, err := admin.Clients()
+	if err != nil || len(clients) != 4 {
+		t.Fatalf("Expected 4 open connections but found %v: %q", clients, err)
+	}
+
+	idleInfo, found := findClient(clients, idle)
+	if !found || idleInfo.Command != "" || idleInfo.Running != 0 || idleInfo.Requests != 1 || idleInfo.Identity != "" {
+		t.Fatalf("Expected the idle connection to have served one request and be waiting but found %+v", idleInfo)
+	}
+	if idleInfo.BytesIn != int64(len(readRequest)) || idleInfo.BytesOut != int64(len(protocol.EncodeNullResponse())) {
+		t.Fatalf("Expected the idle connection to count the bytes of its request and response but found %+v", idleInfo)
+	}
+	if idleInfo.ConnectedAt.Before(started) || idleInfo.ConnectedAt.After(time.Now()) {
+		t.Fatalf("Expected the idle connection to have connected during the test but found %s", idleInfo.ConnectedAt)
+	}
+
+	slowInfo, found := findClient(clients, slow)
+	if !found || slowInfo.Command != wire.PING || slowInfo.Running < time.Millisecond*50 || slowInfo.Requests != 0 || slowInfo.BytesIn != int64(len(pingRequest)) {
+		t.Fatalf("Expected the slow connection to be running PING for at least 50ms but found %+v", slowInfo)
+	}
+
+	for _, info := range clients {
+		if info.Command == wire.CLIENTS && info.Identity != "admin" {
+			t.Fatalf("Expected the connection running CLIENTS to be the admin but found %+v", info)
+		}
+	}
+
+	victimInfo, _ := findClient(clients, victim)
+	killed, err := admin.KillClient(victimInfo.ID)
+	if err != nil || !killed {
+		t.Fatalf("Expected to kill connection %d but got %t: %q", victimInfo.ID, killed, err)
+	}
+
+	_, err = roundTrip(t, victim, wire.READ, "missing")
+	if err == nil {
+		t.Fatalf("Expected the killed connection to be closed")
+	}
+
+	command, err := roundTrip(t, idle, wire.READ, "missing")
+	if err != nil || command != wire.NULL {
+		t.Fatalf("Expected the other connections to keep working but got %s: %q", command, err)
+	}
+
+	close(releaseSlow)
+	if command := <-slowResponse; command != wire.ACK {
+		t.Fatalf("Expected the slow PING to finish once released but got %s", command)
+	}
+
+	// the killed connection is unregistered once its handler notices the connection closed
+	for attempt := 0; attempt < 100; attempt++ {
+		clients, err = admin.Clients()
+		if _, found = findClient(clients, victim); !found {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil || len(clients) != 3 || found {
+		t.Fatalf("Expected the killed connection to be gone but found %v: %q", clients, err)
+	}
+
+	killed, err = admin.KillClient(victimInfo.ID)
+	if err != nil || killed {
+		t.Fatalf("Expected no connection left to kill with ID %d but got %t: %q", victimInfo.ID, killed, err)
+	}
+}
+
+func TestClientsNeedsAnAdminSession(t *testing.T) {
+	server := New("localhost", 0, WithAdminToken("secret"))
+
+	responseCommand, response := send(t, &server, &session{}, wire.CLIENTS)
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	responseCommand, response = send(t, &server, &session{}, wire.CLIENTKILL, "1")
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	responseCommand, _ = send(t, &server, &session{admin: true}, wire.CLIENTKILL, "1")
+	if responseCommand != wire.NULL {
+		t.Fatalf("Expected killing a connection that does not exist to be NULL but got %s", responseCommand)
+	}
+}
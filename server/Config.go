@@ -0,0 +1,192 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// protectedPrefixesSetting is the CONFIG name for the comma separated list of protected prefixes
+	protectedPrefixesSetting = "protected-prefixes"
+	// ttlPolicySetting is the CONFIG name for the comma separated list of TTL rules, see formatTTLRules
+	ttlPolicySetting = "ttl-policy"
+	// defaultTTLSetting is the CONFIG name for the TTL given to keys created without an expiration, "0s" disables it
+	defaultTTLSetting = "default-ttl"
+	// maxKeySegmentsSetting, maxSegmentLengthSetting, and maxKeyLengthSetting are the CONFIG names for the key limits,
+	// see engine.KeyLimits. "0" restores the default
+	maxKeySegmentsSetting   = "max-key-segments"
+	maxSegmentLengthSetting = "max-segment-length"
+	maxKeyLengthSetting     = "max-key-length"
+	// maxValueLengthSetting is the CONFIG name for the longest value writes may carry, "0" lifts the limit
+	maxValueLengthSetting = "max-value-length"
+	// highWaterBytesSetting, lowWaterBytesSetting, highWaterKeysSetting, and lowWaterKeysSetting are the CONFIG names
+	// for the water marks, see engine.WaterMarks. "0" clears a mark
+	highWaterBytesSetting = "high-water-bytes"
+	lowWaterBytesSetting  = "low-water-bytes"
+	highWaterKeysSetting  = "high-water-keys"
+	lowWaterKeysSetting   = "low-water-keys"
+)
+
+func (s *Server) setConfig(session *session, name string, value string) error {
+	if !session.admin {
+		return wire.NewError(wire.UNAUTHORIZED, "CONFIG requires an admin session")
+	}
+
+	switch name {
+	case protectedPrefixesSetting:
+		s.SetProtectedPrefixes(splitList(value)...)
+		return nil
+	case ttlPolicySetting:
+		rules, err := parseTTLRules(value)
+		if err != nil {
+			return err
+		}
+		s.forEachDatabase(func(store *engine.DataStore) { store.SetTTLPolicy(rules...) })
+		return nil
+	case defaultTTLSetting:
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return wire.NewError(wire.INVALIDSETTING, "default TTL %q needs a duration of zero or more", value)
+		}
+		s.forEachDatabase(func(store *engine.DataStore) { store.SetDefaultTTL(ttl) })
+		return nil
+	case maxKeySegmentsSetting, maxSegmentLengthSetting, maxKeyLengthSetting:
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return wire.NewError(wire.INVALIDSETTING, "%s %q needs a whole number of zero or more", name, value)
+		}
+
+		limits := s.dataStore.KeyLimits()
+		switch name {
+		case maxKeySegmentsSetting:
+			limits.MaxKeySegments = limit
+		case maxSegmentLengthSetting:
+			limits.MaxSegmentLength = limit
+		default:
+			limits.MaxKeyLength = limit
+		}
+		s.forEachDatabase(func(store *engine.DataStore) { store.SetKeyLimits(limits) })
+		return nil
+	case maxValueLengthSetting:
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return wire.NewError(wire.INVALIDSETTING, "%s %q needs a whole number of zero or more", name, value)
+		}
+		s.forEachDatabase(func(store *engine.DataStore) { store.SetMaxValueLength(length) })
+		return nil
+	case highWaterBytesSetting, lowWaterBytesSetting, highWaterKeysSetting, lowWaterKeysSetting:
+		mark, err := strconv.Atoi(value)
+		if err != nil || mark < 0 {
+			return wire.NewError(wire.INVALIDSETTING, "%s %q needs a whole number of zero or more", name, value)
+		}
+
+		marks := s.dataStore.WaterMarks()
+		switch name {
+		case highWaterBytesSetting:
+			marks.HighBytes = mark
+		case lowWaterBytesSetting:
+			marks.LowBytes = mark
+		case highWaterKeysSetting:
+			marks.HighKeys = mark
+		default:
+			marks.LowKeys = mark
+		}
+		s.forEachDatabase(func(store *engine.DataStore) { store.SetWaterMarks(marks) })
+		return nil
+	default:
+		return wire.NewError(wire.UNKNOWNSETTING, "unknown setting %q", name)
+	}
+}
+
+func (s *Server) getConfig(session *session, name string) (string, error) {
+	if !session.admin {
+		return "", wire.NewError(wire.UNAUTHORIZED, "CONFIG requires an admin session")
+	}
+
+	switch name {
+	case protectedPrefixesSetting:
+		return strings.Join(s.ProtectedPrefixes(), ","), nil
+	case ttlPolicySetting:
+		return formatTTLRules(s.dataStore.TTLPolicy()), nil
+	case defaultTTLSetting:
+		return s.dataStore.DefaultTTL().String(), nil
+	case maxKeySegmentsSetting:
+		return strconv.Itoa(s.dataStore.KeyLimits().MaxKeySegments), nil
+	case maxSegmentLengthSetting:
+		return strconv.Itoa(s.dataStore.KeyLimits().MaxSegmentLength), nil
+	case maxKeyLengthSetting:
+		return strconv.Itoa(s.dataStore.KeyLimits().MaxKeyLength), nil
+	case maxValueLengthSetting:
+		return strconv.Itoa(s.dataStore.MaxValueLength()), nil
+	case highWaterBytesSetting:
+		return strconv.Itoa(s.dataStore.WaterMarks().HighBytes), nil
+	case lowWaterBytesSetting:
+		return strconv.Itoa(s.dataStore.WaterMarks().LowBytes), nil
+	case highWaterKeysSetting:
+		return strconv.Itoa(s.dataStore.WaterMarks().HighKeys), nil
+	case lowWaterKeysSetting:
+		return strconv.Itoa(s.dataStore.WaterMarks().LowKeys), nil
+	default:
+		return "", wire.NewError(wire.UNKNOWNSETTING, "unknown setting %q", name)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// formatTTLRules
+/**
+* Render TTL rules as the ttl-policy setting: comma separated prefix=duration entries, with ":reject" after the
+* duration for rules that refuse longer expirations instead of shortening them, such as "pii=24h0m0s,secret=1h0m0s:reject"
+ */
+func formatTTLRules(rules []engine.TTLRule) string {
+	formatted := make([]string, len(rules))
+	for i, rule := range rules {
+		formatted[i] = rule.Prefix + "=" + rule.MaxTTL.String()
+		if rule.Reject {
+			formatted[i] += ":reject"
+		}
+	}
+	return strings.Join(formatted, ",")
+}
+
+// parseTTLRules reads the format written by formatTTLRules, accepting ":clamp" for rules that shorten expirations
+func parseTTLRules(value string) ([]engine.TTLRule, error) {
+	var rules []engine.TTLRule
+	for _, entry := range splitList(value) {
+		separator := strings.LastIndex(entry, "=")
+		if separator < 0 {
+			return nil, wire.NewError(wire.INVALIDSETTING, "TTL rule %q is not prefix=duration", entry)
+		}
+
+		rule := engine.TTLRule{Prefix: entry[:separator]}
+		limit, mode, _ := strings.Cut(entry[separator+1:], ":")
+		switch mode {
+		case "", "clamp":
+		case "reject":
+			rule.Reject = true
+		default:
+			return nil, wire.NewError(wire.INVALIDSETTING, "TTL rule %q has unknown mode %q", entry, mode)
+		}
+
+		maxTTL, err := time.ParseDuration(limit)
+		if err != nil || maxTTL <= 0 {
+			return nil, wire.NewError(wire.INVALIDSETTING, "TTL rule %q needs a positive duration", entry)
+		}
+		rule.MaxTTL = maxTTL
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTLPolicyCanBeChangedAtRuntime(t *testing.T) {
+	server := New("localhost", 0, WithAdminToken("secret"), WithTTLPolicy(engine.TTLRule{Prefix: "pii", MaxTTL: time.Hour * 24}))
+	protocol := wire.Protocol{}
+	admin := &session{admin: true}
+
+	_, response := send(t, &server, admin, wire.CONFIG, "GET", ttlPolicySetting)
+	policy, err := protocol.DecodeConfigResponse(response)
+	if err != nil || policy != "pii=24h0m0s" {
+		t.Fatalf("Expected CONFIG GET to return the configured policy but got %q: %q", policy, err)
+	}
+
+	responseCommand, _ := send(t, &server, admin, wire.CONFIG, "SET", ttlPolicySetting, "pii=24h,pii:ssn=1h:reject")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected CONFIG SET of the TTL policy to succeed but got %s", responseCommand)
+	}
+
+	send(t, &server, admin, wire.INSERT, "pii:email:1", "abc123")
+	send(t, &server, admin, wire.INSERT, "pii:ssn:1", "abc123")
+
+	_, response = send(t, &server, admin, wire.READEXPIRATION, "pii:email:1")
+	expiration, err := protocol.DecodeReadExpirationResponse(response)
+	if err != nil || expiration.After(time.Now().Add(time.Hour*24)) || expiration.Before(time.Now().Add(time.Hour*23)) {
+		t.Fatalf("Expected a bare insert under pii to expire in 24h but found %q: %q", expiration, err)
+	}
+
+	responseCommand, response = send(t, &server, admin, wire.EXPIRE, "pii:ssn:1", protocol.EncodeTime(time.Now().Add(time.Hour*2)))
+	assertError(t, wire.ErrTTLExceeded, responseCommand, response)
+
+	for _, invalid := range []string{"pii", "pii=forever", "pii=-1h", "pii=1h:sometimes"} {
+		responseCommand, response = send(t, &server, admin, wire.CONFIG, "SET", ttlPolicySetting, invalid)
+		assertError(t, wire.ErrInvalidSetting, responseCommand, response)
+	}
+
+	responseCommand, response = send(t, &server, &session{}, wire.CONFIG, "GET", ttlPolicySetting)
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	responseCommand, response = send(t, &server, admin, wire.CONFIG, "GET", "max-connections")
+	assertError(t, wire.ErrUnknownSetting, responseCommand, response)
+}
+
+func TestTTLRulesRoundTripThroughTheSetting(t *testing.T) {
+	rules := []engine.TTLRule{
+		{Prefix: "pii", MaxTTL: time.Hour * 24},
+		{Prefix: "pii:ssn", MaxTTL: time.Minute * 90, Reject: true},
+	}
+
+	parsed, err := parseTTLRules(formatTTLRules(rules))
+	if err != nil || !reflect.DeepEqual(parsed, rules) {
+		t.Fatalf("Expected to parse back %v but got %v: %q", rules, parsed, err)
+	}
+
+	parsed, err = parseTTLRules("")
+	if err != nil || len(parsed) != 0 {
+		t.Fatalf("Expected an empty setting to clear the rules but got %v: %q", parsed, err)
+	}
+}
+
+func TestDefaultTTLCanBeChangedAtRuntime(t *testing.T) {
+	server := New("localhost", 0, WithAdminToken("secret"), WithDefaultTTL(time.Hour))
+	protocol := wire.Protocol{}
+	admin := &session{admin: true}
+
+	_, response := send(t, &server, admin, wire.CONFIG, "GET", defaultTTLSetting)
+	ttl, err := protocol.DecodeConfigResponse(response)
+	if err != nil || ttl != "1h0m0s" {
+		t.Fatalf("Expected CONFIG GET to return the configured default TTL but got %q: %q", ttl, err)
+	}
+
+	send(t, &server, admin, wire.INSERT, "cached", "abc123")
+	_, response = send(t, &server, admin, wire.READEXPIRATION, "cached")
+	expiration, err := protocol.DecodeReadExpirationResponse(response)
+	if err != nil || expiration.After(time.Now().Add(time.Hour)) || expiration.Before(time.Now().Add(time.Minute*59)) {
+		t.Fatalf("Expected a bare insert to expire in 1h but found %q: %q", expiration, err)
+	}
+
+	responseCommand, _ := send(t, &server, admin, wire.CONFIG, "SET", defaultTTLSetting, "0s")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected CONFIG SET of the default TTL to succeed but got %s", responseCommand)
+	}
+
+	send(t, &server, admin, wire.INSERT, "immortal", "abc123")
+	responseCommand, _ = send(t, &server, admin, wire.READEXPIRATION, "immortal")
+	if responseCommand != wire.NULL {
+		t.Fatalf("Expected no expiration once the default TTL is disabled but got %s", responseCommand)
+	}
+
+	for _, invalid := range []string{"forever", "-1h"} {
+		responseCommand, response = send(t, &server, admin, wire.CONFIG, "SET", defaultTTLSetting, invalid)
+		assertError(t, wire.ErrInvalidSetting, responseCommand, response)
+	}
+
+	_, response = send(t, &server, &session{}, wire.STATS)
+	stats, err := protocol.DecodeStatsResponse(response)
+	if err != nil || stats["keys"] != 2 || stats["default-ttl-applied"] != 1 {
+		t.Fatalf("Expected STATS to count 2 keys and 1 default TTL but got %v: %q", stats, err)
+	}
+}
+
+func TestKeyLimitsCanBeChangedAtRuntime(t *testing.T) {
+	server := New("localhost", 0, WithAdminToken("secret"), WithKeyLimits(engine.KeyLimits{MaxKeySegments: 3}))
+	protocol := wire.Protocol{}
+	admin := &session{admin: true}
+
+	_, response := send(t, &server, admin, wire.CONFIG, "GET", maxKeySegmentsSetting)
+	segments, err := protocol.DecodeConfigResponse(response)
+	if err != nil || segments != "3" {
+		t.Fatalf("Expected CONFIG GET to return the configured segment limit but got %q: %q", segments, err)
+	}
+	_, response = send(t, &server, admin, wire.CONFIG, "GET", maxKeyLengthSetting)
+	length, err := protocol.DecodeConfigResponse(response)
+	if err != nil || length != strconv.Itoa(engine.DefaultMaxKeyLength) {
+		t.Fatalf("Expected CONFIG GET to return the default key length but got %q: %q", length, err)
+	}
+
+	responseCommand, response := send(t, &server, admin, wire.INSERT, "a:b:c:d", "1")
+	assertError(t, wire.ErrKeyTooComplex, responseCommand, response)
+	if message := protocol.DecodeError(response).Error(); !strings.Contains(message, "segments of 4 exceeds the limit of 3") {
+		t.Fatalf("Expected the error to say which limit the key broke but got %q", message)
+	}
+
+	send(t, &server, admin, wire.CONFIG, "SET", maxKeySegmentsSetting, "4")
+	send(t, &server, admin, wire.CONFIG, "SET", maxSegmentLengthSetting, "1")
+	responseCommand, _ = send(t, &server, admin, wire.INSERT, "a:b:c:d", "1")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected the insert to succeed once the segment limit was raised but got %s", responseCommand)
+	}
+	responseCommand, response = send(t, &server, admin, wire.INSERT, "a:bc", "1")
+	assertError(t, wire.ErrKeyTooComplex, responseCommand, response)
+
+	for _, invalid := range []string{"many", "-1", "1.5"} {
+		responseCommand, response = send(t, &server, admin, wire.CONFIG, "SET", maxSegmentLengthSetting, invalid)
+		assertError(t, wire.ErrInvalidSetting, responseCommand, response)
+	}
+}
+
+func TestMaxValueLengthCanBeChangedAtRuntime(t *testing.T) {
+	server := New("localhost", 0, WithMaxValueLength(4))
+	protocol := wire.Protocol{}
+	admin := &session{admin: true}
+
+	if responseCommand, _ := send(t, &server, admin, wire.INSERT, "at", "1234"); responseCommand != wire.ACK {
+		t.Fatalf("Expected a value exactly at the limit to be inserted but got %s", responseCommand)
+	}
+	responseCommand, response := send(t, &server, admin, wire.INSERT, "over", "12345")
+	assertError(t, wire.ErrValueTooLarge, responseCommand, response)
+	if message := protocol.DecodeError(response).Error(); !strings.Contains(message, "max value length of 4") {
+		t.Fatalf("Expected the error to say which limit the value broke but got %q", message)
+	}
+	responseCommand, response = send(t, &server, admin, wire.HSET, "hash", "field", "12345")
+	assertError(t, wire.ErrValueTooLarge, responseCommand, response)
+
+	send(t, &server, admin, wire.CONFIG, "SET", maxValueLengthSetting, "0")
+	_, response = send(t, &server, admin, wire.CONFIG, "GET", maxValueLengthSetting)
+	if length, err := protocol.DecodeConfigResponse(response); err != nil || length != "0" {
+		t.Fatalf("Expected CONFIG GET to return the lifted limit but got %q: %q", length, err)
+	}
+	if responseCommand, _ = send(t, &server, admin, wire.INSERT, "over", "12345"); responseCommand != wire.ACK {
+		t.Fatalf("Expected a limit of zero to accept the value but got %s", responseCommand)
+	}
+
+	for _, invalid := range []string{"large", "-1"} {
+		responseCommand, response = send(t, &server, admin, wire.CONFIG, "SET", maxValueLengthSetting, invalid)
+		assertError(t, wire.ErrInvalidSetting, responseCommand, response)
+	}
+
+	// servers refuse values over the default limit unless told otherwise
+	defaults := New("localhost", 0)
+	_, response = send(t, &defaults, admin, wire.CONFIG, "GET", maxValueLengthSetting)
+	if length, _ := protocol.DecodeConfigResponse(response); length != strconv.Itoa(engine.DefaultMaxValueLength) {
+		t.Fatalf("Expected the default max value length but got %q", length)
+	}
+}
+
+func TestValuesOverTheDefaultLimitAreRefusedOnAConnectionThatStaysUsable(t *testing.T) {
+	server := New("localhost", 0, WithLogger(nil))
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer server.Stop()
+
+	protocol := wire.Protocol{}
+	connection := dial(t, net.JoinHostPort("localhost", strconv.Itoa(server.Port())))
+	frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+	exchange := func(command wire.Command, arguments ...string) (wire.Command, []byte) {
+		t.Helper()
+		request, _ := protocol.EncodeMessage(command, arguments...)
+		if _, err := connection.Write(request); err != nil {
+			t.Fatalf("Error writing %s %q", command, err)
+		}
+		response, err := frames.ReadFrame()
+		if err != nil {
+			t.Fatalf("Expected %s to be answered but got %q", command, err)
+		}
+		responseCommand, _ := protocol.DecipherCommand(response)
+		return responseCommand, response
+	}
+
+	// the default message size lets the value through to the store, which refuses it
+	responseCommand, response := exchange(wire.INSERT, "huge", strings.Repeat("v", engine.DefaultMaxValueLength+1))
+	assertError(t, wire.ErrValueTooLarge, responseCommand, response)
+	if responseCommand, _ = exchange(wire.INSERT, "small", "1"); responseCommand != wire.ACK {
+		t.Fatalf("Expected the connection to stay usable but got %s", responseCommand)
+	}
+}
+
+func TestWaterMarksCanBeChangedAtRuntime(t *testing.T) {
+	server := New("localhost", 0, WithAdminToken("secret"), WithWaterMarks(engine.WaterMarks{HighKeys: 3}))
+	protocol := wire.Protocol{}
+	admin := &session{admin: true}
+
+	for _, key := range []string{"a", "b", "c"} {
+		send(t, &server, admin, wire.INSERT, key, "1")
+	}
+	responseCommand, response := send(t, &server, admin, wire.INSERT, "d", "1")
+	assertError(t, wire.ErrStoreFull, responseCommand, response)
+	responseCommand, response = send(t, &server, admin, wire.UPSERT, "d", "1")
+	assertError(t, wire.ErrStoreFull, responseCommand, response)
+	responseCommand, response = send(t, &server, admin, wire.GETORSET, "d", "1")
+	assertError(t, wire.ErrStoreFull, responseCommand, response)
+	responseCommand, response = send(t, &server, admin, wire.INSERT, "a", "1")
+	assertError(t, wire.ErrKeyExists, responseCommand, response)
+	if responseCommand, _ = send(t, &server, admin, wire.UPSERT, "a", "2"); responseCommand != wire.ACK {
+		t.Fatalf("Expected an upsert of a key that is present to succeed but got %s", responseCommand)
+	}
+
+	_, response = send(t, &server, admin, wire.STATS)
+	stats, err := protocol.DecodeStatsResponse(response)
+	if err != nil || stats["store-full-rejections"] != 3 || stats["size-bytes"] != 6 {
+		t.Fatalf("Expected STATS to count the refused writes and the size but got %v: %q", stats, err)
+	}
+
+	send(t, &server, admin, wire.CONFIG, "SET", highWaterKeysSetting, "10")
+	if responseCommand, _ = send(t, &server, admin, wire.INSERT, "d", "1"); responseCommand != wire.ACK {
+		t.Fatalf("Expected the insert to succeed once the mark was raised but got %s", responseCommand)
+	}
+	_, response = send(t, &server, admin, wire.CONFIG, "GET", highWaterKeysSetting)
+	if mark, err := protocol.DecodeConfigResponse(response); err != nil || mark != "10" {
+		t.Fatalf("Expected CONFIG GET to return the raised mark but got %q: %q", mark, err)
+	}
+
+	for _, invalid := range []string{"lots", "-1"} {
+		responseCommand, response = send(t, &server, admin, wire.CONFIG, "SET", lowWaterBytesSetting, invalid)
+		assertError(t, wire.ErrInvalidSetting, responseCommand, response)
+	}
+}
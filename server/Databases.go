@@ -0,0 +1,117 @@
+package server
+
+import (
+	"datastore/engine"
+	"encoding/hex"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// databases
+/**
+* The named databases connections select with SELECTDB, held by pointer so copies of the Server share them. Each is a
+* data store of its own, created the first time a connection uses it and removed by DROPDB. The default database,
+* selected by the empty name, is the Server's own data store and always exists.
+*
+* The mutex is held while a database is created or dropped and while CONFIG SET changes every database, so a database
+* created at the same time as a setting changes is never left with the old setting.
+ */
+type databases struct {
+	mutex  sync.Mutex
+	stores map[string]*engine.DataStore
+	// options are the ones the default database was created with, see newDatabase
+	options engine.Options
+}
+
+// databaseSpillDirectory holds the directories named databases spill their values to, inside the spill directory
+const databaseSpillDirectory = "databases"
+
+// database returns the data store of the named database, creating it when this is the first time it is used
+func (s *Server) database(name string) *engine.DataStore {
+	if name == "" {
+		return &s.dataStore
+	}
+
+	s.databases.mutex.Lock()
+	defer s.databases.mutex.Unlock()
+	store, exists := s.databases.stores[name]
+	if !exists {
+		store = s.newDatabase(name)
+		s.databases.stores[name] = store
+	}
+	return store
+}
+
+// newDatabase
+/**
+* Create the data store of a named database with the settings the default database has now, so CONFIG SET changes made
+* before it existed apply to it too. The caller must hold the mutex.
+*
+* Each database spills to a directory of its own, since a spill tier removes the files in its directory it does not
+* know about. Named databases share the default database's expiration archive but not its change feed, which is
+* replayed into a single data store and would mix the databases up.
+ */
+func (s *Server) newDatabase(name string) *engine.DataStore {
+	options := s.databases.options
+	options.TTLRules = s.dataStore.TTLPolicy()
+	options.DefaultTTL = s.dataStore.DefaultTTL()
+	options.KeyLimits = s.dataStore.KeyLimits()
+	options.MaxValueLength = s.dataStore.MaxValueLength()
+	options.WaterMarks = s.dataStore.WaterMarks()
+	options.ChangeFeed = nil
+	if options.SpillDirectory != "" {
+		options.SpillDirectory = filepath.Join(options.SpillDirectory, databaseSpillDirectory, hex.EncodeToString([]byte(name)))
+	}
+
+	store := engine.NewDataStoreWithOptions(options)
+	return &store
+}
+
+// dropDatabase removes a named database and everything in it, reporting whether it existed. The default database is
+// emptied instead.
+func (s *Server) dropDatabase(name string) bool {
+	if name == "" {
+		s.dataStore.Truncate()
+		return true
+	}
+
+	s.databases.mutex.Lock()
+	store, exists := s.databases.stores[name]
+	delete(s.databases.stores, name)
+	s.databases.mutex.Unlock()
+	if !exists {
+		return false
+	}
+
+	// connections that looked the store up before it was dropped may still be using it, emptying it releases the
+	// files its values spilled to
+	store.Truncate()
+	store.Close()
+	return true
+}
+
+// forEachDatabase calls change with the default database and then every named one, holding the mutex so no database
+// is created in between
+func (s *Server) forEachDatabase(change func(store *engine.DataStore)) {
+	s.databases.mutex.Lock()
+	defer s.databases.mutex.Unlock()
+
+	change(&s.dataStore)
+	for _, store := range s.databases.stores {
+		change(store)
+	}
+}
+
+// databaseNames returns the names of the named databases that exist, sorted
+func (s *Server) databaseNames() []string {
+	s.databases.mutex.Lock()
+	defer s.databases.mutex.Unlock()
+
+	names := make([]string, 0, len(s.databases.stores))
+	for name := range s.databases.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"datastore/wire"
+	"path/filepath"
+	"testing"
+)
+
+// runIn sends a request through runCommand on session, so writes are appended to the log in its database
+func runIn(t *testing.T, server *Server, session *session, command wire.Command, arguments ...string) wire.Command {
+	protocol := wire.Protocol{}
+	request, err := protocol.EncodeMessage(command, arguments...)
+	if err != nil {
+		t.Fatalf("Error encoding %s request %q", command, err)
+	}
+
+	response, err := server.runCommand(session, command, request)
+	if err != nil {
+		t.Fatalf("Expected the %s request to be handled but got %q", command, err)
+	}
+	responseCommand, _ := protocol.DecipherCommand(response[0])
+	return responseCommand
+}
+
+func TestDatabasesKeepTheirKeysApart(t *testing.T) {
+	server := New("localhost", 0)
+	protocol := wire.Protocol{}
+	billing := &session{}
+	search := &session{}
+	fallback := &session{}
+
+	send(t, &server, billing, wire.SELECTDB, "billing")
+	send(t, &server, search, wire.SELECTDB, "search")
+	send(t, &server, billing, wire.INSERT, "config", "billing")
+	send(t, &server, billing, wire.INSERT, "invoice:1", "42")
+	send(t, &server, search, wire.INSERT, "config", "search")
+	send(t, &server, fallback, wire.INSERT, "config", "default")
+
+	for connection, expected := range map[*session]string{billing: "billing", search: "search", fallback: "default"} {
+		_, response := send(t, &server, connection, wire.READ, "config")
+		if value, _ := protocol.DecodeReadResponse(response); value != expected {
+			t.Fatalf("Expected config to be %q in its database but got %q", expected, value)
+		}
+	}
+	if responseCommand, _ := send(t, &server, search, wire.PRESENT, "invoice:1"); responseCommand != wire.NULL {
+		t.Fatalf("Expected a key of one database to be missing from another but got %s", responseCommand)
+	}
+
+	_, response := send(t, &server, fallback, wire.STATS)
+	stats, _ := protocol.DecodeStatsResponse(response)
+	if stats["databases"] != 2 || stats["keys"] != 1 {
+		t.Fatalf("Expected 2 named databases and 1 key in the default one but found %v", stats)
+	}
+
+	// TRUNCATE empties the selected database alone
+	send(t, &server, billing, wire.TRUNCATE)
+	if billing := server.database("billing"); billing.Count() != 0 {
+		t.Fatalf("Expected TRUNCATE to empty the selected database but %d keys are left", billing.Count())
+	}
+	if server.database("search").Count() != 1 || server.dataStore.Count() != 1 {
+		t.Fatalf("Expected TRUNCATE to leave the other databases alone")
+	}
+
+	// selecting the empty name goes back to the default database
+	send(t, &server, search, wire.SELECTDB, "")
+	_, response = send(t, &server, search, wire.READ, "config")
+	if value, _ := protocol.DecodeReadResponse(response); value != "default" {
+		t.Fatalf("Expected selecting the empty name to select the default database but read %q", value)
+	}
+}
+
+func TestDropDBRemovesADatabase(t *testing.T) {
+	server := New("localhost", 0, WithProtectedPrefixes("system"), WithAdminToken("secret"))
+	connection := &session{}
+	send(t, &server, connection, wire.SELECTDB, "scratch")
+	send(t, &server, connection, wire.INSERT, "key", "1")
+	server.dataStore.Insert("key", "default")
+
+	responseCommand, response := send(t, &server, &session{}, wire.DROPDB, "scratch")
+	assertError(t, wire.ErrProtected, responseCommand, response)
+
+	admin := &session{}
+	send(t, &server, admin, wire.AUTH, "secret")
+	if responseCommand, _ = send(t, &server, admin, wire.DROPDB, "scratch"); responseCommand != wire.ACK {
+		t.Fatalf("Expected dropping a database to be acknowledged but got %s", responseCommand)
+	}
+	if names := server.databaseNames(); len(names) != 0 {
+		t.Fatalf("Expected the dropped database to be gone but found %v", names)
+	}
+	if responseCommand, _ = send(t, &server, admin, wire.DROPDB, "scratch"); responseCommand != wire.NULL {
+		t.Fatalf("Expected dropping a database that does not exist to answer NULL but got %s", responseCommand)
+	}
+	if value, _ := server.dataStore.Read("key"); value != "default" {
+		t.Fatalf("Expected dropping a database to leave the default one alone but read %q", value)
+	}
+
+	// a connection that still has the dropped database selected starts it again, empty
+	if responseCommand, _ = send(t, &server, connection, wire.PRESENT, "key"); responseCommand != wire.NULL {
+		t.Fatalf("Expected the dropped database to come back empty but got %s", responseCommand)
+	}
+}
+
+func TestConfigChangesEveryDatabase(t *testing.T) {
+	server := New("localhost", 0)
+	admin := &session{admin: true}
+	before := &session{}
+	after := &session{}
+
+	send(t, &server, before, wire.SELECTDB, "before")
+	send(t, &server, before, wire.PING)
+	send(t, &server, admin, wire.CONFIG, "SET", maxKeySegmentsSetting, "2")
+	send(t, &server, after, wire.SELECTDB, "after")
+
+	for _, connection := range []*session{before, after} {
+		responseCommand, response := send(t, &server, connection, wire.INSERT, "a:b:c", "1")
+		assertError(t, wire.ErrKeyTooComplex, responseCommand, response)
+	}
+}
+
+func TestTheAppendOnlyLogRebuildsEveryDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+
+	first := startWithLog(t, path)
+	billing := &session{admin: true, database: "billing"}
+	search := &session{admin: true, database: "search"}
+	runIn(t, first, billing, wire.INSERT, "config", "billing")
+	runIn(t, first, search, wire.INSERT, "config", "search")
+	runIn(t, first, &session{admin: true}, wire.INSERT, "config", "default")
+	runIn(t, first, search, wire.INSERT, "index", "1")
+	runIn(t, first, &session{admin: true, database: "scratch"}, wire.INSERT, "key", "1")
+	runIn(t, first, billing, wire.DROPDB, "scratch")
+	first.Stop()
+
+	assertDatabases := func(server *Server) {
+		t.Helper()
+		if names := server.databaseNames(); len(names) != 2 || names[0] != "billing" || names[1] != "search" {
+			t.Fatalf("Expected the billing and search databases but found %v", names)
+		}
+		for name, expected := range map[string]string{"billing": "billing", "search": "search", "": "default"} {
+			if value, _ := server.database(name).Read("config"); value != expected {
+				t.Fatalf("Expected config to be %q in database %q but read %q", expected, name, value)
+			}
+		}
+		if !server.database("search").Present("index") || server.database("").Present("index") {
+			t.Fatalf("Expected index to be in the search database alone")
+		}
+	}
+
+	second := startWithLog(t, path)
+	assertDatabases(second)
+
+	// the log remembers which database it left off in, so a write to the default database selects it again
+	runIn(t, second, &session{admin: true}, wire.INSERT, "later", "1")
+	err := second.RewriteAppendOnlyLog()
+	if err != nil {
+		t.Fatalf("Expected the log to be rewritten but got %q", err)
+	}
+	runIn(t, second, billing, wire.INSERT, "invoice:1", "42")
+	second.Stop()
+
+	third := startWithLog(t, path)
+	defer third.Stop()
+	assertDatabases(third)
+	if !third.dataStore.Present("later") || !third.database("billing").Present("invoice:1") {
+		t.Fatalf("Expected the writes around the rewrite to be replayed into their databases")
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+	"errors"
+)
+
+// engineErrors
+/**
+* How each error the engine can return is reported to clients: the wire error code and the message, which is formatted
+* with the key the command was operating on, followed by the engine's own message when detailed is set
+ */
+var engineErrors = []struct {
+	err      error
+	code     wire.ErrorCode
+	format   string
+	detailed bool
+}{
+	{err: engine.ErrKeyNotFound, code: wire.KEYNOTFOUND, format: "key %q not found"},
+	{err: engine.ErrKeyExists, code: wire.KEYEXISTS, format: "key %q already exists"},
+	{err: engine.ErrTTLExceeded, code: wire.TTLEXCEEDED, format: "expiration for key %q exceeds its maximum TTL"},
+	{err: engine.ErrKeyTooComplex, code: wire.KEYTOOCOMPLEX, format: "key %.64q is too complex", detailed: true},
+	{err: engine.ErrValueTooLarge, code: wire.VALUETOOLARGE, format: "value for %.64q is too large", detailed: true},
+	{err: engine.ErrStoreFull, code: wire.STOREFULL, format: "data store is full, key %q was not created"},
+	{err: engine.ErrWrongType, code: wire.WRONGTYPE, format: "key %q holds a value of the wrong type"},
+	{err: engine.ErrNotInteger, code: wire.NOTINTEGER, format: "key %q does not hold a 64-bit integer, or would not after the change"},
+}
+
+// keyError
+/**
+* Translate an error returned by the engine for an operation on key into the typed wire error sent to the client
+*
+* Returns nil for a nil error. Errors the engine does not define are passed through unchanged and reach the client as
+* an untyped ERR response.
+ */
+func keyError(err error, key string) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, engineError := range engineErrors {
+		if errors.Is(err, engineError.err) {
+			wireError := wire.NewError(engineError.code, engineError.format, key)
+			if engineError.detailed {
+				wireError.Message += ": " + err.Error()
+			}
+			return wireError
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// info
+/**
+* Collect the fields reported by INFO, describing what the server is rather than what it has done, keyed by the names
+* clients see:
+*
+* - version: the build of the server, see Version
+* - revision: the version control revision the server was built from, only when the build recorded one
+* - go-version: the Go release the server was built with
+* - platform: the operating system and architecture the server runs on, such as linux/amd64
+* - address and port: where the server listens for connections, the port being the one bound when it was set to 0
+* - uptime-ms: how long ago the server last started, in milliseconds, 0 before it has started
+* - keys: the number of keys stored in the default database, see engine.DataStore.Count
+* - connections: the number of open connections
+* - goroutines: the number of goroutines in the server's process
+* - heap-alloc-bytes: the bytes allocated on the heap and not yet freed, see runtime.MemStats.HeapAlloc
+ */
+func (s *Server) info() map[string]string {
+	s.listening.mutex.Lock()
+	started := s.listening.started
+	s.listening.mutex.Unlock()
+	uptime := time.Duration(0)
+	if !started.IsZero() {
+		uptime = time.Since(started)
+	}
+
+	s.connections.mutex.Lock()
+	connections := len(s.connections.open)
+	s.connections.mutex.Unlock()
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	info := map[string]string{
+		"version":          Version,
+		"go-version":       runtime.Version(),
+		"platform":         runtime.GOOS + "/" + runtime.GOARCH,
+		"address":          s.address,
+		"port":             strconv.Itoa(s.Port()),
+		"uptime-ms":        s.wire.EncodeDuration(uptime),
+		"keys":             strconv.Itoa(s.dataStore.Count()),
+		"connections":      strconv.Itoa(connections),
+		"goroutines":       strconv.Itoa(runtime.NumGoroutine()),
+		"heap-alloc-bytes": strconv.FormatUint(memory.HeapAlloc, 10),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info["revision"] = setting.Value
+			}
+		}
+	}
+	return info
+}
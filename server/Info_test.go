@@ -0,0 +1,78 @@
+package server
+
+import (
+	"datastore/wire"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// uptime sends INFO and returns the uptime it reports
+func uptime(t *testing.T, server *Server) time.Duration {
+	t.Helper()
+	responseCommand, response := send(t, server, &session{}, wire.INFO)
+	if responseCommand != wire.INFO {
+		t.Fatalf("Expected an INFO response but got %s", responseCommand)
+	}
+	info, err := server.wire.DecodeInfoResponse(response)
+	if err != nil {
+		t.Fatalf("Error decoding the INFO response %q", err)
+	}
+	uptime, err := server.wire.DecodeDuration(info["uptime-ms"])
+	if err != nil {
+		t.Fatalf("Error decoding the uptime %q", err)
+	}
+	return uptime
+}
+
+func TestInfoReportsWhatTheServerIs(t *testing.T) {
+	server := New("localhost", 0, WithLogger(nil))
+	if uptime(t, &server) != 0 {
+		t.Fatalf("Expected no uptime before the server started")
+	}
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer server.Stop()
+	server.dataStore.Insert("a", "1")
+	server.dataStore.Insert("b", "2")
+
+	info := server.info()
+	expected := map[string]string{
+		"version":     Version,
+		"go-version":  runtime.Version(),
+		"platform":    runtime.GOOS + "/" + runtime.GOARCH,
+		"address":     "localhost",
+		"port":        strconv.Itoa(server.Port()),
+		"keys":        "2",
+		"connections": "0",
+	}
+	for name, value := range expected {
+		if info[name] != value {
+			t.Fatalf("Expected %s to be %q but found %q", name, value, info[name])
+		}
+	}
+	for _, name := range []string{"goroutines", "heap-alloc-bytes"} {
+		if count, err := strconv.ParseUint(info[name], 10, 64); err != nil || count == 0 {
+			t.Fatalf("Expected %s to be a positive count but found %q", name, info[name])
+		}
+	}
+}
+
+func TestInfoUptimeIncreases(t *testing.T) {
+	server := New("localhost", 0, WithLogger(nil))
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer server.Stop()
+
+	first := uptime(t, &server)
+	time.Sleep(time.Millisecond * 20)
+	second := uptime(t, &server)
+	if second <= first {
+		t.Fatalf("Expected the uptime to increase from %s but it was %s", first, second)
+	}
+}
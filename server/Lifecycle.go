@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// Hooks
+/**
+* Functions run at points in the server's lifecycle, for processes that embed the server. Any of them can be nil.
+*
+* Each hook runs at most once per Start and Stop cycle, on the goroutine that reached that point, and a panic in a hook
+* is recovered and logged rather than taking the server down.
+ */
+type Hooks struct {
+	// OnListening runs during Start once the listener is bound, before any connection is accepted, with the address
+	// actually bound. Start does not return until it has finished.
+	OnListening func(address net.Addr)
+	// OnStartFailed runs instead of every other hook when Start cannot bind its listener
+	OnStartFailed func(err error)
+	// OnReady runs after the first command since Start was handled successfully
+	OnReady func()
+	// OnStopping runs at the start of Stop, before open connections are closed
+	OnStopping func()
+	// OnStopped runs at the end of Stop, after the listener and open connections have been closed
+	OnStopped func()
+}
+
+// lifecycle tracks which hooks have run in the current cycle, it is held by pointer so connections can share it
+type lifecycle struct {
+	mutex   sync.Mutex
+	running bool
+	ready   bool
+}
+
+func (s *Server) hookListening(address net.Addr) {
+	s.lifecycle.mutex.Lock()
+	s.lifecycle.running = true
+	s.lifecycle.ready = false
+	s.lifecycle.mutex.Unlock()
+
+	if s.hooks.OnListening != nil {
+		s.runHook("OnListening", func() { s.hooks.OnListening(address) })
+	}
+}
+
+func (s *Server) hookStartFailed(err error) {
+	if s.hooks.OnStartFailed != nil {
+		s.runHook("OnStartFailed", func() { s.hooks.OnStartFailed(err) })
+	}
+}
+
+// hookCommandSucceeded runs OnReady the first time it is called after Start
+func (s *Server) hookCommandSucceeded() {
+	s.lifecycle.mutex.Lock()
+	first := s.lifecycle.running && !s.lifecycle.ready
+	s.lifecycle.ready = true
+	s.lifecycle.mutex.Unlock()
+
+	if first && s.hooks.OnReady != nil {
+		s.runHook("OnReady", s.hooks.OnReady)
+	}
+}
+
+// hookStopping runs OnStopping and reports whether the server was running, so Stop only runs OnStopped for a real stop
+func (s *Server) hookStopping() bool {
+	s.lifecycle.mutex.Lock()
+	wasRunning := s.lifecycle.running
+	s.lifecycle.running = false
+	s.lifecycle.mutex.Unlock()
+
+	if wasRunning && s.hooks.OnStopping != nil {
+		s.runHook("OnStopping", s.hooks.OnStopping)
+	}
+
+	return wasRunning
+}
+
+func (s *Server) hookStopped() {
+	if s.hooks.OnStopped != nil {
+		s.runHook("OnStopped", s.hooks.OnStopped)
+	}
+}
+
+func (s *Server) runHook(name string, hook func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.logger.Errorf("Recovered from panic in %s hook: %v", name, recovered)
+		}
+	}()
+
+	hook()
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"datastore/client"
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hookRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *hookRecorder) record(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *hookRecorder) recorded() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.events...)
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnListening:   func(address net.Addr) { r.record(fmt.Sprintf("listening on %d", address.(*net.TCPAddr).Port)) },
+		OnStartFailed: func(err error) { r.record("start failed") },
+		OnReady:       func() { r.record("ready") },
+		OnStopping:    func() { r.record("stopping") },
+		OnStopped:     func() { r.record("stopped") },
+	}
+}
+
+func assertEvents(t *testing.T, recorder *hookRecorder, expected ...string) {
+	events := recorder.recorded()
+	if len(events) != len(expected) {
+		t.Fatalf("Expected hook events %q but found %q", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Expected hook events %q but found %q", expected, events)
+		}
+	}
+}
+
+func TestLifecycleHooksRunOnceInOrder(t *testing.T) {
+	recorder := &hookRecorder{}
+	runningServer := New("localhost", 8899, WithHooks(recorder.hooks()))
+	remote := client.New("localhost", 8899)
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	// OnListening has already run by the time Start returns
+	assertEvents(t, recorder, "listening on 8899")
+
+	for i := 0; i < 3; i++ {
+		_, err = remote.Upsert("key", "value")
+		if err != nil {
+			t.Fatalf("Error sending command %q", err)
+		}
+	}
+	assertEvents(t, recorder, "listening on 8899", "ready")
+
+	err = runningServer.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping server %q", err)
+	}
+	runningServer.Stop()
+	assertEvents(t, recorder, "listening on 8899", "ready", "stopping", "stopped")
+
+	// a restart is a new cycle
+	err = runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error restarting server %q", err)
+	}
+	_, err = remote.Upsert("key", "value2")
+	if err != nil {
+		t.Fatalf("Error sending command after restart %q", err)
+	}
+	runningServer.Stop()
+	assertEvents(t, recorder, "listening on 8899", "ready", "stopping", "stopped", "listening on 8899", "ready", "stopping", "stopped")
+}
+
+func TestOnlyStartFailedRunsWhenBindFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:8900")
+	if err != nil {
+		t.Fatalf("Error reserving port %q", err)
+	}
+	defer listener.Close()
+
+	recorder := &hookRecorder{}
+	failingServer := New("localhost", 8900, WithHooks(recorder.hooks()))
+
+	err = failingServer.Start()
+	if err == nil {
+		t.Fatalf("Expected start to fail on a port that is in use")
+	}
+	failingServer.Stop()
+
+	assertEvents(t, recorder, "start failed")
+}
+
+func TestPanickingHooksDoNotStopTheServer(t *testing.T) {
+	runningServer := New("localhost", 8901, WithHooks(Hooks{
+		OnListening: func(net.Addr) { panic("listening") },
+		OnReady:     func() { panic("ready") },
+		OnStopping:  func() { panic("stopping") },
+	}))
+	remote := client.New("localhost", 8901)
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = remote.Upsert("key", "value")
+		if err != nil {
+			t.Fatalf("Expected the server to keep serving after a hook panicked but got %q", err)
+		}
+	}
+
+	err = runningServer.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping server %q", err)
+	}
+}
+
+func TestStopDrainsCommandsInFlightAndReleasesThePort(t *testing.T) {
+	held := make(chan bool, 1)
+	release := make(chan bool)
+	runningServer := New("localhost", 8947)
+	runningServer.beforeCommand = func(command wire.Command) {
+		if command == wire.PING {
+			held <- true
+			<-release
+		}
+	}
+
+	// stopping a server that never started does nothing
+	if err := runningServer.Stop(); err != nil {
+		t.Fatalf("Expected stopping a server before Start to succeed but got %q", err)
+	}
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+
+	idle := dial(t, "localhost:8947")
+	roundTrip(t, idle, wire.READ, "missing")
+	busy := dial(t, "localhost:8947")
+	answered := make(chan wire.Command, 1)
+	go func() {
+		command, _ := roundTrip(t, busy, wire.PING)
+		answered <- command
+	}()
+	<-held
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- runningServer.Stop() }()
+	select {
+	case <-stopped:
+		t.Fatalf("Expected Stop to wait for the command in flight")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	if command := <-answered; command != wire.ACK {
+		t.Fatalf("Expected the command in flight to be answered but got %s", command)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Expected Stop to succeed once the command was answered but got %q", err)
+	}
+	if _, err := wire.NewFrameReader(idle, wire.MaxFrameSize).ReadFrame(); err == nil {
+		t.Fatalf("Expected the idle connection to be closed")
+	}
+
+	listener, err := net.Listen("tcp", "localhost:8947")
+	if err != nil {
+		t.Fatalf("Expected the port to be released once Stop returned but got %q", err)
+	}
+	listener.Close()
+
+	if err := runningServer.Stop(); err != nil {
+		t.Fatalf("Expected stopping again to succeed but got %q", err)
+	}
+}
+
+func TestStopClosesCommandsStillInFlightAfterTheTimeout(t *testing.T) {
+	held := make(chan bool, 1)
+	release := make(chan bool)
+	defer close(release)
+	runningServer := New("localhost", 8948)
+	runningServer.beforeCommand = func(command wire.Command) {
+		if command == wire.PING {
+			held <- true
+			<-release
+		}
+	}
+
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+
+	busy := dial(t, "localhost:8948")
+	go roundTrip(t, busy, wire.PING)
+	<-held
+
+	started := time.Now()
+	err = runningServer.StopWithTimeout(time.Millisecond * 50)
+	if !errors.Is(err, ErrStopTimeout) || time.Since(started) > time.Second {
+		t.Fatalf("Expected Stop to give up on the command after the timeout but got %q after %s", err, time.Since(started))
+	}
+	if _, err := wire.NewFrameReader(busy, wire.MaxFrameSize).ReadFrame(); err == nil {
+		t.Fatalf("Expected the connection still running a command to be closed")
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log"
+	"os"
+)
+
+// Logger
+/**
+* Receives what the server has to say, see WithLogger. Errorf is for failures the server carries on after, such as a
+* response that could not be written or an append only log that could not be synced. Infof is for starting, stopping,
+* and other events an operator expects to see once in a while, and Debugf for every connection, failed request, and
+* cleanup of expired keys.
+*
+* Methods are called from every connection's goroutine at once, and must be safe to call concurrently.
+ */
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// LogLevel is the least severe level a standard logger writes, see NewStandardLogger
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+// standardLogger writes the messages at level or above to a log.Logger, prefixed with their level
+type standardLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+// NewStandardLogger returns a Logger writing the messages at level or above to logger
+func NewStandardLogger(logger *log.Logger, level LogLevel) Logger {
+	return &standardLogger{logger: logger, level: level}
+}
+
+// defaultLogger is what servers log to without WithLogger, info and errors to stderr
+func defaultLogger() Logger {
+	return NewStandardLogger(log.New(os.Stderr, "", log.LstdFlags), LogInfo)
+}
+
+func (l *standardLogger) Debugf(format string, args ...any) {
+	l.logf(LogDebug, "DEBUG ", format, args)
+}
+
+func (l *standardLogger) Infof(format string, args ...any) {
+	l.logf(LogInfo, "INFO ", format, args)
+}
+
+func (l *standardLogger) Errorf(format string, args ...any) {
+	l.logf(LogError, "ERROR ", format, args)
+}
+
+func (l *standardLogger) logf(level LogLevel, prefix string, format string, args []any) {
+	if level < l.level {
+		return
+	}
+	l.logger.Printf(prefix+format, args...)
+}
+
+// discardLogger drops every message, for WithLogger(nil)
+type discardLogger struct{}
+
+func (discardLogger) Debugf(string, ...any) {}
+func (discardLogger) Infof(string, ...any)  {}
+func (discardLogger) Errorf(string, ...any) {}
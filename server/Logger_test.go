@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"datastore/wire"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps every message logged at each level
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (r *recordingLogger) record(level string, format string, args []any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages = append(r.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (r *recordingLogger) Debugf(format string, args ...any) { r.record("DEBUG", format, args) }
+func (r *recordingLogger) Infof(format string, args ...any)  { r.record("INFO", format, args) }
+func (r *recordingLogger) Errorf(format string, args ...any) { r.record("ERROR", format, args) }
+
+// logged reports whether a message starting with prefix was logged
+func (r *recordingLogger) logged(prefix string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, message := range r.messages {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// failingConnection reads from one end of a pipe and fails every write
+type failingConnection struct {
+	net.Conn
+}
+
+var errConnectionReset = errors.New("connection reset by peer")
+
+func (c failingConnection) Write([]byte) (int, error) {
+	return 0, errConnectionReset
+}
+
+// serveFailing serves a connection whose writes fail, sending request on it, and waits for the server to close it
+func serveFailing(t *testing.T, server *Server, request []byte) {
+	t.Helper()
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	served := make(chan bool)
+	go func() {
+		defer close(served)
+		server.ServeConn(failingConnection{serverEnd})
+	}()
+	// the server stops reading an oversized request part way, closing the pipe under the rest of it
+	go clientEnd.Write(request)
+
+	select {
+	case <-served:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Expected the server to close a connection it cannot write to")
+	}
+}
+
+func TestAConnectionThatCannotBeWrittenToIsLoggedWithoutPanicking(t *testing.T) {
+	logger := &recordingLogger{}
+	server := New("localhost", 0, WithLogger(logger), WithMaxMessageSize(64))
+	protocol := wire.Protocol{}
+
+	ping, _ := protocol.EncodeMessage(wire.PING)
+	serveFailing(t, &server, ping)
+	if !logger.logged("ERROR Error writing response") {
+		t.Fatalf("Expected the failed response to be logged as an error but found %v", logger.messages)
+	}
+
+	oversized, _ := protocol.EncodeMessage(wire.INSERT, "key", strings.Repeat("v", 1000))
+	serveFailing(t, &server, oversized)
+	if !logger.logged("ERROR Error writing error response: " + errConnectionReset.Error()) {
+		t.Fatalf("Expected the failed error response to be logged as an error but found %v", logger.messages)
+	}
+	if !logger.logged("DEBUG Closing connection") || !logger.logged("DEBUG Closed connection") {
+		t.Fatalf("Expected the connections closing to be logged at debug but found %v", logger.messages)
+	}
+}
+
+func TestStandardLoggerWritesTheLevelsAtOrAboveItsOwn(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewStandardLogger(log.New(&output, "", 0), LogInfo)
+	logger.Debugf("accepted %d", 1)
+	logger.Infof("listening on %s", "localhost")
+	logger.Errorf("failed %s", "badly")
+
+	if output.String() != "INFO listening on localhost\nERROR failed badly\n" {
+		t.Fatalf("Expected info and errors but not debug to be written but found %q", output.String())
+	}
+}
+
+func TestServerLogsStartingAndCleanups(t *testing.T) {
+	logger := &recordingLogger{}
+	server := New("localhost", 0, WithLogger(logger))
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer server.Stop()
+
+	if !logger.logged("INFO Server listening on localhost:") {
+		t.Fatalf("Expected the server to log where it listens but found %v", logger.messages)
+	}
+
+	server.dataStore.Insert("session", "1")
+	server.dataStore.Expire("session", time.Now().Add(-time.Second))
+	server.dataStore.CleanupNow()
+	if !logger.logged("DEBUG Cleanup removed 1 expired keys") {
+		t.Fatalf("Expected the cleanup to be logged at debug but found %v", logger.messages)
+	}
+}
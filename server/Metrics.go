@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"datastore/wire"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metrics
+/**
+* Counters of the commands the server has answered since it was created, shared by every connection and updated with
+* atomic operations, reported by STATS and the metrics endpoint, see WithMetricsEndpoint
+*
+* commands holds the counters of every command in wire.Commands, built by newMetrics and only read after, so counting a
+* command takes no lock. Commands missing from the table are only counted in writes and errors, like wire.IsWrite.
+ */
+type metrics struct {
+	commands     map[wire.Command]*commandMetrics
+	reads        atomic.Int64
+	writes       atomic.Int64
+	errors       atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+// commandMetrics counts how many times one command was answered and how many of those answers were errors
+type commandMetrics struct {
+	answered atomic.Int64
+	errors   atomic.Int64
+}
+
+func newMetrics() *metrics {
+	commands := map[wire.Command]*commandMetrics{}
+	for _, spec := range wire.Commands {
+		commands[spec.Command] = &commandMetrics{}
+	}
+	return &metrics{commands: commands}
+}
+
+// count records a command answered with an ERR response or not, requestSize and responseSize bytes long
+func (m *metrics) count(command wire.Command, requestSize int, responseSize int, failed bool) {
+	if wire.IsWrite(command) {
+		m.writes.Add(1)
+	} else {
+		m.reads.Add(1)
+	}
+	m.bytesRead.Add(int64(requestSize))
+	m.bytesWritten.Add(int64(responseSize))
+	if failed {
+		m.errors.Add(1)
+	}
+
+	counters, known := m.commands[command]
+	if !known {
+		return
+	}
+	counters.answered.Add(1)
+	if failed {
+		counters.errors.Add(1)
+	}
+}
+
+// commandStatPrefix starts the names of the statistics of single commands, see addTo
+const commandStatPrefix = "command-"
+
+// addTo adds the counters to the statistics reported by STATS, see Server.stats for what they count
+func (m *metrics) addTo(stats map[string]int64) {
+	stats["reads"] = m.reads.Load()
+	stats["writes"] = m.writes.Load()
+	stats["errors"] = m.errors.Load()
+	stats["bytes-read"] = m.bytesRead.Load()
+	stats["bytes-written"] = m.bytesWritten.Load()
+	for command, counters := range m.commands {
+		answered := counters.answered.Load()
+		if answered == 0 {
+			continue
+		}
+		name := commandStatPrefix + strings.ToLower(string(command))
+		stats[name] = answered
+		stats[name+"-errors"] = counters.errors.Load()
+	}
+}
+
+// gaugeStats are the statistics that can go down as well as up, every other statistic only ever grows
+var gaugeStats = map[string]bool{
+	"keys":                        true,
+	"databases":                   true,
+	"connections":                 true,
+	"parked-connections":          true,
+	"active-connections":          true,
+	"value-bytes":                 true,
+	"spilled-keys":                true,
+	"spilled-bytes":               true,
+	"size-bytes":                  true,
+	"largest-clock-regression-ms": true,
+	"longest-lock-hold-ms":        true,
+}
+
+// prometheusName turns the name STATS reports a statistic by into a metric name, counters end in _total
+func prometheusName(stat string) string {
+	name := "datastore_" + strings.ReplaceAll(stat, "-", "_")
+	if !gaugeStats[stat] {
+		name += "_total"
+	}
+	return name
+}
+
+// prometheusMetrics
+/**
+* Encode the statistics STATS reports in the Prometheus text format, each named after its STATS name with dashes
+* replaced by underscores and a datastore_ prefix, and counters ending in _total. The counts of single commands are
+* datastore_commands_total and datastore_command_errors_total, labelled with the command.
+ */
+func (s *Server) prometheusMetrics() []byte {
+	stats := s.stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		if !strings.HasPrefix(name, commandStatPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	for _, name := range names {
+		metricType := "counter"
+		if gaugeStats[name] {
+			metricType = "gauge"
+		}
+		fmt.Fprintf(&buffer, "# TYPE %s %s\n%s %d\n", prometheusName(name), metricType, prometheusName(name), stats[name])
+	}
+
+	commands := make([]string, 0, len(s.metrics.commands))
+	for command := range s.metrics.commands {
+		commands = append(commands, string(command))
+	}
+	sort.Strings(commands)
+	buffer.WriteString("# TYPE datastore_commands_total counter\n")
+	for _, command := range commands {
+		answered := s.metrics.commands[wire.Command(command)].answered.Load()
+		fmt.Fprintf(&buffer, "datastore_commands_total{command=%q} %d\n", command, answered)
+	}
+	buffer.WriteString("# TYPE datastore_command_errors_total counter\n")
+	for _, command := range commands {
+		errors := s.metrics.commands[wire.Command(command)].errors.Load()
+		fmt.Fprintf(&buffer, "datastore_command_errors_total{command=%q} %d\n", command, errors)
+	}
+
+	return buffer.Bytes()
+}
+
+// serveMetrics
+/**
+* Serve the Prometheus metrics at /metrics on address until the returned server is closed, see WithMetricsEndpoint.
+* Returns the address the endpoint is bound to, which differs from address when it asks for a free port.
+ */
+func (s *Server) serveMetrics(address string) (*http.Server, string, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			writer.Header().Set("Allow", "GET, HEAD")
+			http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writer.Write(s.prometheusMetrics())
+	})
+
+	endpoint := &http.Server{Handler: mux}
+	go func() {
+		err := endpoint.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("Error serving metrics: %s", err.Error())
+		}
+	}()
+	return endpoint, listener.Addr().String(), nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"datastore/wire"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStats sends STATS on a raw connection and decodes the statistics it answers with
+func readStats(t *testing.T, connection net.Conn) map[string]int64 {
+	t.Helper()
+	protocol := wire.Protocol{}
+	request, _ := protocol.EncodeMessage(wire.STATS)
+	_, err := connection.Write(request)
+	if err != nil {
+		t.Fatalf("Error sending STATS %q", err)
+	}
+
+	response, err := wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+	if err != nil {
+		t.Fatalf("Error reading the STATS response %q", err)
+	}
+	stats, err := protocol.DecodeStatsResponse(response)
+	if err != nil {
+		t.Fatalf("Error decoding the STATS response %q", err)
+	}
+	return stats
+}
+
+func TestMetricsCountCommandsAcrossConnections(t *testing.T) {
+	runningServer := New("localhost", 0, WithMetricsEndpoint("localhost:0"))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	protocol := wire.Protocol{}
+	address := net.JoinHostPort("localhost", strconv.Itoa(runningServer.Port()))
+
+	requests := []struct {
+		command   wire.Command
+		arguments []string
+		expected  wire.Command
+	}{
+		{wire.INSERT, []string{"a", "1"}, wire.ACK},
+		{wire.INSERT, []string{"a", "2"}, wire.ERR},
+		{wire.READ, []string{"a"}, wire.READ},
+		{wire.READ, []string{"missing"}, wire.NULL},
+		{wire.UPDATE, []string{"missing", "1"}, wire.ERR},
+	}
+	requestBytes := int64(0)
+	first := dial(t, address)
+	for _, request := range requests {
+		message, _ := protocol.EncodeMessage(request.command, request.arguments...)
+		requestBytes += int64(len(message))
+		if command, err := roundTrip(t, first, request.command, request.arguments...); err != nil || command != request.expected {
+			t.Fatalf("Expected %s to be answered with %s but got %s: %q", request.command, request.expected, command, err)
+		}
+	}
+	first.Close()
+
+	// the counters outlive the connection that moved them
+	second := dial(t, address)
+	for _, request := range requests[:3] {
+		message, _ := protocol.EncodeMessage(request.command, request.arguments...)
+		requestBytes += int64(len(message))
+		roundTrip(t, second, request.command, request.arguments...)
+	}
+
+	stats := readStats(t, second)
+	expected := map[string]int64{
+		"reads":                 3,
+		"writes":                5,
+		"errors":                4,
+		"bytes-read":            requestBytes,
+		"connections-accepted":  2,
+		"command-insert":        4,
+		"command-insert-errors": 3,
+		"command-read":          3,
+		"command-read-errors":   0,
+		"command-update":        1,
+		"command-update-errors": 1,
+	}
+	for name, count := range expected {
+		if stats[name] != count {
+			t.Fatalf("Expected STATS to report %s as %d but found %d in %v", name, count, stats[name], stats)
+		}
+	}
+	if stats["bytes-written"] == 0 {
+		t.Fatalf("Expected STATS to count the bytes of the responses")
+	}
+	if _, present := stats["command-delete"]; present {
+		t.Fatalf("Expected commands that were never answered to be left out but found %v", stats)
+	}
+
+	response, err := http.Get("http://" + runningServer.MetricsAddress() + "/metrics")
+	if err != nil {
+		t.Fatalf("Error fetching the metrics %q", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	for _, line := range []string{
+		"# TYPE datastore_keys gauge\ndatastore_keys 1\n",
+		"# TYPE datastore_reads_total counter\ndatastore_reads_total 4\n",
+		"datastore_writes_total 5\n",
+		"datastore_connections_accepted_total 2\n",
+		"datastore_commands_total{command=\"INSERT\"} 4\n",
+		"datastore_command_errors_total{command=\"INSERT\"} 3\n",
+		"datastore_commands_total{command=\"DELETE\"} 0\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("Expected the metrics to contain %q but found:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsCountExpiredKeysTheCleanupRemoves(t *testing.T) {
+	runningServer := New("localhost", 0)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	protocol := wire.Protocol{}
+	connection := dial(t, net.JoinHostPort("localhost", strconv.Itoa(runningServer.Port())))
+	roundTrip(t, connection, wire.INSERT, "session", "1")
+	if command, err := roundTrip(t, connection, wire.EXPIREIN, "session", protocol.EncodeDuration(time.Millisecond)); err != nil || command != wire.ACK {
+		t.Fatalf("Expected the key to be given an expiration but got %s: %q", command, err)
+	}
+
+	// every write schedules a cleanup, the key is removed by the first one after it expired
+	deadline := time.Now().Add(time.Second * 2)
+	for readStats(t, connection)["expired-removed"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected STATS to count the expired key once the cleanup removed it")
+		}
+		time.Sleep(time.Millisecond * 10)
+		roundTrip(t, connection, wire.UPSERT, "tick", "1")
+	}
+}
+
+func TestStartFailsWhenTheMetricsEndpointCannotBeBound(t *testing.T) {
+	taken, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening %q", err)
+	}
+	defer taken.Close()
+
+	runningServer := New("localhost", 0, WithMetricsEndpoint(taken.Addr().String()))
+	if err := runningServer.Start(); err == nil {
+		runningServer.Stop()
+		t.Fatalf("Expected Start to fail when the metrics address is taken")
+	}
+}
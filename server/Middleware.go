@@ -0,0 +1,227 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+	"errors"
+	"strings"
+)
+
+// ConnContext describes the connection a command arrived on, for Middleware
+type ConnContext struct {
+	RemoteAddress string
+	// Identity is who the session authenticated as, "admin" after AUTH with the admin token, "client" after AUTH with
+	// the token WithRequiredAuth asks for, and empty otherwise
+	Identity string
+	// Database is the name of the database the connection selected with SELECTDB, empty for the default database
+	Database string
+}
+
+// Middleware
+/**
+* Checks and rewrites the commands that operate on keys before they reach the data store, see WithMiddleware
+*
+* BeforeWrite sees INSERT, UPDATE, GETUPDATE, UPSERT, GETORSET, HSET, and each key of INSERTMANY with the value they
+* write, and DELETE, CDELETE, GETDEL, EXPIRE, EXPIREIN, HDEL, INCR, DECR, and both keys of RENAME with an empty
+* value. The commands a MULTI carries are seen one by one as themselves, and refusing any refuses the whole MULTI.
+* BeforeRead sees READ, READSTALE, READSTATUS, READEXPIRATION, PRESENT, HGET, HGETALL, HLEN, and each key of MEXISTS
+* and READMANY.
+* Returning a different key or value runs the command with it instead, the value is ignored for commands that do not
+* write one. Returning an error refuses the command: a *wire.Error reaches the client as it is, and any other error as
+* a REJECTED error carrying its message.
+*
+* Commands on every key under a prefix pass the prefix as the key: DELETEBY, EXPIREBY, UPDATEBY with its value, and
+* TRUNCATE with the empty prefix to BeforeWrite, and COUNTBY, KEYSBY, READBY, SCAN, and EXPORT to BeforeRead. They run
+* on the prefix returned, one ending in the key separator being taken as the segments before it, and answer with the
+* keys they found named under the prefix sent. UPDATEBY also passes each key it is about to update to BeforeWrite with
+* the value, and is refused when any is. KEYSMATCH, COMPLETE, NEWEST, and OLDEST find keys middleware cannot resolve
+* and are refused with a REJECTED error, while COUNT and EXPHIST only count keys and do not go through middleware.
+*
+* Writes are appended to the append only log and streamed to replicas with the keys and values middleware resolved them
+* to, and neither replaying the log nor a replica applying them runs them through middleware again. Hooks run on the
+* connection's goroutine without any data store lock held, and must be safe to call from several connections at once.
+ */
+type Middleware interface {
+	BeforeWrite(ctx ConnContext, op wire.Command, key string, value string) (string, string, error)
+	BeforeRead(ctx ConnContext, op wire.Command, key string) (string, error)
+}
+
+// MiddlewareFuncs is a Middleware built from functions, either of which can be nil to let every command through
+type MiddlewareFuncs struct {
+	Write func(ctx ConnContext, op wire.Command, key string, value string) (string, string, error)
+	Read  func(ctx ConnContext, op wire.Command, key string) (string, error)
+}
+
+func (m MiddlewareFuncs) BeforeWrite(ctx ConnContext, op wire.Command, key string, value string) (string, string, error) {
+	if m.Write == nil {
+		return key, value, nil
+	}
+	return m.Write(ctx, op, key, value)
+}
+
+func (m MiddlewareFuncs) BeforeRead(ctx ConnContext, op wire.Command, key string) (string, error) {
+	if m.Read == nil {
+		return key, nil
+	}
+	return m.Read(ctx, op, key)
+}
+
+func (s *session) connContext() ConnContext {
+	return ConnContext{RemoteAddress: s.remoteAddress, Identity: s.identity(), Database: s.database}
+}
+
+// beforeWrite runs each middleware in order on a write, returning the key and value to write or the error that refused
+// it, and notes them on the session, see resolvedFrame. A resolved session's writes are let through as they are.
+func (s *Server) beforeWrite(session *session, command wire.Command, key string, value string) (string, string, error) {
+	sent := key
+	hooks := s.middleware
+	if session.resolved {
+		hooks = nil
+	}
+	for _, middleware := range hooks {
+		var err error
+		key, value, err = middleware.BeforeWrite(session.connContext(), command, key, value)
+		if err != nil {
+			return "", "", rejected(err)
+		}
+	}
+
+	session.written = append(session.written, writtenKey{sent: sent, stored: key, value: value})
+	return key, value, nil
+}
+
+// beforeRead runs each middleware in order on a read, returning the key to read or the error that refused it. A
+// resolved session's reads are let through as they are.
+func (s *Server) beforeRead(session *session, command wire.Command, key string) (string, error) {
+	if session.resolved {
+		return key, nil
+	}
+	for _, middleware := range s.middleware {
+		var err error
+		key, err = middleware.BeforeRead(session.connContext(), command, key)
+		if err != nil {
+			return "", rejected(err)
+		}
+	}
+
+	return key, nil
+}
+
+// beforePrefixWrite
+/**
+* Run the prefix of a command writing every key under it through middleware like the key of a write, see
+* resolvedPrefix, returning the prefix and value to write or the error that refused it
+ */
+func (s *Server) beforePrefixWrite(session *session, command wire.Command, prefix string, value string) (string, string, error) {
+	stored, value, err := s.beforeWrite(session, command, prefix, value)
+	if err != nil {
+		return "", "", err
+	}
+
+	stored = s.resolvedPrefix(prefix, stored)
+	session.written[len(session.written)-1].stored = stored
+	return stored, value, nil
+}
+
+// beforePrefixRead runs the prefix of a command reading every key under it through middleware like the key of a read,
+// see resolvedPrefix, returning the prefix to read or the error that refused it
+func (s *Server) beforePrefixRead(session *session, command wire.Command, prefix string) (string, error) {
+	stored, err := s.beforeRead(session, command, prefix)
+	if err != nil {
+		return "", err
+	}
+	return s.resolvedPrefix(prefix, stored), nil
+}
+
+// resolvedPrefix
+/**
+* Return the prefix to run a command on for the one middleware resolved prefix to. One ending in the key separator is
+* taken as the segments before it, since no key is under a prefix ending in it, so middleware keeping keys under
+* "tenant:" runs a command on the empty prefix on every key under "tenant".
+ */
+func (s *Server) resolvedPrefix(prefix string, stored string) string {
+	if stored == prefix || s.protection.separator == "" {
+		return stored
+	}
+	return strings.TrimSuffix(stored, s.protection.separator)
+}
+
+// sentKey returns a key found under the prefix stored middleware resolved sent to as the client would name it, under
+// sent instead, the reverse of storedKey
+func (s *Server) sentKey(key string, sent string, stored string) string {
+	if stored == sent || stored == "" {
+		return key
+	}
+	rest := strings.TrimPrefix(key, stored)
+	if sent == "" {
+		return strings.TrimPrefix(rest, s.protection.separator)
+	}
+	return sent + rest
+}
+
+// storedKey returns a key under the prefix sent as the data store holds it, under the prefix stored middleware
+// resolved sent to instead, the reverse of sentKey
+func (s *Server) storedKey(key string, sent string, stored string) string {
+	if stored == sent || stored == "" {
+		return key
+	}
+	if sent == "" {
+		return stored + s.protection.separator + key
+	}
+	return stored + strings.TrimPrefix(key, sent)
+}
+
+// checkUpdateBy
+/**
+* Run every key UPDATEBY is about to set to value through middleware, named as the session would name it, refusing the
+* whole command when middleware refuses any. Only whether middleware refuses a key counts, the UPDATEBY writes the
+* prefix and value middleware resolved. Keys written under the prefix while the others are checked may be updated
+* without being checked.
+ */
+func (s *Server) checkUpdateBy(session *session, store *engine.DataStore, sent string, stored string, value string) error {
+	if session.resolved {
+		return nil
+	}
+
+	for _, key := range store.KeysBy(stored) {
+		if store.HoldsHash(key) {
+			continue
+		}
+		key, value := s.sentKey(key, sent, stored), value
+		for _, middleware := range s.middleware {
+			var err error
+			key, value, err = middleware.BeforeWrite(session.connContext(), wire.UPDATEBY, key, value)
+			if err != nil {
+				return rejected(err)
+			}
+		}
+	}
+	return nil
+}
+
+// unsupportedWithMiddleware are the commands on keys that middleware cannot resolve, found by a pattern, by a partial
+// segment, or across the whole data store, see checkMiddlewareSupports
+var unsupportedWithMiddleware = map[wire.Command]bool{
+	wire.KEYSMATCH: true,
+	wire.COMPLETE:  true,
+	wire.NEWEST:    true,
+	wire.OLDEST:    true,
+}
+
+// checkMiddlewareSupports refuses the commands middleware cannot resolve the keys of with a REJECTED error, while there
+// is middleware to resolve them through
+func (s *Server) checkMiddlewareSupports(session *session, command wire.Command) error {
+	if len(s.middleware) == 0 || session.resolved || !unsupportedWithMiddleware[command] {
+		return nil
+	}
+	return wire.NewError(wire.REJECTED, "%s is not supported by a server with middleware", command)
+}
+
+// rejected turns an error returned by middleware into the error sent to the client
+func rejected(err error) error {
+	var wireError *wire.Error
+	if errors.As(err, &wireError) {
+		return wireError
+	}
+	return wire.NewError(wire.REJECTED, "%s", err.Error())
+}
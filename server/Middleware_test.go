@@ -0,0 +1,220 @@
+package server
+
+import (
+	"datastore/client"
+	"datastore/wire"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// validJSONConfig refuses values under "config:" that are not valid JSON
+var validJSONConfig = MiddlewareFuncs{
+	Write: func(ctx ConnContext, op wire.Command, key string, value string) (string, string, error) {
+		if strings.HasPrefix(key, "config:") && (op == wire.INSERT || op == wire.UPDATE || op == wire.UPSERT || op == wire.UPDATEBY) && !json.Valid([]byte(value)) {
+			return "", "", errors.New(fmt.Sprintf("value of %q must be valid JSON", key))
+		}
+		return key, value, nil
+	},
+}
+
+// tenantKeys keeps every key under a prefix naming the identity of the session
+var tenantKeys = MiddlewareFuncs{
+	Write: func(ctx ConnContext, op wire.Command, key string, value string) (string, string, error) {
+		return tenantKey(ctx, key), value, nil
+	},
+	Read: func(ctx ConnContext, op wire.Command, key string) (string, error) {
+		return tenantKey(ctx, key), nil
+	},
+}
+
+func tenantKey(ctx ConnContext, key string) string {
+	tenant := ctx.Identity
+	if tenant == "" {
+		tenant = "anonymous"
+	}
+	return tenant + ":" + key
+}
+
+// middlewareRecorder remembers each command it sees, in the order middleware ran
+type middlewareRecorder struct {
+	mutex *sync.Mutex
+	seen  *[]string
+	name  string
+}
+
+func (r middlewareRecorder) BeforeWrite(ctx ConnContext, op wire.Command, key string, value string) (string, string, error) {
+	r.record(fmt.Sprintf("%s %s %s=%s", r.name, op, key, value))
+	return key, value, nil
+}
+
+func (r middlewareRecorder) BeforeRead(ctx ConnContext, op wire.Command, key string) (string, error) {
+	r.record(fmt.Sprintf("%s %s %s", r.name, op, key))
+	return key, nil
+}
+
+func (r middlewareRecorder) record(entry string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	*r.seen = append(*r.seen, entry)
+}
+
+func TestMiddlewareRejectsAndRewritesCommands(t *testing.T) {
+	runningServer := New("localhost", 8928, WithAdminToken("secret"), WithMiddleware(validJSONConfig, tenantKeys))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	anonymous := client.New("localhost", 8928)
+	_, err = anonymous.Upsert("config:limits", "{not json")
+	if !errors.Is(err, client.ErrRejected) || !strings.Contains(err.Error(), "must be valid JSON") {
+		t.Fatalf("Expected the invalid JSON to be rejected but got %q", err)
+	}
+
+	_, err = anonymous.Upsert("config:limits", `{"max":10}`)
+	if err != nil {
+		t.Fatalf("Expected the valid JSON to be written but got %q", err)
+	}
+	value, present, err := anonymous.Read("config:limits")
+	if err != nil || !present || value != `{"max":10}` {
+		t.Fatalf("Expected reads to be rewritten like writes but got %q: %q", value, err)
+	}
+	value, _ = runningServer.dataStore.Read("anonymous:config:limits")
+	if value != `{"max":10}` || runningServer.dataStore.Count() != 1 {
+		t.Fatalf("Expected the key to be stored under the tenant prefix but found %v", runningServer.dataStore.KeysBy(""))
+	}
+
+	// the identity middleware sees changes once the session authenticates
+	admin := client.New("localhost", 8928, client.WithAuthToken("secret"))
+	_, present, _ = admin.Read("config:limits")
+	if present {
+		t.Fatalf("Expected the admin to read its own tenant's keys")
+	}
+	admin.Upsert("config:limits", `{"max":20}`)
+	present = runningServer.dataStore.Present("admin:config:limits")
+	if !present {
+		t.Fatalf("Expected the admin's write under its own tenant prefix but found %v", runningServer.dataStore.KeysBy(""))
+	}
+}
+
+func TestMiddlewareRunsInOrderAndStopsAtTheFirstError(t *testing.T) {
+	var mutex sync.Mutex
+	var seen []string
+	first := middlewareRecorder{mutex: &mutex, seen: &seen, name: "first"}
+	last := middlewareRecorder{mutex: &mutex, seen: &seen, name: "last"}
+	server := New("localhost", 0, WithProtectedPrefixes("admin"), WithMiddleware(first, validJSONConfig, tenantKeys, last))
+	defer server.Stop()
+	connection := &session{}
+
+	responseCommand, _ := send(t, &server, connection, wire.INSERT, "config:a", "[1]")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected the insert to succeed but got %s", responseCommand)
+	}
+	send(t, &server, connection, wire.RENAME, "config:a", "config:b", "false")
+	send(t, &server, connection, wire.MEXISTS, "config:a", "config:b")
+
+	// an error stops the chain and the command, later middleware never sees it
+	responseCommand, response := send(t, &server, connection, wire.UPDATE, "config:b", "[")
+	assertError(t, wire.ErrRejected, responseCommand, response)
+
+	expected := []string{
+		"first INSERT config:a=[1]",
+		"last INSERT anonymous:config:a=[1]",
+		"first RENAME config:a=",
+		"last RENAME anonymous:config:a=",
+		"first RENAME config:b=",
+		"last RENAME anonymous:config:b=",
+		"first MEXISTS config:a",
+		"last MEXISTS anonymous:config:a",
+		"first MEXISTS config:b",
+		"last MEXISTS anonymous:config:b",
+		"first UPDATE config:b=[",
+	}
+	if strings.Join(seen, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected middleware to run in order %q but found %q", expected, seen)
+	}
+	value, _ := server.dataStore.Read("anonymous:config:b")
+	if value != "[1]" {
+		t.Fatalf("Expected the rejected update to leave the value alone but found %q", value)
+	}
+
+	// a wire error keeps its code, and protected prefixes are checked against the rewritten key
+	refuse := MiddlewareFuncs{Write: func(ctx ConnContext, op wire.Command, key string, value string) (string, string, error) {
+		if op == wire.DELETE {
+			return "", "", wire.NewError(wire.KEYNOTFOUND, "deletes are disabled")
+		}
+		return "admin:" + key, value, nil
+	}}
+	refusing := New("localhost", 0, WithProtectedPrefixes("admin"), WithMiddleware(refuse))
+	defer refusing.Stop()
+	responseCommand, response = send(t, &refusing, connection, wire.DELETE, "key")
+	assertError(t, wire.ErrKeyNotFound, responseCommand, response)
+	responseCommand, response = send(t, &refusing, connection, wire.UPSERT, "key", "value")
+	assertError(t, wire.ErrProtected, responseCommand, response)
+}
+
+func TestMiddlewareResolvesThePrefixesOfCommandsOnManyKeys(t *testing.T) {
+	protocol := wire.Protocol{}
+	path := filepath.Join(t.TempDir(), "datastore.aof")
+	first := startWithLog(t, path, WithMiddleware(validJSONConfig, tenantKeys))
+	anonymous := &session{}
+	admin := &session{admin: true}
+	runIn(t, first, anonymous, wire.INSERT, "config:a", "[1]")
+	runIn(t, first, anonymous, wire.INSERT, "config:b", "{}")
+	runIn(t, first, admin, wire.INSERT, "config:a", "[2]")
+
+	// reads find the session's own keys, named as it wrote them
+	_, response := send(t, first, anonymous, wire.KEYSBY, "config")
+	keys, _ := protocol.DecodeKeysByResponse(response)
+	if sort.Strings(keys); !reflect.DeepEqual(keys, []string{"config:a", "config:b"}) {
+		t.Fatalf("Expected KEYSBY to find the session's own keys but found %v", keys)
+	}
+	_, response = send(t, first, anonymous, wire.READBY, "")
+	if values, _ := protocol.DecodeReadByResponse(response); !reflect.DeepEqual(values, map[string]string{"config:a": "[1]", "config:b": "{}"}) {
+		t.Fatalf("Expected READBY to read the session's own keys but found %v", values)
+	}
+	_, response = send(t, first, anonymous, wire.SCAN, "config", "", "1")
+	keys, cursor, _ := protocol.DecodeScanResponse(response)
+	_, response = send(t, first, anonymous, wire.SCAN, "config", cursor, "1")
+	rest, _, _ := protocol.DecodeScanResponse(response)
+	if !reflect.DeepEqual(append(keys, rest...), []string{"config:a", "config:b"}) {
+		t.Fatalf("Expected SCAN to page through the session's own keys but found %v and %v", keys, rest)
+	}
+
+	// UPDATEBY is refused when middleware refuses any of the keys it would update
+	responseCommand, response := send(t, first, anonymous, wire.UPDATEBY, "config", "{not json")
+	assertError(t, wire.ErrRejected, responseCommand, response)
+	if value, _ := first.dataStore.Read("anonymous:config:a"); value != "[1]" {
+		t.Fatalf("Expected the refused UPDATEBY to leave the value alone but found %q", value)
+	}
+	runIn(t, first, anonymous, wire.UPDATEBY, "config", "[3]")
+	if value, _ := first.dataStore.Read("admin:config:a"); value != "[2]" {
+		t.Fatalf("Expected UPDATEBY to leave the keys of other sessions alone but found %q", value)
+	}
+
+	// TRUNCATE empties only the session's own keys, on the server and when the log is replayed
+	runIn(t, first, anonymous, wire.TRUNCATE)
+	if keys := first.dataStore.KeysBy(""); !reflect.DeepEqual(keys, []string{"admin:config:a"}) {
+		t.Fatalf("Expected TRUNCATE to leave the keys of other sessions but found %v", keys)
+	}
+	first.Stop()
+	second := startWithLog(t, path, WithMiddleware(validJSONConfig, tenantKeys))
+	defer second.Stop()
+	if keys := second.dataStore.KeysBy(""); !reflect.DeepEqual(keys, []string{"admin:config:a"}) {
+		t.Fatalf("Expected the replayed TRUNCATE to leave the keys of other sessions but found %v", keys)
+	}
+
+	// commands finding keys middleware cannot resolve are refused
+	for _, request := range [][]string{{string(wire.KEYSMATCH), "*"}, {string(wire.NEWEST), "1"}, {string(wire.COMPLETE), "con", "1"}} {
+		responseCommand, response = send(t, second, anonymous, wire.Command(request[0]), request[1:]...)
+		assertError(t, wire.ErrRejected, responseCommand, response)
+	}
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"datastore/engine"
+	"time"
+)
+
+// config holds the settings Options can change, it is embedded in Server
+type config struct {
+	idleTimeout              time.Duration
+	maxConnectionAge         time.Duration
+	maxRequestsPerConnection int
+	adminToken               string
+	requiredToken            string
+	protectedPrefixes        []string
+	ttlRules                 []engine.TTLRule
+	staleWindow              time.Duration
+	defaultTTL               time.Duration
+	clock                    func() time.Time
+	expirationArchive        engine.ArchiveSink
+	changeFeed               engine.ChangeFeed
+	keyLimits                engine.KeyLimits
+	maxValueLength           int
+	keySeparator             string
+	spillDirectory           string
+	spillThreshold           int
+	maxLockHold              time.Duration
+	waterMarks               engine.WaterMarks
+	maxKeys                  int
+	evictionPolicy           engine.EvictionPolicy
+	maxResponseFrame         int
+	maxMessageSize           int
+	appendLogPath            string
+	appendSync               AppendSync
+	metricsAddress           string
+	replicaOf                string
+	replicaToken             string
+	parking                  ConnectionParking
+	middleware               []Middleware
+	hooks                    Hooks
+	logger                   Logger
+}
+
+type Option func(*config)
+
+// WithIdleTimeout closes connections that have not sent a request for the provided duration, defaults to 10 seconds
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.idleTimeout = timeout
+	}
+}
+
+// WithMaxConnectionAge
+/**
+* Recycle connections once they have been open for the provided duration, zero leaves them open indefinitely
+*
+* The age is checked after each request, so the request in flight when the limit passes is always answered before
+* the connection is recycled.
+ */
+func WithMaxConnectionAge(age time.Duration) Option {
+	return func(c *config) {
+		c.maxConnectionAge = age
+	}
+}
+
+// WithMaxRequestsPerConnection recycles connections after they have served the provided number of requests, zero
+// allows unlimited requests
+func WithMaxRequestsPerConnection(requests int) Option {
+	return func(c *config) {
+		c.maxRequestsPerConnection = requests
+	}
+}
+
+// WithAdminToken enables the AUTH command, a connection that authenticates with this token becomes an admin session
+func WithAdminToken(token string) Option {
+	return func(c *config) {
+		c.adminToken = token
+	}
+}
+
+// WithRequiredAuth
+/**
+* Refuse every command except AUTH, HELLO, PING, and CAPABILITIES with an UNAUTHORIZED error until the connection has
+* sent AUTH with this token or the admin token, for servers reachable by more than trusted clients. Authenticating
+* with this token does not make the session an admin, see WithAdminToken.
+ */
+func WithRequiredAuth(token string) Option {
+	return func(c *config) {
+		c.requiredToken = token
+	}
+}
+
+// WithProtectedPrefixes
+/**
+* Only allow admin sessions to write keys under the provided prefixes, see Server.SetProtectedPrefixes to change the
+* list while the server is running
+ */
+func WithProtectedPrefixes(prefixes ...string) Option {
+	return func(c *config) {
+		c.protectedPrefixes = prefixes
+	}
+}
+
+// WithTTLPolicy
+/**
+* Limit how long keys under the rules' prefixes may live, see engine.TTLRule. The rules can be changed while the server
+* is running with CONFIG SET ttl-policy.
+ */
+func WithTTLPolicy(rules ...engine.TTLRule) Option {
+	return func(c *config) {
+		c.ttlRules = rules
+	}
+}
+
+// WithStaleWindow keeps expired keys for the provided duration before cleaning them up, so READSTALE can still serve
+// them, see engine.Options.StaleWindow
+func WithStaleWindow(window time.Duration) Option {
+	return func(c *config) {
+		c.staleWindow = window
+	}
+}
+
+// WithDefaultTTL
+/**
+* Give keys created without an expiration one this far in the future, see engine.DataStore.SetDefaultTTL. It can be
+* changed while the server is running with CONFIG SET default-ttl.
+ */
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.defaultTTL = ttl
+	}
+}
+
+// WithClock evaluates expirations by clock instead of time.Now, see engine.Options.Clock
+func WithClock(clock func() time.Time) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithExpirationArchive
+/**
+* Hand every key that expires to the target instead of letting it vanish, see engine.Options.ExpirationArchive. STATS
+* reports how many keys were archived and dropped.
+ */
+func WithExpirationArchive(target engine.ArchiveSink) Option {
+	return func(c *config) {
+		c.expirationArchive = target
+	}
+}
+
+// WithChangeFeed
+/**
+* Send every change to the data store to the feed as it is made, see engine.Options.ChangeFeed. A wal.Writer keeps them
+* in a log that other processes can follow with a wal.Reader.
+ */
+func WithChangeFeed(feed engine.ChangeFeed) Option {
+	return func(c *config) {
+		c.changeFeed = feed
+	}
+}
+
+// WithKeyLimits
+/**
+* Refuse writes that would create keys with more segments, longer segments, or more characters than the limits allow,
+* see engine.KeyLimits. The limits can be changed while the server is running with CONFIG SET max-key-segments,
+* max-segment-length, and max-key-length.
+ */
+func WithKeyLimits(limits engine.KeyLimits) Option {
+	return func(c *config) {
+		c.keyLimits = limits
+	}
+}
+
+// WithMaxValueLength
+/**
+* Refuse writes carrying values longer than length bytes with a VALUETOOLARGE error, see engine.Options.MaxValueLength.
+* Defaults to engine.DefaultMaxValueLength, and zero accepts values of any length the maximum message size lets through,
+* see WithMaxMessageSize. The limit can be changed while the server is running with CONFIG SET max-value-length.
+ */
+func WithMaxValueLength(length int) Option {
+	return func(c *config) {
+		c.maxValueLength = length
+	}
+}
+
+// WithKeySeparator
+/**
+* Split keys into segments on separator instead of ":", see engine.Options.KeySeparator. KEYSBY, DELETEBY, and the other
+* commands taking a prefix match whole segments split on it, as do protected prefixes and TTL rules.
+ */
+func WithKeySeparator(separator string) Option {
+	return func(c *config) {
+		c.keySeparator = separator
+	}
+}
+
+// WithSpillDirectory
+/**
+* Keep values longer than threshold bytes in files in dir instead of in memory, see engine.Options.SpillDirectory. Zero
+* uses engine.DefaultSpillThreshold. STATS reports how many bytes are held in memory and spilled.
+ */
+func WithSpillDirectory(dir string, threshold int) Option {
+	return func(c *config) {
+		c.spillDirectory = dir
+		c.spillThreshold = threshold
+	}
+}
+
+// WithMaxLockHold bounds how long DELETEBY, EXPIREBY, and the cleanup of expired keys hold up other commands, see
+// engine.Options.MaxLockHold. STATS reports the longest they have held them up
+func WithMaxLockHold(hold time.Duration) Option {
+	return func(c *config) {
+		c.maxLockHold = hold
+	}
+}
+
+// WithWaterMarks
+/**
+* Refuse writes that would create keys with a STOREFULL error once the data store holds too much, until enough is
+* deleted or expires, see engine.WaterMarks. STATS reports the size the marks are compared with and how many writes
+* were refused. The marks can be changed while the server is running with CONFIG SET high-water-bytes,
+* low-water-bytes, high-water-keys, and low-water-keys.
+ */
+func WithWaterMarks(marks engine.WaterMarks) Option {
+	return func(c *config) {
+		c.waterMarks = marks
+	}
+}
+
+// WithEviction
+/**
+* Run the server as a bounded cache, evicting a key chosen by policy whenever a write would create a key past maxKeys
+* in a database, see engine.Options.MaxKeys. Evicted keys are gone as if deleted, and STATS reports how many were
+* evicted. Zero never evicts.
+ */
+func WithEviction(maxKeys int, policy engine.EvictionPolicy) Option {
+	return func(c *config) {
+		c.maxKeys = maxKeys
+		c.evictionPolicy = policy
+	}
+}
+
+// WithMaxResponseFrame
+/**
+* Split KEYSBY responses longer than size bytes, length prefix included, into CONTINUED frames that the client joins
+* back together, see wire.EncodeSplitResponse. Defaults to the maximum message size, see WithMaxMessageSize, which
+* clients accept by default.
+ */
+func WithMaxResponseFrame(size int) Option {
+	return func(c *config) {
+		c.maxResponseFrame = size
+	}
+}
+
+// WithMaxMessageSize
+/**
+* Refuse requests longer than size bytes, length prefix included, with an ERR response before allocating anything for
+* them, and close the connection since the rest of the request cannot be told apart from the next one. Defaults to
+* wire.DefaultMaxMessageSize, as do sizes too small to hold a frame, and is capped at wire.MaxFrameSize. Values longer
+* than it cannot be written, so clients storing them need their bound raised as well, see client.WithMaxMessageSize.
+ */
+func WithMaxMessageSize(size int) Option {
+	return func(c *config) {
+		c.maxMessageSize = size
+	}
+}
+
+// WithAppendOnlyLog
+/**
+* Append every write that changes the store to the file at path, flushed to disk as sync says, and replay the file on
+* the first Start to rebuild the store from it. See Server.RewriteAppendOnlyLog to compact the file.
+*
+* A file whose last command was cut short by a crash is truncated to the commands before it with a warning. The
+* commands are written in the wire encoding the clients sent them in, with the keys and values middleware resolved them
+* to, see WithMiddleware.
+ */
+func WithAppendOnlyLog(path string, sync AppendSync) Option {
+	return func(c *config) {
+		c.appendLogPath = path
+		c.appendSync = sync
+	}
+}
+
+// WithMetricsEndpoint
+/**
+* Serve the statistics STATS reports over HTTP at /metrics on address in the Prometheus text format, see
+* Server.MetricsAddress. The endpoint starts and stops with the server, and Start fails when address cannot be bound.
+ */
+func WithMetricsEndpoint(address string) Option {
+	return func(c *config) {
+		c.metricsAddress = address
+	}
+}
+
+// WithReplicaOf
+/**
+* Make the server a read-only replica of the primary at address, given as host:port. Start connects to the primary with
+* REPLICATE, after AUTH with token when it is not empty, and the server applies the snapshot and then every write the
+* primary streams to it, connecting again whenever the connection is lost. Writes from clients are refused with a
+* READONLY error while reads are answered from what has been applied so far.
+*
+* Each time the replica connects it empties its databases before applying the snapshot, so reads may find keys missing
+* until it has caught up. Expirations are streamed as the times they fall at, those of TTLs given relative to now, such
+* as with EXPIREIN or the default TTL, in an EXPIRE following the write. Writes are streamed with the keys and values
+* the primary's middleware resolved them to, and the replica applies them without running its own, see WithMiddleware.
+ */
+func WithReplicaOf(address string, token string) Option {
+	return func(c *config) {
+		c.replicaOf = address
+		c.replicaToken = token
+	}
+}
+
+// WithConnectionParking
+/**
+* Park connections that have been idle for parking.After instead of keeping a goroutine blocked reading each of them,
+* see ConnectionParking. Parking is off by default, and on platforms other than unix connections are never parked.
+* STATS reports how many connections are parked and active.
+ */
+func WithConnectionParking(parking ConnectionParking) Option {
+	return func(c *config) {
+		c.parking = parking
+	}
+}
+
+// WithMiddleware
+/**
+* Check and rewrite commands on keys and prefixes before they reach the data store, see Middleware. Middleware runs in
+* the order it was added, each seeing the key and value the one before it returned, and the first error stops the
+* command. Protected prefixes are checked against the key the last middleware returned.
+ */
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, middleware...)
+	}
+}
+
+// WithLogger
+/**
+* Send what the server logs to logger instead of writing info and errors to stderr, see Logger and NewStandardLogger. A
+* nil logger discards everything.
+ */
+func WithLogger(logger Logger) Option {
+	return func(c *config) {
+		if logger == nil {
+			logger = discardLogger{}
+		}
+		c.logger = logger
+	}
+}
+
+// WithHooks registers functions to run at points in the server's lifecycle, see Hooks
+func WithHooks(hooks Hooks) Option {
+	return func(c *config) {
+		c.hooks = hooks
+	}
+}
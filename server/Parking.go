@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultParkingSweep = time.Millisecond * 10
+
+// ConnectionParking
+/**
+* Settings for parking idle connections, see WithConnectionParking
+*
+* A connection that has had no request in flight for After is parked: the goroutine serving it returns, along with its
+* read buffer, and the connection waits in a list that is swept every Sweep for connections with bytes to read. A
+* parked connection that sends a request is picked up by the next sweep and served by a new goroutine, so Sweep bounds
+* the extra latency of its first request. Sweep defaults to 10 milliseconds.
+ */
+type ConnectionParking struct {
+	After time.Duration
+	Sweep time.Duration
+}
+
+// servedConnection is everything about a connection that outlives the goroutine serving it, so it can be parked
+type servedConnection struct {
+	connection net.Conn
+	state      *connectionState
+	session    *session
+	requests   int
+	// idleSince is when the connection was accepted or last answered a request, the idle timeout counts from it
+	idleSince time.Time
+	// raw checks whether bytes are waiting while the connection is parked, nil when it cannot be parked
+	raw syscall.RawConn
+}
+
+// connectionPoller holds the parked connections, it is held by pointer so connections can share it
+type connectionPoller struct {
+	mutex    sync.Mutex
+	parked   map[*servedConnection]bool
+	sweeping bool
+}
+
+// parkable returns the raw connection used to check whether a parked connection is readable, or nil if it cannot be
+// parked because parking is off, the connection is not a socket, or the platform cannot check it
+func (s *Server) parkable(connection net.Conn) syscall.RawConn {
+	if s.parking.After <= 0 || !canPeek {
+		return nil
+	}
+
+	socket, isSocket := connection.(syscall.Conn)
+	if !isSocket {
+		return nil
+	}
+	raw, err := socket.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	return raw
+}
+
+// park adds a connection whose goroutine is returning to the parked connections, starting a sweep if none is running.
+// It reports false without parking the connection once Stop has started, since Stop closes only those parked before.
+func (s *Server) park(connection *servedConnection) bool {
+	s.poller.mutex.Lock()
+	if s.listening.draining.Load() {
+		s.poller.mutex.Unlock()
+		return false
+	}
+	s.poller.parked[connection] = true
+	start := !s.poller.sweeping
+	s.poller.sweeping = true
+	s.poller.mutex.Unlock()
+
+	if start {
+		go s.sweepParked()
+	}
+	return true
+}
+
+// sweepParked resumes each parked connection that has bytes to read or has been idle past the idle timeout, which then
+// closes it, until there are no parked connections left
+func (s *Server) sweepParked() {
+	interval := s.parking.Sweep
+	if interval <= 0 {
+		interval = defaultParkingSweep
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		s.poller.mutex.Lock()
+		for connection := range s.poller.parked {
+			if now.Before(connection.idleSince.Add(s.idleTimeout)) && !readable(connection.raw) {
+				continue
+			}
+			delete(s.poller.parked, connection)
+			go s.serve(connection)
+		}
+		if len(s.poller.parked) == 0 {
+			s.poller.sweeping = false
+			s.poller.mutex.Unlock()
+			return
+		}
+		s.poller.mutex.Unlock()
+	}
+}
+
+// unparkAll closes every parked connection, for Stop
+func (s *Server) unparkAll() {
+	s.poller.mutex.Lock()
+	defer s.poller.mutex.Unlock()
+
+	for connection := range s.poller.parked {
+		delete(s.poller.parked, connection)
+		s.connections.remove(connection.connection)
+		connection.connection.Close()
+	}
+}
+
+// parkedCount returns the number of parked connections
+func (p *connectionPoller) parkedCount() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.parked)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package server
+
+import "syscall"
+
+// canPeek is false where readable cannot check a socket without reading it, so connections are never parked
+const canPeek = false
+
+func readable(raw syscall.RawConn) bool {
+	return true
+}
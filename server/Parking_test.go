@@ -0,0 +1,166 @@
+package server
+
+import (
+	"datastore/wire"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func waitForParked(t *testing.T, server *Server, parked int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for server.stats()["parked-connections"] != parked {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d parked connections but found %v", parked, server.stats())
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestParkedConnectionsAnswerTheirNextRequest(t *testing.T) {
+	if !canPeek {
+		t.Skip("connections are never parked on this platform")
+	}
+
+	runningServer := New("localhost", 8926,
+		WithAdminToken("secret"),
+		WithProtectedPrefixes("system"),
+		WithConnectionParking(ConnectionParking{After: time.Millisecond * 20, Sweep: time.Millisecond * 5}),
+	)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	connection := dial(t, "localhost:8926")
+	command, err := roundTrip(t, connection, wire.AUTH, "secret")
+	if err != nil || command != wire.ACK {
+		t.Fatalf("Expected to authenticate but got %s: %q", command, err)
+	}
+
+	waitForParked(t, &runningServer, 1)
+	stats := runningServer.stats()
+	if stats["connections"] != 1 || stats["active-connections"] != 0 {
+		t.Fatalf("Expected the only connection to be parked but found %v", stats)
+	}
+
+	// the resumed connection keeps its session and answers promptly
+	started := time.Now()
+	command, err = roundTrip(t, connection, wire.UPSERT, "system:key", "value")
+	if err != nil || command != wire.ACK {
+		t.Fatalf("Expected the admin session to survive parking but got %s: %q", command, err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Millisecond*500 {
+		t.Fatalf("Expected a parked connection to be answered promptly but it took %s", elapsed)
+	}
+	value, _ := runningServer.dataStore.Read("system:key")
+	if value != "value" {
+		t.Fatalf("Expected the request to be applied but found %q", value)
+	}
+
+	// a request that starts arriving before the connection parks and finishes after is read whole
+	protocol := wire.Protocol{}
+	request, _ := protocol.EncodeMessage(wire.READ, "system:key")
+	waitForParked(t, &runningServer, 1)
+	connection.Write(request[:3])
+	time.Sleep(time.Millisecond * 50)
+	connection.Write(request[3:])
+	response, err := wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+	if err != nil {
+		t.Fatalf("Expected a response to the split request but got %q", err)
+	}
+	value, err = protocol.DecodeReadResponse(response)
+	if err != nil || value != "value" {
+		t.Fatalf("Expected to read the value back but got %q: %q", value, err)
+	}
+}
+
+func TestParkedConnectionsCloseAfterTheIdleTimeout(t *testing.T) {
+	if !canPeek {
+		t.Skip("connections are never parked on this platform")
+	}
+
+	runningServer := New("localhost", 8926,
+		WithIdleTimeout(time.Millisecond*100),
+		WithConnectionParking(ConnectionParking{After: time.Millisecond * 20, Sweep: time.Millisecond * 5}),
+	)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	connection := dial(t, "localhost:8926")
+	roundTrip(t, connection, wire.PING)
+	waitForParked(t, &runningServer, 1)
+
+	_, err = wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+	if err == nil {
+		t.Fatalf("Expected the server to close the idle connection")
+	}
+	waitForParked(t, &runningServer, 0)
+	if connections := runningServer.stats()["connections"]; connections != 0 {
+		t.Fatalf("Expected no open connections but found %d", connections)
+	}
+}
+
+// BenchmarkIdleConnections reports the memory the server uses for each of 10000 idle connections, with a goroutine
+// blocked reading each of them and with them parked
+func BenchmarkIdleConnections(b *testing.B) {
+	const idle = 10000
+
+	for _, mode := range []struct {
+		name    string
+		parking ConnectionParking
+	}{
+		{name: "goroutine"},
+		{name: "parked", parking: ConnectionParking{After: time.Millisecond * 10, Sweep: time.Millisecond * 50}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				runningServer := New("localhost", 8927, WithIdleTimeout(time.Minute), WithConnectionParking(mode.parking))
+				err := runningServer.Start()
+				if err != nil {
+					b.Fatalf("Error starting server %q", err)
+				}
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				connections := make([]net.Conn, 0, idle)
+				for len(connections) < idle {
+					connection, err := net.Dial("tcp", "localhost:8927")
+					if err != nil {
+						b.Skipf("Could not open %d connections: %s", idle, err)
+					}
+					connections = append(connections, connection)
+				}
+				expected := "connections"
+				if mode.parking.After > 0 {
+					expected = "parked-connections"
+				}
+				deadline := time.Now().Add(time.Second * 30)
+				for runningServer.stats()[expected] < idle {
+					if time.Now().After(deadline) {
+						b.Skipf("The server could not accept %d connections, it may need a higher file descriptor limit", idle)
+					}
+					time.Sleep(time.Millisecond * 10)
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				used := (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+				b.ReportMetric(float64(used)/idle, "bytes/conn")
+
+				for _, connection := range connections {
+					connection.Close()
+				}
+				runningServer.Stop()
+			}
+		})
+	}
+}
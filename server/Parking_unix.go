@@ -0,0 +1,23 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+// canPeek is whether readable works on this platform
+const canPeek = true
+
+// readable reports whether a parked connection has bytes to read, or has been closed or failed, without reading from it
+// or blocking. The runtime keeps sockets non-blocking, so peeking at an empty one returns EAGAIN straight away.
+func readable(raw syscall.RawConn) bool {
+	ready := true
+	err := raw.Read(func(fd uintptr) bool {
+		var peeked [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), peeked[:], syscall.MSG_PEEK)
+		ready = err != syscall.EAGAIN && err != syscall.EWOULDBLOCK
+		// returning true stops the runtime from waiting for the socket to become readable
+		return true
+	})
+
+	return ready || err != nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/subtle"
+	"datastore/wire"
+	"strings"
+	"sync"
+)
+
+// session is the state of a single client connection
+type session struct {
+	admin bool
+	// authenticated is set by AUTH with either token, see WithRequiredAuth
+	authenticated bool
+	// protocolVersion is the version negotiated with HELLO, connections that never send it speak version 1
+	protocolVersion int
+	// remoteAddress is the address of the client, reported to middleware
+	remoteAddress string
+	// database is the name of the database selected with SELECTDB, empty for the default database
+	database string
+	// watch is set by WATCH, and the connection streams the changes it subscribed to once WATCH is answered
+	watch *watch
+	// replica is set by REPLICATE, and the connection streams the snapshot and the writes once REPLICATE is answered
+	replica *replica
+	// replicating is set on the session a replica applies its primary's writes with, the only one that may write to it
+	replicating bool
+	// resolved is set on the sessions the append only log is replayed with and a replica applies its primary's writes
+	// with, whose commands carry the keys and values middleware resolved when they were first run and do not go through
+	// it again
+	resolved bool
+	// written holds the keys and values the write being run resolved through middleware, see resolvedFrame
+	written []writtenKey
+}
+
+// writtenKey is a key a write was sent with, and the key and value middleware resolved it to, the ones the data store
+// holds. The value is empty for commands that do not write one.
+type writtenKey struct {
+	sent   string
+	stored string
+	value  string
+}
+
+// identity is who the session authenticated as, reported by CLIENTS
+func (s *session) identity() string {
+	if s.admin {
+		return "admin"
+	}
+	if s.authenticated {
+		return "client"
+	}
+	return ""
+}
+
+// prefixProtection
+/**
+* The key prefixes only admin sessions may write under. Held by pointer so the list can be changed at runtime and
+* seen by every connection.
+ */
+type prefixProtection struct {
+	mutex    sync.RWMutex
+	prefixes []string
+	// separator is the one the data store splits keys on, protected prefixes are bounded by it
+	separator string
+}
+
+// SetProtectedPrefixes replaces the list of key prefixes that only admin sessions may write under
+func (s *Server) SetProtectedPrefixes(prefixes ...string) {
+	s.protection.mutex.Lock()
+	defer s.protection.mutex.Unlock()
+	s.protection.prefixes = append([]string{}, prefixes...)
+}
+
+// ProtectedPrefixes returns the current list of protected key prefixes
+func (s *Server) ProtectedPrefixes() []string {
+	s.protection.mutex.RLock()
+	defer s.protection.mutex.RUnlock()
+	return append([]string{}, s.protection.prefixes...)
+}
+
+// authenticate makes the session an admin when token is the admin token, and only authenticated when it is the token
+// WithRequiredAuth asks for
+func (s *Server) authenticate(session *session, token string) error {
+	if matchesToken(token, s.adminToken) {
+		session.admin = true
+		session.authenticated = true
+		return nil
+	}
+	if matchesToken(token, s.requiredToken) {
+		session.authenticated = true
+		return nil
+	}
+
+	return wire.NewError(wire.UNAUTHORIZED, "invalid token")
+}
+
+// matchesToken compares in constant time so how long a wrong guess takes says nothing about how close it was, an
+// empty expected token is not set and matches nothing
+func matchesToken(token string, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// answeredBeforeAuth are the commands a server with WithRequiredAuth answers on connections that have not sent AUTH
+var answeredBeforeAuth = map[wire.Command]bool{
+	wire.AUTH:         true,
+	wire.HELLO:        true,
+	wire.PING:         true,
+	wire.CAPABILITIES: true,
+}
+
+// checkAuthenticated returns an UNAUTHORIZED error for commands a server requiring AUTH does not answer yet
+func (s *Server) checkAuthenticated(session *session, command wire.Command) error {
+	if s.requiredToken == "" || session.authenticated || session.admin || answeredBeforeAuth[command] {
+		return nil
+	}
+	return wire.NewError(wire.UNAUTHORIZED, "authentication required")
+}
+
+// checkAdmin returns an UNAUTHORIZED error for commands only admin sessions may send
+func (s *Server) checkAdmin(session *session, command wire.Command) error {
+	if !session.admin {
+		return wire.NewError(wire.UNAUTHORIZED, "%s requires an admin session", command)
+	}
+	return nil
+}
+
+// checkKeyWrite returns a PROTECTED error when key falls under a protected prefix and the session is not an admin
+func (s *Server) checkKeyWrite(session *session, key string) error {
+	if session.admin {
+		return nil
+	}
+
+	s.protection.mutex.RLock()
+	defer s.protection.mutex.RUnlock()
+
+	for _, protected := range s.protection.prefixes {
+		if underPrefix(key, protected, s.protection.separator) {
+			return wire.NewError(wire.PROTECTED, "key %q is under protected prefix %q", key, protected)
+		}
+	}
+
+	return nil
+}
+
+// checkPrefixWrite
+/**
+* Returns a PROTECTED error when a write to every key under prefix would touch any protected key and the session is
+* not an admin, which is the case when the prefix is under a protected prefix or a protected prefix is under it
+*
+* Writes that span protected and unprotected keys are refused outright rather than applied to the unprotected part.
+ */
+func (s *Server) checkPrefixWrite(session *session, prefix string) error {
+	if session.admin {
+		return nil
+	}
+
+	s.protection.mutex.RLock()
+	defer s.protection.mutex.RUnlock()
+
+	for _, protected := range s.protection.prefixes {
+		if underPrefix(prefix, protected, s.protection.separator) || underPrefix(protected, prefix, s.protection.separator) {
+			return wire.NewError(wire.PROTECTED, "prefix %q overlaps protected prefix %q", prefix, protected)
+		}
+	}
+
+	return nil
+}
+
+// underPrefix
+/**
+* Whether key is prefix itself or sits below it, using the same separator bounded matching as the key index so "system"
+* covers "system:config" but not "systemic:foo". Everything is under the empty prefix.
+ */
+func underPrefix(key string, prefix string, separator string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+separator)
+}
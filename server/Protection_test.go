@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"datastore/wire"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func send(t *testing.T, server *Server, session *session, command wire.Command, arguments ...string) (wire.Command, []byte) {
+	protocol := wire.Protocol{}
+	request, err := protocol.EncodeMessage(command, arguments...)
+	if err != nil {
+		t.Fatalf("Error encoding %s request %q", command, err)
+	}
+
+	buffers, err := server.handleMessage(session, request)
+	if err != nil {
+		t.Fatalf("Expected the %s request to be handled but got %q", command, err)
+	}
+	response := bytes.Join(buffers, nil)
+
+	responseCommand, err := protocol.DecipherCommand(response)
+	if err != nil {
+		t.Fatalf("Error deciphering %s response %q", command, err)
+	}
+
+	return responseCommand, response
+}
+
+func assertError(t *testing.T, expected error, responseCommand wire.Command, response []byte) {
+	protocol := wire.Protocol{}
+	if responseCommand != wire.ERR || !errors.Is(protocol.DecodeError(response), expected) {
+		t.Fatalf("Expected %q but got a %s response", expected, responseCommand)
+	}
+}
+
+func TestProtectedPrefixesRejectWrites(t *testing.T) {
+	server := New("localhost", 0, WithProtectedPrefixes("system"))
+	protocol := wire.Protocol{}
+	anonymous := &session{}
+	future := protocol.EncodeTime(time.Now().Add(time.Hour))
+
+	server.dataStore.Insert("system:config", "abc123")
+	server.dataStore.Insert("region:1:store:1", "abc123")
+
+	writes := []struct {
+		command   wire.Command
+		arguments []string
+	}{
+		{wire.INSERT, []string{"system:new", "1"}},
+		{wire.INSERTMANY, []string{"region:1:new", "1", "system:new", "1"}},
+		{wire.UPDATE, []string{"system:config", "1"}},
+		{wire.UPSERT, []string{"system:config", "1"}},
+		{wire.UPSERT, []string{"system", "1"}},
+		{wire.DELETE, []string{"system:config"}},
+		{wire.EXPIRE, []string{"system:config", future}},
+		{wire.RENAME, []string{"system:config", "region:1:config", "false"}},
+		{wire.RENAME, []string{"region:1:store:1", "system:store", "false"}},
+		{wire.DELETEBY, []string{"system"}},
+		{wire.DELETEBY, []string{"system:config"}},
+		{wire.EXPIREBY, []string{"system", future}},
+		{wire.UPDATEBY, []string{"system", "1"}},
+		{wire.TRUNCATE, nil},
+	}
+	for _, write := range writes {
+		responseCommand, response := send(t, &server, anonymous, write.command, write.arguments...)
+		assertError(t, wire.ErrProtected, responseCommand, response)
+	}
+
+	value, present := server.dataStore.Read("system:config")
+	if !present || value != "abc123" {
+		t.Fatalf("Expected protected key to be untouched but found %q", value)
+	}
+	if server.dataStore.Present("region:1:new") {
+		t.Fatalf("Expected a batch with a protected key to insert none of its keys")
+	}
+
+	responseCommand, _ := send(t, &server, anonymous, wire.READ, "system:config")
+	if responseCommand != wire.READ {
+		t.Fatalf("Expected reads under a protected prefix to be allowed but got %s", responseCommand)
+	}
+	responseCommand, _ = send(t, &server, anonymous, wire.KEYSBY, "system")
+	if responseCommand != wire.KEYSBY {
+		t.Fatalf("Expected KEYSBY under a protected prefix to be allowed but got %s", responseCommand)
+	}
+}
+
+func TestProtectedPrefixesAreSeparatorBounded(t *testing.T) {
+	server := New("localhost", 0, WithProtectedPrefixes("system"))
+	anonymous := &session{}
+
+	responseCommand, _ := send(t, &server, anonymous, wire.INSERT, "systemic:foo", "1")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected systemic:foo to be writable but got %s", responseCommand)
+	}
+
+	responseCommand, _ = send(t, &server, anonymous, wire.DELETEBY, "systemic")
+	if responseCommand != wire.DELETEBY {
+		t.Fatalf("Expected DELETEBY systemic to be allowed but got %s", responseCommand)
+	}
+}
+
+func TestPrefixWritesSpanningProtectedKeysFailEntirely(t *testing.T) {
+	server := New("localhost", 0, WithProtectedPrefixes("region:1:system"))
+	anonymous := &session{}
+
+	server.dataStore.Insert("region:1:system:config", "abc123")
+	server.dataStore.Insert("region:1:store:1", "abc123")
+	server.dataStore.Insert("region:2:store:1", "abc123")
+
+	responseCommand, response := send(t, &server, anonymous, wire.DELETEBY, "region")
+	assertError(t, wire.ErrProtected, responseCommand, response)
+	if server.dataStore.Count() != 3 {
+		t.Fatalf("Expected a rejected DELETEBY to delete nothing but %d keys remain", server.dataStore.Count())
+	}
+
+	responseCommand, _ = send(t, &server, anonymous, wire.DELETEBY, "region:2")
+	if responseCommand != wire.DELETEBY || server.dataStore.Count() != 2 {
+		t.Fatalf("Expected DELETEBY of an unprotected subtree to succeed but got %s", responseCommand)
+	}
+}
+
+func TestAdminSessionsBypassProtection(t *testing.T) {
+	server := New("localhost", 0, WithProtectedPrefixes("system"), WithAdminToken("secret"))
+	admin := &session{}
+	anonymous := &session{}
+
+	responseCommand, response := send(t, &server, admin, wire.AUTH, "wrong")
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	responseCommand, response = send(t, &server, anonymous, wire.CONFIG, "SET", protectedPrefixesSetting, "")
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	responseCommand, _ = send(t, &server, admin, wire.AUTH, "secret")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected AUTH with the admin token to succeed but got %s", responseCommand)
+	}
+
+	responseCommand, _ = send(t, &server, admin, wire.INSERT, "system:config", "1")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected an admin write under a protected prefix to succeed but got %s", responseCommand)
+	}
+
+	responseCommand, response = send(t, &server, anonymous, wire.UPSERT, "system:config", "2")
+	assertError(t, wire.ErrProtected, responseCommand, response)
+
+	responseCommand, response = send(t, &server, admin, wire.CONFIG, "SET", "max-connections", "1")
+	assertError(t, wire.ErrUnknownSetting, responseCommand, response)
+
+	responseCommand, _ = send(t, &server, admin, wire.CONFIG, "SET", protectedPrefixesSetting, "internal,audit")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected CONFIG SET from an admin to succeed but got %s", responseCommand)
+	}
+
+	responseCommand, _ = send(t, &server, anonymous, wire.UPSERT, "system:config", "2")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected system to be writable once it was removed from the protected prefixes but got %s", responseCommand)
+	}
+	responseCommand, response = send(t, &server, anonymous, wire.INSERT, "audit:1", "1")
+	assertError(t, wire.ErrProtected, responseCommand, response)
+}
+
+func TestRequiredAuthRefusesCommandsUntilAuthSucceeds(t *testing.T) {
+	server := New("localhost", 0, WithRequiredAuth("shared"), WithAdminToken("secret"))
+	protocol := wire.Protocol{}
+	connection := &session{}
+
+	responseCommand, response := send(t, &server, connection, wire.TRUNCATE)
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+	if message := protocol.DecodeError(response).Error(); !strings.Contains(message, "authentication required") {
+		t.Fatalf("Expected the refusal to say authentication is required but got %q", message)
+	}
+	responseCommand, response = send(t, &server, connection, wire.READ, "key")
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	// clients find out whether to authenticate before they have
+	for _, command := range []wire.Command{wire.PING, wire.CAPABILITIES} {
+		if responseCommand, _ = send(t, &server, connection, command); responseCommand == wire.ERR {
+			t.Fatalf("Expected %s to be answered before AUTH", command)
+		}
+	}
+	_, response = send(t, &server, connection, wire.CAPABILITIES)
+	capabilities, _ := protocol.DecodeCapabilitiesResponse(response)
+	if !capabilities.Has(wire.CapabilityAuth) || !capabilities.Has(wire.CapabilityAuthRequired) {
+		t.Fatalf("Expected a server requiring AUTH to announce it but found %v", capabilities.Flags)
+	}
+
+	responseCommand, response = send(t, &server, connection, wire.AUTH, "wrong")
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+	responseCommand, response = send(t, &server, connection, wire.INSERT, "key", "1")
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	responseCommand, _ = send(t, &server, connection, wire.AUTH, "shared")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected AUTH with the required token to succeed but got %s", responseCommand)
+	}
+	responseCommand, _ = send(t, &server, connection, wire.INSERT, "key", "1")
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected an INSERT after AUTH to succeed but got %s", responseCommand)
+	}
+	if responseCommand, _ = send(t, &server, connection, wire.READ, "key"); responseCommand != wire.READ {
+		t.Fatalf("Expected a READ after AUTH to succeed but got %s", responseCommand)
+	}
+
+	// the required token does not make the session an admin, the admin token also lets a connection in
+	responseCommand, response = send(t, &server, connection, wire.CLIENTS)
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+	if connection.identity() != "client" {
+		t.Fatalf("Expected the session to be identified as a client but got %q", connection.identity())
+	}
+	admin := &session{}
+	send(t, &server, admin, wire.AUTH, "secret")
+	if responseCommand, _ = send(t, &server, admin, wire.CLIENTS); responseCommand != wire.CLIENTS {
+		t.Fatalf("Expected an admin session to be let in by a server requiring AUTH but got %s", responseCommand)
+	}
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bytes"
+	"datastore/wire"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaBuffer is how many writes a replica may fall behind by before its primary disconnects it
+const replicaBuffer = 4096
+
+// replicaRetryInterval is how long a replica waits to connect to its primary again after losing the connection
+const replicaRetryInterval = time.Second
+
+// snapshotChunk is how much of a snapshot a primary writes to a replica within each idle timeout
+const snapshotChunk = 64 << 10
+
+// replicas
+/**
+* The replicas a primary streams its writes to, held by pointer so copies of the Server share it
+*
+* Writes hold mutex for reading while no replica is attached and for writing while one is, so they are streamed in the
+* order they were applied. Attaching a replica holds it for writing while the snapshot is taken, so every write is
+* either in the snapshot or streamed after it.
+ */
+type replicas struct {
+	mutex    sync.RWMutex
+	attached map[*replica]bool
+	// count is the number of attached replicas, only changed while mutex is held for writing
+	count atomic.Int32
+}
+
+// replica is a connection that sent REPLICATE, which streams the snapshot and then the writes once REPLICATE is answered
+type replica struct {
+	snapshot []byte
+	// writes carries the frames of the writes to stream, and is closed once the replica is detached
+	writes chan []byte
+	// database is the one the last write queued for the replica ran in, see stream
+	database  string
+	heartbeat time.Duration
+}
+
+// changesStore reports whether command is a write that is logged and streamed to replicas when it changes something,
+// CONFIG changes settings rather than the store
+func changesStore(command wire.Command) bool {
+	return wire.IsWrite(command) && command != wire.CONFIG
+}
+
+// holdWrite takes the mutex for a write as replicas describes, returning the function releasing it
+func (r *replicas) holdWrite() func() {
+	if r.count.Load() == 0 {
+		r.mutex.RLock()
+		// replicas only attach while the mutex is held for writing, so none can while it is held for reading
+		if r.count.Load() == 0 {
+			return r.mutex.RUnlock
+		}
+		r.mutex.RUnlock()
+	}
+
+	r.mutex.Lock()
+	return r.mutex.Unlock
+}
+
+// stream
+/**
+* Queue a write that ran in database for every attached replica, after a SELECTDB for those whose last write ran in
+* another one. The caller must hold the mutex from holdWrite. A replica with no room left is detached rather than
+* holding up the primary's writes, and connects again for a new snapshot.
+ */
+func (r *replicas) stream(database string, message []byte) {
+	if len(r.attached) == 0 {
+		return
+	}
+
+	frame := append([]byte(nil), message...)
+	for attached := range r.attached {
+		queued := true
+		if attached.database != database {
+			selectDB, _ := (&wire.Protocol{}).EncodeMessage(wire.SELECTDB, database)
+			queued = attached.queue(selectDB)
+			attached.database = database
+		}
+		if !queued || !attached.queue(frame) {
+			r.remove(attached)
+		}
+	}
+}
+
+// queue adds a frame to the writes streamed to the replica without waiting, returning false when there is no room
+func (r *replica) queue(frame []byte) bool {
+	select {
+	case r.writes <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// remove detaches a replica and closes its writes, the caller must hold the mutex for writing
+func (r *replicas) remove(detached *replica) {
+	if !r.attached[detached] {
+		return
+	}
+	delete(r.attached, detached)
+	r.count.Add(-1)
+	close(detached.writes)
+}
+
+// detach removes the replica of a connection that closed, if it is still attached
+func (r *replicas) detach(detached *replica) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.remove(detached)
+}
+
+// attachReplica
+/**
+* Take a snapshot of every database for a session that sent REPLICATE and attach it as a replica, so the writes from now
+* on are queued for it. Writes wait while the snapshot is taken. A heartbeat of zero or less sends a PING frame every
+* half of the idle timeout.
+ */
+func (s *Server) attachReplica(session *session, heartbeat time.Duration) error {
+	if heartbeat <= 0 {
+		heartbeat = s.idleTimeout / 2
+	}
+
+	s.replicas.mutex.Lock()
+	defer s.replicas.mutex.Unlock()
+
+	var snapshot bytes.Buffer
+	database, err := s.writeSnapshot(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	attached := &replica{snapshot: snapshot.Bytes(), writes: make(chan []byte, replicaBuffer), database: database, heartbeat: heartbeat}
+	s.replicas.attached[attached] = true
+	s.replicas.count.Add(1)
+	session.replica = attached
+	return nil
+}
+
+// streamToReplica
+/**
+* Write the snapshot to a connection that sent REPLICATE, then the frame of every write queued for it and a PING frame
+* every heartbeat while there are none, until the replica closes the connection, falls too far behind, a write fails,
+* or the server stops. Like streamChanges, each part must be written within the idle timeout and anything the replica
+* sends ends the stream.
+ */
+func (s *Server) streamToReplica(served *servedConnection, frames *wire.FrameReader, writer *wire.FrameWriter) {
+	connection := served.connection
+	streaming := served.session.replica
+
+	// checked again after clearing the deadline, which would otherwise replace the one Stop interrupts reads with
+	err := connection.SetReadDeadline(time.Time{})
+	if err != nil || s.listening.draining.Load() {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		frames.ReadFrame()
+	}()
+
+	snapshot := streaming.snapshot
+	streaming.snapshot = nil
+	for len(snapshot) > 0 {
+		chunk := snapshot
+		if len(chunk) > snapshotChunk {
+			chunk = chunk[:snapshotChunk]
+		}
+		err = connection.SetWriteDeadline(time.Now().Add(s.idleTimeout))
+		if err == nil {
+			_, err = connection.Write(chunk)
+		}
+		if err != nil {
+			s.logger.Errorf("Error writing the snapshot to the replica %s: %s", served.session.remoteAddress, err.Error())
+			return
+		}
+		snapshot = snapshot[len(chunk):]
+	}
+
+	heartbeat := time.NewTicker(streaming.heartbeat)
+	defer heartbeat.Stop()
+	ping, _ := s.wire.EncodeMessage(wire.PING)
+
+	for {
+		var frame []byte
+		select {
+		case write, open := <-streaming.writes:
+			if !open {
+				s.logger.Errorf("Disconnecting the replica %s, it fell more than %d writes behind", served.session.remoteAddress, replicaBuffer)
+				return
+			}
+			frame = write
+		case <-heartbeat.C:
+			if s.listening.draining.Load() {
+				return
+			}
+			frame = ping
+		case <-closed:
+			return
+		}
+
+		err = connection.SetWriteDeadline(time.Now().Add(s.idleTimeout))
+		if err != nil {
+			return
+		}
+		err = writer.WriteFrame(frame)
+		if err != nil {
+			s.logger.Errorf("Disconnecting the replica %s after a failed write: %s", served.session.remoteAddress, err.Error())
+			return
+		}
+	}
+}
+
+// primaryLink is a replica's connection to its primary between Start and Stop, held by pointer so copies of the Server
+// share it
+type primaryLink struct {
+	mutex      sync.Mutex
+	connection net.Conn
+	// stop is closed by Stop, and done once the replica stopped applying the primary's writes
+	stop chan struct{}
+	done chan struct{}
+}
+
+// followPrimary applies the writes of the primary set with WithReplicaOf until stopFollowing, connecting again each
+// time the connection is lost. Servers that are not replicas follow nothing.
+func (s *Server) followPrimary() {
+	if s.replicaOf == "" {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	s.upstream.mutex.Lock()
+	s.upstream.stop, s.upstream.done = stop, done
+	s.upstream.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		for {
+			err := s.replicate(stop)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			s.logger.Errorf("Lost the primary %s, connecting again in %s: %s", s.replicaOf, replicaRetryInterval, err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(replicaRetryInterval):
+			}
+		}
+	}()
+}
+
+// stopFollowing closes the connection to the primary and waits for the write being applied, if any
+func (s *Server) stopFollowing() {
+	s.upstream.mutex.Lock()
+	stop, done := s.upstream.stop, s.upstream.done
+	s.upstream.stop, s.upstream.done = nil, nil
+	if stop != nil {
+		close(stop)
+	}
+	if s.upstream.connection != nil {
+		s.upstream.connection.Close()
+	}
+	s.upstream.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// replicate
+/**
+* Connect to the primary, send REPLICATE, and apply what it streams until the connection fails or stop is closed
+*
+* The replica's databases are emptied before the snapshot is applied. Everything is applied through runCommand by a
+* session that alone may write to a replica, so the replica's append only log and its own replicas see it too. A
+* command that fails to apply is logged and the rest are still applied. The primary is given the idle timeout to
+* answer, and half of it as the heartbeat, so a primary that went away is noticed within one and a half idle timeouts.
+ */
+func (s *Server) replicate(stop chan struct{}) error {
+	connection, err := net.DialTimeout("tcp", s.replicaOf, s.idleTimeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	s.upstream.mutex.Lock()
+	select {
+	case <-stop:
+		s.upstream.mutex.Unlock()
+		return net.ErrClosed
+	default:
+	}
+	s.upstream.connection = connection
+	s.upstream.mutex.Unlock()
+
+	frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+	heartbeat := s.idleTimeout / 2
+	if s.replicaToken != "" {
+		err = s.requestPrimary(connection, frames, wire.AUTH, s.replicaToken)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.requestPrimary(connection, frames, wire.REPLICATE, s.wire.EncodeDuration(heartbeat))
+	if err != nil {
+		return err
+	}
+	s.logger.Infof("Replicating the primary %s", s.replicaOf)
+
+	applying := &session{admin: true, replicating: true, resolved: true, remoteAddress: s.replicaOf}
+	s.apply(applying, wire.TRUNCATE)
+	for _, name := range s.databaseNames() {
+		s.apply(applying, wire.DROPDB, name)
+	}
+
+	for {
+		err = connection.SetReadDeadline(time.Now().Add(heartbeat + s.idleTimeout))
+		if err != nil {
+			return err
+		}
+		frame, err := frames.ReadFrame()
+		if err != nil {
+			return err
+		}
+
+		command, err := s.wire.DecipherCommand(frame)
+		if err != nil {
+			return err
+		}
+		if command == wire.PING {
+			continue
+		}
+		s.applyFrame(applying, command, frame)
+	}
+}
+
+// apply encodes a command and applies it as if the primary had streamed it
+func (s *Server) apply(applying *session, command wire.Command, arguments ...string) {
+	frame, err := s.wire.EncodeMessage(command, arguments...)
+	if err == nil {
+		s.applyFrame(applying, command, frame)
+	}
+}
+
+// applyFrame runs a command streamed by the primary, logging it when it fails
+func (s *Server) applyFrame(applying *session, command wire.Command, frame []byte) {
+	response, err := s.runCommand(applying, command, frame)
+	if err == nil {
+		err = responseError(s, response)
+	}
+	if err != nil {
+		s.logger.Errorf("Applying %s from the primary %s failed: %s", command, s.replicaOf, err.Error())
+	}
+}
+
+// requestPrimary sends a request to the primary and reads the answer, returning an error for anything but ACK
+func (s *Server) requestPrimary(connection net.Conn, frames *wire.FrameReader, command wire.Command, arguments ...string) error {
+	request, err := s.wire.EncodeMessage(command, arguments...)
+	if err != nil {
+		return err
+	}
+
+	err = connection.SetDeadline(time.Now().Add(s.idleTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = connection.Write(request)
+	if err != nil {
+		return err
+	}
+	response, err := frames.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	answered, err := s.wire.DecipherCommand(response)
+	switch {
+	case err != nil:
+		return err
+	case answered == wire.ACK:
+		return nil
+	case answered == wire.ERR:
+		return s.wire.DecodeError(response)
+	default:
+		return fmt.Errorf("the primary answered %s with %s", command, answered)
+	}
+}
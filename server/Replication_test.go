@@ -0,0 +1,155 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startReplicaOf starts a replica of primary, which must have been started, stopping it when the test ends
+func startReplicaOf(t *testing.T, primary *Server, token string, opts ...Option) *Server {
+	t.Helper()
+	replicaOf := WithReplicaOf(net.JoinHostPort("localhost", strconv.Itoa(primary.Port())), token)
+	replica := New("localhost", 0, append(opts, WithLogger(nil), replicaOf)...)
+	err := replica.Start()
+	if err != nil {
+		t.Fatalf("Error starting replica %q", err)
+	}
+	t.Cleanup(func() { replica.Stop() })
+	return &replica
+}
+
+// waitForConvergence fails the test unless the store of the replica holds what the store of the primary does within
+// five seconds
+func waitForConvergence(t *testing.T, primary *engine.DataStore, replica *engine.DataStore) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		expected, found := primary.ReadBy(""), replica.ReadBy("")
+		if reflect.DeepEqual(expected, found) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the replica to hold the primary's %d keys but it held %d", len(expected), len(found))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestReplicaConvergesOnThePrimaryAndServesReads(t *testing.T) {
+	primary := New("localhost", 0, WithLogger(nil))
+	err := primary.Start()
+	if err != nil {
+		t.Fatalf("Error starting primary %q", err)
+	}
+	defer primary.Stop()
+
+	// the first half of the keys reach the replica in the snapshot, and the rest streamed as they are written
+	writer := &session{}
+	for i := 0; i < 500; i++ {
+		runIn(t, &primary, writer, wire.INSERT, fmt.Sprintf("key:%d", i), strconv.Itoa(i))
+	}
+	runIn(t, &primary, writer, wire.SELECTDB, "shop")
+	runIn(t, &primary, writer, wire.INSERT, "orders:1", "pending")
+	runIn(t, &primary, writer, wire.SELECTDB, "")
+
+	replica := startReplicaOf(t, &primary, "")
+	for i := 500; i < 1000; i++ {
+		runIn(t, &primary, writer, wire.INSERT, fmt.Sprintf("key:%d", i), strconv.Itoa(i))
+	}
+	runIn(t, &primary, writer, wire.UPDATE, "key:0", "updated")
+	runIn(t, &primary, writer, wire.DELETE, "key:1")
+	runIn(t, &primary, writer, wire.EXPIRE, "key:2", primary.wire.EncodeTime(time.Now().Add(time.Hour)))
+	runIn(t, &primary, writer, wire.SELECTDB, "shop")
+	runIn(t, &primary, writer, wire.UPDATE, "orders:1", "shipped")
+
+	waitForConvergence(t, &primary.dataStore, &replica.dataStore)
+	waitForConvergence(t, primary.database("shop"), replica.database("shop"))
+	if expiration, _ := replica.dataStore.ReadExpiration("key:2"); expiration.IsZero() {
+		t.Fatalf("Expected the expiration to be replicated")
+	}
+
+	reader := &session{}
+	if responseCommand := runIn(t, replica, reader, wire.READ, "key:0"); responseCommand != wire.READ {
+		t.Fatalf("Expected the replica to answer READ but got %s", responseCommand)
+	}
+	if responseCommand := runIn(t, replica, reader, wire.COUNT); responseCommand != wire.COUNT || replica.dataStore.Count() != 999 {
+		t.Fatalf("Expected the replica to count 999 keys but got %s with %d", responseCommand, replica.dataStore.Count())
+	}
+	if responseCommand := runIn(t, replica, reader, wire.KEYSBY, "key:99"); responseCommand != wire.KEYSBY {
+		t.Fatalf("Expected the replica to answer KEYSBY but got %s", responseCommand)
+	}
+}
+
+func TestReplicasApplyTheKeysThePrimarysMiddlewareResolved(t *testing.T) {
+	primary := New("localhost", 0, WithLogger(nil), WithMiddleware(tenantKeys))
+	err := primary.Start()
+	if err != nil {
+		t.Fatalf("Error starting primary %q", err)
+	}
+	defer primary.Stop()
+
+	// the first key reaches the replica in the snapshot, and the rest streamed as they are written
+	writer := &session{}
+	runIn(t, &primary, writer, wire.INSERT, "a", "1")
+	replica := startReplicaOf(t, &primary, "", WithMiddleware(tenantKeys))
+	runIn(t, &primary, writer, wire.INSERT, "b", "2")
+	runIn(t, &primary, writer, wire.EXPIREIN, "b", primary.wire.EncodeDuration(time.Hour))
+	runIn(t, &primary, writer, wire.RENAME, "a", "c", "false")
+
+	waitForConvergence(t, &primary.dataStore, &replica.dataStore)
+	expected := map[string]string{"anonymous:b": "2", "anonymous:c": "1"}
+	if found := replica.dataStore.ReadBy(""); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("Expected the replica to hold the keys %v middleware resolved but found %v", expected, found)
+	}
+	if _, expires := replica.dataStore.TTL("anonymous:b"); !expires {
+		t.Fatalf("Expected the expiration of %q to be replicated", "anonymous:b")
+	}
+}
+
+func TestReplicasRefuseWritesFromClients(t *testing.T) {
+	primary := New("localhost", 0, WithLogger(nil))
+	err := primary.Start()
+	if err != nil {
+		t.Fatalf("Error starting primary %q", err)
+	}
+	defer primary.Stop()
+	replica := startReplicaOf(t, &primary, "")
+
+	// writes are refused before they are run, so even an admin cannot write to a replica
+	protocol := wire.Protocol{}
+	for _, request := range [][]string{{string(wire.INSERT), "a", "1"}, {string(wire.DELETE), "a"}, {string(wire.TRUNCATE)}} {
+		message, _ := protocol.EncodeMessage(wire.Command(request[0]), request[1:]...)
+		response, err := replica.runCommand(&session{admin: true}, wire.Command(request[0]), message)
+		if err != nil {
+			t.Fatalf("Expected %s to be answered but got %q", request[0], err)
+		}
+		responseCommand, _ := protocol.DecipherCommand(response[0])
+		assertError(t, wire.ErrReadOnly, responseCommand, response[0])
+	}
+
+	if !replica.capabilities().Has(wire.CapabilityReadOnly) || primary.capabilities().Has(wire.CapabilityReadOnly) {
+		t.Fatalf("Expected only the replica to report it is read-only")
+	}
+}
+
+func TestReplicateNeedsAnAdminSessionWhenThereIsAnAdminToken(t *testing.T) {
+	primary := New("localhost", 0, WithLogger(nil), WithAdminToken("secret"))
+	err := primary.Start()
+	if err != nil {
+		t.Fatalf("Error starting primary %q", err)
+	}
+	defer primary.Stop()
+	primary.dataStore.Insert("a", "1")
+
+	responseCommand, response := send(t, &primary, &session{}, wire.REPLICATE)
+	assertError(t, wire.ErrUnauthorized, responseCommand, response)
+
+	replica := startReplicaOf(t, &primary, "secret")
+	waitForConvergence(t, &primary.dataStore, &replica.dataStore)
+}
@@ -1,152 +1,553 @@
 package server
 
 import (
-	"bufio"
 	"datastore/engine"
 	"datastore/wire"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	address   string
-	port      int
-	started   bool
-	stopped   bool
-	wire      wire.Protocol
-	dataStore engine.DataStore
+	address     string
+	port        int
+	listening   *listening
+	wire        wire.Protocol
+	dataStore   engine.DataStore
+	databases   *databases
+	connections *connectionTracker
+	protection  *prefixProtection
+	lifecycle   *lifecycle
+	poller      *connectionPoller
+	appendLog   *appendLog
+	replicas    *replicas
+	upstream    *primaryLink
+	metrics     *metrics
+	// beforeCommand runs as each command starts, letting tests hold a command in flight
+	beforeCommand func(command wire.Command)
+	config
 }
 
-func New(address string, port int) Server {
+// defaultStopTimeout is how long Stop waits for commands in flight to be answered
+const defaultStopTimeout = time.Second * 10
+
+// ErrStopTimeout is returned by Stop when commands were still in flight once its timeout passed
+var ErrStopTimeout = errors.New("timed out waiting for commands in flight, their connections were closed")
+
+// listening
+/**
+* The listener between Start and Stop, held by pointer so copies of the Server share it
+*
+* draining is set from the start of Stop until the next Start, and tells connections to close rather than wait for
+* another request.
+ */
+type listening struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	// accepting is closed once the loop accepting connections from listener has returned
+	accepting chan struct{}
+	draining  atomic.Bool
+	// metricsEndpoint serves the Prometheus metrics between Start and Stop, nil without WithMetricsEndpoint
+	metricsEndpoint *http.Server
+	// started is when the last Start began listening, which INFO reports the uptime since
+	started time.Time
+}
+
+// connectionTracker
+/**
+* Keeps track of open connections so they can be listed and closed, and counts every connection accepted. The count
+* doubles as the ID of each connection. handlers counts the open connections, so Stop can wait for them to close.
+ */
+type connectionTracker struct {
+	mutex    sync.Mutex
+	open     map[net.Conn]*connectionState
+	accepted int64
+	handlers sync.WaitGroup
+}
+
+func New(address string, port int, opts ...Option) Server {
+	serverConfig := config{
+		idleTimeout:    time.Second * 10,
+		maxMessageSize: wire.DefaultMaxMessageSize,
+		maxValueLength: engine.DefaultMaxValueLength,
+	}
+	for _, opt := range opts {
+		opt(&serverConfig)
+	}
+	if serverConfig.maxMessageSize <= wire.LengthPrefixSize {
+		serverConfig.maxMessageSize = wire.DefaultMaxMessageSize
+	}
+	if serverConfig.maxMessageSize > wire.MaxFrameSize {
+		serverConfig.maxMessageSize = wire.MaxFrameSize
+	}
+	if serverConfig.maxResponseFrame <= 0 || serverConfig.maxResponseFrame > wire.MaxFrameSize {
+		serverConfig.maxResponseFrame = serverConfig.maxMessageSize
+	}
+	if serverConfig.logger == nil {
+		serverConfig.logger = defaultLogger()
+	}
+	if serverConfig.clock == nil {
+		serverConfig.clock = time.Now
+	}
+	logger := serverConfig.logger
+
+	storeOptions := engine.Options{
+		TTLRules:          serverConfig.ttlRules,
+		StaleWindow:       serverConfig.staleWindow,
+		DefaultTTL:        serverConfig.defaultTTL,
+		Clock:             serverConfig.clock,
+		ExpirationArchive: serverConfig.expirationArchive,
+		ChangeFeed:        serverConfig.changeFeed,
+		KeyLimits:         serverConfig.keyLimits,
+		MaxValueLength:    serverConfig.maxValueLength,
+		SpillDirectory:    serverConfig.spillDirectory,
+		SpillThreshold:    serverConfig.spillThreshold,
+		MaxLockHold:       serverConfig.maxLockHold,
+		WaterMarks:        serverConfig.waterMarks,
+		MaxKeys:           serverConfig.maxKeys,
+		EvictionPolicy:    serverConfig.evictionPolicy,
+		KeySeparator:      serverConfig.keySeparator,
+		OnCleanup: func(removed int) {
+			if removed > 0 {
+				logger.Debugf("Cleanup removed %d expired keys", removed)
+			}
+		},
+	}
+	separator := serverConfig.keySeparator
+	if separator == "" {
+		separator = engine.DefaultKeySeparator
+	}
+
 	return Server{
-		address:   address,
-		port:      port,
-		started:   false,
-		stopped:   true,
-		wire:      wire.Protocol{},
-		dataStore: engine.NewDataStore(),
+		address:     address,
+		port:        port,
+		listening:   &listening{},
+		wire:        wire.Protocol{},
+		dataStore:   engine.NewDataStoreWithOptions(storeOptions),
+		databases:   &databases{stores: map[string]*engine.DataStore{}, options: storeOptions},
+		connections: &connectionTracker{open: map[net.Conn]*connectionState{}},
+		protection:  &prefixProtection{prefixes: serverConfig.protectedPrefixes, separator: separator},
+		lifecycle:   &lifecycle{},
+		poller:      &connectionPoller{parked: map[*servedConnection]bool{}},
+		appendLog:   newAppendLog(serverConfig.appendLogPath, serverConfig.appendSync, logger),
+		replicas:    &replicas{attached: map[*replica]bool{}},
+		upstream:    &primaryLink{},
+		metrics:     newMetrics(),
+		config:      serverConfig,
 	}
 }
 
+// Port returns the port the server listens on, the one it was given or the free port Start found for a port of zero
+func (s *Server) Port() int {
+	return s.port
+}
+
+// MetricsAddress returns the address the metrics endpoint is served on once Start has bound it, with the free port it
+// found for a port of zero, and the empty string without WithMetricsEndpoint
+func (s *Server) MetricsAddress() string {
+	return s.metricsAddress
+}
+
+// AcceptedConnections returns the number of connections the server has accepted since it was created
+func (s *Server) AcceptedConnections() int64 {
+	s.connections.mutex.Lock()
+	defer s.connections.mutex.Unlock()
+	return s.connections.accepted
+}
+
+// Start listens on the server's address and port, a port of zero listens on a free port that Port then returns. The
+// first Start replays the append only log set with WithAppendOnlyLog before listening.
 func (s *Server) Start() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.address, s.port))
+	err := s.appendLog.open(s)
+	if err != nil {
+		s.logger.Errorf("Error opening the append only log: %s", err.Error())
+		s.hookStartFailed(err)
+		return err
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.address, strconv.Itoa(s.port)))
 	if err != nil {
-		fmt.Printf("Error starting server: %s\n", err.Error())
+		s.logger.Errorf("Error starting server: %s", err.Error())
+		s.appendLog.close()
+		s.hookStartFailed(err)
 		return err
 	}
 
-	s.started = true
-	s.stopped = false
-	fmt.Printf("Server listenting on %s:%d...\n", s.address, s.port)
-	go s.listenForConnections(listener)
+	var metricsEndpoint *http.Server
+	if s.metricsAddress != "" {
+		metricsEndpoint, s.metricsAddress, err = s.serveMetrics(s.metricsAddress)
+		if err != nil {
+			s.logger.Errorf("Error serving metrics: %s", err.Error())
+			listener.Close()
+			s.appendLog.close()
+			s.hookStartFailed(err)
+			return err
+		}
+	}
+
+	if bound, ok := listener.Addr().(*net.TCPAddr); ok {
+		s.port = bound.Port
+	}
+	accepting := make(chan struct{})
+	s.listening.mutex.Lock()
+	s.listening.listener = listener
+	s.listening.metricsEndpoint = metricsEndpoint
+	s.listening.accepting = accepting
+	s.listening.draining.Store(false)
+	s.listening.started = time.Now()
+	s.listening.mutex.Unlock()
+
+	s.logger.Infof("Server listening on %s:%d", s.address, s.port)
+	s.hookListening(listener.Addr())
+	go s.listenForConnections(listener, accepting)
+	s.followPrimary()
 	return nil
 }
 
+// Stop
+/**
+* Stop the server, waiting up to 10 seconds for commands in flight to be answered, see StopWithTimeout
+ */
 func (s *Server) Stop() error {
-	println("Stopping server")
-	s.started = false
+	return s.StopWithTimeout(defaultStopTimeout)
+}
+
+// StopWithTimeout
+/**
+* Stop accepting connections and close every open one once it has answered the command it is running, waiting up to
+* timeout for them to
+*
+* The port is released by the time StopWithTimeout returns. Idle and parked connections are closed straight away, and
+* connections running a command are closed once it has been answered. Connections still running a command when the
+* timeout passes are closed without waiting for them, and ErrStopTimeout is returned.
+* The append only log is flushed and closed once the connections are, the next Start appends to it again.
+*
+* Stopping a server that is not running closes the connections handed to ServeConn and does nothing else, so Stop can
+* be called more than once and before Start.
+ */
+func (s *Server) StopWithTimeout(timeout time.Duration) error {
+	s.logger.Infof("Stopping server")
+	wasRunning := s.hookStopping()
 
-	if !s.stopped {
-		// send a message to trigger shutdown
-		connection, err := net.Dial("tcp", fmt.Sprintf("%s:%d", s.address, s.port))
+	s.listening.mutex.Lock()
+	listener, accepting := s.listening.listener, s.listening.accepting
+	metricsEndpoint := s.listening.metricsEndpoint
+	s.listening.listener = nil
+	s.listening.metricsEndpoint = nil
+	s.listening.draining.Store(true)
+	s.listening.mutex.Unlock()
+
+	if listener != nil {
+		err := listener.Close()
 		if err != nil {
-			return err
+			s.logger.Errorf("Error closing listener: %s", err.Error())
 		}
-		defer connection.Close()
-		err = connection.SetDeadline(time.Now().Add(time.Second * 60))
+		<-accepting
+	}
+	if metricsEndpoint != nil {
+		err := metricsEndpoint.Close()
 		if err != nil {
-			return err
+			s.logger.Errorf("Error closing the metrics endpoint: %s", err.Error())
 		}
+	}
 
-		_, err = connection.Write([]byte{})
-		if err != nil {
-			return err
-		}
+	s.stopFollowing()
+	s.unparkAll()
+	s.connections.interruptReads()
+	err := s.connections.wait(timeout)
+	if err != nil {
+		s.connections.closeAll()
 	}
+	s.appendLog.close()
 
-	for !s.stopped {
+	if wasRunning {
+		s.hookStopped()
 	}
 
-	return nil
+	return err
 }
 
-func (s *Server) listenForConnections(listener net.Listener) {
-	defer func(listener net.Listener) {
-		err := listener.Close()
-		if err != nil {
-			fmt.Println("Error closing listener:", err.Error())
-		} else {
-			s.stopped = true
-		}
-	}(listener)
+// listenForConnections accepts connections until Stop closes the listener, then closes accepting
+func (s *Server) listenForConnections(listener net.Listener, accepting chan struct{}) {
+	defer close(accepting)
 
+	backoff := time.Duration(0)
 	for {
 		connection, err := listener.Accept()
-		connection.SetDeadline(time.Now().Add(time.Second * 10))
-
-		if !s.started {
-			break
+		if errors.Is(err, net.ErrClosed) {
+			return
 		}
 
 		if err != nil {
-			fmt.Printf("Error on connection: %s\n", err.Error())
-		} else {
-			go s.handleConnection(connection)
+			// such as running out of file descriptors, the connection waits to be accepted again once some are released,
+			// which waiting lets happen rather than spinning on the same error
+			backoff = nextAcceptBackoff(backoff)
+			s.logger.Errorf("Error accepting a connection, retrying in %s: %s", backoff, err.Error())
+			time.Sleep(backoff)
+			continue
 		}
+
+		backoff = 0
+		connection.SetDeadline(time.Now().Add(time.Second * 10))
+		go s.handleConnection(connection)
 	}
 }
 
+// maxAcceptBackoff is the longest listenForConnections waits between failed accepts
+const maxAcceptBackoff = time.Second
+
+// nextAcceptBackoff doubles the wait after a failed accept, starting at 5ms and capped at maxAcceptBackoff
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return time.Millisecond * 5
+	}
+	if backoff*2 > maxAcceptBackoff {
+		return maxAcceptBackoff
+	}
+	return backoff * 2
+}
+
+// handleConnection
+/**
+* Serve requests from a connection until the client closes it, it sits idle past the idle timeout, or it reaches one
+* of the configured recycling limits
+*
+* Requests on one connection are handled one at a time in the order they arrive, and each is answered before the next
+* is read, so a client can pipeline several requests and rely on each seeing the effects of the ones before it. This
+* ordering is part of the protocol and clients such as client.Session depend on it. When a recycling limit is reached
+* the response to the request in flight is followed by a CONNECTIONRECYCLED error telling the client that nothing
+* further will be processed on this connection, and then the connection is closed.
+ */
 func (s *Server) handleConnection(connection net.Conn) {
-	defer func(connection net.Conn) {
+	s.logger.Debugf("Accepted connection from %s", connection.RemoteAddr())
+	s.serve(&servedConnection{
+		connection: connection,
+		state:      s.connections.add(connection),
+		session:    &session{remoteAddress: connection.RemoteAddr().String()},
+		idleSince:  time.Now(),
+		raw:        s.parkable(connection),
+	})
+}
+
+// ServeConn
+/**
+* Serve requests from a connection the server did not accept itself, such as one end of a net.Pipe for a client in the
+* same process, until it is closed, as handleConnection describes. The server does not need to have been started, and
+* Stop closes the connection along with every other.
+ */
+func (s *Server) ServeConn(connection net.Conn) {
+	s.handleConnection(connection)
+}
+
+// serve
+/**
+* Serve requests from a connection, for handleConnection or when a parked connection is resumed, until the connection
+* is closed or parked again
+*
+* A connection that can be parked first waits for a request only until it has been idle for the parking threshold.
+* Waiting reads nothing, so when nothing has arrived by then the connection is parked with no bytes of the next request
+* read and its read buffer is dropped. A resumed connection is past the threshold, so it reads its next request straight
+* away, or finds the idle timeout has passed and closes.
+ */
+func (s *Server) serve(served *servedConnection) {
+	connection := served.connection
+	parked := false
+	defer func() {
+		if parked {
+			return
+		}
+		if served.session.watch != nil {
+			served.session.watch.unsubscribe()
+		}
+		if served.session.replica != nil {
+			s.replicas.detach(served.session.replica)
+		}
+		s.connections.remove(connection)
 		err := connection.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Errorf("Error closing connection from %s: %s", served.session.remoteAddress, err.Error())
+			return
+		}
+		s.logger.Debugf("Closed connection from %s", served.session.remoteAddress)
+	}()
+
+	frames := wire.NewFrameReader(connection, uint32(s.maxMessageSize))
+	writer := wire.NewFrameWriter(connection)
+
+	for {
+		if s.listening.draining.Load() {
+			return
+		}
+
+		idleUntil := served.idleSince.Add(s.idleTimeout)
+		parkAt := served.idleSince.Add(s.parking.After)
+		if served.raw != nil && frames.Buffered() == 0 && parkAt.Before(idleUntil) && time.Now().Before(parkAt) {
+			err := connection.SetDeadline(parkAt)
+			if err != nil || s.listening.draining.Load() {
+				return
+			}
+			err = frames.Ready()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// the sweep checks the socket itself, and a passed deadline would make it look readable
+				err = connection.SetDeadline(time.Time{})
+				if err != nil {
+					return
+				}
+				parked = s.park(served)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		// checked again after setting the deadline, which would otherwise replace the one Stop interrupts reads with
+		err := connection.SetDeadline(idleUntil)
+		if err != nil || s.listening.draining.Load() {
+			return
+		}
+
+		message, err := frames.ReadFrame()
+		var truncated *wire.TruncatedFrameError
+		var invalidSize *wire.FrameSizeError
+		if errors.As(err, &truncated) || errors.As(err, &invalidSize) {
+			s.logger.Debugf("Closing connection from %s after an unreadable request: %s", served.session.remoteAddress, err.Error())
+			s.sendErrorResponse(writer, err)
+			return
+		}
 		if err != nil {
-			fmt.Println("Error closing connection:", err.Error())
+			// the client closed the connection or let it go idle between requests
+			return
 		}
-	}(connection)
 
-	// https://stackoverflow.com/a/47585913
-	connectionBuffer := bufio.NewReader(connection)
-	messageSizeBytes, err := connectionBuffer.Peek(4)
-	if err != nil {
-		s.sendErrorResponse(connection, err)
-		return
-	}
-	if len(messageSizeBytes) != 4 {
-		s.sendErrorResponse(connection, err)
-		return
-	}
+		command, _ := s.wire.DecipherCommand(message)
+		served.state.begin(command, len(message))
+		if s.beforeCommand != nil {
+			s.beforeCommand(command)
+		}
 
-	messageSize := binary.LittleEndian.Uint32(messageSizeBytes[:4])
-	message := make([]byte, messageSize)
-	_, err = io.ReadFull(connectionBuffer, message)
-	if err != nil {
-		s.sendErrorResponse(connection, err)
-		return
-	}
+		response, err := s.runCommand(served.session, command, message)
+		if err != nil {
+			s.logger.Debugf("Error handling %s from %s: %s", command, served.session.remoteAddress, err.Error())
+			response = net.Buffers{s.wire.EncodeErrResponse(err)}
+		} else {
+			s.hookCommandSucceeded()
+		}
+		failed := err != nil
+		if len(response) > 0 {
+			answered, _ := s.wire.DecipherCommand(response[0])
+			failed = answered == wire.ERR
+		}
 
-	response, err := s.handleMessage(message)
-	if err != nil {
-		s.sendErrorResponse(connection, err)
-		return
-	}
+		served.requests++
+		recycle := (s.maxRequestsPerConnection > 0 && served.requests >= s.maxRequestsPerConnection) ||
+			(s.maxConnectionAge > 0 && time.Since(served.state.connectedAt) >= s.maxConnectionAge)
+		if recycle {
+			response = append(response, s.wire.EncodeErrResponse(wire.ErrConnectionRecycled))
+		}
 
-	_, err = connection.Write(response)
-	if err != nil {
-		fmt.Println("Error writing response:", err.Error())
-		return
+		// writing consumes the buffers, so measure the response first
+		size := 0
+		for _, segment := range response {
+			size += len(segment)
+		}
+
+		// counted before the response is written, so a client that has its answer finds it counted
+		s.metrics.count(command, len(message), size, failed)
+		err = writer.WriteFrame(response...)
+		served.state.finish(size, served.session.identity())
+		if err != nil {
+			s.logger.Errorf("Error writing response to %s: %s", served.session.remoteAddress, err.Error())
+			return
+		}
+
+		if recycle {
+			return
+		}
+		if served.session.watch != nil {
+			s.streamChanges(served, frames, writer)
+			return
+		}
+		if served.session.replica != nil {
+			s.streamToReplica(served, frames, writer)
+			return
+		}
+		served.idleSince = time.Now()
 	}
 }
 
-func (s *Server) handleMessage(message []byte) ([]byte, error) {
+// keyStatuses maps the engine's key statuses to those READSTATUS responds with
+var keyStatuses = map[engine.KeyStatus]wire.KeyStatus{
+	engine.KeyLive:    wire.KeyLive,
+	engine.KeyExpired: wire.KeyExpired,
+	engine.KeyMissing: wire.KeyMissing,
+}
+
+// expireModes maps the modes of the EXPIRE command to the engine's
+var expireModes = map[wire.ExpireMode]engine.ExpireMode{
+	wire.ExpireAlways:    engine.ExpireAlways,
+	wire.ExpireIfNone:    engine.ExpireIfNone,
+	wire.ExpireIfSet:     engine.ExpireIfSet,
+	wire.ExpireIfLonger:  engine.ExpireIfLonger,
+	wire.ExpireIfShorter: engine.ExpireIfShorter,
+}
+
+// refusedAsFull reports whether a write that did not create key was refused because the data store is over its water
+// marks, the engine only refuses writes creating keys, so a key that is present was refused for another reason
+func refusedAsFull(store *engine.DataStore, key string) bool {
+	return !store.Present(key) && store.CheckCapacity() != nil
+}
+
+// handleMessage
+/**
+* Decode a request, run it against the data store of the database the session selected, and encode the response
+*
+* A returned error means the request itself could not be handled and is sent to the client as an ERR response.
+* Failures of the operation are encoded into the response:
+*
+* - Errors from the engine, and false results that mean a required key was missing or in the way (INSERT, UPDATE,
+*   DELETE), become typed ERR responses through keyError.
+* - False results that mean there was nothing to return or nothing to do are NULL: READ and READEXPIRATION of a missing
+*   key, PRESENT of a missing key, an UPSERT that did not change the stored value, and an EXPIRE whose mode kept the
+*   current expiration.
+*
+* Commands on single keys go through the server's Middleware first, which may refuse them with an ERR response or
+* rewrite their keys and values. Writes under a protected prefix from a session that has not authenticated as an admin
+* are then refused with a PROTECTED ERR response before they reach the data store.
+*
+* A string command that finds a key holding a hash, and a hash command that finds one holding a string, fail with a
+* WRONGTYPE ERR response.
+*
+* MULTI applies the commands it carries with nothing in between and answers with the response each would have had on
+* its own. One that cannot be decoded or is refused by middleware or a protected prefix fails the whole MULTI.
+*
+* Successful responses are wrapped in WARN when there is something the client should know, see warn: an EXPIRE shortened
+* by a TTL rule carries TTLCLAMPED.
+*
+* The response is returned as buffers that are written to the connection together, READ keeps the value in its own
+* buffer so large values are not copied into a single frame first.
+ */
+func (s *Server) handleMessage(session *session, message []byte) (net.Buffers, error) {
 	command, err := s.wire.DecipherCommand(message)
 	if err != nil {
 		return nil, err
 	}
 
+	err = s.checkAuthenticated(session, command)
+	if err == nil {
+		err = s.checkMiddlewareSupports(session, command)
+	}
+	if err != nil {
+		return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+	}
+	store := s.database(session.database)
+
 	switch command {
 	case wire.READ:
 		key, err := s.wire.DecodeRead(message)
@@ -154,7 +555,17 @@ func (s *Server) handleMessage(message []byte) ([]byte, error) {
 			return nil, err
 		}
 
-		response := s.wire.EncodeReadResponse(s.dataStore.Read(key))
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		value, present := store.Read(key)
+		if !present && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+
+		response := s.wire.EncodeReadResponseSegments(value, present)
 		return response, nil
 	case wire.INSERT:
 		key, value, err := s.wire.DecodeInsert(message)
@@ -162,103 +573,973 @@ func (s *Server) handleMessage(message []byte) ([]byte, error) {
 			return nil, err
 		}
 
-		response := s.wire.EncodeInsertResponse(s.dataStore.Insert(key, value))
-		return response, nil
+		key, value, err = s.beforeWrite(session, command, key, value)
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err == nil {
+			err = keyError(store.CheckKey(key), key)
+		}
+		if err == nil {
+			err = keyError(store.CheckValue(value), key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		var insertErr error
+		if !store.Insert(key, value) {
+			insertErr = engine.ErrKeyExists
+			if refusedAsFull(store, key) {
+				insertErr = engine.ErrStoreFull
+			}
+		}
+
+		response := s.wire.EncodeAckOrErrResponse(keyError(insertErr, key))
+		return net.Buffers{response}, nil
+	case wire.INSERTMANY:
+		keys, values, err := s.wire.DecodeInsertMany(message)
+		if err != nil {
+			return nil, err
+		}
+
+		// every key is checked before any is inserted, so a refused batch inserts nothing
+		for i := range keys {
+			keys[i], values[i], err = s.beforeWrite(session, command, keys[i], values[i])
+			if err == nil {
+				err = s.checkKeyWrite(session, keys[i])
+			}
+			if err == nil {
+				err = keyError(store.CheckKey(keys[i]), keys[i])
+			}
+			if err == nil {
+				err = keyError(store.CheckValue(values[i]), keys[i])
+			}
+			if err != nil {
+				return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+			}
+		}
+
+		inserted := 0
+		for i, key := range keys {
+			if store.Insert(key, values[i]) {
+				inserted++
+			}
+		}
+
+		response := s.wire.EncodeInsertManyResponse(inserted)
+		return net.Buffers{response}, nil
+	case wire.READSTALE:
+		key, staleWindow, err := s.wire.DecodeReadStale(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		value, stale, present := store.ReadStale(key, staleWindow)
+		if !present && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+
+		response := s.wire.EncodeReadStaleResponse(value, stale, present)
+		return net.Buffers{response}, nil
+	case wire.READSTATUS:
+		key, err := s.wire.DecodeReadStatus(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		value, status := store.ReadWithStatus(key)
+		if status == engine.KeyMissing && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+
+		response := s.wire.EncodeReadStatusResponse(value, keyStatuses[status])
+		return net.Buffers{response}, nil
 	case wire.READEXPIRATION:
 		key, err := s.wire.DecodeReadExpiration(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeReadExpiationResponse(s.dataStore.ReadExpiration(key))
-		return response, nil
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeReadExpiationResponse(store.ReadExpiration(key))
+		return net.Buffers{response}, nil
 	case wire.EXPIRE:
-		key, expiration, err := s.wire.DecodeExpire(message)
+		key, expiration, mode, err := s.wire.DecodeExpireWithMode(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeExpireResponse(s.dataStore.Expire(key, expiration))
-		return response, nil
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		changed, limited, err := store.ExpireWithLimit(key, expiration, expireModes[mode])
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		response := s.wire.EncodeExpireResponse(changed)
+		if changed && limited.Before(expiration) {
+			response = s.warn(session, response, wire.Warning{
+				Code:    wire.TTLCLAMPED,
+				Message: fmt.Sprintf("expiration for key %q shortened to %s by its TTL rule", key, limited.UTC().Format(time.RFC3339)),
+			})
+		}
+		return net.Buffers{response}, nil
+	case wire.INCR, wire.DECR:
+		key, delta, err := s.wire.DecodeCounter(command, message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		var value int64
+		if command == wire.INCR {
+			value, err = store.Increment(key, delta)
+		} else {
+			value, err = store.Decrement(key, delta)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		return net.Buffers{s.wire.EncodeCounterResponse(command, value)}, nil
+	case wire.EXPIREIN:
+		key, ttl, err := s.wire.DecodeExpireIn(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		changed, limited, err := store.ExpireInWithLimit(key, ttl, engine.ExpireAlways)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		response := s.wire.EncodeExpireResponse(changed)
+		if changed && limited < ttl {
+			response = s.warn(session, response, wire.Warning{
+				Code:    wire.TTLCLAMPED,
+				Message: fmt.Sprintf("time to live for key %q shortened to %s by its TTL rule", key, limited),
+			})
+		}
+		return net.Buffers{response}, nil
+	case wire.GETORSET:
+		key, defaultValue, ttl, err := s.wire.DecodeGetOrSet(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, defaultValue, err = s.beforeWrite(session, command, key, defaultValue)
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err == nil {
+			err = keyError(store.CheckKey(key), key)
+		}
+		if err == nil {
+			err = keyError(store.CheckValue(defaultValue), key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		value, existed := store.GetOrSetWithTTL(key, defaultValue, ttl)
+		if existed && value == "" && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+		if !existed && refusedAsFull(store, key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrStoreFull, key))}, nil
+		}
+
+		response := s.wire.EncodeGetOrSetResponse(value, existed)
+		return net.Buffers{response}, nil
 	case wire.UPDATE:
 		key, value, err := s.wire.DecodeUpdate(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeUpdateResponse(s.dataStore.Update(key, value))
-		return response, nil
+		key, value, err = s.beforeWrite(session, command, key, value)
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err == nil {
+			err = keyError(store.CheckValue(value), key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		var updateErr error
+		if !store.Update(key, value) {
+			updateErr = engine.ErrKeyNotFound
+			if store.HoldsHash(key) {
+				updateErr = engine.ErrWrongType
+			}
+		}
+
+		response := s.wire.EncodeAckOrErrResponse(keyError(updateErr, key))
+		return net.Buffers{response}, nil
 	case wire.DELETE:
 		key, err := s.wire.DecodeDelete(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeDeleteResponse(s.dataStore.Delete(key))
-		return response, nil
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		var deleteErr error
+		if !store.Delete(key) {
+			deleteErr = engine.ErrKeyNotFound
+		}
+
+		response := s.wire.EncodeAckOrErrResponse(keyError(deleteErr, key))
+		return net.Buffers{response}, nil
 	case wire.UPSERT:
 		key, value, err := s.wire.DecodeUpsert(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeUpsertResponse(s.dataStore.Upsert(key, value))
-		return response, nil
-	case wire.PRESENT:
-		key, err := s.wire.DecodePresent(message)
+		key, value, err = s.beforeWrite(session, command, key, value)
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err == nil {
+			err = keyError(store.CheckKey(key), key)
+		}
+		if err == nil {
+			err = keyError(store.CheckValue(value), key)
+		}
 		if err != nil {
-			return nil, err
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
 		}
 
-		response := s.wire.EncodePresentResponse(s.dataStore.Present(key))
-		return response, nil
-	case wire.TRUNCATE:
-		err := s.wire.DecodeTruncate(message)
+		upserted := store.Upsert(key, value)
+		if !upserted && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+		if !upserted && refusedAsFull(store, key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrStoreFull, key))}, nil
+		}
+
+		response := s.wire.EncodeUpsertResponse(upserted)
+		return net.Buffers{response}, nil
+	case wire.CDELETE:
+		key, expectedValue, err := s.wire.DecodeDeleteIfEquals(message)
 		if err != nil {
 			return nil, err
 		}
 
-		s.dataStore.Truncate()
-		response := s.wire.EncodeAckResponse()
-		return response, nil
-	case wire.COUNT:
-		err := s.wire.DecodeCount(message)
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
 		if err != nil {
-			return nil, err
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
 		}
 
-		response := s.wire.EncodeCountResponse(s.dataStore.Count())
-		return response, nil
-	case wire.KEYSBY:
-		prefix, err := s.wire.DecodeKeysBy(message)
+		deleted, actual, present := store.DeleteIfEquals(key, expectedValue)
+		if !present && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+		response := s.wire.EncodeDeleteIfEqualsResponse(deleted, actual, present)
+		return net.Buffers{response}, nil
+	case wire.GETDEL:
+		key, err := s.wire.DecodeGetDel(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeKeysByResponse(s.dataStore.KeysBy(prefix))
-		return response, nil
-	case wire.DELETEBY:
-		prefix, err := s.wire.DecodeDeleteBy(message)
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
 		if err != nil {
-			return nil, err
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
 		}
 
-		response := s.wire.EncodeDeleteByResponse(s.dataStore.DeleteBy(prefix))
-		return response, nil
-	case wire.EXPIREBY:
-		prefix, expiration, err := s.wire.DecodeExpireBy(message)
+		value, present := store.ReadAndDelete(key)
+		if !present && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+
+		return net.Buffers{s.wire.EncodeGetDelResponse(value, present)}, nil
+	case wire.GETUPDATE:
+		key, value, err := s.wire.DecodeGetUpdate(message)
 		if err != nil {
 			return nil, err
 		}
 
-		response := s.wire.EncodeExpireByResponse(s.dataStore.ExpireBy(prefix, expiration))
-		return response, nil
-	default:
-		return nil, errors.New(fmt.Sprintf("Unknown command %q for message %b", command, message))
-	}
-}
-
-func (s *Server) sendErrorResponse(connection net.Conn, err error) {
-	_, writeErr := connection.Write(s.wire.EncodeErrResponse(err))
-	fmt.Println(writeErr.Error())
+		key, value, err = s.beforeWrite(session, command, key, value)
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err == nil {
+			err = keyError(store.CheckValue(value), key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		oldValue, present := store.ReadAndUpdate(key, value)
+		if !present && store.HoldsHash(key) {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(engine.ErrWrongType, key))}, nil
+		}
+
+		return net.Buffers{s.wire.EncodeGetUpdateResponse(oldValue, present)}, nil
+	case wire.HSET:
+		key, field, value, err := s.wire.DecodeHSet(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, value, err = s.beforeWrite(session, command, key, value)
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		created, err := store.HSet(key, field, value)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		response := s.wire.EncodeHSetResponse(created)
+		return net.Buffers{response}, nil
+	case wire.HGET:
+		key, field, err := s.wire.DecodeHGet(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		value, present, err := store.HGet(key, field)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		response := s.wire.EncodeHGetResponse(value, present)
+		return net.Buffers{response}, nil
+	case wire.HDEL:
+		key, field, err := s.wire.DecodeHDel(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _, err = s.beforeWrite(session, command, key, "")
+		if err == nil {
+			err = s.checkKeyWrite(session, key)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		deleted, err := store.HDel(key, field)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		response := s.wire.EncodeHDelResponse(deleted)
+		return net.Buffers{response}, nil
+	case wire.HGETALL:
+		key, err := s.wire.DecodeHGetAll(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		fields, err := store.HGetAll(key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		return s.wire.EncodeHGetAllResponseFrames(fields, s.maxResponseFrame), nil
+	case wire.HLEN:
+		key, err := s.wire.DecodeHLen(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		length, err := store.HLen(key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(keyError(err, key))}, nil
+		}
+
+		response := s.wire.EncodeHLenResponse(length)
+		return net.Buffers{response}, nil
+	case wire.PRESENT:
+		key, err := s.wire.DecodePresent(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = s.beforeRead(session, command, key)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodePresentResponse(store.Present(key))
+		return net.Buffers{response}, nil
+	case wire.TRUNCATE:
+		err := s.wire.DecodeTruncate(message)
+		if err != nil {
+			return nil, err
+		}
+
+		// middleware keeping keys under a prefix truncates only the keys under it
+		prefix, _, err := s.beforePrefixWrite(session, command, "", "")
+		if err == nil {
+			err = s.checkPrefixWrite(session, prefix)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		if prefix == "" {
+			store.Truncate()
+		} else {
+			store.DeleteBy(prefix)
+		}
+		response := s.wire.EncodeAckResponse()
+		return net.Buffers{response}, nil
+	case wire.MEXISTS:
+		keys, err := s.wire.DecodeMExists(message)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range keys {
+			keys[i], err = s.beforeRead(session, command, keys[i])
+			if err != nil {
+				return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+			}
+		}
+
+		response := s.wire.EncodeMExistsResponse(store.PresentMulti(keys))
+		return net.Buffers{response}, nil
+	case wire.READMANY:
+		keys, err := s.wire.DecodeReadMany(message)
+		if err != nil {
+			return nil, err
+		}
+
+		// values are returned under the keys as requested, even when middleware reads them from other keys
+		values := make(map[string]string, len(keys))
+		for _, requested := range keys {
+			key, err := s.beforeRead(session, command, requested)
+			if err != nil {
+				return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+			}
+
+			value, present := store.Read(key)
+			if present {
+				values[requested] = value
+			}
+		}
+
+		return s.wire.EncodeReadManyResponseFrames(values, s.maxResponseFrame), nil
+	case wire.STATS:
+		response := s.wire.EncodeStatsResponse(s.stats())
+		return net.Buffers{response}, nil
+	case wire.INFO:
+		response := s.wire.EncodeInfoResponse(s.info())
+		return net.Buffers{response}, nil
+	case wire.CLIENTS:
+		err := s.wire.DecodeClients(message)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.checkAdmin(session, command)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeClientsResponse(s.connections.clients())
+		return net.Buffers{response}, nil
+	case wire.CLIENTKILL:
+		id, err := s.wire.DecodeClientKill(message)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.checkAdmin(session, command)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeClientKillResponse(s.connections.kill(id))
+		return net.Buffers{response}, nil
+	case wire.PING:
+		err := s.wire.DecodePing(message)
+		if err != nil {
+			return nil, err
+		}
+
+		response := s.wire.EncodeAckResponse()
+		return net.Buffers{response}, nil
+	case wire.HELLO:
+		version, err := s.wire.DecodeHello(message)
+		if err != nil {
+			return nil, err
+		}
+
+		session.protocolVersion = version
+		if version > wire.ProtocolVersion {
+			session.protocolVersion = wire.ProtocolVersion
+		}
+		response := s.wire.EncodeHelloResponse(wire.ProtocolVersion)
+		return net.Buffers{response}, nil
+	case wire.CAPABILITIES:
+		err := s.wire.DecodeCapabilities(message)
+		if err != nil {
+			return nil, err
+		}
+
+		response := s.wire.EncodeCapabilitiesResponse(s.capabilities())
+		return net.Buffers{response}, nil
+	case wire.COUNT:
+		err := s.wire.DecodeCount(message)
+		if err != nil {
+			return nil, err
+		}
+
+		response := s.wire.EncodeCountResponse(store.Count())
+		return net.Buffers{response}, nil
+	case wire.COUNTBY:
+		prefix, err := s.wire.DecodeCountBy(message)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, err = s.beforePrefixRead(session, command, prefix)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeCountByResponse(store.CountBy(prefix))
+		return net.Buffers{response}, nil
+	case wire.KEYSBY:
+		prefix, err := s.wire.DecodeKeysBy(message)
+		if err != nil {
+			return nil, err
+		}
+
+		stored, err := s.beforePrefixRead(session, command, prefix)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		keys := store.KeysBy(stored)
+		for i, key := range keys {
+			keys[i] = s.sentKey(key, prefix, stored)
+		}
+		return s.wire.EncodeKeysByResponseFrames(keys, s.maxResponseFrame), nil
+	case wire.KEYSMATCH:
+		pattern, err := s.wire.DecodeKeysMatching(message)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.wire.EncodeKeysMatchingResponseFrames(store.KeysMatching(pattern), s.maxResponseFrame), nil
+	case wire.READBY:
+		prefix, err := s.wire.DecodeReadBy(message)
+		if err != nil {
+			return nil, err
+		}
+
+		stored, err := s.beforePrefixRead(session, command, prefix)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		values := store.ReadBy(stored)
+		if stored != prefix {
+			found := values
+			values = make(map[string]string, len(found))
+			for key, value := range found {
+				values[s.sentKey(key, prefix, stored)] = value
+			}
+		}
+		return s.wire.EncodeReadByResponseFrames(values, s.maxResponseFrame), nil
+	case wire.DELETEBY:
+		prefix, err := s.wire.DecodeDeleteBy(message)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, _, err = s.beforePrefixWrite(session, command, prefix, "")
+		if err == nil {
+			err = s.checkPrefixWrite(session, prefix)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeDeleteByResponse(store.DeleteBy(prefix))
+		return net.Buffers{response}, nil
+	case wire.UPDATEBY:
+		prefix, value, err := s.wire.DecodeUpdateBy(message)
+		if err != nil {
+			return nil, err
+		}
+
+		stored, value, err := s.beforePrefixWrite(session, command, prefix, value)
+		if err == nil {
+			err = s.checkPrefixWrite(session, stored)
+		}
+		if err == nil {
+			err = keyError(store.CheckValue(value), stored)
+		}
+		if err == nil {
+			err = s.checkUpdateBy(session, store, prefix, stored, value)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeUpdateByResponse(store.UpdateBy(stored, value))
+		return net.Buffers{response}, nil
+	case wire.EXPIREBY:
+		prefix, expiration, err := s.wire.DecodeExpireBy(message)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, _, err = s.beforePrefixWrite(session, command, prefix, "")
+		if err == nil {
+			err = s.checkPrefixWrite(session, prefix)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeExpireByResponse(store.ExpireBy(prefix, expiration))
+		return net.Buffers{response}, nil
+	case wire.EXPHIST:
+		buckets, err := s.wire.DecodeExpirationHistogram(message)
+		if err != nil {
+			return nil, err
+		}
+
+		response := s.wire.EncodeExpirationHistogramResponse(store.ExpirationHistogram(buckets))
+		return net.Buffers{response}, nil
+	case wire.NEWEST, wire.OLDEST:
+		count, err := s.wire.DecodeWriteOrder(command, message)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+		if command == wire.NEWEST {
+			keys = store.NewestKeys(count)
+		} else {
+			keys = store.OldestKeys(count)
+		}
+
+		response := s.wire.EncodeWriteOrderResponse(command, keys)
+		return net.Buffers{response}, nil
+	case wire.COMPLETE:
+		partial, limit, err := s.wire.DecodeComplete(message)
+		if err != nil {
+			return nil, err
+		}
+
+		response := s.wire.EncodeCompleteResponse(store.CompleteKeyPrefix(partial, limit))
+		return net.Buffers{response}, nil
+	case wire.SCAN:
+		prefix, cursor, limit, err := s.wire.DecodeScan(message)
+		if err != nil {
+			return nil, err
+		}
+
+		stored, err := s.beforePrefixRead(session, command, prefix)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+		if cursor != "" {
+			cursor = s.storedKey(cursor, prefix, stored)
+		}
+
+		keys, next := store.Scan(stored, cursor, limit)
+		for i, key := range keys {
+			keys[i] = s.sentKey(key, prefix, stored)
+		}
+		if next != "" {
+			next = s.sentKey(next, prefix, stored)
+		}
+		response := s.wire.EncodeScanResponse(keys, next)
+		return net.Buffers{response}, nil
+	case wire.RENAME:
+		oldKey, newKey, overwrite, err := s.wire.DecodeRename(message)
+		if err != nil {
+			return nil, err
+		}
+
+		oldKey, _, err = s.beforeWrite(session, command, oldKey, "")
+		if err == nil {
+			newKey, _, err = s.beforeWrite(session, command, newKey, "")
+		}
+		if err == nil {
+			err = s.checkKeyWrite(session, oldKey)
+		}
+		if err == nil {
+			err = s.checkKeyWrite(session, newKey)
+		}
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		err = store.Rename(oldKey, newKey, overwrite)
+		if errors.Is(err, engine.ErrKeyExists) || errors.Is(err, engine.ErrKeyTooComplex) {
+			err = keyError(err, newKey)
+		} else {
+			err = keyError(err, oldKey)
+		}
+
+		response := s.wire.EncodeAckOrErrResponse(err)
+		return net.Buffers{response}, nil
+	case wire.EXPORT:
+		prefix, err := s.wire.DecodeExport(message)
+		if err != nil {
+			return nil, err
+		}
+
+		stored, err := s.beforePrefixRead(session, command, prefix)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		// export from a snapshot so the result reflects a single instant even while other connections write
+		snapshot := store.Snapshot()
+		defer snapshot.Release()
+
+		var exported []wire.ExportedKey
+		for _, key := range snapshot.KeysBy(stored) {
+			value, _ := snapshot.Read(key)
+			expiration, _ := snapshot.ReadExpiration(key)
+			exported = append(exported, wire.ExportedKey{Key: s.sentKey(key, prefix, stored), Value: value, Expiration: expiration})
+		}
+
+		response := s.wire.EncodeExportResponse(exported)
+		return net.Buffers{response}, nil
+	case wire.AUTH:
+		token, err := s.wire.DecodeAuth(message)
+		if err != nil {
+			return nil, err
+		}
+
+		response := s.wire.EncodeAckOrErrResponse(s.authenticate(session, token))
+		return net.Buffers{response}, nil
+	case wire.REPLICATE:
+		heartbeat, err := s.wire.DecodeReplicate(message)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.adminToken != "" {
+			err = s.checkAdmin(session, command)
+		}
+		if err == nil {
+			err = s.attachReplica(session, heartbeat)
+		}
+		response := s.wire.EncodeAckOrErrResponse(err)
+		return net.Buffers{response}, nil
+	case wire.MULTI:
+		commands, operations, err := s.decodeMulti(message)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.checkMulti(session, commands, operations)
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		results := store.ApplyBatch(operations)
+		response := s.multiResponse(commands, operations, results)
+		return net.Buffers{response}, nil
+	case wire.WATCH:
+		prefix, heartbeat, err := s.wire.DecodeWatch(message)
+		if err != nil {
+			return nil, err
+		}
+
+		s.startWatch(session, store, prefix, heartbeat)
+		response := s.wire.EncodeAckResponse()
+		return net.Buffers{response}, nil
+	case wire.SELECTDB:
+		name, err := s.wire.DecodeSelectDB(message)
+		if err != nil {
+			return nil, err
+		}
+
+		session.database = name
+		response := s.wire.EncodeAckResponse()
+		return net.Buffers{response}, nil
+	case wire.DROPDB:
+		name, err := s.wire.DecodeDropDB(message)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.checkPrefixWrite(session, "")
+		if err != nil {
+			return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+		}
+
+		response := s.wire.EncodeDropDBResponse(s.dropDatabase(name))
+		return net.Buffers{response}, nil
+	case wire.CONFIG:
+		action, name, value, err := s.wire.DecodeConfig(message)
+		if err != nil {
+			return nil, err
+		}
+
+		if action == wire.ConfigGet {
+			value, err := s.getConfig(session, name)
+			if err != nil {
+				return net.Buffers{s.wire.EncodeErrResponse(err)}, nil
+			}
+
+			response := s.wire.EncodeConfigResponse(value)
+			return net.Buffers{response}, nil
+		}
+
+		response := s.wire.EncodeAckOrErrResponse(s.setConfig(session, name, value))
+		return net.Buffers{response}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown command %q for message %b", command, message))
+	}
+}
+
+// warn wraps a successful response with warnings when the session negotiated a protocol version that understands WARN,
+// older clients get the response alone
+func (s *Server) warn(session *session, response []byte, warnings ...wire.Warning) []byte {
+	if session.protocolVersion < 2 {
+		return response
+	}
+
+	return s.wire.EncodeWarnResponse(response, warnings...)
+}
+
+func (s *Server) sendErrorResponse(writer *wire.FrameWriter, err error) {
+	writeErr := writer.WriteFrame(s.wire.EncodeErrResponse(err))
+	if writeErr != nil {
+		s.logger.Errorf("Error writing error response: %s", writeErr.Error())
+	}
+}
+
+func (t *connectionTracker) add(connection net.Conn) *connectionState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.accepted++
+	t.handlers.Add(1)
+
+	state := &connectionState{
+		id:            t.accepted,
+		remoteAddress: connection.RemoteAddr().String(),
+		connectedAt:   time.Now(),
+	}
+	t.open[connection] = state
+	return state
+}
+
+func (t *connectionTracker) remove(connection net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, open := t.open[connection]; open {
+		delete(t.open, connection)
+		t.handlers.Done()
+	}
+}
+
+// interruptReads wakes every connection waiting for its next request, which then sees the server draining and closes.
+// A connection running a command answers it first, since only reads are interrupted.
+func (t *connectionTracker) interruptReads() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for connection := range t.open {
+		connection.SetReadDeadline(time.Now())
+	}
+}
+
+// wait waits for every open connection to close, returning ErrStopTimeout if some are still open after timeout
+func (t *connectionTracker) wait(timeout time.Duration) error {
+	closed := make(chan struct{})
+	go func() {
+		t.handlers.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-time.After(timeout):
+		return ErrStopTimeout
+	}
+}
+
+func (t *connectionTracker) closeAll() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for connection := range t.open {
+		connection.Close()
+	}
 }
@@ -0,0 +1,602 @@
+package server
+
+import (
+	"bytes"
+	"datastore/engine"
+	"datastore/wire"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type commandOutcome struct {
+	name      string
+	command   wire.Command
+	arguments []string
+	// response is the expected response command, for ERR responses err is the typed error it must decode to
+	response wire.Command
+	err      error
+}
+
+func TestEveryCommandReportsItsOutcome(t *testing.T) {
+	server := New("localhost", 0)
+	protocol := wire.Protocol{}
+
+	future := protocol.EncodeTime(time.Now().Add(time.Hour))
+	tooDeep := strings.Repeat("a:", engine.DefaultMaxKeySegments) + "a"
+	multiInsert, _ := protocol.EncodeMessage(wire.INSERT, "multi", "1")
+
+	// run in order against one server, each step relies on the state left by the ones before it
+	outcomes := []commandOutcome{
+		{"read missing", wire.READ, []string{"a"}, wire.NULL, nil},
+		{"insert", wire.INSERT, []string{"a", "1"}, wire.ACK, nil},
+		{"insert existing", wire.INSERT, []string{"a", "1"}, wire.ERR, wire.ErrKeyExists},
+		{"insert too complex", wire.INSERT, []string{tooDeep, "1"}, wire.ERR, wire.ErrKeyTooComplex},
+		{"insert many", wire.INSERTMANY, []string{"a", "1", "many", "1"}, wire.INSERTMANY, nil},
+		{"insert many too complex", wire.INSERTMANY, []string{"other", "1", tooDeep, "1"}, wire.ERR, wire.ErrKeyTooComplex},
+		{"delete inserted many", wire.DELETE, []string{"many"}, wire.ACK, nil},
+		{"read", wire.READ, []string{"a"}, wire.READ, nil},
+		{"read many", wire.READMANY, []string{"a", "missing"}, wire.READMANY, nil},
+		{"update", wire.UPDATE, []string{"a", "2"}, wire.ACK, nil},
+		{"update missing", wire.UPDATE, []string{"b", "2"}, wire.ERR, wire.ErrKeyNotFound},
+		{"upsert new", wire.UPSERT, []string{"b", "2"}, wire.ACK, nil},
+		{"upsert identical", wire.UPSERT, []string{"b", "2"}, wire.NULL, nil},
+		{"upsert too complex", wire.UPSERT, []string{tooDeep, "2"}, wire.ERR, wire.ErrKeyTooComplex},
+		{"present", wire.PRESENT, []string{"b"}, wire.ACK, nil},
+		{"present missing", wire.PRESENT, []string{"c"}, wire.NULL, nil},
+		{"read expiration missing", wire.READEXPIRATION, []string{"a"}, wire.NULL, nil},
+		{"expire", wire.EXPIRE, []string{"a", future}, wire.ACK, nil},
+		{"expire if longer than no expiration", wire.EXPIRE, []string{"b", future, string(wire.ExpireIfLonger)}, wire.NULL, nil},
+		{"expire if shorter than no expiration", wire.EXPIRE, []string{"b", future, string(wire.ExpireIfShorter)}, wire.ACK, nil},
+		{"expire missing", wire.EXPIRE, []string{"c", future}, wire.ERR, wire.ErrKeyNotFound},
+		{"expire in", wire.EXPIREIN, []string{"b", protocol.EncodeDuration(time.Hour)}, wire.ACK, nil},
+		{"expire in missing", wire.EXPIREIN, []string{"c", protocol.EncodeDuration(time.Hour)}, wire.ERR, wire.ErrKeyNotFound},
+		{"incr missing", wire.INCR, []string{"counter", "2"}, wire.INCR, nil},
+		{"decr", wire.DECR, []string{"counter", "5"}, wire.DECR, nil},
+		{"decr overflowing", wire.DECR, []string{"counter", "9223372036854775807"}, wire.ERR, wire.ErrNotInteger},
+		{"incr too complex", wire.INCR, []string{tooDeep, "1"}, wire.ERR, wire.ErrKeyTooComplex},
+		{"read expiration", wire.READEXPIRATION, []string{"a"}, wire.READEXPIRATION, nil},
+		{"read stale", wire.READSTALE, []string{"a", protocol.EncodeDuration(time.Minute)}, wire.READSTALE, nil},
+		{"read stale missing", wire.READSTALE, []string{"missing", protocol.EncodeDuration(time.Minute)}, wire.NULL, nil},
+		{"read status", wire.READSTATUS, []string{"a"}, wire.READSTATUS, nil},
+		{"read status missing", wire.READSTATUS, []string{"missing"}, wire.READSTATUS, nil},
+		{"rename", wire.RENAME, []string{"a", "c", "false"}, wire.ACK, nil},
+		{"rename missing", wire.RENAME, []string{"a", "d", "false"}, wire.ERR, wire.ErrKeyNotFound},
+		{"rename onto existing", wire.RENAME, []string{"b", "c", "false"}, wire.ERR, wire.ErrKeyExists},
+		{"rename too complex", wire.RENAME, []string{"b", tooDeep, "false"}, wire.ERR, wire.ErrKeyTooComplex},
+		{"delete", wire.DELETE, []string{"c"}, wire.ACK, nil},
+		{"delete missing", wire.DELETE, []string{"c"}, wire.ERR, wire.ErrKeyNotFound},
+		{"cdelete mismatch", wire.CDELETE, []string{"b", "1"}, wire.CDELETE, nil},
+		{"cdelete missing", wire.CDELETE, []string{"c", "1"}, wire.NULL, nil},
+		{"cdelete", wire.CDELETE, []string{"b", "2"}, wire.ACK, nil},
+		{"insert the empty string", wire.INSERT, []string{"empty", ""}, wire.ACK, nil},
+		{"cdelete mismatch on the empty string", wire.CDELETE, []string{"empty", "1"}, wire.CDELETE, nil},
+		{"cdelete the empty string", wire.CDELETE, []string{"empty", ""}, wire.ACK, nil},
+		{"getupdate", wire.GETUPDATE, []string{"counter", "7"}, wire.GETUPDATE, nil},
+		{"getupdate missing", wire.GETUPDATE, []string{"c", "1"}, wire.NULL, nil},
+		{"getdel", wire.GETDEL, []string{"counter"}, wire.GETDEL, nil},
+		{"getdel missing", wire.GETDEL, []string{"counter"}, wire.NULL, nil},
+		{"get or set missing", wire.GETORSET, []string{"b", "3", protocol.EncodeDuration(time.Hour)}, wire.GETORSET, nil},
+		{"get or set existing", wire.GETORSET, []string{"b", "4"}, wire.GETORSET, nil},
+		{"get or set too complex", wire.GETORSET, []string{tooDeep, "4"}, wire.ERR, wire.ErrKeyTooComplex},
+		{"hset", wire.HSET, []string{"h", "f", "1"}, wire.ACK, nil},
+		{"hset existing field", wire.HSET, []string{"h", "f", "2"}, wire.NULL, nil},
+		{"hset on a string", wire.HSET, []string{"b", "f", "1"}, wire.ERR, wire.ErrWrongType},
+		{"hget", wire.HGET, []string{"h", "f"}, wire.HGET, nil},
+		{"hget missing field", wire.HGET, []string{"h", "g"}, wire.NULL, nil},
+		{"hget on a string", wire.HGET, []string{"b", "f"}, wire.ERR, wire.ErrWrongType},
+		{"hlen", wire.HLEN, []string{"h"}, wire.HLEN, nil},
+		{"hgetall", wire.HGETALL, []string{"h"}, wire.HGETALL, nil},
+		{"hgetall missing", wire.HGETALL, []string{"missing"}, wire.HGETALL, nil},
+		{"read a hash", wire.READ, []string{"h"}, wire.ERR, wire.ErrWrongType},
+		{"read status of a hash", wire.READSTATUS, []string{"h"}, wire.ERR, wire.ErrWrongType},
+		{"update a hash", wire.UPDATE, []string{"h", "1"}, wire.ERR, wire.ErrWrongType},
+		{"upsert a hash", wire.UPSERT, []string{"h", "1"}, wire.ERR, wire.ErrWrongType},
+		{"incr a hash", wire.INCR, []string{"h", "1"}, wire.ERR, wire.ErrWrongType},
+		{"getdel a hash", wire.GETDEL, []string{"h"}, wire.ERR, wire.ErrWrongType},
+		{"getupdate a hash", wire.GETUPDATE, []string{"h", "1"}, wire.ERR, wire.ErrWrongType},
+		{"hdel missing field", wire.HDEL, []string{"h", "g"}, wire.NULL, nil},
+		{"hdel", wire.HDEL, []string{"h", "f"}, wire.ACK, nil},
+		{"count", wire.COUNT, nil, wire.COUNT, nil},
+		{"count by", wire.COUNTBY, []string{"b"}, wire.COUNTBY, nil},
+		{"ping", wire.PING, nil, wire.ACK, nil},
+		{"hello", wire.HELLO, []string{"2"}, wire.HELLO, nil},
+		{"capabilities", wire.CAPABILITIES, nil, wire.CAPABILITIES, nil},
+		{"stats", wire.STATS, nil, wire.STATS, nil},
+		{"clients unauthorized", wire.CLIENTS, nil, wire.ERR, wire.ErrUnauthorized},
+		{"client kill unauthorized", wire.CLIENTKILL, []string{"1"}, wire.ERR, wire.ErrUnauthorized},
+		{"present multi", wire.MEXISTS, []string{"a", "b", "a"}, wire.MEXISTS, nil},
+		{"keys by", wire.KEYSBY, []string{""}, wire.KEYSBY, nil},
+		{"keys matching", wire.KEYSMATCH, []string{"*"}, wire.KEYSMATCH, nil},
+		{"read by", wire.READBY, []string{""}, wire.READBY, nil},
+		{"newest", wire.NEWEST, []string{"2"}, wire.NEWEST, nil},
+		{"oldest", wire.OLDEST, []string{"2"}, wire.OLDEST, nil},
+		{"scan", wire.SCAN, []string{"", "", "10"}, wire.SCAN, nil},
+		{"complete", wire.COMPLETE, []string{"", strconv.Itoa(0)}, wire.COMPLETE, nil},
+		{"update by", wire.UPDATEBY, []string{"", "1"}, wire.UPDATEBY, nil},
+		{"expire by", wire.EXPIREBY, []string{"", future}, wire.EXPIREBY, nil},
+		{"expiration histogram", wire.EXPHIST, []string{protocol.EncodeDuration(time.Hour)}, wire.EXPHIST, nil},
+		{"export", wire.EXPORT, []string{""}, wire.EXPORT, nil},
+		{"delete by", wire.DELETEBY, []string{""}, wire.DELETEBY, nil},
+		{"multi", wire.MULTI, []string{string(multiInsert)}, wire.MULTI, nil},
+		{"truncate", wire.TRUNCATE, nil, wire.ACK, nil},
+	}
+
+	for _, outcome := range outcomes {
+		request, err := protocol.EncodeMessage(outcome.command, outcome.arguments...)
+		if err != nil {
+			t.Fatalf("%s: error encoding request %q", outcome.name, err)
+		}
+
+		buffers, err := server.handleMessage(&session{}, request)
+		if err != nil {
+			t.Fatalf("%s: expected the request to be handled but got %q", outcome.name, err)
+		}
+		response := bytes.Join(buffers, nil)
+
+		responseCommand, err := protocol.DecipherCommand(response)
+		if err != nil || responseCommand != outcome.response {
+			t.Fatalf("%s: expected a %s response but got %s: %q", outcome.name, outcome.response, responseCommand, err)
+		}
+
+		if outcome.err != nil {
+			decodedErr := protocol.DecodeError(response)
+			if !errors.Is(decodedErr, outcome.err) {
+				t.Fatalf("%s: expected the response to carry %q but got %q", outcome.name, outcome.err, decodedErr)
+			}
+		}
+	}
+}
+
+func TestMalformedRequestsAreErrors(t *testing.T) {
+	server := New("localhost", 0)
+	protocol := wire.Protocol{}
+
+	request, _ := protocol.EncodeMessage(wire.RENAME, "a", "b", "sometimes")
+	_, err := server.handleMessage(&session{}, request)
+	if err == nil {
+		t.Fatalf("Expected a RENAME with an invalid overwrite flag to be rejected")
+	}
+
+	request, _ = protocol.EncodeMessage(wire.EXPIRE, "a", protocol.EncodeTime(time.Now()), "SOMETIMES")
+	_, err = server.handleMessage(&session{}, request)
+	if err == nil {
+		t.Fatalf("Expected an EXPIRE with an unknown mode to be rejected")
+	}
+
+	request, _ = protocol.EncodeMessage(wire.INSERT, "a")
+	_, err = server.handleMessage(&session{}, request)
+	if err == nil {
+		t.Fatalf("Expected an INSERT without a value to be rejected")
+	}
+
+	request, _ = protocol.EncodeMessage(wire.CLIENTKILL, "first")
+	_, err = server.handleMessage(&session{admin: true}, request)
+	if err == nil {
+		t.Fatalf("Expected a CLIENTKILL without a numeric ID to be rejected")
+	}
+}
+
+func TestClampedExpireWarnsOnlyAfterHello(t *testing.T) {
+	server := New("localhost", 0, WithTTLPolicy(engine.TTLRule{Prefix: "pii", MaxTTL: time.Hour}))
+	protocol := wire.Protocol{}
+	server.dataStore.Insert("pii:1", "abc123")
+	server.dataStore.Insert("public:1", "abc123")
+	tooLong := protocol.EncodeTime(time.Now().Add(time.Hour * 2))
+
+	// a session that never said HELLO speaks version 1 and only sees the ACK
+	legacy := &session{}
+	responseCommand, _ := send(t, &server, legacy, wire.EXPIRE, "pii:1", tooLong)
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected an ACK without warnings before HELLO but got %s", responseCommand)
+	}
+
+	current := &session{}
+	responseCommand, response := send(t, &server, current, wire.HELLO, "99")
+	version, err := protocol.DecodeHelloResponse(response)
+	if responseCommand != wire.HELLO || err != nil || version != wire.ProtocolVersion || current.protocolVersion != wire.ProtocolVersion {
+		t.Fatalf("Expected HELLO to settle on version %d but got %d: %q", wire.ProtocolVersion, version, err)
+	}
+
+	responseCommand, response = send(t, &server, current, wire.EXPIRE, "pii:1", tooLong)
+	if responseCommand != wire.WARN {
+		t.Fatalf("Expected a WARN response to a clamped EXPIRE but got %s", responseCommand)
+	}
+	inner, warnings, err := protocol.DecodeWarnings(response)
+	if err != nil || len(warnings) != 1 || warnings[0].Code != wire.TTLCLAMPED {
+		t.Fatalf("Expected a TTLCLAMPED warning but found %v: %q", warnings, err)
+	}
+	if innerCommand, _ := protocol.DecipherCommand(inner); innerCommand != wire.ACK {
+		t.Fatalf("Expected the warning to wrap an ACK but found %s", innerCommand)
+	}
+
+	responseCommand, _ = send(t, &server, current, wire.EXPIRE, "public:1", tooLong)
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected an EXPIRE within every rule to be a plain ACK but got %s", responseCommand)
+	}
+
+	// the time to live is counted on the server, so it is clamped the same way
+	responseCommand, response = send(t, &server, current, wire.EXPIREIN, "pii:1", protocol.EncodeDuration(time.Hour*2))
+	if _, warnings, err = protocol.DecodeWarnings(response); responseCommand != wire.WARN || err != nil || warnings[0].Code != wire.TTLCLAMPED {
+		t.Fatalf("Expected a TTLCLAMPED warning for a clamped EXPIREIN but got %s: %q", responseCommand, err)
+	}
+	responseCommand, _ = send(t, &server, current, wire.EXPIREIN, "pii:1", protocol.EncodeDuration(time.Minute))
+	if responseCommand != wire.ACK {
+		t.Fatalf("Expected an EXPIREIN within the rule to be a plain ACK but got %s", responseCommand)
+	}
+}
+
+func TestCapabilitiesFollowTheConfiguration(t *testing.T) {
+	protocol := wire.Protocol{}
+	capabilitiesOf := func(server *Server) wire.Capabilities {
+		// an unauthenticated session can ask, clients need the answer to decide whether to AUTH
+		responseCommand, response := send(t, server, &session{}, wire.CAPABILITIES)
+		capabilities, err := protocol.DecodeCapabilitiesResponse(response)
+		if responseCommand != wire.CAPABILITIES || err != nil {
+			t.Fatalf("Expected a CAPABILITIES response but got %s: %q", responseCommand, err)
+		}
+		return capabilities
+	}
+
+	openServer := New("localhost", 0)
+	open := capabilitiesOf(&openServer)
+	if open.ProtocolVersion != wire.ProtocolVersion || open.ServerVersion != Version {
+		t.Fatalf("Expected protocol version %d and server version %q but got %+v", wire.ProtocolVersion, Version, open)
+	}
+	for _, flag := range []wire.Capability{wire.CapabilityInlineTTL, wire.CapabilityHashes, wire.CapabilitySplitResponses, wire.CapabilityWarnings} {
+		if !open.Has(flag) {
+			t.Fatalf("Expected every server to have %q but found %v", flag, open.Flags)
+		}
+	}
+	if open.Has(wire.CapabilityAuth) || open.Has(wire.CapabilityProtectedPrefixes) {
+		t.Fatalf("Expected a server without a token or protected prefixes not to announce them but found %v", open.Flags)
+	}
+
+	protected := New("localhost", 0, WithAdminToken("secret"), WithProtectedPrefixes("system"))
+	if flags := capabilitiesOf(&protected); !flags.Has(wire.CapabilityAuth) || !flags.Has(wire.CapabilityProtectedPrefixes) {
+		t.Fatalf("Expected a server with a token and protected prefixes to announce them but found %v", flags.Flags)
+	}
+
+	// protected prefixes can change at runtime, the answer follows them
+	protected.SetProtectedPrefixes()
+	if flags := capabilitiesOf(&protected); !flags.Has(wire.CapabilityAuth) || flags.Has(wire.CapabilityProtectedPrefixes) {
+		t.Fatalf("Expected clearing the protected prefixes to stop announcing them but found %v", flags.Flags)
+	}
+}
+
+func TestInvalidFrameLengthsAreAnsweredWithAnError(t *testing.T) {
+	runningServer := New("localhost", 8911)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	connection, err := net.Dial("tcp", "localhost:8911")
+	if err != nil {
+		t.Fatalf("Error connecting to server %q", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second * 5))
+
+	// a declared length past the maximum must be refused before the server tries to allocate or read it
+	prefix := make([]byte, wire.LengthPrefixSize)
+	binary.LittleEndian.PutUint32(prefix, wire.MaxFrameSize+1)
+	_, err = connection.Write(prefix)
+	if err != nil {
+		t.Fatalf("Error writing request %q", err)
+	}
+
+	response, err := wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+	protocol := wire.Protocol{}
+	command, _ := protocol.DecipherCommand(response)
+	if err != nil || command != wire.ERR {
+		t.Fatalf("Expected an ERR response to an oversized frame but got %q: %q", command, err)
+	}
+}
+
+func TestRequestsAreBoundByTheMaximumMessageSize(t *testing.T) {
+	runningServer := New("localhost", 8956, WithMaxMessageSize(1024))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	protocol := wire.Protocol{}
+
+	// lengths past the maximum or too short to hold a command are refused without reading or allocating the rest
+	for _, declared := range []uint32{1025, 0xFFFFFFFF, 0, 3, 4} {
+		connection, err := net.Dial("tcp", "localhost:8956")
+		if err != nil {
+			t.Fatalf("Error connecting to server %q", err)
+		}
+		connection.SetDeadline(time.Now().Add(time.Second * 5))
+
+		prefix := make([]byte, wire.LengthPrefixSize)
+		binary.LittleEndian.PutUint32(prefix, declared)
+		connection.Write(prefix)
+
+		frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+		response, err := frames.ReadFrame()
+		command, _ := protocol.DecipherCommand(response)
+		if err != nil || command != wire.ERR {
+			t.Fatalf("Expected an ERR response to a declared length of %d but got %q: %q", declared, command, err)
+		}
+		if _, err = frames.ReadFrame(); err == nil {
+			t.Fatalf("Expected the connection to be closed after a declared length of %d", declared)
+		}
+		connection.Close()
+	}
+
+	// a request of exactly the maximum is served
+	request, _ := protocol.EncodeMessage(wire.INSERT, "key", "")
+	request, _ = protocol.EncodeMessage(wire.INSERT, "key", strings.Repeat("v", 1024-len(request)))
+	connection, err := net.Dial("tcp", "localhost:8956")
+	if err != nil {
+		t.Fatalf("Error connecting to server %q", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second * 5))
+	connection.Write(request)
+	response, err := wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+	if command, _ := protocol.DecipherCommand(response); err != nil || len(request) != 1024 || command != wire.ACK {
+		t.Fatalf("Expected a request of %d bytes to be inserted but got %q: %q", len(request), command, err)
+	}
+}
+
+func TestGarbageRequestsAreErrorsAndTheServerKeepsServing(t *testing.T) {
+	runningServer := New("localhost", 0, WithLogger(nil))
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+	address := net.JoinHostPort("localhost", strconv.Itoa(runningServer.Port()))
+	protocol := wire.Protocol{}
+
+	// garbage inside a well formed frame is answered and the connection carries on with the next request
+	connection := dial(t, address)
+	for _, garbage := range [][]byte{{0xff, 0xfe, 0x00, 0x01}, []byte("NOTACOMMAND"), {0x00}, bytes.Repeat([]byte{0x1f}, 64)} {
+		frame := make([]byte, wire.LengthPrefixSize, wire.LengthPrefixSize+len(garbage))
+		binary.LittleEndian.PutUint32(frame, uint32(wire.LengthPrefixSize+len(garbage)))
+		_, err = connection.Write(append(frame, garbage...))
+		if err != nil {
+			t.Fatalf("Error writing request %q", err)
+		}
+		response, err := wire.NewFrameReader(connection, wire.MaxFrameSize).ReadFrame()
+		if command, _ := protocol.DecipherCommand(response); err != nil || command != wire.ERR {
+			t.Fatalf("Expected an ERR response to the garbage %q but got %q: %q", garbage, command, err)
+		}
+
+		if command, err := roundTrip(t, connection, wire.UPSERT, "key", "1"); err != nil || command != wire.ACK && command != wire.NULL {
+			t.Fatalf("Expected a valid request after the garbage %q to be served but got %q: %q", garbage, command, err)
+		}
+	}
+
+	// a malformed length prefix closes its own connection and leaves the server serving every other
+	for _, prefix := range [][]byte{{0x00, 0x00, 0x00, 0x00}, {0xff, 0xff, 0xff, 0xff}, {0x02, 0x00}} {
+		malformed := dial(t, address)
+		malformed.Write(prefix)
+		if tcp, ok := malformed.(*net.TCPConn); ok && len(prefix) < wire.LengthPrefixSize {
+			// a prefix cut short only reaches the server as such once the client stops writing
+			tcp.CloseWrite()
+		}
+		frames := wire.NewFrameReader(malformed, wire.MaxFrameSize)
+		response, err := frames.ReadFrame()
+		command, _ := protocol.DecipherCommand(response)
+		if len(prefix) == wire.LengthPrefixSize && (err != nil || command != wire.ERR) {
+			t.Fatalf("Expected an ERR response to the length prefix %v but got %q: %q", prefix, command, err)
+		}
+		if _, err = frames.ReadFrame(); err == nil {
+			t.Fatalf("Expected the connection to be closed after the length prefix %v", prefix)
+		}
+
+		if command, err := roundTrip(t, connection, wire.READ, "key"); err != nil || command != wire.READ {
+			t.Fatalf("Expected the server to keep serving after the length prefix %v but got %q: %q", prefix, command, err)
+		}
+		if command, err := roundTrip(t, dial(t, address), wire.READ, "key"); err != nil || command != wire.READ {
+			t.Fatalf("Expected new connections to be served after the length prefix %v but got %q: %q", prefix, command, err)
+		}
+	}
+}
+
+// failingListener fails every Accept with err until it has failed times times, then reports being closed
+type failingListener struct {
+	net.Listener
+	err   error
+	times int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.times == 0 {
+		return nil, net.ErrClosed
+	}
+	l.times--
+	return nil, l.err
+}
+
+func TestFailedAcceptsAreLoggedAndRetriedUntilTheListenerCloses(t *testing.T) {
+	logger := &recordingLogger{}
+	server := New("localhost", 0, WithLogger(logger))
+	listener := &failingListener{err: errors.New("too many open files"), times: 3}
+
+	accepting := make(chan struct{})
+	go server.listenForConnections(listener, accepting)
+	select {
+	case <-accepting:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Expected the accept loop to return once the listener was closed")
+	}
+
+	failures := 0
+	for _, message := range logger.messages {
+		if strings.HasPrefix(message, "ERROR Error accepting a connection") && strings.HasSuffix(message, "too many open files") {
+			failures++
+		}
+	}
+	if failures != 3 {
+		t.Fatalf("Expected each of the 3 failed accepts to be logged but found %v", logger.messages)
+	}
+}
+
+func TestAcceptBackoffDoublesUpToItsMaximum(t *testing.T) {
+	backoff := time.Duration(0)
+	expected := []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000}
+	for _, milliseconds := range expected {
+		backoff = nextAcceptBackoff(backoff)
+		if backoff != time.Millisecond*milliseconds {
+			t.Fatalf("Expected a backoff of %dms but found %s", milliseconds, backoff)
+		}
+	}
+}
+
+func TestPipelinedRequestsAreHandledInArrivalOrder(t *testing.T) {
+	runningServer := New("localhost", 8920)
+	err := runningServer.Start()
+	if err != nil {
+		t.Fatalf("Error starting server %q", err)
+	}
+	defer runningServer.Stop()
+
+	protocol := wire.Protocol{}
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	// every INSERT and the EXPIRE after it go out in a single write, before any response is read
+	var requests []byte
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		insert, _ := protocol.EncodeMessage(wire.INSERT, key, "abc123")
+		expire, _ := protocol.EncodeMessage(wire.EXPIRE, key, protocol.EncodeTime(expiration))
+		requests = append(append(requests, insert...), expire...)
+	}
+
+	connection := dial(t, "localhost:8920")
+	go connection.Write(requests)
+
+	frames := wire.NewFrameReader(connection, wire.MaxFrameSize)
+	for i := 0; i < 4000; i++ {
+		response, err := frames.ReadFrame()
+		command, _ := protocol.DecipherCommand(response)
+		if err != nil || command != wire.ACK {
+			t.Fatalf("Expected response %d to be an ACK but got %s: %q", i, command, err)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		found, present := runningServer.dataStore.ReadExpiration(key)
+		if !present || !found.Equal(expiration) {
+			t.Fatalf("Expected %q to expire at %s but found %s", key, expiration, found)
+		}
+	}
+}
+
+func TestOversizedKeysByResponsesAreSplitIntoFrames(t *testing.T) {
+	protocol := wire.Protocol{}
+	request, _ := protocol.EncodeMessage(wire.KEYSBY, "user")
+	keys := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("user:%d", i))
+	}
+	single := len(protocol.EncodeKeysByResponse(keys))
+
+	for _, limit := range []int{single + 1, single, single - 1, single / 10} {
+		server := New("localhost", 0, WithMaxResponseFrame(limit))
+		for _, key := range keys {
+			server.dataStore.Insert(key, "1")
+		}
+
+		frames, err := server.handleMessage(&session{}, request)
+		if err != nil {
+			t.Fatalf("Expected KEYSBY to be handled but got %q", err)
+		}
+		if (len(frames) == 1) != (limit >= single) {
+			t.Fatalf("Expected a %d byte response to be split only when over the %d byte limit but got %d frames", single, limit, len(frames))
+		}
+
+		var continued []string
+		for i, frame := range frames {
+			command, _ := protocol.DecipherCommand(frame)
+			if len(frame) > limit || binary.LittleEndian.Uint32(frame) != uint32(len(frame)) {
+				t.Fatalf("Expected frame %d to declare its length within the %d byte limit but it has %d bytes", i, limit, len(frame))
+			}
+			if i == len(frames)-1 {
+				if command != wire.KEYSBY {
+					t.Fatalf("Expected the last frame to be a KEYSBY frame but got %s", command)
+				}
+				break
+			}
+
+			_, arguments, err := protocol.DecodeContinued(frame)
+			if command != wire.CONTINUED || err != nil {
+				t.Fatalf("Expected frame %d to be a CONTINUED frame but got %s: %q", i, command, err)
+			}
+			continued = append(continued, arguments...)
+		}
+
+		joined, err := protocol.JoinResponse(continued, frames[len(frames)-1])
+		found, decodeErr := protocol.DecodeKeysByResponse(joined)
+		expected := server.dataStore.KeysBy("user")
+		sort.Strings(found)
+		sort.Strings(expected)
+		if err != nil || decodeErr != nil || strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Expected the frames to join into the data store's keys but got %d keys: %q %q", len(found), err, decodeErr)
+		}
+	}
+}
+
+func TestKeySeparatorAppliesOverTheWire(t *testing.T) {
+	server := New("localhost", 0, WithKeySeparator("/"), WithProtectedPrefixes("etc"))
+	protocol := wire.Protocol{}
+	anonymous := &session{}
+
+	for _, key := range []string{"home/ada/notes", "home/ada/todo", "home:ada:mail", "etc:motd"} {
+		if responseCommand, _ := send(t, &server, anonymous, wire.INSERT, key, "1"); responseCommand != wire.ACK {
+			t.Fatalf("Expected %q to be inserted but got %s", key, responseCommand)
+		}
+	}
+
+	_, response := send(t, &server, anonymous, wire.KEYSBY, "home/ada")
+	keys, err := protocol.DecodeKeysByResponse(response)
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"home/ada/notes", "home/ada/todo"}) {
+		t.Fatalf("Expected KEYSBY to split keys on / but found %v: %q", keys, err)
+	}
+
+	responseCommand, response := send(t, &server, anonymous, wire.INSERT, "etc/passwd", "1")
+	assertError(t, wire.ErrProtected, responseCommand, response)
+}
+
+func TestEvictionKeepsEachDatabaseWithinItsMaximum(t *testing.T) {
+	server := New("localhost", 0, WithEviction(2, engine.EvictLeastRecentlyUsed))
+	protocol := wire.Protocol{}
+	connection := &session{}
+	named := &session{}
+	send(t, &server, named, wire.SELECTDB, "cache")
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		send(t, &server, connection, wire.READ, "a")
+		send(t, &server, connection, wire.INSERT, key, "1")
+		send(t, &server, named, wire.INSERT, key, "1")
+	}
+
+	if responseCommand, _ := send(t, &server, connection, wire.PRESENT, "a"); responseCommand != wire.ACK {
+		t.Fatalf("Expected the recently read key to survive eviction but got %s", responseCommand)
+	}
+	if server.dataStore.Count() != 2 || server.database("cache").Count() != 2 {
+		t.Fatalf("Expected both databases to hold 2 keys but found %d and %d", server.dataStore.Count(), server.database("cache").Count())
+	}
+
+	_, response := send(t, &server, connection, wire.STATS)
+	stats, _ := protocol.DecodeStatsResponse(response)
+	if stats["evicted"] != 2 {
+		t.Fatalf("Expected STATS to report 2 evicted keys but found %v", stats)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+// stats
+/**
+* Collect the statistics reported by STATS, keyed by the names clients see:
+*
+* - keys: the number of keys stored in the default database, counting expired keys that have not been cleaned up yet.
+*   The other statistics of the data store describe the default database too.
+* - databases: how many named databases exist, see SELECTDB
+* - default-ttl-applied: how many keys have been given the default TTL since the server started
+* - connections: the number of open connections, CLIENTS describes each of them
+* - parked-connections: how many of the open connections are parked, see WithConnectionParking
+* - active-connections: how many of the open connections have a goroutine serving them
+* - archived: how many expired keys have been archived, see WithExpirationArchive
+* - archive-dropped: how many expired keys could not be archived and were dropped
+* - value-bytes: the length of the values held in memory
+* - spilled-keys: how many values are kept in files, see WithSpillDirectory
+* - spilled-bytes: the length of the values kept in files
+* - clock-regressions: how many times the server's clock went backwards, see engine.Stats.ClockRegressions
+* - largest-clock-regression-ms: the furthest the server's clock went backwards in one jump, in milliseconds
+* - longest-lock-hold-ms: the longest a bulk command held up the others, in milliseconds, see WithMaxLockHold
+* - size-bytes: the length of every key and of the values held in memory, which WithWaterMarks compares with
+* - store-full-rejections: how many writes were refused with STOREFULL, see WithWaterMarks
+* - expired-removed: how many expired keys the cleanup has removed, see engine.Stats.ExpiredRemoved
+* - evicted: how many keys were evicted to keep the database within its maximum number of keys, see WithEviction
+* - connections-accepted: how many connections the server has accepted since it was created
+* - reads and writes: how many read and write commands have been answered, unknown commands count as writes
+* - errors: how many of those commands were answered with an ERR response
+* - bytes-read and bytes-written: the length of the requests and of the responses to them, as CLIENTS measures them
+* - command-<name> and command-<name>-errors: how many times each command, named in lower case, has been answered and
+*   answered with an ERR response, only for commands answered at least once
+ */
+func (s *Server) stats() map[string]int64 {
+	storeStats := s.dataStore.Stats()
+
+	s.connections.mutex.Lock()
+	connections := len(s.connections.open)
+	accepted := s.connections.accepted
+	s.connections.mutex.Unlock()
+	parked := s.poller.parkedCount()
+
+	stats := map[string]int64{
+		"keys":                        int64(storeStats.Keys),
+		"databases":                   int64(len(s.databaseNames())),
+		"default-ttl-applied":         int64(storeStats.DefaultTTLsApplied),
+		"connections":                 int64(connections),
+		"parked-connections":          int64(parked),
+		"active-connections":          int64(connections - parked),
+		"archived":                    int64(storeStats.Archived),
+		"archive-dropped":             int64(storeStats.ArchiveDropped),
+		"value-bytes":                 int64(storeStats.ValueBytes),
+		"spilled-keys":                int64(storeStats.SpilledKeys),
+		"spilled-bytes":               int64(storeStats.SpilledBytes),
+		"clock-regressions":           int64(storeStats.ClockRegressions),
+		"largest-clock-regression-ms": storeStats.LargestClockRegression.Milliseconds(),
+		"longest-lock-hold-ms":        storeStats.LongestLockHold.Milliseconds(),
+		"size-bytes":                  int64(storeStats.SizeBytes),
+		"store-full-rejections":       int64(storeStats.StoreFullRejections),
+		"expired-removed":             int64(storeStats.ExpiredRemoved),
+		"evicted":                     int64(storeStats.Evicted),
+		"connections-accepted":        accepted,
+	}
+	s.metrics.addTo(stats)
+	return stats
+}
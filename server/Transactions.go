@@ -0,0 +1,91 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+)
+
+// multiOperations maps the commands a MULTI may carry to the operations of the engine's batches
+var multiOperations = map[wire.Command]engine.ChangeOperation{
+	wire.INSERT: engine.ChangeInsert,
+	wire.UPDATE: engine.ChangeUpdate,
+	wire.UPSERT: engine.ChangeUpsert,
+	wire.DELETE: engine.ChangeDelete,
+	wire.EXPIRE: engine.ChangeExpire,
+}
+
+// decodeMulti
+/**
+* Decode every command a MULTI carries into the operation the engine applies for it, returning the commands alongside
+* the operations. A single command that cannot be decoded fails the whole MULTI, so nothing is applied.
+ */
+func (s *Server) decodeMulti(message []byte) ([]wire.Command, []engine.Operation, error) {
+	frames, err := s.wire.DecodeMulti(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commands := make([]wire.Command, len(frames))
+	operations := make([]engine.Operation, len(frames))
+	for i, frame := range frames {
+		commands[i], _ = s.wire.DecipherCommand(frame)
+		operation := engine.Operation{Kind: multiOperations[commands[i]]}
+		switch commands[i] {
+		case wire.INSERT:
+			operation.Key, operation.Value, err = s.wire.DecodeInsert(frame)
+		case wire.UPDATE:
+			operation.Key, operation.Value, err = s.wire.DecodeUpdate(frame)
+		case wire.UPSERT:
+			operation.Key, operation.Value, err = s.wire.DecodeUpsert(frame)
+		case wire.DELETE:
+			operation.Key, err = s.wire.DecodeDelete(frame)
+		case wire.EXPIRE:
+			var mode wire.ExpireMode
+			operation.Key, operation.Expiration, mode, err = s.wire.DecodeExpireWithMode(frame)
+			operation.Mode = expireModes[mode]
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		operations[i] = operation
+	}
+
+	return commands, operations, nil
+}
+
+// checkMulti runs the middleware and the protected prefixes on every operation of a MULTI before any is applied, so a
+// refused MULTI applies nothing. Middleware rewriting a key or value rewrites the operation.
+func (s *Server) checkMulti(session *session, commands []wire.Command, operations []engine.Operation) error {
+	for i := range operations {
+		operation := &operations[i]
+		var err error
+		operation.Key, operation.Value, err = s.beforeWrite(session, commands[i], operation.Key, operation.Value)
+		if err == nil {
+			err = s.checkKeyWrite(session, operation.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// multiResponse encodes the response each command of a MULTI would have had on its own from the results of the batch
+func (s *Server) multiResponse(commands []wire.Command, operations []engine.Operation, results []engine.Result) []byte {
+	responses := make([][]byte, len(results))
+	for i, result := range results {
+		switch {
+		case result.Err != nil:
+			responses[i] = s.wire.EncodeErrResponse(keyError(result.Err, operations[i].Key))
+		case commands[i] == wire.UPSERT:
+			responses[i] = s.wire.EncodeUpsertResponse(result.Applied)
+		case commands[i] == wire.EXPIRE:
+			responses[i] = s.wire.EncodeExpireResponse(result.Applied)
+		default:
+			responses[i] = s.wire.EncodeAckResponse()
+		}
+	}
+
+	return s.wire.EncodeMultiResponse(responses)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"datastore/wire"
+	"errors"
+	"testing"
+	"time"
+)
+
+// sendMulti sends a MULTI carrying commands and decodes the response of each, failing the test unless it was handled
+func sendMulti(t *testing.T, server *Server, session *session, commands ...[]byte) (wire.Command, []wire.Command) {
+	t.Helper()
+	protocol := wire.Protocol{}
+	arguments := make([]string, len(commands))
+	for i, command := range commands {
+		arguments[i] = string(command)
+	}
+	responseCommand, response := send(t, server, session, wire.MULTI, arguments...)
+	if responseCommand != wire.MULTI {
+		return responseCommand, nil
+	}
+
+	frames, err := protocol.DecodeMultiResponse(response, len(commands))
+	if err != nil {
+		t.Fatalf("Error decoding MULTI response %q", err)
+	}
+	answered := make([]wire.Command, len(frames))
+	for i, frame := range frames {
+		answered[i], _ = protocol.DecipherCommand(frame)
+	}
+	return responseCommand, answered
+}
+
+// encode encodes a request to carry in a MULTI
+func encode(command wire.Command, arguments ...string) []byte {
+	message, _ := (&wire.Protocol{}).EncodeMessage(command, arguments...)
+	return message
+}
+
+func TestMultiAnswersEachCommandAsIfSentAlone(t *testing.T) {
+	server := New("localhost", 0, WithLogger(nil))
+	protocol := wire.Protocol{}
+	future := protocol.EncodeTime(time.Now().Add(time.Hour))
+	server.dataStore.Insert("cart:1", "apple")
+
+	responseCommand, answered := sendMulti(t, &server, &session{},
+		encode(wire.DELETE, "cart:1"),
+		encode(wire.UPSERT, "order:1", "apple"),
+		encode(wire.UPSERT, "order:1", "apple"),
+		encode(wire.INSERT, "order:1", "pear"),
+		encode(wire.UPDATE, "cart:1", "pear"),
+		encode(wire.EXPIRE, "order:1", future),
+		encode(wire.EXPIRE, "order:1", future, string(wire.ExpireIfNone)),
+	)
+	expected := []wire.Command{wire.ACK, wire.ACK, wire.NULL, wire.ERR, wire.ERR, wire.ACK, wire.NULL}
+	if responseCommand != wire.MULTI || len(answered) != len(expected) {
+		t.Fatalf("Expected a MULTI response with %d responses but got %s %v", len(expected), responseCommand, answered)
+	}
+	for i := range expected {
+		if answered[i] != expected[i] {
+			t.Fatalf("Expected the responses %v but got %v", expected, answered)
+		}
+	}
+
+	if server.dataStore.Present("cart:1") || !server.dataStore.Present("order:1") {
+		t.Fatalf("Expected the cart to be moved to the order")
+	}
+}
+
+func TestMultiAppliesNothingWhenAnyCommandIsRefused(t *testing.T) {
+	server := New("localhost", 0, WithLogger(nil), WithProtectedPrefixes("system"))
+	defer server.Stop()
+	protocol := wire.Protocol{}
+	server.dataStore.Insert("cart:1", "apple")
+
+	undecodable := encode(wire.EXPIRE, "cart:1", "soon")
+	request, _ := protocol.EncodeMulti([][]byte{encode(wire.DELETE, "cart:1"), undecodable})
+	if _, err := server.handleMessage(&session{}, request); err == nil {
+		t.Fatalf("Expected a MULTI carrying an undecodable EXPIRE to fail")
+	}
+	request, _ = protocol.EncodeMulti([][]byte{encode(wire.DELETE, "cart:1"), encode(wire.READ, "cart:1")})
+	if _, err := server.handleMessage(&session{}, request); err == nil {
+		t.Fatalf("Expected a MULTI carrying a READ to fail")
+	}
+
+	responseCommand, response := send(t, &server, &session{}, wire.MULTI, string(encode(wire.DELETE, "cart:1")), string(encode(wire.INSERT, "system:1", "1")))
+	assertError(t, wire.ErrProtected, responseCommand, response)
+
+	if !server.dataStore.Present("cart:1") || server.dataStore.Present("system:1") {
+		t.Fatalf("Expected nothing to be applied by the refused MULTI commands")
+	}
+
+	refusing := New("localhost", 0, WithLogger(nil), WithMiddleware(MiddlewareFuncs{Write: func(ctx ConnContext, op wire.Command, key string, value string) (string, string, error) {
+		if op == wire.UPSERT {
+			return "", "", errors.New("no upserts")
+		}
+		return key, value, nil
+	}}))
+	defer refusing.Stop()
+	refusing.dataStore.Insert("cart:1", "apple")
+	responseCommand, _ = sendMulti(t, &refusing, &session{}, encode(wire.DELETE, "cart:1"), encode(wire.UPSERT, "order:1", "apple"))
+	if responseCommand != wire.ERR || !refusing.dataStore.Present("cart:1") {
+		t.Fatalf("Expected middleware refusing one command to refuse the whole MULTI but got %s", responseCommand)
+	}
+}
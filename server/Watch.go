@@ -0,0 +1,102 @@
+package server
+
+import (
+	"datastore/engine"
+	"datastore/wire"
+	"time"
+)
+
+// watch is the subscription of a connection that sent WATCH, streamed to it once the WATCH is answered
+type watch struct {
+	changes     <-chan engine.Change
+	unsubscribe func()
+	heartbeat   time.Duration
+}
+
+// startWatch
+/**
+* Subscribe the session to the changes under prefix in its database for WATCH. The subscription starts before WATCH is
+* answered, so every change made after the client reads the ACK is streamed to it. A heartbeat of zero or less sends a
+* PING frame every half of the idle timeout.
+ */
+func (s *Server) startWatch(session *session, store *engine.DataStore, prefix string, heartbeat time.Duration) {
+	if heartbeat <= 0 {
+		heartbeat = s.idleTimeout / 2
+	}
+
+	changes, unsubscribe := store.Subscribe(prefix)
+	session.watch = &watch{changes: changes, unsubscribe: unsubscribe, heartbeat: heartbeat}
+}
+
+// streamChanges
+/**
+* Write an EVENT frame for every change the connection's WATCH subscribed to, and a PING frame every heartbeat while
+* there are none so the client can tell a quiet server from a dead one, until the client closes the connection, a
+* write fails, or the server stops. Each frame must be written within the idle timeout, so a client that stopped
+* reading is disconnected rather than holding the connection open forever.
+*
+* The client sends nothing after WATCH, so the connection is read only to notice it being closed, and anything the
+* client does send ends the stream.
+ */
+func (s *Server) streamChanges(served *servedConnection, frames *wire.FrameReader, writer *wire.FrameWriter) {
+	connection := served.connection
+	watching := served.session.watch
+
+	// checked again after clearing the deadline, which would otherwise replace the one Stop interrupts reads with
+	err := connection.SetReadDeadline(time.Time{})
+	if err != nil || s.listening.draining.Load() {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		frames.ReadFrame()
+	}()
+
+	heartbeat := time.NewTicker(watching.heartbeat)
+	defer heartbeat.Stop()
+	ping, _ := s.wire.EncodeMessage(wire.PING)
+
+	for {
+		var frame []byte
+		select {
+		case change, open := <-watching.changes:
+			if !open {
+				return
+			}
+			frame = s.wire.EncodeEvent(wireChange(change))
+		case <-heartbeat.C:
+			if s.listening.draining.Load() {
+				return
+			}
+			frame = ping
+		case <-closed:
+			return
+		}
+
+		err = connection.SetWriteDeadline(time.Now().Add(s.idleTimeout))
+		if err != nil {
+			return
+		}
+		err = writer.WriteFrame(frame)
+		if err != nil {
+			s.logger.Debugf("Ending the watch of %s after a failed write: %s", served.session.remoteAddress, err.Error())
+			return
+		}
+	}
+}
+
+// wireChange converts a change of the engine to the one EVENT frames carry
+func wireChange(change engine.Change) wire.Change {
+	converted := wire.Change{
+		Sequence:  change.Sequence,
+		Operation: string(change.Operation),
+		Key:       change.Key,
+		Field:     change.Field,
+		Value:     change.Value,
+	}
+	if change.Operation == engine.ChangeExpire {
+		converted.Expiration = change.Expiration
+	}
+	return converted
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"datastore/wire"
+	"net"
+	"testing"
+	"time"
+)
+
+// readCommand reads the next frame from frames, failing the test unless it carries expected
+func readCommand(t *testing.T, frames *wire.FrameReader, expected wire.Command) []byte {
+	t.Helper()
+	protocol := wire.Protocol{}
+	message, err := frames.ReadFrame()
+	if err != nil {
+		t.Fatalf("Expected a %s frame but got %q", expected, err)
+	}
+	if command, _ := protocol.DecipherCommand(message); command != expected {
+		t.Fatalf("Expected a %s frame but got %s", expected, command)
+	}
+	return message
+}
+
+func TestWatchStreamsChangesAndHeartbeatsUntilTheServerStops(t *testing.T) {
+	server := New("localhost", 0, WithLogger(nil))
+	protocol := wire.Protocol{}
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	clientEnd.SetDeadline(time.Now().Add(time.Second * 5))
+
+	served := make(chan bool)
+	go func() {
+		defer close(served)
+		server.ServeConn(serverEnd)
+	}()
+
+	frames := wire.NewFrameReader(clientEnd, uint32(wire.DefaultMaxMessageSize))
+	selectDB, _ := protocol.EncodeMessage(wire.SELECTDB, "shop")
+	watch, _ := protocol.EncodeMessage(wire.WATCH, "orders", protocol.EncodeDuration(time.Millisecond*20))
+	clientEnd.Write(selectDB)
+	readCommand(t, frames, wire.ACK)
+	clientEnd.Write(watch)
+	readCommand(t, frames, wire.ACK)
+
+	server.dataStore.Insert("orders:1", "in the default database")
+	server.database("shop").Insert("customers:1", "ada")
+	server.database("shop").Insert("orders:1", "pending")
+	server.database("shop").Expire("orders:1", time.Now().Add(time.Hour))
+
+	change, err := protocol.DecodeEvent(readCommand(t, frames, wire.EVENT))
+	if err != nil || change.Operation != "insert" || change.Key != "orders:1" || change.Value != "pending" {
+		t.Fatalf("Expected the insert into the selected database but got %+v: %q", change, err)
+	}
+	change, err = protocol.DecodeEvent(readCommand(t, frames, wire.EVENT))
+	if err != nil || change.Operation != "expire" || change.Expiration.Before(time.Now()) {
+		t.Fatalf("Expected the expiration to be streamed but got %+v: %q", change, err)
+	}
+	readCommand(t, frames, wire.PING)
+
+	server.Stop()
+	select {
+	case <-served:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Expected stopping the server to end the watch")
+	}
+}
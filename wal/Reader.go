@@ -0,0 +1,251 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pollInterval is how long Next waits before looking for new records again once it has read everything in the log
+const pollInterval = time.Millisecond * 10
+
+// ErrClosed is returned by Next once the Reader has been closed
+var ErrClosed = errors.New("reader closed")
+
+// Reader
+/**
+* Follows the records of a log written by a Writer, from any sequence still in the log, across segment rotations and
+* into records appended while it reads
+*
+* A Reader is registered with the Writers of the same process from Open until Close, and retention keeps every segment
+* holding records it has yet to read. Next, Seek, and Close may not be called at the same time, except that Close may be
+* called from another goroutine to stop a Next that is waiting.
+ */
+type Reader struct {
+	dir string
+	// next is the sequence of the next record to return, read by Writers applying retention
+	next   uint64
+	closed chan bool
+	once   sync.Once
+	// reading is held by Next so Close can wait for it to stop before closing the segment
+	reading sync.Mutex
+
+	file     *os.File
+	path     string
+	first    uint64
+	buffered *bufio.Reader
+	// partial is the start of a record still being written at the end of the segment
+	partial []byte
+	// following is the first record of the segment after the open one once it exists, so the open one is complete
+	following uint64
+}
+
+// Open starts reading the log in dir from its oldest record
+func Open(dir string) (*Reader, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &Reader{dir: dir, next: 1, closed: make(chan bool)}
+	if len(segments) > 0 {
+		reader.next = segments[0].first
+	}
+	register(reader)
+
+	return reader, nil
+}
+
+func (r *Reader) position() uint64 {
+	return atomic.LoadUint64(&r.next)
+}
+
+// Seek
+/**
+* Have Next return the record with the sequence, or the first record after it when it is not in the log yet
+*
+* Returns a CompactedError when retention has deleted the record, leaving the position unchanged.
+ */
+func (r *Reader) Seek(sequence uint64) error {
+	segments, err := listSegments(r.dir)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 && sequence < segments[0].first {
+		return &CompactedError{Requested: sequence, Earliest: segments[0].first}
+	}
+
+	r.closeSegment()
+	atomic.StoreUint64(&r.next, sequence)
+	return nil
+}
+
+// Next
+/**
+* Return the next record, waiting for it to be written when the reader has reached the end of the log
+*
+* Returns ErrClosed once the reader is closed, and a CompactedError when the record was deleted by retention before the
+* reader got to it.
+ */
+func (r *Reader) Next() (Record, error) {
+	r.reading.Lock()
+	defer r.reading.Unlock()
+
+	for {
+		select {
+		case <-r.closed:
+			r.closeSegment()
+			return Record{}, ErrClosed
+		default:
+		}
+
+		if r.file == nil {
+			opened, err := r.openSegment()
+			if err != nil {
+				return Record{}, err
+			}
+			if !opened {
+				r.wait()
+				continue
+			}
+		}
+
+		line, err := r.readLine()
+		if err != nil {
+			return Record{}, err
+		}
+		if line != nil {
+			record, err := parseRecord(line)
+			if err != nil {
+				return Record{}, errors.New(fmt.Sprintf("malformed record in %s: %s", r.path, err.Error()))
+			}
+			if record.Sequence < r.position() {
+				continue
+			}
+
+			atomic.StoreUint64(&r.next, record.Sequence+1)
+			return record, nil
+		}
+
+		// the segment is complete once a later one exists, but the writer may have finished it after the read above so it
+		// is read once more before moving on
+		if r.following > 0 {
+			// a change the writer failed to append leaves a gap before the following segment
+			if r.following > r.position() {
+				atomic.StoreUint64(&r.next, r.following)
+			}
+			r.closeSegment()
+			continue
+		}
+		segments, err := listSegments(r.dir)
+		if err != nil {
+			return Record{}, err
+		}
+		for _, later := range segments {
+			if later.first > r.first {
+				r.following = later.first
+				break
+			}
+		}
+		if r.following > 0 {
+			continue
+		}
+
+		r.wait()
+	}
+}
+
+// openSegment opens the segment holding the next record, reporting false when the log has no segments yet
+func (r *Reader) openSegment() (bool, error) {
+	segments, err := listSegments(r.dir)
+	if err != nil || len(segments) == 0 {
+		return false, err
+	}
+
+	next := r.position()
+	if next < segments[0].first {
+		return false, &CompactedError{Requested: next, Earliest: segments[0].first}
+	}
+
+	holding := segments[0]
+	for _, candidate := range segments[1:] {
+		if candidate.first > next {
+			break
+		}
+		holding = candidate
+	}
+
+	file, err := os.Open(holding.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// deleted by retention since it was listed
+		return r.openSegment()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	r.file = file
+	r.path = holding.path
+	r.first = holding.first
+	r.buffered = bufio.NewReader(file)
+	return true, nil
+}
+
+// readLine returns the next complete line of the segment, or nil when the rest of it has not been written yet
+func (r *Reader) readLine() ([]byte, error) {
+	chunk, err := r.buffered.ReadBytes('\n')
+	r.partial = append(r.partial, chunk...)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	line := r.partial
+	r.partial = nil
+	return line, nil
+}
+
+func (r *Reader) closeSegment() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = nil
+	r.path = ""
+	r.first = 0
+	r.buffered = nil
+	r.partial = nil
+	r.following = 0
+}
+
+func (r *Reader) wait() {
+	select {
+	case <-r.closed:
+	case <-time.After(pollInterval):
+	}
+}
+
+// Close stops the reader, unblocking a waiting Next, and lets retention delete the segments it was holding on to
+func (r *Reader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		unregister(r)
+	})
+
+	r.reading.Lock()
+	defer r.reading.Unlock()
+	r.closeSegment()
+	return nil
+}
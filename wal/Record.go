@@ -0,0 +1,122 @@
+package wal
+
+import (
+	"bytes"
+	"datastore/engine"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record
+/**
+* One change read from the log, see engine.Change
+*
+* Each record is stored as one line of JSON in the form
+* {"sequence":12,"time":"...","operation":"upsert","key":"...","value":"..."}, with "expiration" added for expire
+* records and "field" for hset and hdel records. Times are RFC 3339 with nanoseconds. Fields may be added to records but never removed or renamed, so readers
+* should ignore fields they do not know.
+ */
+type Record struct {
+	Sequence   uint64                 `json:"sequence"`
+	Time       time.Time              `json:"time"`
+	Operation  engine.ChangeOperation `json:"operation"`
+	Key        string                 `json:"key"`
+	Field      string                 `json:"field,omitempty"`
+	Value      string                 `json:"value"`
+	Expiration *time.Time             `json:"expiration,omitempty"`
+}
+
+func newRecord(change engine.Change) Record {
+	record := Record{
+		Sequence:  change.Sequence,
+		Time:      change.Time,
+		Operation: change.Operation,
+		Key:       change.Key,
+		Field:     change.Field,
+		Value:     change.Value,
+	}
+	if !change.Expiration.IsZero() {
+		expiration := change.Expiration
+		record.Expiration = &expiration
+	}
+
+	return record
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%d %s %q", r.Sequence, r.Operation, r.Key)
+}
+
+// parseRecord decodes one line of a segment
+func parseRecord(line []byte) (Record, error) {
+	var record Record
+	err := json.Unmarshal(bytes.TrimSuffix(line, []byte{'\n'}), &record)
+	return record, err
+}
+
+// ErrCompacted matches every CompactedError with errors.Is
+var ErrCompacted = &CompactedError{}
+
+// CompactedError
+/**
+* Returned when a reader asks for records that retention has already deleted. Earliest is the sequence of the oldest
+* record still in the log, where the reader can Seek to carry on after reading what it missed from elsewhere.
+ */
+type CompactedError struct {
+	Requested uint64
+	Earliest  uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("record %d has been compacted, the earliest record available is %d", e.Requested, e.Earliest)
+}
+
+func (e *CompactedError) Is(target error) bool {
+	var compacted *CompactedError
+	return errors.As(target, &compacted)
+}
+
+// segmentSuffix ends the name of every segment file, which starts with the sequence of the segment's first record
+const segmentSuffix = ".wal"
+
+// segment is one file of the log, holding the records from first up to the first record of the next segment
+type segment struct {
+	first uint64
+	path  string
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
+
+// listSegments returns the segments in dir ordered by their first record, ignoring files that are not segments
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+
+	return segments, nil
+}
@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"datastore/engine"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openWriter(t *testing.T, dir string, options Options) *Writer {
+	t.Helper()
+	writer, err := OpenWriter(dir, options)
+	if err != nil {
+		t.Fatalf("Error opening writer %q", err)
+	}
+	t.Cleanup(func() { writer.Close() })
+	return writer
+}
+
+func openReader(t *testing.T, dir string) *Reader {
+	t.Helper()
+	reader, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Error opening reader %q", err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	return reader
+}
+
+func countSegments(t *testing.T, dir string) int {
+	t.Helper()
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("Error listing segments %q", err)
+	}
+	return len(segments)
+}
+
+func TestTailingReaderSeesEveryRecordOnceAcrossRotations(t *testing.T) {
+	previous := runtime.GOMAXPROCS(4)
+	t.Cleanup(func() { runtime.GOMAXPROCS(previous) })
+
+	dir := t.TempDir()
+	writer := openWriter(t, dir, Options{SegmentSize: 1024})
+	ds := engine.NewDataStoreWithOptions(engine.Options{ChangeFeed: writer})
+	reader := openReader(t, dir)
+
+	const writers, writes = 4, 500
+	var waitGroup sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		waitGroup.Add(1)
+		go func(key string) {
+			defer waitGroup.Done()
+			for version := 0; version < writes; version++ {
+				ds.Upsert(key, fmt.Sprint(version))
+			}
+		}(fmt.Sprintf("key%d", w))
+	}
+
+	lastVersion := map[string]int{}
+	for expected := uint64(1); expected <= writers*writes; expected++ {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Expected record %d but got %q", expected, err)
+		}
+		if record.Sequence != expected || record.Operation != engine.ChangeUpsert {
+			t.Fatalf("Expected record %d to follow on without gaps or repeats but found %s", expected, record)
+		}
+
+		version := 0
+		fmt.Sscan(record.Value, &version)
+		if previous, found := lastVersion[record.Key]; found && version != previous+1 {
+			t.Fatalf("Expected the records of %q in the order they were written but found %d after %d", record.Key, version, previous)
+		}
+		lastVersion[record.Key] = version
+	}
+	waitGroup.Wait()
+
+	if segments := countSegments(t, dir); segments < 10 {
+		t.Fatalf("Expected the writes to rotate through many segments but found %d", segments)
+	}
+
+	// a reader waiting at the end of the log returns once it is closed
+	stopped := make(chan error)
+	go func() {
+		_, err := reader.Next()
+		stopped <- err
+	}()
+	time.Sleep(pollInterval * 3)
+	reader.Close()
+	err := <-stopped
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected the waiting reader to stop once closed but got %q", err)
+	}
+}
+
+func TestRetentionKeepsWhatReadersNeedAndCompactsTheRest(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writer := openWriter(t, dir, Options{
+		SegmentSize: 1,
+		Retention:   time.Hour,
+		Clock:       func() time.Time { return now },
+	})
+
+	// a segment per record, the first reader still needs all of them
+	holding := openReader(t, dir)
+	for sequence := uint64(1); sequence <= 5; sequence++ {
+		writer.Append(engine.Change{Sequence: sequence, Operation: engine.ChangeInsert, Key: fmt.Sprint(sequence)})
+	}
+	record, _ := holding.Next()
+	now = now.Add(time.Hour * 2)
+	writer.Append(engine.Change{Sequence: 6, Operation: engine.ChangeInsert, Key: "6"})
+	if segments := countSegments(t, dir); segments != 5 {
+		t.Fatalf("Expected retention to keep the segments from %s on for the reader but found %d segments", record, segments)
+	}
+
+	holding.Close()
+	writer.Append(engine.Change{Sequence: 7, Operation: engine.ChangeInsert, Key: "7"})
+	if segments := countSegments(t, dir); segments != 1 {
+		t.Fatalf("Expected retention to delete every segment but the active one but found %d", segments)
+	}
+
+	reader := openReader(t, dir)
+	err := reader.Seek(3)
+	var compacted *CompactedError
+	if !errors.As(err, &compacted) || !errors.Is(err, ErrCompacted) || compacted.Requested != 3 || compacted.Earliest != 7 {
+		t.Fatalf("Expected seeking to a deleted record to report the earliest one left but got %q", err)
+	}
+
+	record, err = reader.Next()
+	if err != nil || record.Sequence != 7 {
+		t.Fatalf("Expected a new reader to start at the earliest record but got %s: %q", record, err)
+	}
+}
+
+func TestReopenedWriterContinuesTheSequence(t *testing.T) {
+	dir := t.TempDir()
+	writer := openWriter(t, dir, Options{})
+	ds := engine.NewDataStoreWithOptions(engine.Options{ChangeFeed: writer})
+	ds.Insert("a", "1")
+	ds.Insert("b", "2")
+	writer.Close()
+
+	// a crash part way through writing a record leaves the start of it behind
+	segments, _ := listSegments(dir)
+	file, _ := os.OpenFile(segments[0].path, os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString(`{"sequence":3,"opera`)
+	file.Close()
+
+	writer = openWriter(t, dir, Options{})
+	if writer.LastSequence() != 2 {
+		t.Fatalf("Expected the reopened log to end at the last complete record but found %d", writer.LastSequence())
+	}
+	restarted := engine.NewDataStoreWithOptions(engine.Options{ChangeFeed: writer})
+	restarted.Upsert("a", "3")
+
+	reader := openReader(t, dir)
+	var found []string
+	for len(found) < 3 {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Error reading the log %q", err)
+		}
+		found = append(found, fmt.Sprintf("%d %s=%s", record.Sequence, record.Key, record.Value))
+	}
+	if fmt.Sprint(found) != "[1 a=1 2 b=2 3 a=3]" || countSegments(t, dir) != 2 {
+		t.Fatalf("Expected the new data store's changes to carry on the sequence in a new segment but found %q", found)
+	}
+
+	err := writer.Append(engine.Change{Sequence: 3})
+	if err == nil {
+		t.Fatalf("Expected a change out of sequence to be refused")
+	}
+}
@@ -0,0 +1,291 @@
+package wal
+
+import (
+	"bufio"
+	"datastore/engine"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultSegmentSize = 64 << 20
+
+// Options configures a Writer, every field is optional
+type Options struct {
+	// SegmentSize starts a new segment once the active one holds this many bytes, defaults to 64MiB
+	SegmentSize int64
+	// SegmentAge starts a new segment once the active one has been open this long, zero only rotates by size
+	SegmentAge time.Duration
+	// Retention deletes segments whose last record was written this long ago, once no open Reader still needs them.
+	// Zero keeps every segment
+	Retention time.Duration
+	// Clock returns the current time used for rotation and retention, defaults to time.Now
+	Clock func() time.Time
+}
+
+// Writer
+/**
+* Appends the changes of a data store to a log of segment files in one directory, so other processes can follow them
+* with a Reader. A Writer is an engine.ChangeFeed, give it to the data store with engine.Options.ChangeFeed.
+*
+* Segments are named after the sequence of their first record and only the newest one is written to. A new segment is
+* started when the active one reaches Options.SegmentSize or Options.SegmentAge, checked as each change is appended, and
+* whenever a Writer is opened. Deleting old segments under Options.Retention is the log's only form of compaction: the
+* records left always run without gaps from the first record of the oldest segment, and a Reader asking for anything
+* before it gets a CompactedError.
+*
+* Only one Writer may write to a directory at a time. Retention only knows about the Readers opened in the same process.
+ */
+type Writer struct {
+	mutex   sync.Mutex
+	dir     string
+	options Options
+	last    uint64
+
+	active       *os.File
+	activeSize   int64
+	activeOpened time.Time
+}
+
+// OpenWriter
+/**
+* Open the log in dir for appending, creating the directory if needed. Changes already in the log are kept and
+* LastSequence reports the newest of them. A record cut short by a crash at the end of the newest segment is removed.
+ */
+func OpenWriter(dir string, options Options) (*Writer, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = defaultSegmentSize
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &Writer{dir: dir, options: options}
+	if len(segments) > 0 {
+		writer.last, err = repairSegment(segments[len(segments)-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return writer, nil
+}
+
+// repairSegment cuts a segment back to its last complete record and returns that record's sequence
+func repairSegment(last segment) (uint64, error) {
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	sequence := last.first - 1
+	complete := int64(0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		record, err := parseRecord(line)
+		if err != nil {
+			break
+		}
+		sequence = record.Sequence
+		complete += int64(len(line))
+	}
+
+	return sequence, file.Truncate(complete)
+}
+
+// LastSequence returns the sequence of the newest record in the log, zero when it is empty
+func (w *Writer) LastSequence() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.last
+}
+
+// Append
+/**
+* Write a change to the log, starting a new segment first when the active one is due to rotate
+*
+* Changes must be appended in sequence order. A change that fails to be written is removed from the segment again, and
+* the next change starts a new segment.
+ */
+func (w *Writer) Append(change engine.Change) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if change.Sequence <= w.last {
+		return errors.New(fmt.Sprintf("change %d is not after the last change in the log %d", change.Sequence, w.last))
+	}
+
+	line, err := json.Marshal(newRecord(change))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	now := w.options.Clock()
+	if w.active == nil || w.activeSize >= w.options.SegmentSize ||
+		(w.options.SegmentAge > 0 && now.Sub(w.activeOpened) >= w.options.SegmentAge) {
+		err = w.rotate(change.Sequence, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	written, err := w.active.Write(line)
+	if err != nil {
+		if written > 0 {
+			w.active.Truncate(w.activeSize)
+		}
+		w.active.Close()
+		w.active = nil
+		return err
+	}
+
+	w.activeSize += int64(written)
+	w.last = change.Sequence
+	return nil
+}
+
+// rotate closes the active segment and starts a new one whose first record is first, then applies retention
+func (w *Writer) rotate(first uint64, now time.Time) error {
+	err := w.closeActive()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(segmentPath(w.dir, first), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.active = file
+	w.activeSize = 0
+	w.activeOpened = now
+
+	return w.prune(now)
+}
+
+// prune deletes the oldest segments that are past retention and that no open reader still has records to read from
+func (w *Writer) prune(now time.Time) error {
+	if w.options.Retention <= 0 {
+		return nil
+	}
+
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	needed := oldestNeeded(w.dir)
+	// the newest segment is the active one and is never deleted
+	for i := 0; i < len(segments)-1; i++ {
+		if needed < segments[i+1].first {
+			return nil
+		}
+
+		info, err := os.Stat(segments[i].path)
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) < w.options.Retention {
+			return nil
+		}
+
+		err = os.Remove(segments[i].path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) closeActive() error {
+	if w.active == nil {
+		return nil
+	}
+
+	err := w.active.Sync()
+	closeErr := w.active.Close()
+	w.active = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Close syncs and closes the active segment, changes appended afterwards start a new one
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closeActive()
+}
+
+// openReaders are the Readers open in this process by directory, so retention keeps the segments they still need
+var openReaders = struct {
+	mutex sync.Mutex
+	byDir map[string]map[*Reader]bool
+}{byDir: map[string]map[*Reader]bool{}}
+
+// oldestNeeded returns the lowest sequence an open reader of dir will read next, or the highest sequence when there are
+// none
+func oldestNeeded(dir string) uint64 {
+	openReaders.mutex.Lock()
+	defer openReaders.mutex.Unlock()
+
+	needed := uint64(math.MaxUint64)
+	for reader := range openReaders.byDir[dir] {
+		if next := reader.position(); next < needed {
+			needed = next
+		}
+	}
+
+	return needed
+}
+
+func register(reader *Reader) {
+	openReaders.mutex.Lock()
+	defer openReaders.mutex.Unlock()
+
+	if openReaders.byDir[reader.dir] == nil {
+		openReaders.byDir[reader.dir] = map[*Reader]bool{}
+	}
+	openReaders.byDir[reader.dir][reader] = true
+}
+
+func unregister(reader *Reader) {
+	openReaders.mutex.Lock()
+	defer openReaders.mutex.Unlock()
+
+	delete(openReaders.byDir[reader.dir], reader)
+	if len(openReaders.byDir[reader.dir]) == 0 {
+		delete(openReaders.byDir, reader.dir)
+	}
+}
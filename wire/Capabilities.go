@@ -0,0 +1,139 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type Capability string
+
+const (
+	// CapabilityAuth is reported by servers with an admin token or a required token, so AUTH can succeed
+	CapabilityAuth Capability = "auth"
+	// CapabilityAuthRequired is reported by servers that refuse every command but AUTH, HELLO, PING, and CAPABILITIES
+	// until AUTH succeeds
+	CapabilityAuthRequired Capability = "auth-required"
+	// CapabilityProtectedPrefixes is reported by servers that refuse writes under some prefixes until AUTH
+	CapabilityProtectedPrefixes Capability = "protected-prefixes"
+	// CapabilityInlineTTL is reported by servers that take a TTL with GETORSET, setting the value and its expiration
+	// in one write
+	CapabilityInlineTTL Capability = "inline-ttl"
+	// CapabilityHashes is reported by servers with the HSET, HGET, HDEL, HGETALL, and HLEN commands
+	CapabilityHashes Capability = "hashes"
+	// CapabilitySplitResponses is reported by servers that split responses too large for one frame into CONTINUED
+	// frames
+	CapabilitySplitResponses Capability = "split-responses"
+	// CapabilityWatch is reported by servers with the WATCH command, streaming changes to keys as EVENT frames
+	CapabilityWatch Capability = "watch"
+	// CapabilityTransactions is reported by servers with the MULTI command, applying several writes with nothing in
+	// between
+	CapabilityTransactions Capability = "transactions"
+	// CapabilityReplication is reported by servers with the REPLICATE command, streaming their writes to replicas
+	CapabilityReplication Capability = "replication"
+	// CapabilityReadOnly is reported by replicas, which refuse writes with a READONLY error
+	CapabilityReadOnly Capability = "read-only"
+	// CapabilityWarnings is reported by servers that send WARN responses to clients announcing version 2 with HELLO
+	CapabilityWarnings Capability = "warnings"
+)
+
+// Capabilities
+/**
+* What a server told a client about itself in answer to CAPABILITIES, so the client can adapt to what it supports
+* rather than find out from errors
+ */
+type Capabilities struct {
+	ProtocolVersion int
+	// ServerVersion identifies the build of the server, for humans rather than for adapting to
+	ServerVersion string
+	Flags         []Capability
+}
+
+// Has reports whether the server announced the capability
+func (c Capabilities) Has(flag Capability) bool {
+	for _, announced := range c.Flags {
+		if announced == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// SpecCapabilities returns the capabilities that follow from the Commands table of this version of the protocol, a
+// server adds those that depend on its configuration
+func SpecCapabilities() []Capability {
+	var capabilities []Capability
+	if ProtocolVersion >= 2 {
+		capabilities = append(capabilities, CapabilityWarnings)
+	}
+	for _, command := range ResponseCommands {
+		if command == CONTINUED {
+			capabilities = append(capabilities, CapabilitySplitResponses)
+		}
+	}
+
+	for _, spec := range Commands {
+		switch spec.Command {
+		case GETORSET:
+			for _, argument := range spec.Arguments {
+				if argument.Name == "ttl" {
+					capabilities = append(capabilities, CapabilityInlineTTL)
+				}
+			}
+		case HSET:
+			capabilities = append(capabilities, CapabilityHashes)
+		case WATCH:
+			capabilities = append(capabilities, CapabilityWatch)
+		case MULTI:
+			capabilities = append(capabilities, CapabilityTransactions)
+		case REPLICATE:
+			capabilities = append(capabilities, CapabilityReplication)
+		}
+	}
+
+	return capabilities
+}
+
+func (p *Protocol) DecodeCapabilities(message []byte) error {
+	return p.decodeEmptyCommand(CAPABILITIES, message)
+}
+
+// EncodeCapabilitiesResponse encodes the protocol version and the server version followed by one argument per flag
+func (p *Protocol) EncodeCapabilitiesResponse(capabilities Capabilities) []byte {
+	arguments := make([]string, 0, 2+len(capabilities.Flags))
+	arguments = append(arguments, strconv.Itoa(capabilities.ProtocolVersion), capabilities.ServerVersion)
+	for _, flag := range capabilities.Flags {
+		arguments = append(arguments, string(flag))
+	}
+
+	message, err := p.EncodeMessage(CAPABILITIES, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeCapabilitiesResponse keeps flags it does not know, so a client can pass along what newer servers announce
+func (p *Protocol) DecodeCapabilitiesResponse(message []byte) (Capabilities, error) {
+	arguments, err := p.decodeCommand(CAPABILITIES, message)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	if len(arguments) < 2 {
+		return Capabilities{}, errors.New(fmt.Sprintf("expected at least 2 arguments for a CAPABILITIES response but found %d: %v", len(arguments), arguments))
+	}
+
+	version, err := strconv.Atoi(arguments[0])
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	capabilities := Capabilities{ProtocolVersion: version, ServerVersion: arguments[1], Flags: []Capability{}}
+	for _, flag := range arguments[2:] {
+		capabilities.Flags = append(capabilities.Flags, Capability(flag))
+	}
+
+	return capabilities, nil
+}
@@ -0,0 +1,83 @@
+package wire
+
+import "errors"
+
+// argumentOverhead is the separators and length that come before every argument of a frame
+const argumentOverhead = 1 + 4 + 1
+
+// EncodeSplitResponse
+/**
+* Encode a list response as one frame when it fits in maxFrameSize bytes, or split it across as many frames as it
+* takes. Every frame but the last is a CONTINUED frame carrying the command of the response as its first argument
+* followed by the next arguments of the response, and the last frame is the response command with the arguments left.
+*
+* Continuation is marked by the command of the frame rather than by an argument, so no argument of the response can be
+* mistaken for it. An argument too long to fit in a frame on its own is sent in a frame of its own anyway.
+ */
+func (p *Protocol) EncodeSplitResponse(command Command, maxFrameSize int, arguments []string) [][]byte {
+	size := LengthPrefixSize + 1 + len(command)
+	for _, argument := range arguments {
+		size += argumentOverhead + len(argument)
+	}
+	if size <= maxFrameSize {
+		return [][]byte{p.encodeListResponse(command, arguments)}
+	}
+
+	continuedSize := LengthPrefixSize + 1 + len(CONTINUED) + argumentOverhead + len(command)
+	var frames [][]byte
+	start := 0
+	size = continuedSize
+	for i, argument := range arguments {
+		argumentSize := argumentOverhead + len(argument)
+		if i > start && size+argumentSize > maxFrameSize {
+			frames = append(frames, p.encodeListResponse(CONTINUED, append([]string{string(command)}, arguments[start:i]...)))
+			start = i
+			size = continuedSize
+		}
+		size += argumentSize
+	}
+
+	return append(frames, p.encodeListResponse(command, arguments[start:]))
+}
+
+// DecodeContinued decodes the command a CONTINUED frame is part of and the arguments it carries
+func (p *Protocol) DecodeContinued(message []byte) (Command, []string, error) {
+	arguments, err := p.decodeCommand(CONTINUED, message)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(arguments) == 0 {
+		return "", nil, errors.New("expected the continued command for a CONTINUED response but found no arguments")
+	}
+
+	return Command(arguments[0]), arguments[1:], nil
+}
+
+// JoinResponse
+/**
+* Join the arguments of the CONTINUED frames of a split response with its last frame, returning the response as the one
+* message it would have been had it not been split
+ */
+func (p *Protocol) JoinResponse(continued []string, last []byte) ([]byte, error) {
+	command, err := p.DecipherCommand(last)
+	if err != nil {
+		return nil, err
+	}
+
+	arguments, err := p.decodeCommand(command, last)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.EncodeMessage(command, append(continued, arguments...)...)
+}
+
+func (p *Protocol) encodeListResponse(command Command, arguments []string) []byte {
+	message, err := p.EncodeMessage(command, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
@@ -0,0 +1,79 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+)
+
+type ErrorCode string
+
+const (
+	KEYEXISTS   ErrorCode = "KEYEXISTS"
+	KEYNOTFOUND ErrorCode = "KEYNOTFOUND"
+	// CONNECTIONRECYCLED is sent after the last response on a connection the server is about to close, any request
+	// that receives it instead of a response was not processed and can be retried on a new connection
+	CONNECTIONRECYCLED ErrorCode = "CONNECTIONRECYCLED"
+	UNAUTHORIZED       ErrorCode = "UNAUTHORIZED"
+	PROTECTED          ErrorCode = "PROTECTED"
+	UNKNOWNSETTING     ErrorCode = "UNKNOWNSETTING"
+	INVALIDSETTING     ErrorCode = "INVALIDSETTING"
+	TTLEXCEEDED        ErrorCode = "TTLEXCEEDED"
+	// REJECTED is sent when server middleware refused a command without giving a code of its own
+	REJECTED ErrorCode = "REJECTED"
+	// KEYTOOCOMPLEX is sent when a write would create a key with more segments, or longer segments, than the server allows
+	KEYTOOCOMPLEX ErrorCode = "KEYTOOCOMPLEX"
+	// WRONGTYPE is sent when a hash command names a key holding a string, or a string command one holding a hash
+	WRONGTYPE ErrorCode = "WRONGTYPE"
+	// STOREFULL is sent when a write would create a key while the server is over its high-water mark, writes to keys
+	// that are present, deletes, and reads still succeed
+	STOREFULL ErrorCode = "STOREFULL"
+	// NOTINTEGER is sent when INCR or DECR names a key whose value is not a 64-bit integer, or would not be one after
+	NOTINTEGER ErrorCode = "NOTINTEGER"
+	// VALUETOOLARGE is sent when a write carries a value longer than the server allows, the message names the limit
+	VALUETOOLARGE ErrorCode = "VALUETOOLARGE"
+	// READONLY is sent when a write reaches a replica, which only applies the writes its primary streams to it
+	READONLY ErrorCode = "READONLY"
+)
+
+// Error
+/**
+* A typed failure carried by an ERR response
+*
+* Errors compare equal with errors.Is when their codes match, so the package level sentinels can be used to branch on
+* an error decoded from a response regardless of its message.
+ */
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+var (
+	ErrKeyExists          = &Error{Code: KEYEXISTS, Message: "key already exists"}
+	ErrKeyNotFound        = &Error{Code: KEYNOTFOUND, Message: "key not found"}
+	ErrConnectionRecycled = &Error{Code: CONNECTIONRECYCLED, Message: "connection recycled by server"}
+	ErrUnauthorized       = &Error{Code: UNAUTHORIZED, Message: "unauthorized"}
+	ErrProtected          = &Error{Code: PROTECTED, Message: "key is under a protected prefix"}
+	ErrUnknownSetting     = &Error{Code: UNKNOWNSETTING, Message: "unknown setting"}
+	ErrInvalidSetting     = &Error{Code: INVALIDSETTING, Message: "invalid setting value"}
+	ErrTTLExceeded        = &Error{Code: TTLEXCEEDED, Message: "expiration exceeds the maximum TTL"}
+	ErrRejected           = &Error{Code: REJECTED, Message: "rejected by the server"}
+	ErrKeyTooComplex      = &Error{Code: KEYTOOCOMPLEX, Message: "key too complex"}
+	ErrWrongType          = &Error{Code: WRONGTYPE, Message: "key holds a value of the wrong type"}
+	ErrStoreFull          = &Error{Code: STOREFULL, Message: "data store is full"}
+	ErrNotInteger         = &Error{Code: NOTINTEGER, Message: "value is not a 64-bit integer"}
+	ErrValueTooLarge      = &Error{Code: VALUETOOLARGE, Message: "value too large"}
+	ErrReadOnly           = &Error{Code: READONLY, Message: "read-only replica"}
+)
+
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	var targetError *Error
+	return errors.As(target, &targetError) && targetError.Code == e.Code
+}
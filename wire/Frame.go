@@ -0,0 +1,155 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// MaxFrameSize is the largest frame, length prefix included, that clients and servers can be configured to accept
+const MaxFrameSize = 1 << 30
+
+// DefaultMaxMessageSize is the largest frame, length prefix included, that clients and servers accept unless configured
+// otherwise, so a corrupt or hostile length prefix cannot make them allocate much more than any real request needs
+const DefaultMaxMessageSize = 8 << 20
+
+// FrameSizeError
+/**
+* Returned by FrameReader.ReadFrame when a frame declares a length that is too short to hold a command or longer than
+* the reader's maximum. Nothing past the length prefix has been read, so the stream cannot be resynchronized.
+ */
+type FrameSizeError struct {
+	Size    uint32
+	MaxSize uint32
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("declared frame length %d is outside %d to %d bytes", e.Size, LengthPrefixSize+1, e.MaxSize)
+}
+
+// TruncatedFrameError
+/**
+* Returned by FrameReader.ReadFrame when the stream fails part way through a frame, after Read bytes of it arrived. Err
+* is io.ErrUnexpectedEOF when the stream ended, or the error of the underlying reader such as a deadline.
+ */
+type TruncatedFrameError struct {
+	Read int
+	Err  error
+}
+
+func (e *TruncatedFrameError) Error() string {
+	return fmt.Sprintf("frame truncated after %d bytes: %s", e.Read, e.Err.Error())
+}
+
+func (e *TruncatedFrameError) Unwrap() error {
+	return e.Err
+}
+
+// FrameReader
+/**
+* Reads length prefixed frames from a stream, however the stream happens to split them into reads
+ */
+type FrameReader struct {
+	reader  *bufio.Reader
+	maxSize uint32
+}
+
+// NewFrameReader buffers r and reads frames of at most maxSize bytes, length prefix included, from it
+func NewFrameReader(r io.Reader, maxSize uint32) *FrameReader {
+	return &FrameReader{reader: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// ReadFrame
+/**
+* Read the next whole frame, length prefix included
+*
+* Errors before any byte of the frame arrived are returned unchanged, so io.EOF means the stream closed cleanly between
+* frames. Errors part way through are a TruncatedFrameError, and lengths that cannot be valid are a FrameSizeError
+* found before the frame is allocated.
+ */
+func (r *FrameReader) ReadFrame() ([]byte, error) {
+	var prefix [LengthPrefixSize]byte
+	read, err := io.ReadFull(r.reader, prefix[:])
+	if err != nil {
+		return nil, truncated(read, err)
+	}
+
+	size := binary.LittleEndian.Uint32(prefix[:])
+	if size <= LengthPrefixSize || size > r.maxSize {
+		return nil, &FrameSizeError{Size: size, MaxSize: r.maxSize}
+	}
+
+	frame := make([]byte, size)
+	copy(frame, prefix[:])
+	read, err = io.ReadFull(r.reader, frame[LengthPrefixSize:])
+	if err != nil {
+		return nil, truncated(LengthPrefixSize+read, err)
+	}
+
+	return frame, nil
+}
+
+// Ready
+/**
+* Wait until the next frame has started to arrive without reading any of it, returning the stream's error if it fails
+* first. An error from Ready means no byte of the next frame has been read, so a deadline can pass without losing data.
+ */
+func (r *FrameReader) Ready() error {
+	_, err := r.reader.Peek(1)
+	return err
+}
+
+// Buffered returns the number of bytes already read from the stream that have not been returned in a frame yet
+func (r *FrameReader) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// truncated turns an error after read bytes of a frame into the error ReadFrame returns
+func truncated(read int, err error) error {
+	if read == 0 {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &TruncatedFrameError{Read: read, Err: err}
+}
+
+// FrameWriter
+/**
+* Writes whole frames to a stream, either fully or with an error
+ */
+type FrameWriter struct {
+	writer io.Writer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{writer: w}
+}
+
+// WriteFrame
+/**
+* Write the segments of one or more whole frames, such as a header and a large value, without copying them together.
+* Network connections write the segments with a single system call where they can.
+*
+* Returns io.ErrShortWrite if the stream accepted less than the whole frame without reporting an error.
+ */
+func (w *FrameWriter) WriteFrame(segments ...[]byte) error {
+	total := int64(0)
+	for _, segment := range segments {
+		total += int64(len(segment))
+	}
+
+	buffers := net.Buffers(segments)
+	written, err := buffers.WriteTo(w.writer)
+	if err != nil {
+		return err
+	}
+	if written != total {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
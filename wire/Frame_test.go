@@ -0,0 +1,105 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// oneByteReader delivers the stream a byte at a time, like a slow connection splitting frames across many reads
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(buffer []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+
+	buffer[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+// shortWriter accepts at most limit bytes per write without reporting an error, breaking the io.Writer contract
+type shortWriter struct {
+	limit int
+}
+
+func (w *shortWriter) Write(data []byte) (int, error) {
+	if len(data) > w.limit {
+		return w.limit, nil
+	}
+	return len(data), nil
+}
+
+func TestFrameReaderReadsFramesDeliveredAByteAtATime(t *testing.T) {
+	protocol := Protocol{}
+	first, _ := protocol.EncodeMessage(READ, "key1")
+	second, _ := protocol.EncodeMessage(INSERT, "key2", "abc123")
+
+	frames := NewFrameReader(&oneByteReader{data: append(append([]byte{}, first...), second...)}, MaxFrameSize)
+
+	for _, expected := range [][]byte{first, second} {
+		frame, err := frames.ReadFrame()
+		if err != nil || !bytes.Equal(frame, expected) {
+			t.Fatalf("Expected to read frame %q but got %q: %q", expected, frame, err)
+		}
+	}
+
+	_, err := frames.ReadFrame()
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF at the frame boundary but got %q", err)
+	}
+}
+
+func TestFrameReaderReportsTruncatedFrames(t *testing.T) {
+	protocol := Protocol{}
+	frame, _ := protocol.EncodeMessage(INSERT, "key1", "abc123")
+
+	for _, length := range []int{2, LengthPrefixSize, len(frame) - 1} {
+		frames := NewFrameReader(&oneByteReader{data: frame[:length]}, MaxFrameSize)
+
+		_, err := frames.ReadFrame()
+		var truncated *TruncatedFrameError
+		if !errors.As(err, &truncated) || truncated.Read != length || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Expected a truncation after %d bytes but got %q", length, err)
+		}
+	}
+}
+
+func TestFrameReaderRejectsInvalidLengthsBeforeAllocating(t *testing.T) {
+	for _, size := range []uint32{0, LengthPrefixSize, 1025, 1 << 31} {
+		prefix := make([]byte, LengthPrefixSize)
+		binary.LittleEndian.PutUint32(prefix, size)
+		frames := NewFrameReader(bytes.NewReader(prefix), 1024)
+
+		_, err := frames.ReadFrame()
+		var invalidSize *FrameSizeError
+		if !errors.As(err, &invalidSize) || invalidSize.Size != size || invalidSize.MaxSize != 1024 {
+			t.Fatalf("Expected a frame size error for a declared length of %d but got %q", size, err)
+		}
+	}
+}
+
+func TestFrameWriterWritesEverySegment(t *testing.T) {
+	protocol := Protocol{}
+	segments := protocol.EncodeReadResponseSegments("abc123", true)
+	expected := protocol.EncodeReadResponse("abc123", true)
+
+	var written bytes.Buffer
+	err := NewFrameWriter(&written).WriteFrame(segments...)
+	if err != nil || !bytes.Equal(written.Bytes(), expected) {
+		t.Fatalf("Expected to write %q but wrote %q: %q", expected, written.Bytes(), err)
+	}
+
+	err = NewFrameWriter(&shortWriter{limit: 3}).WriteFrame(expected)
+	if err != io.ErrShortWrite {
+		t.Fatalf("Expected io.ErrShortWrite from a writer that dropped bytes but got %q", err)
+	}
+}
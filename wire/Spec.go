@@ -0,0 +1,338 @@
+package wire
+
+import (
+	"encoding/json"
+)
+
+//go:generate go run ../cmd/wirespec -o spec.json
+
+// ProtocolVersion
+/**
+* Bumped whenever a change to the protocol would break an existing client or server
+*
+* Version 2 added WARN responses, which a server only sends on connections where the client announced version 2 or
+* later with HELLO. Connections that never send HELLO are answered as version 1.
+*
+* Version 3 encodes times in RFC 3339 with nanoseconds rather than as unix timestamps in milliseconds, on every
+* connection. Timestamps in milliseconds are still decoded, so requests from older clients and older append only logs
+* are understood, but older clients cannot decode the times in responses.
+ */
+const ProtocolVersion = 3
+
+// LengthPrefixSize is the number of bytes of the little endian message length at the start of every frame
+const LengthPrefixSize = 4
+
+type ArgumentKind string
+
+const (
+	// STRING arguments are opaque byte strings such as keys, prefixes, and values
+	STRING ArgumentKind = "string"
+	// TIMESTAMP arguments are RFC 3339 times in UTC with nanoseconds, unix timestamps in milliseconds encoded as decimal
+	// strings are accepted too
+	TIMESTAMP ArgumentKind = "timestamp"
+	// DURATION arguments are a number of milliseconds encoded as a decimal string
+	DURATION ArgumentKind = "duration_ms"
+	// INTEGER arguments are signed integers encoded as decimal strings
+	INTEGER ArgumentKind = "integer"
+	// BOOLEAN arguments are the strings "true" or "false"
+	BOOLEAN ArgumentKind = "boolean"
+	// BITMAP arguments hold one bit per item of the request, starting from the lowest bit of the first byte
+	BITMAP ArgumentKind = "bitmap"
+	// FRAME arguments are whole frames of other commands or responses, their length prefix included
+	FRAME ArgumentKind = "frame"
+)
+
+type ResponseShape string
+
+const (
+	// ACK_OR_NULL responses are an ACK frame on success or a NULL frame when nothing was done
+	ACK_OR_NULL ResponseShape = "ACK_OR_NULL"
+	// ACK_ONLY responses are always an ACK frame
+	ACK_ONLY ResponseShape = "ACK"
+	// SINGLE_OR_NULL responses are a frame with one argument, or a NULL frame when there is nothing to return
+	SINGLE_OR_NULL ResponseShape = "SINGLE_OR_NULL"
+	// SINGLE responses are a frame with exactly one argument, a count of nothing is the argument "0" and never NULL
+	SINGLE ResponseShape = "SINGLE"
+	// LIST responses are a frame with zero or more arguments, an empty result is the frame with no arguments and never
+	// NULL. NULL is reserved for a single key that is absent or a change that was not made
+	LIST ResponseShape = "LIST"
+	// LIST_OR_NULL responses are a frame with a fixed set of arguments, or a NULL frame when there is nothing to return
+	LIST_OR_NULL ResponseShape = "LIST_OR_NULL"
+	// ACK_NULL_OR_SINGLE responses are an ACK frame when the change was made, a NULL frame when there was nothing to
+	// change, or a frame with one argument explaining why the change was not made
+	ACK_NULL_OR_SINGLE ResponseShape = "ACK_NULL_OR_SINGLE"
+	// ACK_OR_SINGLE responses are an ACK frame or a frame with one argument, depending on what the request asked for
+	ACK_OR_SINGLE ResponseShape = "ACK_OR_SINGLE"
+)
+
+type ArgumentSpec struct {
+	Name string       `json:"name"`
+	Kind ArgumentKind `json:"kind"`
+	// Optional arguments may be left off the end of a request
+	Optional bool `json:"optional,omitempty"`
+}
+
+type ResponseSpec struct {
+	Shape ResponseShape `json:"shape"`
+	// Command is the command of the frame carrying a successful payload, ACK and NULL frames are described by Shape
+	Command Command      `json:"command,omitempty"`
+	Kind    ArgumentKind `json:"kind,omitempty"`
+}
+
+// CommandSpec
+/**
+* Describes a request command: the arguments it takes, the response it produces, and the typed errors it can fail with.
+* When Variadic is set the last argument may be repeated zero or more times. Write commands change what is stored or
+* how the server behaves and must be sent to the primary, every other command may be answered by a replica.
+ */
+type CommandSpec struct {
+	Command   Command        `json:"name"`
+	Arguments []ArgumentSpec `json:"arguments"`
+	Variadic  bool           `json:"variadic"`
+	Write     bool           `json:"write"`
+	Response  ResponseSpec   `json:"response"`
+	Errors    []ErrorCode    `json:"errors"`
+}
+
+type ErrorCodeSpec struct {
+	Code        ErrorCode `json:"code"`
+	Description string    `json:"description"`
+}
+
+type WarningCodeSpec struct {
+	Code        WarningCode `json:"code"`
+	Description string      `json:"description"`
+}
+
+var keyArgument = ArgumentSpec{Name: "key", Kind: STRING}
+var valueArgument = ArgumentSpec{Name: "value", Kind: STRING}
+var fieldArgument = ArgumentSpec{Name: "field", Kind: STRING}
+var prefixArgument = ArgumentSpec{Name: "prefix", Kind: STRING}
+var expirationArgument = ArgumentSpec{Name: "expiration", Kind: TIMESTAMP}
+
+// Commands is the table of every request command the protocol supports
+var Commands = []CommandSpec{
+	{Command: READ, Arguments: []ArgumentSpec{keyArgument}, Response: ResponseSpec{Shape: SINGLE_OR_NULL, Command: READ, Kind: STRING}, Errors: []ErrorCode{REJECTED, WRONGTYPE}},
+	{Command: READEXPIRATION, Arguments: []ArgumentSpec{keyArgument}, Response: ResponseSpec{Shape: SINGLE_OR_NULL, Command: READEXPIRATION, Kind: TIMESTAMP}, Errors: []ErrorCode{REJECTED}},
+	// READSTALE responses carry the value and whether it is stale, expired keys are returned within the stale window
+	{Command: READSTALE, Arguments: []ArgumentSpec{keyArgument, {Name: "staleWindow", Kind: DURATION}}, Response: ResponseSpec{Shape: LIST_OR_NULL, Command: READSTALE, Kind: STRING}, Errors: []ErrorCode{REJECTED, WRONGTYPE}},
+	// READSTATUS responses carry LIVE followed by the value, or EXPIRED or MISSING on their own
+	{Command: READSTATUS, Arguments: []ArgumentSpec{keyArgument}, Response: ResponseSpec{Shape: LIST, Command: READSTATUS, Kind: STRING}, Errors: []ErrorCode{REJECTED, WRONGTYPE}},
+	{Command: INSERT, Arguments: []ArgumentSpec{keyArgument, valueArgument}, Write: true, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{KEYEXISTS, PROTECTED, REJECTED, KEYTOOCOMPLEX, STOREFULL, VALUETOOLARGE}},
+	{Command: UPDATE, Arguments: []ArgumentSpec{keyArgument, valueArgument}, Write: true, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{KEYNOTFOUND, PROTECTED, REJECTED, WRONGTYPE, VALUETOOLARGE}},
+	{Command: UPSERT, Arguments: []ArgumentSpec{keyArgument, valueArgument}, Write: true, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{PROTECTED, REJECTED, KEYTOOCOMPLEX, WRONGTYPE, STOREFULL, VALUETOOLARGE}},
+	{Command: DELETE, Arguments: []ArgumentSpec{keyArgument}, Write: true, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{KEYNOTFOUND, PROTECTED, REJECTED}},
+	// CDELETE answers ACK when it deleted the key, NULL when the key was not present, and a CDELETE frame carrying the
+	// current value when it did not match
+	// GETDEL reads a key and deletes it in one step, so of several clients popping the same key only one receives it
+	{Command: GETDEL, Arguments: []ArgumentSpec{keyArgument}, Write: true, Response: ResponseSpec{Shape: SINGLE_OR_NULL, Command: GETDEL, Kind: STRING}, Errors: []ErrorCode{PROTECTED, REJECTED, WRONGTYPE}},
+	// GETUPDATE updates a key like UPDATE and answers with the value it replaced, or NULL when the key was not present
+	{Command: GETUPDATE, Arguments: []ArgumentSpec{keyArgument, valueArgument}, Write: true, Response: ResponseSpec{Shape: SINGLE_OR_NULL, Command: GETUPDATE, Kind: STRING}, Errors: []ErrorCode{PROTECTED, REJECTED, WRONGTYPE, VALUETOOLARGE}},
+	{Command: CDELETE, Arguments: []ArgumentSpec{keyArgument, {Name: "expectedValue", Kind: STRING}}, Write: true, Response: ResponseSpec{Shape: ACK_NULL_OR_SINGLE, Command: CDELETE, Kind: STRING}, Errors: []ErrorCode{PROTECTED, REJECTED, WRONGTYPE}},
+	// GETORSET responses carry the value the key holds and whether it existed, the default is only stored when it did not
+	{Command: GETORSET, Arguments: []ArgumentSpec{keyArgument, {Name: "defaultValue", Kind: STRING}, {Name: "ttl", Kind: DURATION, Optional: true}}, Write: true, Response: ResponseSpec{Shape: LIST, Command: GETORSET, Kind: STRING}, Errors: []ErrorCode{PROTECTED, REJECTED, KEYTOOCOMPLEX, WRONGTYPE, STOREFULL, VALUETOOLARGE}},
+	// HSET answers ACK when it created the field and NULL when it replaced the value of one
+	{Command: HSET, Arguments: []ArgumentSpec{keyArgument, fieldArgument, valueArgument}, Write: true, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{WRONGTYPE, PROTECTED, REJECTED, KEYTOOCOMPLEX, STOREFULL, VALUETOOLARGE}},
+	{Command: HGET, Arguments: []ArgumentSpec{keyArgument, fieldArgument}, Response: ResponseSpec{Shape: SINGLE_OR_NULL, Command: HGET, Kind: STRING}, Errors: []ErrorCode{WRONGTYPE, REJECTED}},
+	// HDEL answers NULL when the field was not present, deleting the last field of a hash deletes its key
+	{Command: HDEL, Arguments: []ArgumentSpec{keyArgument, fieldArgument}, Write: true, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{WRONGTYPE, PROTECTED, REJECTED}},
+	// HGETALL responses carry the name and the value of each field, sorted by name, and are split into CONTINUED frames
+	// followed by an HGETALL frame when too large for one frame
+	{Command: HGETALL, Arguments: []ArgumentSpec{keyArgument}, Response: ResponseSpec{Shape: LIST, Command: HGETALL, Kind: STRING}, Errors: []ErrorCode{WRONGTYPE, REJECTED}},
+	{Command: HLEN, Arguments: []ArgumentSpec{keyArgument}, Response: ResponseSpec{Shape: SINGLE, Command: HLEN, Kind: INTEGER}, Errors: []ErrorCode{WRONGTYPE, REJECTED}},
+	{Command: PRESENT, Arguments: []ArgumentSpec{keyArgument}, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{REJECTED}},
+	// EXPIRE answers NULL when a mode (NX, XX, GT, or LT) kept the current expiration
+	{Command: EXPIRE, Arguments: []ArgumentSpec{keyArgument, expirationArgument, {Name: "mode", Kind: STRING, Optional: true}}, Write: true, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{KEYNOTFOUND, PROTECTED, TTLEXCEEDED, REJECTED}},
+	// EXPIREIN expires a key ttl from now by the server's clock, a ttl of zero or less expires it straight away
+	{Command: EXPIREIN, Arguments: []ArgumentSpec{keyArgument, {Name: "ttl", Kind: DURATION}}, Write: true, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{KEYNOTFOUND, PROTECTED, TTLEXCEEDED, REJECTED}},
+	// INCR and DECR add to or subtract from the integer stored under a key, a key that is not present counts as zero
+	{Command: INCR, Arguments: []ArgumentSpec{keyArgument, {Name: "delta", Kind: INTEGER}}, Write: true, Response: ResponseSpec{Shape: SINGLE, Command: INCR, Kind: INTEGER}, Errors: []ErrorCode{NOTINTEGER, WRONGTYPE, PROTECTED, REJECTED, KEYTOOCOMPLEX, STOREFULL}},
+	{Command: DECR, Arguments: []ArgumentSpec{keyArgument, {Name: "delta", Kind: INTEGER}}, Write: true, Response: ResponseSpec{Shape: SINGLE, Command: DECR, Kind: INTEGER}, Errors: []ErrorCode{NOTINTEGER, WRONGTYPE, PROTECTED, REJECTED, KEYTOOCOMPLEX, STOREFULL}},
+	{Command: TRUNCATE, Write: true, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{PROTECTED, REJECTED}},
+	{Command: COUNT, Response: ResponseSpec{Shape: SINGLE, Command: COUNT, Kind: INTEGER}},
+	{Command: COUNTBY, Arguments: []ArgumentSpec{prefixArgument}, Response: ResponseSpec{Shape: SINGLE, Command: COUNTBY, Kind: INTEGER}, Errors: []ErrorCode{REJECTED}},
+	// KEYSBY responses too large for one frame are split into CONTINUED frames followed by a KEYSBY frame
+	{Command: KEYSBY, Arguments: []ArgumentSpec{prefixArgument}, Response: ResponseSpec{Shape: LIST, Command: KEYSBY, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	// KEYSMATCH responses carry the keys matching a glob pattern sorted, split like KEYSBY
+	{Command: KEYSMATCH, Arguments: []ArgumentSpec{{Name: "pattern", Kind: STRING}}, Response: ResponseSpec{Shape: LIST, Command: KEYSMATCH, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	{Command: DELETEBY, Arguments: []ArgumentSpec{prefixArgument}, Write: true, Response: ResponseSpec{Shape: SINGLE, Command: DELETEBY, Kind: INTEGER}, Errors: []ErrorCode{PROTECTED, REJECTED}},
+	{Command: UPDATEBY, Arguments: []ArgumentSpec{prefixArgument, valueArgument}, Write: true, Response: ResponseSpec{Shape: SINGLE, Command: UPDATEBY, Kind: INTEGER}, Errors: []ErrorCode{PROTECTED, REJECTED, VALUETOOLARGE}},
+	{Command: EXPIREBY, Arguments: []ArgumentSpec{prefixArgument, expirationArgument}, Write: true, Response: ResponseSpec{Shape: SINGLE, Command: EXPIREBY, Kind: INTEGER}, Errors: []ErrorCode{PROTECTED, REJECTED}},
+	{Command: EXPHIST, Arguments: []ArgumentSpec{{Name: "bucket", Kind: DURATION}}, Variadic: true, Response: ResponseSpec{Shape: LIST, Command: EXPHIST, Kind: INTEGER}},
+	// NEWEST and OLDEST list up to count keys by when their values were last written, starting from either end
+	{Command: NEWEST, Arguments: []ArgumentSpec{{Name: "count", Kind: INTEGER}}, Response: ResponseSpec{Shape: LIST, Command: NEWEST, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	{Command: OLDEST, Arguments: []ArgumentSpec{{Name: "count", Kind: INTEGER}}, Response: ResponseSpec{Shape: LIST, Command: OLDEST, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	{Command: COMPLETE, Arguments: []ArgumentSpec{{Name: "partial", Kind: STRING}, {Name: "limit", Kind: INTEGER}}, Response: ResponseSpec{Shape: LIST, Command: COMPLETE, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	// SCAN responses carry the cursor to pass to the next SCAN, empty once there are no more keys, followed by up to
+	// limit keys matching the prefix
+	{Command: SCAN, Arguments: []ArgumentSpec{prefixArgument, {Name: "cursor", Kind: STRING}, {Name: "limit", Kind: INTEGER}}, Response: ResponseSpec{Shape: LIST, Command: SCAN, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	{Command: RENAME, Arguments: []ArgumentSpec{{Name: "oldKey", Kind: STRING}, {Name: "newKey", Kind: STRING}, {Name: "overwrite", Kind: BOOLEAN}}, Write: true, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{KEYNOTFOUND, KEYEXISTS, PROTECTED, REJECTED, KEYTOOCOMPLEX}},
+	// READBY responses carry each key matching the prefix followed by its value, sorted by key, split like KEYSBY
+	{Command: READBY, Arguments: []ArgumentSpec{prefixArgument}, Response: ResponseSpec{Shape: LIST, Command: READBY, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	// EXPORT responses carry a key, its value, and its expiration timestamp (empty when it does not expire) per key
+	{Command: EXPORT, Arguments: []ArgumentSpec{prefixArgument}, Response: ResponseSpec{Shape: LIST, Command: EXPORT, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	{Command: AUTH, Arguments: []ArgumentSpec{{Name: "token", Kind: STRING}}, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{UNAUTHORIZED}},
+	// SELECTDB scopes every later command on the connection to the named database, created the first time it is used,
+	// and an empty name selects the default database
+	{Command: SELECTDB, Arguments: []ArgumentSpec{{Name: "name", Kind: STRING}}, Response: ResponseSpec{Shape: ACK_ONLY}},
+	// DROPDB removes a named database and every key in it, answering NULL when it does not exist. The default database
+	// cannot be removed and is emptied instead, like TRUNCATE.
+	{Command: DROPDB, Arguments: []ArgumentSpec{{Name: "name", Kind: STRING}}, Write: true, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{PROTECTED}},
+	// INSERTMANY arguments alternate keys and the values to insert them with, keys already present are skipped and the
+	// response carries how many were inserted
+	{Command: INSERTMANY, Arguments: []ArgumentSpec{{Name: "keyOrValue", Kind: STRING}}, Variadic: true, Write: true, Response: ResponseSpec{Shape: SINGLE, Command: INSERTMANY, Kind: INTEGER}, Errors: []ErrorCode{PROTECTED, REJECTED, KEYTOOCOMPLEX, VALUETOOLARGE}},
+	// READMANY responses carry each requested key that is present followed by its value, sorted by key
+	{Command: READMANY, Arguments: []ArgumentSpec{keyArgument}, Variadic: true, Response: ResponseSpec{Shape: LIST, Command: READMANY, Kind: STRING}, Errors: []ErrorCode{REJECTED}},
+	// MEXISTS answers with one bit per requested key, set when the key is present
+	{Command: MEXISTS, Arguments: []ArgumentSpec{keyArgument}, Variadic: true, Response: ResponseSpec{Shape: SINGLE, Command: MEXISTS, Kind: BITMAP}, Errors: []ErrorCode{REJECTED}},
+	// STATS responses carry one name=value argument per statistic, sorted by name, with integer values
+	{Command: STATS, Response: ResponseSpec{Shape: LIST, Command: STATS, Kind: STRING}},
+	// INFO responses carry one name=value argument per field describing the server, sorted by name. Values are strings,
+	// and clients should ignore fields they do not know, as later servers may add more
+	{Command: INFO, Response: ResponseSpec{Shape: LIST, Command: INFO, Kind: STRING}},
+	// CLIENTS responses carry one argument per open connection of space separated name=value fields, see ClientInfo
+	{Command: CLIENTS, Response: ResponseSpec{Shape: LIST, Command: CLIENTS, Kind: STRING}, Errors: []ErrorCode{UNAUTHORIZED}},
+	// CLIENTKILL answers NULL when no open connection has the ID
+	{Command: CLIENTKILL, Arguments: []ArgumentSpec{{Name: "id", Kind: INTEGER}}, Response: ResponseSpec{Shape: ACK_OR_NULL}, Errors: []ErrorCode{UNAUTHORIZED}},
+	// MULTI carries the frames of INSERT, UPDATE, UPSERT, DELETE, and EXPIRE commands that are applied in order with
+	// nothing in between, and answers with the response frame of each. A command that fails does not stop the rest,
+	// while a MULTI with a command that cannot be decoded, or that is refused before reaching the store, applies nothing
+	{Command: MULTI, Arguments: []ArgumentSpec{{Name: "command", Kind: FRAME}}, Variadic: true, Write: true, Response: ResponseSpec{Shape: LIST, Command: MULTI, Kind: FRAME}, Errors: []ErrorCode{PROTECTED, REJECTED}},
+	// REPLICATE is answered with ACK, then the connection carries the frames of commands rebuilding every database of
+	// the primary, followed by every write the primary applies from then on in the encoding it was sent in, preceded by
+	// a SELECTDB whenever its database differs from the one before, and a PING frame every heartbeat while there are
+	// none. A replica falling too far behind is disconnected. Servers with an admin token only answer admin sessions.
+	{Command: REPLICATE, Arguments: []ArgumentSpec{{Name: "heartbeat", Kind: DURATION, Optional: true}}, Response: ResponseSpec{Shape: ACK_ONLY}, Errors: []ErrorCode{UNAUTHORIZED}},
+	{Command: PING, Response: ResponseSpec{Shape: ACK_ONLY}},
+	// WATCH is answered with ACK, then the connection carries an EVENT frame for every change to the keys under the
+	// prefix in the selected database, and a PING frame every heartbeat while there are none, until the client closes
+	// it. The server picks the heartbeat when it is left off. Changes the connection falls too far behind on are dropped
+	{Command: WATCH, Arguments: []ArgumentSpec{prefixArgument, {Name: "heartbeat", Kind: DURATION, Optional: true}}, Response: ResponseSpec{Shape: ACK_ONLY}},
+	// HELLO announces the protocol version the client speaks and is answered with the version the server speaks, the
+	// connection uses the lower of the two from then on
+	{Command: HELLO, Arguments: []ArgumentSpec{{Name: "version", Kind: INTEGER}}, Response: ResponseSpec{Shape: SINGLE, Command: HELLO, Kind: INTEGER}},
+	// CAPABILITIES responses carry the protocol version, the server version, then one argument per capability the server
+	// has, see Capabilities. It is answered before AUTH so clients can find out whether to authenticate.
+	{Command: CAPABILITIES, Response: ResponseSpec{Shape: LIST, Command: CAPABILITIES, Kind: STRING}},
+	// CONFIG SET answers ACK, CONFIG GET answers a CONFIG frame carrying the value of the setting
+	{Command: CONFIG, Arguments: []ArgumentSpec{{Name: "action", Kind: STRING}, {Name: "name", Kind: STRING}, {Name: "value", Kind: STRING, Optional: true}}, Write: true, Response: ResponseSpec{Shape: ACK_OR_SINGLE, Command: CONFIG, Kind: STRING}, Errors: []ErrorCode{UNAUTHORIZED, UNKNOWNSETTING, INVALIDSETTING}},
+}
+
+// ResponseCommands are the commands that only appear in responses
+var ResponseCommands = []Command{ACK, NULL, ERR, WARN, CONTINUED, EVENT}
+
+// ErrorCodes describes every code an ERR response can carry
+var ErrorCodes = []ErrorCodeSpec{
+	{Code: KEYEXISTS, Description: "the key to insert is already present"},
+	{Code: KEYNOTFOUND, Description: "the key to modify is not present"},
+	{Code: CONNECTIONRECYCLED, Description: "sent after the last response on a connection the server is closing, a request answered with it was not processed and can be retried on a new connection"},
+	{Code: UNAUTHORIZED, Description: "the token is wrong, the command needs a session authenticated with AUTH, or the server requires AUTH before any command but AUTH, HELLO, PING, and CAPABILITIES"},
+	{Code: PROTECTED, Description: "the write targets a key under a protected prefix and the session is not authenticated as an admin"},
+	{Code: UNKNOWNSETTING, Description: "CONFIG named a setting the server does not have"},
+	{Code: INVALIDSETTING, Description: "CONFIG SET gave a value the setting cannot take"},
+	{Code: TTLEXCEEDED, Description: "the expiration is further away than the TTL rule for the key allows"},
+	{Code: REJECTED, Description: "middleware on the server refused the command, the message says why"},
+	{Code: KEYTOOCOMPLEX, Description: "the command would create a key with more segments, a longer segment, or more characters than the server's key limits allow"},
+	{Code: STOREFULL, Description: "the write would create a key while the server is over its high-water mark, writes to keys that are present, deletes, and reads still succeed"},
+	{Code: WRONGTYPE, Description: "a hash command named a key holding a string, or a string command named a key holding a hash"},
+	{Code: NOTINTEGER, Description: "INCR or DECR named a key whose value is not a 64-bit integer, or the result would not fit in one"},
+	{Code: VALUETOOLARGE, Description: "the value is longer than the server allows, the message names the limit"},
+	{Code: READONLY, Description: "the write was sent to a replica, which only applies the writes of its primary, send it to the primary instead"},
+}
+
+// WarningCodes describes every code a WARN response can carry
+var WarningCodes = []WarningCodeSpec{
+	{Code: TTLCLAMPED, Description: "EXPIRE or EXPIREIN set an earlier expiration than requested because the TTL rule for the key limits it"},
+}
+
+var knownCommands = func() map[Command]bool {
+	known := map[Command]bool{}
+	for _, spec := range Commands {
+		known[spec.Command] = true
+	}
+	for _, command := range ResponseCommands {
+		known[command] = true
+	}
+	return known
+}()
+
+var multiCommands = func() map[Command]bool {
+	carried := map[Command]bool{}
+	for _, command := range MultiCommands {
+		carried[command] = true
+	}
+	return carried
+}()
+
+var writeCommands = func() map[Command]bool {
+	writes := map[Command]bool{}
+	for _, spec := range Commands {
+		writes[spec.Command] = spec.Write
+	}
+	return writes
+}()
+
+// IsWrite
+/**
+* Report whether a request command must be sent to the primary, commands missing from the table count as writes
+ */
+func IsWrite(command Command) bool {
+	write, known := writeCommands[command]
+	return write || !known
+}
+
+type frameSpec struct {
+	LengthPrefixBytes    int    `json:"lengthPrefixBytes"`
+	ByteOrder            string `json:"byteOrder"`
+	Separator            byte   `json:"separator"`
+	LengthIncludesPrefix bool   `json:"lengthIncludesPrefix"`
+	Layout               string `json:"layout"`
+}
+
+type protocolSpec struct {
+	ProtocolVersion  int               `json:"protocolVersion"`
+	Frame            frameSpec         `json:"frame"`
+	Commands         []CommandSpec     `json:"commands"`
+	ResponseCommands []Command         `json:"responseCommands"`
+	ErrorCodes       []ErrorCodeSpec   `json:"errorCodes"`
+	WarningCodes     []WarningCodeSpec `json:"warningCodes"`
+}
+
+// SpecJSON
+/**
+* Render the protocol description as an indented JSON document for clients written in other languages
+ */
+func SpecJSON() ([]byte, error) {
+	spec := protocolSpec{
+		ProtocolVersion: ProtocolVersion,
+		Frame: frameSpec{
+			LengthPrefixBytes:    LengthPrefixSize,
+			ByteOrder:            "little-endian",
+			Separator:            messageSeparatorBinary,
+			LengthIncludesPrefix: true,
+			Layout:               "length | COMMAND (| argumentLength | argument)*",
+		},
+		Commands:         make([]CommandSpec, len(Commands)),
+		ResponseCommands: ResponseCommands,
+		ErrorCodes:       ErrorCodes,
+		WarningCodes:     WarningCodes,
+	}
+
+	// render missing arguments and errors as empty lists rather than null so generated code never has to check
+	for i, command := range Commands {
+		if command.Arguments == nil {
+			command.Arguments = []ArgumentSpec{}
+		}
+		if command.Errors == nil {
+			command.Errors = []ErrorCode{}
+		}
+		spec.Commands[i] = command
+	}
+
+	document, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(document, '\n'), nil
+}
@@ -0,0 +1,35 @@
+package wire
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestCommittedSpecIsUpToDate(t *testing.T) {
+	committed, err := os.ReadFile("spec.json")
+	if err != nil {
+		t.Fatalf("Could not read committed spec: %q", err)
+	}
+
+	generated, err := SpecJSON()
+	if err != nil {
+		t.Fatalf("Could not generate spec: %q", err)
+	}
+
+	if !bytes.Equal(committed, generated) {
+		t.Fatalf("spec.json is out of date with the command table, regenerate it with go generate ./wire")
+	}
+}
+
+func TestEverySpecCommandIsDecipherable(t *testing.T) {
+	protocol := Protocol{}
+
+	for _, spec := range Commands {
+		message, _ := protocol.EncodeMessage(spec.Command)
+		command, err := protocol.DecipherCommand(message)
+		if err != nil || command != spec.Command {
+			t.Fatalf("Expected to decipher command %q from the spec table but got %q: %q", spec.Command, command, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+)
+
+type WarningCode string
+
+const (
+	// TTLCLAMPED is sent with an EXPIRE or EXPIREIN that was applied with an earlier expiration than requested,
+	// because a TTL rule limits how long the key may live
+	TTLCLAMPED WarningCode = "TTLCLAMPED"
+)
+
+// Warning
+/**
+* Something a client should know about a request that nevertheless succeeded, carried by a WARN response
+ */
+type Warning struct {
+	Code    WarningCode
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Code, w.Message)
+}
+
+// EncodeWarnResponse
+/**
+* Wrap a successful response with warnings. The WARN frame carries the whole response frame as its first argument,
+* followed by a code and a message argument for each warning. Without warnings the response is returned unchanged.
+*
+* Only send WARN to clients that announced protocol version 2 or later with HELLO, older clients cannot decode it.
+ */
+func (p *Protocol) EncodeWarnResponse(response []byte, warnings ...Warning) []byte {
+	if len(warnings) == 0 {
+		return response
+	}
+
+	arguments := make([]string, 0, 1+len(warnings)*2)
+	arguments = append(arguments, string(response))
+	for _, warning := range warnings {
+		arguments = append(arguments, string(warning.Code), warning.Message)
+	}
+
+	message, err := p.EncodeMessage(WARN, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeWarnings
+/**
+* Unwrap a WARN response, returning the response frame it carries and its warnings. The response is decoded like any
+* other, the warnings do not change what it means.
+ */
+func (p *Protocol) DecodeWarnings(message []byte) ([]byte, []Warning, error) {
+	arguments, err := p.decodeCommand(WARN, message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(arguments) < 3 || len(arguments)%2 != 1 {
+		return nil, nil, errors.New(fmt.Sprintf("expected a response followed by warning codes and messages for a WARN response but found %d arguments: %v", len(arguments), arguments))
+	}
+
+	warnings := make([]Warning, 0, len(arguments)/2)
+	for i := 1; i < len(arguments); i += 2 {
+		warnings = append(warnings, Warning{Code: WarningCode(arguments[i]), Message: arguments[i+1]})
+	}
+
+	return []byte(arguments[0]), warnings, nil
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -27,10 +30,58 @@ const (
 	KEYSBY         Command = "KEYSBY"
 	DELETEBY       Command = "DELETEBY"
 	EXPIREBY       Command = "EXPIREBY"
+	EXPHIST        Command = "EXPHIST"
+	COMPLETE       Command = "COMPLETE"
+	RENAME         Command = "RENAME"
+	AUTH           Command = "AUTH"
+	CONFIG         Command = "CONFIG"
+	EXPORT         Command = "EXPORT"
+	PING           Command = "PING"
+	MEXISTS        Command = "MEXISTS"
+	READSTALE      Command = "READSTALE"
+	READSTATUS     Command = "READSTATUS"
+	NEWEST         Command = "NEWEST"
+	OLDEST         Command = "OLDEST"
+	STATS          Command = "STATS"
+	CDELETE        Command = "CDELETE"
+	CLIENTS        Command = "CLIENTS"
+	CLIENTKILL     Command = "CLIENTKILL"
+	HELLO          Command = "HELLO"
+	GETORSET       Command = "GETORSET"
+	HSET           Command = "HSET"
+	HGET           Command = "HGET"
+	HDEL           Command = "HDEL"
+	HGETALL        Command = "HGETALL"
+	HLEN           Command = "HLEN"
+	CAPABILITIES   Command = "CAPABILITIES"
+	INSERTMANY     Command = "INSERTMANY"
+	READMANY       Command = "READMANY"
+	EXPIREIN       Command = "EXPIREIN"
+	INCR           Command = "INCR"
+	DECR           Command = "DECR"
+	GETDEL         Command = "GETDEL"
+	GETUPDATE      Command = "GETUPDATE"
+	READBY         Command = "READBY"
+	UPDATEBY       Command = "UPDATEBY"
+	COUNTBY        Command = "COUNTBY"
+	SCAN           Command = "SCAN"
+	KEYSMATCH      Command = "KEYSMATCH"
+	SELECTDB       Command = "SELECTDB"
+	DROPDB         Command = "DROPDB"
+	WATCH          Command = "WATCH"
+	MULTI          Command = "MULTI"
+	REPLICATE      Command = "REPLICATE"
+	INFO           Command = "INFO"
 
 	ACK  Command = "ACK"
 	NULL Command = "NULL"
 	ERR  Command = "ERR"
+	// WARN wraps a successful response with warnings, see EncodeWarnResponse
+	WARN Command = "WARN"
+	// CONTINUED carries part of a response too large for one frame, see EncodeSplitResponse
+	CONTINUED Command = "CONTINUED"
+	// EVENT carries a change to a key to a connection that sent WATCH, see EncodeEvent
+	EVENT Command = "EVENT"
 )
 
 const messageSeparatorBinary = byte(0x7C)
@@ -39,7 +90,8 @@ func (p *Protocol) DecipherCommand(request []byte) (Command, error) {
 	var commandBytes []byte
 
 	// the first 4 bytes are the message size, and the 5th byte is a separator
-	// the command is every byte starting at the 6th byte until you hit another separator
+	// the command is every byte starting at the 6th byte until you hit another separator, no command holds one so the
+	// first separator is always the one before the arguments whatever bytes they hold
 	for i := 5; i < len(request); i++ {
 		currentByte := request[i]
 
@@ -52,14 +104,36 @@ func (p *Protocol) DecipherCommand(request []byte) (Command, error) {
 
 	parsedCommand := Command(commandBytes)
 
-	switch parsedCommand {
-	case READ, READEXPIRATION, INSERT, UPDATE, UPSERT, DELETE, PRESENT, EXPIRE, TRUNCATE, COUNT, KEYSBY, DELETEBY, EXPIREBY, ACK, NULL, ERR:
-		return parsedCommand, nil
-	default:
+	if !knownCommands[parsedCommand] {
 		return "", errors.New(fmt.Sprintf("%s is not a valid command", parsedCommand))
 	}
+
+	return parsedCommand, nil
+}
+
+// DecodeFrame decodes the command and arguments of any frame, for code that passes frames along without handling the
+// commands they carry
+func (p *Protocol) DecodeFrame(message []byte) (Command, []string, error) {
+	command, err := p.DecipherCommand(message)
+	if err != nil {
+		return "", nil, err
+	}
+
+	arguments, err := p.decodeCommand(command, message)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return command, arguments, nil
 }
 
+// EncodeMessage
+/**
+* Encode a frame carrying command and its arguments
+*
+* Arguments are opaque bytes prefixed with their exact length, Go strings being used only to carry them. They may hold
+* any bytes, NUL bytes, the separator, and invalid UTF-8 included, and are decoded back byte for byte.
+ */
 func (p *Protocol) EncodeMessage(command Command, params ...string) ([]byte, error) {
 	var message []byte
 
@@ -96,14 +170,28 @@ func (p *Protocol) DecodeError(message []byte) error {
 		return err
 	}
 
-	if len(arguments) != 1 {
-		return errors.New(fmt.Sprintf("expected 1 argument for an err command but found %d: %v", len(arguments), arguments))
+	switch len(arguments) {
+	case 1:
+		return errors.New(arguments[0])
+	case 2:
+		return &Error{Code: ErrorCode(arguments[0]), Message: arguments[1]}
+	default:
+		return errors.New(fmt.Sprintf("expected 1 or 2 arguments for an err command but found %d: %v", len(arguments), arguments))
 	}
-
-	return errors.New(arguments[0])
 }
 
+// EncodeErrResponse
+// Typed errors are encoded with their code as the first argument followed by the message, any other error is encoded
+// as just its message
 func (p *Protocol) EncodeErrResponse(err error) []byte {
+	var typedErr *Error
+	if errors.As(err, &typedErr) {
+		message, encodeErr := p.EncodeMessage(ERR, string(typedErr.Code), typedErr.Message)
+		if encodeErr == nil {
+			return message
+		}
+	}
+
 	var message []byte
 
 	message = append(message, []byte(ERR)...)
@@ -124,6 +212,15 @@ func (p *Protocol) EncodeErrResponse(err error) []byte {
 	return message
 }
 
+// EncodeAckOrErrResponse encodes an ACK response when err is nil and an ERR response for err otherwise
+func (p *Protocol) EncodeAckOrErrResponse(err error) []byte {
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return p.EncodeAckResponse()
+}
+
 func (p *Protocol) EncodeNullResponse() []byte {
 	// 0009|NULL
 	return []byte{0x9, 0x0, 0x0, 0x0, messageSeparatorBinary, 0x4E, 0x55, 0x4C, 0x4C}
@@ -155,6 +252,31 @@ func (p *Protocol) EncodeReadResponse(value string, present bool) []byte {
 	}
 }
 
+// EncodeReadResponseSegments
+/**
+* Encode the same frame as EncodeReadResponse, split into the header and the value
+*
+* The header holds the frame length, command and argument length, the value follows as its own segment, so the
+* frame can be written with a single vectored write instead of first being concatenated into one buffer. Converting
+* the value to bytes is the only copy of it that is made.
+ */
+func (p *Protocol) EncodeReadResponseSegments(value string, present bool) net.Buffers {
+	if !present {
+		return net.Buffers{p.EncodeNullResponse()}
+	}
+
+	headerLength := LengthPrefixSize + 1 + len(READ) + 1 + 4 + 1
+	header := make([]byte, 0, headerLength)
+	header = binary.LittleEndian.AppendUint32(header, uint32(headerLength+len(value)))
+	header = append(header, messageSeparatorBinary)
+	header = append(header, READ...)
+	header = append(header, messageSeparatorBinary)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(value)))
+	header = append(header, messageSeparatorBinary)
+
+	return net.Buffers{header, []byte(value)}
+}
+
 func (p *Protocol) DecodeInsert(message []byte) (string, string, error) {
 	return p.decodeKeyValueCommand(INSERT, message)
 }
@@ -163,19 +285,29 @@ func (p *Protocol) EncodeInsertResponse(valueInserted bool) []byte {
 	return p.encodeAckOrNullResponse(valueInserted)
 }
 
+// DecodeTime
+/**
+* Decode a time encoded by EncodeTime, or a unix timestamp in milliseconds as peers older than protocol version 3
+* encode them and as append only logs written by them hold, returned in the local time zone
+ */
 func (p *Protocol) DecodeTime(timestampString string) (time.Time, error) {
 	timestamp, err := strconv.ParseInt(timestampString, 10, 64)
+	if err == nil {
+		return time.UnixMilli(timestamp), nil
+	}
+
+	decodedTime, err := time.Parse(time.RFC3339Nano, timestampString)
 	if err != nil {
-		return time.Time{}, errors.New(fmt.Sprintf("Expected a unix millisecond timestamp, but could not get that from arguement value %q: %q", timestampString, err))
+		return time.Time{}, errors.New(fmt.Sprintf("Expected an RFC 3339 or unix millisecond timestamp, but could not get that from argument value %q: %q", timestampString, err))
 	}
 
-	return time.UnixMilli(timestamp), nil
+	return decodedTime.Local(), nil
 }
 
 // EncodeTime
-// Times are encoded in the protocol as unix timestamps with milliseconds
-func (p *Protocol) EncodeTime(time time.Time) string {
-	return strconv.FormatInt(time.UnixMilli(), 10)
+// Times are encoded in the protocol in RFC 3339 in UTC with nanoseconds, so they decode to the time that was encoded
+func (p *Protocol) EncodeTime(timestamp time.Time) string {
+	return timestamp.UTC().Format(time.RFC3339Nano)
 }
 
 func (p *Protocol) DecodeReadExpiration(message []byte) (string, error) {
@@ -214,23 +346,270 @@ func (p *Protocol) EncodeReadExpiationResponse(expiration time.Time, expirationP
 	}
 }
 
+// DecodeReadStale decodes the key and the stale window of a READSTALE request
+func (p *Protocol) DecodeReadStale(message []byte) (string, time.Duration, error) {
+	arguments, err := p.decodeCommand(READSTALE, message)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(arguments) != 2 {
+		return "", 0, errors.New(fmt.Sprintf("expected 2 arguments for a READSTALE command but found %d: %v", len(arguments), arguments))
+	}
+
+	staleWindow, err := p.DecodeDuration(arguments[1])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return arguments[0], staleWindow, nil
+}
+
+// EncodeReadStaleResponse encodes the value and whether it is stale, or NULL when the key was not present
+func (p *Protocol) EncodeReadStaleResponse(value string, stale bool, present bool) []byte {
+	if !present {
+		return p.EncodeNullResponse()
+	}
+
+	message, err := p.EncodeMessage(READSTALE, value, strconv.FormatBool(stale))
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeReadStaleResponse decodes the value and whether it is stale from a READSTALE response
+func (p *Protocol) DecodeReadStaleResponse(message []byte) (string, bool, error) {
+	arguments, err := p.decodeCommand(READSTALE, message)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(arguments) != 2 {
+		return "", false, errors.New(fmt.Sprintf("expected 2 arguments for a READSTALE response but found %d: %v", len(arguments), arguments))
+	}
+
+	stale, err := strconv.ParseBool(arguments[1])
+	if err != nil {
+		return "", false, err
+	}
+
+	return arguments[0], stale, nil
+}
+
+// KeyStatus is the first argument of a READSTATUS response telling why a key was or was not read
+type KeyStatus string
+
+const (
+	KeyLive    KeyStatus = "LIVE"
+	KeyExpired KeyStatus = "EXPIRED"
+	KeyMissing KeyStatus = "MISSING"
+)
+
+func (p *Protocol) DecodeReadStatus(message []byte) (string, error) {
+	return p.decodeKeyCommand(READSTATUS, message)
+}
+
+// EncodeReadStatusResponse encodes the status of a key followed by its value when it is live
+func (p *Protocol) EncodeReadStatusResponse(value string, status KeyStatus) []byte {
+	arguments := []string{string(status)}
+	if status == KeyLive {
+		arguments = append(arguments, value)
+	}
+
+	message, err := p.EncodeMessage(READSTATUS, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeReadStatusResponse decodes the value and the status of a key from a READSTATUS response
+func (p *Protocol) DecodeReadStatusResponse(message []byte) (string, KeyStatus, error) {
+	arguments, err := p.decodeCommand(READSTATUS, message)
+	if err != nil {
+		return "", KeyMissing, err
+	}
+
+	if len(arguments) == 0 {
+		return "", KeyMissing, errors.New("expected a status in a READSTATUS response but found no arguments")
+	}
+
+	status := KeyStatus(arguments[0])
+	switch {
+	case status == KeyLive && len(arguments) == 2:
+		return arguments[1], status, nil
+	case (status == KeyExpired || status == KeyMissing) && len(arguments) == 1:
+		return "", status, nil
+	default:
+		return "", KeyMissing, errors.New(fmt.Sprintf("unexpected READSTATUS response %v", arguments))
+	}
+}
+
+// DecodeGetOrSet decodes the key, the default value, and the optional TTL of a GETORSET request, the TTL is zero when
+// it is left off
+func (p *Protocol) DecodeGetOrSet(message []byte) (string, string, time.Duration, error) {
+	arguments, err := p.decodeCommand(GETORSET, message)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if len(arguments) != 2 && len(arguments) != 3 {
+		return "", "", 0, errors.New(fmt.Sprintf("expected 2 or 3 arguments for a GETORSET command but found %d: %v", len(arguments), arguments))
+	}
+
+	var ttl time.Duration
+	if len(arguments) == 3 {
+		ttl, err = p.DecodeDuration(arguments[2])
+		if err != nil {
+			return "", "", 0, err
+		}
+	}
+
+	return arguments[0], arguments[1], ttl, nil
+}
+
+// EncodeGetOrSetResponse encodes the value the key holds and whether it existed before the request
+func (p *Protocol) EncodeGetOrSetResponse(value string, existed bool) []byte {
+	message, err := p.EncodeMessage(GETORSET, value, strconv.FormatBool(existed))
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeGetOrSetResponse decodes the value and whether the key existed from a GETORSET response
+func (p *Protocol) DecodeGetOrSetResponse(message []byte) (string, bool, error) {
+	arguments, err := p.decodeCommand(GETORSET, message)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(arguments) != 2 {
+		return "", false, errors.New(fmt.Sprintf("expected 2 arguments for a GETORSET response but found %d: %v", len(arguments), arguments))
+	}
+
+	existed, err := strconv.ParseBool(arguments[1])
+	if err != nil {
+		return "", false, err
+	}
+
+	return arguments[0], existed, nil
+}
+
+// ExpireMode is the optional third argument of an EXPIRE command deciding whether the current expiration is replaced
+type ExpireMode string
+
+const (
+	// ExpireAlways is the default when no mode is sent
+	ExpireAlways    ExpireMode = ""
+	ExpireIfNone    ExpireMode = "NX"
+	ExpireIfSet     ExpireMode = "XX"
+	ExpireIfLonger  ExpireMode = "GT"
+	ExpireIfShorter ExpireMode = "LT"
+)
+
 func (p *Protocol) DecodeExpire(message []byte) (string, time.Time, error) {
+	key, expiration, mode, err := p.DecodeExpireWithMode(message)
+	if err == nil && mode != ExpireAlways {
+		return "", time.Time{}, errors.New(fmt.Sprintf("expected 2 arguments for an EXPIRE command but found mode %q", mode))
+	}
+
+	return key, expiration, err
+}
+
+// DecodeExpireWithMode decodes an EXPIRE command with or without the optional mode argument
+func (p *Protocol) DecodeExpireWithMode(message []byte) (string, time.Time, ExpireMode, error) {
 	arguments, err := p.decodeCommand(EXPIRE, message)
 
 	if err != nil {
-		return "", time.Time{}, err
+		return "", time.Time{}, ExpireAlways, err
 	}
 
-	if len(arguments) != 2 {
-		return "", time.Time{}, errors.New(fmt.Sprintf("expected 2 arguments for an EXPIRE command but found %d: %v", len(arguments), arguments))
+	if len(arguments) != 2 && len(arguments) != 3 {
+		return "", time.Time{}, ExpireAlways, errors.New(fmt.Sprintf("expected 2 or 3 arguments for an EXPIRE command but found %d: %v", len(arguments), arguments))
 	}
 
 	decodedTime, err := p.DecodeTime(arguments[1])
 	if err != nil {
-		return "", time.Time{}, err
+		return "", time.Time{}, ExpireAlways, err
 	}
 
-	return arguments[0], decodedTime, nil
+	mode := ExpireAlways
+	if len(arguments) == 3 {
+		mode = ExpireMode(arguments[2])
+		switch mode {
+		case ExpireAlways, ExpireIfNone, ExpireIfSet, ExpireIfLonger, ExpireIfShorter:
+		default:
+			return "", time.Time{}, ExpireAlways, errors.New(fmt.Sprintf("unknown EXPIRE mode %q", mode))
+		}
+	}
+
+	return arguments[0], decodedTime, mode, nil
+}
+
+// DecodeCounter decodes the key and the delta of an INCR or DECR command
+func (p *Protocol) DecodeCounter(command Command, message []byte) (string, int64, error) {
+	arguments, err := p.decodeCommand(command, message)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(arguments) != 2 {
+		return "", 0, errors.New(fmt.Sprintf("expected 2 arguments for a %s command but found %d: %v", command, len(arguments), arguments))
+	}
+
+	delta, err := strconv.ParseInt(arguments[1], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return arguments[0], delta, nil
+}
+
+// EncodeCounterResponse answers INCR or DECR with the value of the counter after the change
+func (p *Protocol) EncodeCounterResponse(command Command, value int64) []byte {
+	message, err := p.EncodeMessage(command, strconv.FormatInt(value, 10))
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeCounterResponse(command Command, message []byte) (int64, error) {
+	arguments, err := p.decodeCommand(command, message)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(arguments) != 1 {
+		return 0, errors.New(fmt.Sprintf("expected 1 argument for a %s response but found %d: %v", command, len(arguments), arguments))
+	}
+
+	return strconv.ParseInt(arguments[0], 10, 64)
+}
+
+// DecodeExpireIn decodes the key and the time to live of an EXPIREIN command
+func (p *Protocol) DecodeExpireIn(message []byte) (string, time.Duration, error) {
+	arguments, err := p.decodeCommand(EXPIREIN, message)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(arguments) != 2 {
+		return "", 0, errors.New(fmt.Sprintf("expected 2 arguments for an EXPIREIN command but found %d: %v", len(arguments), arguments))
+	}
+
+	ttl, err := p.DecodeDuration(arguments[1])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return arguments[0], ttl, nil
 }
 
 func (p *Protocol) EncodeExpireResponse(expirationSet bool) []byte {
@@ -253,6 +632,51 @@ func (p *Protocol) EncodeDeleteResponse(success bool) []byte {
 	return p.encodeAckOrNullResponse(success)
 }
 
+func (p *Protocol) DecodeGetDel(message []byte) (string, error) {
+	return p.decodeKeyCommand(GETDEL, message)
+}
+
+// EncodeGetDelResponse answers GETDEL with the value the key held before it was deleted, or NULL when it was not present
+func (p *Protocol) EncodeGetDelResponse(value string, present bool) []byte {
+	if !present {
+		return p.EncodeNullResponse()
+	}
+
+	message, err := p.EncodeMessage(GETDEL, value)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeGetDelResponse(message []byte) (string, error) {
+	return p.decodeKeyCommand(GETDEL, message)
+}
+
+func (p *Protocol) DecodeGetUpdate(message []byte) (string, string, error) {
+	return p.decodeKeyValueCommand(GETUPDATE, message)
+}
+
+// EncodeGetUpdateResponse answers GETUPDATE with the value the key held before it was updated, or NULL when it was not
+// present
+func (p *Protocol) EncodeGetUpdateResponse(oldValue string, present bool) []byte {
+	if !present {
+		return p.EncodeNullResponse()
+	}
+
+	message, err := p.EncodeMessage(GETUPDATE, oldValue)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeGetUpdateResponse(message []byte) (string, error) {
+	return p.decodeKeyCommand(GETUPDATE, message)
+}
+
 func (p *Protocol) DecodeUpsert(message []byte) (string, string, error) {
 	return p.decodeKeyValueCommand(UPSERT, message)
 }
@@ -273,6 +697,10 @@ func (p *Protocol) DecodeTruncate(message []byte) error {
 	return p.decodeEmptyCommand(TRUNCATE, message)
 }
 
+func (p *Protocol) DecodePing(message []byte) error {
+	return p.decodeEmptyCommand(PING, message)
+}
+
 func (p *Protocol) DecodeCount(message []byte) error {
 	return p.decodeEmptyCommand(COUNT, message)
 }
@@ -285,6 +713,18 @@ func (p *Protocol) EncodeCountResponse(count int) []byte {
 	return p.encodeIntResponse(COUNT, count)
 }
 
+func (p *Protocol) DecodeCountBy(message []byte) (string, error) {
+	return p.decodeKeyCommand(COUNTBY, message)
+}
+
+func (p *Protocol) DecodeCountByResponse(message []byte) (int, error) {
+	return p.decodeIntResponse(COUNTBY, message)
+}
+
+func (p *Protocol) EncodeCountByResponse(count int) []byte {
+	return p.encodeIntResponse(COUNTBY, count)
+}
+
 func (p *Protocol) DecodeKeysBy(message []byte) (string, error) {
 	return p.decodeKeyCommand(KEYSBY, message)
 }
@@ -309,6 +749,24 @@ func (p *Protocol) EncodeKeysByResponse(keys []string) []byte {
 	return message
 }
 
+// EncodeKeysByResponseFrames encodes the keys in frames of at most maxFrameSize bytes, see EncodeSplitResponse
+func (p *Protocol) EncodeKeysByResponseFrames(keys []string, maxFrameSize int) [][]byte {
+	return p.EncodeSplitResponse(KEYSBY, maxFrameSize, keys)
+}
+
+func (p *Protocol) DecodeKeysMatching(message []byte) (string, error) {
+	return p.decodeKeyCommand(KEYSMATCH, message)
+}
+
+func (p *Protocol) DecodeKeysMatchingResponse(message []byte) ([]string, error) {
+	return p.decodeCommand(KEYSMATCH, message)
+}
+
+// EncodeKeysMatchingResponseFrames encodes the keys in frames of at most maxFrameSize bytes, see EncodeSplitResponse
+func (p *Protocol) EncodeKeysMatchingResponseFrames(keys []string, maxFrameSize int) [][]byte {
+	return p.EncodeSplitResponse(KEYSMATCH, maxFrameSize, keys)
+}
+
 func (p *Protocol) DecodeDeleteBy(message []byte) (string, error) {
 	return p.decodeKeyCommand(DELETEBY, message)
 }
@@ -348,53 +806,959 @@ func (p *Protocol) EncodeExpireByResponse(count int) []byte {
 	return p.encodeIntResponse(EXPIREBY, count)
 }
 
-func (p *Protocol) decodeCommand(command Command, message []byte) ([]string, error) {
-	var arguments []string
+func (p *Protocol) DecodeUpdateBy(message []byte) (string, string, error) {
+	return p.decodeKeyValueCommand(UPDATEBY, message)
+}
 
-	// first 5 bytes are message size + separator we can ignore
-	// next n non separator bytes plus the separator following are the command which we can ignore
-	prefixSize := 5 + len(command)
+func (p *Protocol) DecodeUpdateByResponse(message []byte) (int, error) {
+	return p.decodeIntResponse(UPDATEBY, message)
+}
 
-	// next we should have our argument pairs. Each will be prefixed by a separator, then have 4 bytes of argument
-	// size, a separator, and then that many bytes of the actual argument value
-	// If there is another separator after the argument value that means there is another argument pair
-	messageOffset := prefixSize
-	for messageOffset < len(message) && message[messageOffset] == messageSeparatorBinary {
-		if messageOffset+5 > len(message) {
-			return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
-		}
-		argumentSize := int(binary.LittleEndian.Uint32(message[messageOffset+1 : messageOffset+5]))
+func (p *Protocol) EncodeUpdateByResponse(count int) []byte {
+	return p.encodeIntResponse(UPDATEBY, count)
+}
 
-		argumentStart := messageOffset + 6
-		argumentEnd := argumentStart + argumentSize
+func (p *Protocol) DecodeExpirationHistogram(message []byte) ([]time.Duration, error) {
+	arguments, err := p.decodeCommand(EXPHIST, message)
 
-		if argumentEnd > len(message) {
-			return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]time.Duration, len(arguments))
+	for i, argument := range arguments {
+		bucket, err := p.DecodeDuration(argument)
+		if err != nil {
+			return nil, err
 		}
-		arguments = append(arguments, string(message[argumentStart:argumentEnd]))
 
-		messageOffset = argumentEnd
+		buckets[i] = bucket
 	}
 
-	if messageOffset != len(message) {
-		return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
-	}
+	return buckets, nil
+}
 
-	return arguments, nil
+func (p *Protocol) DecodeExpirationHistogramResponse(message []byte) ([]int, error) {
+	return p.decodeIntsResponse(EXPHIST, message)
 }
 
-func (p *Protocol) decodeKeyCommand(command Command, message []byte) (string, error) {
-	arguments, err := p.decodeCommand(command, message)
+func (p *Protocol) EncodeExpirationHistogramResponse(counts []int) []byte {
+	return p.encodeIntsResponse(EXPHIST, counts)
+}
 
-	if err != nil {
-		return "", err
+func (p *Protocol) DecodeMExists(message []byte) ([]string, error) {
+	return p.decodeCommand(MEXISTS, message)
+}
+
+// EncodeMExistsResponse
+/**
+* Encode the presence of each requested key as a bitmap, one bit per key in request order starting from the lowest bit
+* of the first byte, so a batch of n keys is answered with (n+7)/8 bytes
+ */
+func (p *Protocol) EncodeMExistsResponse(present []bool) []byte {
+	bitmap := make([]byte, (len(present)+7)/8)
+	for i, keyPresent := range present {
+		if keyPresent {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
 	}
 
-	if len(arguments) != 1 {
-		return "", errors.New(fmt.Sprintf("expected 1 arguments for a %q command but found %d: %v", command, len(arguments), arguments))
+	message, err := p.EncodeMessage(MEXISTS, string(bitmap))
+	if err != nil {
+		return p.EncodeErrResponse(err)
 	}
 
-	return arguments[0], nil
+	return message
+}
+
+// DecodeMExistsResponse decodes the bitmap of an MEXISTS response for a request of count keys
+func (p *Protocol) DecodeMExistsResponse(message []byte, count int) ([]bool, error) {
+	bitmap, err := p.decodeKeyCommand(MEXISTS, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bitmap) != (count+7)/8 {
+		return nil, errors.New(fmt.Sprintf("expected a %d byte bitmap for %d keys but found %d bytes", (count+7)/8, count, len(bitmap)))
+	}
+
+	present := make([]bool, count)
+	for i := range present {
+		present[i] = bitmap[i/8]&(1<<(i%8)) != 0
+	}
+
+	return present, nil
+}
+
+// DecodeInsertMany decodes the alternating key and value arguments of an INSERTMANY command into keys and their values
+func (p *Protocol) DecodeInsertMany(message []byte) ([]string, []string, error) {
+	arguments, err := p.decodeCommand(INSERTMANY, message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(arguments)%2 != 0 {
+		return nil, nil, errors.New(fmt.Sprintf("expected key and value pairs for an INSERTMANY command but found %d arguments", len(arguments)))
+	}
+
+	keys := make([]string, 0, len(arguments)/2)
+	values := make([]string, 0, len(arguments)/2)
+	for i := 0; i < len(arguments); i += 2 {
+		keys = append(keys, arguments[i])
+		values = append(values, arguments[i+1])
+	}
+
+	return keys, values, nil
+}
+
+// EncodeInsertManyResponse answers INSERTMANY with the number of keys it inserted
+func (p *Protocol) EncodeInsertManyResponse(inserted int) []byte {
+	return p.encodeIntResponse(INSERTMANY, inserted)
+}
+
+func (p *Protocol) DecodeInsertManyResponse(message []byte) (int, error) {
+	return p.decodeIntResponse(INSERTMANY, message)
+}
+
+func (p *Protocol) DecodeReadMany(message []byte) ([]string, error) {
+	return p.decodeCommand(READMANY, message)
+}
+
+// EncodeReadManyResponseFrames
+/**
+* Encode the keys found by READMANY as a response carrying two arguments per key, the key and its value, sorted by key.
+* Keys that were not found are left out, so a key holding the empty string is told apart from a missing one. Responses
+* larger than maxFrameSize bytes are split into CONTINUED frames, see EncodeSplitResponse.
+ */
+func (p *Protocol) EncodeReadManyResponseFrames(values map[string]string, maxFrameSize int) [][]byte {
+	return p.encodePairsResponseFrames(READMANY, values, maxFrameSize)
+}
+
+// DecodeReadManyResponse decodes the keys found and their values from a READMANY response, joined with JoinResponse if
+// it was split
+func (p *Protocol) DecodeReadManyResponse(message []byte) (map[string]string, error) {
+	return p.decodePairsResponse(READMANY, message)
+}
+
+func (p *Protocol) DecodeReadBy(message []byte) (string, error) {
+	return p.decodeKeyCommand(READBY, message)
+}
+
+// EncodeReadByResponseFrames encodes the keys found by READBY and their values like EncodeReadManyResponseFrames
+func (p *Protocol) EncodeReadByResponseFrames(values map[string]string, maxFrameSize int) [][]byte {
+	return p.encodePairsResponseFrames(READBY, values, maxFrameSize)
+}
+
+// DecodeReadByResponse decodes the keys found and their values from a READBY response, joined with JoinResponse if it
+// was split
+func (p *Protocol) DecodeReadByResponse(message []byte) (map[string]string, error) {
+	return p.decodePairsResponse(READBY, message)
+}
+
+// DecodeWriteOrder decodes the number of keys a NEWEST or OLDEST command asks for
+func (p *Protocol) DecodeWriteOrder(command Command, message []byte) (int, error) {
+	count, err := p.decodeKeyCommand(command, message)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(count)
+}
+
+// DecodeWriteOrderResponse decodes the keys of a NEWEST or OLDEST response in the order the server found them
+func (p *Protocol) DecodeWriteOrderResponse(command Command, message []byte) ([]string, error) {
+	return p.decodeCommand(command, message)
+}
+
+func (p *Protocol) EncodeWriteOrderResponse(command Command, keys []string) []byte {
+	message, err := p.EncodeMessage(command, keys...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// EncodeStatsResponse encodes each statistic as a name=value argument, sorted by name
+func (p *Protocol) EncodeStatsResponse(stats map[string]int64) []byte {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	arguments := make([]string, len(names))
+	for i, name := range names {
+		arguments[i] = name + "=" + strconv.FormatInt(stats[name], 10)
+	}
+
+	message, err := p.EncodeMessage(STATS, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeStatsResponse(message []byte) (map[string]int64, error) {
+	arguments, err := p.decodeCommand(STATS, message)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]int64, len(arguments))
+	for _, argument := range arguments {
+		name, value, found := strings.Cut(argument, "=")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("expected a name=value statistic but found %q", argument))
+		}
+
+		stats[name], err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// EncodeInfoResponse encodes each field as a name=value argument, sorted by name
+func (p *Protocol) EncodeInfoResponse(info map[string]string) []byte {
+	names := make([]string, 0, len(info))
+	for name := range info {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	arguments := make([]string, len(names))
+	for i, name := range names {
+		arguments[i] = name + "=" + info[name]
+	}
+
+	message, err := p.EncodeMessage(INFO, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeInfoResponse decodes the fields of an INFO response by name, a value holding = keeps everything after the first
+func (p *Protocol) DecodeInfoResponse(message []byte) (map[string]string, error) {
+	arguments, err := p.decodeCommand(INFO, message)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string, len(arguments))
+	for _, argument := range arguments {
+		name, value, found := strings.Cut(argument, "=")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("expected a name=value field but found %q", argument))
+		}
+
+		info[name] = value
+	}
+
+	return info, nil
+}
+
+// DecodeDeleteIfEquals decodes the key and the value it must hold to be deleted from a CDELETE command
+func (p *Protocol) DecodeDeleteIfEquals(message []byte) (string, string, error) {
+	return p.decodeKeyValueCommand(CDELETE, message)
+}
+
+// EncodeDeleteIfEqualsResponse
+/**
+* Encode the outcome of a CDELETE: ACK when the key was deleted, NULL when it was not present, and otherwise a CDELETE
+* frame carrying the value it holds instead
+ */
+func (p *Protocol) EncodeDeleteIfEqualsResponse(deleted bool, actual string, present bool) []byte {
+	if deleted {
+		return p.EncodeAckResponse()
+	}
+	if !present {
+		return p.EncodeNullResponse()
+	}
+
+	message, err := p.EncodeMessage(CDELETE, actual)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeDeleteIfEqualsResponse decodes the value a key held instead of the expected one from a CDELETE response
+func (p *Protocol) DecodeDeleteIfEqualsResponse(message []byte) (string, error) {
+	return p.decodeKeyCommand(CDELETE, message)
+}
+
+// ClientInfo
+/**
+* One connection of a CLIENTS response. Command is empty while the connection waits for its next request, otherwise it
+* is the command being processed and Running is how long it has been running. Identity is "admin" for sessions that
+* authenticated with AUTH and empty for everyone else.
+ */
+type ClientInfo struct {
+	ID            int64
+	RemoteAddress string
+	ConnectedAt   time.Time
+	Requests      int64
+	BytesIn       int64
+	BytesOut      int64
+	Command       Command
+	Running       time.Duration
+	Identity      string
+}
+
+func (p *Protocol) DecodeClients(message []byte) error {
+	return p.decodeEmptyCommand(CLIENTS, message)
+}
+
+// EncodeClientsResponse
+/**
+* Encode each connection as one argument of space separated name=value fields, such as
+* "id=3 addr=127.0.0.1:53211 connected=1700000000000 requests=12 in=640 out=96 command=READ running=5 identity="
+ */
+func (p *Protocol) EncodeClientsResponse(clients []ClientInfo) []byte {
+	arguments := make([]string, len(clients))
+	for i, client := range clients {
+		arguments[i] = fmt.Sprintf("id=%d addr=%s connected=%s requests=%d in=%d out=%d command=%s running=%s identity=%s",
+			client.ID, client.RemoteAddress, p.EncodeTime(client.ConnectedAt), client.Requests, client.BytesIn,
+			client.BytesOut, client.Command, p.EncodeDuration(client.Running), client.Identity)
+	}
+
+	message, err := p.EncodeMessage(CLIENTS, arguments...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeClientsResponse decodes the connections of a CLIENTS response, ignoring fields it does not know
+func (p *Protocol) DecodeClientsResponse(message []byte) ([]ClientInfo, error) {
+	arguments, err := p.decodeCommand(CLIENTS, message)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]ClientInfo, len(arguments))
+	for i, argument := range arguments {
+		for _, field := range strings.Fields(argument) {
+			name, value, found := strings.Cut(field, "=")
+			if !found {
+				return nil, errors.New(fmt.Sprintf("expected a name=value field but found %q in %q", field, argument))
+			}
+
+			switch name {
+			case "id":
+				clients[i].ID, err = strconv.ParseInt(value, 10, 64)
+			case "addr":
+				clients[i].RemoteAddress = value
+			case "connected":
+				clients[i].ConnectedAt, err = p.DecodeTime(value)
+			case "requests":
+				clients[i].Requests, err = strconv.ParseInt(value, 10, 64)
+			case "in":
+				clients[i].BytesIn, err = strconv.ParseInt(value, 10, 64)
+			case "out":
+				clients[i].BytesOut, err = strconv.ParseInt(value, 10, 64)
+			case "command":
+				clients[i].Command = Command(value)
+			case "running":
+				clients[i].Running, err = p.DecodeDuration(value)
+			case "identity":
+				clients[i].Identity = value
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return clients, nil
+}
+
+func (p *Protocol) DecodeClientKill(message []byte) (int64, error) {
+	id, err := p.decodeKeyCommand(CLIENTKILL, message)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(id, 10, 64)
+}
+
+// EncodeClientKillResponse answers ACK when the connection was closed and NULL when no connection had the ID
+func (p *Protocol) EncodeClientKillResponse(killed bool) []byte {
+	return p.encodeAckOrNullResponse(killed)
+}
+
+func (p *Protocol) DecodeComplete(message []byte) (string, int, error) {
+	arguments, err := p.decodeCommand(COMPLETE, message)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(arguments) != 2 {
+		return "", 0, errors.New(fmt.Sprintf("expected 2 arguments for a COMPLETE command but found %d: %v", len(arguments), arguments))
+	}
+
+	limit, err := strconv.Atoi(arguments[1])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return arguments[0], limit, nil
+}
+
+func (p *Protocol) DecodeCompleteResponse(message []byte) ([]string, error) {
+	completions, err := p.decodeCommand(COMPLETE, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return completions, nil
+}
+
+func (p *Protocol) EncodeCompleteResponse(completions []string) []byte {
+	message, err := p.EncodeMessage(COMPLETE, completions...)
+
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeScan(message []byte) (string, string, int, error) {
+	arguments, err := p.decodeCommand(SCAN, message)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if len(arguments) != 3 {
+		return "", "", 0, errors.New(fmt.Sprintf("expected 3 arguments for a SCAN command but found %d: %v", len(arguments), arguments))
+	}
+
+	limit, err := strconv.Atoi(arguments[2])
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return arguments[0], arguments[1], limit, nil
+}
+
+// DecodeScanResponse decodes the keys of a SCAN response and the cursor to continue after them, empty on the last page
+func (p *Protocol) DecodeScanResponse(message []byte) ([]string, string, error) {
+	arguments, err := p.decodeCommand(SCAN, message)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(arguments) == 0 {
+		return nil, "", errors.New("expected a cursor in the SCAN response but found no arguments")
+	}
+
+	return arguments[1:], arguments[0], nil
+}
+
+// EncodeScanResponse encodes the cursor to continue from followed by the keys of the page
+func (p *Protocol) EncodeScanResponse(keys []string, cursor string) []byte {
+	message, err := p.EncodeMessage(SCAN, append([]string{cursor}, keys...)...)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeRename(message []byte) (string, string, bool, error) {
+	arguments, err := p.decodeCommand(RENAME, message)
+
+	if err != nil {
+		return "", "", false, err
+	}
+
+	if len(arguments) != 3 {
+		return "", "", false, errors.New(fmt.Sprintf("expected 3 arguments for a RENAME command but found %d: %v", len(arguments), arguments))
+	}
+
+	overwrite, err := strconv.ParseBool(arguments[2])
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return arguments[0], arguments[1], overwrite, nil
+}
+
+func (p *Protocol) DecodeAuth(message []byte) (string, error) {
+	return p.decodeKeyCommand(AUTH, message)
+}
+
+// DecodeSelectDB decodes the name of the database a SELECTDB command switches the connection to, empty for the default
+func (p *Protocol) DecodeSelectDB(message []byte) (string, error) {
+	return p.decodeKeyCommand(SELECTDB, message)
+}
+
+// DecodeDropDB decodes the name of the database a DROPDB command removes
+func (p *Protocol) DecodeDropDB(message []byte) (string, error) {
+	return p.decodeKeyCommand(DROPDB, message)
+}
+
+// EncodeDropDBResponse answers ACK when the database was dropped and NULL when it did not exist
+func (p *Protocol) EncodeDropDBResponse(dropped bool) []byte {
+	return p.encodeAckOrNullResponse(dropped)
+}
+
+// DecodeWatch decodes the prefix a WATCH command streams the changes under and how often the server should send a PING
+// frame while there are none, zero when the client left it to the server
+func (p *Protocol) DecodeWatch(message []byte) (string, time.Duration, error) {
+	arguments, err := p.decodeCommand(WATCH, message)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(arguments) != 1 && len(arguments) != 2 {
+		return "", 0, errors.New(fmt.Sprintf("expected 1 or 2 arguments for a WATCH command but found %d: %v", len(arguments), arguments))
+	}
+
+	var heartbeat time.Duration
+	if len(arguments) == 2 {
+		heartbeat, err = p.DecodeDuration(arguments[1])
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	return arguments[0], heartbeat, nil
+}
+
+// DecodeReplicate decodes how often a REPLICATE command asks the primary to send a PING frame while it has no writes to
+// stream, zero when the replica left it to the primary
+func (p *Protocol) DecodeReplicate(message []byte) (time.Duration, error) {
+	arguments, err := p.decodeCommand(REPLICATE, message)
+	if err != nil {
+		return 0, err
+	}
+
+	switch len(arguments) {
+	case 0:
+		return 0, nil
+	case 1:
+		return p.DecodeDuration(arguments[0])
+	default:
+		return 0, errors.New(fmt.Sprintf("expected 0 or 1 arguments for a REPLICATE command but found %d: %v", len(arguments), arguments))
+	}
+}
+
+// MultiCommands are the commands a MULTI command may carry
+var MultiCommands = []Command{INSERT, UPDATE, UPSERT, DELETE, EXPIRE}
+
+// EncodeMulti encodes a MULTI command carrying the frames of the commands to apply together, in the order to apply them
+func (p *Protocol) EncodeMulti(commands [][]byte) ([]byte, error) {
+	arguments := make([]string, len(commands))
+	for i, command := range commands {
+		arguments[i] = string(command)
+	}
+
+	return p.EncodeMessage(MULTI, arguments...)
+}
+
+// DecodeMulti
+/**
+* Decode the frames of the commands a MULTI command carries, each checked to be a frame of one of the MultiCommands.
+* Their arguments are left to the decoder of each command, which refuses frames that are not whole.
+ */
+func (p *Protocol) DecodeMulti(message []byte) ([][]byte, error) {
+	arguments, err := p.decodeCommand(MULTI, message)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := make([][]byte, len(arguments))
+	for i, argument := range arguments {
+		command, err := p.DecipherCommand([]byte(argument))
+		if err != nil {
+			return nil, err
+		}
+		if !multiCommands[command] {
+			return nil, errors.New(fmt.Sprintf("%s cannot be part of a MULTI command", command))
+		}
+		commands[i] = []byte(argument)
+	}
+
+	return commands, nil
+}
+
+// EncodeMultiResponse answers MULTI with the response frame of each command it carried, in the same order
+func (p *Protocol) EncodeMultiResponse(responses [][]byte) []byte {
+	message, err := p.EncodeMulti(responses)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeMultiResponse decodes the response frames of a MULTI response to a request carrying count commands
+func (p *Protocol) DecodeMultiResponse(message []byte, count int) ([][]byte, error) {
+	arguments, err := p.decodeCommand(MULTI, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arguments) != count {
+		return nil, errors.New(fmt.Sprintf("expected %d responses for a MULTI command but found %d", count, len(arguments)))
+	}
+
+	responses := make([][]byte, len(arguments))
+	for i, argument := range arguments {
+		responses[i] = []byte(argument)
+	}
+
+	return responses, nil
+}
+
+// Change
+/**
+* A change to a key streamed to a connection that sent WATCH, see engine.Change. Operation is one of the engine's change
+* operations, such as "insert", "delete", or "expired". Expiration is only set by "expire" and is the zero time
+* otherwise.
+ */
+type Change struct {
+	Sequence   uint64
+	Operation  string
+	Key        string
+	Field      string
+	Value      string
+	Expiration time.Time
+}
+
+// EncodeEvent encodes an EVENT frame carrying the sequence, operation, key, field, value, and expiration of a change,
+// the expiration being empty when it is not set
+func (p *Protocol) EncodeEvent(change Change) []byte {
+	expiration := ""
+	if !change.Expiration.IsZero() {
+		expiration = p.EncodeTime(change.Expiration)
+	}
+
+	message, err := p.EncodeMessage(EVENT, strconv.FormatUint(change.Sequence, 10), change.Operation, change.Key, change.Field, change.Value, expiration)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeEvent(message []byte) (Change, error) {
+	arguments, err := p.decodeCommand(EVENT, message)
+	if err != nil {
+		return Change{}, err
+	}
+
+	if len(arguments) != 6 {
+		return Change{}, errors.New(fmt.Sprintf("expected 6 arguments for an EVENT frame but found %d: %v", len(arguments), arguments))
+	}
+
+	sequence, err := strconv.ParseUint(arguments[0], 10, 64)
+	if err != nil {
+		return Change{}, err
+	}
+
+	change := Change{Sequence: sequence, Operation: arguments[1], Key: arguments[2], Field: arguments[3], Value: arguments[4]}
+	if arguments[5] != "" {
+		change.Expiration, err = p.DecodeTime(arguments[5])
+		if err != nil {
+			return Change{}, err
+		}
+	}
+
+	return change, nil
+}
+
+// ConfigAction is the first argument of a CONFIG command
+type ConfigAction string
+
+const (
+	// ConfigSet changes a setting, CONFIG SET name value
+	ConfigSet ConfigAction = "SET"
+	// ConfigGet reads a setting, CONFIG GET name
+	ConfigGet ConfigAction = "GET"
+)
+
+// DecodeConfig decodes a CONFIG command into its action, the name of the setting, and for SET the new value
+func (p *Protocol) DecodeConfig(message []byte) (ConfigAction, string, string, error) {
+	arguments, err := p.decodeCommand(CONFIG, message)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	switch {
+	case len(arguments) == 3 && ConfigAction(arguments[0]) == ConfigSet:
+		return ConfigSet, arguments[1], arguments[2], nil
+	case len(arguments) == 2 && ConfigAction(arguments[0]) == ConfigGet:
+		return ConfigGet, arguments[1], "", nil
+	default:
+		return "", "", "", errors.New(fmt.Sprintf("expected SET with a name and a value or GET with a name for a CONFIG command but found %d arguments: %v", len(arguments), arguments))
+	}
+}
+
+// EncodeConfigResponse encodes the value of a setting read with CONFIG GET
+func (p *Protocol) EncodeConfigResponse(value string) []byte {
+	message, err := p.EncodeMessage(CONFIG, value)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeConfigResponse(message []byte) (string, error) {
+	return p.decodeKeyCommand(CONFIG, message)
+}
+
+// ExportedKey is one key of an EXPORT response, Expiration is the zero time for keys that do not expire
+type ExportedKey struct {
+	Key        string
+	Value      string
+	Expiration time.Time
+}
+
+func (p *Protocol) DecodeExport(message []byte) (string, error) {
+	return p.decodeKeyCommand(EXPORT, message)
+}
+
+// DecodeExportResponse
+/**
+* Decode an EXPORT response, which carries three arguments per key: the key, the value, and the expiration timestamp or
+* the empty string when the key does not expire
+ */
+func (p *Protocol) DecodeExportResponse(message []byte) ([]ExportedKey, error) {
+	arguments, err := p.decodeCommand(EXPORT, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arguments)%3 != 0 {
+		return nil, errors.New(fmt.Sprintf("expected EXPORT response arguments in groups of 3 but found %d: %v", len(arguments), arguments))
+	}
+
+	exported := make([]ExportedKey, len(arguments)/3)
+	for i := range exported {
+		exported[i].Key = arguments[i*3]
+		exported[i].Value = arguments[i*3+1]
+		if arguments[i*3+2] != "" {
+			exported[i].Expiration, err = p.DecodeTime(arguments[i*3+2])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return exported, nil
+}
+
+func (p *Protocol) EncodeExportResponse(exported []ExportedKey) []byte {
+	arguments := make([]string, 0, len(exported)*3)
+	for _, key := range exported {
+		expiration := ""
+		if !key.Expiration.IsZero() {
+			expiration = p.EncodeTime(key.Expiration)
+		}
+		arguments = append(arguments, key.Key, key.Value, expiration)
+	}
+
+	message, err := p.EncodeMessage(EXPORT, arguments...)
+
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+// DecodeHSet decodes the key, the field, and the value of an HSET command
+func (p *Protocol) DecodeHSet(message []byte) (string, string, string, error) {
+	arguments, err := p.decodeCommand(HSET, message)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if len(arguments) != 3 {
+		return "", "", "", errors.New(fmt.Sprintf("expected 3 arguments for an HSET command but found %d: %v", len(arguments), arguments))
+	}
+
+	return arguments[0], arguments[1], arguments[2], nil
+}
+
+// EncodeHSetResponse answers HSET with ACK when it created the field and NULL when it replaced one
+func (p *Protocol) EncodeHSetResponse(created bool) []byte {
+	return p.encodeAckOrNullResponse(created)
+}
+
+// DecodeHGet decodes the key and the field of an HGET command
+func (p *Protocol) DecodeHGet(message []byte) (string, string, error) {
+	return p.decodeKeyValueCommand(HGET, message)
+}
+
+func (p *Protocol) EncodeHGetResponse(value string, present bool) []byte {
+	if !present {
+		return p.EncodeNullResponse()
+	}
+
+	message, err := p.EncodeMessage(HGET, value)
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
+
+func (p *Protocol) DecodeHGetResponse(message []byte) (string, error) {
+	return p.decodeKeyCommand(HGET, message)
+}
+
+// DecodeHDel decodes the key and the field of an HDEL command
+func (p *Protocol) DecodeHDel(message []byte) (string, string, error) {
+	return p.decodeKeyValueCommand(HDEL, message)
+}
+
+// EncodeHDelResponse answers HDEL with ACK when it deleted the field and NULL when the field was not present
+func (p *Protocol) EncodeHDelResponse(deleted bool) []byte {
+	return p.encodeAckOrNullResponse(deleted)
+}
+
+func (p *Protocol) DecodeHGetAll(message []byte) (string, error) {
+	return p.decodeKeyCommand(HGETALL, message)
+}
+
+// EncodeHGetAllResponseFrames
+/**
+* Encode the fields of a hash as an HGETALL response carrying two arguments per field, its name and its value, sorted
+* by name. Responses larger than maxFrameSize bytes are split into CONTINUED frames, see EncodeSplitResponse.
+ */
+func (p *Protocol) EncodeHGetAllResponseFrames(fields map[string]string, maxFrameSize int) [][]byte {
+	return p.encodePairsResponseFrames(HGETALL, fields, maxFrameSize)
+}
+
+// DecodeHGetAllResponse decodes the fields of a hash from an HGETALL response, joined with JoinResponse if it was split
+func (p *Protocol) DecodeHGetAllResponse(message []byte) (map[string]string, error) {
+	return p.decodePairsResponse(HGETALL, message)
+}
+
+func (p *Protocol) DecodeHLen(message []byte) (string, error) {
+	return p.decodeKeyCommand(HLEN, message)
+}
+
+func (p *Protocol) EncodeHLenResponse(length int) []byte {
+	return p.encodeIntResponse(HLEN, length)
+}
+
+func (p *Protocol) DecodeHLenResponse(message []byte) (int, error) {
+	return p.decodeIntResponse(HLEN, message)
+}
+
+// DecodeHello returns the protocol version a client announced with HELLO
+func (p *Protocol) DecodeHello(message []byte) (int, error) {
+	version, err := p.decodeKeyCommand(HELLO, message)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(version)
+}
+
+// EncodeHelloResponse answers HELLO with the protocol version the server speaks
+func (p *Protocol) EncodeHelloResponse(version int) []byte {
+	return p.encodeIntResponse(HELLO, version)
+}
+
+func (p *Protocol) DecodeHelloResponse(message []byte) (int, error) {
+	return p.decodeIntResponse(HELLO, message)
+}
+
+func (p *Protocol) DecodeDuration(durationString string) (time.Duration, error) {
+	milliseconds, err := strconv.ParseInt(durationString, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Expected a millisecond duration, but could not get that from arguement value %q: %q", durationString, err))
+	}
+
+	return time.Duration(milliseconds) * time.Millisecond, nil
+}
+
+// EncodeDuration
+// Durations are encoded in the protocol as a whole number of milliseconds
+func (p *Protocol) EncodeDuration(duration time.Duration) string {
+	return strconv.FormatInt(duration.Milliseconds(), 10)
+}
+
+// decodeCommand
+/**
+* Decode the arguments of a frame carrying command
+*
+* Keys and values may hold any bytes, the separator included, so nothing is found by scanning for separators: the
+* command is compared in place and every argument is skipped by its length. A frame is only decoded when its length,
+* every separator, and every argument length agree with how EncodeMessage lays it out.
+ */
+func (p *Protocol) decodeCommand(command Command, message []byte) ([]string, error) {
+	// a frame without arguments decodes to an empty list rather than nil, so empty results are never confused with errors
+	arguments := []string{}
+
+	// first 5 bytes are message size + separator, followed by the command
+	prefixSize := 5 + len(command)
+	if len(message) < prefixSize || message[4] != messageSeparatorBinary || string(message[5:prefixSize]) != string(command) {
+		return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
+	}
+	if int(binary.LittleEndian.Uint32(message[:4])) != len(message) {
+		return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
+	}
+
+	// next we should have our argument pairs. Each will be prefixed by a separator, then have 4 bytes of argument
+	// size, a separator, and then that many bytes of the actual argument value
+	// If there is another separator after the argument value that means there is another argument pair
+	messageOffset := prefixSize
+	for messageOffset < len(message) && message[messageOffset] == messageSeparatorBinary {
+		if messageOffset+6 > len(message) || message[messageOffset+5] != messageSeparatorBinary {
+			return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
+		}
+		argumentSize := int(binary.LittleEndian.Uint32(message[messageOffset+1 : messageOffset+5]))
+
+		argumentStart := messageOffset + 6
+		argumentEnd := argumentStart + argumentSize
+
+		if argumentSize < 0 || argumentEnd > len(message) {
+			return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
+		}
+		arguments = append(arguments, string(message[argumentStart:argumentEnd]))
+
+		messageOffset = argumentEnd
+	}
+
+	if messageOffset != len(message) {
+		return nil, errors.New(fmt.Sprintf("Malformed message, could not decode: %b", message))
+	}
+
+	return arguments, nil
+}
+
+func (p *Protocol) decodeKeyCommand(command Command, message []byte) (string, error) {
+	arguments, err := p.decodeCommand(command, message)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(arguments) != 1 {
+		return "", errors.New(fmt.Sprintf("expected 1 arguments for a %q command but found %d: %v", command, len(arguments), arguments))
+	}
+
+	return arguments[0], nil
 }
 
 func (p *Protocol) decodeKeyValueCommand(command Command, message []byte) (string, string, error) {
@@ -433,6 +1797,41 @@ func (p *Protocol) decodeEmptyCommand(command Command, message []byte) error {
 	return nil
 }
 
+// encodePairsResponseFrames encodes a map as a response of name and value argument pairs sorted by name, split into
+// CONTINUED frames when larger than maxFrameSize bytes
+func (p *Protocol) encodePairsResponseFrames(command Command, pairs map[string]string, maxFrameSize int) [][]byte {
+	names := make([]string, 0, len(pairs))
+	for name := range pairs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	arguments := make([]string, 0, len(pairs)*2)
+	for _, name := range names {
+		arguments = append(arguments, name, pairs[name])
+	}
+
+	return p.EncodeSplitResponse(command, maxFrameSize, arguments)
+}
+
+func (p *Protocol) decodePairsResponse(command Command, message []byte) (map[string]string, error) {
+	arguments, err := p.decodeCommand(command, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arguments)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("expected %s response arguments in pairs but found %d: %v", command, len(arguments), arguments))
+	}
+
+	pairs := make(map[string]string, len(arguments)/2)
+	for i := 0; i < len(arguments); i += 2 {
+		pairs[arguments[i]] = arguments[i+1]
+	}
+
+	return pairs, nil
+}
+
 func (p *Protocol) decodeIntResponse(command Command, message []byte) (int, error) {
 	arguments, err := p.decodeCommand(command, message)
 
@@ -461,3 +1860,38 @@ func (p *Protocol) encodeIntResponse(command Command, count int) []byte {
 
 	return message
 }
+
+func (p *Protocol) decodeIntsResponse(command Command, message []byte) ([]int, error) {
+	arguments, err := p.decodeCommand(command, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]int, len(arguments))
+	for i, argument := range arguments {
+		intValue, err := strconv.Atoi(argument)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = intValue
+	}
+
+	return values, nil
+}
+
+func (p *Protocol) encodeIntsResponse(command Command, values []int) []byte {
+	arguments := make([]string, len(values))
+	for i, value := range values {
+		arguments[i] = strconv.Itoa(value)
+	}
+
+	message, err := p.EncodeMessage(command, arguments...)
+
+	if err != nil {
+		return p.EncodeErrResponse(err)
+	}
+
+	return message
+}
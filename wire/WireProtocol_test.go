@@ -1,6 +1,15 @@
 package wire
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestEncodeCommand(t *testing.T) {
 	protocol := Protocol{}
@@ -98,3 +107,926 @@ func TestDecodeRead(t *testing.T) {
 		t.Fatalf("Expected an error %q", err)
 	}
 }
+
+func TestExpirationHistogramRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	commandBytes, _ := protocol.EncodeMessage(EXPHIST, protocol.EncodeDuration(time.Minute), protocol.EncodeDuration(time.Hour))
+	buckets, err := protocol.DecodeExpirationHistogram(commandBytes)
+	if err != nil || len(buckets) != 2 || buckets[0] != time.Minute || buckets[1] != time.Hour {
+		t.Fatalf("Expected to decode buckets [1m 1h] but got %v: %q", buckets, err)
+	}
+
+	commandBytes, _ = protocol.EncodeMessage(EXPHIST, "not a number")
+	_, err = protocol.DecodeExpirationHistogram(commandBytes)
+	if err == nil {
+		t.Fatalf("Expected an error decoding an invalid bucket")
+	}
+
+	counts, err := protocol.DecodeExpirationHistogramResponse(protocol.EncodeExpirationHistogramResponse([]int{3, 0, 12}))
+	if err != nil || len(counts) != 3 || counts[0] != 3 || counts[1] != 0 || counts[2] != 12 {
+		t.Fatalf("Expected to decode counts [3 0 12] but got %v: %q", counts, err)
+	}
+}
+
+func TestReadStaleRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	commandBytes, _ := protocol.EncodeMessage(READSTALE, "key1", protocol.EncodeDuration(time.Minute))
+	key, staleWindow, err := protocol.DecodeReadStale(commandBytes)
+	if err != nil || key != "key1" || staleWindow != time.Minute {
+		t.Fatalf("Expected to decode key1 with a 1m window but got %q %s: %q", key, staleWindow, err)
+	}
+
+	commandBytes, _ = protocol.EncodeMessage(READSTALE, "key1")
+	_, _, err = protocol.DecodeReadStale(commandBytes)
+	if err == nil {
+		t.Fatalf("Expected an error decoding a request without a window")
+	}
+
+	value, stale, err := protocol.DecodeReadStaleResponse(protocol.EncodeReadStaleResponse("abc123", true, true))
+	if err != nil || value != "abc123" || !stale {
+		t.Fatalf("Expected to decode a stale abc123 but got %q %t: %q", value, stale, err)
+	}
+
+	command, _ := protocol.DecipherCommand(protocol.EncodeReadStaleResponse("", false, false))
+	if command != NULL {
+		t.Fatalf("Expected a missing key to be encoded as NULL but got %q", command)
+	}
+}
+
+func TestExpireInRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	commandBytes, _ := protocol.EncodeMessage(EXPIREIN, "key1", protocol.EncodeDuration(-time.Minute))
+	key, ttl, err := protocol.DecodeExpireIn(commandBytes)
+	if err != nil || key != "key1" || ttl != -time.Minute {
+		t.Fatalf("Expected to decode key1 with a -1m ttl but got %q %s: %q", key, ttl, err)
+	}
+
+	commandBytes, _ = protocol.EncodeMessage(EXPIREIN, "key1", "soon")
+	if _, _, err = protocol.DecodeExpireIn(commandBytes); err == nil {
+		t.Fatalf("Expected an error decoding a ttl that is not a number of milliseconds")
+	}
+}
+
+func TestCounterRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	commandBytes, _ := protocol.EncodeMessage(DECR, "requests", "-12")
+	key, delta, err := protocol.DecodeCounter(DECR, commandBytes)
+	if err != nil || key != "requests" || delta != -12 {
+		t.Fatalf("Expected to decode requests with a delta of -12 but got %q %d: %q", key, delta, err)
+	}
+
+	commandBytes, _ = protocol.EncodeMessage(INCR, "requests", "1.5")
+	if _, _, err = protocol.DecodeCounter(INCR, commandBytes); err == nil {
+		t.Fatalf("Expected an error decoding a delta that is not an integer")
+	}
+
+	value, err := protocol.DecodeCounterResponse(INCR, protocol.EncodeCounterResponse(INCR, -9223372036854775808))
+	if err != nil || value != -9223372036854775808 {
+		t.Fatalf("Expected the smallest 64-bit integer to survive the round trip but got %d: %q", value, err)
+	}
+}
+
+func TestReadStatusResponses(t *testing.T) {
+	protocol := Protocol{}
+
+	golden := []struct {
+		value    string
+		status   KeyStatus
+		expected string
+	}{
+		{"abc", KeyLive, "\x22\x00\x00\x00|READSTATUS|\x04\x00\x00\x00|LIVE|\x03\x00\x00\x00|abc"},
+		{"", KeyLive, "\x1f\x00\x00\x00|READSTATUS|\x04\x00\x00\x00|LIVE|\x00\x00\x00\x00|"},
+		{"", KeyExpired, "\x1c\x00\x00\x00|READSTATUS|\x07\x00\x00\x00|EXPIRED"},
+		{"", KeyMissing, "\x1c\x00\x00\x00|READSTATUS|\x07\x00\x00\x00|MISSING"},
+	}
+
+	for _, frame := range golden {
+		response := protocol.EncodeReadStatusResponse(frame.value, frame.status)
+		if string(response) != frame.expected {
+			t.Fatalf("%s: expected the response %q but got %q", frame.status, frame.expected, response)
+		}
+
+		value, status, err := protocol.DecodeReadStatusResponse(response)
+		if err != nil || value != frame.value || status != frame.status {
+			t.Fatalf("%s: expected to decode %q but got %q with status %s: %q", frame.status, frame.value, value, status, err)
+		}
+	}
+
+	for _, arguments := range [][]string{{}, {"LIVE"}, {"EXPIRED", "abc"}, {"GONE"}} {
+		response, _ := protocol.EncodeMessage(READSTATUS, arguments...)
+		if _, _, err := protocol.DecodeReadStatusResponse(response); err == nil {
+			t.Fatalf("Expected an error decoding the READSTATUS response %v", arguments)
+		}
+	}
+}
+
+func TestSplitResponsesRespectTheFrameLimit(t *testing.T) {
+	protocol := Protocol{}
+	keys := []string{"aaaa", "CONTINUED", "KEYSBY", "dddd", "eeee", "ffff", "gggg"}
+	single := protocol.EncodeKeysByResponse(keys)
+
+	for _, limit := range []int{len(single) + 1, len(single)} {
+		frames := protocol.EncodeKeysByResponseFrames(keys, limit)
+		if len(frames) != 1 || string(frames[0]) != string(single) {
+			t.Fatalf("Expected a response fitting in %d bytes to be a single frame but got %q", limit, frames)
+		}
+	}
+
+	// CONTINUED frames start with 4 bytes of length, |CONTINUED, and |length|KEYSBY, 26 bytes in all
+	golden := []string{
+		"\x24\x00\x00\x00|CONTINUED|\x06\x00\x00\x00|KEYSBY|\x04\x00\x00\x00|aaaa",
+		"\x29\x00\x00\x00|CONTINUED|\x06\x00\x00\x00|KEYSBY|\x09\x00\x00\x00|CONTINUED",
+		"\x26\x00\x00\x00|CONTINUED|\x06\x00\x00\x00|KEYSBY|\x06\x00\x00\x00|KEYSBY",
+		"\x24\x00\x00\x00|CONTINUED|\x06\x00\x00\x00|KEYSBY|\x04\x00\x00\x00|dddd",
+		"\x24\x00\x00\x00|CONTINUED|\x06\x00\x00\x00|KEYSBY|\x04\x00\x00\x00|eeee",
+		"\x24\x00\x00\x00|CONTINUED|\x06\x00\x00\x00|KEYSBY|\x04\x00\x00\x00|ffff",
+		"\x15\x00\x00\x00|KEYSBY|\x04\x00\x00\x00|gggg",
+	}
+	frames := protocol.EncodeKeysByResponseFrames(keys, 41)
+	if len(frames) != len(golden) {
+		t.Fatalf("Expected every key in a frame of its own but got %q", frames)
+	}
+	for i, frame := range frames {
+		if string(frame) != golden[i] {
+			t.Fatalf("Expected frame %d to be %q but got %q", i, golden[i], frame)
+		}
+	}
+
+	frames = protocol.EncodeKeysByResponseFrames(keys, 46)
+	if len(frames) != 5 || len(frames[3]) != 46 {
+		t.Fatalf("Expected frames packed up to exactly 46 bytes but got %q", frames)
+	}
+
+	var continued []string
+	for _, frame := range frames[:len(frames)-1] {
+		command, arguments, err := protocol.DecodeContinued(frame)
+		if err != nil || command != KEYSBY || len(frame) > 46 {
+			t.Fatalf("Expected a CONTINUED frame of a KEYSBY response within the limit but got %q: %q", frame, err)
+		}
+		continued = append(continued, arguments...)
+	}
+	joined, err := protocol.JoinResponse(continued, frames[len(frames)-1])
+	if err != nil || string(joined) != string(single) {
+		t.Fatalf("Expected the frames to join back into %q but got %q: %q", single, joined, err)
+	}
+}
+
+func TestWriteOrderRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	for _, command := range []Command{NEWEST, OLDEST} {
+		commandBytes, _ := protocol.EncodeMessage(command, "3")
+		count, err := protocol.DecodeWriteOrder(command, commandBytes)
+		if err != nil || count != 3 {
+			t.Fatalf("Expected to decode a count of 3 from %s but got %d: %q", command, count, err)
+		}
+
+		keys, err := protocol.DecodeWriteOrderResponse(command, protocol.EncodeWriteOrderResponse(command, []string{"b", "a"}))
+		if err != nil || len(keys) != 2 || keys[0] != "b" || keys[1] != "a" {
+			t.Fatalf("Expected to decode keys [b a] from %s but got %v: %q", command, keys, err)
+		}
+	}
+
+	commandBytes, _ := protocol.EncodeMessage(NEWEST, "many")
+	_, err := protocol.DecodeWriteOrder(NEWEST, commandBytes)
+	if err == nil {
+		t.Fatalf("Expected an error decoding an invalid count")
+	}
+}
+
+func TestEmptyResultsAreTypedResponses(t *testing.T) {
+	protocol := Protocol{}
+
+	golden := []struct {
+		name     string
+		response []byte
+		expected string
+	}{
+		{"keys by", protocol.EncodeKeysByResponse(nil), "\x0b\x00\x00\x00|KEYSBY"},
+		{"complete", protocol.EncodeCompleteResponse(nil), "\x0d\x00\x00\x00|COMPLETE"},
+		{"export", protocol.EncodeExportResponse(nil), "\x0b\x00\x00\x00|EXPORT"},
+		{"newest", protocol.EncodeWriteOrderResponse(NEWEST, nil), "\x0b\x00\x00\x00|NEWEST"},
+		{"count", protocol.EncodeCountResponse(0), "\x11\x00\x00\x00|COUNT|\x01\x00\x00\x00|0"},
+		{"delete by", protocol.EncodeDeleteByResponse(0), "\x14\x00\x00\x00|DELETEBY|\x01\x00\x00\x00|0"},
+		{"expire by", protocol.EncodeExpireByResponse(0), "\x14\x00\x00\x00|EXPIREBY|\x01\x00\x00\x00|0"},
+	}
+
+	for _, frame := range golden {
+		if string(frame.response) != frame.expected {
+			t.Fatalf("%s: expected the empty response %q but got %q", frame.name, frame.expected, frame.response)
+		}
+	}
+
+	keys, err := protocol.DecodeKeysByResponse(golden[0].response)
+	if err != nil || keys == nil || len(keys) != 0 {
+		t.Fatalf("Expected an empty KEYSBY to decode to an empty non-nil list but got %#v: %q", keys, err)
+	}
+
+	completions, err := protocol.DecodeCompleteResponse(golden[1].response)
+	if err != nil || completions == nil || len(completions) != 0 {
+		t.Fatalf("Expected an empty COMPLETE to decode to an empty non-nil list but got %#v: %q", completions, err)
+	}
+
+	exported, err := protocol.DecodeExportResponse(golden[2].response)
+	if err != nil || exported == nil || len(exported) != 0 {
+		t.Fatalf("Expected an empty EXPORT to decode to an empty non-nil list but got %#v: %q", exported, err)
+	}
+
+	newest, err := protocol.DecodeWriteOrderResponse(NEWEST, golden[3].response)
+	if err != nil || newest == nil || len(newest) != 0 {
+		t.Fatalf("Expected an empty NEWEST to decode to an empty non-nil list but got %#v: %q", newest, err)
+	}
+
+	for i, decode := range []func([]byte) (int, error){protocol.DecodeCountResponse, protocol.DecodeDeleteByResponse, protocol.DecodeExpireByResponse} {
+		count, err := decode(golden[4+i].response)
+		if err != nil || count != 0 {
+			t.Fatalf("%s: expected to decode a count of 0 but got %d: %q", golden[4+i].name, count, err)
+		}
+	}
+}
+
+func TestKeyCommandsRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(PRESENT, "user|1")
+	key, err := protocol.DecodePresent(request)
+	if err != nil || key != "user|1" {
+		t.Fatalf("Expected to decode the PRESENT key %q but got %q: %q", "user|1", key, err)
+	}
+	for present, expected := range map[bool]Command{true: ACK, false: NULL} {
+		command, _ := protocol.DecipherCommand(protocol.EncodePresentResponse(present))
+		if command != expected {
+			t.Fatalf("Expected PRESENT of a key present=%t to be answered with %q but got %q", present, expected, command)
+		}
+	}
+
+	for command, decode := range map[Command]func([]byte) (string, error){KEYSBY: protocol.DecodeKeysBy, KEYSMATCH: protocol.DecodeKeysMatching, DELETEBY: protocol.DecodeDeleteBy} {
+		request, _ = protocol.EncodeMessage(command, "tenant|1:")
+		prefix, err := decode(request)
+		if err != nil || prefix != "tenant|1:" {
+			t.Fatalf("Expected to decode the %s prefix but got %q: %q", command, prefix, err)
+		}
+	}
+
+	expiration := time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC)
+	request, _ = protocol.EncodeMessage(EXPIREBY, "tenant|1:", protocol.EncodeTime(expiration))
+	prefix, decodedExpiration, err := protocol.DecodeExpireBy(request)
+	if err != nil || prefix != "tenant|1:" || !decodedExpiration.Equal(expiration) {
+		t.Fatalf("Expected to decode the EXPIREBY prefix and expiration but got %q and %s: %q", prefix, decodedExpiration, err)
+	}
+	request, _ = protocol.EncodeMessage(EXPIREBY, "tenant|1:")
+	if _, _, err = protocol.DecodeExpireBy(request); err == nil {
+		t.Fatalf("Expected an error decoding EXPIREBY without an expiration")
+	}
+}
+
+func TestEmptyCommandsRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	for command, decode := range map[Command]func([]byte) error{TRUNCATE: protocol.DecodeTruncate, COUNT: protocol.DecodeCount} {
+		request, _ := protocol.EncodeMessage(command)
+		if err := decode(request); err != nil {
+			t.Fatalf("Expected to decode %s without arguments but got %q", command, err)
+		}
+
+		request, _ = protocol.EncodeMessage(command, "unexpected")
+		if err := decode(request); err == nil {
+			t.Fatalf("Expected an error decoding %s with an argument", command)
+		}
+
+		request, _ = protocol.EncodeMessage(PING)
+		if err := decode(request); err == nil {
+			t.Fatalf("Expected an error decoding PING as %s", command)
+		}
+	}
+}
+
+func TestCountResponsesRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	responses := []struct {
+		encode func(int) []byte
+		decode func([]byte) (int, error)
+	}{
+		{protocol.EncodeCountResponse, protocol.DecodeCountResponse},
+		{protocol.EncodeDeleteByResponse, protocol.DecodeDeleteByResponse},
+		{protocol.EncodeExpireByResponse, protocol.DecodeExpireByResponse},
+	}
+	for _, response := range responses {
+		for _, count := range []int{0, 1, 123456} {
+			encoded := response.encode(count)
+			decoded, err := response.decode(encoded)
+			if err != nil || decoded != count {
+				t.Fatalf("Expected %q to decode to %d but got %d: %q", encoded, count, decoded, err)
+			}
+		}
+	}
+
+	if _, err := protocol.DecodeDeleteByResponse(protocol.EncodeCountResponse(1)); err == nil {
+		t.Fatalf("Expected an error decoding a COUNT response as a DELETEBY response")
+	}
+}
+
+func TestKeysByResponseRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	for _, keys := range [][]string{{}, {"user:1"}, {"a|b", "|", "||c|", ""}} {
+		decoded, err := protocol.DecodeKeysByResponse(protocol.EncodeKeysByResponse(keys))
+		if err != nil || !reflect.DeepEqual(decoded, keys) {
+			t.Fatalf("Expected the keys %q to round trip but got %q: %q", keys, decoded, err)
+		}
+	}
+}
+
+func TestScanRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(SCAN, "user", "user:1", "1000")
+	prefix, cursor, limit, err := protocol.DecodeScan(request)
+	if err != nil || prefix != "user" || cursor != "user:1" || limit != 1000 {
+		t.Fatalf("Expected the SCAN request to round trip but got %q, %q, %d: %q", prefix, cursor, limit, err)
+	}
+
+	for _, page := range []struct {
+		keys   []string
+		cursor string
+	}{{[]string{}, ""}, {[]string{"user:1", "user:2"}, "user:2"}, {[]string{"", "|"}, "|"}} {
+		keys, cursor, err := protocol.DecodeScanResponse(protocol.EncodeScanResponse(page.keys, page.cursor))
+		if err != nil || !reflect.DeepEqual(keys, page.keys) || cursor != page.cursor {
+			t.Fatalf("Expected the page %q after %q to round trip but got %q after %q: %q", page.keys, page.cursor, keys, cursor, err)
+		}
+	}
+}
+
+func TestStatsRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	response := protocol.EncodeStatsResponse(map[string]int64{"keys": 12, "default-ttl-applied": 0})
+	expected, _ := protocol.EncodeMessage(STATS, "default-ttl-applied=0", "keys=12")
+	if string(response) != string(expected) {
+		t.Fatalf("Expected statistics sorted by name %q but got %q", expected, response)
+	}
+
+	stats, err := protocol.DecodeStatsResponse(response)
+	if err != nil || len(stats) != 2 || stats["keys"] != 12 || stats["default-ttl-applied"] != 0 {
+		t.Fatalf("Expected to decode both statistics but got %v: %q", stats, err)
+	}
+
+	for _, invalid := range []string{"keys", "keys=many"} {
+		response, _ = protocol.EncodeMessage(STATS, invalid)
+		_, err = protocol.DecodeStatsResponse(response)
+		if err == nil {
+			t.Fatalf("Expected an error decoding the statistic %q", invalid)
+		}
+	}
+}
+
+func TestInfoRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	response := protocol.EncodeInfoResponse(map[string]string{"version": "1.4.0", "address": "", "build": "flags=-trimpath"})
+	expected, _ := protocol.EncodeMessage(INFO, "address=", "build=flags=-trimpath", "version=1.4.0")
+	if string(response) != string(expected) {
+		t.Fatalf("Expected fields sorted by name %q but got %q", expected, response)
+	}
+
+	info, err := protocol.DecodeInfoResponse(response)
+	if err != nil || len(info) != 3 || info["version"] != "1.4.0" || info["address"] != "" || info["build"] != "flags=-trimpath" {
+		t.Fatalf("Expected to decode the three fields but got %v: %q", info, err)
+	}
+
+	response, _ = protocol.EncodeMessage(INFO, "version")
+	_, err = protocol.DecodeInfoResponse(response)
+	if err == nil {
+		t.Fatalf("Expected an error decoding a field without a value")
+	}
+}
+
+func TestGetDelRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	value, err := protocol.DecodeGetDelResponse(protocol.EncodeGetDelResponse("", true))
+	if err != nil || value != "" {
+		t.Fatalf("Expected a key holding the empty string to decode as such but got %q: %q", value, err)
+	}
+
+	command, _ := protocol.DecipherCommand(protocol.EncodeGetDelResponse("", false))
+	if command != NULL {
+		t.Fatalf("Expected a missing key to be encoded as NULL but got %q", command)
+	}
+}
+
+func TestGetUpdateRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	message, _ := protocol.EncodeMessage(GETUPDATE, "counter", "2")
+	key, value, err := protocol.DecodeGetUpdate(message)
+	if err != nil || key != "counter" || value != "2" {
+		t.Fatalf("Expected to decode the key and new value but got %q, %q: %q", key, value, err)
+	}
+
+	oldValue, err := protocol.DecodeGetUpdateResponse(protocol.EncodeGetUpdateResponse("1", true))
+	if err != nil || oldValue != "1" {
+		t.Fatalf("Expected to decode the old value but got %q: %q", oldValue, err)
+	}
+
+	command, _ := protocol.DecipherCommand(protocol.EncodeGetUpdateResponse("", false))
+	if command != NULL {
+		t.Fatalf("Expected a missing key to be encoded as NULL but got %q", command)
+	}
+}
+
+func TestReadByRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+	values := map[string]string{"user:1": "ada", "user:2": ""}
+
+	frames := protocol.EncodeReadByResponseFrames(values, 1024)
+	if len(frames) != 1 {
+		t.Fatalf("Expected a small response to fit in one frame but found %d", len(frames))
+	}
+	decoded, err := protocol.DecodeReadByResponse(frames[0])
+	if err != nil || !reflect.DeepEqual(decoded, values) {
+		t.Fatalf("Expected %v but decoded %v: %q", values, decoded, err)
+	}
+}
+
+func TestDeleteIfEqualsRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(CDELETE, "lock:job42", "holder1")
+	key, expected, err := protocol.DecodeDeleteIfEquals(request)
+	if err != nil || key != "lock:job42" || expected != "holder1" {
+		t.Fatalf("Expected to decode %q and %q but got %q and %q: %q", "lock:job42", "holder1", key, expected, err)
+	}
+
+	outcomes := []struct {
+		deleted  bool
+		actual   string
+		present  bool
+		response Command
+	}{
+		{true, "holder1", true, ACK},
+		{false, "", false, NULL},
+		{false, "holder2", true, CDELETE},
+	}
+	for _, outcome := range outcomes {
+		response := protocol.EncodeDeleteIfEqualsResponse(outcome.deleted, outcome.actual, outcome.present)
+		command, err := protocol.DecipherCommand(response)
+		if err != nil || command != outcome.response {
+			t.Fatalf("Expected a %s response for deleted=%t present=%t but got %s: %q", outcome.response, outcome.deleted, outcome.present, command, err)
+		}
+	}
+
+	actual, err := protocol.DecodeDeleteIfEqualsResponse(protocol.EncodeDeleteIfEqualsResponse(false, "holder2", true))
+	if err != nil || actual != "holder2" {
+		t.Fatalf("Expected to decode the actual value %q but got %q: %q", "holder2", actual, err)
+	}
+}
+
+func TestClientsRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	clients := []ClientInfo{
+		{ID: 1, RemoteAddress: "127.0.0.1:53211", ConnectedAt: time.UnixMilli(1700000000000), Requests: 12, BytesIn: 640, BytesOut: 96, Command: READ, Running: time.Millisecond * 5, Identity: "admin"},
+		{ID: 7, RemoteAddress: "[::1]:40000", ConnectedAt: time.UnixMilli(1700000000500)},
+	}
+
+	decoded, err := protocol.DecodeClientsResponse(protocol.EncodeClientsResponse(clients))
+	if err != nil || !reflect.DeepEqual(decoded, clients) {
+		t.Fatalf("Expected to decode %+v but got %+v: %q", clients, decoded, err)
+	}
+
+	// fields added by newer servers are skipped
+	response, _ := protocol.EncodeMessage(CLIENTS, "id=3 addr=127.0.0.1:1 flavor=vanilla")
+	decoded, err = protocol.DecodeClientsResponse(response)
+	if err != nil || len(decoded) != 1 || decoded[0].ID != 3 || decoded[0].RemoteAddress != "127.0.0.1:1" {
+		t.Fatalf("Expected to decode the known fields but got %+v: %q", decoded, err)
+	}
+
+	for _, invalid := range []string{"id", "id=three"} {
+		response, _ = protocol.EncodeMessage(CLIENTS, invalid)
+		_, err = protocol.DecodeClientsResponse(response)
+		if err == nil {
+			t.Fatalf("Expected an error decoding the connection %q", invalid)
+		}
+	}
+}
+
+func TestWarnResponseRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	ack := protocol.EncodeAckResponse()
+	if !bytes.Equal(protocol.EncodeWarnResponse(ack), ack) {
+		t.Fatalf("Expected a response without warnings to be left unwrapped")
+	}
+
+	warnings := []Warning{{Code: TTLCLAMPED, Message: "shortened"}, {Code: "OTHER", Message: "with | separators"}}
+	response := protocol.EncodeWarnResponse(ack, warnings...)
+	command, err := protocol.DecipherCommand(response)
+	if err != nil || command != WARN {
+		t.Fatalf("Expected a WARN response but got %s: %q", command, err)
+	}
+
+	wrapped, decoded, err := protocol.DecodeWarnings(response)
+	if err != nil || !bytes.Equal(wrapped, ack) || !reflect.DeepEqual(decoded, warnings) {
+		t.Fatalf("Expected the ACK and its warnings back but found %q and %v: %q", wrapped, decoded, err)
+	}
+
+	malformed, _ := protocol.EncodeMessage(WARN, string(ack), string(TTLCLAMPED))
+	_, _, err = protocol.DecodeWarnings(malformed)
+	if err == nil {
+		t.Fatalf("Expected a warning without a message to be rejected")
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(HELLO, "2")
+	version, err := protocol.DecodeHello(request)
+	if err != nil || version != 2 {
+		t.Fatalf("Expected version 2 but got %d: %q", version, err)
+	}
+
+	version, err = protocol.DecodeHelloResponse(protocol.EncodeHelloResponse(ProtocolVersion))
+	if err != nil || version != ProtocolVersion {
+		t.Fatalf("Expected version %d but got %d: %q", ProtocolVersion, version, err)
+	}
+}
+
+func TestGetOrSetRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(GETORSET, "key", "default", protocol.EncodeDuration(time.Minute))
+	key, defaultValue, ttl, err := protocol.DecodeGetOrSet(request)
+	if err != nil || key != "key" || defaultValue != "default" || ttl != time.Minute {
+		t.Fatalf("Expected the key, default, and TTL but found %q %q %s: %q", key, defaultValue, ttl, err)
+	}
+
+	request, _ = protocol.EncodeMessage(GETORSET, "key", "default")
+	_, _, ttl, err = protocol.DecodeGetOrSet(request)
+	if err != nil || ttl != 0 {
+		t.Fatalf("Expected no TTL when it is left off but found %s: %q", ttl, err)
+	}
+
+	value, existed, err := protocol.DecodeGetOrSetResponse(protocol.EncodeGetOrSetResponse("", true))
+	if err != nil || value != "" || !existed {
+		t.Fatalf("Expected an empty existing value but found %q, existed=%t: %q", value, existed, err)
+	}
+}
+
+func TestMExistsRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	commandBytes, _ := protocol.EncodeMessage(MEXISTS, "key1", "key2", "key1")
+	keys, err := protocol.DecodeMExists(commandBytes)
+	if err != nil || len(keys) != 3 || keys[0] != "key1" || keys[1] != "key2" || keys[2] != "key1" {
+		t.Fatalf("Expected to decode keys [key1 key2 key1] but got %v: %q", keys, err)
+	}
+
+	for _, expected := range [][]bool{{}, {true}, {false, true, false, false, true, true, false, true}, {true, false, false, false, false, false, false, false, true}} {
+		response := protocol.EncodeMExistsResponse(expected)
+		if len(response) != 4+len("|MEXISTS")+6+(len(expected)+7)/8 {
+			t.Fatalf("Expected one bit per key but %d keys took a %d byte response", len(expected), len(response))
+		}
+
+		present, err := protocol.DecodeMExistsResponse(response, len(expected))
+		if err != nil || len(present) != len(expected) {
+			t.Fatalf("Expected to decode %v but got %v: %q", expected, present, err)
+		}
+		for i := range expected {
+			if present[i] != expected[i] {
+				t.Fatalf("Expected to decode %v but got %v", expected, present)
+			}
+		}
+	}
+
+	_, err = protocol.DecodeMExistsResponse(protocol.EncodeMExistsResponse([]bool{true, true}), 9)
+	if err == nil {
+		t.Fatalf("Expected an error decoding a bitmap too short for the keys requested")
+	}
+}
+
+func TestTypedErrorRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	err := protocol.DecodeError(protocol.EncodeErrResponse(NewError(KEYEXISTS, "key %q already exists", "key1")))
+	if !errors.Is(err, ErrKeyExists) || errors.Is(err, ErrKeyNotFound) || err.Error() != "key \"key1\" already exists" {
+		t.Fatalf("Expected a typed key exists error but got %q", err)
+	}
+
+	err = protocol.DecodeError(protocol.EncodeErrResponse(errors.New("plain failure")))
+	if errors.Is(err, ErrKeyExists) || errors.Is(err, ErrKeyNotFound) || err.Error() != "plain failure" {
+		t.Fatalf("Expected an untyped error but got %q", err)
+	}
+}
+
+func TestTimeRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	for _, sent := range []time.Time{time.Now(), time.Date(2024, 2, 29, 23, 59, 59, 123456789, time.FixedZone("", -7*60*60)), {}} {
+		decoded, err := protocol.DecodeTime(protocol.EncodeTime(sent))
+		if err != nil || !decoded.Equal(sent) {
+			t.Fatalf("Expected %s to round trip to the nanosecond but got %s: %q", sent, decoded, err)
+		}
+	}
+
+	// older peers encode times as unix timestamps in milliseconds
+	decoded, err := protocol.DecodeTime("1700000000500")
+	if err != nil || !decoded.Equal(time.UnixMilli(1700000000500)) {
+		t.Fatalf("Expected a millisecond timestamp to decode but got %s: %q", decoded, err)
+	}
+
+	for _, invalid := range []string{"", "soon", "2024-02-29"} {
+		if _, err = protocol.DecodeTime(invalid); err == nil {
+			t.Fatalf("Expected an error decoding the time %q", invalid)
+		}
+	}
+}
+
+func TestExportResponseRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	expiration := time.Now().Add(time.Hour).Round(0)
+	exported := []ExportedKey{
+		{Key: "region:1:store:1", Value: "abc123", Expiration: expiration},
+		{Key: "region:1:store:2", Value: ""},
+	}
+
+	decoded, err := protocol.DecodeExportResponse(protocol.EncodeExportResponse(exported))
+	if err != nil || len(decoded) != 2 || decoded[0] != exported[0] || decoded[1] != exported[1] {
+		t.Fatalf("Expected to decode %v but got %v: %q", exported, decoded, err)
+	}
+
+	commandBytes, _ := protocol.EncodeMessage(EXPORT, "region:1:store:1", "abc123")
+	_, err = protocol.DecodeExportResponse(commandBytes)
+	if err == nil {
+		t.Fatalf("Expected an error decoding an incomplete export entry")
+	}
+}
+
+func TestReadResponseSegmentsMatchTheFrame(t *testing.T) {
+	protocol := Protocol{}
+
+	for _, value := range []string{"", "abc123", "a|b|c", strings.Repeat("x", 1<<20)} {
+		segmented := bytes.Join(protocol.EncodeReadResponseSegments(value, true), nil)
+		if !bytes.Equal(segmented, protocol.EncodeReadResponse(value, true)) {
+			t.Fatalf("Expected the segments for a %d byte value to match the single frame", len(value))
+		}
+
+		decoded, err := protocol.DecodeReadResponse(segmented)
+		if err != nil || decoded != value {
+			t.Fatalf("Expected to decode the %d byte value but got %d bytes: %q", len(value), len(decoded), err)
+		}
+	}
+
+	null := bytes.Join(protocol.EncodeReadResponseSegments("", false), nil)
+	if !bytes.Equal(null, protocol.EncodeNullResponse()) {
+		t.Fatalf("Expected a missing value to encode as NULL but got %q", null)
+	}
+}
+
+// encoded keeps benchmark results alive so the encoding is not optimised away
+var encoded net.Buffers
+
+func BenchmarkEncodeReadResponse(b *testing.B) {
+	protocol := Protocol{}
+
+	for _, size := range []int{1 << 20, 10 << 20} {
+		value := strings.Repeat("a", size)
+
+		b.Run(fmt.Sprintf("Frame/%dMB", size>>20), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoded = net.Buffers{protocol.EncodeReadResponse(value, true)}
+			}
+		})
+
+		b.Run(fmt.Sprintf("Segments/%dMB", size>>20), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoded = protocol.EncodeReadResponseSegments(value, true)
+			}
+		})
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(HSET, "key", "field", "value")
+	key, field, value, err := protocol.DecodeHSet(request)
+	if err != nil || key != "key" || field != "field" || value != "value" {
+		t.Fatalf("Expected the key, field, and value but found %q %q %q: %q", key, field, value, err)
+	}
+
+	value, err = protocol.DecodeHGetResponse(protocol.EncodeHGetResponse("", true))
+	if err != nil || value != "" {
+		t.Fatalf("Expected an empty field value but found %q: %q", value, err)
+	}
+
+	// fields are sent as name and value pairs, sorted by name
+	golden := "\x27\x00\x00\x00|HGETALL|\x01\x00\x00\x00|a|\x01\x00\x00\x00|1|\x01\x00\x00\x00|b|\x00\x00\x00\x00|"
+	frames := protocol.EncodeHGetAllResponseFrames(map[string]string{"b": "", "a": "1"}, 1024)
+	if len(frames) != 1 || string(frames[0]) != golden {
+		t.Fatalf("Expected the frame %q but got %q", golden, frames)
+	}
+
+	fields := map[string]string{}
+	for i := 0; i < 100; i++ {
+		fields[fmt.Sprintf("field:%03d", i)] = strings.Repeat("v", i)
+	}
+	frames = protocol.EncodeHGetAllResponseFrames(fields, 256)
+	var continued []string
+	for _, frame := range frames[:len(frames)-1] {
+		command, arguments, err := protocol.DecodeContinued(frame)
+		if err != nil || command != HGETALL || len(frame) > 256 {
+			t.Fatalf("Expected a CONTINUED frame of an HGETALL response within the limit but got %q: %q", frame, err)
+		}
+		continued = append(continued, arguments...)
+	}
+	joined, err := protocol.JoinResponse(continued, frames[len(frames)-1])
+	if err != nil {
+		t.Fatalf("Error joining the frames %q", err)
+	}
+	decoded, err := protocol.DecodeHGetAllResponse(joined)
+	if err != nil || len(decoded) != len(fields) || decoded["field:099"] != fields["field:099"] {
+		t.Fatalf("Expected the fields to survive being split across %d frames but found %d: %q", len(frames), len(decoded), err)
+	}
+}
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	sent := Capabilities{ProtocolVersion: 2, ServerVersion: "1.4.0", Flags: []Capability{CapabilityAuth, "from-the-future"}}
+	received, err := protocol.DecodeCapabilitiesResponse(protocol.EncodeCapabilitiesResponse(sent))
+	if err != nil || received.ProtocolVersion != 2 || received.ServerVersion != "1.4.0" || len(received.Flags) != 2 {
+		t.Fatalf("Expected the capabilities back but found %+v: %q", received, err)
+	}
+	if !received.Has(CapabilityAuth) || !received.Has("from-the-future") || received.Has(CapabilityHashes) {
+		t.Fatalf("Expected exactly the flags sent, unknown ones included, but found %v", received.Flags)
+	}
+
+	received, err = protocol.DecodeCapabilitiesResponse(protocol.EncodeCapabilitiesResponse(Capabilities{ProtocolVersion: 1}))
+	if err != nil || received.Flags == nil || len(received.Flags) != 0 {
+		t.Fatalf("Expected no flags but found %v: %q", received.Flags, err)
+	}
+
+	truncated, _ := protocol.EncodeMessage(CAPABILITIES, "2")
+	if _, err := protocol.DecodeCapabilitiesResponse(truncated); err == nil {
+		t.Fatalf("Expected a response without a server version to be refused")
+	}
+}
+
+func TestInsertManyRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(INSERTMANY, "a", "1", "b", "")
+	keys, values, err := protocol.DecodeInsertMany(request)
+	if err != nil || len(keys) != 2 || keys[1] != "b" || values[0] != "1" || values[1] != "" {
+		t.Fatalf("Expected the keys and values back but found %v %v: %q", keys, values, err)
+	}
+
+	request, _ = protocol.EncodeMessage(INSERTMANY, "a", "1", "b")
+	if _, _, err := protocol.DecodeInsertMany(request); err == nil {
+		t.Fatalf("Expected a key without a value to be refused")
+	}
+
+	inserted, err := protocol.DecodeInsertManyResponse(protocol.EncodeInsertManyResponse(2))
+	if err != nil || inserted != 2 {
+		t.Fatalf("Expected 2 inserted keys but found %d: %q", inserted, err)
+	}
+}
+
+func TestEventRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	request, _ := protocol.EncodeMessage(WATCH, "orders:", "500")
+	prefix, heartbeat, err := protocol.DecodeWatch(request)
+	if err != nil || prefix != "orders:" || heartbeat != time.Millisecond*500 {
+		t.Fatalf("Expected the prefix and heartbeat back but found %q %s: %q", prefix, heartbeat, err)
+	}
+	request, _ = protocol.EncodeMessage(WATCH, "")
+	if prefix, heartbeat, err = protocol.DecodeWatch(request); err != nil || prefix != "" || heartbeat != 0 {
+		t.Fatalf("Expected a WATCH without a heartbeat to leave it to the server but found %q %s: %q", prefix, heartbeat, err)
+	}
+
+	expiration := time.Now().Add(time.Hour).Round(0)
+	for _, sent := range []Change{
+		{Sequence: 7, Operation: "insert", Key: "orders:1", Value: "a|b\x00"},
+		{Sequence: 8, Operation: "expire", Key: "orders:1", Expiration: expiration},
+		{Sequence: 9, Operation: "hset", Key: "orders:2", Field: "status", Value: ""},
+	} {
+		received, err := protocol.DecodeEvent(protocol.EncodeEvent(sent))
+		if err != nil || received != sent {
+			t.Fatalf("Expected %+v back but found %+v: %q", sent, received, err)
+		}
+	}
+
+	truncated, _ := protocol.EncodeMessage(EVENT, "1", "insert", "key")
+	if _, err := protocol.DecodeEvent(truncated); err == nil {
+		t.Fatalf("Expected an EVENT frame missing arguments to be refused")
+	}
+}
+
+func TestReadManyTellsEmptyValuesFromMissingKeys(t *testing.T) {
+	protocol := Protocol{}
+
+	golden := "\x28\x00\x00\x00|READMANY|\x01\x00\x00\x00|a|\x00\x00\x00\x00||\x01\x00\x00\x00|b|\x01\x00\x00\x00|2"
+	frames := protocol.EncodeReadManyResponseFrames(map[string]string{"b": "2", "a": ""}, 1024)
+	if len(frames) != 1 || string(frames[0]) != golden {
+		t.Fatalf("Expected the frame %q but got %q", golden, frames)
+	}
+
+	values, err := protocol.DecodeReadManyResponse(frames[0])
+	if err != nil || len(values) != 2 || values["b"] != "2" {
+		t.Fatalf("Expected both keys back but found %v: %q", values, err)
+	}
+	if value, present := values["a"]; !present || value != "" {
+		t.Fatalf("Expected the key holding the empty string to be present")
+	}
+
+	values, err = protocol.DecodeReadManyResponse(protocol.EncodeReadManyResponseFrames(map[string]string{}, 1024)[0])
+	if err != nil || values == nil || len(values) != 0 {
+		t.Fatalf("Expected no keys but found %v: %q", values, err)
+	}
+}
+
+func FuzzEncodeMessageRoundTrip(f *testing.F) {
+	f.Add("", "", []byte{})
+	f.Add("|", "||", []byte("|\x00\x00\x00|"))
+	f.Add("user|1", "|INSERT|", []byte{0x7C, 0x04, 0x00, 0x00, 0x00, 0x7C})
+	f.Add("héllo|wörld", "日本|語", []byte("\xff\xfe|"))
+
+	protocol := Protocol{}
+	f.Fuzz(func(t *testing.T, key string, value string, extra []byte) {
+		for _, arguments := range [][]string{{}, {key}, {key, value}, {key, value, string(extra)}} {
+			message, err := protocol.EncodeMessage(INSERT, arguments...)
+			if err != nil {
+				t.Fatalf("Expected %q to encode but got %q", arguments, err)
+			}
+
+			command, decoded, err := protocol.DecodeFrame(message)
+			if err != nil || command != INSERT || !reflect.DeepEqual(decoded, arguments) {
+				t.Fatalf("Expected INSERT %q to round trip but got %s %q: %q", arguments, command, decoded, err)
+			}
+		}
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	protocol := Protocol{}
+	for _, arguments := range [][]string{{}, {"key"}, {"|", "a|b"}, {"", "|\x04\x00\x00\x00|"}} {
+		message, _ := protocol.EncodeMessage(INSERT, arguments...)
+		f.Add(message)
+	}
+	f.Add(protocol.EncodeErrResponse(errors.New("key|missing")))
+	f.Add([]byte{0x7C, 0x7C, 0x7C, 0x7C, 0x7C, 0x7C})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		command, arguments, err := protocol.DecodeFrame(frame)
+		if err != nil {
+			return
+		}
+
+		// only frames laid out exactly as EncodeMessage would are decoded, so encoding them again gives them back
+		message, _ := protocol.EncodeMessage(command, arguments...)
+		if !bytes.Equal(message, frame) {
+			t.Fatalf("Expected %q to decode only if it is how %s %q is encoded, which is %q", frame, command, arguments, message)
+		}
+	})
+}
+
+func TestMultiRoundTrip(t *testing.T) {
+	protocol := Protocol{}
+
+	insert, _ := protocol.EncodeMessage(INSERT, "orders:1", "a|b\x00")
+	deleteCommand, _ := protocol.EncodeMessage(DELETE, "orders:0")
+	request, _ := protocol.EncodeMulti([][]byte{insert, deleteCommand})
+	commands, err := protocol.DecodeMulti(request)
+	if err != nil || len(commands) != 2 || !bytes.Equal(commands[0], insert) || !bytes.Equal(commands[1], deleteCommand) {
+		t.Fatalf("Expected the frames of both commands back but found %q: %q", commands, err)
+	}
+	if key, value, err := protocol.DecodeInsert(commands[0]); err != nil || key != "orders:1" || value != "a|b\x00" {
+		t.Fatalf("Expected the carried INSERT to decode but found %q %q: %q", key, value, err)
+	}
+
+	read, _ := protocol.EncodeMessage(READ, "orders:1")
+	withRead, _ := protocol.EncodeMulti([][]byte{insert, read})
+	if _, err := protocol.DecodeMulti(withRead); err == nil {
+		t.Fatalf("Expected a MULTI carrying a READ to be refused")
+	}
+
+	responses := [][]byte{protocol.EncodeAckResponse(), protocol.EncodeNullResponse(), protocol.EncodeErrResponse(NewError(KEYNOTFOUND, "key %q not found", "orders:0"))}
+	decoded, err := protocol.DecodeMultiResponse(protocol.EncodeMultiResponse(responses), 3)
+	if err != nil || len(decoded) != 3 || !bytes.Equal(decoded[2], responses[2]) {
+		t.Fatalf("Expected the response frames back but found %q: %q", decoded, err)
+	}
+	if _, err := protocol.DecodeMultiResponse(protocol.EncodeMultiResponse(responses), 2); err == nil {
+		t.Fatalf("Expected a MULTI response with a response too many to be refused")
+	}
+}